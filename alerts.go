@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/alert"
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The default number of consecutive failed OBM operations after which to
+// alert; see AlertsConfig.Threshold.
+const defaultAlertThreshold = 3
+
+// How many alerts may be waiting to be sent; more are dropped.
+const alertQueueSize = 64
+
+// Watches the outcome of OBM operations, alerting operators when a node's
+// OBM fails too many times in a row (e.g. because its BMC is dead or
+// unreachable), and again once it recovers. Alerts are sent in the
+// background, to the destinations in the current config's Alerts.
+type alerter struct {
+	config *LiveConfig
+	send   func(context.Context, alert.Config, alert.Message) error
+	queue  chan alert.Message
+	log    *logger.Logger
+
+	mu       sync.Mutex
+	failures map[string]int // consecutive failures, by node label.
+}
+
+func newAlerter(config *LiveConfig) *alerter {
+	a := &alerter{
+		config:   config,
+		send:     alert.Send,
+		queue:    make(chan alert.Message, alertQueueSize),
+		log:      logger.With("subsystem", "alerts"),
+		failures: make(map[string]int),
+	}
+	go a.run()
+	return a
+}
+
+// Send queued alerts, forever.
+func (a *alerter) run() {
+	for msg := range a.queue {
+		cfg := a.config.Get().Alerts.Config()
+		if err := a.send(context.Background(), cfg, msg); err != nil {
+			a.log.Error("Error sending alert", "subject", msg.Subject, "err", err)
+		}
+	}
+}
+
+// Report whether err, returned by an OBM operation, indicates a problem
+// with the OBM, rather than with the request, the node's registration or
+// the daemon's own state (e.g. a node being drained).
+func isOBMFailure(err error) bool {
+	switch err {
+	case nil, context.Canceled,
+		// Nodes and tokens:
+		obmd.ErrNoSuchNode, obmd.ErrNodeExists, obmd.ErrInvalidToken, obmd.ErrVersionMismatch,
+		obmd.ErrNodeQuarantined, obmd.ErrNodeInMaintenance, obmd.ErrNodeDraining,
+		obmd.ErrShuttingDown, obmd.ErrNoSuchConsole,
+		// Requests the daemon refuses itself:
+		obmd.ErrInvalidShutdownTimeout, obmd.ErrWatchdogTimeoutTooShort,
+		obmd.ErrPolicyUnavailable,
+		obmd.ErrNoPendingPassword, obmd.ErrPasswordPending,
+		obmd.ErrNoSuchPowerGroup, obmd.ErrNodeInPowerGroup, obmd.ErrInvalidPowerBudget,
+		obmd.ErrInvalidGroupName, obmd.ErrGroupPowerLimit,
+		obmd.ErrNoSuchRollout, obmd.ErrNoSuchImage,
+		obmd.ErrNoSuchPDU, obmd.ErrNoSuchOutlet, obmd.ErrInvalidOutletName, obmd.ErrOutletNotSwitchable,
+		// Requests the driver refuses without asking the OBM:
+		driver.ErrUnknownType, driver.ErrInvalidBootdev, driver.ErrNotSupported,
+		driver.ErrInvalidPassword, driver.ErrInvalidPowerRestorePolicy,
+		driver.ErrInvalidWatchdogTimeout, driver.ErrNoConsole, driver.ErrConsoleInUse:
+		return false
+	}
+	switch err.(type) {
+	case obmd.PowerCycleRateError, obmd.PolicyDeniedError, obmd.InvalidLabelError,
+		driver.UnsupportedError, *driver.InvalidInfoError:
+		return false
+	}
+	return true
+}
+
+// Record the outcome of an OBM operation on the node `label`.
+func (a *alerter) observe(label string, err error) {
+	if err != nil && !isOBMFailure(err) {
+		return
+	}
+	cfg := a.config.Get().Alerts
+	threshold := cfg.Threshold
+	if threshold == 0 {
+		threshold = defaultAlertThreshold
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := a.failures[label]
+	if err == nil {
+		delete(a.failures, label)
+		if n >= threshold {
+			a.alert(cfg, alert.Message{
+				Subject: fmt.Sprintf("obmd: OBM of node %s recovered", label),
+				Body: fmt.Sprintf("An operation on node %s's OBM succeeded, "+
+					"after %d consecutive failures.", label, n),
+			})
+		}
+		return
+	}
+	n++
+	a.failures[label] = n
+	if n == threshold {
+		a.alert(cfg, alert.Message{
+			Subject: fmt.Sprintf("obmd: OBM of node %s is failing", label),
+			Body: fmt.Sprintf("The last %d operations on node %s's OBM failed; "+
+				"the BMC may be down or unreachable. The last error was:\n\n%v",
+				n, label, err),
+		})
+	}
+}
+
+// Alert operators that the node `label` has reported a critical hardware
+// fault (as described by desc, e.g. "a power supply failure") in its event
+// log.
+func (a *alerter) hardwareFault(label, desc string, e driver.EventLogEntry) {
+	body := fmt.Sprintf("Node %s's event log reports %s: %s: %s (record %d).",
+		label, desc, e.Sensor, e.Event, e.ID)
+	if !e.Time.IsZero() {
+		body += fmt.Sprintf("\n\nThe OBM logged it at %s.", e.Time.Format(time.RFC3339))
+	}
+	a.alert(a.config.Get().Alerts, alert.Message{
+		Subject: fmt.Sprintf("obmd: node %s reported %s", label, desc),
+		Body:    body,
+	})
+}
+
+// Forget about the node `label`, e.g. because it was deleted.
+func (a *alerter) forget(label string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.failures, label)
+}
+
+// Carry over what we know about the node `label` to newLabel, which it has
+// been renamed to.
+func (a *alerter) rename(label, newLabel string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n, ok := a.failures[label]; ok {
+		delete(a.failures, label)
+		a.failures[newLabel] = n
+	}
+}
+
+// Queue msg for sending, if there is anywhere to send it.
+func (a *alerter) alert(cfg AlertsConfig, msg alert.Message) {
+	a.log.Warn(msg.Subject)
+	if !cfg.Config().Enabled() {
+		return
+	}
+	select {
+	case a.queue <- msg:
+	default:
+		a.log.Error("Alert queue is full; dropping alert", "subject", msg.Subject)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Write a consistent snapshot of the database to w. dbType and dbPath are
+// as in the config file.
+//
+// For sqlite, the snapshot is a complete sqlite database file. For postgres,
+// it is the (plain text) output of pg_dump.
+func backupDB(db *sql.DB, dbType, dbPath string, w io.Writer) error {
+	switch dbType {
+	case "sqlite3":
+		return backupSqlite(db, w)
+	case "postgres":
+		return backupPostgres(dbPath, w)
+	default:
+		return obmd.ErrBackupUnsupported
+	}
+}
+
+// Back up an sqlite database. We have sqlite write the snapshot to a
+// temporary file via VACUUM INTO, which is safe to run against a live
+// database, and then copy that file to w.
+func backupSqlite(db *sql.DB, w io.Writer) error {
+	dir, err := ioutil.TempDir("", "obmd-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "obmd.db")
+	_, err = db.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Back up a postgres database by shelling out to pg_dump. dbPath is passed
+// to pg_dump as a connection string, except for any password, which is
+// passed in the environment (PGPASSWORD), so that other local users can't
+// read it from the command line.
+func backupPostgres(dbPath string, w io.Writer) error {
+	var stderr bytes.Buffer
+	dsn, password := splitPostgresPassword(dbPath)
+	cmd := exec.Command("pg_dump", "--dbname", dsn)
+	if password != "" {
+		cmd.Env = append(os.Environ(), "PGPASSWORD="+password)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("pg_dump: %v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// A password in a key/value connection string: the value is either
+// single-quoted (with backslash escapes) or runs up to whitespace.
+var dsnPassword = regexp.MustCompile(`(^|\s)password\s*=\s*('(?:[^'\\]|\\.)*'|\S*)`)
+
+// Split a postgres connection string, in either URL or key/value form,
+// into the string without its password, and the password ("" if none).
+func splitPostgresPassword(dsn string) (string, string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn, ""
+		}
+		var password string
+		if u.User != nil {
+			password, _ = u.User.Password()
+			u.User = url.User(u.User.Username())
+		}
+		query := u.Query()
+		if p := query.Get("password"); p != "" {
+			password = p
+			query.Del("password")
+			u.RawQuery = query.Encode()
+		}
+		return u.String(), password
+	}
+	m := dsnPassword.FindStringSubmatchIndex(dsn)
+	if m == nil {
+		return dsn, ""
+	}
+	password := dsn[m[4]:m[5]]
+	if strings.HasPrefix(password, "'") {
+		password = strings.TrimSuffix(password[1:], "'")
+		password = strings.NewReplacer(`\'`, "'", `\\`, `\`).Replace(password)
+	}
+	return strings.TrimSpace(dsn[:m[0]] + dsn[m[1]:]), password
+}
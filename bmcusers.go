@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"math/big"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Characters used in generated passwords. These are safe to pass through
+// any driver's tooling without quoting.
+const passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// Length of generated passwords. This fits within IPMI 1.5's limit.
+const passwordLen = 16
+
+// Generate a random password.
+func randomPassword() (string, error) {
+	buf := make([]byte, passwordLen)
+	max := big.NewInt(int64(len(passwordChars)))
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		buf[i] = passwordChars[n.Int64()]
+	}
+	return string(buf), nil
+}
+
+// Return a copy of the stored info for a node (as accepted by
+// driver.Registry), with its driver-specific "info" field replaced.
+func replaceDriverInfo(stored, info []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(stored, &fields); err != nil {
+		return nil, err
+	}
+	fields["info"] = json.RawMessage(info)
+	return json.Marshal(fields)
+}
+
+// List the user accounts on the node's OBM; see driver.UserManager. This is
+// an admin operation, so needs no token.
+func (d *LocalDaemon) NodeBMCUsers(ctx context.Context, label string) (users []driver.User, err error) {
+	err = d.withOBM(ctx, label, nil, func(ctx context.Context, node *Node) error {
+		m, ok := node.OBM.(driver.UserManager)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		users, err = m.Users(ctx)
+		return err
+	})
+	return users, err
+}
+
+// Create the table of passwords which nodes' OBMs may have been given,
+// but which haven't been stored in their info yet, if it doesn't exist.
+func createPendingPasswords(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS pending_passwords (
+		label VARCHAR(80) PRIMARY KEY,
+		password TEXT NOT NULL
+	)`)
+	return err
+}
+
+// Record that the node's OBM is about to be given `password`. It is
+// forgotten when the node's info is next updated, or on ClearPendingPassword.
+func (s *State) SetPendingPassword(label, password string) error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM pending_passwords WHERE label = $1`, label)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO pending_passwords(label, password) VALUES ($1, $2)`, label, password)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	return err
+}
+
+// Forget the node's pending password, if any.
+func (s *State) ClearPendingPassword(label string) error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM pending_passwords WHERE label = $1`, label)
+	return err
+}
+
+// Return the node's pending password, or ErrNoPendingPassword if it has
+// none.
+func (s *State) PendingPassword(label string) (string, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	var password string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT password FROM pending_passwords WHERE label = $1`, label).Scan(&password)
+	if err == sql.ErrNoRows {
+		return "", obmd.ErrNoPendingPassword
+	}
+	return password, err
+}
+
+// Change the password the node's OBM logs in with (see
+// driver.UserManager), generating a random one if password is "". Once the
+// OBM has accepted the new password, the node's stored info is updated to
+// match, which restarts its OBM (disconnecting any console sessions), but
+// keeps its token. Returns the new password.
+//
+// The new password is stored as pending before the OBM is given it, so
+// that it can't be lost if a later step fails (or obmd dies); see
+// PendingNodePassword. While a node has a pending password, this retries
+// with it (password must be "" or the same), and returns
+// ErrPasswordPending otherwise.
+func (d *LocalDaemon) ChangeNodePassword(ctx context.Context, label, password string) (string, error) {
+	generated := password == ""
+	if generated {
+		var err error
+		if password, err = randomPassword(); err != nil {
+			return "", err
+		}
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return "", obmd.ErrShuttingDown
+	}
+	// Hold the label's mutation lock as well as the node's lock throughout,
+	// so that the node can't be deleted or re-registered between its OBM
+	// accepting the new password and the password being stored.
+	unlock := d.state.mutations.lock(label)
+	defer unlock()
+	node, err := d.lockNode(ctx, label)
+	if err != nil {
+		return "", err
+	}
+	defer node.Unlock()
+	pending, err := d.state.PendingPassword(label)
+	switch {
+	case err == nil && !generated && password != pending:
+		return "", obmd.ErrPasswordPending
+	case err == nil:
+		password = pending
+	case err != obmd.ErrNoPendingPassword:
+		return "", err
+	}
+	node.acquireOBM()
+	defer node.releaseOBM()
+	err = d.changePassword(nodeLogContext(ctx, label, node), label, node, password)
+	if d.alerts != nil {
+		d.alerts.observe(label, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// Do the work of ChangeNodePassword, with the locks held.
+func (d *LocalDaemon) changePassword(ctx context.Context, label string, node *Node, password string) error {
+	m, ok := node.OBM.(driver.UserManager)
+	if !ok {
+		return driver.ErrNotSupported
+	}
+	log := logger.FromContext(ctx)
+	if err := d.state.SetPendingPassword(label, password); err != nil {
+		return err
+	}
+	driverInfo, err := m.ChangePassword(ctx, password)
+	if err == driver.ErrInvalidPassword {
+		// Rejected before the OBM was touched.
+		d.state.ClearPendingPassword(label)
+		return err
+	} else if err != nil {
+		log.Error("Failed to change the password of a node's OBM; "+
+			"it may have the pending password", "err", err)
+		return err
+	}
+	info, err := replaceDriverInfo(node.ConnInfo, driverInfo)
+	if err == nil && sameJSON(node.ConnInfo, info) {
+		// e.g. the shard driver, where the worker stores the password.
+		return d.state.ClearPendingPassword(label)
+	}
+	if err == nil {
+		err = d.state.replaceNodeInfo(label, node, info)
+	}
+	if err != nil {
+		log.Error("Failed to store the new password for a node's OBM; "+
+			"it is kept as pending", "err", err)
+		return err
+	}
+	d.publish("node_updated", label, nil)
+	return nil
+}
+
+// Return the password the node's OBM may have been given by an unfinished
+// call to ChangeNodePassword, or ErrNoPendingPassword if there is none.
+// This is an admin operation.
+func (d *LocalDaemon) PendingNodePassword(label string) (string, error) {
+	if _, err := d.state.GetNode(label); err != nil && err != obmd.ErrNodeQuarantined {
+		return "", err
+	}
+	return d.state.PendingPassword(label)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A client for obmd's api.
+type client struct {
+	base       string // e.g. "https://obmd.example.com:8080", without a trailing slash.
+	adminToken string
+	token      string // the node token for "regular user" calls.
+	http       *http.Client
+}
+
+// Which credentials a call needs.
+type auth int
+
+const (
+	adminAuth auth = iota
+	tokenAuth
+)
+
+// Build a request for the api call `method path`, with the given query
+// parameters (which may be nil) and body (which may be nil).
+func (c *client) request(method, path string, as auth, query url.Values, body io.Reader) (*http.Request, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	switch as {
+	case adminAuth:
+		if c.adminToken == "" {
+			return nil, fmt.Errorf("This needs the admin token; see -admin-token.")
+		}
+	case tokenAuth:
+		if c.token == "" {
+			return nil, fmt.Errorf("This needs a node token; see -token.")
+		}
+		query.Set("token", c.token)
+	}
+	u := c.base + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if as == adminAuth {
+		req.SetBasicAuth("admin", c.adminToken)
+	}
+	return req, nil
+}
+
+// Make an api call, sending `in` (if not nil) as its JSON body, and
+// decoding the JSON response into `out` (if not nil).
+func (c *client) call(method, path string, as auth, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	resp, err := c.stream(method, path, as, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Make an api call, returning the response for the caller to read (and
+// close) its body. Responses other than 200 are returned as errors.
+func (c *client) stream(method, path string, as auth, query url.Values, body io.Reader) (*http.Response, error) {
+	req, err := c.request(method, path, as, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, statusError(req, resp)
+	}
+	return resp, nil
+}
+
+// Return an error describing an unsuccessful response. The api only sends
+// status codes, so we explain the common ones.
+func statusError(req *http.Request, resp *http.Response) error {
+	msg := resp.Status
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		msg += " (no such node, or bad admin token)"
+	case http.StatusUnauthorized:
+		msg += " (invalid node token)"
+	case http.StatusConflict:
+		msg += " (node quarantined, or console busy/not connected)"
+	case http.StatusNotImplemented:
+		msg += " (not supported by this node's OBM)"
+	}
+	// Some calls (e.g. the debug endpoints) include a reason.
+	text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if s := strings.TrimSpace(string(text)); s != "" {
+		msg += ": " + s
+	}
+	return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, msg)
+}
+
+// Escape a node label for use in a path.
+func nodePath(label string, rest ...string) string {
+	parts := append([]string{"/node", url.PathEscape(label)}, rest...)
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	cases := []struct {
+		args, name, rest string
+	}{
+		{"node list", "node list", ""},
+		{"console -replay 4k node-23", "console", "-replay 4k node-23"},
+		{"console snapshot node-23", "console snapshot", "node-23"},
+		{"power cycle -force node-23", "power cycle", "-force node-23"},
+	}
+	for _, v := range cases {
+		name, _, rest, ok := findCommand(strings.Fields(v.args))
+		if !ok || name != v.name || strings.Join(rest, " ") != v.rest {
+			t.Errorf("%q: got (%q, %q, %v).", v.args, name, rest, ok)
+		}
+	}
+	if _, _, _, ok := findCommand([]string{"power", "on", "node-23"}); ok {
+		t.Error("Expected an unknown command not to be found.")
+	}
+}
+
+// Verify: admin calls use basic auth, node calls pass the token in the
+// query string, and errors report the status.
+func TestCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, pass, ok := req.BasicAuth()
+		switch req.URL.Path {
+		case "/node/node 23/token":
+			if !ok || pass != "admin-secret" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"token": "node-secret"}`))
+		case "/node/node 23/power_off":
+			if req.URL.Query().Get("token") != "node-secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	c := &client{base: srv.URL, http: http.DefaultClient}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := c.call("POST", nodePath("node 23", "token"), adminAuth, nil, &resp); err == nil {
+		t.Fatal("Expected an error without the admin token.")
+	}
+	c.adminToken = "admin-secret"
+	if err := c.call("POST", nodePath("node 23", "token"), adminAuth, nil, &resp); err != nil {
+		t.Fatal(err)
+	}
+	c.token = "bogus"
+	err := c.call("POST", nodePath("node 23", "power_off"), tokenAuth, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatal("Expected a 401 error, but got:", err)
+	}
+	c.token = resp.Token
+	if err = c.call("POST", nodePath("node 23", "power_off"), tokenAuth, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// The key which detaches from the console: Ctrl-], as with telnet. (The
+// usual "~." would be passed on to ipmitool's own console, and end it.)
+const detachKey = 0x1d
+
+// Stream a node's console to stdout, and send stdin to it, until the
+// console ends or the user presses detachKey. If stdin is a terminal, it
+// is put in raw mode meanwhile, so that keystrokes are sent as typed.
+func attachConsole(c *client, label, replay string) error {
+	query := url.Values{}
+	if replay != "" {
+		query.Set("replay", replay)
+	}
+	// The token goes in the query too; request adds it.
+	resp, err := c.stream("GET", nodePath(label, "console"), tokenAuth, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Fprintf(os.Stderr, "Connected to %s; press Ctrl-] to detach.\r\n", label)
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		done <- err
+	}()
+	go func() {
+		done <- sendInput(c, label, os.Stdin)
+	}()
+	err = <-done
+	fmt.Fprintf(os.Stderr, "\r\nDisconnected from %s.\r\n", label)
+	return err
+}
+
+// Send what is read from r to the node's console, until detachKey is read.
+// If the console doesn't accept input, say so, and just wait for
+// detachKey.
+func sendInput(c *client, label string, r io.Reader) error {
+	buf := make([]byte, 1024)
+	readOnly := false
+	for {
+		n, err := r.Read(buf)
+		data := buf[:n]
+		i := bytes.IndexByte(data, detachKey)
+		if i >= 0 {
+			data = data[:i]
+		}
+		if len(data) != 0 && !readOnly {
+			resp, errSend := c.stream("POST", nodePath(label, "console", "input"),
+				tokenAuth, nil, bytes.NewReader(data))
+			if errSend != nil {
+				fmt.Fprintf(os.Stderr, "\r\nCan't send input: %v\r\n", errSend)
+				readOnly = true
+			} else {
+				resp.Body.Close()
+			}
+		}
+		if i >= 0 || err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
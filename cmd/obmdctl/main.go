@@ -0,0 +1,460 @@
+// obmdctl is a command-line client for obmd's api. Run it with no
+// arguments for usage.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Defaults are taken from the environment after parsing, so that
+	// usage doesn't print the tokens.
+	baseURL = flag.String("url", "",
+		"Base url of the obmd server (default $OBMD_URL, or "+defaultURL+")")
+	adminToken = flag.String("admin-token", "",
+		"Admin token, for admin commands (default $OBMD_ADMIN_TOKEN)")
+	nodeToken = flag.String("token", "",
+		"Node token, for power, boot device and console commands (default $OBMD_TOKEN)")
+	caCert = flag.String("cacert", "",
+		"File with the CA certificate(s) to trust for https, instead of the system's")
+)
+
+const defaultURL = "http://localhost:8080"
+
+// Return value if it isn't empty, and otherwise the environment variable
+// `name`.
+func orEnv(value, name string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+// Indicates that a command was invoked incorrectly; usage is printed.
+var errUsage = errors.New("usage")
+
+// A subcommand. Its name may be several words, e.g. "node add".
+type command struct {
+	args string // description of the arguments, for usage.
+	help string
+	run  func(c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"node list": {"", "List the registered nodes.",
+		func(c *client, args []string) error {
+			if len(args) != 0 {
+				return errUsage
+			}
+			var resp struct {
+				Nodes []string `json:"nodes"`
+			}
+			if err := c.call("GET", "/node", adminAuth, nil, &resp); err != nil {
+				return err
+			}
+			for _, label := range resp.Nodes {
+				fmt.Println(label)
+			}
+			return nil
+		}},
+	"node quarantined": {"", "List quarantined nodes, with the reasons.",
+		func(c *client, args []string) error {
+			if len(args) != 0 {
+				return errUsage
+			}
+			var resp struct {
+				Nodes map[string]string `json:"nodes"`
+			}
+			if err := c.call("GET", "/quarantine", adminAuth, nil, &resp); err != nil {
+				return err
+			}
+			for _, label := range sortedKeys(resp.Nodes) {
+				fmt.Printf("%s\t%s\n", label, resp.Nodes[label])
+			}
+			return nil
+		}},
+	"node add": {"LABEL INFO", "Register a node. INFO is its JSON connection info, " +
+		"e.g. '{\"type\": \"ipmi\", \"info\": {...}}', or @FILE to read it from a file.",
+		func(c *client, args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			return putNode(c, args[0], args[1])
+		}},
+	"node update": {"LABEL INFO", "Replace a node's connection info (see node add). " +
+		"The api has no separate update call, so this deletes and re-adds the node, " +
+		"which invalidates its token.",
+		func(c *client, args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			if _, err := readInfo(args[1]); err != nil {
+				return err
+			}
+			if err := c.call("DELETE", nodePath(args[0]), adminAuth, nil, nil); err != nil {
+				return err
+			}
+			return putNode(c, args[0], args[1])
+		}},
+	"node delete": {"LABEL", "Unregister a node.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return c.call("DELETE", nodePath(args[0]), adminAuth, nil, nil)
+		}},
+	"node lan": {"LABEL", "Show the network configuration of a node's OBM.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return printJSON(c, nodePath(args[0], "lan"), adminAuth)
+		}},
+	"node users": {"LABEL", "List the user accounts on a node's OBM.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return printJSON(c, nodePath(args[0], "bmc_users"), adminAuth)
+		}},
+	"node password": {"LABEL [PASSWORD]", "Change the password obmd uses for " +
+		"a node's OBM, to a random one if none is given, and print it.",
+		func(c *client, args []string) error {
+			if len(args) != 1 && len(args) != 2 {
+				return errUsage
+			}
+			var in struct {
+				Password string `json:"password"`
+			}
+			if len(args) == 2 {
+				in.Password = args[1]
+			}
+			var out struct {
+				Password string `json:"password"`
+			}
+			err := c.call("POST", nodePath(args[0], "bmc_password"), adminAuth, &in, &out)
+			if err == nil {
+				fmt.Println(out.Password)
+			}
+			return err
+		}},
+	"token issue": {"LABEL", "Issue a new token for a node, invalidating " +
+		"the old one, and print it.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			var resp struct {
+				Token string `json:"token"`
+			}
+			err := c.call("POST", nodePath(args[0], "token"), adminAuth, nil, &resp)
+			if err == nil {
+				fmt.Println(resp.Token)
+			}
+			return err
+		}},
+	"token revoke": {"LABEL", "Invalidate a node's token.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return c.call("DELETE", nodePath(args[0], "token"), adminAuth, nil, nil)
+		}},
+	"power off": {"LABEL", "Power off a node.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return c.call("POST", nodePath(args[0], "power_off"), tokenAuth, nil, nil)
+		}},
+	"power shutdown": {"[-timeout DURATION] LABEL", "Ask a node's operating " +
+		"system to shut down. With -timeout, power it off if it is still on after that long.",
+		func(c *client, args []string) error {
+			fs := flag.NewFlagSet("power shutdown", flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+			timeout := fs.Duration("timeout", 0, "")
+			if fs.Parse(args) != nil || fs.NArg() != 1 {
+				return errUsage
+			}
+			in := struct {
+				Timeout string `json:"timeout"`
+			}{timeout.String()}
+			return c.call("POST", nodePath(fs.Arg(0), "shutdown"), tokenAuth, &in, nil)
+		}},
+	"power cycle": {"[-force] LABEL", "Reboot a node, or power it on if it is " +
+		"off. With -force, don't give its operating system a chance to shut down.",
+		func(c *client, args []string) error {
+			fs := flag.NewFlagSet("power cycle", flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+			force := fs.Bool("force", false, "")
+			if fs.Parse(args) != nil || fs.NArg() != 1 {
+				return errUsage
+			}
+			in := struct {
+				Force bool `json:"force"`
+			}{*force}
+			return c.call("POST", nodePath(fs.Arg(0), "power_cycle"), tokenAuth, &in, nil)
+		}},
+	"power status": {"LABEL", "Print whether a node is on or off.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			var resp struct {
+				Power string `json:"power"`
+			}
+			err := c.call("GET", nodePath(args[0], "power_status"), tokenAuth, nil, &resp)
+			if err == nil {
+				fmt.Println(resp.Power)
+			}
+			return err
+		}},
+	"power reading": {"LABEL", "Show a node's power consumption.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return printJSON(c, nodePath(args[0], "power_reading"), tokenAuth)
+		}},
+	"power limit": {"LABEL WATTS", "Cap a node's power consumption; 0 removes the cap.",
+		func(c *client, args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			watts, err := strconv.Atoi(args[1])
+			if err != nil {
+				return errUsage
+			}
+			in := struct {
+				Watts int `json:"watts"`
+			}{watts}
+			return c.call("PUT", nodePath(args[0], "power_limit"), tokenAuth, &in, nil)
+		}},
+	"bootdev": {"LABEL DEVICE", "Set a node's boot device.",
+		func(c *client, args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			in := struct {
+				Dev string `json:"bootdev"`
+			}{args[1]}
+			return c.call("PUT", nodePath(args[0], "boot_device"), tokenAuth, &in, nil)
+		}},
+	"capabilities": {"LABEL", "Show what a node's OBM supports, e.g. boot devices.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return printJSON(c, nodePath(args[0], "capabilities"), tokenAuth)
+		}},
+	"console": {"[-replay BYTES] LABEL", "Attach the terminal to a node's console. " +
+		"Press Ctrl-] to detach.",
+		func(c *client, args []string) error {
+			fs := flag.NewFlagSet("console", flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+			replay := fs.String("replay", "", "")
+			if fs.Parse(args) != nil || fs.NArg() != 1 {
+				return errUsage
+			}
+			return attachConsole(c, fs.Arg(0), *replay)
+		}},
+	"console snapshot": {"LABEL", "Print a node's recent console output.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			resp, err := c.stream("GET", nodePath(args[0], "console", "snapshot"),
+				tokenAuth, nil, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			_, err = io.Copy(os.Stdout, resp.Body)
+			return err
+		}},
+	"console sessions": {"", "List the open console connections.",
+		func(c *client, args []string) error {
+			if len(args) != 0 {
+				return errUsage
+			}
+			return printJSON(c, "/console", adminAuth)
+		}},
+	"console disconnect": {"ID", "Close a console connection, as listed by " +
+		"console sessions.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			return c.call("DELETE", "/console/"+url.PathEscape(args[0]), adminAuth, nil, nil)
+		}},
+	"backup": {"FILE", "Save a backup of the database to FILE.",
+		func(c *client, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			resp, err := c.stream("GET", "/backup", adminAuth, nil, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err = io.Copy(f, resp.Body); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}},
+}
+
+// Register a node, with info as accepted by readInfo.
+func putNode(c *client, label, info string) error {
+	data, err := readInfo(info)
+	if err != nil {
+		return err
+	}
+	resp, err := c.stream("PUT", nodePath(label), adminAuth, nil, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Return the node info given on the command line: either JSON, or @FILE.
+// It is checked for being valid JSON here, for a clearer error message.
+func readInfo(arg string) (json.RawMessage, error) {
+	data := []byte(arg)
+	if strings.HasPrefix(arg, "@") {
+		var err error
+		if data, err = ioutil.ReadFile(arg[1:]); err != nil {
+			return nil, err
+		}
+	}
+	var info json.RawMessage
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("Invalid node info: %v", err)
+	}
+	return info, nil
+}
+
+// GET path, and print the JSON response, indented.
+func printJSON(c *client, path string, as auth) error {
+	var resp interface{}
+	if err := c.call("GET", path, as, nil, &resp); err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(resp, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] COMMAND [ARGS...]\n\nCommands:\n",
+		os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %s\n        %s\n",
+			strings.TrimSpace(name+" "+cmd.args), cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// Find the command named by the start of args (preferring the longest
+// name), returning it and the remaining arguments.
+func findCommand(args []string) (name string, cmd command, rest []string, ok bool) {
+	for n := len(args); n > 0; n-- {
+		name = strings.Join(args[:n], " ")
+		if cmd, ok = commands[name]; ok {
+			return name, cmd, args[n:], true
+		}
+	}
+	return "", command{}, nil, false
+}
+
+// Make an http client, trusting the certificates in *caCert if set.
+func httpClient() (*http.Client, error) {
+	if *caCert == "" {
+		return http.DefaultClient, nil
+	}
+	pem, err := ioutil.ReadFile(*caCert)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s.", *caCert)
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}, nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	name, cmd, args, ok := findCommand(flag.Args())
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	httpc, err := httpClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	base := orEnv(*baseURL, "OBMD_URL")
+	if base == "" {
+		base = defaultURL
+	}
+	c := &client{
+		base:       strings.TrimSuffix(base, "/"),
+		adminToken: orEnv(*adminToken, "OBMD_ADMIN_TOKEN"),
+		token:      orEnv(*nodeToken, "OBMD_TOKEN"),
+		http:       httpc,
+	}
+	err = cmd.run(c, args)
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] %s\n", os.Args[0],
+			strings.TrimSpace(name+" "+cmd.args))
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// Raw mode isn't supported here, so input is sent a line at a time, and
+// keys like Ctrl-C act locally.
+func makeRaw(f *os.File) (restore func(), err error) {
+	return func() {}, nil
+}
@@ -0,0 +1,43 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctlTermios(f *os.File, req uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req,
+		uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Put f in raw mode (like cfmakeraw(3)) if it is a terminal, returning a
+// function to restore its previous mode. If it isn't a terminal, this does
+// nothing.
+func makeRaw(f *os.File) (restore func(), err error) {
+	var old syscall.Termios
+	if ioctlTermios(f, ioctlGetTermios, &old) != nil {
+		return func() {}, nil
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG |
+		syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err = ioctlTermios(f, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return func() { ioctlTermios(f, ioctlSetTermios, &old) }, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+func TestEnvName(t *testing.T) {
+	cases := map[string]string{
+		"DBType":          "OBMD_DB_TYPE",
+		"DBKey":           "OBMD_DB_KEY",
+		"ListenAddr":      "OBMD_LISTEN_ADDR",
+		"AdminToken":      "OBMD_ADMIN_TOKEN",
+		"ConnMaxLifetime": "OBMD_CONN_MAX_LIFETIME",
+	}
+	for field, expected := range cases {
+		actual := envName(field)
+		if actual != expected {
+			t.Errorf("envName(%q): expected %q but got %q", field, expected, actual)
+		}
+	}
+}
+
+// Environment variables should override values from the file, and be parsed
+// according to the field's type.
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"OBMD_LISTEN_ADDR":       ":9090",
+		"OBMD_ADMIN_TOKEN":       "0123456789abcdef0123456789abcdef",
+		"OBMD_MAX_OPEN_CONNS":    "7",
+		"OBMD_INVENTORY_PRUNE":   "true",
+		"OBMD_OPERATION_TIMEOUT": "1m30s",
+		"OBMD_RETRIES":           `{"ipmi": {"Attempts": 3}}`,
+	}
+	config := Config{
+		DBType:     "sqlite3",
+		ListenAddr: ":8080",
+	}
+	err := config.applyEnv(func(name string) (string, bool) {
+		val, ok := env[name]
+		return val, ok
+	})
+	if err != nil {
+		t.Fatal("applyEnv:", err)
+	}
+
+	var token obmd.Token
+	errpanic((&token).UnmarshalText([]byte(env["OBMD_ADMIN_TOKEN"])))
+	if config.DBType != "sqlite3" ||
+		config.ListenAddr != ":9090" ||
+		config.AdminToken != token ||
+		config.MaxOpenConns != 7 ||
+		!config.InventoryPrune ||
+		config.OperationTimeout != obmd.Duration(90*time.Second) ||
+		config.Retries["ipmi"].Attempts != 3 {
+		t.Fatalf("Unexpected config after applying environment: %+v", config)
+	}
+
+	err = config.applyEnv(func(name string) (string, bool) {
+		return "not a number", name == "OBMD_MAX_OPEN_CONNS"
+	})
+	if err == nil {
+		t.Fatal("applyEnv accepted an invalid value.")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	good := *theConfig
+	if problems := good.Validate(); len(problems) != 0 {
+		t.Fatalf("Unexpected problems with valid config: %v", problems)
+	}
+
+	bad := good
+	bad.DBType = "mysql"
+	bad.AdminToken = obmd.Token{}
+	bad.QueryTimeout = obmd.Duration(-time.Second)
+	bad.LogLevel = "loud"
+	bad.VirtualBMCs = map[string]VirtualBMCConfig{
+		"node-1": {ListenAddr: "623", User: "admin"},
+	}
+	bad.DriverRoutes = []DriverRouteConfig{{Network: "10.20.0.0/16", Proxy: "ftp://proxy"}}
+	if problems := bad.Validate(); len(problems) != 7 {
+		t.Fatalf("Expected 7 problems with invalid config, but got: %v", problems)
+	}
+}
+
+// Settings which only take effect at startup should be reported when they
+// change.
+func TestRestartOnlyChanges(t *testing.T) {
+	prev := &Config{TCPKeepAlivePeriod: obmd.Duration(time.Minute)}
+	next := &Config{TCPKeepAlivePeriod: obmd.Duration(time.Hour)}
+	if changes := restartOnlyChanges(prev, next); len(changes) != 1 || changes[0] != "TCPKeepAlivePeriod" {
+		t.Fatalf("Unexpected restart-only changes: %q", changes)
+	}
+	if changes := restartOnlyChanges(prev, prev); len(changes) != 0 {
+		t.Fatalf("Unexpected restart-only changes to an unchanged config: %q", changes)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The most console audit records kept per node; older ones are deleted.
+const maxConsoleAudit = 10000
+
+// Create the console audit table, if it doesn't exist. Times are stored as
+// nanoseconds since the Unix epoch, as in the power history.
+func createConsoleAudit(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS console_audit (
+		id VARCHAR(32) PRIMARY KEY,
+		label VARCHAR(80) NOT NULL,
+		session VARCHAR(20) NOT NULL,
+		started BIGINT NOT NULL,
+		ended BIGINT,
+		token_hash VARCHAR(64) NOT NULL,
+		remote TEXT NOT NULL,
+		bytes BIGINT NOT NULL,
+		end_reason TEXT NOT NULL
+	)`)
+	if err == nil {
+		_, err = db.ExecContext(ctx,
+			`CREATE INDEX IF NOT EXISTS console_audit_label_started ON console_audit (label, started)`)
+	}
+	return err
+}
+
+// The end reason recorded for sessions which were still open when obmd
+// last stopped; see endDanglingConsoleAudit.
+const consoleEndRestarted = "obmd restarted"
+
+// Mark the sessions which were open when obmd last stopped as ended at
+// `now`, since no session survives a restart. Their byte counts aren't
+// known, so are left as 0.
+func endDanglingConsoleAudit(ctx context.Context, db *sql.DB, now time.Time) error {
+	_, err := db.ExecContext(ctx,
+		`UPDATE console_audit SET ended = $1, end_reason = $2 WHERE ended IS NULL`,
+		now.UnixNano(), consoleEndRestarted)
+	return err
+}
+
+// Record the start of a console session on the node `label`, returning
+// the record's ID. tokenHash is as for ConsoleAuditRecord.
+func (s *State) StartConsoleAudit(label, session string, started time.Time, tokenHash, remote string) (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf[:])
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO console_audit(id, label, session, started, token_hash, remote, bytes, end_reason)
+		VALUES ($1, $2, $3, $4, $5, $6, 0, '')`,
+		id, label, session, started.UnixNano(), tokenHash, remote)
+	if err == nil {
+		// Delete all but the latest maxConsoleAudit records:
+		_, err = s.db.ExecContext(ctx, `
+			DELETE FROM console_audit WHERE label = $1 AND started < (
+				SELECT started FROM console_audit WHERE label = $2
+				ORDER BY started DESC LIMIT 1 OFFSET $3
+			)`, label, label, maxConsoleAudit-1)
+	}
+	return id, err
+}
+
+// Record the end of the console session with the given record ID.
+func (s *State) EndConsoleAudit(id string, ended time.Time, bytes uint64, reason string) error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE console_audit SET ended = $1, bytes = $2, end_reason = $3 WHERE id = $4`,
+		ended.UnixNano(), int64(bytes), reason, id)
+	return err
+}
+
+// Return the records of console sessions on the node `label` which were
+// open at any time between from and to (either of which may be zero, for
+// no limit), oldest first. Records are kept after the node is deleted, so
+// this doesn't check that it exists.
+func (s *State) ConsoleAudit(label string, from, to time.Time) ([]obmd.ConsoleAuditRecord, error) {
+	var fromNs, toNs int64 = 0, 1<<63 - 1
+	if !from.IsZero() {
+		fromNs = from.UnixNano()
+	}
+	if !to.IsZero() {
+		toNs = to.UnixNano()
+	}
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT session, started, ended, token_hash, remote, bytes, end_reason
+		FROM console_audit
+		WHERE label = $1 AND started <= $2 AND (ended IS NULL OR ended >= $3)
+		ORDER BY started`, label, toNs, fromNs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []obmd.ConsoleAuditRecord{}
+	for rows.Next() {
+		var (
+			r       obmd.ConsoleAuditRecord
+			started int64
+			ended   sql.NullInt64
+			bytes   int64
+		)
+		err = rows.Scan(&r.Session, &started, &ended, &r.TokenHash, &r.Remote, &bytes, &r.EndReason)
+		if err != nil {
+			return nil, err
+		}
+		r.Started = time.Unix(0, started).UTC()
+		if ended.Valid {
+			t := time.Unix(0, ended.Int64).UTC()
+			r.Ended = &t
+		}
+		r.Bytes = uint64(bytes)
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// Return the records of console sessions on the node which were open at
+// any time between from and to; see State.ConsoleAudit.
+func (d *LocalDaemon) NodeConsoleAudit(label string, from, to time.Time) ([]obmd.ConsoleAuditRecord, error) {
+	return d.state.ConsoleAudit(label, from, to)
+}
+
+// Record the start of the console session c, which must have been
+// assigned an ID (see consoleRegistry.newID), arranging for its end to be recorded when it is closed. Errors are
+// logged, rather than refusing the session.
+func (d *LocalDaemon) auditConsole(c *consoleConn, token *obmd.Token) {
+	var tokenHash string
+	if token != nil {
+		tokenHash = obmd.AuditTokenHash(*token)
+	}
+	session := strconv.FormatUint(c.id, 10)
+	id, err := d.state.StartConsoleAudit(c.label, session, c.connected, tokenHash, c.remote)
+	if err != nil {
+		logger.Warn("Failed to record console session", "node", c.label, "err", err)
+		return
+	}
+	c.audit = func() {
+		err := d.state.EndConsoleAudit(id, time.Now(), atomic.LoadUint64(&c.bytes), c.EndReason())
+		if err != nil {
+			logger.Warn("Failed to record end of console session", "session", session, "err", err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The counters behind a node's ConsoleStats. These are updated atomically.
+type consoleCounters struct {
+	bytes        uint64
+	sessions     uint64
+	dialFailures uint64
+}
+
+// The set of console connections currently open, so that they can be
+// listed and forcibly disconnected by the admin.
+type consoleRegistry struct {
+	sync.Mutex
+	nextID uint64
+	conns  map[uint64]*consoleConn
+}
+
+func newConsoleRegistry() *consoleRegistry {
+	return &consoleRegistry{conns: make(map[uint64]*consoleConn)}
+}
+
+// Return a new connection ID.
+func (r *consoleRegistry) newID() uint64 {
+	r.Lock()
+	defer r.Unlock()
+	r.nextID++
+	return r.nextID
+}
+
+// Add c, which must have been assigned an ID by newID, to the registry.
+func (r *consoleRegistry) add(c *consoleConn) {
+	r.Lock()
+	defer r.Unlock()
+	c.registry = r
+	r.conns[c.id] = c
+}
+
+func (r *consoleRegistry) remove(c *consoleConn) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.conns, c.id)
+}
+
+// Return information about each open connection, ordered by ID (and so
+// by connection time).
+func (r *consoleRegistry) list() []obmd.ConsoleSession {
+	r.Lock()
+	defer r.Unlock()
+	conns := make([]*consoleConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].id < conns[j].id
+	})
+	ret := make([]obmd.ConsoleSession, len(conns))
+	for i, c := range conns {
+		ret[i] = obmd.ConsoleSession{
+			ID:        strconv.FormatUint(c.id, 10),
+			Node:      c.label,
+			Connected: c.connected,
+			Remote:    c.remote,
+			Bytes:     atomic.LoadUint64(&c.bytes),
+		}
+	}
+	return ret
+}
+
+// Return the number of open connections for each node which has any.
+func (r *consoleRegistry) active() map[string]int {
+	r.Lock()
+	defer r.Unlock()
+	ret := make(map[string]int)
+	for _, c := range r.conns {
+		ret[c.label]++
+	}
+	return ret
+}
+
+// Report whether any connection to the node `label` is open, other than
+// background ones (see driver.WithBackground).
+func (r *consoleRegistry) inUse(label string) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, c := range r.conns {
+		if c.label == label && !c.background {
+			return true
+		}
+	}
+	return false
+}
+
+// Relabel the connections to the node `label`, which has been renamed to
+// newLabel.
+func (r *consoleRegistry) rename(label, newLabel string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, c := range r.conns {
+		if c.label == label {
+			c.label = newLabel
+		}
+	}
+}
+
+// Close the connection with the given ID.
+func (r *consoleRegistry) disconnect(id string) error {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return obmd.ErrNoSuchConsole
+	}
+	r.Lock()
+	c, ok := r.conns[n]
+	r.Unlock()
+	if !ok {
+		return obmd.ErrNoSuchConsole
+	}
+	atomic.StoreInt32(&c.disconnected, 1)
+	return c.Close()
+}
+
+// A console connection, which releases the node's OBM when closed.
+type consoleConn struct {
+	// Number of bytes read. This comes first to ensure 64-bit alignment;
+	// see the sync/atomic docs.
+	bytes uint64
+
+	io.ReadCloser
+	node       *Node
+	once       sync.Once
+	id         uint64
+	label      string           // protected by the registry's lock.
+	registry   *consoleRegistry // nil if not registered.
+	remote     string
+	connected  time.Time
+	background bool // dialed on obmd's own behalf; see driver.WithBackground.
+
+	// Set (atomically) to 1 when the admin disconnects the session.
+	disconnected int32
+
+	// Records the end of the session in the console audit; nil if its
+	// start wasn't recorded.
+	audit func()
+}
+
+func (c *consoleConn) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddUint64(&c.bytes, uint64(n))
+	atomic.AddUint64(&c.node.console.bytes, uint64(n))
+	return n, err
+}
+
+// Report why the connection ended, as reported to clients: the reasons in
+// driver.ConsoleEnder, except that "dropped" is reported as
+// "token_revoked" (since that is why obmd drops consoles), and "stopped" as
+// why the node's OBM was stopped (see Node.StopOBM); or "disconnected" if
+// the admin disconnected it. Returns "" if the connection hasn't ended, or
+// the reason is unknown.
+func (c *consoleConn) EndReason() string {
+	if atomic.LoadInt32(&c.disconnected) != 0 {
+		return "disconnected"
+	}
+	e, ok := c.ReadCloser.(driver.ConsoleEnder)
+	if !ok {
+		return ""
+	}
+	switch reason := e.EndReason(); reason {
+	case driver.ConsoleEndDropped:
+		return "token_revoked"
+	case driver.ConsoleEndStopped:
+		return c.node.getStopReason()
+	default:
+		return reason
+	}
+}
+
+func (c *consoleConn) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() {
+		if c.registry != nil {
+			c.registry.remove(c)
+		}
+		if c.audit != nil {
+			c.audit()
+		}
+		c.node.releaseOBM()
+	})
+	return err
+}
@@ -1,126 +1,1207 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"io"
+	"sort"
+	"strconv"
 	"sync"
-)
+	"sync/atomic"
+	"time"
 
-var (
-	ErrNodeExists   = errors.New("Node already exists.")
-	ErrNoSuchNode   = errors.New("No such node.")
-	ErrInvalidToken = errors.New("Invalid token.")
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/events"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
 )
 
-type Daemon struct {
-	sync.Mutex
-	state *State
-	funcs chan func()
+// The longest a node may be given to shut down before it is powered off;
+// see LocalDaemon.ShutdownNode.
+const maxShutdownTimeout = time.Hour
+
+// How long powering off a node which didn't shut down in time may take.
+const shutdownEscalationTimeout = time.Minute
+
+// LocalDaemon implements obmd.Daemon, operating on nodes' OBMs itself.
+//
+// The State does its own locking, so changes to one node (creating or
+// deleting it, putting it into maintenance mode, etc.) don't hold up
+// operations on others. The embedded RWMutex is held for reading by all of
+// these, and for writing only by operations on the set of nodes as a whole
+// (e.g. reconciling it with an inventory, or shutting down), which must not
+// run concurrently with anything else. Operations on an individual node are
+// further serialized by that node's own lock.
+type LocalDaemon struct {
+	// The minimum time between power cycles of a node by users, in
+	// nanoseconds; accessed atomically. This comes first to ensure 64-bit
+	// alignment; see the sync/atomic docs. See SetPowerCycleInterval.
+	powerCycleInterval int64
+
+	sync.RWMutex
+	state  *State
+	closed bool
+	funcs  chan func()
+	stop   chan struct{} // closed by Close.
+
+	consoles *consoleRegistry
+	power    *powerGate
+	rollouts rolloutRegistry
+
+	// The labels new nodes may have; see SetLabelPolicy. Like the set of
+	// nodes, this is protected by the embedded RWMutex.
+	labels labelPolicy
+
+	// Templates for registering nodes; see SetNodeTemplates. Protected by
+	// the embedded RWMutex.
+	templates map[string]NodeTemplate
+
+	// Where to publish events; nil if nowhere. See SetEventPublisher.
+	events eventPublisher
+
+	// Watches for failing OBMs; nil if nothing does. See SetAlerter.
+	alerts *alerter
+
+	// The authorization policy; nil if there is none. See SetPolicy.
+	// Protected by the embedded RWMutex.
+	policy *policyHook
+
+	// See SetHealthChecks. healthWake is signalled when the settings
+	// change.
+	healthLock     sync.Mutex
+	healthSettings pollSettings
+	healthWake     chan struct{}
+
+	// Likewise, see SetSELMonitoring.
+	selLock     sync.Mutex
+	selSettings pollSettings
+	selWake     chan struct{}
+
+	// Likewise, see SetPowerGroupReapply. capFailures holds why each
+	// power group member's share couldn't be applied, if it couldn't.
+	powerGroupLock     sync.Mutex
+	powerGroupSettings pollSettings
+	powerGroupWake     chan struct{}
+	capFailures        map[string]string
+}
+
+// Something which publishes events, e.g. an *events.Publisher.
+type eventPublisher interface {
+	Publish(ev events.Event)
+}
+
+// Create a LocalDaemon managing the nodes in state. This starts goroutines
+// which run health checks (see SetHealthChecks), read event logs (see
+// SetSELMonitoring) and reapply power groups (see SetPowerGroupReapply),
+// and if state was created with an OBMIdleTimeout, another which stops idle
+// OBMs.
+func NewDaemon(state *State) *LocalDaemon {
+	ret := &LocalDaemon{
+		state:    state,
+		stop:     make(chan struct{}),
+		consoles: newConsoleRegistry(),
+		power:    newPowerGate(),
+		labels:   labelPolicy{pattern: defaultLabelRegexp, maxLen: maxLabelLength},
+
+		healthWake:     make(chan struct{}, 1),
+		selWake:        make(chan struct{}, 1),
+		powerGroupWake: make(chan struct{}, 1),
+		capFailures:    make(map[string]string),
+	}
+	go ret.monitorHealth()
+	go ret.monitorSEL()
+	go ret.monitorPowerGroups()
+	if idle := state.opts.OBMIdleTimeout; idle != 0 {
+		go ret.stopIdleOBMs(idle)
+	}
+	return ret
+}
+
+// Publish events (changes to nodes, and power operations on them) to p.
+// This must be called before the daemon is used.
+func (d *LocalDaemon) SetEventPublisher(p eventPublisher) {
+	d.events = p
+}
+
+// Report the outcome of OBM operations to a, which alerts operators to
+// failing OBMs. This must be called before the daemon is used.
+func (d *LocalDaemon) SetAlerter(a *alerter) {
+	d.alerts = a
+}
+
+// Refuse to let users power cycle a node more than once per interval
+// (zero means no limit), e.g. to stop clients' retry loops wearing out its
+// power supply. Admins are exempt. This may be called at any time.
+func (d *LocalDaemon) SetPowerCycleInterval(interval time.Duration) {
+	atomic.StoreInt64(&d.powerCycleInterval, int64(interval))
 }
 
-func NewDaemon(state *State) *Daemon {
-	return &Daemon{
-		state: state,
+// Check that the node may be power cycled now (by the admin, if admin is
+// true), and if so, record that it is being. The caller must hold the
+// node's lock.
+func (d *LocalDaemon) checkPowerCycleRate(node *Node, admin bool) error {
+	interval := time.Duration(atomic.LoadInt64(&d.powerCycleInterval))
+	now := time.Now()
+	if wait := node.lastPowerCycle.Add(interval).Sub(now); wait > 0 && !admin {
+		return obmd.PowerCycleRateError{RetryAfter: wait}
+	}
+	node.lastPowerCycle = now
+	return nil
+}
+
+// Publish an event of the given type about the node `label`. detail may be
+// nil.
+func (d *LocalDaemon) publish(typ, label string, detail map[string]string) {
+	if d.events != nil {
+		d.events.Publish(events.Event{Type: typ, Node: label, Detail: detail})
 	}
 }
 
-func (d *Daemon) DeleteNode(label string) error {
+// Periodically stop the OBMs of nodes which have not been used for at
+// least `idle`, until the daemon is closed.
+func (d *LocalDaemon) stopIdleOBMs(idle time.Duration) {
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(idle / 2):
+		}
+		for label, node := range d.state.Nodes() {
+			if node.stopIfIdle(idle) {
+				logger.Debug("Stopped idle OBM", "subsystem", "daemon", "node", label)
+			}
+		}
+	}
+}
+
+// Shut down the daemon, disconnecting any console sessions and stopping
+// all of the OBMs. Waits for in-progress operations to complete. After
+// Close returns, node operations fail with ErrShuttingDown.
+func (d *LocalDaemon) Close() error {
 	d.Lock()
 	defer d.Unlock()
-	return d.state.DeleteNode(label)
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	close(d.stop)
+	return d.state.Close()
 }
 
-func (d *Daemon) SetNode(label string, info []byte) error {
+// Start the OBMs of any nodes which are not yet running; see
+// StateOptions.DeferOBMStart.
+func (d *LocalDaemon) StartOBMs() {
 	d.Lock()
 	defer d.Unlock()
+	if d.closed {
+		return
+	}
+	d.state.StartOBMs()
+}
+
+// Return a description of each node's state, for debugging. This does not
+// take the nodes' locks, so it works even if operations are hung.
+func (d *LocalDaemon) InspectNodes() map[string]map[string]interface{} {
+	ret := make(map[string]map[string]interface{})
+	for label, node := range d.state.Nodes() {
+		info := map[string]interface{}{}
+		if i, ok := node.OBM.(driver.Inspector); ok {
+			for k, v := range i.Inspect() {
+				info[k] = v
+			}
+		}
+		info["obm_running"] = node.OBMRunning()
+		ret[label] = info
+	}
+	return ret
+}
+
+// Describe each node (excluding quarantined ones) for a Snapshot, keyed by
+// label.
+func (d *LocalDaemon) NodeSnapshots() map[string]obmd.NodeSnapshot {
+	ret := make(map[string]obmd.NodeSnapshot)
+	for label, node := range d.state.Nodes() {
+		var info struct {
+			Type  string          `json:"type"`
+			Model string          `json:"model"`
+			Info  json.RawMessage `json:"info"`
+		}
+		var fields interface{}
+		if json.Unmarshal(node.ConnInfo, &info) == nil {
+			obmd.DecodeJSON(info.Info, &fields)
+		}
+		snap := obmd.NodeSnapshot{
+			Type:    info.Type,
+			Model:   info.Model,
+			Info:    redactSecrets(fields),
+			Version: node.Version,
+		}
+		if reason, ok := d.state.Maintenance(label); ok {
+			snap.Maintenance = &reason
+		}
+		if reason, ok := d.state.Draining(label); ok {
+			snap.Draining = &reason
+		}
+		snap.Owner = d.state.Owner(label)
+		ret[label] = snap
+	}
+	return ret
+}
+
+// Write a consistent snapshot of the database to w; see backupDB. We don't
+// take the lock for this, as the database itself guarantees consistency,
+// and a slow reader would otherwise block all other operations.
+func (d *LocalDaemon) Backup(dbType, dbPath string, w io.Writer) error {
+	return backupDB(d.state.db, dbType, dbPath, w)
+}
+
+// Delete the node. If it was in a power group, the group's budget is
+// redistributed among the remaining members.
+func (d *LocalDaemon) DeleteNode(label string) error {
+	group, err := d.state.PowerGroupOf(label)
+	if err != nil {
+		return err
+	}
+	if err = d.deleteNode(label); err != nil {
+		return err
+	}
+	if group != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), powerGroupTimeout)
+		defer cancel()
+		d.applyPowerGroup(ctx, group)
+	}
+	return nil
+}
+
+func (d *LocalDaemon) deleteNode(label string) error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+	err := d.state.DeleteNode(label)
+	if err == nil {
+		d.publish("node_deleted", label, nil)
+		if d.alerts != nil {
+			d.alerts.forget(label)
+		}
+		d.powerGroupLock.Lock()
+		delete(d.capFailures, label)
+		d.powerGroupLock.Unlock()
+	}
+	return err
+}
+
+func (d *LocalDaemon) SetNode(label string, info []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
 
 	d.state.check()
 
-	_, err := d.state.GetNode(label)
+	info, err := expandTemplate(d.templates, info)
+	if err != nil {
+		return err
+	}
+	_, err = d.state.GetNode(label)
 	if err == nil {
-		return ErrNodeExists
+		return obmd.ErrNodeExists
+	}
+	// Quarantined nodes already have their labels, which may predate the
+	// label policy, so only check new ones.
+	if err == obmd.ErrNoSuchNode {
+		if err = d.labels.check(label); err != nil {
+			return err
+		}
 	}
-	// Create the node.
+	// Create the node (or replace it, if it is quarantined).
 	_, err = d.state.NewNode(label, info)
+	if err == nil {
+		d.publish("node_registered", label, nil)
+	}
 
 	d.state.check()
 	return err
 }
 
-func (d *Daemon) GetNodeToken(label string) (Token, error) {
+// Change the label of the node (which may be quarantined) `label` to
+// newLabel. The node keeps its token, maintenance mode, and everything else
+// about it; only the label changes. Open console connections stay open.
+func (d *LocalDaemon) RenameNode(label, newLabel string) error {
 	d.Lock()
 	defer d.Unlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+	if err := d.labels.check(newLabel); err != nil {
+		return err
+	}
+	if err := d.state.RenameNode(label, newLabel); err != nil {
+		return err
+	}
+	d.consoles.rename(label, newLabel)
+	if d.alerts != nil {
+		d.alerts.rename(label, newLabel)
+	}
+	d.powerGroupLock.Lock()
+	if msg, ok := d.capFailures[label]; ok {
+		delete(d.capFailures, label)
+		d.capFailures[newLabel] = msg
+	}
+	d.powerGroupLock.Unlock()
+	d.publish("node_renamed", newLabel, map[string]string{"old_label": label})
+	d.state.check()
+	return nil
+}
+
+// Return the labels of all nodes (including quarantined ones), sorted.
+func (d *LocalDaemon) NodeLabels() []string {
+	d.RLock()
+	defer d.RUnlock()
+	labels := d.state.Labels()
+	sort.Strings(labels)
+	return labels
+}
+
+// Return the labels of quarantined nodes, mapped to the reason each was
+// quarantined.
+func (d *LocalDaemon) QuarantinedNodes() map[string]string {
+	d.RLock()
+	defer d.RUnlock()
+	ret := make(map[string]string)
+	for label, err := range d.state.QuarantinedNodes() {
+		ret[label] = err.Error()
+	}
+	return ret
+}
+
+// Issue a new token for the node, invalidating the old one. Returns
+// ErrNodeDraining if the node is being drained (see SetNodeDraining), and
+// an error if the authorization policy refuses (see SetPolicy).
+func (d *LocalDaemon) GetNodeToken(ctx context.Context, label string) (token obmd.Token, err error) {
+	if err = d.checkPolicy(ctx, label, nil, "token", nil); err != nil {
+		return
+	}
+	err = d.withNode(ctx, label, nil, func(ctx context.Context, node *Node) error {
+		if _, ok := d.state.Draining(label); ok {
+			return obmd.ErrNodeDraining
+		}
+		token, err = node.NewToken()
+		return err
+	})
+	return
+}
+
+// Return the node's version; see Node.Version.
+func (d *LocalDaemon) NodeVersion(label string) (string, error) {
 	node, err := d.state.GetNode(label)
 	if err != nil {
-		return Token{}, err
+		return "", err
 	}
-	token, err := node.NewToken()
+	return node.Version, nil
+}
+
+// Report when the node's token was issued and last used, e.g. to find nodes
+// whose users have stopped using them.
+func (d *LocalDaemon) NodeTokenUsage(label string) (usage obmd.TokenUsage, err error) {
+	d.RLock()
+	defer d.RUnlock()
+	node, err := d.state.GetNode(label)
 	if err != nil {
-		return Token{}, err
+		return usage, err
 	}
-	return token, nil
+	return node.getTokenUsage(), nil
 }
 
-func (d *Daemon) InvalidateNodeToken(label string) error {
-	d.Lock()
-	defer d.Unlock()
-	node, err := d.state.GetNode(label)
+// Report when the token of each node (excluding quarantined ones) was
+// issued and last used, keyed by label.
+func (d *LocalDaemon) TokenUsage() map[string]obmd.TokenUsage {
+	nodes := d.state.Nodes()
+	ret := make(map[string]obmd.TokenUsage, len(nodes))
+	for label, node := range nodes {
+		ret[label] = node.getTokenUsage()
+	}
+	return ret
+}
+
+func (d *LocalDaemon) InvalidateNodeToken(label string) error {
+	return d.withNode(context.Background(), label, nil, func(ctx context.Context, node *Node) error {
+		node.ClearToken()
+		return nil
+	})
+}
+
+// Look up the node with the specified label, and call fn on it. If token is
+// not nil, first check that it is valid for the node. fn is passed ctx,
+// carrying the node's label, driver type and the operation's name (see
+// obmd.WithOpName) for logging; see logger.NewContext.
+//
+// This holds the LocalDaemon's read lock, so that the node cannot be deleted out
+// from under fn, and the node's own lock, so that operations on the same node
+// are serialized. Operations on other nodes may proceed concurrently. The
+// node's OBM is started if necessary, and is kept running until fn returns.
+//
+// If ctx is done while waiting for the node's lock (e.g. because the
+// client gave up), this gives up too, without calling fn.
+//
+// Returns an error if the node does not exist or token is invalid, and
+// otherwise the return value of fn.
+func (d *LocalDaemon) withNode(ctx context.Context, label string, token *obmd.Token, fn func(context.Context, *Node) error) error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+	node, err := d.lockNode(ctx, label)
 	if err != nil {
 		return err
 	}
-	node.ClearToken()
+	defer node.Unlock()
+	if token != nil && !node.useToken(*token, obmd.OpName(ctx)) {
+		return obmd.ErrInvalidToken
+	}
+	if isPassiveUse(ctx) {
+		if !node.acquireRunningOBM() {
+			return errOBMStopped
+		}
+		defer node.releasePassiveOBM()
+	} else {
+		node.acquireOBM()
+		defer node.releaseOBM()
+	}
+	return fn(nodeLogContext(ctx, label, node), node)
+}
+
+// Returned by withNode for passive uses (see withPassiveUse) of nodes
+// whose OBMs aren't running.
+var errOBMStopped = errors.New("OBM is not running.")
+
+// The key of the context value set by withPassiveUse.
+type passiveUseKey struct{}
+
+// Return a context for periodic checks made on obmd's own behalf (health
+// checks and SEL polls), which mustn't keep nodes' OBMs running when they
+// are started lazily (see StateOptions.OBMIdleTimeout): withNode gives up
+// with errOBMStopped rather than start a stopped OBM for them, and they
+// don't count as use of a running one.
+func withPassiveUse(ctx context.Context) context.Context {
+	return context.WithValue(ctx, passiveUseKey{}, true)
+}
+
+// Report whether ctx is from withPassiveUse.
+func isPassiveUse(ctx context.Context) bool {
+	return ctx.Value(passiveUseKey{}) != nil
+}
+
+// Return ctx, carrying the node's label, driver type and the operation's
+// name (if any) for logging.
+func nodeLogContext(ctx context.Context, label string, node *Node) context.Context {
+	kv := []interface{}{"node", label, "driver", node.driverType()}
+	if name := obmd.OpName(ctx); name != "" {
+		kv = append(kv, "op", name)
+	}
+	return logger.NewContext(ctx, kv...)
+}
+
+// Look up the node with the specified label and acquire its lock (see
+// Node.lockContext). If the node is deleted or replaced while we wait for
+// the lock, this looks it up again. The caller must hold the daemon's lock
+// for reading.
+func (d *LocalDaemon) lockNode(ctx context.Context, label string) (*Node, error) {
+	for {
+		node, err := d.state.GetNode(label)
+		if err != nil {
+			return nil, err
+		}
+		if err = node.lockContext(ctx); err != nil {
+			return nil, err
+		}
+		if node.removed {
+			node.Unlock()
+			continue
+		}
+		if err = checkVersion(ctx, node); err != nil {
+			node.Unlock()
+			return nil, err
+		}
+		return node, nil
+	}
+}
+
+// Like withNode, but for operations which use the node's OBM, whose
+// outcome is reported to the alerter (if any). Giving up before fn is
+// called (including for a passive use of a stopped OBM) says nothing about
+// the OBM, so isn't reported.
+func (d *LocalDaemon) withOBM(ctx context.Context, label string, token *obmd.Token, fn func(context.Context, *Node) error) error {
+	called := false
+	err := d.withNode(ctx, label, token, func(ctx context.Context, node *Node) error {
+		called = true
+		return fn(ctx, node)
+	})
+	if d.alerts != nil && err != errOBMStopped && (called || err != ctx.Err()) {
+		d.alerts.observe(label, err)
+	}
+	return err
+}
+
+// Like withOBM, but for operations which change the node's power or boot
+// state. Users may not do these while the node is in maintenance mode (see
+// SetNodeMaintenance), and get ErrNodeInMaintenance; admins (i.e. callers
+// passing a nil token, unless ctx is from userContext) may. The operation,
+// op, with the given detail, must also be allowed by the authorization
+// policy, if any (see SetPolicy), which is asked before taking any locks.
+func (d *LocalDaemon) withPowerOp(ctx context.Context, label string, token *obmd.Token, op string, detail map[string]string, fn func(context.Context, *Node) error) error {
+	if err := d.checkPolicy(ctx, label, token, op, detail); err != nil {
+		return err
+	}
+	return d.withOBM(ctx, label, token, func(ctx context.Context, node *Node) error {
+		if _, ok := d.state.Maintenance(label); ok && !isAdminOp(ctx, token) {
+			return obmd.ErrNodeInMaintenance
+		}
+		node.powerOps++
+		return fn(ctx, node)
+	})
+}
+
+// The key of the context value set by userContext.
+type userOpKey struct{}
+
+// Report whether an operation with the given context and token is made by
+// the admin. Background operations (see driver.WithBackground) are not.
+func isAdminOp(ctx context.Context, token *obmd.Token) bool {
+	return token == nil && ctx.Value(userOpKey{}) == nil && !driver.IsBackground(ctx)
+}
+
+// Return ErrVersionMismatch if ctx is from obmd.WithExpectedVersion, and the
+// node's version is not the one expected.
+func checkVersion(ctx context.Context, node *Node) error {
+	if v, ok := obmd.ExpectedVersion(ctx); ok && v != node.Version {
+		return obmd.ErrVersionMismatch
+	}
 	return nil
 }
 
-// Get the node with the specified label, and check that `token` is valid for it.
-// Returns an error if the node does not exist or token is invalid.
-func (d *Daemon) getNodeWithToken(label string, token *Token) (*Node, error) {
-	node, err := d.state.GetNode(label)
+// Return a context for operations made on behalf of users who were
+// authenticated by some means other than a node token (e.g. by a virtual
+// BMC), so pass a nil token, but mustn't be treated as the admin.
+func userContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, userOpKey{}, true)
+}
+
+// Put the node into maintenance mode, recording reason, or take it out of
+// maintenance mode if on is false. This persists across restarts.
+// Operations already in progress on the node are finished when it returns.
+func (d *LocalDaemon) SetNodeMaintenance(label string, on bool, reason string) error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+	err := d.state.SetMaintenance(label, on, reason)
+	if err == nil && on {
+		d.publish("maintenance_set", label, map[string]string{"reason": reason})
+	} else if err == nil {
+		d.publish("maintenance_cleared", label, nil)
+	}
+	return err
+}
+
+// Report whether the node is in maintenance mode, and if so, why.
+func (d *LocalDaemon) NodeMaintenance(label string) (on bool, reason string, err error) {
+	d.RLock()
+	defer d.RUnlock()
+	if _, err = d.state.GetNode(label); err != nil && err != obmd.ErrNodeQuarantined {
+		return false, "", err
+	}
+	reason, on = d.state.Maintenance(label)
+	return on, reason, nil
+}
+
+// Start draining the node, recording reason, or stop if on is false. While
+// a node is draining, GetNodeToken refuses to issue new tokens for it, but
+// its existing token and console sessions keep working, so that it can be
+// taken out of the pool of allocatable nodes without disturbing its
+// current user. This persists across restarts.
+func (d *LocalDaemon) SetNodeDraining(label string, on bool, reason string) error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+	err := d.state.SetDraining(label, on, reason)
+	if err == nil && on {
+		d.publish("drain_set", label, map[string]string{"reason": reason})
+	} else if err == nil {
+		d.publish("drain_cleared", label, nil)
+	}
+	return err
+}
+
+// Report whether the node is being drained, and if so, why.
+func (d *LocalDaemon) NodeDraining(label string) (on bool, reason string, err error) {
+	d.RLock()
+	defer d.RUnlock()
+	if _, err = d.state.GetNode(label); err != nil && err != obmd.ErrNodeQuarantined {
+		return false, "", err
+	}
+	reason, on = d.state.Draining(label)
+	return on, reason, nil
+}
+
+// Connect to the node's console, replaying up to `replay` bytes of recent
+// output if the driver supports it (see driver.ConsoleReplayer). Dialing can
+// be slow (e.g. if a previous session is slow to shut down), so unlike other
+// operations, we hold neither the node's lock nor the daemon's while doing
+// it, lest we delay e.g. an emergency power off, or a reload. Instead, we
+// check the token again afterwards, in case it was invalidated in the
+// meantime.
+//
+// Users authenticated by other means (see userContext) pass a nil token,
+// and may only connect while the node has a token, which they act with.
+// Connections made on obmd's own behalf (see driver.WithBackground) also
+// pass a nil token, but need none.
+func (d *LocalDaemon) DialNodeConsole(ctx context.Context, label string, replay int, remote string, token *obmd.Token) (io.ReadCloser, error) {
+	d.RLock()
+	if d.closed {
+		d.RUnlock()
+		return nil, obmd.ErrShuttingDown
+	}
+	node, err := d.lockNode(ctx, label)
+	if err != nil {
+		d.RUnlock()
+		return nil, err
+	}
+	ctx = nodeLogContext(ctx, label, node)
+	background := driver.IsBackground(ctx)
+	if token == nil && !isAdminOp(ctx, nil) && !background {
+		// e.g. an ssh client with an authorized key: act with the
+		// node's current token, so that the session is subject to its
+		// revocation, and attributed to it.
+		current, ok := node.currentToken()
+		if !ok {
+			node.Unlock()
+			d.RUnlock()
+			return nil, obmd.ErrInvalidToken
+		}
+		token = &current
+	}
+	valid := func() bool {
+		return !node.removed && (token == nil || node.useToken(*token, obmd.OpName(ctx)))
+	}
+	if !valid() {
+		node.Unlock()
+		d.RUnlock()
+		return nil, obmd.ErrInvalidToken
+	}
+	if err = driver.CheckSupported(node.OBM, driver.OpConsole); err != nil {
+		node.Unlock()
+		d.RUnlock()
+		return nil, err
+	}
+	// Keep the OBM running for as long as the console is in use. This is
+	// done with the lock held, so that the node can't be deleted (and its
+	// OBM stopped) first.
+	node.acquireOBM()
+	node.Unlock()
+	d.RUnlock()
+	var conn io.ReadCloser
+	if r, ok := node.OBM.(driver.ConsoleReplayer); ok && replay > 0 {
+		conn, err = r.DialConsoleReplay(ctx, replay)
+	} else {
+		conn, err = node.OBM.DialConsole(ctx)
+	}
 	if err != nil {
+		atomic.AddUint64(&node.console.dialFailures, 1)
+		node.releaseOBM()
 		return nil, err
 	}
-	if !node.ValidToken(*token) {
-		return nil, ErrInvalidToken
+	atomic.AddUint64(&node.console.sessions, 1)
+	c := &consoleConn{
+		ReadCloser: conn,
+		node:       node,
+		label:      label,
+		remote:     remote,
+		connected:  time.Now(),
+		background: background,
+	}
+	node.Lock()
+	ok := valid()
+	node.Unlock()
+	if !ok {
+		c.Close()
+		return nil, obmd.ErrInvalidToken
 	}
-	return node, nil
+	c.id = d.consoles.newID()
+	d.auditConsole(c, token)
+	d.consoles.add(c)
+	return c, nil
 }
 
-func (d *Daemon) DialNodeConsole(label string, token *Token) (io.ReadCloser, error) {
-	d.Lock()
-	defer d.Unlock()
-	node, err := d.getNodeWithToken(label, token)
+// List the open console connections.
+func (d *LocalDaemon) ConsoleSessions() []obmd.ConsoleSession {
+	return d.consoles.list()
+}
+
+// Return the console statistics for a node.
+func (d *LocalDaemon) NodeConsoleStats(ctx context.Context, label string, token *obmd.Token) (stats obmd.ConsoleStats, err error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return stats, obmd.ErrShuttingDown
+	}
+	node, err := d.state.GetNode(label)
 	if err != nil {
-		return nil, err
+		return stats, err
+	}
+	node.Lock()
+	valid := token == nil || node.useToken(*token, "console/stats")
+	node.Unlock()
+	if !valid {
+		return stats, obmd.ErrInvalidToken
 	}
-	return node.OBM.DialConsole()
+	if err = checkVersion(ctx, node); err != nil {
+		return stats, err
+	}
+	return node.consoleStats(d.consoles.active()[label]), nil
 }
 
-func (d *Daemon) PowerOffNode(label string, token *Token) error {
-	d.Lock()
-	defer d.Unlock()
-	node, err := d.getNodeWithToken(label, token)
+// Return the console statistics for every node, keyed by label.
+func (d *LocalDaemon) ConsoleStats() map[string]obmd.ConsoleStats {
+	active := d.consoles.active()
+	nodes := d.state.Nodes()
+	ret := make(map[string]obmd.ConsoleStats, len(nodes))
+	for label, node := range nodes {
+		ret[label] = node.consoleStats(active[label])
+	}
+	return ret
+}
+
+// Forcibly close the console connection with the given ID (as reported by
+// ConsoleSessions), leaving any others to the same node alone.
+func (d *LocalDaemon) DisconnectConsole(id string) error {
+	return d.consoles.disconnect(id)
+}
+
+// Check whether token is valid for the node, without doing anything else.
+func (d *LocalDaemon) CheckNodeToken(label string, token obmd.Token) error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+	node, err := d.state.GetNode(label)
 	if err != nil {
 		return err
 	}
-	return node.OBM.PowerOff()
+	node.Lock()
+	defer node.Unlock()
+	if !node.useToken(token, "authenticate") {
+		return obmd.ErrInvalidToken
+	}
+	return nil
 }
 
-func (d *Daemon) PowerCycleNode(label string, force bool, token *Token) error {
-	d.Lock()
-	defer d.Unlock()
-	node, err := d.getNodeWithToken(label, token)
+// Return recent output from the node's console; see
+// driver.ConsoleSnapshotter.
+func (d *LocalDaemon) NodeConsoleSnapshot(ctx context.Context, label string, n int, token *obmd.Token) (data []byte, err error) {
+	err = d.withNode(ctx, label, token, func(ctx context.Context, node *Node) error {
+		s, ok := node.OBM.(driver.ConsoleSnapshotter)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		data, err = s.ConsoleSnapshot(ctx, n)
+		return err
+	})
+	return data, err
+}
+
+// Send input to the node's console; see driver.ConsoleWriter.
+func (d *LocalDaemon) WriteNodeConsole(ctx context.Context, label string, p []byte, token *obmd.Token) error {
+	return d.withNode(ctx, label, token, func(ctx context.Context, node *Node) error {
+		if _, ok := node.currentToken(); token == nil && !isAdminOp(ctx, nil) && !ok {
+			// As in DialNodeConsole.
+			return obmd.ErrInvalidToken
+		}
+		w, ok := node.OBM.(driver.ConsoleWriter)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return w.WriteConsole(ctx, p)
+	})
+}
+
+func (d *LocalDaemon) PowerOffNode(ctx context.Context, label string, token *obmd.Token) error {
+	err := d.withPowerOp(ctx, label, token, "power_off", nil, func(ctx context.Context, node *Node) error {
+		if err := driver.CheckSupported(node.OBM, driver.OpPowerOff); err != nil {
+			return err
+		}
+		return node.OBM.PowerOff(ctx)
+	})
+	if err == nil {
+		d.publish("power_off", label, nil)
+	}
+	return err
+}
+
+// Ask the node's operating system to shut down; see driver.SoftPowerer.
+// If timeout is non-zero, and the node is still on after that long, it is
+// powered off, unless another operation has changed its power or boot
+// state since (or its token has changed, if this was done with one). This
+// returns once the shutdown is requested; powering off happens in the
+// background. Returns ErrInvalidShutdownTimeout if the timeout is
+// negative or longer than maxShutdownTimeout.
+func (d *LocalDaemon) ShutdownNode(ctx context.Context, label string, timeout time.Duration, token *obmd.Token) error {
+	if timeout < 0 || timeout > maxShutdownTimeout {
+		return obmd.ErrInvalidShutdownTimeout
+	}
+	detail := map[string]string{"timeout": timeout.String()}
+	var shutdown *Node
+	var ops uint64
+	err := d.withPowerOp(ctx, label, token, "shutdown", detail, func(ctx context.Context, node *Node) error {
+		p, ok := node.OBM.(driver.SoftPowerer)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		shutdown, ops = node, node.powerOps
+		return p.SoftPowerOff(ctx)
+	})
 	if err != nil {
 		return err
 	}
-	return node.OBM.PowerCycle(force)
+	d.publish("shutdown", label, detail)
+	if timeout != 0 {
+		var tokenCopy *obmd.Token
+		if token != nil {
+			tokenCopy = new(obmd.Token)
+			*tokenCopy = *token
+		}
+		go d.escalateShutdown(label, shutdown, ops, timeout, !isAdminOp(ctx, token), tokenCopy)
+	}
+	return nil
+}
+
+// Power off the node after timeout, if it is still on, and hasn't been
+// replaced or had any other power operations since the shutdown, which
+// was its ops'th; see ShutdownNode. user and token say who asked for the
+// shutdown.
+func (d *LocalDaemon) escalateShutdown(label string, shutdown *Node, ops uint64, timeout time.Duration, user bool, token *obmd.Token) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.stop:
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownEscalationTimeout)
+	defer cancel()
+	ctx = obmd.WithOpName(ctx, "shutdown")
+	if user {
+		ctx = userContext(ctx)
+	}
+	escalated := false
+	err := d.withOBM(ctx, label, token, func(ctx context.Context, node *Node) error {
+		if node != shutdown || node.powerOps != ops {
+			return nil
+		}
+		if _, ok := d.state.Maintenance(label); ok && !isAdminOp(ctx, token) {
+			return obmd.ErrNodeInMaintenance
+		}
+		if err := driver.CheckSupported(node.OBM, driver.OpPowerOff); err != nil {
+			return err
+		}
+		state, err := node.OBM.PowerStatus(ctx)
+		if err != nil || state == driver.PowerStateOff {
+			return err
+		}
+		escalated = true
+		return node.OBM.PowerOff(ctx)
+	})
+	switch {
+	case err != nil:
+		logger.Warn("Failed to power off node after shutdown timed out",
+			"node", label, "err", err)
+	case escalated:
+		logger.Info("Node didn't shut down in time; powered it off",
+			"node", label, "timeout", timeout)
+		d.publish("power_off", label, map[string]string{"escalated": "true"})
+	}
 }
 
-func (d *Daemon) SetNodeBootDev(label string, dev string, token *Token) error {
-	d.Lock()
-	defer d.Unlock()
-	node, err := d.getNodeWithToken(label, token)
+// Power cycle the node, once it is its turn; see SetPowerOnStagger.
+func (d *LocalDaemon) PowerCycleNode(ctx context.Context, label string, force bool, token *obmd.Token) error {
+	release, err := d.power.acquire(ctx)
 	if err != nil {
 		return err
 	}
-	return node.OBM.SetBootdev(dev)
+	defer release()
+	return d.powerCycleNode(ctx, label, force, token)
+}
+
+// Like PowerCycleNode, but not staggered.
+func (d *LocalDaemon) powerCycleNode(ctx context.Context, label string, force bool, token *obmd.Token) error {
+	detail := map[string]string{"force": strconv.FormatBool(force)}
+	err := d.withPowerOp(ctx, label, token, "power_cycle", detail, func(ctx context.Context, node *Node) error {
+		if err := driver.CheckSupported(node.OBM, driver.OpPowerCycle); err != nil {
+			return err
+		}
+		if err := d.checkPowerCycleRate(node, isAdminOp(ctx, token)); err != nil {
+			return err
+		}
+		return node.OBM.PowerCycle(ctx, force)
+	})
+	if err == nil {
+		d.publish("power_cycle", label, detail)
+	}
+	return err
+}
+
+// Power on the node, if it isn't already, once it is its turn (see
+// SetPowerOnStagger). There is no OBM operation for this, so it is done by
+// power cycling the node if it is off, which turns it on.
+func (d *LocalDaemon) PowerOnNode(ctx context.Context, label string, token *obmd.Token) error {
+	release, err := d.power.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return d.powerOnNode(ctx, label, token)
+}
+
+// Like PowerOnNode, but not staggered.
+func (d *LocalDaemon) powerOnNode(ctx context.Context, label string, token *obmd.Token) error {
+	err := d.withPowerOp(ctx, label, token, "power_on", nil, func(ctx context.Context, node *Node) error {
+		for _, op := range []driver.Operation{driver.OpPowerStatus, driver.OpPowerCycle} {
+			if err := driver.CheckSupported(node.OBM, op); err != nil {
+				return err
+			}
+		}
+		state, err := node.OBM.PowerStatus(ctx)
+		if err != nil || state == driver.PowerStateOn {
+			return err
+		}
+		if err = d.checkPowerCycleRate(node, isAdminOp(ctx, token)); err != nil {
+			return err
+		}
+		return node.OBM.PowerCycle(ctx, true)
+	})
+	if err == nil {
+		d.publish("power_on", label, nil)
+	}
+	return err
+}
+
+func (d *LocalDaemon) NodePowerStatus(ctx context.Context, label string, token *obmd.Token) (state driver.PowerState, err error) {
+	err = d.withOBM(ctx, label, token, func(ctx context.Context, node *Node) error {
+		if err := driver.CheckSupported(node.OBM, driver.OpPowerStatus); err != nil {
+			return err
+		}
+		state, err = node.OBM.PowerStatus(ctx)
+		return err
+	})
+	return state, err
+}
+
+// Report the node's power state, and its boot device (see
+// driver.BootdevReporter), or "" if the OBM can't report that.
+func (d *LocalDaemon) NodeStatus(ctx context.Context, label string, token *obmd.Token) (state driver.PowerState, bootdev string, err error) {
+	state = driver.PowerStateUnknown
+	err = d.withOBM(ctx, label, token, func(ctx context.Context, node *Node) error {
+		if err := driver.CheckSupported(node.OBM, driver.OpPowerStatus); err != nil {
+			return err
+		}
+		state, err = node.OBM.PowerStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if r, ok := node.OBM.(driver.BootdevReporter); ok {
+			bootdev, err = r.Bootdev(ctx)
+			if err == driver.ErrNotSupported {
+				err = nil
+			}
+		}
+		return err
+	})
+	return state, bootdev, err
+}
+
+// Report the network configuration of the node's OBM; see
+// driver.LANInspector. This is an admin operation, so needs no token.
+func (d *LocalDaemon) NodeLANConfig(ctx context.Context, label string) (config driver.LANConfig, err error) {
+	err = d.withOBM(ctx, label, nil, func(ctx context.Context, node *Node) error {
+		i, ok := node.OBM.(driver.LANInspector)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		config, err = i.LANConfig(ctx)
+		return err
+	})
+	return config, err
+}
+
+// Report the state of the node's watchdog timer; see driver.Watchdog.
+func (d *LocalDaemon) NodeWatchdog(ctx context.Context, label string, token *obmd.Token) (status driver.WatchdogStatus, err error) {
+	err = d.withOBM(ctx, label, token, func(ctx context.Context, node *Node) error {
+		w, ok := node.OBM.(driver.Watchdog)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		status, err = w.WatchdogStatus(ctx)
+		return err
+	})
+	return status, err
+}
+
+// Arm the node's watchdog timer, so that the node is power cycled unless
+// the timer is reset or stopped within `seconds`; see driver.Watchdog.
+// The power cycle happens on the OBM, out of the reach of
+// SetPowerCycleInterval, so users get ErrWatchdogTimeoutTooShort if
+// `seconds` is shorter than the interval; admins are exempt.
+func (d *LocalDaemon) ArmNodeWatchdog(ctx context.Context, label string, seconds int, token *obmd.Token) error {
+	interval := time.Duration(atomic.LoadInt64(&d.powerCycleInterval))
+	if time.Duration(seconds)*time.Second < interval && !isAdminOp(ctx, token) {
+		return obmd.ErrWatchdogTimeoutTooShort
+	}
+	detail := map[string]string{"action": "arm", "timeout": strconv.Itoa(seconds)}
+	err := d.withPowerOp(ctx, label, token, "watchdog", detail, func(ctx context.Context, node *Node) error {
+		w, ok := node.OBM.(driver.Watchdog)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return w.ArmWatchdog(ctx, seconds)
+	})
+	if err == nil {
+		d.publish("watchdog_armed", label, map[string]string{"timeout": detail["timeout"]})
+	}
+	return err
+}
+
+// Restart the countdown of the node's watchdog timer.
+func (d *LocalDaemon) ResetNodeWatchdog(ctx context.Context, label string, token *obmd.Token) error {
+	detail := map[string]string{"action": "reset"}
+	return d.withPowerOp(ctx, label, token, "watchdog", detail, func(ctx context.Context, node *Node) error {
+		w, ok := node.OBM.(driver.Watchdog)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return w.ResetWatchdog(ctx)
+	})
+}
+
+// Stop the node's watchdog timer.
+func (d *LocalDaemon) StopNodeWatchdog(ctx context.Context, label string, token *obmd.Token) error {
+	detail := map[string]string{"action": "stop"}
+	err := d.withPowerOp(ctx, label, token, "watchdog", detail, func(ctx context.Context, node *Node) error {
+		w, ok := node.OBM.(driver.Watchdog)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return w.StopWatchdog(ctx)
+	})
+	if err == nil {
+		d.publish("watchdog_stopped", label, nil)
+	}
+	return err
+}
+
+// Report the node's power restore policy; see driver.PowerRestorer. This
+// is an admin operation, so needs no token.
+func (d *LocalDaemon) NodePowerRestorePolicy(ctx context.Context, label string) (policy driver.PowerRestorePolicy, err error) {
+	err = d.withOBM(ctx, label, nil, func(ctx context.Context, node *Node) error {
+		r, ok := node.OBM.(driver.PowerRestorer)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		policy, err = r.PowerRestorePolicy(ctx)
+		return err
+	})
+	return policy, err
+}
+
+// Set the node's power restore policy; see driver.PowerRestorer. This is
+// an admin operation, so needs no token.
+func (d *LocalDaemon) SetNodePowerRestorePolicy(ctx context.Context, label string, policy driver.PowerRestorePolicy) error {
+	if !policy.Valid() {
+		return driver.ErrInvalidPowerRestorePolicy
+	}
+	err := d.withOBM(ctx, label, nil, func(ctx context.Context, node *Node) error {
+		r, ok := node.OBM.(driver.PowerRestorer)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return r.SetPowerRestorePolicy(ctx, policy)
+	})
+	if err == nil {
+		d.publish("power_restore_policy_set", label, map[string]string{"policy": string(policy)})
+	}
+	return err
+}
+
+// Read the node's power consumption; see driver.PowerMeter.
+func (d *LocalDaemon) NodePowerReading(ctx context.Context, label string, token *obmd.Token) (reading driver.PowerReading, err error) {
+	err = d.withOBM(ctx, label, token, func(ctx context.Context, node *Node) error {
+		m, ok := node.OBM.(driver.PowerMeter)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		reading, err = m.PowerReading(ctx)
+		return err
+	})
+	return reading, err
+}
+
+// Set or remove the node's power limit; see driver.PowerMeter. The limits
+// of nodes in power groups are set by their groups, so can't be set
+// directly; this returns ErrGroupPowerLimit for them.
+func (d *LocalDaemon) SetNodePowerLimit(ctx context.Context, label string, watts int, token *obmd.Token) error {
+	if group, err := d.state.PowerGroupOf(label); err != nil {
+		return err
+	} else if group != "" {
+		return obmd.ErrGroupPowerLimit
+	}
+	detail := map[string]string{"watts": strconv.Itoa(watts)}
+	err := d.withPowerOp(ctx, label, token, "power_limit", detail, func(ctx context.Context, node *Node) error {
+		m, ok := node.OBM.(driver.PowerMeter)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return m.SetPowerLimit(ctx, watts)
+	})
+	if err == nil {
+		d.publish("power_limit_set", label, detail)
+	}
+	return err
+}
+
+// Describe what the node's OBM supports.
+func (d *LocalDaemon) NodeCapabilities(ctx context.Context, label string, token *obmd.Token) (caps obmd.Capabilities, err error) {
+	err = d.withOBM(ctx, label, token, func(ctx context.Context, node *Node) error {
+		if l, ok := node.OBM.(driver.Limited); ok {
+			caps.Unsupported = l.Unsupported()
+		}
+		if l, ok := node.OBM.(driver.BootdevLister); ok {
+			caps.BootDevices, err = l.Bootdevs(ctx)
+			if err == driver.ErrNotSupported {
+				err = nil
+			}
+		}
+		return err
+	})
+	return caps, err
+}
+
+func (d *LocalDaemon) SetNodeBootDev(ctx context.Context, label string, dev string, token *obmd.Token) error {
+	detail := map[string]string{"bootdev": dev}
+	err := d.withPowerOp(ctx, label, token, "boot_device", detail, func(ctx context.Context, node *Node) error {
+		if err := driver.CheckSupported(node.OBM, driver.OpSetBootdev); err != nil {
+			return err
+		}
+		return node.OBM.SetBootdev(ctx, dev)
+	})
+	if err == nil {
+		d.publish("bootdev_set", label, detail)
+	}
+	return err
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/api"
+)
+
+// Response body for the node debugging endpoint. Maps node labels to
+// driver-specific information about their state.
+type DebugNodesResp struct {
+	Nodes map[string]map[string]interface{} `json:"nodes"`
+}
+
+// Make the handler for the debug listener. This exposes net/http/pprof
+// (including goroutine dumps, via /debug/pprof/goroutine?debug=2),
+// /debug/nodes, which reports the state of each node's OBM, and expvar's
+// /debug/vars, which includes the usage of the process limits. As with the
+// admin api, everything requires admin credentials, and returns 404
+// otherwise. If faults is not nil, /debug/faults manages its rules.
+func makeDebugHandler(config *LiveConfig, daemon *LocalDaemon, faults *FaultInjector) http.Handler {
+	r := mux.NewRouter()
+	adminR := r.MatcherFunc(func(req *http.Request, m *mux.RouteMatch) bool {
+		return api.IsAdmin(req, config.Get().AdminToken)
+	}).Subrouter()
+
+	adminR.Path("/debug/pprof/cmdline").HandlerFunc(pprof.Cmdline)
+	adminR.Path("/debug/pprof/profile").HandlerFunc(pprof.Profile)
+	adminR.Path("/debug/pprof/symbol").HandlerFunc(pprof.Symbol)
+	adminR.Path("/debug/pprof/trace").HandlerFunc(pprof.Trace)
+	// pprof.Index also serves the named profiles, e.g. /debug/pprof/heap:
+	adminR.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	adminR.Methods("GET").Path("/debug/vars").Handler(expvar.Handler())
+
+	adminR.Methods("GET").Path("/debug/nodes").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&DebugNodesResp{
+				Nodes: daemon.InspectNodes(),
+			})
+		})
+
+	if faults == nil {
+		return r
+	}
+	adminR.Methods("GET").Path("/debug/faults").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&FaultsArgs{Faults: faults.Rules()})
+		})
+	adminR.Methods("PUT").Path("/debug/faults").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args FaultsArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err == nil {
+				err = faults.SetRules(args.Faults)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		})
+	adminR.Methods("DELETE").Path("/debug/faults").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			faults.SetRules(nil)
+		})
+
+	return r
+}
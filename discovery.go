@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Describe the nodes for Prometheus service discovery: one target group
+// per node (including quarantined ones), sorted by label, whose target is
+// the node's label. The groups' labels are:
+//
+//   - __meta_obmd_node: the node's label.
+//   - __meta_obmd_driver: the node's OBM type, e.g. "ipmi".
+//   - __meta_obmd_addr: the OBM's address, if its info has an "addr"
+//     field (as the ipmi driver's does).
+//   - __meta_obmd_quarantined: "true" or "false".
+//
+// Nothing else from the node's info (e.g. credentials) is included.
+func (d *LocalDaemon) PrometheusTargets() []obmd.PrometheusTargetGroup {
+	ret := []obmd.PrometheusTargetGroup{}
+	for label, node := range d.state.Nodes() {
+		var info struct {
+			Type string `json:"type"`
+			Info struct {
+				Addr string `json:"addr"`
+			} `json:"info"`
+		}
+		// Other drivers' info may not be an object; we take what we
+		// can get.
+		json.Unmarshal(node.ConnInfo, &info)
+		group := obmd.PrometheusTargetGroup{
+			Targets: []string{label},
+			Labels: map[string]string{
+				"__meta_obmd_node":        label,
+				"__meta_obmd_driver":      info.Type,
+				"__meta_obmd_quarantined": "false",
+			},
+		}
+		if info.Info.Addr != "" {
+			group.Labels["__meta_obmd_addr"] = info.Info.Addr
+		}
+		ret = append(ret, group)
+	}
+	for label := range d.state.QuarantinedNodes() {
+		ret = append(ret, obmd.PrometheusTargetGroup{
+			Targets: []string{label},
+			Labels: map[string]string{
+				"__meta_obmd_node":        label,
+				"__meta_obmd_quarantined": "true",
+			},
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Targets[0] < ret[j].Targets[0]
+	})
+	return ret
+}
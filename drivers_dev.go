@@ -0,0 +1,18 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/dummy"
+	"github.com/CCI-MOC/obmd/internal/driver/mock"
+)
+
+// Drivers for testing & development. These are only included in builds
+// with the "dev" tag, so that production binaries can't register fake
+// nodes.
+var devDrivers = driver.Registry{
+	"dummy": dummy.Driver,
+	"mock":  mock.Driver,
+}
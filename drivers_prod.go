@@ -0,0 +1,12 @@
+//go:build !dev
+// +build !dev
+
+package main
+
+import (
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Production builds don't include any development drivers; see
+// drivers_dev.go.
+var devDrivers = driver.Registry{}
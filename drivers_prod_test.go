@@ -0,0 +1,25 @@
+//go:build !dev
+// +build !dev
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/CCI-MOC/obmd/internal/api"
+)
+
+// A production build must not allow registering nodes with the development
+// drivers.
+func TestNoDevDrivers(t *testing.T) {
+	daemon := newTestDaemon()
+	daemon.state.driver = newRegistry(NewLiveConfig(theConfig), newProcLimits(theConfig))
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	for _, typ := range []string{"mock", "dummy"} {
+		adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+			"PUT", "http://localhost/node/somenode",
+			`{"type": "` + typ + `", "info": {"addr": "10.0.0.3"}}`,
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The operations faults may be injected into, as named in FaultRule.Op.
+var faultOps = []string{
+	"dial_console",
+	"power_off",
+	"soft_power_off",
+	"power_cycle",
+	"set_bootdev",
+	"power_status",
+	"power_reading",
+	"set_power_limit",
+	"lan_config",
+	"bmc_users",
+	"change_password",
+	"bootdevs",
+	"bootdev",
+	"power_restore_policy",
+	"set_power_restore_policy",
+	"model",
+	"watchdog_status",
+	"arm_watchdog",
+	"reset_watchdog",
+	"stop_watchdog",
+	"firmware_versions",
+	"update_firmware",
+	"event_log",
+}
+
+// A rule for injecting faults into OBM operations, for testing how clients
+// cope with misbehaving OBMs. Empty Node, Driver and Op fields match
+// anything.
+type FaultRule struct {
+	Node   string `json:"node"`
+	Driver string `json:"driver"` // the node's OBM type, e.g. "ipmi".
+	Op     string `json:"op"`     // one of faultOps.
+
+	// Wait this long before doing the operation (or failing it). If the
+	// operation's context expires first, it fails with a timeout.
+	Delay obmd.Duration `json:"delay"`
+
+	// If set, fail the operation with this error message, rather than
+	// doing it.
+	Error string `json:"error"`
+
+	// If set, garble the result of the operation: the power state is
+	// flipped, power readings are negated, and console output has bits
+	// flipped at random. Other operations are unaffected.
+	Corrupt bool `json:"corrupt"`
+
+	// The chance (between 0 and 1) that the rule applies to each matching
+	// operation. Zero means always.
+	Probability float64 `json:"probability"`
+
+	// If non-zero, the rule is removed after applying this many times.
+	Count int `json:"count"`
+}
+
+// Request and response body for the fault injection debugging endpoint.
+type FaultsArgs struct {
+	Faults []FaultRule `json:"faults"`
+}
+
+// Check that r is a valid rule.
+func (r *FaultRule) Validate() error {
+	if r.Op != "" {
+		valid := false
+		for _, op := range faultOps {
+			valid = valid || r.Op == op
+		}
+		if !valid {
+			return fmt.Errorf("Unknown op %q.", r.Op)
+		}
+	}
+	switch {
+	case r.Delay < 0:
+		return errors.New("delay must not be negative.")
+	case r.Probability < 0 || r.Probability > 1:
+		return errors.New("probability must be between 0 and 1.")
+	case r.Count < 0:
+		return errors.New("count must not be negative.")
+	case r.Delay == 0 && r.Error == "" && !r.Corrupt:
+		return errors.New("At least one of delay, error and corrupt must be set.")
+	}
+	return nil
+}
+
+func (r *FaultRule) matches(label, typ, op string) bool {
+	return (r.Node == "" || r.Node == label) &&
+		(r.Driver == "" || r.Driver == typ) &&
+		(r.Op == "" || r.Op == op)
+}
+
+// The fault injection rules in effect. The zero value has none.
+type FaultInjector struct {
+	sync.Mutex
+	rules []FaultRule
+}
+
+// Return the rules in effect.
+func (f *FaultInjector) Rules() []FaultRule {
+	f.Lock()
+	defer f.Unlock()
+	return append([]FaultRule{}, f.rules...)
+}
+
+// Replace the rules in effect. Returns an error (leaving the rules as they
+// were) if any rule is invalid.
+func (f *FaultInjector) SetRules(rules []FaultRule) error {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return fmt.Errorf("Fault %d: %v", i, err)
+		}
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.rules = append([]FaultRule(nil), rules...)
+	return nil
+}
+
+// Return the first rule which applies to an operation, if any, counting it
+// against the rule's Count.
+func (f *FaultInjector) pick(label, typ, op string) (FaultRule, bool) {
+	f.Lock()
+	defer f.Unlock()
+	for i := range f.rules {
+		r := &f.rules[i]
+		if !r.matches(label, typ, op) {
+			continue
+		}
+		if r.Probability != 0 && rand.Float64() >= r.Probability {
+			continue
+		}
+		picked := *r
+		if r.Count != 0 {
+			r.Count--
+			if r.Count == 0 {
+				f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			}
+		}
+		return picked, true
+	}
+	return FaultRule{}, false
+}
+
+// Wrap a node's OBM such that its operations are subject to the injector's
+// rules. info is the node's stored info, which names its driver. This is
+// suitable for StateOptions.WrapOBM.
+func (f *FaultInjector) WrapOBM(label string, info []byte, obm driver.OBM) driver.OBM {
+	var typ struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(info, &typ)
+	o := faultOBM{faults: f, label: label, typ: typ.Type}
+	o.Wrapped = driver.Wrapped{OBM: obm, Hook: o.hook}
+	return o
+}
+
+// An OBM whose operations are subject to a FaultInjector. Operations whose
+// results may be garbled override driver.Wrapped's methods; the others
+// go through hook.
+type faultOBM struct {
+	driver.Wrapped
+	faults *FaultInjector
+	label  string
+	typ    string
+}
+
+// Apply any rule matching op, as a driver.Hook, unless op isn't one of
+// faultOps.
+func (o faultOBM) hook(ctx context.Context, op string, call func() error) error {
+	for _, faultOp := range faultOps {
+		if op == faultOp {
+			if _, err := o.inject(ctx, op); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return call()
+}
+
+// Apply any rule matching op: wait out its delay, then return its error,
+// if any. corrupt reports whether the result should be garbled.
+func (o faultOBM) inject(ctx context.Context, op string) (corrupt bool, err error) {
+	rule, ok := o.faults.pick(o.label, o.typ, op)
+	if !ok {
+		return false, nil
+	}
+	logger.Debug("Injecting fault",
+		"node", o.label, "op", op, "delay", time.Duration(rule.Delay),
+		"error", rule.Error, "corrupt", rule.Corrupt)
+	if rule.Delay > 0 {
+		timer := time.NewTimer(time.Duration(rule.Delay))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false, ctx.Err()
+		}
+	}
+	if rule.Error != "" {
+		return false, errors.New(rule.Error)
+	}
+	return rule.Corrupt, nil
+}
+
+func (o faultOBM) DialConsole(ctx context.Context) (io.ReadCloser, error) {
+	corrupt, err := o.inject(ctx, "dial_console")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := o.OBM.DialConsole(ctx)
+	return garble(conn, corrupt), err
+}
+
+func (o faultOBM) PowerStatus(ctx context.Context) (driver.PowerState, error) {
+	corrupt, err := o.inject(ctx, "power_status")
+	if err != nil {
+		return driver.PowerStateUnknown, err
+	}
+	state, err := o.OBM.PowerStatus(ctx)
+	if corrupt {
+		switch state {
+		case driver.PowerStateOn:
+			state = driver.PowerStateOff
+		case driver.PowerStateOff:
+			state = driver.PowerStateOn
+		}
+	}
+	return state, err
+}
+
+func (o faultOBM) DialConsoleReplay(ctx context.Context, replay int) (io.ReadCloser, error) {
+	corrupt, err := o.inject(ctx, "dial_console")
+	if err != nil {
+		return nil, err
+	}
+	var conn io.ReadCloser
+	if r, ok := o.OBM.(driver.ConsoleReplayer); ok {
+		conn, err = r.DialConsoleReplay(ctx, replay)
+	} else {
+		conn, err = o.OBM.DialConsole(ctx)
+	}
+	return garble(conn, corrupt), err
+}
+
+func (o faultOBM) PowerReading(ctx context.Context) (reading driver.PowerReading, err error) {
+	m, ok := o.OBM.(driver.PowerMeter)
+	if !ok {
+		return reading, driver.ErrNotSupported
+	}
+	corrupt, err := o.inject(ctx, "power_reading")
+	if err != nil {
+		return reading, err
+	}
+	reading, err = m.PowerReading(ctx)
+	if corrupt {
+		reading.Watts = -reading.Watts
+		reading.Min = -reading.Min
+		reading.Max = -reading.Max
+		reading.Average = -reading.Average
+	}
+	return reading, err
+}
+
+// Return conn, with its output garbled if corrupt is true.
+func garble(conn io.ReadCloser, corrupt bool) io.ReadCloser {
+	if conn == nil || !corrupt {
+		return conn
+	}
+	return garbledConn{conn}
+}
+
+// A console connection which flips a random bit in about one byte in 16
+// of its output.
+type garbledConn struct {
+	io.ReadCloser
+}
+
+func (c garbledConn) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	for i := range p[:n] {
+		if rand.Intn(16) == 0 {
+			p[i] ^= 1 << uint(rand.Intn(8))
+		}
+	}
+	return n, err
+}
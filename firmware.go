@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The states of a FirmwareRollout.
+const (
+	rolloutRunning = "running"
+	rolloutDone    = "done"
+	rolloutHalted  = "halted" // a node failed, so later nodes were skipped.
+)
+
+// The states of a node in a FirmwareRollout.
+const (
+	firmwarePending   = "pending"
+	firmwareUpdating  = "updating"
+	firmwareVerifying = "verifying"
+	firmwareDone      = "done"
+	firmwareFailed    = "failed"
+	firmwareSkipped   = "skipped"
+)
+
+// The firmware rollouts started since the daemon started.
+type rolloutRegistry struct {
+	sync.Mutex
+	nextID   uint64
+	rollouts []*obmd.FirmwareRollout
+}
+
+// Return a copy of r, which the caller must have locked the registry to
+// read.
+func copyRollout(r *obmd.FirmwareRollout) obmd.FirmwareRollout {
+	ret := *r
+	ret.Nodes = append([]obmd.FirmwareNodeStatus(nil), r.Nodes...)
+	return ret
+}
+
+// Report the versions of the node's firmware; see driver.FirmwareInspector.
+// This is an admin operation, so needs no token.
+func (d *LocalDaemon) NodeFirmwareVersions(ctx context.Context, label string) (versions map[string]string, err error) {
+	err = d.withOBM(ctx, label, nil, func(ctx context.Context, node *Node) error {
+		i, ok := node.OBM.(driver.FirmwareInspector)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		versions, err = i.FirmwareVersions(ctx)
+		return err
+	})
+	return versions, err
+}
+
+// Install the image read from r as the firmware for component on the node;
+// see driver.FirmwareUpdater. This is an admin operation, so needs no token.
+// Other operations on the node wait until it is done.
+func (d *LocalDaemon) UpdateNodeFirmware(ctx context.Context, label, component string, r io.Reader) error {
+	err := d.withOBM(ctx, label, nil, func(ctx context.Context, node *Node) error {
+		u, ok := node.OBM.(driver.FirmwareUpdater)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return u.UpdateFirmware(ctx, component, r)
+	})
+	if err == nil {
+		d.publish("firmware_updated", label, map[string]string{"component": component})
+	}
+	return err
+}
+
+// Start installing the image at imagePath as the firmware for component
+// on each of the nodes `labels`, in that order, `groupSize` nodes at a
+// time (one if zero), allowing each node up to `timeout` (if non-zero).
+// After updating each node, check that it reports `version`; if any node
+// in a group fails, the rollout halts, and later nodes are skipped. The
+// rollout runs in the background; its progress is reported by
+// FirmwareRollout.
+func (d *LocalDaemon) StartFirmwareRollout(component, imagePath, version string, labels []string, groupSize int, timeout time.Duration) (obmd.FirmwareRollout, error) {
+	if info, err := os.Stat(imagePath); os.IsNotExist(err) || err == nil && info.IsDir() {
+		return obmd.FirmwareRollout{}, obmd.ErrNoSuchImage
+	} else if err != nil {
+		return obmd.FirmwareRollout{}, err
+	}
+	d.RLock()
+	if d.closed {
+		d.RUnlock()
+		return obmd.FirmwareRollout{}, obmd.ErrShuttingDown
+	}
+	for _, label := range labels {
+		if _, err := d.state.GetNode(label); err != nil {
+			d.RUnlock()
+			return obmd.FirmwareRollout{}, err
+		}
+	}
+	d.RUnlock()
+
+	if groupSize == 0 {
+		groupSize = 1
+	}
+	r := &obmd.FirmwareRollout{
+		Component: component,
+		Image:     filepath.Base(imagePath),
+		Version:   version,
+		GroupSize: groupSize,
+		State:     rolloutRunning,
+		Started:   time.Now().UTC(),
+	}
+	for _, label := range labels {
+		r.Nodes = append(r.Nodes, obmd.FirmwareNodeStatus{Node: label, State: firmwarePending})
+	}
+	d.rollouts.Lock()
+	d.rollouts.nextID++
+	r.ID = strconv.FormatUint(d.rollouts.nextID, 10)
+	d.rollouts.rollouts = append(d.rollouts.rollouts, r)
+	ret := copyRollout(r)
+	d.rollouts.Unlock()
+
+	go d.runRollout(r, imagePath, timeout)
+	return ret, nil
+}
+
+// Return the rollouts started since the daemon started, oldest first.
+func (d *LocalDaemon) FirmwareRollouts() []obmd.FirmwareRollout {
+	d.rollouts.Lock()
+	defer d.rollouts.Unlock()
+	ret := make([]obmd.FirmwareRollout, 0, len(d.rollouts.rollouts))
+	for _, r := range d.rollouts.rollouts {
+		ret = append(ret, copyRollout(r))
+	}
+	return ret
+}
+
+// Return the rollout with the given ID.
+func (d *LocalDaemon) FirmwareRollout(id string) (obmd.FirmwareRollout, error) {
+	d.rollouts.Lock()
+	defer d.rollouts.Unlock()
+	for _, r := range d.rollouts.rollouts {
+		if r.ID == id {
+			return copyRollout(r), nil
+		}
+	}
+	return obmd.FirmwareRollout{}, obmd.ErrNoSuchRollout
+}
+
+// Carry out the rollout r; see StartFirmwareRollout.
+func (d *LocalDaemon) runRollout(r *obmd.FirmwareRollout, imagePath string, timeout time.Duration) {
+	log := logger.With("subsystem", "firmware", "rollout", r.ID)
+	log.Info("Starting firmware rollout", "component", r.Component,
+		"image", r.Image, "nodes", len(r.Nodes))
+	state := rolloutDone
+	for start := 0; start < len(r.Nodes); start += r.GroupSize {
+		end := start + r.GroupSize
+		if end > len(r.Nodes) {
+			end = len(r.Nodes)
+		}
+		if state == rolloutHalted {
+			d.setRolloutNode(r, start, end, func(s *obmd.FirmwareNodeStatus) {
+				s.State = firmwareSkipped
+			})
+			continue
+		}
+		errs := make([]error, end-start)
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i-start] = d.rollOutTo(r, i, imagePath, timeout)
+			}(i)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				log.Warn("Firmware update failed", "node", r.Nodes[start+i].Node, "err", err)
+				state = rolloutHalted
+			}
+		}
+	}
+	d.rollouts.Lock()
+	r.State = state
+	d.rollouts.Unlock()
+	log.Info("Firmware rollout finished", "state", state)
+}
+
+// Update the firmware of r's i'th node, recording its progress, and
+// return any error.
+func (d *LocalDaemon) rollOutTo(r *obmd.FirmwareRollout, i int, imagePath string, timeout time.Duration) error {
+	label := r.Nodes[i].Node
+	setState := func(state string) {
+		d.setRolloutNode(r, i, i+1, func(s *obmd.FirmwareNodeStatus) { s.State = state })
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	setState(firmwareUpdating)
+	err := func() error {
+		f, err := os.Open(imagePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return d.UpdateNodeFirmware(ctx, label, r.Component, f)
+	}()
+	var version string
+	if err == nil {
+		setState(firmwareVerifying)
+		var versions map[string]string
+		versions, err = d.NodeFirmwareVersions(ctx, label)
+		version = versions[r.Component]
+		if err == nil && version != r.Version {
+			err = fmt.Errorf("Firmware version is %q after the update; expected %q.",
+				version, r.Version)
+		}
+	}
+	d.setRolloutNode(r, i, i+1, func(s *obmd.FirmwareNodeStatus) {
+		s.State = firmwareDone
+		s.Version = version
+		if err != nil {
+			s.State = firmwareFailed
+			s.Error = err.Error()
+		}
+	})
+	return err
+}
+
+// Call fn on the status of each of r's nodes from start up to end.
+func (d *LocalDaemon) setRolloutNode(r *obmd.FirmwareRollout, start, end int, fn func(*obmd.FirmwareNodeStatus)) {
+	d.rollouts.Lock()
+	defer d.rollouts.Unlock()
+	for i := start; i < end; i++ {
+		fn(&r.Nodes[i])
+	}
+}
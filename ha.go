@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// The advisory lock key used for leader election if Config.HALockKey is
+// not set. It is "obmd" in ASCII.
+const defaultHALockKey = 0x6f626d64
+
+// Leadership of a group of obmd instances sharing a postgres database.
+//
+// Leadership is held via a session-level advisory lock on a dedicated
+// database connection. If the leader dies, postgres ends its session,
+// releasing the lock, and one of the standbys acquires it.
+//
+// The connection is held for as long as the leader runs, so it should
+// come from a pool of its own: taken from the main pool, it would leave
+// one connection fewer for everything else, or none with MaxOpenConns 1.
+type leaderLock struct {
+	conn *sql.Conn
+}
+
+// Block until we become the leader. db should be used for nothing else;
+// see leaderLock.
+func acquireLeadership(ctx context.Context, db *sql.DB, key int64) (*leaderLock, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &leaderLock{conn: conn}, nil
+}
+
+// Check the lock's connection every `interval`. If the connection fails,
+// we must assume that postgres has released the lock, and that a standby
+// may have taken over; the returned channel then receives the error.
+func (l *leaderLock) watch(interval time.Duration) <-chan error {
+	lost := make(chan error, 1)
+	go func() {
+		for {
+			time.Sleep(interval)
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := l.conn.PingContext(ctx)
+			cancel()
+			if err != nil {
+				lost <- err
+				return
+			}
+		}
+	}()
+	return lost
+}
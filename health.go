@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// How many nodes may be health checked (or have their event logs read) at
+// once; see forEachNode.
+const healthCheckConcurrency = 16
+
+// Settings for periodic checks of every node; see SetHealthChecks and
+// SetSELMonitoring.
+type pollSettings struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// Periodically check the health of every node's OBM, by asking for the
+// node's power status: every `interval` (zero disables the checks), with
+// each check allowed up to `timeout` (zero means no limit). The results
+// are available from NodeHealth, and changes in the nodes' power states
+// from NodePowerHistory. Failed checks count as OBM failures for the
+// alerter (see SetAlerter). This may be called at any time.
+func (d *LocalDaemon) SetHealthChecks(interval, timeout time.Duration) {
+	d.healthLock.Lock()
+	d.healthSettings = pollSettings{interval: interval, timeout: timeout}
+	d.healthLock.Unlock()
+	select {
+	case d.healthWake <- struct{}{}:
+	default:
+	}
+}
+
+// Return the results of the latest health check of each (non-quarantined)
+// node which has been checked.
+func (d *LocalDaemon) NodeHealth() map[string]obmd.NodeHealth {
+	return d.state.Health()
+}
+
+// Run health checks according to the current settings, until the daemon
+// is closed.
+func (d *LocalDaemon) monitorHealth() {
+	for {
+		d.healthLock.Lock()
+		settings := d.healthSettings
+		d.healthLock.Unlock()
+		var tick <-chan time.Time
+		if settings.interval != 0 {
+			tick = time.After(settings.interval)
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-d.healthWake:
+		case <-tick:
+			d.checkHealth(settings.timeout)
+		}
+	}
+}
+
+// Check the health of every node once, allowing each check up to timeout
+// (if non-zero).
+func (d *LocalDaemon) checkHealth(timeout time.Duration) {
+	d.forEachNode(func(label string) {
+		d.checkNodeHealth(label, timeout)
+	})
+}
+
+// Call fn with the label of each node, up to healthCheckConcurrency at
+// once, returning once all calls have (or, if the daemon is closed
+// meanwhile, once the calls already started have).
+func (d *LocalDaemon) forEachNode(fn func(label string)) {
+	nodes := d.state.Nodes()
+	labels := make([]string, 0, len(nodes))
+	for label := range nodes {
+		labels = append(labels, label)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, healthCheckConcurrency)
+	for _, label := range labels {
+		select {
+		case sem <- struct{}{}:
+		case <-d.stop:
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(label)
+		}(label)
+	}
+	wg.Wait()
+}
+
+// Check the health of a single node. Nothing is recorded if the node no
+// longer exists (or is quarantined), its OBM isn't running (having been
+// stopped for being idle; checks don't count as use, lest they keep it
+// running), or it doesn't support querying the power status.
+func (d *LocalDaemon) checkNodeHealth(label string, timeout time.Duration) {
+	// The timeout is for the OBM; waiting for another operation on the
+	// node to finish doesn't count.
+	d.withOBM(withPassiveUse(context.Background()), label, nil, func(ctx context.Context, node *Node) error {
+		if timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if driver.CheckSupported(node.OBM, driver.OpPowerStatus) != nil {
+			// There's nothing to check.
+			return nil
+		}
+		start := time.Now()
+		power, err := node.OBM.PowerStatus(ctx)
+		d.state.RecordHealth(label, start, time.Since(start), power, err)
+		if err == nil {
+			d.recordPower(label, start, power)
+		}
+		return err
+	})
+}
@@ -0,0 +1,160 @@
+// Package alert sends alerts to operators, by email (SMTP) and/or to a
+// Slack incoming webhook.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Where to send alerts. Each destination which is configured is used.
+type Config struct {
+	// The URL of a Slack incoming webhook (or anything compatible, e.g.
+	// a Mattermost one).
+	SlackWebhook string
+
+	// Email settings; alerts are emailed if SMTP.Addr is set.
+	SMTP SMTPConfig
+}
+
+type SMTPConfig struct {
+	// The mail server's host:port. STARTTLS is used if the server
+	// supports it.
+	Addr string
+
+	// The sender and recipients of alert emails.
+	From string
+	To   []string
+
+	// Credentials, if the server requires them. These are only sent over
+	// TLS.
+	User     string
+	Password string
+}
+
+// Report whether any destination is configured.
+func (c Config) Enabled() bool {
+	return c.SlackWebhook != "" || c.SMTP.Addr != ""
+}
+
+// An alert.
+type Message struct {
+	Subject string // a one-line summary.
+	Body    string
+}
+
+// How long to wait for a destination before giving up.
+const sendTimeout = 30 * time.Second
+
+// Send msg to each destination in cfg, returning an error if sending to
+// any of them failed.
+func Send(ctx context.Context, cfg Config, msg Message) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	var errs []string
+	if cfg.SlackWebhook != "" {
+		if err := sendSlack(ctx, cfg.SlackWebhook, msg); err != nil {
+			errs = append(errs, "slack: "+err.Error())
+		}
+	}
+	if cfg.SMTP.Addr != "" {
+		if err := sendEmail(ctx, cfg.SMTP, msg); err != nil {
+			errs = append(errs, "smtp: "+err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func sendSlack(ctx context.Context, url string, msg Message) error {
+	body, err := json.Marshal(map[string]string{
+		"text": "*" + msg.Subject + "*\n" + msg.Body,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func sendEmail(ctx context.Context, cfg SMTPConfig, msg Message) error {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.User != "" {
+		// PlainAuth refuses to send credentials without TLS (except
+		// to localhost).
+		if err = c.Auth(smtp.PlainAuth("", cfg.User, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		cfg.From, strings.Join(cfg.To, ", "), oneLine(msg.Subject),
+		time.Now().Format(time.RFC1123Z),
+		strings.Replace(msg.Body, "\n", "\r\n", -1))
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Replace line breaks in s with spaces, so that it can't add headers.
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
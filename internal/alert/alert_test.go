@@ -0,0 +1,109 @@
+package alert
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testMsg = Message{Subject: "node-1 is\r\nBcc: evil@example.com", Body: "It broke."}
+
+func TestSlack(t *testing.T) {
+	var text string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct{ Text string }
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		text = body.Text
+	}))
+	defer srv.Close()
+
+	if err := Send(context.Background(), Config{SlackWebhook: srv.URL}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "It broke.") {
+		t.Fatalf("Unexpected message text: %q", text)
+	}
+
+	srv.Config.Handler = http.NotFoundHandler()
+	if Send(context.Background(), Config{SlackWebhook: srv.URL}, testMsg) == nil {
+		t.Fatal("Sending to a webhook which returned 404 succeeded.")
+	}
+}
+
+// Serve one SMTP session on ln, returning the message's data (after
+// dot-unstuffing) on the channel.
+func fakeSMTP(ln net.Listener) <-chan string {
+	ch := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		reply := func(s string) { c.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		var data []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+				reply("250 OK")
+			case "DATA":
+				reply("354 Go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data = append(data, strings.TrimPrefix(line, "."))
+				}
+				reply("250 OK")
+				ch <- strings.Join(data, "")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+	return ch
+}
+
+func TestEmail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	msgs := fakeSMTP(ln)
+	err = Send(context.Background(), Config{SMTP: SMTPConfig{
+		Addr: ln.Addr().String(),
+		From: "obmd@example.com",
+		To:   []string{"ops@example.com"},
+	}}, testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := <-msgs
+	if !strings.Contains(data, "Subject: node-1 is  Bcc: evil@example.com\r\n") ||
+		!strings.Contains(data, "To: ops@example.com\r\n") ||
+		!strings.HasSuffix(data, "It broke.\r\n") {
+		t.Fatalf("Unexpected message:\n%s", data)
+	}
+}
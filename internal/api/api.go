@@ -0,0 +1,701 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/images"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// request body for the power cycle call
+type PowerCycleArgs struct {
+	Force bool `json:"force"`
+}
+
+// Request body for the shutdown call, which is optional.
+type ShutdownArgs struct {
+	// If non-zero, how long to give the node to shut down before
+	// powering it off.
+	Timeout obmd.Duration `json:"timeout"`
+}
+
+// request body for the set bootdev call
+type SetBootdevArgs struct {
+	Dev string `json:"bootdev"`
+}
+
+// Response body for the power status call.
+type PowerResp struct {
+	Power driver.PowerState `json:"power"`
+}
+
+// Request body for the set power limit call.
+type PowerLimitArgs struct {
+	Watts int `json:"watts"`
+}
+
+// Request body for the arm watchdog call.
+type WatchdogArgs struct {
+	Timeout int `json:"timeout"` // seconds
+}
+
+// Response body for a request whose body had the problems listed, e.g.
+// registering a node with invalid info.
+type ProblemsResp struct {
+	Problems []string `json:"problems"`
+}
+
+// Response body for a request which failed for a reason worth explaining,
+// e.g. an operation the node's OBM doesn't support.
+type ErrorResp struct {
+	Error string `json:"error"`
+}
+
+// Request body for renaming a node.
+type RenameArgs struct {
+	Label string `json:"label"` // the new label.
+}
+
+// Request and response body for a node's power restore policy, i.e.
+// what it does when power is restored after an outage.
+type PowerPolicyResp struct {
+	Policy driver.PowerRestorePolicy `json:"policy"` // one of the driver.PowerRestore constants.
+}
+
+// Response body for listing the users on a node's OBM.
+type BMCUsersResp struct {
+	Users []driver.User `json:"users"`
+}
+
+// Request body for changing the password a node's OBM logs in with. If
+// Password is empty, a random one is generated.
+type ChangePasswordArgs struct {
+	Password string `json:"password"`
+}
+
+// Response body for changing the password a node's OBM logs in with, and
+// for reading its pending password.
+type PasswordResp struct {
+	Password string `json:"password"`
+}
+
+// Connection info for an OBM.
+type ConnInfo struct {
+	// The name of the driver to use:
+	Type string `json:"type"`
+
+	// Driver-specific connection info:
+	Info []byte
+}
+
+// Response body for successful new token requests.
+type TokenResp struct {
+	Token   obmd.Token `json:"token"`
+	Version string     `json:"version"` // the node's version; see obmd.Daemon.NodeVersion.
+}
+
+// Response body for listing nodes.
+type NodesResp struct {
+	Nodes []string `json:"nodes"`
+}
+
+// Response body for listing quarantined nodes. Maps node labels to the
+// reason for their quarantine.
+type QuarantineResp struct {
+	Nodes map[string]string `json:"nodes"`
+}
+
+// Response body for reporting a node's firmware versions, keyed by
+// component (e.g. "bmc").
+type FirmwareResp struct {
+	Versions map[string]string `json:"versions"`
+}
+
+// Request body for starting a firmware rollout.
+type FirmwareRolloutArgs struct {
+	Component string   `json:"component"`
+	Image     string   `json:"image"`   // a file name in Settings.FirmwareDir.
+	Version   string   `json:"version"` // the version expected afterwards.
+	Nodes     []string `json:"nodes"`
+	GroupSize int      `json:"group_size"`
+}
+
+// Response body for listing firmware rollouts.
+type FirmwareRolloutsResp struct {
+	Rollouts []obmd.FirmwareRollout `json:"rollouts"`
+}
+
+// Response body for listing images.
+type ImagesResp struct {
+	Images []images.Image `json:"images"`
+}
+
+// Response body for a signed image URL.
+type ImageURLResp struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// Response body for reporting the nodes' health. Maps node labels to the
+// results of their latest health checks.
+type HealthResp struct {
+	Nodes map[string]obmd.NodeHealth `json:"nodes"`
+}
+
+// Response body for reporting the nodes' token usage. Maps node labels to
+// when their tokens were issued and last used.
+type TokenUsageResp struct {
+	Nodes map[string]obmd.TokenUsage `json:"nodes"`
+}
+
+// Request body for the batch power call.
+type BatchPowerArgs struct {
+	Action string   `json:"action"` // "on", "off" or "cycle".
+	Force  bool     `json:"force"`  // for "cycle"; see PowerCycleArgs.
+	Nodes  []string `json:"nodes"`
+}
+
+// The outcome for one node of the batch power call; the response is a
+// sequence of these.
+type BatchPowerResult struct {
+	Node string `json:"node"`
+
+	// The status the call for just this node would have returned.
+	Status int `json:"status"`
+}
+
+// Response body for listing PDUs.
+type PDUsResp struct {
+	PDUs []string `json:"pdus"`
+}
+
+// Response body for listing a PDU's outlets.
+type PDUResp struct {
+	Outlets []obmd.PDUOutlet `json:"outlets"`
+}
+
+// Request body for recording a PDU outlet.
+type PDUOutletArgs struct {
+	Node        string `json:"node"` // empty if it doesn't power a node.
+	Order       int    `json:"order"`
+	Description string `json:"description"`
+}
+
+// Request body for powering the nodes on a PDU.
+type PDUPowerArgs struct {
+	Action string `json:"action"` // as for BatchPowerArgs.
+	Force  bool   `json:"force"`
+}
+
+// The outcome for one outlet of the PDU nodes power call; the response is a
+// sequence of these.
+type PDUPowerResult struct {
+	Outlet string `json:"outlet"`
+	Node   string `json:"node,omitempty"`
+	Status int    `json:"status"`
+}
+
+// Request body for creating or replacing a power group.
+type PowerGroupArgs struct {
+	Budget int      `json:"budget"` // in watts.
+	Nodes  []string `json:"nodes"`
+}
+
+// Response body for listing power groups.
+type PowerGroupsResp struct {
+	Groups []obmd.PowerGroup `json:"groups"`
+}
+
+// The outcome of setting or removing one node's power limit on behalf of a
+// power group.
+type PowerCapStatus struct {
+	Node   string `json:"node"`
+	Watts  int    `json:"watts"`
+	Status int    `json:"status"`
+}
+
+// Response body for changing a power group.
+type PowerCapsResp struct {
+	Caps []PowerCapStatus `json:"caps"`
+}
+
+// Request body for putting a node into maintenance mode.
+type MaintenanceArgs struct {
+	Reason string `json:"reason"`
+}
+
+// Response body for querying a node's maintenance mode.
+type MaintenanceResp struct {
+	Maintenance bool   `json:"maintenance"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Request body for draining a node.
+type DrainArgs struct {
+	Reason string `json:"reason"`
+}
+
+// Response body for querying whether a node is draining.
+type DrainResp struct {
+	Draining bool   `json:"draining"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Request body for moving a node to another project.
+type TransferArgs struct {
+	Project string `json:"project"`
+}
+
+// Response body for querying which project owns a node.
+type OwnerResp struct {
+	Project   string              `json:"project"`
+	Transfers []obmd.NodeTransfer `json:"transfers"`
+}
+
+// Request body for the console expect call.
+type ExpectArgs struct {
+	// Regular expression (RE2 syntax) to wait for.
+	Pattern string `json:"pattern"`
+
+	// How long to wait; zero means until the client gives up.
+	Timeout obmd.Duration `json:"timeout"`
+
+	// Number of lines preceding the match to return.
+	Context int `json:"context"`
+
+	// Number of bytes of recent output to search as well, if the server
+	// keeps console history; see the console call.
+	Replay int `json:"replay"`
+
+	// Whether to remove escape sequences and control characters before
+	// matching; see consoleio.Sanitizer.
+	Sanitize bool `json:"sanitize"`
+}
+
+// Response body for listing console connections.
+type ConsolesResp struct {
+	Sessions []obmd.ConsoleSession `json:"sessions"`
+}
+
+// Response body for a node's console audit.
+type ConsoleAuditResp struct {
+	Sessions []obmd.ConsoleAuditRecord `json:"sessions"`
+}
+
+// Response body for comparing a snapshot with the current one; see
+// diffSnapshots.
+type SnapshotDiffResp struct {
+	Changes []SnapshotChange `json:"changes"`
+}
+
+// An io.Writer which records whether anything has been written to it.
+// This is used to tell whether it is still possible to report an error
+// via the http status code.
+type trackingWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	t.wrote = true
+	return t.w.Write(p)
+}
+
+// Parse a size in bytes, with an optional suffix "k" or "m" (case
+// insensitive) for KiB or MiB, e.g. "64k".
+func parseSize(text string) (int, error) {
+	mult := 1
+	switch strings.ToLower(text[len(text)-1:]) {
+	case "k":
+		mult = 1 << 10
+	case "m":
+		mult = 1 << 20
+	}
+	if mult != 1 {
+		text = text[:len(text)-1]
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("Size must not be negative: %d", n)
+	}
+	return n * mult, nil
+}
+
+// Check the arguments for starting a firmware rollout. The image must be
+// a plain file name, so that only images in Settings.FirmwareDir can be
+// installed.
+func checkFirmwareRolloutArgs(args FirmwareRolloutArgs) error {
+	switch {
+	case args.Component == "" || args.Version == "":
+		return errors.New("A component and version must be given.")
+	case args.Image == "" || args.Image == "." || args.Image == ".." ||
+		strings.ContainsAny(args.Image, `/\`):
+		return fmt.Errorf("Invalid image name %q.", args.Image)
+	case len(args.Nodes) == 0:
+		return errors.New("No nodes given.")
+	case args.GroupSize < 0:
+		return errors.New("Group size must not be negative.")
+	}
+	seen := make(map[string]bool, len(args.Nodes))
+	for _, label := range args.Nodes {
+		if seen[label] {
+			return fmt.Errorf("Node %q is listed twice.", label)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+// The longest X-Request-ID header accepted from clients; see requestID.
+const maxRequestIDLength = 64
+
+// The status recorded for requests abandoned because the client closed the
+// connection, following nginx. There is no standard status for this.
+const StatusClientClosedRequest = 499
+
+// Format d for a Retry-After header, in whole seconds, rounded up.
+func retryAfter(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// Report whether req is authenticated as the admin, whose token is
+// adminToken.
+func IsAdmin(req *http.Request, adminToken obmd.Token) bool {
+	user, pass, ok := req.BasicAuth()
+	if !(ok && user == "admin") {
+		return false
+	}
+	var tok obmd.Token
+	err := (&tok).UnmarshalText([]byte(pass))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(tok[:], adminToken[:]) == 1
+}
+
+// Which parts of the api a handler serves; see NewHandler.
+type Parts int
+
+const (
+	AdminAPI Parts = 1 << iota
+	UserAPI
+
+	AllAPI = AdminAPI | UserAPI
+)
+
+// The settings the api's handlers use, taken from the daemon's config; see
+// the Config fields of the same names (the image settings are in
+// Config.Images). Zero values have the same meaning as there.
+type Settings struct {
+	AdminToken obmd.Token
+
+	OperationTimeout    time.Duration
+	WriteTimeout        time.Duration
+	MaxRequestBodyBytes int64
+	IdempotencyWindow   time.Duration
+
+	Redfish bool
+	WebUI   bool
+
+	ConsoleRecordDir string
+
+	FirmwareDir           string
+	FirmwareUpdateTimeout time.Duration
+
+	// The database to back up.
+	DBType string
+	DBPath string
+
+	// Where the images are served from; nil if they aren't.
+	Images           images.Store
+	ImageBaseURL     string
+	ImageURLLifetime time.Duration
+}
+
+// The dependencies of the api's handlers, which they reach through the
+// methods of this type; see NewHandler. The routes for each kind of
+// resource are registered by methods in their own files, e.g. nodeRoutes.
+type api struct {
+	daemon   obmd.Daemon
+	settings func() *Settings
+	snapshot func() interface{}
+	log      *logger.Logger
+
+	// Deduplicates retries of requests made with an Idempotency-Key; see
+	// idempotent.
+	idempotency *idempotencyCache
+}
+
+// Return the http status for an error returned by a Daemon method,
+// logging unexpected errors with the fields carried by ctx.
+func (a *api) errorStatus(ctx context.Context, desc string, err error) int {
+	switch err.(type) {
+	case obmd.PowerCycleRateError:
+		return http.StatusTooManyRequests
+	case obmd.InvalidLabelError:
+		return http.StatusBadRequest
+	case *driver.InvalidInfoError:
+		return http.StatusUnprocessableEntity
+	case driver.UnsupportedError:
+		return http.StatusNotImplemented
+	case obmd.PolicyDeniedError:
+		return http.StatusForbidden
+	}
+	switch err {
+	case nil:
+		return http.StatusOK
+	case obmd.ErrNodeExists:
+		return http.StatusConflict
+	case obmd.ErrNoSuchNode, obmd.ErrNoSuchConsole, obmd.ErrNoSuchRollout, obmd.ErrNoSuchPDU, obmd.ErrNoSuchOutlet,
+		obmd.ErrNoSuchPowerGroup, obmd.ErrNoPendingPassword:
+		return http.StatusNotFound
+	case obmd.ErrInvalidToken:
+		return http.StatusUnauthorized
+	case obmd.ErrNodeQuarantined, obmd.ErrNodeDraining, driver.ErrNoConsole, driver.ErrConsoleInUse,
+		obmd.ErrNodeInPowerGroup, obmd.ErrPasswordPending, obmd.ErrGroupPowerLimit:
+		return http.StatusConflict
+	case obmd.ErrNodeInMaintenance:
+		return http.StatusLocked
+	case obmd.ErrVersionMismatch:
+		return http.StatusPreconditionFailed
+	case obmd.ErrShuttingDown, obmd.ErrPolicyUnavailable:
+		return http.StatusServiceUnavailable
+	case driver.ErrInvalidBootdev, driver.ErrUnknownType, driver.ErrInvalidPassword,
+		driver.ErrInvalidPowerRestorePolicy, driver.ErrInvalidWatchdogTimeout,
+		obmd.ErrInvalidShutdownTimeout, obmd.ErrWatchdogTimeoutTooShort, obmd.ErrNoSuchImage, obmd.ErrInvalidOutletName,
+		obmd.ErrInvalidPowerBudget, obmd.ErrInvalidGroupName:
+		return http.StatusBadRequest
+	case obmd.ErrBackupUnsupported, driver.ErrNotSupported, obmd.ErrOutletNotSwitchable:
+		return http.StatusNotImplemented
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case context.Canceled:
+		// The client went away, so won't see this, but it
+		// shouldn't be logged as an error.
+		return StatusClientClosedRequest
+	default:
+		a.log.WithContext(ctx).Error("Unexpected error returned", "op", desc, "err", err)
+		return http.StatusInternalServerError
+	}
+}
+
+// Handle the errors returned by Daemon methods while serving req, reporting the
+// correct http status. This calls w.WriteHeader, so headers must be set before
+// calling this method.
+func (a *api) relayError(w http.ResponseWriter, req *http.Request, desc string, err error) {
+	if e, ok := err.(obmd.PowerCycleRateError); ok {
+		w.Header().Set("Retry-After", retryAfter(e.RetryAfter))
+	}
+	status := a.errorStatus(req.Context(), desc, err)
+	e, invalidInfo := err.(*driver.InvalidInfoError)
+	_, denied := err.(obmd.PolicyDeniedError)
+	explain := status == http.StatusNotImplemented || denied
+	if invalidInfo || explain {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	switch {
+	case invalidInfo:
+		json.NewEncoder(w).Encode(&ProblemsResp{Problems: e.Problems})
+	case explain:
+		json.NewEncoder(w).Encode(&ErrorResp{Error: err.Error()})
+	}
+}
+
+// Return a context for an OBM operation made on behalf of req, which
+// is subject to the configured OperationTimeout. The caller must call
+// the returned CancelFunc when the operation is complete.
+func (a *api) opContext(req *http.Request) (context.Context, context.CancelFunc) {
+	timeout := a.settings().OperationTimeout
+	if timeout == 0 {
+		return context.WithCancel(req.Context())
+	}
+	return context.WithTimeout(req.Context(), timeout)
+}
+
+// Wrap a handler for a non-streaming request, applying the configured
+// limits on request body size and the time taken to write the response.
+// Streaming responses (the console & backups) can legitimately take
+// arbitrarily long, so they are exempt from WriteTimeout, which is why
+// we enforce it here rather than in the http.Server.
+func (a *api) bounded(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg := a.settings()
+		if cfg.MaxRequestBodyBytes != 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, cfg.MaxRequestBodyBytes)
+		}
+		if cfg.WriteTimeout == 0 {
+			h.ServeHTTP(w, req)
+			return
+		}
+		http.TimeoutHandler(h, cfg.WriteTimeout, "").ServeHTTP(w, req)
+	})
+}
+
+// Helper which extracts the token from the query string, and passes it to the "real"
+// handler. Note that this doesn't check the validity of the token, merely parses it.
+func (a *api) withToken(handler func(http.ResponseWriter, *http.Request, *obmd.Token)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var token obmd.Token
+		err := (&token).UnmarshalText([]byte(req.URL.Query().Get("token")))
+		if err != nil {
+			a.relayError(w, req, "getToken()", err)
+			return
+		}
+		// Identify the token in logs by (a prefix of) its hash in the
+		// console audit, rather than the token itself.
+		req = req.WithContext(logger.NewContext(req.Context(), "token", obmd.AuditTokenHash(token)[:16]))
+		// Name the operation after the route, e.g. "power_cycle",
+		// for the node's token usage.
+		if route := mux.CurrentRoute(req); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				op := strings.TrimPrefix(tmpl, "/node/{node_id}/")
+				req = req.WithContext(obmd.WithOpName(req.Context(), op))
+			}
+		}
+		// Report the node's version, and if the client gave the
+		// version it expects, only operate on that.
+		if version, err := a.daemon.NodeVersion(nodeId(req)); err == nil {
+			w.Header().Set("Node-Version", version)
+		}
+		if _, ok := req.URL.Query()["expect_version"]; ok {
+			version := req.URL.Query().Get("expect_version")
+			req = req.WithContext(obmd.WithExpectedVersion(req.Context(), version))
+		}
+		handler(w, req, &token)
+	})
+}
+
+// Deduplicate retries of requests made with an Idempotency-Key; see
+// idempotencyCache.
+func (a *api) idempotent(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		window := a.settings().IdempotencyWindow
+		if window == 0 {
+			window = defaultIdempotencyWindow
+		}
+		a.idempotency.serve(w, req, window, h)
+	})
+}
+
+// Fetch the node_id out of a request's captured variables. This requires that
+// req was matched by a route that had "{node_id}" somewhere in its path.
+func nodeId(req *http.Request) string {
+	return mux.Vars(req)["node_id"]
+}
+
+// Make a handler for the api, operating on nodes through daemon. It calls
+// settings for the current settings whenever it needs them, so they may
+// change from one request to the next, e.g. when the config is reloaded;
+// the result must not be modified. snapshot returns a description of the
+// nodes and policy settings, for the snapshot calls, which must encode as a
+// JSON object. `parts` selects whether to serve the admin api, the
+// "regular user" api, or both; requests for the parts not served get a
+// 404.
+func NewHandler(daemon obmd.Daemon, settings func() *Settings, snapshot func() interface{}, parts Parts) http.Handler {
+	r := mux.NewRouter()
+	a := &api{
+		daemon:      daemon,
+		settings:    settings,
+		snapshot:    snapshot,
+		log:         logger.With("subsystem", "http"),
+		idempotency: newIdempotencyCache(),
+	}
+
+	// The Redfish api, if enabled, which handles its own authentication.
+	r.PathPrefix("/redfish").MatcherFunc(func(req *http.Request, m *mux.RouteMatch) bool {
+		return settings().Redfish
+	}).Handler(a.bounded(makeRedfishHandler(a, parts)))
+
+	// The web UI, if enabled. It uses both parts of the api, so it is only
+	// served if both are.
+	uiEnabled := func(req *http.Request, m *mux.RouteMatch) bool {
+		return parts == AllAPI && settings().WebUI
+	}
+	r.Methods("GET").Path("/ui/").MatcherFunc(uiEnabled).HandlerFunc(serveUI)
+	r.Methods("GET").Path("/ui").MatcherFunc(uiEnabled).
+		Handler(http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+
+	// Router for admin-only requests. Because we validate the admin token here,
+	// anything with an invalid admin token will simply not match, returning 404
+	// (Not found). TODO: think about whether we want that as an explicit security
+	// feature. It masks the presence or abscence of nodes, which is nice (but if
+	// we're to rely on that, we need to mitigate timing attacks).
+	adminR := r.MatcherFunc(func(req *http.Request, m *mux.RouteMatch) bool {
+		return parts&AdminAPI != 0 && IsAdmin(req, settings().AdminToken)
+	}).Subrouter()
+
+	// Router for "regular user" requests.
+	userR := r.MatcherFunc(func(req *http.Request, m *mux.RouteMatch) bool {
+		return parts&UserAPI != 0
+	}).Subrouter()
+
+	a.nodeRoutes(adminR)
+	a.obmRoutes(adminR)
+	a.powerRoutes(adminR, userR)
+	a.consoleRoutes(adminR, userR)
+	a.imageRoutes(adminR, userR)
+	a.snapshotRoutes(adminR)
+	a.pduRoutes(adminR)
+	a.powerGroupRoutes(adminR)
+
+	// Record who made each request, for the authorization policy, and
+	// identify it and what it is for in everything logged on its behalf.
+	// X-Requester is only believed from the admin, as anyone can set it.
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requester := obmd.Requester{RemoteAddr: req.RemoteAddr}
+		if IsAdmin(req, settings().AdminToken) {
+			requester.Identity = req.Header.Get("X-Requester")
+		}
+		ctx := obmd.WithRequester(req.Context(), requester)
+		id := requestID(req)
+		w.Header().Set("X-Request-ID", id)
+		kv := []interface{}{"request_id", id}
+		var match mux.RouteMatch
+		if r.Match(req, &match) && match.Route != nil {
+			if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+				kv = append(kv, "route", req.Method+" "+tmpl)
+			}
+			if label, ok := match.Vars["node_id"]; ok {
+				kv = append(kv, "node", label)
+			}
+		}
+		ctx = logger.NewContext(ctx, kv...)
+		r.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// Return the ID of the request: the X-Request-ID header the client (or a
+// proxy) gave, if it is reasonable, or else a random one.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-ID"); id != "" && len(id) <= maxRequestIDLength {
+		ok := true
+		for _, c := range []byte(id) {
+			ok = ok && c > ' ' && c <= '~'
+		}
+		if ok {
+			return id
+		}
+	}
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The admin token used by these tests.
+var testAdminToken = obmd.Token{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+// A Daemon for testing handlers against. Only the methods overridden here
+// may be called; the others panic, through the nil embedded Daemon.
+type stubDaemon struct {
+	obmd.Daemon
+
+	// The context and token of the last call made with them.
+	ctx   context.Context
+	token *obmd.Token
+
+	// What calls return.
+	err     error
+	power   driver.PowerState
+	version string
+
+	// The arguments of the last calls to SetNode and SetPDUOutlet.
+	label  string
+	info   []byte
+	outlet obmd.PDUOutlet
+}
+
+func (d *stubDaemon) SetNode(label string, info []byte) error {
+	d.label, d.info = label, info
+	return d.err
+}
+
+func (d *stubDaemon) DeleteNode(label string) error {
+	d.label = label
+	return d.err
+}
+
+func (d *stubDaemon) NodeVersion(label string) (string, error) {
+	if d.version == "" {
+		return "", obmd.ErrNoSuchNode
+	}
+	return d.version, nil
+}
+
+func (d *stubDaemon) TransferNode(ctx context.Context, label, project string) error {
+	d.ctx, d.label = ctx, label
+	return d.err
+}
+
+func (d *stubDaemon) PowerOffNode(ctx context.Context, label string, token *obmd.Token) error {
+	d.ctx, d.label, d.token = ctx, label, token
+	return d.err
+}
+
+func (d *stubDaemon) NodePowerStatus(ctx context.Context, label string, token *obmd.Token) (driver.PowerState, error) {
+	d.ctx, d.label, d.token = ctx, label, token
+	return d.power, d.err
+}
+
+func (d *stubDaemon) SetPDUOutlet(o obmd.PDUOutlet) error {
+	d.outlet = o
+	return d.err
+}
+
+// Make a handler for the api on daemon, with the given settings.
+func newTestHandler(daemon obmd.Daemon, settings Settings, parts Parts) http.Handler {
+	settings.AdminToken = testAdminToken
+	snapshot := func() interface{} {
+		return map[string]interface{}{"nodes": map[string]string{"node-1": "ipmi"}}
+	}
+	return NewHandler(daemon, func() *Settings { return &settings }, snapshot, parts)
+}
+
+// Make a request to h, authenticated as the admin if admin is true.
+func serve(h http.Handler, admin bool, method, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if admin {
+		text, _ := testAdminToken.MarshalText()
+		req.SetBasicAuth("admin", string(text))
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+func requireStatus(t *testing.T, desc string, resp *httptest.ResponseRecorder, status int) {
+	if resp.Code != status {
+		t.Fatalf("%s: expected status %d but got %d (body: %q)", desc, status, resp.Code, resp.Body.String())
+	}
+}
+
+// The admin api should only be served to the admin, and only by handlers
+// for it.
+func TestAdminAuth(t *testing.T) {
+	daemon := &stubDaemon{}
+	h := newTestHandler(daemon, Settings{}, AllAPI)
+	requireStatus(t, "Registering a node without credentials",
+		serve(h, false, "PUT", "/node/node-1", `{}`), http.StatusNotFound)
+	if daemon.label != "" {
+		t.Fatal("The node was registered without credentials.")
+	}
+	requireStatus(t, "Registering a node", serve(h, true, "PUT", "/node/node-1", `{"type": "ipmi"}`), http.StatusOK)
+	if daemon.label != "node-1" || string(daemon.info) != `{"type": "ipmi"}` {
+		t.Fatalf("Unexpected call to SetNode(%q, %q).", daemon.label, daemon.info)
+	}
+
+	h = newTestHandler(daemon, Settings{}, UserAPI)
+	requireStatus(t, "Registering a node on the user api",
+		serve(h, true, "PUT", "/node/node-2", `{}`), http.StatusNotFound)
+}
+
+// Errors from the daemon should be reported with the matching status, and
+// explained where that is useful.
+func TestErrorStatus(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{obmd.ErrNoSuchNode, http.StatusNotFound, ""},
+		{obmd.ErrNodeExists, http.StatusConflict, ""},
+		{obmd.InvalidLabelError{Label: "x", Reason: "too short"}, http.StatusBadRequest, ""},
+		{&driver.InvalidInfoError{Problems: []string{"no addr"}}, http.StatusUnprocessableEntity,
+			`{"problems":["no addr"]}`},
+		{obmd.PolicyDeniedError{Reason: "not today"}, http.StatusForbidden,
+			`{"error":"Refused by the authorization policy: not today"}`},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, ""},
+	}
+	for _, c := range cases {
+		h := newTestHandler(&stubDaemon{err: c.err}, Settings{}, AllAPI)
+		resp := serve(h, true, "PUT", "/node/node-1", `{}`)
+		requireStatus(t, c.err.Error(), resp, c.status)
+		if body := strings.TrimSpace(resp.Body.String()); body != c.body {
+			t.Fatalf("%v: expected body %q but got %q", c.err, c.body, body)
+		}
+	}
+
+	h := newTestHandler(&stubDaemon{err: obmd.PowerCycleRateError{RetryAfter: 1500 * time.Millisecond}},
+		Settings{}, AllAPI)
+	resp := serve(h, true, "PUT", "/node/node-1", `{}`)
+	requireStatus(t, "Power cycling too soon", resp, http.StatusTooManyRequests)
+	if retry := resp.Header().Get("Retry-After"); retry != "2" {
+		t.Fatalf("Expected Retry-After: 2, but got %q.", retry)
+	}
+}
+
+// Deleting a node which doesn't exist should only succeed if the client
+// says that's fine.
+func TestDeleteNodeIdempotent(t *testing.T) {
+	h := newTestHandler(&stubDaemon{err: obmd.ErrNoSuchNode}, Settings{}, AllAPI)
+	requireStatus(t, "Deleting a missing node",
+		serve(h, true, "DELETE", "/node/node-1", ""), http.StatusNotFound)
+	requireStatus(t, "Deleting a missing node idempotently",
+		serve(h, true, "DELETE", "/node/node-1?idempotent=true", ""), http.StatusOK)
+	requireStatus(t, "Deleting with a bad ?idempotent=",
+		serve(h, true, "DELETE", "/node/node-1?idempotent=maybe", ""), http.StatusBadRequest)
+}
+
+// Calls made with a token should pass it to the daemon, along with the
+// operation's name and any version the client expects.
+func TestPowerStatus(t *testing.T) {
+	daemon := &stubDaemon{power: driver.PowerStateOn, version: "v1"}
+	h := newTestHandler(daemon, Settings{}, AllAPI)
+	token := obmd.Token{0xff}
+	text, _ := token.MarshalText()
+
+	resp := serve(h, false, "GET", "/node/node-1/power_status?token="+string(text)+"&expect_version=v1", "")
+	requireStatus(t, "Getting the power status", resp, http.StatusOK)
+	var body PowerResp
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Power != driver.PowerStateOn {
+		t.Fatalf("Unexpected power status %+v (err: %v).", body, err)
+	}
+	if version := resp.Header().Get("Node-Version"); version != "v1" {
+		t.Fatalf("Expected Node-Version: v1, but got %q.", version)
+	}
+	if daemon.label != "node-1" || daemon.token == nil || *daemon.token != token {
+		t.Fatalf("Unexpected call to NodePowerStatus(%q, %v).", daemon.label, daemon.token)
+	}
+	if op := obmd.OpName(daemon.ctx); op != "power_status" {
+		t.Fatalf("Expected the operation to be named \"power_status\", but it was %q.", op)
+	}
+	if version, ok := obmd.ExpectedVersion(daemon.ctx); !ok || version != "v1" {
+		t.Fatalf("Expected version \"v1\" to be required, but got %q (%v).", version, ok)
+	}
+
+	requireStatus(t, "Getting the power status with a malformed token",
+		serve(h, false, "GET", "/node/node-1/power_status?token=xyz", ""), http.StatusUnauthorized)
+}
+
+// X-Requester should be passed on for the admin, and only the admin.
+func TestRequester(t *testing.T) {
+	daemon := &stubDaemon{}
+	h := newTestHandler(daemon, Settings{}, AllAPI)
+	req := httptest.NewRequest("PUT", "/node/node-1/owner", strings.NewReader(`{"project": "p"}`))
+	text, _ := testAdminToken.MarshalText()
+	req.SetBasicAuth("admin", string(text))
+	req.Header.Set("X-Requester", "project-x")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	requireStatus(t, "Transferring a node", resp, http.StatusOK)
+	if r := obmd.RequesterOf(daemon.ctx); r.Identity != "project-x" || r.RemoteAddr != req.RemoteAddr {
+		t.Fatalf("Unexpected requester %+v.", r)
+	}
+	if resp.Header().Get("X-Request-ID") == "" {
+		t.Fatal("The response had no X-Request-ID.")
+	}
+
+	token := obmd.Token{0xff}
+	text, _ = token.MarshalText()
+	req = httptest.NewRequest("POST", "/node/node-1/power_off?token="+string(text), nil)
+	req.Header.Set("X-Requester", "project-x")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	requireStatus(t, "Powering off", resp, http.StatusOK)
+	if r := obmd.RequesterOf(daemon.ctx); r.Identity != "" {
+		t.Fatalf("X-Requester was believed from a user: %+v.", r)
+	}
+}
+
+// The outlet and PDU should come from the path, and the rest from the
+// body.
+func TestSetPDUOutlet(t *testing.T) {
+	daemon := &stubDaemon{}
+	h := newTestHandler(daemon, Settings{}, AllAPI)
+	resp := serve(h, true, "PUT", "/pdu/pdu-1/outlet/3", `{"node": "node-1", "order": 2}`)
+	requireStatus(t, "Recording an outlet", resp, http.StatusOK)
+	expected := obmd.PDUOutlet{PDU: "pdu-1", Outlet: "3", Node: "node-1", Order: 2}
+	if daemon.outlet != expected {
+		t.Fatalf("Expected outlet %+v but got %+v.", expected, daemon.outlet)
+	}
+	requireStatus(t, "Recording an outlet with a bad body",
+		serve(h, true, "PUT", "/pdu/pdu-1/outlet/3", `{`), http.StatusBadRequest)
+}
+
+// The snapshot calls should report and compare against the snapshot
+// given to NewHandler.
+func TestSnapshot(t *testing.T) {
+	h := newTestHandler(&stubDaemon{}, Settings{}, AllAPI)
+	resp := serve(h, true, "GET", "/snapshot", "")
+	requireStatus(t, "Taking a snapshot", resp, http.StatusOK)
+	if body := strings.TrimSpace(resp.Body.String()); body != `{"nodes":{"node-1":"ipmi"}}` {
+		t.Fatalf("Unexpected snapshot %q.", body)
+	}
+
+	resp = serve(h, true, "POST", "/snapshot/diff", `{"nodes": {"node-1": "redfish"}}`)
+	requireStatus(t, "Comparing a snapshot", resp, http.StatusOK)
+	var diff SnapshotDiffResp
+	if err := json.NewDecoder(resp.Body).Decode(&diff); err != nil {
+		t.Fatal("Decoding the differences:", err)
+	}
+	if len(diff.Changes) != 1 || diff.Changes[0].Path != "/nodes/node-1" ||
+		diff.Changes[0].Old != "redfish" || diff.Changes[0].New != "ipmi" {
+		t.Fatalf("Unexpected differences %+v.", diff.Changes)
+	}
+}
+
+// Settings should be read afresh for each request.
+func TestSettingsChange(t *testing.T) {
+	settings := &Settings{AdminToken: testAdminToken}
+	h := NewHandler(&stubDaemon{}, func() *Settings { return settings }, nil, AllAPI)
+	requireStatus(t, "The web UI while disabled", serve(h, false, "GET", "/ui/", ""), http.StatusNotFound)
+	settings = &Settings{AdminToken: testAdminToken, WebUI: true}
+	requireStatus(t, "The web UI once enabled", serve(h, false, "GET", "/ui/", ""), http.StatusOK)
+}
+
+// Each kind of resource's routes can be served on their own, e.g. to test
+// their handlers in isolation.
+func TestAPIRoutes(t *testing.T) {
+	daemon := &stubDaemon{}
+	a := &api{
+		daemon:      daemon,
+		settings:    func() *Settings { return &Settings{} },
+		log:         logger.With("subsystem", "http"),
+		idempotency: newIdempotencyCache(),
+	}
+	r := mux.NewRouter()
+	a.powerRoutes(r.NewRoute().Subrouter(), r.NewRoute().Subrouter())
+
+	text, _ := obmd.Token{0xff}.MarshalText()
+	resp := serve(r, false, "POST", "/node/routes/power_off?token="+string(text), "")
+	requireStatus(t, "Powering off", resp, http.StatusOK)
+	if daemon.label != "routes" {
+		t.Fatalf("Expected node \"routes\" to be powered off, but it was %q.", daemon.label)
+	}
+	resp = serve(r, false, "GET", "/node/routes/console/stats?token="+string(text), "")
+	requireStatus(t, "Console stats without the console routes", resp, http.StatusNotFound)
+}
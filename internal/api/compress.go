@@ -0,0 +1,87 @@
+package api
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Choose a content-coding for the response to req, from its Accept-Encoding
+// header: "gzip", "deflate", or "" if the client accepts neither.
+func negotiateEncoding(req *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[len("q="):], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if coding == "*" {
+			coding = "gzip"
+		}
+		// Prefer gzip when the client has no preference; some
+		// clients get "deflate" wrong.
+		if (coding == "gzip" || coding == "deflate") && (q > bestQ || q == bestQ && coding == "gzip") {
+			best, bestQ = coding, q
+		}
+	}
+	if bestQ <= 0 {
+		return ""
+	}
+	return best
+}
+
+// An http.ResponseWriter which compresses the body of the response. Flush
+// sends everything written so far to the client, at some cost in the
+// compression ratio, so this is usable for streams. Close must be called
+// to finish the body.
+type compressedResponse struct {
+	http.ResponseWriter
+	z interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+// Compress the response written to w if the client accepts it (see
+// negotiateEncoding), returning the ResponseWriter to use instead, and a
+// function which must be called when the response is complete. Must be
+// called before the headers are written.
+func compressResponse(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(req)
+	cw := &compressedResponse{ResponseWriter: w}
+	switch encoding {
+	case "gzip":
+		cw.z = gzip.NewWriter(w)
+	case "deflate":
+		// In http, "deflate" means the zlib format, not raw deflate.
+		cw.z = zlib.NewWriter(w)
+	default:
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Del("Content-Length")
+	return cw, func() { cw.z.Close() }
+}
+
+func (w *compressedResponse) Write(p []byte) (int, error) {
+	return w.z.Write(p)
+}
+
+func (w *compressedResponse) Flush() {
+	w.z.Flush()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// The preferred encoding the client accepts should be chosen.
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		accept, encoding string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"GZIP ; q=1.0", "gzip"},
+		{"gzip;q=0", ""},
+		{"*", "gzip"},
+		{"br, *;q=0.1", "gzip"},
+		{"gzip;q=bogus", ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", c.accept)
+		if got := negotiateEncoding(req); got != c.encoding {
+			t.Errorf("negotiateEncoding(%q) = %q; expected %q", c.accept, got, c.encoding)
+		}
+	}
+}
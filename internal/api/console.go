@@ -0,0 +1,297 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/consoleio"
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Register the routes for nodes' consoles, and managing console
+// sessions.
+func (a *api) consoleRoutes(adminR, userR *mux.Router) {
+	// Report who was on a node's console, optionally just those sessions
+	// open at some time between ?from= and ?to=.
+	adminR.Methods("GET").Path("/node/{node_id}/console_audit").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var from, to time.Time
+			for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+				if s := req.URL.Query().Get(name); s != "" {
+					var err error
+					*t, err = time.Parse(time.RFC3339, s)
+					if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+				}
+			}
+			sessions, err := a.daemon.NodeConsoleAudit(nodeId(req), from, to)
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeConsoleAudit()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ConsoleAuditResp{Sessions: sessions})
+		})))
+
+	// List the open console connections.
+	adminR.Methods("GET").Path("/console").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ConsolesResp{
+				Sessions: a.daemon.ConsoleSessions(),
+			})
+		})))
+
+	// Forcibly close a console connection.
+	adminR.Methods("DELETE").Path("/console/{session_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := a.daemon.DisconnectConsole(mux.Vars(req)["session_id"])
+			a.relayError(w, req, "daemon.DisconnectConsole()", err)
+		})))
+
+	userR.Methods("GET").Path("/node/{node_id}/console").
+		Handler(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			var replay int
+			if text := req.URL.Query().Get("replay"); text != "" {
+				var err error
+				replay, err = parseSize(text)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			var sanitize, compress, status bool
+			if text := req.URL.Query().Get("sanitize"); text != "" {
+				var err error
+				sanitize, err = strconv.ParseBool(text)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			if text := req.URL.Query().Get("compress"); text != "" {
+				var err error
+				compress, err = strconv.ParseBool(text)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			if text := req.URL.Query().Get("status"); text != "" {
+				var err error
+				status, err = strconv.ParseBool(text)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			ctx, cancel := a.opContext(req)
+			conn, err := a.daemon.DialNodeConsole(ctx, nodeId(req), replay, req.RemoteAddr, token)
+			cancel()
+			if err != nil {
+				a.relayError(w, req, "daemon.DialNodeConsole()", err)
+			} else {
+				ender, _ := conn.(driver.ConsoleEnder)
+				conn = consoleio.StartRecording(conn, a.settings().ConsoleRecordDir, nodeId(req))
+				if sanitize {
+					conn = consoleio.NewSanitizer(conn)
+				}
+				defer conn.Close()
+				if compress {
+					// Each chunk is still flushed as it arrives (below).
+					var finish func()
+					w, finish = compressResponse(w, req)
+					defer finish()
+				}
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Trailer", "Console-End-Reason")
+				if status {
+					// Tell the user what state the node is in, since
+					// the console may well be quiet. This goes in the
+					// headers, so the stream is just the console's.
+					ctx, cancel := a.opContext(req)
+					power, bootdev, err := a.daemon.NodeStatus(ctx, nodeId(req), token)
+					cancel()
+					if err != nil {
+						w.Header().Set("Console-Status-Error", err.Error())
+					} else {
+						w.Header().Set("Console-Power", string(power))
+						if bootdev != "" {
+							w.Header().Set("Console-Bootdev", bootdev)
+						}
+					}
+				}
+				// Send the headers now, rather than waiting for output,
+				// so the client knows it's connected.
+				if flusher, ok := w.(http.Flusher); ok {
+					flusher.Flush()
+				}
+
+				// If the client goes away while the console is quiet,
+				// we won't notice from writing to it, so also watch for
+				// the server noticing the connection closing. This
+				// unblocks the read below.
+				done := make(chan struct{})
+				defer close(done)
+				go func() {
+					select {
+					case <-req.Context().Done():
+						conn.Close()
+					case <-done:
+					}
+				}()
+
+				// Copy stream to the client. Unfortunately we can't just use
+				// io.Copy here, because we need to call Flush() between writes.
+				// otherwise, the client won't receive console data in a timely
+				// manner, because the ResponseWriter may buffer it.
+				var buf [4096]byte
+				for err == nil {
+					var n int
+					n, err = conn.Read(buf[:])
+					if n != 0 {
+						_, err = w.Write(buf[:n])
+					}
+					if flusher, ok := w.(http.Flusher); ok {
+						flusher.Flush()
+					}
+				}
+
+				// ErrClosedPipe means the admin closed the connection.
+				if err != io.EOF && err != io.ErrClosedPipe {
+					a.log.WithContext(req.Context()).Warn("Error reading from console",
+						"node", nodeId(req), "err", err)
+				}
+				// Tell the client why the stream ended, so it can tell
+				// e.g. a revoked token from a network problem.
+				reason := "unknown"
+				if ender != nil && ender.EndReason() != "" {
+					reason = ender.EndReason()
+				}
+				w.Header().Set("Console-End-Reason", reason)
+			}
+		}))
+
+	// Wait for a pattern to appear in the console output. Like the console
+	// itself, this can legitimately take a long time, so it isn't subject
+	// to WriteTimeout.
+	userR.Methods("POST").Path("/node/{node_id}/console/expect").
+		Handler(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			if max := a.settings().MaxRequestBodyBytes; max != 0 {
+				req.Body = http.MaxBytesReader(w, req.Body, max)
+			}
+			var args ExpectArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil || args.Timeout < 0 || args.Context < 0 || args.Replay < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			re, err := regexp.Compile(args.Pattern)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var (
+				ctx    context.Context
+				cancel context.CancelFunc
+			)
+			if args.Timeout == 0 {
+				ctx, cancel = context.WithCancel(req.Context())
+			} else {
+				ctx, cancel = context.WithTimeout(req.Context(), time.Duration(args.Timeout))
+			}
+			defer cancel()
+			conn, err := a.daemon.DialNodeConsole(ctx, nodeId(req), args.Replay, req.RemoteAddr, token)
+			if err != nil {
+				a.relayError(w, req, "daemon.DialNodeConsole()", err)
+				return
+			}
+			if args.Sanitize {
+				conn = consoleio.NewSanitizer(conn)
+			}
+			resp, err := expectPattern(ctx, conn, re, args.Context)
+			if err == io.EOF {
+				// The console session ended without a match.
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			if err != nil {
+				a.relayError(w, req, "expectPattern()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		}))
+
+	// Return recent console output, without streaming.
+	userR.Methods("GET").Path("/node/{node_id}/console/snapshot").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			var (
+				size     int
+				sanitize bool
+				err      error
+			)
+			if text := req.URL.Query().Get("size"); text != "" {
+				if size, err = parseSize(text); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			if text := req.URL.Query().Get("sanitize"); text != "" {
+				if sanitize, err = strconv.ParseBool(text); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			data, err := a.daemon.NodeConsoleSnapshot(ctx, nodeId(req), size, token)
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeConsoleSnapshot()", err)
+				return
+			}
+			if sanitize {
+				data = consoleio.Sanitize(data)
+			}
+			w, finish := compressResponse(w, req)
+			defer finish()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(data)
+		})))
+
+	userR.Methods("GET").Path("/node/{node_id}/console/stats").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			stats, err := a.daemon.NodeConsoleStats(req.Context(), nodeId(req), token)
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeConsoleStats()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&stats)
+		})))
+
+	// Send the request body to the console, e.g. as keystrokes.
+	userR.Methods("POST").Path("/node/{node_id}/console/input").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			data, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err = a.daemon.WriteNodeConsole(ctx, nodeId(req), data, token)
+			a.relayError(w, req, "daemon.WriteNodeConsole()", err)
+		})))
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// The maximum length of a line considered by expectPattern; longer lines
+// are truncated to their last maxExpectLine bytes.
+const maxExpectLine = 4096
+
+// Response body for a successful console expect call.
+type ExpectResp struct {
+	// The text which matched the pattern.
+	Match string `json:"match"`
+
+	// The line containing the match. If the match is in the line being
+	// written (e.g. a prompt), this is the line so far.
+	Line string `json:"line"`
+
+	// Up to the requested number of lines preceding Line, oldest first.
+	Before []string `json:"before"`
+}
+
+// Read console output from r until a line matches re, returning the match
+// along with up to `before` preceding lines. Partial lines are matched as
+// they arrive, so that prompts (which don't end in a newline) are found.
+// Returns ctx.Err() if ctx is done first, or io.EOF if the output ends.
+// This closes r when it returns.
+func expectPattern(ctx context.Context, r io.ReadCloser, re *regexp.Regexp, before int) (*ExpectResp, error) {
+	defer r.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Unblock the read below if we give up:
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-done:
+		}
+	}()
+
+	var (
+		buf   [4096]byte
+		line  []byte
+		lines []string
+	)
+	// Check the current line for a match, and return the response if there
+	// is one.
+	check := func() *ExpectResp {
+		text := strings.TrimRight(string(line), "\r\n")
+		loc := re.FindStringIndex(text)
+		if loc == nil {
+			return nil
+		}
+		return &ExpectResp{
+			Match:  text[loc[0]:loc[1]],
+			Line:   text,
+			Before: append([]string{}, lines...),
+		}
+	}
+	for {
+		n, err := r.Read(buf[:])
+		data := buf[:n]
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				line = append(line, data...)
+				break
+			}
+			line = append(line, data[:i+1]...)
+			data = data[i+1:]
+			if resp := check(); resp != nil {
+				return resp, nil
+			}
+			if before > 0 {
+				if len(lines) == before {
+					lines = lines[1:]
+				}
+				lines = append(lines, strings.TrimRight(string(line), "\r\n"))
+			}
+			line = line[:0]
+		}
+		if len(line) > maxExpectLine {
+			line = append(line[:0], line[len(line)-maxExpectLine:]...)
+		}
+		if len(line) > 0 {
+			if resp := check(); resp != nil {
+				return resp, nil
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The default for Settings.IdempotencyWindow.
+const defaultIdempotencyWindow = 10 * time.Minute
+
+// The most results an idempotencyCache keeps; beyond this, the oldest are
+// forgotten early.
+const maxIdempotentResults = 10000
+
+// The results of requests made with an Idempotency-Key header, so that
+// retries of them (e.g. after a network blip hid the response) get the
+// original result, rather than repeating e.g. a power cycle.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	results map[string]*idempotentResult // by scope; see serve.
+	max     int                          // the most results to keep.
+
+	// The results, oldest first, for forgetting them. Entries for results
+	// which have already been forgotten are skipped.
+	order []idempotentEntry
+}
+
+type idempotentEntry struct {
+	scope  string
+	result *idempotentResult
+}
+
+// The result of a request made with an Idempotency-Key.
+type idempotentResult struct {
+	bodyHash [sha256.Size]byte
+	done     chan struct{} // closed once the request is finished.
+
+	// The fields below are set before done is closed.
+	abandoned bool      // the client went away; there is no result.
+	expires   time.Time // when the result is forgotten.
+	status    int
+	header    http.Header
+	body      []byte
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		results: make(map[string]*idempotentResult),
+		max:     maxIdempotentResults,
+	}
+}
+
+// Return the result for scope, and true if the caller is the first to ask
+// for it, and so must finish it. Expired results are forgotten as they are
+// come across, and the oldest once there are too many.
+func (c *idempotencyCache) start(scope string, bodyHash [sha256.Size]byte, now time.Time) (*idempotentResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.order) != 0 {
+		e := c.order[0]
+		if c.results[e.scope] == e.result {
+			if len(c.results) < c.max && !e.result.expired(now) {
+				break
+			}
+			delete(c.results, e.scope)
+		}
+		c.order[0] = idempotentEntry{}
+		c.order = c.order[1:]
+	}
+	if r, ok := c.results[scope]; ok && !r.expired(now) {
+		return r, false
+	}
+	r := &idempotentResult{bodyHash: bodyHash, done: make(chan struct{})}
+	c.results[scope] = r
+	c.order = append(c.order, idempotentEntry{scope, r})
+	return r, true
+}
+
+// Report whether the result should have been forgotten by now.
+func (r *idempotentResult) expired(now time.Time) bool {
+	return !r.expires.IsZero() && now.After(r.expires)
+}
+
+// Record the outcome of the request for scope, which was recorded by rec,
+// keeping it until `window` from now if it is final: a success, or a
+// client error which a retry would get too. Other results (server errors,
+// timeouts, and 429, which says to retry later) are passed to requests
+// already waiting for them, but then forgotten, so a retry starts afresh.
+// If the client went away before it finished, there is no result.
+func (c *idempotencyCache) finish(scope string, r *idempotentResult, rec *resultRecorder, window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status == StatusClientClosedRequest {
+		r.abandoned = true
+	}
+	if !finalStatus(rec.status) && c.results[scope] == r {
+		delete(c.results, scope)
+	}
+	r.expires = time.Now().Add(window)
+	r.status, r.header, r.body = rec.status, rec.header, rec.body.Bytes()
+	close(r.done)
+}
+
+// Report whether a request which got status would get it again if retried.
+func finalStatus(status int) bool {
+	switch {
+	case status >= 200 && status < 300:
+		return true
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests,
+		status == StatusClientClosedRequest:
+		return false
+	default:
+		return status >= 400 && status < 500
+	}
+}
+
+// Write the result to w. If replayed is true, it is marked as being the
+// result of an earlier request.
+func (r *idempotentResult) write(w http.ResponseWriter, replayed bool) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body)
+}
+
+// Serve req with h, unless it has an Idempotency-Key header, and the same
+// request (with the same method, path, token and key) has been made within
+// `window`, in which case reply with that request's result (waiting for it
+// if necessary), if it was final; see finish. A request with the same key
+// but a different body gets 422.
+func (c *idempotencyCache) serve(w http.ResponseWriter, req *http.Request, window time.Duration, h http.Handler) {
+	key := req.Header.Get("Idempotency-Key")
+	if key == "" {
+		h.ServeHTTP(w, req)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	bodyHash := sha256.Sum256(body)
+	scope := req.Method + " " + req.URL.Path + "\n" + req.URL.Query().Get("token") + "\n" + key
+	for {
+		r, first := c.start(scope, bodyHash, time.Now())
+		if r.bodyHash != bodyHash {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		if first {
+			rec := &resultRecorder{header: make(http.Header)}
+			h.ServeHTTP(rec, req)
+			c.finish(scope, r, rec, window)
+			r.write(w, false)
+			return
+		}
+		select {
+		case <-r.done:
+		case <-req.Context().Done():
+			w.WriteHeader(StatusClientClosedRequest)
+			return
+		}
+		if !r.abandoned {
+			r.write(w, true)
+			return
+		}
+		// The original request was abandoned, so try again.
+	}
+}
+
+// An http.ResponseWriter which records the response.
+type resultRecorder struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *resultRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *resultRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *resultRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
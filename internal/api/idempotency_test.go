@@ -0,0 +1,36 @@
+package api
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The idempotency cache should forget the oldest results once it is full,
+// and expired ones once they are reached.
+func TestIdempotencyCacheBound(t *testing.T) {
+	c := newIdempotencyCache()
+	c.max = 2
+	var hash [sha256.Size]byte
+	now := time.Now()
+	for _, scope := range []string{"a", "b", "c"} {
+		r, first := c.start(scope, hash, now)
+		if !first {
+			t.Fatalf("Result for %q was already there.", scope)
+		}
+		c.finish(scope, r, &resultRecorder{header: make(http.Header)}, time.Minute)
+	}
+	if len(c.results) > 2 {
+		t.Fatalf("Cache holds %d results; expected at most 2.", len(c.results))
+	}
+	if _, first := c.start("c", hash, now); first {
+		t.Fatal("The newest result was forgotten.")
+	}
+	if _, first := c.start("a", hash, now); !first {
+		t.Fatal("The oldest result wasn't forgotten.")
+	}
+	if _, first := c.start("c", hash, now.Add(time.Hour)); !first {
+		t.Fatal("An expired result was replayed.")
+	}
+}
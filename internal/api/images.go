@@ -0,0 +1,111 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/images"
+)
+
+// Register the routes for listing and serving images.
+func (a *api) imageRoutes(adminR, userR *mux.Router) {
+	// List the images.
+	adminR.Methods("GET").Path("/images").MatcherFunc(a.imagesEnabled).
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			list, err := a.settings().Images.List(req.Context())
+			if err != nil {
+				a.log.WithContext(req.Context()).Error("Error listing images", "err", err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			if list == nil {
+				list = []images.Image{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ImagesResp{Images: list})
+		})))
+
+	// Get a signed URL at which an image may be fetched, e.g. by a BMC
+	// attaching it as virtual media.
+	adminR.Methods("POST").Path("/images/{image}/url").MatcherFunc(a.imagesEnabled).
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name := imageName(req)
+			if !images.ValidName(name) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			cfg := a.settings()
+			lifetime := cfg.ImageURLLifetime
+			if lifetime == 0 {
+				lifetime = defaultImageURLLifetime
+			}
+			expires := time.Now().Add(lifetime).Truncate(time.Second).UTC()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ImageURLResp{
+				URL:     signedImageURL(cfg, req, name, expires),
+				Expires: expires,
+			})
+		})))
+
+	// Serve an image, to anyone with a signed URL for it. Like the
+	// console, this may take arbitrarily long, so it is exempt from
+	// WriteTimeout.
+	userR.Methods("GET", "HEAD").Path("/images/{image}").MatcherFunc(a.imagesEnabled).
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			cfg := a.settings()
+			name := imageName(req)
+			if !images.ValidName(name) {
+				http.NotFound(w, req)
+				return
+			}
+			if !images.Verify(imageKey(cfg), name, req.URL.Query(), time.Now()) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			cfg.Images.Serve(w, req, name)
+		})
+}
+
+// Report whether an image store is configured.
+func (a *api) imagesEnabled(req *http.Request, m *mux.RouteMatch) bool {
+	return a.settings().Images != nil
+}
+
+// Fetch the image name out of a request's captured variables, as for
+// nodeId.
+func imageName(req *http.Request) string {
+	return mux.Vars(req)["image"]
+}
+
+// The default for Settings.ImageURLLifetime.
+const defaultImageURLLifetime = 24 * time.Hour
+
+// Return the key with which to sign image URLs. This is derived from the
+// admin token, so that changing it revokes any URLs which were handed out,
+// and so that every obmd instance sharing the token accepts the same URLs.
+func imageKey(cfg *Settings) []byte {
+	sum := sha256.Sum256(append([]byte("obmd image urls\n"), cfg.AdminToken[:]...))
+	return sum[:]
+}
+
+// Return a signed URL, valid until expires, at which the image `name` may
+// be fetched without authenticating. req is the request for the URL, whose
+// address is used unless cfg.ImageBaseURL is set.
+func signedImageURL(cfg *Settings, req *http.Request, name string, expires time.Time) string {
+	base := strings.TrimSuffix(cfg.ImageBaseURL, "/")
+	if base == "" {
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + req.Host
+	}
+	query := images.Sign(imageKey(cfg), name, expires)
+	return base + "/images/" + url.PathEscape(name) + "?" + query.Encode()
+}
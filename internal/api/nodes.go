@@ -0,0 +1,230 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Register the routes for managing nodes: registering, renaming and
+// deleting them, their tokens, maintenance mode, draining and ownership,
+// and listing them and their health.
+func (a *api) nodeRoutes(adminR *mux.Router) {
+	// Register a new node, or update the information in an existing one.
+	adminR.Methods("PUT").Path("/node/{node_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			info, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			a.relayError(w, req, "daemon.SetNode()", a.daemon.SetNode(nodeId(req), info))
+		})))
+
+	// Unregister a node. Deleting a node which doesn't exist gets 404,
+	// unless ?idempotent=true is given.
+	adminR.Methods("DELETE").Path("/node/{node_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			idempotent := false
+			if text := req.URL.Query().Get("idempotent"); text != "" {
+				var err error
+				if idempotent, err = strconv.ParseBool(text); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			err := a.daemon.DeleteNode(nodeId(req))
+			if err == obmd.ErrNoSuchNode && idempotent {
+				err = nil
+			}
+			a.relayError(w, req, "daemon.DeleteNode()", err)
+		})))
+
+	// Change a node's label.
+	adminR.Methods("POST").Path("/node/{node_id}/rename").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args RenameArgs
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			a.relayError(w, req, "daemon.RenameNode()", a.daemon.RenameNode(nodeId(req), args.Label))
+		})))
+
+	adminR.Methods("POST").Path("/node/{node_id}/token").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			token, err := a.daemon.GetNodeToken(req.Context(), nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.GetNodeToken()", err)
+			} else {
+				version, _ := a.daemon.NodeVersion(nodeId(req))
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(&TokenResp{
+					Token:   token,
+					Version: version,
+				})
+			}
+		})))
+
+	adminR.Methods("DELETE").Path("/node/{node_id}/token").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := a.daemon.InvalidateNodeToken(nodeId(req))
+			a.relayError(w, req, "daemon.InvalidateNodeToken()", err)
+		})))
+
+	// Report when a node's token was issued and last used.
+	adminR.Methods("GET").Path("/node/{node_id}/token").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			usage, err := a.daemon.NodeTokenUsage(nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeTokenUsage()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&usage)
+		})))
+
+	// Put a node into maintenance mode, in which users can't change its
+	// power or boot state.
+	adminR.Methods("PUT").Path("/node/{node_id}/maintenance").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args MaintenanceArgs
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil && err != io.EOF {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := a.daemon.SetNodeMaintenance(nodeId(req), true, args.Reason)
+			a.relayError(w, req, "daemon.SetNodeMaintenance()", err)
+		})))
+
+	adminR.Methods("DELETE").Path("/node/{node_id}/maintenance").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := a.daemon.SetNodeMaintenance(nodeId(req), false, "")
+			a.relayError(w, req, "daemon.SetNodeMaintenance()", err)
+		})))
+
+	adminR.Methods("GET").Path("/node/{node_id}/maintenance").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			on, reason, err := a.daemon.NodeMaintenance(nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeMaintenance()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&MaintenanceResp{Maintenance: on, Reason: reason})
+		})))
+
+	// Drain a node: stop issuing new tokens for it, without disturbing
+	// its current user.
+	adminR.Methods("PUT").Path("/node/{node_id}/drain").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args DrainArgs
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil && err != io.EOF {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := a.daemon.SetNodeDraining(nodeId(req), true, args.Reason)
+			a.relayError(w, req, "daemon.SetNodeDraining()", err)
+		})))
+
+	adminR.Methods("DELETE").Path("/node/{node_id}/drain").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			err := a.daemon.SetNodeDraining(nodeId(req), false, "")
+			a.relayError(w, req, "daemon.SetNodeDraining()", err)
+		})))
+
+	adminR.Methods("GET").Path("/node/{node_id}/drain").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			on, reason, err := a.daemon.NodeDraining(nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeDraining()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&DrainResp{Draining: on, Reason: reason})
+		})))
+
+	// Move a node to another project, revoking its token and closing its
+	// console sessions.
+	adminR.Methods("PUT").Path("/node/{node_id}/owner").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args TransferArgs
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := a.daemon.TransferNode(req.Context(), nodeId(req), args.Project)
+			a.relayError(w, req, "daemon.TransferNode()", err)
+		})))
+
+	adminR.Methods("GET").Path("/node/{node_id}/owner").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			project, transfers, err := a.daemon.NodeOwner(nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeOwner()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&OwnerResp{Project: project, Transfers: transfers})
+		})))
+
+	// List all nodes.
+	adminR.Methods("GET").Path("/node").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&NodesResp{Nodes: a.daemon.NodeLabels()})
+		})))
+
+	// List nodes as targets for Prometheus's http service discovery.
+	adminR.Methods("GET").Path("/sd/prometheus").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(a.daemon.PrometheusTargets())
+		})))
+
+	// List quarantined nodes.
+	adminR.Methods("GET").Path("/quarantine").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&QuarantineResp{
+				Nodes: a.daemon.QuarantinedNodes(),
+			})
+		})))
+
+	// Report the results of the nodes' latest health checks.
+	adminR.Methods("GET").Path("/nodes/health").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&HealthResp{Nodes: a.daemon.NodeHealth()})
+		})))
+
+	// Report when every node's token was issued and last used, optionally
+	// only for nodes whose tokens haven't been used for some time.
+	adminR.Methods("GET").Path("/nodes/tokens").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			usage := a.daemon.TokenUsage()
+			if s := req.URL.Query().Get("unused_for"); s != "" {
+				d, err := time.ParseDuration(s)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				since := time.Now().Add(-d)
+				for label, u := range usage {
+					if !u.UnusedSince(since) {
+						delete(usage, label)
+					}
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&TokenUsageResp{Nodes: usage})
+		})))
+}
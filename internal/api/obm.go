@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The default for Settings.FirmwareUpdateTimeout.
+const defaultFirmwareUpdateTimeout = time.Hour
+
+// Register the routes for managing nodes' OBMs themselves: their network
+// configuration, power restore policies, users, passwords and firmware.
+func (a *api) obmRoutes(adminR *mux.Router) {
+	// Report the network configuration of a node's OBM.
+	adminR.Methods("GET").Path("/node/{node_id}/lan").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			config, err := a.daemon.NodeLANConfig(ctx, nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeLANConfig()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&config)
+		})))
+
+	// Report and set what a node does when power is restored.
+	adminR.Methods("GET").Path("/node/{node_id}/power_policy").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			policy, err := a.daemon.NodePowerRestorePolicy(ctx, nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.NodePowerRestorePolicy()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&PowerPolicyResp{Policy: policy})
+		})))
+	adminR.Methods("PUT").Path("/node/{node_id}/power_policy").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args PowerPolicyResp
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err := a.daemon.SetNodePowerRestorePolicy(ctx, nodeId(req), args.Policy)
+			a.relayError(w, req, "daemon.SetNodePowerRestorePolicy()", err)
+		})))
+
+	// List the user accounts on a node's OBM.
+	adminR.Methods("GET").Path("/node/{node_id}/bmc_users").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			users, err := a.daemon.NodeBMCUsers(ctx, nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeBMCUsers()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&BMCUsersResp{Users: users})
+		})))
+
+	// Change (or rotate) the password a node's OBM logs in with.
+	adminR.Methods("POST").Path("/node/{node_id}/bmc_password").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args ChangePasswordArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil && err != io.EOF {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			password, err := a.daemon.ChangeNodePassword(ctx, nodeId(req), args.Password)
+			if err != nil {
+				a.relayError(w, req, "daemon.ChangeNodePassword()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&PasswordResp{Password: password})
+		})))
+
+	// Report the password a node's OBM may have been given by a password
+	// change which failed part way.
+	adminR.Methods("GET").Path("/node/{node_id}/bmc_password").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			password, err := a.daemon.PendingNodePassword(nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.PendingNodePassword()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&PasswordResp{Password: password})
+		})))
+
+	// Report the versions of a node's firmware.
+	adminR.Methods("GET").Path("/node/{node_id}/firmware").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			versions, err := a.daemon.NodeFirmwareVersions(ctx, nodeId(req))
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeFirmwareVersions()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&FirmwareResp{Versions: versions})
+		})))
+
+	// Firmware rollouts, if enabled.
+	firmwareR := adminR.MatcherFunc(func(req *http.Request, m *mux.RouteMatch) bool {
+		return a.settings().FirmwareDir != ""
+	}).Subrouter()
+
+	// Start a firmware rollout, which runs in the background.
+	firmwareR.Methods("POST").Path("/firmware/rollouts").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args FirmwareRolloutArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err == nil {
+				err = checkFirmwareRolloutArgs(args)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			cfg := a.settings()
+			timeout := cfg.FirmwareUpdateTimeout
+			if timeout == 0 {
+				timeout = defaultFirmwareUpdateTimeout
+			}
+			rollout, err := a.daemon.StartFirmwareRollout(args.Component,
+				filepath.Join(cfg.FirmwareDir, args.Image), args.Version,
+				args.Nodes, args.GroupSize, timeout)
+			if err != nil {
+				a.relayError(w, req, "daemon.StartFirmwareRollout()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", "/firmware/rollouts/"+rollout.ID)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(&rollout)
+		})))
+
+	// List firmware rollouts.
+	firmwareR.Methods("GET").Path("/firmware/rollouts").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&FirmwareRolloutsResp{
+				Rollouts: a.daemon.FirmwareRollouts(),
+			})
+		})))
+
+	// Report the progress of a firmware rollout.
+	firmwareR.Methods("GET").Path("/firmware/rollouts/{rollout_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rollout, err := a.daemon.FirmwareRollout(mux.Vars(req)["rollout_id"])
+			if err != nil {
+				a.relayError(w, req, "daemon.FirmwareRollout()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&rollout)
+		})))
+}
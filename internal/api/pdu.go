@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Register the routes for mapping PDU outlets to nodes, and powering the
+// nodes on a PDU.
+func (a *api) pduRoutes(adminR *mux.Router) {
+	adminR.Methods("GET").Path("/pdu").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			pdus, err := a.daemon.PDUs()
+			if err != nil {
+				a.relayError(w, req, "daemon.PDUs()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&PDUsResp{PDUs: pdus})
+		})))
+
+	adminR.Methods("GET").Path("/pdu/{pdu_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			outlets, err := a.daemon.PDUOutlets(mux.Vars(req)["pdu_id"])
+			if err != nil {
+				a.relayError(w, req, "daemon.PDUOutlets()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&PDUResp{Outlets: outlets})
+		})))
+
+	// Record an outlet, and what it powers.
+	adminR.Methods("PUT").Path("/pdu/{pdu_id}/outlet/{outlet_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args PDUOutletArgs
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := a.daemon.SetPDUOutlet(obmd.PDUOutlet{
+				PDU:         mux.Vars(req)["pdu_id"],
+				Outlet:      mux.Vars(req)["outlet_id"],
+				Node:        args.Node,
+				Order:       args.Order,
+				Description: args.Description,
+			})
+			a.relayError(w, req, "daemon.SetPDUOutlet()", err)
+		})))
+
+	adminR.Methods("DELETE").Path("/pdu/{pdu_id}/outlet/{outlet_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			vars := mux.Vars(req)
+			err := a.daemon.DeletePDUOutlet(vars["pdu_id"], vars["outlet_id"])
+			a.relayError(w, req, "daemon.DeletePDUOutlet()", err)
+		})))
+
+	// Power on, off or cycle the nodes on a PDU, in order, streaming the
+	// outcome for each outlet as it completes. Like the batch power call,
+	// this is exempt from WriteTimeout.
+	adminR.Methods("POST").Path("/pdu/{pdu_id}/power_nodes").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if max := a.settings().MaxRequestBodyBytes; max != 0 {
+				req.Body = http.MaxBytesReader(w, req.Body, max)
+			}
+			var args PDUPowerArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			switch {
+			case err != nil:
+			case args.Action != obmd.PowerActionOn && args.Action != obmd.PowerActionOff &&
+				args.Action != obmd.PowerActionCycle:
+				err = fmt.Errorf("Unknown action %q.", args.Action)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			pdu := mux.Vars(req)["pdu_id"]
+			// Check that the PDU exists while we can still say so with
+			// the status code.
+			if _, err = a.daemon.PDUOutlets(pdu); err != nil {
+				a.relayError(w, req, "daemon.PDUOutlets()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			flusher, _ := w.(http.Flusher)
+			enc := json.NewEncoder(w)
+			timeout := a.settings().OperationTimeout
+			err = a.daemon.PowerPDUNodes(req.Context(), pdu, args.Action, args.Force, timeout,
+				func(o obmd.PDUOutlet, err error) {
+					enc.Encode(&PDUPowerResult{
+						Outlet: o.Outlet,
+						Node:   o.Node,
+						Status: a.errorStatus(req.Context(), "daemon.PowerPDUNodes()", err),
+					})
+					if flusher != nil {
+						flusher.Flush()
+					}
+				})
+			if err != nil {
+				// The outlets were deleted meanwhile; nothing was done.
+				a.log.WithContext(req.Context()).Warn("Error powering the nodes on a PDU", "pdu", pdu, "err", err)
+			}
+		})
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Register the routes for nodes' power, boot devices and watchdogs.
+func (a *api) powerRoutes(adminR, userR *mux.Router) {
+	// Report when a node was seen to power on and off, optionally over
+	// just the last ?period=.
+	adminR.Methods("GET").Path("/node/{node_id}/power_history").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var period time.Duration
+			if s := req.URL.Query().Get("period"); s != "" {
+				var err error
+				period, err = time.ParseDuration(s)
+				if err != nil || period < 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			history, err := a.daemon.NodePowerHistory(nodeId(req), period)
+			if err != nil {
+				a.relayError(w, req, "daemon.NodePowerHistory()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&history)
+		})))
+
+	// Power on, off or cycle many nodes, streaming the outcome for each
+	// as it completes. Like the console, this may take arbitrarily long
+	// (powering on is staggered), so it is exempt from WriteTimeout.
+	adminR.Methods("POST").Path("/batch/power").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if max := a.settings().MaxRequestBodyBytes; max != 0 {
+				req.Body = http.MaxBytesReader(w, req.Body, max)
+			}
+			var args BatchPowerArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			switch {
+			case err != nil:
+			case args.Action != obmd.PowerActionOn && args.Action != obmd.PowerActionOff &&
+				args.Action != obmd.PowerActionCycle:
+				err = fmt.Errorf("Unknown action %q.", args.Action)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			flusher, _ := w.(http.Flusher)
+			enc := json.NewEncoder(w)
+			timeout := a.settings().OperationTimeout
+			a.daemon.PowerNodes(req.Context(), args.Nodes, args.Action, args.Force, timeout,
+				func(label string, err error) {
+					enc.Encode(&BatchPowerResult{
+						Node:   label,
+						Status: a.errorStatus(req.Context(), "daemon.PowerNodes()", err),
+					})
+					if flusher != nil {
+						flusher.Flush()
+					}
+				})
+		})
+
+	userR.Methods("POST").Path("/node/{node_id}/power_cycle").
+		Handler(a.bounded(a.idempotent(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			var args PowerCycleArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err = a.daemon.PowerCycleNode(ctx, nodeId(req), args.Force, token)
+			a.relayError(w, req, "daemon.PowerCycleNode()", err)
+		}))))
+
+	userR.Methods("POST").Path("/node/{node_id}/power_off").
+		Handler(a.bounded(a.idempotent(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			a.relayError(w, req, "daemon.PowerOff()", a.daemon.PowerOffNode(ctx, nodeId(req), token))
+		}))))
+
+	userR.Methods("POST").Path("/node/{node_id}/shutdown").
+		Handler(a.bounded(a.idempotent(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			var args ShutdownArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil && err != io.EOF {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err = a.daemon.ShutdownNode(ctx, nodeId(req), time.Duration(args.Timeout), token)
+			a.relayError(w, req, "daemon.ShutdownNode()", err)
+		}))))
+
+	userR.Methods("GET").Path("/node/{node_id}/power_status").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			state, err := a.daemon.NodePowerStatus(ctx, nodeId(req), token)
+			if err != nil {
+				a.relayError(w, req, "daemon.NodePowerStatus()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&PowerResp{Power: state})
+		})))
+
+	userR.Methods("GET").Path("/node/{node_id}/power_reading").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			reading, err := a.daemon.NodePowerReading(ctx, nodeId(req), token)
+			if err != nil {
+				a.relayError(w, req, "daemon.NodePowerReading()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&reading)
+		})))
+
+	// Power limits are shared out by the admin (see power groups), so
+	// users can't change them.
+	adminR.Methods("PUT").Path("/node/{node_id}/power_limit").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args PowerLimitArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil || args.Watts < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err = a.daemon.SetNodePowerLimit(ctx, nodeId(req), args.Watts, nil)
+			a.relayError(w, req, "daemon.SetNodePowerLimit()", err)
+		})))
+
+	userR.Methods("GET").Path("/node/{node_id}/watchdog").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			status, err := a.daemon.NodeWatchdog(ctx, nodeId(req), token)
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeWatchdog()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&status)
+		})))
+
+	userR.Methods("PUT").Path("/node/{node_id}/watchdog").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			var args WatchdogArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil || args.Timeout <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err = a.daemon.ArmNodeWatchdog(ctx, nodeId(req), args.Timeout, token)
+			a.relayError(w, req, "daemon.ArmNodeWatchdog()", err)
+		})))
+
+	userR.Methods("POST").Path("/node/{node_id}/watchdog/reset").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err := a.daemon.ResetNodeWatchdog(ctx, nodeId(req), token)
+			a.relayError(w, req, "daemon.ResetNodeWatchdog()", err)
+		})))
+
+	userR.Methods("DELETE").Path("/node/{node_id}/watchdog").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err := a.daemon.StopNodeWatchdog(ctx, nodeId(req), token)
+			a.relayError(w, req, "daemon.StopNodeWatchdog()", err)
+		})))
+
+	userR.Methods("GET").Path("/node/{node_id}/capabilities").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			caps, err := a.daemon.NodeCapabilities(ctx, nodeId(req), token)
+			if err != nil {
+				a.relayError(w, req, "daemon.NodeCapabilities()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&caps)
+		})))
+
+	userR.Methods("PUT").Path("/node/{node_id}/boot_device").
+		Handler(a.bounded(a.withToken(func(w http.ResponseWriter, req *http.Request, token *obmd.Token) {
+			var args SetBootdevArgs
+			err := json.NewDecoder(req.Body).Decode(&args)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			err = a.daemon.SetNodeBootDev(ctx, nodeId(req), args.Dev, token)
+			a.relayError(w, req, "daemon.SetNodeBootDev()", err)
+		})))
+}
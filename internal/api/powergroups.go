@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Register the routes for managing power groups.
+func (a *api) powerGroupRoutes(adminR *mux.Router) {
+	adminR.Methods("GET").Path("/power_group").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			groups, err := a.daemon.PowerGroups()
+			if err != nil {
+				a.relayError(w, req, "daemon.PowerGroups()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&PowerGroupsResp{Groups: groups})
+		})))
+
+	adminR.Methods("GET").Path("/power_group/{group_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			group, err := a.daemon.PowerGroup(mux.Vars(req)["group_id"])
+			if err != nil {
+				a.relayError(w, req, "daemon.PowerGroup()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&group)
+		})))
+
+	// Create or replace a group, and apply its members' shares of the
+	// budget.
+	adminR.Methods("PUT").Path("/power_group/{group_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var args PowerGroupArgs
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			results, err := a.daemon.SetPowerGroup(ctx, mux.Vars(req)["group_id"], args.Budget, args.Nodes)
+			a.relayCaps(w, req, "daemon.SetPowerGroup()", results, err)
+		})))
+
+	// Delete a group, removing its members' power limits.
+	adminR.Methods("DELETE").Path("/power_group/{group_id}").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			results, err := a.daemon.DeletePowerGroup(ctx, mux.Vars(req)["group_id"])
+			a.relayCaps(w, req, "daemon.DeletePowerGroup()", results, err)
+		})))
+}
+
+// Respond with the outcome of changing a power group: an error status if
+// the group wasn't changed, or the outcome for each node otherwise.
+func (a *api) relayCaps(w http.ResponseWriter, req *http.Request, desc string, results []obmd.PowerCapResult, err error) {
+	if err != nil {
+		a.relayError(w, req, desc, err)
+		return
+	}
+	resp := PowerCapsResp{Caps: []PowerCapStatus{}}
+	for _, r := range results {
+		resp.Caps = append(resp.Caps, PowerCapStatus{
+			Node:   r.Node,
+			Watts:  r.Watts,
+			Status: a.errorStatus(req.Context(), desc, r.Err),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// A link to another resource, in Redfish's (OData's) format.
+type redfishLink struct {
+	ID string `json:"@odata.id"`
+}
+
+// The boot override properties of a Redfish ComputerSystem.
+type redfishBoot struct {
+	Enabled   string   `json:"BootSourceOverrideEnabled,omitempty"`
+	Target    string   `json:"BootSourceOverrideTarget,omitempty"`
+	Allowable []string `json:"BootSourceOverrideTarget@Redfish.AllowableValues,omitempty"`
+}
+
+// Redfish boot source override targets, and the boot devices they map to.
+var redfishBootdevs = map[string]string{
+	"None":      "none",
+	"Pxe":       "pxe",
+	"Hdd":       "disk",
+	"Cd":        "cdrom",
+	"BiosSetup": "bios",
+}
+
+// Redfish reset types, and the operations they map to. A graceful restart
+// needs the cooperation of the OS, which we can't ask for; a graceful
+// shutdown is just a request, which it may ignore.
+var redfishResets = map[string]func(d obmd.Daemon, ctx context.Context, label string, token *obmd.Token) error{
+	"On":       obmd.Daemon.PowerOnNode,
+	"ForceOn":  obmd.Daemon.PowerOnNode,
+	"ForceOff": obmd.Daemon.PowerOffNode,
+	"GracefulShutdown": func(d obmd.Daemon, ctx context.Context, label string, token *obmd.Token) error {
+		return d.ShutdownNode(ctx, label, 0, token)
+	},
+	"ForceRestart": func(d obmd.Daemon, ctx context.Context, label string, token *obmd.Token) error {
+		return d.PowerCycleNode(ctx, label, true, token)
+	},
+	"PowerCycle": func(d obmd.Daemon, ctx context.Context, label string, token *obmd.Token) error {
+		return d.PowerCycleNode(ctx, label, false, token)
+	},
+}
+
+// The boot overrides last set on each node via Redfish, which the nodes'
+// OBMs can't report.
+type redfishOverrides struct {
+	sync.Mutex
+	byNode map[string]redfishBoot
+}
+
+func (o *redfishOverrides) get(label string) redfishBoot {
+	o.Lock()
+	defer o.Unlock()
+	boot, ok := o.byNode[label]
+	if !ok {
+		boot = redfishBoot{Enabled: "Disabled", Target: "None"}
+	}
+	return boot
+}
+
+func (o *redfishOverrides) set(label string, boot redfishBoot) {
+	o.Lock()
+	defer o.Unlock()
+	o.byNode[label] = boot
+}
+
+// Make a handler for the Redfish api, which exposes nodes as ComputerSystems
+// under /redfish/v1/Systems, using a's settings and daemon, and reporting
+// errors with the same statuses. `parts` is as for NewHandler: the admin
+// (who may use every node) is accepted only if the admin api is served, and
+// node tokens (each of which give access to its node only) only if the
+// "regular user" api is served.
+func makeRedfishHandler(a *api, parts Parts) http.Handler {
+	daemon := a.daemon
+	r := mux.NewRouter()
+	log := logger.With("subsystem", "redfish")
+	overrides := &redfishOverrides{byNode: make(map[string]redfishBoot)}
+
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("OData-Version", "4.0")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	// Report an error in Redfish's format.
+	writeError := func(w http.ResponseWriter, status int, msg string) {
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		body.Error.Code = "Base.1.0.GeneralError"
+		body.Error.Message = msg
+		writeJSON(w, status, body)
+	}
+
+	// Like api.relayError, but with the body in Redfish's format. The
+	// error's own text is the message, unless it is unexpected.
+	relayError := func(w http.ResponseWriter, req *http.Request, desc string, err error) {
+		if e, ok := err.(obmd.PowerCycleRateError); ok {
+			w.Header().Set("Retry-After", retryAfter(e.RetryAfter))
+		}
+		status := a.errorStatus(req.Context(), desc, err)
+		msg := err.Error()
+		if status == http.StatusInternalServerError {
+			msg = "Internal error."
+		}
+		writeError(w, status, msg)
+	}
+
+	// Check req's credentials, which are http basic auth: either "admin"
+	// and the admin token, or a node's label and token. Returns the
+	// token to act with (nil for the admin), and the node it gives access
+	// to ("" for all of them). If the credentials are invalid, this
+	// responds with a 401, and ok is false.
+	authenticate := func(w http.ResponseWriter, req *http.Request) (label string, token *obmd.Token, ok bool) {
+		if parts&AdminAPI != 0 && IsAdmin(req, a.settings().AdminToken) {
+			return "", nil, true
+		}
+		user, pass, hasAuth := req.BasicAuth()
+		token = new(obmd.Token)
+		if parts&UserAPI != 0 && hasAuth && token.UnmarshalText([]byte(pass)) == nil &&
+			daemon.CheckNodeToken(user, *token) == nil {
+			return user, token, true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="obmd"`)
+		writeError(w, http.StatusUnauthorized, "Invalid credentials.")
+		return "", nil, false
+	}
+
+	// Authenticate req, and check its credentials give access to the
+	// system it names, responding with an error if not.
+	system := func(w http.ResponseWriter, req *http.Request) (label string, token *obmd.Token, ok bool) {
+		allowed, token, ok := authenticate(w, req)
+		if !ok {
+			return "", nil, false
+		}
+		label = mux.Vars(req)["node_id"]
+		if allowed != "" && allowed != label {
+			writeError(w, http.StatusNotFound, "No such system.")
+			return "", nil, false
+		}
+		return label, token, true
+	}
+
+	serviceRoot := func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"@odata.id":      "/redfish/v1/",
+			"@odata.type":    "#ServiceRoot.v1_5_0.ServiceRoot",
+			"Id":             "RootService",
+			"Name":           "obmd Redfish Service",
+			"RedfishVersion": "1.6.0",
+			"Systems":        redfishLink{"/redfish/v1/Systems"},
+		})
+	}
+	r.Methods("GET").Path("/redfish").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"v1": "/redfish/v1/"})
+	})
+	// The service root doesn't require authentication.
+	r.Methods("GET").Path("/redfish/v1").HandlerFunc(serviceRoot)
+	r.Methods("GET").Path("/redfish/v1/").HandlerFunc(serviceRoot)
+
+	r.Methods("GET").Path("/redfish/v1/Systems").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			allowed, _, ok := authenticate(w, req)
+			if !ok {
+				return
+			}
+			labels := []string{allowed}
+			if allowed == "" {
+				labels = daemon.NodeLabels()
+			}
+			members := []redfishLink{}
+			for _, label := range labels {
+				members = append(members, redfishLink{"/redfish/v1/Systems/" + url.PathEscape(label)})
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"@odata.id":           "/redfish/v1/Systems",
+				"@odata.type":         "#ComputerSystemCollection.ComputerSystemCollection",
+				"Name":                "Computer System Collection",
+				"Members":             members,
+				"Members@odata.count": len(members),
+			})
+		})
+
+	r.Methods("GET").Path("/redfish/v1/Systems/{node_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			label, token, ok := system(w, req)
+			if !ok {
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			state, err := daemon.NodePowerStatus(ctx, label, token)
+			switch err {
+			case nil:
+			case obmd.ErrNoSuchNode, obmd.ErrInvalidToken, obmd.ErrNodeQuarantined, obmd.ErrShuttingDown:
+				relayError(w, req, "redfish get system", err)
+				return
+			default:
+				// Report the power state as unknown, rather than
+				// hiding the system.
+				log.Warn("Error querying power status", "node", label, "err", err)
+			}
+			var power interface{}
+			switch state {
+			case driver.PowerStateOn:
+				power = "On"
+			case driver.PowerStateOff:
+				power = "Off"
+			}
+			boot := overrides.get(label)
+			for target := range redfishBootdevs {
+				boot.Allowable = append(boot.Allowable, target)
+			}
+			sort.Strings(boot.Allowable)
+			var resets []string
+			for typ := range redfishResets {
+				resets = append(resets, typ)
+			}
+			sort.Strings(resets)
+			self := "/redfish/v1/Systems/" + url.PathEscape(label)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"@odata.id":   self,
+				"@odata.type": "#ComputerSystem.v1_5_0.ComputerSystem",
+				"Id":          label,
+				"Name":        label,
+				"PowerState":  power,
+				"Boot":        boot,
+				"Actions": map[string]interface{}{
+					"#ComputerSystem.Reset": map[string]interface{}{
+						"target":                            self + "/Actions/ComputerSystem.Reset",
+						"ResetType@Redfish.AllowableValues": resets,
+					},
+				},
+			})
+		})
+
+	// Set the boot source override.
+	r.Methods("PATCH").Path("/redfish/v1/Systems/{node_id}").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			label, token, ok := system(w, req)
+			if !ok {
+				return
+			}
+			var args struct {
+				Boot *redfishBoot
+			}
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil || args.Boot == nil {
+				writeError(w, http.StatusBadRequest, "Expected a Boot object.")
+				return
+			}
+			boot := overrides.get(label)
+			if args.Boot.Target != "" {
+				boot.Target = args.Boot.Target
+			}
+			if args.Boot.Enabled != "" {
+				boot.Enabled = args.Boot.Enabled
+			}
+			dev, ok := redfishBootdevs[boot.Target]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "Unsupported BootSourceOverrideTarget.")
+				return
+			}
+			switch boot.Enabled {
+			case "Disabled":
+				dev = "none"
+			case "Once", "Continuous":
+			default:
+				writeError(w, http.StatusBadRequest, "Unsupported BootSourceOverrideEnabled.")
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			if err := daemon.SetNodeBootDev(ctx, label, dev, token); err != nil {
+				relayError(w, req, "redfish set boot override", err)
+				return
+			}
+			overrides.set(label, boot)
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+	r.Methods("POST").Path("/redfish/v1/Systems/{node_id}/Actions/ComputerSystem.Reset").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			label, token, ok := system(w, req)
+			if !ok {
+				return
+			}
+			var args struct {
+				ResetType string
+			}
+			if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+				writeError(w, http.StatusBadRequest, "Invalid request body.")
+				return
+			}
+			reset, ok := redfishResets[args.ResetType]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "Unsupported ResetType.")
+				return
+			}
+			ctx, cancel := a.opContext(req)
+			defer cancel()
+			if err := reset(daemon, ctx, label, token); err != nil {
+				relayError(w, req, "redfish reset "+args.ResetType, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, http.StatusNotFound, "No such resource.")
+	})
+	return r
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Register the routes for backing up the database and taking snapshots
+// of the configuration.
+func (a *api) snapshotRoutes(adminR *mux.Router) {
+	// Stream a backup of the database to the client.
+	adminR.Methods("GET").Path("/backup").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			tw := &trackingWriter{w: w}
+			err := a.daemon.Backup(a.settings().DBType, a.settings().DBPath, tw)
+			if err == nil {
+				return
+			}
+			if tw.wrote {
+				// Too late to report this via the status code.
+				a.log.WithContext(req.Context()).Error("Error streaming backup", "err", err)
+			} else {
+				a.relayError(w, req, "daemon.Backup()", err)
+			}
+		})
+
+	// Report a snapshot of the nodes and policy settings, for keeping a
+	// record of changes.
+	adminR.Methods("GET").Path("/snapshot").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			snapshot := a.snapshot()
+			json.NewEncoder(w).Encode(&snapshot)
+		})))
+
+	// Compare the given snapshot with the current one.
+	adminR.Methods("POST").Path("/snapshot/diff").
+		Handler(a.bounded(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, err := ioutil.ReadAll(req.Body)
+			var given map[string]interface{}
+			if err != nil || obmd.DecodeJSON(body, &given) != nil || given == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			current, err := json.Marshal(a.snapshot())
+			var now map[string]interface{}
+			if err == nil {
+				err = obmd.DecodeJSON(current, &now)
+			}
+			if err != nil {
+				a.relayError(w, req, "snapshot()", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&SnapshotDiffResp{
+				Changes: diffSnapshots(given, now),
+			})
+		})))
+}
+
+// One difference between two snapshots.
+type SnapshotChange struct {
+	// Where the snapshots differ, as a JSON pointer (RFC 6901), e.g.
+	// "/nodes/node-1/info/addr".
+	Path string `json:"path"`
+
+	// The values in the old and new snapshots; either is left out if it
+	// isn't in that snapshot.
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// Compare the snapshots old and new, which are JSON objects as decoded
+// into interface{}s (see obmd.DecodeJSON), returning the differences in order
+// of their paths. Arrays are compared as a whole.
+func diffSnapshots(old, new interface{}) []SnapshotChange {
+	changes := []SnapshotChange{}
+	diffJSON("", old, new, &changes)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func diffJSON(path string, old, new interface{}, changes *[]SnapshotChange) {
+	oldObj, oldOk := old.(map[string]interface{})
+	newObj, newOk := new.(map[string]interface{})
+	if !oldOk || !newOk {
+		if !reflect.DeepEqual(old, new) {
+			*changes = append(*changes, SnapshotChange{Path: path, Old: old, New: new})
+		}
+		return
+	}
+	for k, v := range oldObj {
+		diffJSON(path+"/"+pointerEscaper.Replace(k), v, newObj[k], changes)
+	}
+	for k, v := range newObj {
+		if _, ok := oldObj[k]; !ok {
+			diffJSON(path+"/"+pointerEscaper.Replace(k), nil, v, changes)
+		}
+	}
+}
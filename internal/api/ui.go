@@ -0,0 +1,288 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// A small single-page admin UI, served under /ui/ if Settings.WebUI is set.
+// It is a static page which talks to the api from the browser, using the
+// admin token the operator enters (which is kept in the tab's session
+// storage), so it needs no support from the server beyond serving it.
+//
+// The page is kept in constants, rather than embedded from a file, since we
+// still support Go versions which predate go:embed.
+
+const uiHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>obmd</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+#side { width: 16em; border-right: 1px solid #ccc; overflow-y: auto; padding: 0.5em; }
+#main { flex: 1; padding: 0.5em 1em; display: flex; flex-direction: column; min-width: 0; }
+#nodes li { cursor: pointer; padding: 0.2em; list-style: none; }
+#nodes li.selected { background: #def; }
+#nodes li.quarantined { color: #a00; }
+#nodes { padding: 0; }
+#console { flex: 1; background: #000; color: #ddd; overflow: auto; margin: 0.5em 0;
+  padding: 0.5em; white-space: pre-wrap; word-break: break-all; }
+#error { color: #a00; }
+.hidden { display: none; }
+button { margin: 0.1em; }
+</style>
+</head>
+<body>
+<div id="side">
+  <form id="login">
+    <input id="admin-token" type="password" placeholder="Admin token" size="20">
+    <button>Log in</button>
+  </form>
+  <button id="refresh" class="hidden">Refresh</button>
+  <ul id="nodes"></ul>
+</div>
+<div id="main">
+  <p id="error"></p>
+  <div id="node" class="hidden">
+    <h2 id="node-label"></h2>
+    <p>
+      Token: <input id="token" size="34" placeholder="none">
+      <button id="new-token">Issue new token</button>
+      <button id="revoke-token">Revoke token</button>
+    </p>
+    <p>
+      Power: <span id="power">unknown</span>
+      <button id="power-status">Refresh</button>
+      <button id="power-off">Off</button>
+      <button id="power-cycle">Reboot</button>
+      <button id="power-reset">Force reboot</button>
+    </p>
+    <p>
+      <button id="console-connect">Connect console</button>
+      <button id="console-disconnect" disabled>Disconnect</button>
+    </p>
+  </div>
+  <pre id="console" class="hidden"></pre>
+  <form id="console-input" class="hidden">
+    <input id="console-line" size="60" placeholder="Send a line to the console">
+    <button>Send</button>
+  </form>
+</div>
+<script>` + uiScript + `</script>
+</body>
+</html>
+`
+
+const uiScript = `
+"use strict";
+var $ = function(id) { return document.getElementById(id); };
+var adminToken = sessionStorage.getItem("obmdAdminToken") || "";
+var current = null;      // the selected node's label.
+var consoleAbort = null; // aborts the console stream, if connected.
+
+function showError(msg) { $("error").textContent = msg || ""; }
+
+function nodeURL(suffix) {
+  return "../node/" + encodeURIComponent(current) + suffix;
+}
+
+// Make an api request, failing if the response isn't a success. If auth is
+// true, authenticate as the admin; otherwise, pass the node token.
+function api(method, url, opts) {
+  opts = opts || {};
+  var headers = {};
+  if (opts.auth) {
+    headers["Authorization"] = "Basic " + btoa("admin:" + adminToken);
+  } else {
+    url += (url.indexOf("?") < 0 ? "?" : "&") + "token=" + encodeURIComponent($("token").value);
+  }
+  return fetch(url, {method: method, headers: headers, body: opts.body, signal: opts.signal})
+    .then(function(resp) {
+      if (!resp.ok) {
+        if (resp.status == 404 && opts.auth) {
+          throw new Error("Not found (or the admin token is wrong).");
+        }
+        throw new Error(method + " " + url.split("?")[0] + ": " + resp.status + " " + resp.statusText);
+      }
+      return resp;
+    });
+}
+
+function loadNodes() {
+  showError();
+  Promise.all([
+    api("GET", "../node", {auth: true}).then(function(r) { return r.json(); }),
+    api("GET", "../quarantine", {auth: true}).then(function(r) { return r.json(); })
+  ]).then(function(results) {
+    var quarantined = results[1].nodes || {};
+    var list = $("nodes");
+    list.textContent = "";
+    (results[0].nodes || []).forEach(function(label) {
+      var li = document.createElement("li");
+      li.textContent = label;
+      if (label in quarantined) {
+        li.className = "quarantined";
+        li.title = "Quarantined: " + quarantined[label];
+      }
+      if (label == current) {
+        li.className += " selected";
+      }
+      li.onclick = function() { select(label); };
+      list.appendChild(li);
+    });
+    $("login").className = "hidden";
+    $("refresh").className = "";
+  }).catch(function(err) {
+    showError(err.message);
+    $("login").className = "";
+  });
+}
+
+function select(label) {
+  disconnectConsole();
+  current = label;
+  $("node-label").textContent = label;
+  $("token").value = "";
+  $("power").textContent = "unknown";
+  $("node").className = "";
+  $("console").textContent = "";
+  Array.prototype.forEach.call($("nodes").children, function(li) {
+    li.classList.toggle("selected", li.textContent == label);
+  });
+}
+
+function powerStatus() {
+  showError();
+  return api("GET", nodeURL("/power_status"))
+    .then(function(r) { return r.json(); })
+    .then(function(status) { $("power").textContent = status.power; })
+    .catch(function(err) { showError(err.message); });
+}
+
+function powerAction(path, body) {
+  return function() {
+    showError();
+    api("POST", nodeURL(path), {body: body})
+      .then(powerStatus)
+      .catch(function(err) { showError(err.message); });
+  };
+}
+
+function connectConsole() {
+  showError();
+  var out = $("console");
+  var controller = new AbortController();
+  consoleAbort = controller;
+  api("GET", nodeURL("/console?sanitize=true&replay=4k"), {signal: controller.signal})
+    .then(function(resp) {
+      out.className = "";
+      $("console-input").className = "";
+      $("console-connect").disabled = true;
+      $("console-disconnect").disabled = false;
+      var reader = resp.body.getReader();
+      var decoder = new TextDecoder();
+      function pump() {
+        return reader.read().then(function(chunk) {
+          if (chunk.done) {
+            return;
+          }
+          var atBottom = out.scrollTop + out.clientHeight >= out.scrollHeight - 4;
+          out.textContent += decoder.decode(chunk.value, {stream: true});
+          if (out.textContent.length > 200000) {
+            out.textContent = out.textContent.slice(-100000);
+          }
+          if (atBottom) {
+            out.scrollTop = out.scrollHeight;
+          }
+          return pump();
+        });
+      }
+      return pump();
+    })
+    .catch(function(err) {
+      if (err.name != "AbortError") {
+        showError(err.message);
+      }
+    })
+    .then(function() {
+      if (consoleAbort == controller) {
+        consoleAbort = null;
+        $("console-connect").disabled = false;
+        $("console-disconnect").disabled = true;
+        $("console-input").className = "hidden";
+      }
+    });
+}
+
+function disconnectConsole() {
+  if (consoleAbort) {
+    consoleAbort.abort();
+  }
+}
+
+$("login").onsubmit = function(e) {
+  e.preventDefault();
+  adminToken = $("admin-token").value;
+  sessionStorage.setItem("obmdAdminToken", adminToken);
+  loadNodes();
+};
+$("refresh").onclick = loadNodes;
+$("new-token").onclick = function() {
+  showError();
+  disconnectConsole();
+  api("POST", nodeURL("/token"), {auth: true})
+    .then(function(r) { return r.json(); })
+    .then(function(resp) { $("token").value = resp.token; })
+    .catch(function(err) { showError(err.message); });
+};
+$("revoke-token").onclick = function() {
+  showError();
+  disconnectConsole();
+  api("DELETE", nodeURL("/token"), {auth: true})
+    .then(function() { $("token").value = ""; })
+    .catch(function(err) { showError(err.message); });
+};
+$("power-status").onclick = powerStatus;
+$("power-off").onclick = powerAction("/power_off");
+$("power-cycle").onclick = powerAction("/power_cycle", '{"force": false}');
+$("power-reset").onclick = powerAction("/power_cycle", '{"force": true}');
+$("console-connect").onclick = connectConsole;
+$("console-disconnect").onclick = disconnectConsole;
+$("console-input").onsubmit = function(e) {
+  e.preventDefault();
+  showError();
+  api("POST", nodeURL("/console/input"), {body: $("console-line").value + "\r"})
+    .then(function() { $("console-line").value = ""; })
+    .catch(function(err) { showError(err.message); });
+};
+
+if (adminToken) {
+  $("admin-token").value = adminToken;
+  loadNodes();
+}
+`
+
+// The Content-Security-Policy for the UI, which only allows its own script
+// to run, and only allows it to talk to this server.
+var uiCSP = func() string {
+	sum := sha256.Sum256([]byte(uiScript))
+	return strings.Join([]string{
+		"default-src 'none'",
+		"script-src 'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'",
+		"style-src 'unsafe-inline'",
+		"connect-src 'self'",
+		"frame-ancestors 'none'",
+	}, "; ")
+}()
+
+// Serve the UI's page.
+func serveUI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", uiCSP)
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(uiHTML))
+}
@@ -0,0 +1,171 @@
+// Package consoleio wraps nodes' console streams: recording them to
+// files, and sanitizing them for clients which aren't terminals.
+package consoleio
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// Writes console output as an asciicast (v2) recording, in which each
+// chunk of output is timestamped; see:
+//
+// https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type asciicastWriter struct {
+	w     io.Writer
+	start time.Time
+	now   func() time.Time // for testing.
+
+	// The tail of the last chunk, if it ended partway through a UTF-8
+	// sequence. Each event must be valid UTF-8, so this is held back
+	// until the rest of it arrives.
+	partial []byte
+}
+
+// The header of an asciicast file.
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+// Start a recording on w, writing the header.
+func newAsciicastWriter(w io.Writer, title string, start time.Time) (*asciicastWriter, error) {
+	err := json.NewEncoder(w).Encode(&asciicastHeader{
+		Version: 2,
+		// Serial consoles don't report a size; this is the traditional
+		// terminal size, which is what most firmware assumes.
+		Width:     80,
+		Height:    24,
+		Timestamp: start.Unix(),
+		Title:     title,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &asciicastWriter{w: w, start: start, now: time.Now}, nil
+}
+
+// Record p as an output event.
+func (a *asciicastWriter) Write(p []byte) (int, error) {
+	data := append(a.partial, p...)
+	a.partial = nil
+	if n := incompleteSuffix(data); n > 0 {
+		a.partial = append([]byte(nil), data[len(data)-n:]...)
+		data = data[:len(data)-n]
+	}
+	if len(data) == 0 {
+		return len(p), nil
+	}
+	// Invalid UTF-8 is replaced with U+FFFD by the encoder.
+	elapsed := a.now().Sub(a.start).Seconds()
+	event := []interface{}{elapsed, "o", string(data)}
+	if err := json.NewEncoder(a.w).Encode(event); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Return the length of the incomplete UTF-8 sequence at the end of p, if
+// any.
+func incompleteSuffix(p []byte) int {
+	// A sequence is at most utf8.UTFMax bytes, so only the last few bytes
+	// can start one.
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		b := p[len(p)-i]
+		if utf8.RuneStart(b) {
+			if !utf8.FullRune(p[len(p)-i:]) {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// A console connection which records what is read from it.
+type recordedConsole struct {
+	io.ReadCloser
+
+	// Protects the fields below, since the connection may be closed
+	// while it is being read (see obmd.Daemon.DisconnectConsole).
+	lock   sync.Mutex
+	file   *os.File
+	cast   *asciicastWriter
+	failed bool // set if we've stopped recording.
+}
+
+func (r *recordedConsole) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n > 0 && !r.failed {
+		if _, werr := r.cast.Write(p[:n]); werr != nil {
+			// Don't interrupt the console over this, but stop
+			// recording.
+			logger.Error("Error recording console output; "+
+				"stopping recording", "file", r.file.Name(), "err", werr)
+			r.failed = true
+		}
+	}
+	return n, err
+}
+
+func (r *recordedConsole) Close() error {
+	err := r.ReadCloser.Close()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+		r.failed = true
+	}
+	return err
+}
+
+// Record conn in dir (see recordConsole), unless dir is empty. If the
+// recording can't be started, the error is logged, and conn is returned
+// as-is.
+func StartRecording(conn io.ReadCloser, dir, label string) io.ReadCloser {
+	if dir == "" {
+		return conn
+	}
+	rec, err := recordConsole(conn, dir, label)
+	if err != nil {
+		logger.Error("Error starting console recording; continuing without it",
+			"node", label, "err", err)
+		return conn
+	}
+	return rec
+}
+
+// Record a client's console connection to the node `label` in a new
+// asciicast file in dir, named after the node and the current time.
+func recordConsole(conn io.ReadCloser, dir, label string) (io.ReadCloser, error) {
+	start := time.Now()
+	name := fmt.Sprintf("%s.%s.cast",
+		url.PathEscape(label),
+		start.UTC().Format("20060102T150405.000000000Z"))
+	file, err := os.OpenFile(filepath.Join(dir, name),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	cast, err := newAsciicastWriter(file, label, start)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &recordedConsole{ReadCloser: conn, file: file, cast: cast}, nil
+}
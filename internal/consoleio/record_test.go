@@ -0,0 +1,33 @@
+package consoleio
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Output should be recorded as timestamped events, without splitting
+// multi-byte characters across events.
+func TestAsciicast(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	now := start
+	buf := &bytes.Buffer{}
+	cast, err := newAsciicastWriter(buf, "somenode", start)
+	if err != nil {
+		t.Fatal("Writing header:", err)
+	}
+	cast.now = func() time.Time { return now }
+
+	now = start.Add(500 * time.Millisecond)
+	cast.Write([]byte("caf\xc3"))
+	now = start.Add(2 * time.Second)
+	cast.Write([]byte("\xa9\r\n"))
+
+	expected := `{"version":2,"width":80,"height":24,"timestamp":1500000000,"title":"somenode"}
+[0.5,"o","caf"]
+[2,"o","é\r\n"]
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected recording. Wanted:\n%s\nbut got:\n%s", expected, buf.String())
+	}
+}
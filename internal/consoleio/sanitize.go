@@ -0,0 +1,95 @@
+package consoleio
+
+import (
+	"io"
+)
+
+// States of the Sanitizer's escape sequence parser.
+const (
+	sanitizeText   = iota
+	sanitizeEscape // after ESC.
+	sanitizeCSI    // in a control sequence (ESC [).
+	sanitizeString // in a string (e.g. ESC ], an operating system command).
+	sanitizeStringEscape
+)
+
+// Wraps a console stream, removing ANSI escape sequences and non-printable
+// characters, for clients which aren't terminals. Newlines and tabs are
+// kept, but carriage returns are dropped, so that "\r\n" becomes "\n".
+// Bytes outside ASCII are passed through, so UTF-8 text is preserved.
+type Sanitizer struct {
+	io.ReadCloser
+	state int
+}
+
+func NewSanitizer(r io.ReadCloser) *Sanitizer {
+	return &Sanitizer{ReadCloser: r}
+}
+
+// Sanitize p in place, as a Sanitizer would, returning the result.
+func Sanitize(p []byte) []byte {
+	return p[:(&Sanitizer{}).filter(p)]
+}
+
+func (s *Sanitizer) Read(p []byte) (int, error) {
+	for {
+		n, err := s.ReadCloser.Read(p)
+		n = s.filter(p[:n])
+		// Don't return (0, nil) just because everything was filtered
+		// out; callers may take that as the end of the stream.
+		if n != 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Filter p in place, returning the length of the result.
+func (s *Sanitizer) filter(p []byte) int {
+	n := 0
+	for _, b := range p {
+		switch s.state {
+		case sanitizeEscape:
+			switch b {
+			case '[':
+				s.state = sanitizeCSI
+			case ']', 'P', 'X', '^', '_':
+				s.state = sanitizeString
+			default:
+				// Intermediate bytes (e.g. the "(" in a character set
+				// selection) are followed by a final byte, which
+				// ends the sequence.
+				if b < 0x20 || b > 0x2f {
+					s.state = sanitizeText
+				}
+			}
+		case sanitizeCSI:
+			if b >= 0x40 && b <= 0x7e {
+				s.state = sanitizeText
+			}
+		case sanitizeString:
+			switch b {
+			case '\a':
+				s.state = sanitizeText
+			case 0x1b:
+				s.state = sanitizeStringEscape
+			}
+		case sanitizeStringEscape:
+			// ESC \ terminates the string; treat anything else as
+			// the start of a new sequence.
+			if b == '\\' {
+				s.state = sanitizeText
+			} else {
+				s.state = sanitizeEscape
+			}
+		default:
+			switch {
+			case b == 0x1b:
+				s.state = sanitizeEscape
+			case b == '\n', b == '\t', b >= 0x20 && b != 0x7f:
+				p[n] = b
+				n++
+			}
+		}
+	}
+	return n
+}
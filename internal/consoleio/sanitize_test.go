@@ -0,0 +1,38 @@
+package consoleio
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Escape sequences and control characters should be removed, even when
+// split across reads.
+func TestSanitizer(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{"plain text\r\n", "plain text\n"},
+		{"\x1b[2J\x1b[1;1Hcleared", "cleared"},
+		{"\x1b[0;37;40mcolour\x1b[0m", "colour"},
+		{"\x1b]0;title\atext", "text"},
+		{"\x1b]0;title\x1b\\text", "text"},
+		{"\x1b(Bcharset", "charset"},
+		{"\x1b7saved\x1b8", "saved"},
+		{"bell\a, tab\t, del\x7f", "bell, tab\t, del"},
+		{"caf\xc3\xa9", "caf\xc3\xa9"},
+	}
+	for _, c := range cases {
+		// Deliver the input a byte at a time, to exercise the parser's
+		// state across reads:
+		r := NewSanitizer(ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(c.in))))
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Sanitizing %q: %v", c.in, err)
+		}
+		if string(out) != c.out {
+			t.Fatalf("Sanitizing %q: wanted %q but got %q", c.in, c.out, out)
+		}
+	}
+}
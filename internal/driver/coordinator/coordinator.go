@@ -4,7 +4,12 @@ package coordinator
 import (
 	"context"
 	"io"
-	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
 )
 
 // A proc is a live "process" managing a console connection.
@@ -17,32 +22,172 @@ type Proc interface {
 	Reader() io.Reader
 }
 
+// A Proc may optionally implement WriterProc, to support sending input to
+// the console.
+type WriterProc interface {
+	// Writer returns an io.Writer that writes to the console.
+	Writer() io.Writer
+}
+
+// A Proc may optionally implement Killer, which the coordinator uses to
+// forcibly clean up a session whose Shutdown exceeds the timeout (see
+// SetTimeout), e.g. by killing a child process and its descendants.
+type Killer interface {
+	Kill() error
+}
+
 // A "primitive" OBM, from which the coordinator can build a driver.OBM.
 type OBM interface {
 	// Connect to the console, returning the managing Proc and an
-	// error, if any.
-	Dial() (Proc, error)
+	// error, if any. ctx is the server's (see Server.Serve), and carries
+	// its fields for logging; the connection outlives the call.
+	Dial(ctx context.Context) (Proc, error)
+}
+
+// The maximum time to wait for a driver operation (see SetTimeout), in
+// nanoseconds. Accessed atomically.
+var timeout int64
+
+// Set the maximum time to wait for a driver operation (connecting to or
+// disconnecting from the console, or a function submitted via RunInServer)
+// before giving up on it, so that a wedged operation (e.g. a hung ipmitool
+// process) can't block a Server forever. Zero means no limit. This applies
+// to all Servers, and may be changed at any time.
+func SetTimeout(d time.Duration) {
+	atomic.StoreInt64(&timeout, int64(d))
+}
+
+// Wait for done to be closed, for at most the timeout. Reports whether it
+// was closed.
+func waitWithTimeout(done <-chan struct{}) bool {
+	d := time.Duration(atomic.LoadInt64(&timeout))
+	if d == 0 {
+		<-done
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// The number of bytes of console output to keep for replay (see
+// SetHistorySize). Accessed atomically.
+var historySize int64
+
+// Set the number of bytes of recent output to keep for each console
+// session, to be replayed to clients on request (see DialConsoleReplay).
+// Zero disables this. If non-zero, sessions also stay connected when their
+// last client disconnects, so that output continues to be recorded until the
+// session is dropped with DropConsole. This applies to sessions started
+// after the call.
+func SetHistorySize(n int) {
+	atomic.StoreInt64(&historySize, int64(n))
+}
+
+// The number of times to try reconnecting a console session whose
+// connection was lost (see SetReconnectAttempts). Accessed atomically.
+var reconnectAttempts int64
+
+// The delay before the first attempt to reconnect a console session, which
+// doubles with each failed attempt, up to reconnectMaxDelay. A session which
+// stayed up for at least reconnectMaxDelay starts over from the beginning.
+// These are the defaults for Server.reconnectMinDelay and
+// reconnectMaxDelay.
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+)
+
+// Set the number of times to try reconnecting a console session whose
+// connection is lost unexpectedly (e.g. because the BMC timed out the
+// session), with exponential backoff between attempts. While reconnecting,
+// clients stay connected; when the session resumes, they receive a marker
+// line noting that output may have been lost, followed by the new output.
+// Zero disables this, in which case the clients are disconnected. This
+// applies to all Servers, and may be changed at any time.
+func SetReconnectAttempts(n int) {
+	atomic.StoreInt64(&reconnectAttempts, int64(n))
+}
+
+// Limits on console sessions (see SetSessionLimits), in nanoseconds.
+// Accessed atomically.
+var (
+	idleTimeout int64
+	maxDuration int64
+)
+
+// Set limits on console sessions, after which they are dropped, freeing the
+// connection to the BMC. A session is idle when no client has read any
+// output from it (other than over connections dialed with
+// driver.WithBackground), and no input has been written to it. A session
+// which lasts longer than max is dropped even if it is in use. Zero means
+// no limit. This applies to sessions started after the call.
+func SetSessionLimits(idle, max time.Duration) {
+	atomic.StoreInt64(&idleTimeout, int64(idle))
+	atomic.StoreInt64(&maxDuration, int64(max))
 }
 
 // A request to connect to the console. If the request succeeds, the connection
 // is sent on `conn`. Otherwise, an error is sent on `err`.
 type consoleReq struct {
+	replay     int
+	background bool           // see driver.WithBackground.
+	log        *logger.Logger // with the fields of the dialer's ctx.
+	err        chan error
+	conn       chan io.ReadCloser
+}
+
+// A request to write to the console. The result is sent on `err`.
+type writeReq struct {
+	data []byte
+	err  chan error
+}
+
+// A request for a snapshot of the console history.
+type snapshotReq struct {
+	n    int
+	data chan []byte
 	err  chan error
-	conn chan io.ReadCloser
 }
 
 // A connection to a console.
 type consoleConn struct {
-	drop    chan struct{}
-	dropped bool
+	server     *Server
+	sess       *session
+	detach     func()
+	once       sync.Once
+	background bool // if set, reading doesn't count as activity.
 	io.Reader
 }
 
-func (c *consoleConn) Close() error {
-	if !c.dropped {
-		c.dropped = true
-		c.drop <- struct{}{}
+func (c *consoleConn) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if n > 0 && !c.background {
+		c.sess.touch()
 	}
+	return n, err
+}
+
+// Report why the session ended; see driver.ConsoleEnder.
+func (c *consoleConn) EndReason() string {
+	return c.sess.endReason()
+}
+
+func (c *consoleConn) Close() error {
+	c.once.Do(func() {
+		c.detach()
+		// Let the server know, in case this was the last client. A
+		// pending notification covers this one too.
+		select {
+		case c.server.clientLeft <- struct{}{}:
+		default:
+		}
+	})
 	return nil
 }
 
@@ -52,75 +197,341 @@ func (c *consoleConn) Close() error {
 //
 // The zero value is not meaningful; use NewServer to create a value.
 type Server struct {
-	// Most of the server logic operates in it's own goroutine (see Serve).
+	// Statistics for Inspect. These are updated atomically by Serve. dials
+	// comes first to ensure 64-bit alignment; see the sync/atomic docs.
+	dials     uint64
+	connected int32
+	clients   int32
+
+	// Most of the server logic operates in it's own goroutines (see Serve).
 	// The fields of this type are used by other goroutines to interact with
 	// the server
 
 	obm OBM
 
-	// Requests to drop the console.
+	// Requests to drop the console. This has a buffer of one, so that
+	// DropConsole doesn't block; a second request while one is pending
+	// is redundant.
 	dropConsole chan struct{}
 
 	// Requests to connect to the console.
 	dialConsole chan consoleReq
 
+	// Notifications that a client has disconnected. This has a buffer of
+	// one, so that closing a connection doesn't block.
+	clientLeft chan struct{}
+
+	// Sessions whose output has ended unexpectedly; see session.
+	sessionLost chan *session
+
+	// Requests to write to the console.
+	writeConsole chan writeReq
+
+	// Requests for a snapshot of the console history.
+	snapshot chan snapshotReq
+
 	// Requests to run a function atomically within the server.
 	funcs chan func()
+
+	// The bounds on the delay before reconnecting a lost console session;
+	// tests shorten them before calling Serve.
+	reconnectMinDelay, reconnectMaxDelay time.Duration
 }
 
+// Run the server until ctx is done. The server has two independent
+// "lanes": one handling console connections, and one running functions
+// submitted via RunInServer. This way, a slow console operation (e.g. an
+// SOL session which is slow to shut down) can't delay a power operation.
 func (s *Server) Serve(ctx context.Context) {
-	conn := &consoleConn{
-		// This won't get used until we over-write `conn` with a
-		// new connection, but we still need it to be non-nil to
-		// have a receive case in the select statement below.
-		drop: make(chan struct{}, 1),
+	done := make(chan struct{})
+	go func() {
+		s.serveConsole(ctx)
+		close(done)
+	}()
+	s.serveCommands(ctx)
+	<-done
+}
+
+// The command lane; see Serve.
+func (s *Server) serveCommands(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case fn := <-s.funcs:
+			fn()
+		}
 	}
+}
 
+// The console lane; see Serve.
+func (s *Server) serveConsole(ctx context.Context) {
+	var sess *session
+
+	// Reconnection state for sess. retry is non-nil while we're waiting
+	// to reconnect, in which case sess's Proc has already been shut down.
 	var (
-		proc Proc
-		err  error
+		retry       <-chan time.Time
+		retryTimer  *time.Timer
+		attempts    int
+		delay       time.Duration
+		connectedAt time.Time
 	)
 
-	stopProcess := func() {
-		if proc == nil {
+	// Timers enforcing the limits for sess; see SetSessionLimits. The
+	// channels are nil if there is no limit.
+	var (
+		idleTimer, maxTimer *time.Timer
+		idleC, maxC         <-chan time.Time
+		idleLimit           time.Duration
+	)
+
+	log := logger.FromContext(ctx).With("subsystem", "coordinator")
+
+	scheduleRetry := func() {
+		retryTimer = time.NewTimer(delay)
+		retry = retryTimer.C
+	}
+
+	cancelRetry := func() {
+		if retry != nil {
+			retryTimer.Stop()
+			retry = nil
+		}
+	}
+
+	startLimits := func() {
+		idleLimit = time.Duration(atomic.LoadInt64(&idleTimeout))
+		if idleLimit > 0 {
+			idleTimer = time.NewTimer(idleLimit)
+			idleC = idleTimer.C
+		}
+		if d := time.Duration(atomic.LoadInt64(&maxDuration)); d > 0 {
+			maxTimer = time.NewTimer(d)
+			maxC = maxTimer.C
+		}
+	}
+
+	stopLimits := func() {
+		if idleC != nil {
+			idleTimer.Stop()
+			idleC = nil
+		}
+		if maxC != nil {
+			maxTimer.Stop()
+			maxC = nil
+		}
+	}
+
+	shutdown := func(p Proc) {
+		var err error
+		done := make(chan struct{})
+		go func() {
+			err = p.Shutdown()
+			close(done)
+		}()
+		if !waitWithTimeout(done) {
+			log.Error("Timed out shutting down obm connection; abandoning it")
+			if k, ok := p.(Killer); ok {
+				if err := k.Kill(); err != nil {
+					log.Error("Error killing obm connection", "err", err)
+				}
+			}
+			return
+		}
+		if err != nil {
+			log.Warn("Error shutting down obm connection; "+
+				"continuing, but this could potentially cause problems.",
+				"err", err)
+		}
+	}
+
+	// Stop sess, if any, for the given reason; see driver.ConsoleEnder.
+	stopProcess := func(reason string) {
+		if sess == nil {
 			return
 		}
-		if err := proc.Shutdown(); err != nil {
-			log.Println(
-				"Error shutting down obm connection:",
-				err, "continuing, but this could potentially",
-				"cause problems.",
-			)
+		atomic.StoreInt32(&s.connected, 0)
+		stopLimits()
+		old := sess
+		sess = nil
+		if retry != nil {
+			cancelRetry()
+			old.end(reason)
+			return
 		}
-		proc = nil
+		old.stop(reason)
+		shutdown(old.proc)
+	}
+
+	// Give up on reconnecting sess, disconnecting its clients.
+	giveUp := func() {
+		log.Error("Giving up on reconnecting to the console")
+		cancelRetry()
+		stopLimits()
+		sess.end(driver.ConsoleEndLost)
+		sess = nil
+	}
+
+	// Connect to the console, giving up after the timeout. If we give up,
+	// the connection is shut down if and when the dial completes.
+	dial := func() (Proc, error) {
+		var (
+			p   Proc
+			err error
+		)
+		done := make(chan struct{})
+		go func() {
+			p, err = s.obm.Dial(ctx)
+			close(done)
+		}()
+		if waitWithTimeout(done) {
+			return p, err
+		}
+		log.Error("Timed out connecting to the console")
+		go func() {
+			<-done
+			if err == nil {
+				p.Shutdown()
+			}
+		}()
+		return nil, context.DeadlineExceeded
+	}
+
+	// Write to the console, giving up after the timeout.
+	write := func(data []byte) error {
+		if sess == nil || retry != nil {
+			return driver.ErrNoConsole
+		}
+		w, ok := sess.proc.(WriterProc)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		sess.touch()
+		var err error
+		done := make(chan struct{})
+		go func() {
+			_, err = w.Writer().Write(data)
+			close(done)
+		}()
+		if !waitWithTimeout(done) {
+			log.Error("Timed out writing to the console")
+			return context.DeadlineExceeded
+		}
+		return err
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			stopProcess()
+			stopProcess(driver.ConsoleEndStopped)
 			return
-		case <-conn.drop:
-			stopProcess()
+		case <-s.clientLeft:
+			// Once the last client has gone, disconnect, unless we're
+			// recording history; see SetHistorySize.
+			if sess != nil && sess.history == nil && sess.numClients() == 0 {
+				stopProcess("")
+			}
 		case <-s.dropConsole:
-			stopProcess()
-		case fn := <-s.funcs:
-			fn()
-		case req := <-s.dialConsole:
-			stopProcess()
-			proc, err = s.obm.Dial()
+			stopProcess(driver.ConsoleEndDropped)
+		case lost := <-s.sessionLost:
+			if lost != sess {
+				// The session was stopped while reporting this.
+				lost.end("")
+				continue
+			}
+			atomic.StoreInt32(&s.connected, 0)
+			shutdown(sess.proc)
+			if time.Since(connectedAt) >= s.reconnectMaxDelay {
+				attempts = 0
+				delay = s.reconnectMinDelay
+			}
+			if attempts >= int(atomic.LoadInt64(&reconnectAttempts)) {
+				stopLimits()
+				sess.end(driver.ConsoleEndLost)
+				sess = nil
+				continue
+			}
+			log.Warn("Lost connection to the console; reconnecting",
+				"delay", delay)
+			scheduleRetry()
+		case <-retry:
+			retry = nil
+			attempts++
+			atomic.AddUint64(&s.dials, 1)
+			proc, err := dial()
 			if err != nil {
-				req.err <- err
+				log.Warn("Error reconnecting to the console",
+					"attempt", attempts, "err", err)
+				if attempts >= int(atomic.LoadInt64(&reconnectAttempts)) {
+					giveUp()
+					continue
+				}
+				delay *= 2
+				if delay > s.reconnectMaxDelay {
+					delay = s.reconnectMaxDelay
+				}
+				scheduleRetry()
 				continue
 			}
-			conn = &consoleConn{
-				// Buffer size of 1, so calls to Close() on the connection
-				// don't block. Otherwise, if we've already dropped the
-				// connection, Close() would deadlock.
-				drop:   make(chan struct{}, 1),
-				Reader: proc.Reader(),
+			log.Info("Reconnected to the console")
+			connectedAt = time.Now()
+			sess.resume(proc)
+			atomic.StoreInt32(&s.connected, 1)
+		case <-idleC:
+			idle := time.Since(sess.lastActive())
+			if idle < idleLimit {
+				idleTimer.Reset(idleLimit - idle)
+				continue
+			}
+			log.Info("Dropping idle console session", "idle", idle)
+			stopProcess(driver.ConsoleEndIdle)
+		case <-maxC:
+			log.Info("Dropping console session which reached the maximum duration")
+			stopProcess(driver.ConsoleEndMaxDuration)
+		case req := <-s.writeConsole:
+			req.err <- write(req.data)
+		case req := <-s.snapshot:
+			switch {
+			case sess == nil:
+				req.err <- driver.ErrNoConsole
+			case sess.history == nil:
+				req.err <- driver.ErrNotSupported
+			default:
+				req.data <- sess.snapshot(req.n)
+			}
+		case req := <-s.dialConsole:
+			// A pending drop request must take effect first:
+			select {
+			case <-s.dropConsole:
+				stopProcess(driver.ConsoleEndDropped)
+			default:
+			}
+			// Join the existing session, if any, so that several clients
+			// can watch the console at once.
+			if sess == nil {
+				atomic.AddUint64(&s.dials, 1)
+				proc, err := dial()
+				if err != nil {
+					req.err <- err
+					continue
+				}
+				sess = newSession(proc, int(atomic.LoadInt64(&historySize)),
+					&s.clients, s.sessionLost)
+				atomic.StoreInt32(&s.connected, 1)
+				startLimits()
+				connectedAt = time.Now()
+				attempts = 0
+				delay = s.reconnectMinDelay
+			}
+			r, detach := sess.attach(req.replay, req.log)
+			req.conn <- &consoleConn{
+				server:     s,
+				sess:       sess,
+				detach:     detach,
+				background: req.background,
+				Reader:     r,
 			}
-			req.conn <- conn
 		}
 	}
 }
@@ -128,26 +539,52 @@ func (s *Server) Serve(ctx context.Context) {
 // Create a Server for the given OBM.
 func NewServer(obm OBM) *Server {
 	return &Server{
-		obm:         obm,
-		dropConsole: make(chan struct{}),
-		dialConsole: make(chan consoleReq),
-		funcs:       make(chan func()),
+		obm:          obm,
+		dropConsole:  make(chan struct{}, 1),
+		dialConsole:  make(chan consoleReq),
+		clientLeft:   make(chan struct{}, 1),
+		sessionLost:  make(chan *session),
+		writeConsole: make(chan writeReq),
+		snapshot:     make(chan snapshotReq),
+		funcs:        make(chan func()),
+
+		reconnectMinDelay: reconnectMinDelay,
+		reconnectMaxDelay: reconnectMaxDelay,
 	}
 }
 
 // Disconnect the current console session. See driver.OBM.DropConsole.
+//
+// This does not wait for the session to be shut down, but the request is
+// handled before any subsequent call to DialConsole.
 func (s *Server) DropConsole() error {
-	s.dropConsole <- struct{}{}
+	select {
+	case s.dropConsole <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
 // Connect to the console. This see driver.OBM.DialConsole
-func (s *Server) DialConsole() (io.ReadCloser, error) {
+func (s *Server) DialConsole(ctx context.Context) (io.ReadCloser, error) {
+	return s.DialConsoleReplay(ctx, 0)
+}
+
+// Connect to the console, replaying up to `replay` bytes of recent output
+// first. See driver.ConsoleReplayer.
+func (s *Server) DialConsoleReplay(ctx context.Context, replay int) (io.ReadCloser, error) {
 	req := consoleReq{
-		err:  make(chan error),
-		conn: make(chan io.ReadCloser),
+		replay:     replay,
+		background: driver.IsBackground(ctx),
+		log:        logger.FromContext(ctx).With("subsystem", "coordinator"),
+		err:        make(chan error),
+		conn:       make(chan io.ReadCloser),
+	}
+	select {
+	case s.dialConsole <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	s.dialConsole <- req
 	select {
 	case err := <-req.err:
 		return nil, err
@@ -156,13 +593,95 @@ func (s *Server) DialConsole() (io.ReadCloser, error) {
 	}
 }
 
-// Run `fn` inside the server's main loop. This ensures that no (other) console
-// related functionality is taken by the server while `fn` is running.
-func (s *Server) RunInServer(fn func()) {
+// Write to the current console session. See driver.ConsoleWriter.
+func (s *Server) WriteConsole(ctx context.Context, p []byte) error {
+	req := writeReq{
+		data: p,
+		err:  make(chan error, 1),
+	}
+	select {
+	case s.writeConsole <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-req.err
+}
+
+// Return recent console output from the history. See
+// driver.ConsoleSnapshotter. This requires history to be enabled; see
+// SetHistorySize.
+func (s *Server) ConsoleSnapshot(ctx context.Context, n int) ([]byte, error) {
+	req := snapshotReq{
+		n:    n,
+		data: make(chan []byte, 1),
+		err:  make(chan error, 1),
+	}
+	select {
+	case s.snapshot <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case data := <-req.data:
+		return data, nil
+	case err := <-req.err:
+		return nil, err
+	}
+}
+
+// Report the state of the console, for debugging. See driver.Inspector.
+func (s *Server) Inspect() map[string]interface{} {
+	return map[string]interface{}{
+		"console_connected": atomic.LoadInt32(&s.connected) == 1,
+		"console_dials":     atomic.LoadUint64(&s.dials),
+		"console_clients":   atomic.LoadInt32(&s.clients),
+	}
+}
+
+// Run `fn` inside the server's command lane (see Serve). This ensures that
+// no other function submitted via RunInServer runs concurrently with `fn`.
+// Console operations are handled independently, and may proceed while
+// `fn` is running.
+//
+// If ctx is done before the server gets to `fn`, `fn` is not run, and
+// ctx.Err() is returned. Once started, `fn` is responsible for respecting
+// the context passed to it, which is derived from ctx, and also has the
+// timeout (see SetTimeout) as its deadline, so exceeding it gives
+// context.DeadlineExceeded. In that case, the server moves on to other
+// functions without waiting for `fn`, though RunInServer itself still
+// waits for `fn` to return.
+func (s *Server) RunInServer(ctx context.Context, fn func(ctx context.Context)) error {
 	done := make(chan struct{})
-	s.funcs <- func() {
-		fn()
-		done <- struct{}{}
+	select {
+	case s.funcs <- func() {
+		d := time.Duration(atomic.LoadInt64(&timeout))
+		if d == 0 {
+			fn(ctx)
+			close(done)
+			return
+		}
+		fnCtx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		go func() {
+			fn(fnCtx)
+			close(done)
+		}()
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			// The deadline has passed too; let it expire, rather
+			// than cancelling fnCtx first.
+			<-fnCtx.Done()
+			logger.FromContext(ctx).Error("Timed out running function in obm server; "+
+				"cancelling it and moving on",
+				"subsystem", "coordinator")
+		}
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 	<-done
+	return nil
 }
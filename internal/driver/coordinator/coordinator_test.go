@@ -0,0 +1,369 @@
+package coordinator
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// An OBM whose Dial blocks until `unblock` is closed.
+type slowOBM struct {
+	unblock chan struct{}
+}
+
+type nopProc struct{}
+
+func (nopProc) Shutdown() error   { return nil }
+func (nopProc) Reader() io.Reader { return strings.NewReader("") }
+
+func (o *slowOBM) Dial(ctx context.Context) (Proc, error) {
+	<-o.unblock
+	return nopProc{}, nil
+}
+
+// A slow console dial should not hold up functions run via RunInServer.
+func TestDialDoesNotBlockCommands(t *testing.T) {
+	obm := &slowOBM{unblock: make(chan struct{})}
+	s := NewServer(obm)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		s.Serve(ctx)
+		close(served)
+	}()
+
+	dialed := make(chan error)
+	go func() {
+		conn, err := s.DialConsole(context.Background())
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+
+	ran := make(chan error)
+	go func() {
+		ran <- s.RunInServer(context.Background(), func(context.Context) {})
+	}()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Fatal("RunInServer failed:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunInServer was blocked by a console dial.")
+	}
+
+	close(obm.unblock)
+	if err := <-dialed; err != nil {
+		t.Fatal("Dialing the console failed:", err)
+	}
+	cancel()
+	<-served
+}
+
+// With a timeout set, wedged operations should be abandoned, rather than
+// blocking the server forever.
+func TestTimeout(t *testing.T) {
+	SetTimeout(50 * time.Millisecond)
+	defer SetTimeout(0)
+	obm := &slowOBM{unblock: make(chan struct{})}
+	defer close(obm.unblock)
+	s := NewServer(obm)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx)
+
+	_, err := s.DialConsole(context.Background())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected a hung dial to time out, but got %v", err)
+	}
+
+	// The function's context reaches its deadline, so that its error
+	// says it timed out, rather than that the caller gave up:
+	var fnErr error
+	err = s.RunInServer(context.Background(), func(ctx context.Context) {
+		<-ctx.Done()
+		fnErr = ctx.Err()
+	})
+	if err != nil || fnErr != context.DeadlineExceeded {
+		t.Fatalf("Expected a hung function to time out; got err = %v, its ctx.Err() = %v", err, fnErr)
+	}
+	err = s.RunInServer(context.Background(), func(context.Context) {})
+	if err != nil {
+		t.Fatal("RunInServer failed after a timeout:", err)
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	r := newRingBuffer(8)
+	if got := string(r.Last(4)); got != "" {
+		t.Fatalf("Empty buffer returned %q", got)
+	}
+	r.Write([]byte("abc"))
+	if got := string(r.Last(8)); got != "abc" {
+		t.Fatalf("Expected %q, got %q", "abc", got)
+	}
+	r.Write([]byte("defghij"))
+	if got := string(r.Last(8)); got != "cdefghij" {
+		t.Fatalf("Expected %q after wrapping, got %q", "cdefghij", got)
+	}
+	if got := string(r.Last(3)); got != "hij" {
+		t.Fatalf("Expected %q, got %q", "hij", got)
+	}
+	r.Write([]byte("0123456789"))
+	if got := string(r.Last(8)); got != "23456789" {
+		t.Fatalf("Expected %q after an oversized write, got %q", "23456789", got)
+	}
+}
+
+// An OBM whose console output is whatever is written to `out`.
+type pipeOBM struct {
+	out *io.PipeWriter
+	in  *io.PipeReader
+}
+
+func (o *pipeOBM) Dial(ctx context.Context) (Proc, error) {
+	return pipeProc{o.in}, nil
+}
+
+type pipeProc struct {
+	r *io.PipeReader
+}
+
+func (p pipeProc) Shutdown() error   { return p.r.Close() }
+func (p pipeProc) Reader() io.Reader { return p.r }
+
+// Ending a session should only discount its own clients from the shared
+// counter, not those of a session that has since replaced it.
+func TestSessionCount(t *testing.T) {
+	var count int32
+	lost := make(chan *session, 1)
+
+	oldR, oldW := io.Pipe()
+	old := newSession(pipeProc{oldR}, 0, &count, lost)
+	_, detachOld := old.attach(0, logger.With())
+	defer detachOld()
+	oldW.Close()
+	<-lost
+
+	newR, newW := io.Pipe()
+	defer newW.Close()
+	sess := newSession(pipeProc{newR}, 0, &count, lost)
+	_, detachNew := sess.attach(0, logger.With())
+	old.end(driver.ConsoleEndLost)
+	if got := atomic.LoadInt32(&count); got != 1 {
+		t.Fatalf("Expected 1 client after the old session ended, got %d", got)
+	}
+	detachNew()
+	if got := atomic.LoadInt32(&count); got != 0 {
+		t.Fatalf("Expected 0 clients after detaching, got %d", got)
+	}
+}
+
+// With history enabled, output should be recorded while no client is
+// connected, and replayed on request.
+func TestHistory(t *testing.T) {
+	SetHistorySize(64)
+	defer SetHistorySize(0)
+	r, w := io.Pipe()
+	s := NewServer(&pipeOBM{out: w, in: r})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx)
+
+	conn, err := s.DialConsole(context.Background())
+	if err != nil {
+		t.Fatal("Dialing the console:", err)
+	}
+	go w.Write([]byte("before\n"))
+	buf := make([]byte, 7)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "before\n" {
+		t.Fatalf("Reading from the console: got %q, %v", buf, err)
+	}
+	conn.Close()
+
+	// Nobody is connected, but this should still be recorded:
+	if _, err = w.Write([]byte("after\n")); err != nil {
+		t.Fatal("Writing console output after the client left:", err)
+	}
+
+	conn, err = s.DialConsoleReplay(context.Background(), 64)
+	if err != nil {
+		t.Fatal("Re-dialing the console:", err)
+	}
+	defer conn.Close()
+	buf = make([]byte, 13)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "before\nafter\n" {
+		t.Fatalf("Reading replayed output: got %q, %v", buf, err)
+	}
+	if dials := s.Inspect()["console_dials"]; dials != uint64(1) {
+		t.Fatalf("Expected the session to be reused, but there were %v dials", dials)
+	}
+
+	snapshot, err := s.ConsoleSnapshot(context.Background(), 6)
+	if err != nil || string(snapshot) != "after\n" {
+		t.Fatalf("Taking a snapshot: got %q, %v", snapshot, err)
+	}
+}
+
+// Several clients can watch the console at once, over a single session.
+func TestFanOut(t *testing.T) {
+	r, w := io.Pipe()
+	s := NewServer(&pipeOBM{out: w, in: r})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx)
+
+	var conns []io.ReadCloser
+	for i := 0; i < 2; i++ {
+		conn, err := s.DialConsole(context.Background())
+		if err != nil {
+			t.Fatal("Dialing the console:", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	go w.Write([]byte("hello\n"))
+	for i, conn := range conns {
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello\n" {
+			t.Fatalf("Reading from client %d: got %q, %v", i, buf, err)
+		}
+	}
+	if dials := s.Inspect()["console_dials"]; dials != uint64(1) {
+		t.Fatalf("Expected one dial, but there were %v", dials)
+	}
+	if clients := s.Inspect()["console_clients"]; clients != int32(2) {
+		t.Fatalf("Expected two clients, but there were %v", clients)
+	}
+}
+
+// An OBM which creates a new pipe on each dial, and sends its write end on
+// `dials`.
+type redialOBM struct {
+	dials chan *io.PipeWriter
+}
+
+func (o *redialOBM) Dial(ctx context.Context) (Proc, error) {
+	r, w := io.Pipe()
+	o.dials <- w
+	return pipeProc{r}, nil
+}
+
+// If the connection to the console is lost, the server should reconnect,
+// and clients should see a marker followed by the new output.
+func TestReconnect(t *testing.T) {
+	SetReconnectAttempts(1)
+	defer SetReconnectAttempts(0)
+
+	obm := &redialOBM{dials: make(chan *io.PipeWriter, 2)}
+	s := NewServer(obm)
+	s.reconnectMinDelay = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx)
+
+	conn, err := s.DialConsole(context.Background())
+	if err != nil {
+		t.Fatal("Dialing the console:", err)
+	}
+	defer conn.Close()
+	w := <-obm.dials
+	go func() {
+		w.Write([]byte("one\n"))
+		w.Close()
+		w = <-obm.dials
+		w.Write([]byte("two\n"))
+	}()
+	want := "one\n" + reconnectMarker + "two\n"
+	buf := make([]byte, len(want))
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != want {
+		t.Fatalf("Reading from the console: got %q, %v", buf, err)
+	}
+}
+
+// An idle session should be dropped, ending its clients' streams.
+func TestIdleTimeout(t *testing.T) {
+	SetSessionLimits(10*time.Millisecond, 0)
+	defer SetSessionLimits(0, 0)
+	r, w := io.Pipe()
+	s := NewServer(&pipeOBM{out: w, in: r})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx)
+
+	conn, err := s.DialConsole(context.Background())
+	if err != nil {
+		t.Fatal("Dialing the console:", err)
+	}
+	defer conn.Close()
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, conn)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal("Reading from the console:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Idle session was not dropped.")
+	}
+	if connected := s.Inspect()["console_connected"]; connected != false {
+		t.Fatal("Console is still connected after being dropped.")
+	}
+	if reason := conn.(driver.ConsoleEnder).EndReason(); reason != driver.ConsoleEndIdle {
+		t.Fatalf("Stream ended with reason %q; expected %q.", reason, driver.ConsoleEndIdle)
+	}
+}
+
+// Reading over a background connection shouldn't count as activity, so a
+// session watched only that way is still dropped when idle.
+func TestBackgroundIdleTimeout(t *testing.T) {
+	SetSessionLimits(50*time.Millisecond, 0)
+	defer SetSessionLimits(0, 0)
+	r, w := io.Pipe()
+	s := NewServer(&pipeOBM{out: w, in: r})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx)
+
+	conn, err := s.DialConsole(driver.WithBackground(context.Background()))
+	if err != nil {
+		t.Fatal("Dialing the console:", err)
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			if _, err := w.Write([]byte("output\n")); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, conn)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal("Reading from the console:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Session with only a background client was not dropped.")
+	}
+	if reason := conn.(driver.ConsoleEnder).EndReason(); reason != driver.ConsoleEndIdle {
+		t.Fatalf("Stream ended with reason %q; expected %q.", reason, driver.ConsoleEndIdle)
+	}
+}
@@ -0,0 +1,310 @@
+package coordinator
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// A fixed-size buffer holding the most recent output from a console.
+type ringBuffer struct {
+	buf  []byte
+	next int  // index at which the next byte will be written.
+	full bool // whether we have wrapped around at least once.
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) {
+	size := len(r.buf)
+	if len(p) >= size {
+		copy(r.buf, p[len(p)-size:])
+		r.next = 0
+		r.full = true
+		return
+	}
+	end := r.next + len(p)
+	n := copy(r.buf[r.next:], p)
+	copy(r.buf, p[n:])
+	if end >= size {
+		r.full = true
+	}
+	r.next = end % size
+}
+
+// Return a copy of the last n bytes written, or everything in the buffer
+// if there is less than that.
+func (r *ringBuffer) Last(n int) []byte {
+	size := len(r.buf)
+	avail := r.next
+	if r.full {
+		avail = size
+	}
+	if n > avail {
+		n = avail
+	}
+	ret := make([]byte, n)
+	start := (r.next - n + size) % size
+	k := copy(ret, r.buf[start:])
+	copy(ret[k:], r.buf)
+	return ret
+}
+
+// How long a client may fall behind (with its queue full) before we give
+// up on it, so that one slow client can't stall the others.
+const slowClientTimeout = 10 * time.Second
+
+// A client attached to a session.
+type client struct {
+	w    *io.PipeWriter
+	log  *logger.Logger
+	data chan []byte   // output to send to the client; closed when the session ends.
+	done chan struct{} // closed when the client is detached.
+	once sync.Once
+}
+
+// Copy output from c.data to the client, until the session ends or the
+// client is detached.
+func (c *client) run() {
+	for {
+		select {
+		case chunk, ok := <-c.data:
+			if !ok {
+				c.w.Close()
+				return
+			}
+			if _, err := c.w.Write(chunk); err != nil {
+				return
+			}
+		case <-c.done:
+			c.w.Close()
+			return
+		}
+	}
+}
+
+// Written to a session's clients (and history) when it reconnects to the
+// console, since some output may have been missed in between.
+const reconnectMarker = "\r\n[obmd: console reconnected; output may have been lost]\r\n"
+
+// A live console session. A goroutine (see pump) copies its output to the
+// history buffer, if any, and to each attached client.
+//
+// When the output ends, the session reports itself on `lost`, unless it
+// has been stopped. The receiver then either resumes it with a new Proc
+// or ends it, which disconnects its clients.
+type session struct {
+	// Time of the last activity (see touch), in Unix nanoseconds. This
+	// comes first to ensure 64-bit alignment; see the sync/atomic docs.
+	active int64
+
+	proc    Proc
+	count   *int32 // adjusted (atomically) as clients attach and detach.
+	lost    chan<- *session
+	stopped chan struct{} // closed by stop.
+
+	// Protects the fields below.
+	lock    sync.Mutex
+	history *ringBuffer // nil if history is disabled.
+	clients map[*client]struct{}
+	ended   bool   // whether the output has ended.
+	reason  string // why the session ended (or is ending); see driver.ConsoleEnder.
+}
+
+// Start a session for proc, keeping up to historySize bytes of output.
+func newSession(proc Proc, historySize int, count *int32, lost chan<- *session) *session {
+	ret := &session{
+		proc:    proc,
+		count:   count,
+		lost:    lost,
+		stopped: make(chan struct{}),
+		clients: make(map[*client]struct{}),
+	}
+	ret.touch()
+	if historySize > 0 {
+		ret.history = newRingBuffer(historySize)
+	}
+	go ret.pump(proc.Reader())
+	return ret
+}
+
+func (s *session) pump(r io.Reader) {
+	var buf [4096]byte
+	for {
+		n, err := r.Read(buf[:])
+		if n != 0 {
+			s.broadcast(append([]byte(nil), buf[:n]...))
+		}
+		if err != nil {
+			select {
+			case s.lost <- s:
+			case <-s.stopped:
+				s.end("")
+			}
+			return
+		}
+	}
+}
+
+// Record chunk in the history, and send it to each client.
+func (s *session) broadcast(chunk []byte) {
+	s.lock.Lock()
+	if s.history != nil {
+		s.history.Write(chunk)
+	}
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.lock.Unlock()
+	s.send(clients, chunk)
+}
+
+// Record activity on the session: a client reading output, or input being
+// written.
+func (s *session) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+// Return the time of the last activity on the session.
+func (s *session) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.active))
+}
+
+// Mark the session as stopped for the given reason (see driver.ConsoleEnder),
+// so that the end of its output is not reported as lost. The caller should
+// then shut down s.proc.
+func (s *session) stop(reason string) {
+	s.lock.Lock()
+	s.reason = reason
+	s.lock.Unlock()
+	close(s.stopped)
+}
+
+// Continue the session with a new Proc, after its output was lost. The
+// clients see a marker before the new output.
+func (s *session) resume(proc Proc) {
+	s.proc = proc
+	go func() {
+		s.broadcast([]byte(reconnectMarker))
+		s.pump(proc.Reader())
+	}()
+}
+
+// End the session for the given reason (unless stop gave one already),
+// disconnecting its clients. This must only be called when pump is not
+// running.
+func (s *session) end(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	s.ended = true
+	for c := range s.clients {
+		close(c.data)
+	}
+	atomic.AddInt32(s.count, -int32(len(s.clients)))
+	s.clients = nil
+}
+
+// Queue chunk for each of clients, detaching any which stay too far behind.
+func (s *session) send(clients []*client, chunk []byte) {
+	var timeout <-chan time.Time
+	for _, c := range clients {
+		select {
+		case c.data <- chunk:
+			continue
+		case <-c.done:
+			continue
+		default:
+		}
+		if timeout == nil {
+			timer := time.NewTimer(slowClientTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case c.data <- chunk:
+		case <-c.done:
+		case <-timeout:
+			c.log.Warn("Disconnecting console client which is too slow")
+			s.detach(c)
+		}
+	}
+}
+
+// Attach a new client. The client's stream begins with up to `replay`
+// bytes of history, and problems with the client are logged to log.
+// Returns the stream, and a function which detaches the client.
+func (s *session) attach(replay int, log *logger.Logger) (io.Reader, func()) {
+	r, w := io.Pipe()
+	c := &client{
+		w:    w,
+		log:  log,
+		data: make(chan []byte, 256),
+		done: make(chan struct{}),
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var past []byte
+	if s.history != nil && replay > 0 {
+		past = s.history.Last(replay)
+	}
+	if s.ended {
+		w.Close()
+	} else {
+		s.clients[c] = struct{}{}
+		atomic.AddInt32(s.count, 1)
+		go c.run()
+	}
+	return io.MultiReader(bytes.NewReader(past), r), func() {
+		r.Close()
+		s.detach(c)
+	}
+}
+
+// Detach a client, leaving the session running.
+func (s *session) detach(c *client) {
+	c.once.Do(func() { close(c.done) })
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		atomic.AddInt32(s.count, -1)
+	}
+}
+
+// Return up to n bytes of the history, or all of it if n is zero. The
+// session must have a history.
+func (s *session) snapshot(n int) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n <= 0 {
+		n = len(s.history.buf)
+	}
+	return s.history.Last(n)
+}
+
+// Return why the session ended, or "" if it hasn't.
+func (s *session) endReason() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.ended {
+		return ""
+	}
+	return s.reason
+}
+
+// Return the number of attached clients.
+func (s *session) numClients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.clients)
+}
@@ -5,10 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
 )
 
 var Driver driver.Driver = dummyDriver{}
@@ -47,8 +47,8 @@ func (d *dummyOBM) DropConsole() error {
 	return nil
 }
 
-func (d *dummyOBM) DialConsole() (io.ReadCloser, error) {
-	conn, err := net.Dial("tcp", d.Addr)
+func (d *dummyOBM) DialConsole(ctx context.Context) (io.ReadCloser, error) {
+	conn, err := driver.DialContext(ctx, "tcp", d.Addr)
 	if err != nil {
 		return nil, err
 	}
@@ -61,17 +61,30 @@ func (d *dummyOBM) DialConsole() (io.ReadCloser, error) {
 	return conn, nil
 }
 
-func (d *dummyOBM) PowerOff() error {
-	log.Println("Powering off:", d)
+func (d *dummyOBM) WriteConsole(ctx context.Context, p []byte) error {
+	if d.conn == nil {
+		return driver.ErrNoConsole
+	}
+	_, err := d.conn.Write(p)
+	return err
+}
+
+func (d *dummyOBM) PowerOff(ctx context.Context) error {
+	logger.FromContext(ctx).Info("Powering off", "driver", "dummy", "addr", d.Addr)
 	return nil
 }
 
-func (d *dummyOBM) PowerCycle(force bool) error {
-	log.Printf("Powering off: %v (force = %v)\n", d, force)
+func (d *dummyOBM) PowerCycle(ctx context.Context, force bool) error {
+	logger.FromContext(ctx).Info("Power cycling", "driver", "dummy", "addr", d.Addr, "force", force)
 	return nil
 }
 
-func (d *dummyOBM) SetBootdev(dev string) error {
-	log.Printf("Setting bootdev = %v: %v\n", dev, d)
+// The dummy driver has no idea whether anything is powered on.
+func (d *dummyOBM) PowerStatus(ctx context.Context) (driver.PowerState, error) {
+	return driver.PowerStateUnknown, nil
+}
+
+func (d *dummyOBM) SetBootdev(ctx context.Context, dev string) error {
+	logger.FromContext(ctx).Info("Setting bootdev", "driver", "dummy", "addr", d.Addr, "bootdev", dev)
 	return nil
 }
@@ -1,7 +1,77 @@
 package driver
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
-	ErrInvalidBootdev = errors.New("Invalid boot device.")
+	ErrInvalidBootdev  = errors.New("Invalid boot device.")
+	ErrNoConsole       = errors.New("No console session is connected.")
+	ErrConsoleInUse    = errors.New("The console is in use by another session.")
+	ErrNotSupported    = errors.New("Operation not supported by this driver.")
+	ErrInvalidPassword = errors.New("Invalid password.")
+
+	ErrInvalidPowerRestorePolicy = errors.New("Invalid power restore policy.")
+	ErrInvalidWatchdogTimeout    = errors.New("Invalid watchdog timeout.")
 )
+
+// An error indicating a failure which may be transient, e.g. a timeout
+// talking to an OBM over a flaky network, such that retrying the operation
+// may succeed. Drivers should wrap errors in this type when they can tell
+// that this is the case; other errors are assumed to be permanent.
+type TransientError struct {
+	Err error
+}
+
+func (e TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Report whether err is a TransientError.
+func IsTransient(err error) bool {
+	_, ok := err.(TransientError)
+	return ok
+}
+
+// Returned by CheckSupported for an operation which an OBM declares (see
+// Limited) it doesn't support.
+type UnsupportedError struct {
+	Op Operation
+}
+
+func (e UnsupportedError) Error() string {
+	return fmt.Sprintf("The node's OBM doesn't support the %q operation.", e.Op)
+}
+
+// Return an UnsupportedError if obm is Limited and doesn't support op, and
+// nil otherwise.
+func CheckSupported(obm OBM, op Operation) error {
+	l, ok := obm.(Limited)
+	if !ok {
+		return nil
+	}
+	for _, unsupported := range l.Unsupported() {
+		if unsupported == op {
+			return UnsupportedError{Op: op}
+		}
+	}
+	return nil
+}
+
+// Report whether err means that an operation isn't supported, i.e. it is
+// ErrNotSupported or an UnsupportedError.
+func IsNotSupported(err error) bool {
+	_, ok := err.(UnsupportedError)
+	return ok || err == ErrNotSupported
+}
+
+// Returned by InfoValidator.ValidateInfo when a node's info is invalid.
+type InvalidInfoError struct {
+	Problems []string
+}
+
+func (e *InvalidInfoError) Error() string {
+	return "Invalid node info: " + strings.Join(e.Problems, "; ")
+}
@@ -3,31 +3,357 @@ package driver
 import (
 	"context"
 	"io"
+	"time"
 )
 
 // An OBM.
+//
+// Methods which take a context.Context should give up and return ctx.Err()
+// if the context is cancelled or its deadline expires before the operation
+// completes.
 type OBM interface {
 	// Manage the OBM. A goroutine executing Serve must be running when
 	// any other OBM method.
 	Serve(ctx context.Context)
 
 	// Connect to the console. Returns the connection and any error.
-	DialConsole() (io.ReadCloser, error)
+	// The context only governs establishing the connection, not its
+	// lifetime.
+	DialConsole(ctx context.Context) (io.ReadCloser, error)
 
-	// Disconnect the current console session, if any.
+	// Disconnect the current console session, if any. This may return
+	// before the session is fully shut down, but must take effect before
+	// any subsequent DialConsole.
 	DropConsole() error
 
 	// Power off the node.
-	PowerOff() error
+	PowerOff(ctx context.Context) error
 
 	// Reboot the node. `force` indicates whether to do a hard power off,
 	// or a soft shutdown (giving the node's operating system a change to
 	// respond).
-	PowerCycle(force bool) error
+	PowerCycle(ctx context.Context, force bool) error
 
 	// Sets the next boot device to `dev`. Valid boot devices are
 	// driver-dependent.
-	SetBootdev(dev string) error
+	SetBootdev(ctx context.Context, dev string) error
+
+	// Report whether the node is powered on. An error means the OBM
+	// could not be queried; PowerStateUnknown means it answered, but
+	// not in a way the driver understands.
+	PowerStatus(ctx context.Context) (PowerState, error)
+}
+
+// The power state of a node.
+type PowerState string
+
+const (
+	PowerStateOn      PowerState = "on"
+	PowerStateOff     PowerState = "off"
+	PowerStateUnknown PowerState = "unknown"
+)
+
+// An operation of the OBM interface; see Limited.
+type Operation string
+
+const (
+	OpConsole     Operation = "console" // DialConsole.
+	OpPowerOff    Operation = "power_off"
+	OpPowerCycle  Operation = "power_cycle"
+	OpSetBootdev  Operation = "set_bootdev"
+	OpPowerStatus Operation = "power_status"
+)
+
+// An OBM may optionally implement Limited, to declare operations of the OBM
+// interface which it can't actually do, e.g. a PDU has no console, and
+// Wake-on-LAN can't set the boot device. These are refused (with an
+// UnsupportedError; see CheckSupported) without calling the OBM.
+type Limited interface {
+	// Return the operations the OBM doesn't support.
+	Unsupported() []Operation
+}
+
+// A console stream (as returned by OBM.DialConsole) may optionally implement
+// ConsoleEnder, to say why it ended.
+type ConsoleEnder interface {
+	// Return why the stream ended: one of the ConsoleEnd constants, or ""
+	// if it hasn't ended (or the reason is unknown).
+	EndReason() string
+}
+
+// Reasons a console stream ended; see ConsoleEnder.
+const (
+	ConsoleEndDropped     = "dropped" // DropConsole was called.
+	ConsoleEndStopped     = "stopped" // the OBM's Serve method was stopped.
+	ConsoleEndIdle        = "idle_timeout"
+	ConsoleEndMaxDuration = "max_duration"
+	ConsoleEndLost        = "console_lost" // the connection to the console was lost.
+)
+
+// The key of the context value set by WithBackground.
+type backgroundKey struct{}
+
+// Return a context for connecting to a console on behalf of obmd itself
+// rather than a user, e.g. to forward its output. Drivers which enforce
+// an idle limit on console sessions shouldn't count reading from such a
+// connection as activity, so that it doesn't keep the console connected
+// on its own.
+func WithBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+// Report whether ctx is from WithBackground.
+func IsBackground(ctx context.Context) bool {
+	return ctx.Value(backgroundKey{}) != nil
+}
+
+// An OBM may optionally implement Inspector, to expose its internal state
+// for debugging purposes.
+type Inspector interface {
+	// Return a JSON-serializable description of the OBM's state. This
+	// must not block, even if the OBM is busy.
+	Inspect() map[string]interface{}
+}
+
+// An OBM may optionally implement ConsoleWriter, to allow clients to send
+// input (e.g. keystrokes) to the console.
+type ConsoleWriter interface {
+	// Write p to the current console session. Returns ErrNoConsole if no
+	// session is connected.
+	WriteConsole(ctx context.Context, p []byte) error
+}
+
+// An OBM may optionally implement ConsoleReplayer, to allow clients to see
+// recent console output from before they connected.
+type ConsoleReplayer interface {
+	// Like DialConsole, but the stream begins with up to `replay` bytes
+	// of the most recent output, if the OBM has kept it.
+	DialConsoleReplay(ctx context.Context, replay int) (io.ReadCloser, error)
+}
+
+// An OBM may optionally implement ConsoleSnapshotter, to allow clients to
+// fetch recent console output without streaming it.
+type ConsoleSnapshotter interface {
+	// Return up to n bytes of the most recent console output, or all
+	// that has been kept if n is zero. Returns ErrNoConsole if no session
+	// is connected, and ErrNotSupported if the OBM isn't keeping output.
+	ConsoleSnapshot(ctx context.Context, n int) ([]byte, error)
+}
+
+// An OBM may optionally implement BootdevLister, to advertise which boot
+// devices SetBootdev accepts.
+type BootdevLister interface {
+	// Return the valid boot devices.
+	Bootdevs(ctx context.Context) ([]string, error)
+}
+
+// An OBM may optionally implement BootdevReporter, to report the boot
+// device set by SetBootdev.
+type BootdevReporter interface {
+	// Return the boot device, as one of those accepted by SetBootdev.
+	Bootdev(ctx context.Context) (string, error)
+}
+
+// An OBM may optionally implement Identifier, to report the make and model
+// of the node's hardware, e.g. from its FRU data.
+type Identifier interface {
+	// Return the manufacturer and model, e.g. "Dell PowerEdge R640".
+	Model(ctx context.Context) (string, error)
+}
+
+// An OBM may optionally implement SoftPowerer, to shut the node down
+// gracefully, as distinct from OBM.PowerOff.
+type SoftPowerer interface {
+	// Ask the node's operating system to shut down, e.g. via an ACPI
+	// power button event. This returns once the request is made; the
+	// operating system may take a while, or ignore it.
+	SoftPowerOff(ctx context.Context) error
+}
+
+// An OBM may optionally implement PowerRestorer, to control what the node
+// does when power is restored after an outage.
+type PowerRestorer interface {
+	// Return the node's power restore policy.
+	PowerRestorePolicy(ctx context.Context) (PowerRestorePolicy, error)
+
+	// Set the node's power restore policy. Returns
+	// ErrInvalidPowerRestorePolicy if policy is not one of the
+	// PowerRestore constants.
+	SetPowerRestorePolicy(ctx context.Context, policy PowerRestorePolicy) error
+}
+
+// What a node does when power is restored after an outage.
+type PowerRestorePolicy string
+
+const (
+	PowerRestoreAlwaysOn  PowerRestorePolicy = "always-on"  // power on.
+	PowerRestorePrevious  PowerRestorePolicy = "previous"   // return to the state it was in.
+	PowerRestoreAlwaysOff PowerRestorePolicy = "always-off" // stay off.
+)
+
+// Report whether p is one of the PowerRestore constants.
+func (p PowerRestorePolicy) Valid() bool {
+	switch p {
+	case PowerRestoreAlwaysOn, PowerRestorePrevious, PowerRestoreAlwaysOff:
+		return true
+	}
+	return false
+}
+
+// An OBM may optionally implement Watchdog, to manage the OBM's watchdog
+// timer, which power cycles the node if it expires, e.g. because the OS
+// never came up to reset it.
+type Watchdog interface {
+	// Report the state of the watchdog timer.
+	WatchdogStatus(ctx context.Context) (WatchdogStatus, error)
+
+	// Set the timer to power cycle the node after `seconds`, and start
+	// it. Returns ErrInvalidWatchdogTimeout if the OBM can't time that
+	// long.
+	ArmWatchdog(ctx context.Context, seconds int) error
+
+	// Restart the timer's countdown.
+	ResetWatchdog(ctx context.Context) error
+
+	// Stop the timer.
+	StopWatchdog(ctx context.Context) error
+}
+
+// The state of a watchdog timer.
+type WatchdogStatus struct {
+	Running bool `json:"running"`
+
+	// What happens when the timer expires: "none", "reset",
+	// "power_off" or "power_cycle".
+	Action string `json:"action"`
+
+	Timeout   int `json:"timeout"`   // the countdown, in seconds.
+	Remaining int `json:"remaining"` // seconds until the timer expires.
+}
+
+// An OBM may optionally implement PowerMeter, to report the node's power
+// consumption and cap it.
+type PowerMeter interface {
+	// Read the node's power consumption.
+	PowerReading(ctx context.Context) (PowerReading, error)
+
+	// Limit the node's power consumption to `watts`, or remove any
+	// limit if it is zero.
+	SetPowerLimit(ctx context.Context, watts int) error
+}
+
+// A node's power consumption, in watts. Min, Max and Average cover a
+// sampling period chosen by the OBM.
+type PowerReading struct {
+	Watts   int `json:"watts"`
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+	Average int `json:"average"`
+}
+
+// An OBM may optionally implement LANInspector, to report the network
+// configuration of the OBM itself, e.g. for auditing.
+type LANInspector interface {
+	LANConfig(ctx context.Context) (LANConfig, error)
+}
+
+// The network configuration of an OBM. Fields the OBM doesn't report are
+// empty.
+type LANConfig struct {
+	IPSource  string `json:"ip_source"` // e.g. "static" or "dhcp".
+	IPAddress string `json:"ip_address"`
+	Netmask   string `json:"netmask"`
+	MAC       string `json:"mac"`
+	Gateway   string `json:"gateway"`
+	VLAN      int    `json:"vlan"` // zero if disabled.
+}
+
+// An OBM may optionally implement UserManager, to manage the user accounts
+// on the OBM itself.
+type UserManager interface {
+	// List the OBM's user accounts.
+	Users(ctx context.Context) ([]User, error)
+
+	// Change the password of the account the driver logs in as, and
+	// check that the new password works. Returns the driver info to use
+	// from now on (in the form passed to Driver.GetOBM), or
+	// ErrInvalidPassword if the OBM can't accept the password.
+	ChangePassword(ctx context.Context, password string) ([]byte, error)
+}
+
+// A user account on an OBM.
+type User struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Privilege string `json:"privilege"`
+}
+
+// An OBM may optionally implement FirmwareInspector, to report the versions
+// of the node's firmware.
+type FirmwareInspector interface {
+	// Return the installed firmware versions, keyed by component, e.g.
+	// "bmc" (the OBM's own firmware) or "bios".
+	FirmwareVersions(ctx context.Context) (map[string]string, error)
+}
+
+// An OBM may optionally implement FirmwareUpdater, to install new firmware.
+type FirmwareUpdater interface {
+	FirmwareInspector
+
+	// Install the image read from r as the firmware for component (as
+	// named by FirmwareVersions), returning once the new firmware is
+	// active. This may take many minutes, and the node may be rebooted.
+	UpdateFirmware(ctx context.Context, component string, r io.Reader) error
+}
+
+// An OBM may optionally implement EventLogReader, to report the entries in
+// the node's hardware event log (e.g. the IPMI System Event Log).
+type EventLogReader interface {
+	// Return the log's entries after the one with record ID `after` (all
+	// of them if it is zero), oldest first. If the log has no entry with
+	// an ID of at least `after` (e.g. because it has been cleared since),
+	// return all of its entries.
+	EventLog(ctx context.Context, after int) ([]EventLogEntry, error)
+}
+
+// Return the entries of log after the one with record ID `after`, as
+// described for EventLogReader. This is for OBMs which can
+// only read their logs in full.
+func EventLogSince(log []EventLogEntry, after int) []EventLogEntry {
+	ret := []EventLogEntry{}
+	latest := 0
+	for _, e := range log {
+		if e.ID > after {
+			ret = append(ret, e)
+		}
+		if e.ID > latest {
+			latest = e.ID
+		}
+	}
+	if latest < after {
+		return log
+	}
+	return ret
+}
+
+// An entry in a node's hardware event log.
+type EventLogEntry struct {
+	// The entry's record ID, as assigned by the OBM. IDs increase as
+	// entries are added, but may start again when the log is cleared.
+	ID int `json:"id"`
+
+	// When the event happened, by the OBM's clock; zero if the OBM didn't
+	// know (e.g. during early boot).
+	Time time.Time `json:"time"`
+
+	// The sensor which reported the event, e.g. "Power Supply #0x51", and
+	// what happened, e.g. "Failure detected".
+	Sensor string `json:"sensor"`
+	Event  string `json:"event"`
+
+	// Whether the event was asserted, as opposed to deasserted (e.g. the
+	// failure has cleared).
+	Asserted bool `json:"asserted"`
 }
 
 // An driver for a type of OBM.
@@ -35,3 +361,20 @@ type Driver interface {
 	// Get an obm object based on the provided info.
 	GetOBM(info []byte) (OBM, error)
 }
+
+// A Driver may optionally implement Checker, to verify its external
+// prerequisites (e.g. programs it runs) up front, rather than failing
+// when nodes are used.
+type Checker interface {
+	// Return any problems found.
+	Check() []error
+}
+
+// A Driver may optionally implement InfoValidator, to check the info for a
+// new node more strictly than GetOBM does, e.g. rejecting unknown fields.
+// (GetOBM must stay lenient, so that nodes registered before a check was
+// added can still be loaded.)
+type InfoValidator interface {
+	// Check info, returning an *InvalidInfoError listing any problems.
+	ValidateInfo(info []byte) error
+}
@@ -0,0 +1,73 @@
+package ipmi
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The oldest version of ipmitool we support. Older versions lack DCMI
+// commands and some of the options we pass.
+var minVersion = [3]int{1, 8, 11}
+
+// How long to wait for "ipmitool -V".
+const versionTimeout = 10 * time.Second
+
+var versionRegexp = regexp.MustCompile(`version (\d+)\.(\d+)\.(\d+)`)
+
+// Check that ipmitool is installed and recent enough, and that we can
+// create the ptys used for console sessions.
+func (d impiDriver) Check() []error {
+	var problems []error
+	if _, err := exec.LookPath("ipmitool"); err != nil {
+		problems = append(problems, fmt.Errorf("ipmitool not found: %v", err))
+	} else if err := checkVersion(); err != nil {
+		problems = append(problems, err)
+	}
+	if err := checkConsole(); err != nil {
+		problems = append(problems,
+			fmt.Errorf("Can't create a terminal for console sessions: %v", err))
+	}
+	return problems
+}
+
+// Check that the installed ipmitool is at least minVersion.
+func checkVersion() error {
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ipmitool", "-V").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Running ipmitool -V: %v", err)
+	}
+	version, ok := parseVersion(string(out))
+	if !ok {
+		return fmt.Errorf("Can't tell ipmitool's version from %q.", out)
+	}
+	for i := range version {
+		if version[i] != minVersion[i] {
+			if version[i] < minVersion[i] {
+				return fmt.Errorf("ipmitool %d.%d.%d is too old; "+
+					"version %d.%d.%d or later is needed.",
+					version[0], version[1], version[2],
+					minVersion[0], minVersion[1], minVersion[2])
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Parse the output of "ipmitool -V", e.g. "ipmitool version 1.8.18".
+func parseVersion(out string) (version [3]int, ok bool) {
+	m := versionRegexp.FindStringSubmatch(out)
+	if m == nil {
+		return version, false
+	}
+	for i := range version {
+		version[i], _ = strconv.Atoi(m[i+1])
+	}
+	return version, true
+}
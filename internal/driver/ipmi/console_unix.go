@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package ipmi
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/kr/pty"
+)
+
+// Start cmd, attached to a pty, and return the pty. ipmitool behaves best
+// with a terminal, e.g. for its escape sequences.
+func startConsole(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	return pty.Start(cmd)
+}
+
+// Check that we can allocate a pty.
+func checkConsole() error {
+	ptm, pts, err := pty.Open()
+	if err != nil {
+		return err
+	}
+	pts.Close()
+	return ptm.Close()
+}
+
+// Kill a process started by startConsole, and its descendants. pty.Start
+// makes the process a session leader, so its process group id is its pid.
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
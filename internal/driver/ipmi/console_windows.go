@@ -0,0 +1,67 @@
+//go:build windows
+// +build windows
+
+package ipmi
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Start cmd, with its stdin and (combined) stdout/stderr connected to the
+// returned pipe. Windows has no ptys, but ipmitool's console works well
+// enough without a terminal.
+func startConsole(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err = cmd.Start()
+	// The child has its own copy of w; we must close ours so that reads
+	// see EOF when the child exits.
+	w.Close()
+	if err != nil {
+		stdin.Close()
+		r.Close()
+		return nil, err
+	}
+	return &pipeConsole{Reader: r, stdin: stdin, stdout: r}, nil
+}
+
+type pipeConsole struct {
+	io.Reader
+	stdin  io.WriteCloser
+	stdout io.Closer
+}
+
+func (c *pipeConsole) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *pipeConsole) Close() error {
+	errIn := c.stdin.Close()
+	errOut := c.stdout.Close()
+	if errIn != nil {
+		return errIn
+	}
+	return errOut
+}
+
+// Consoles use plain pipes, which are always available.
+func checkConsole() error {
+	return nil
+}
+
+// Kill a process started by startConsole. Windows has no process groups
+// in the unix sense, so this only kills the process itself.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
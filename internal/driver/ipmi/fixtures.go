@@ -0,0 +1,153 @@
+package ipmi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// An ipmitool command and its results, as recorded and replayed by
+// SetFixtures. Connection parameters other than the address, such as
+// credentials, are not recorded.
+type fixture struct {
+	Addr   string   `json:"addr"`
+	Args   []string `json:"args"`
+	Stdout string   `json:"stdout"`
+	Stderr string   `json:"stderr"`
+	Exit   int      `json:"exit"` // ipmitool's exit status.
+}
+
+// The current fixtures; see SetFixtures.
+var fixtures struct {
+	sync.Mutex
+	record *os.File
+
+	// Recorded results, by fixtureKey. Each is replayed once, in order,
+	// except for the last, which is repeated indefinitely.
+	replay map[string][]fixture
+}
+
+// Set up recording or replaying of ipmitool commands, for reproducing a
+// BMC's behaviour without the hardware. If record is not "", every
+// ipmitool command run (other than consoles and shells; see
+// SetSessionTimeout) is appended to that file, as a line of JSON. If replay
+// is not "", no ipmitool commands are run; instead, each command is
+// answered with the results recorded for it in that file, or fails if
+// there are none. At most one of these may be set; if neither is, any
+// previous recording or replaying stops.
+func SetFixtures(record, replay string) error {
+	if record != "" && replay != "" {
+		return fmt.Errorf("Cannot both record and replay ipmitool fixtures.")
+	}
+	var (
+		recordFile *os.File
+		responses  map[string][]fixture
+		err        error
+	)
+	if record != "" {
+		recordFile, err = os.OpenFile(record, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	if replay != "" {
+		if responses, err = loadFixtures(replay); err != nil {
+			return err
+		}
+	}
+	fixtures.Lock()
+	defer fixtures.Unlock()
+	if fixtures.record != nil {
+		fixtures.record.Close()
+	}
+	fixtures.record = recordFile
+	fixtures.replay = responses
+	return nil
+}
+
+// Read the fixtures in a file written by recordFixture.
+func loadFixtures(path string) (map[string][]fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ret := make(map[string][]fixture)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var f fixture
+		if err = json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", path, line, err)
+		}
+		key := fixtureKey(f.Addr, f.Args)
+		ret[key] = append(ret[key], f)
+	}
+	return ret, scanner.Err()
+}
+
+// Whether commands are being recorded or replayed. Consoles and shells
+// aren't, so the driver avoids shells while this is the case.
+func usingFixtures() bool {
+	fixtures.Lock()
+	defer fixtures.Unlock()
+	return fixtures.record != nil || fixtures.replay != nil
+}
+
+// Return a copy of args with any secrets (i.e. passwords being set)
+// replaced, so that they aren't written to fixtures.
+func redactArgs(args []string) []string {
+	ret := append([]string(nil), args...)
+	if len(ret) > 4 && ret[0] == "user" && ret[1] == "set" && ret[2] == "password" {
+		ret[4] = "<redacted>"
+	}
+	return ret
+}
+
+func fixtureKey(addr string, args []string) string {
+	return addr + "\x00" + strings.Join(args, "\x00")
+}
+
+// If replaying, return the recorded results for the command, and true.
+// Otherwise, return false.
+func replayFixture(addr string, args []string) (f fixture, replaying bool, err error) {
+	fixtures.Lock()
+	defer fixtures.Unlock()
+	if fixtures.replay == nil {
+		return f, false, nil
+	}
+	args = redactArgs(args)
+	key := fixtureKey(addr, args)
+	responses := fixtures.replay[key]
+	if len(responses) == 0 {
+		return f, true, fmt.Errorf("ipmitool: no recorded results for %q on %s.",
+			strings.Join(args, " "), addr)
+	}
+	f = responses[0]
+	if len(responses) > 1 {
+		fixtures.replay[key] = responses[1:]
+	}
+	return f, true, nil
+}
+
+// If recording, append a command and its results to the fixtures file.
+func recordFixture(f fixture) error {
+	fixtures.Lock()
+	defer fixtures.Unlock()
+	if fixtures.record == nil {
+		return nil
+	}
+	f.Args = redactArgs(f.Args)
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = fixtures.record.Write(append(data, '\n'))
+	return err
+}
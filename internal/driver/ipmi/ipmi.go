@@ -2,40 +2,306 @@
 package ipmi
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/kr/pty"
-
 	"github.com/CCI-MOC/obmd/internal/driver"
 	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
+	"github.com/CCI-MOC/obmd/internal/logger"
 )
 
-var Driver driver.Driver = impiDriver{}
+// An ipmi driver which does not limit the number of concurrent ipmitool
+// processes.
+var Driver driver.Driver = NewDriver(nil)
+
+// Return an ipmi driver which runs ipmitool commands (other than those
+// for console sessions, which are long-lived) subject to limiter.
+func NewDriver(limiter *driver.Limiter) driver.Driver {
+	return impiDriver{limiter: limiter}
+}
+
+type impiDriver struct {
+	limiter *driver.Limiter
+}
+
+// Defaults for ipmitool's -R and -N options, and the deadline for each
+// ipmitool command (see SetDefaults). Accessed atomically.
+var (
+	defaultRetries int64
+	defaultTimeout int64
+	commandTimeout int64
+)
 
-type impiDriver struct{}
+// Set the number of times ipmitool retries a request to the controller
+// (-R) and how long it waits for each attempt (-N, rounded up to whole
+// seconds), for nodes whose info doesn't specify them; zero leaves
+// ipmitool's own defaults in place. Also set the maximum time a single
+// ipmitool command (other than a console session) may run before it is
+// killed and treated as a transient failure; zero means no limit. This
+// applies to all ipmi OBMs, and may be changed at any time.
+func SetDefaults(retries int, timeout, deadline time.Duration) {
+	atomic.StoreInt64(&defaultRetries, int64(retries))
+	atomic.StoreInt64(&defaultTimeout, int64(timeout))
+	atomic.StoreInt64(&commandTimeout, int64(deadline))
+}
 
-func (impiDriver) GetOBM(info []byte) (driver.OBM, error) {
+func (d impiDriver) GetOBM(info []byte) (driver.OBM, error) {
 	connInfo := &connInfo{}
 	err := json.Unmarshal(info, connInfo)
 	if err != nil {
 		return nil, err
 	}
+	if err = connInfo.validate(); err != nil {
+		return nil, err
+	}
+	connInfo.limiter = d.limiter
+	connInfo.route = &routeCache{}
 	return &server{
 		Server: coordinator.NewServer(connInfo),
 		info:   connInfo,
+		raw:    append([]byte(nil), info...),
 	}, nil
 }
 
+// Check info strictly: unlike GetOBM, this rejects unknown fields, and
+// requires addr, user and pass. Problems with the set of fields and with
+// their values are all reported together.
+func (d impiDriver) ValidateInfo(info []byte) error {
+	var problems []string
+	if err := driver.CheckFields(info, &connInfo{}, "addr", "user", "pass"); err != nil {
+		problems = err.(*driver.InvalidInfoError).Problems
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(info, &fields) != nil || fields == nil {
+		// Not an object, as CheckFields has said.
+		return &driver.InvalidInfoError{Problems: problems}
+	}
+	connInfo := &connInfo{}
+	err := json.Unmarshal(info, connInfo)
+	if err == nil {
+		err = connInfo.validate()
+	}
+	if e, ok := err.(*driver.InvalidInfoError); ok {
+		problems = append(problems, e.Problems...)
+	} else if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if problems != nil {
+		return &driver.InvalidInfoError{Problems: problems}
+	}
+	return nil
+}
+
 // connInfo contains the connection info for an IPMI controller.
 type connInfo struct {
 	Addr string `json:"addr"`
 	User string `json:"user"`
 	Pass string `json:"pass"`
+
+	// Optional: the cipher suite ID (ipmitool's -C) and privilege level
+	// (-L) to use. If unset, ipmitool's defaults are used (currently
+	// cipher suite 3 and ADMINISTRATOR).
+	CipherSuite *int   `json:"cipher_suite"`
+	PrivLevel   string `json:"priv_level"`
+
+	// Optional: ipmitool's -R (number of retries) and -N (seconds to
+	// wait for each attempt), overriding the defaults set by SetDefaults.
+	Retries *int `json:"retries"`
+	Timeout *int `json:"timeout"`
+
+	// Optional: the IPMI 2.0 BMC key (Kg), for controllers which have
+	// one set. Kg is used as-is; KgHex is given as hexadecimal, for keys
+	// which aren't printable. At most one of these may be set. Either is
+	// passed to ipmitool in its environment (with -K).
+	Kg    string `json:"kg"`
+	KgHex string `json:"kg_hex"`
+
+	// Optional: bridging parameters, for controllers (e.g. blades) which
+	// are reached through another one, such as a chassis management
+	// module. Addresses are IPMB addresses, which may be given in hex
+	// (e.g. "0x82"); channels are channel numbers. These map to
+	// ipmitool's -t, -b, -T and -B options, respectively.
+	TargetAddr     string `json:"target_addr"`
+	TargetChannel  *int   `json:"target_channel"`
+	TransitAddr    string `json:"transit_addr"`
+	TransitChannel *int   `json:"transit_channel"`
+
+	// Optional: the SOL payload instance to attach the console to, for
+	// controllers with more than one serial port (e.g. multi-node
+	// chassis). If unset, ipmitool's default (1) is used.
+	SOLInstance *int `json:"sol_instance"`
+
+	// The host and (optional) port parsed from Addr, as passed to
+	// ipmitool's -H and -p options.
+	host string
+	port string
+
+	limiter *driver.Limiter
+
+	// The cached route to the controller (see target); nil if routes
+	// aren't cached, e.g. in tests.
+	route *routeCache
+}
+
+// The privilege levels accepted by ipmitool's -L option.
+var privLevels = []string{"CALLBACK", "USER", "OPERATOR", "ADMINISTRATOR"}
+
+// Check the fields of info, splitting Addr into host and port and
+// normalizing PrivLevel to upper case. Returns a *driver.InvalidInfoError
+// listing every problem found, if any.
+func (info *connInfo) validate() error {
+	var problems []string
+	bad := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	var err error
+	info.host, info.port, err = splitAddr(info.Addr)
+	if err != nil {
+		bad("%s", err)
+	}
+	// The cipher suites defined by the IPMI 2.0 spec (and its errata).
+	if info.CipherSuite != nil && (*info.CipherSuite < 0 || *info.CipherSuite > 17) {
+		bad("Invalid cipher_suite %d; must be between 0 and 17.", *info.CipherSuite)
+	}
+	if info.Retries != nil && *info.Retries < 0 {
+		bad("Invalid retries %d; must not be negative.", *info.Retries)
+	}
+	if info.Timeout != nil && *info.Timeout < 1 {
+		bad("Invalid timeout %d; must be at least 1 second.", *info.Timeout)
+	}
+	info.validateKg(bad)
+	info.validateBridging(bad)
+	if info.SOLInstance != nil && (*info.SOLInstance < 1 || *info.SOLInstance > 15) {
+		bad("Invalid sol_instance %d; must be between 1 and 15.", *info.SOLInstance)
+	}
+	if info.PrivLevel != "" {
+		info.PrivLevel = strings.ToUpper(info.PrivLevel)
+		valid := false
+		for _, level := range privLevels {
+			valid = valid || info.PrivLevel == level
+		}
+		if !valid {
+			bad("Invalid priv_level %q; must be one of %s.",
+				info.PrivLevel, strings.Join(privLevels, ", "))
+		}
+	}
+	if problems != nil {
+		return &driver.InvalidInfoError{Problems: problems}
+	}
+	return nil
+}
+
+// The maximum length of a BMC key, in bytes.
+const maxKgLen = 20
+
+// Check the BMC key fields of info, reporting problems to bad.
+func (info *connInfo) validateKg(bad func(format string, args ...interface{})) {
+	if info.Kg != "" && info.KgHex != "" {
+		bad("At most one of kg and kg_hex may be set.")
+	}
+	if len(info.Kg) > maxKgLen || strings.Contains(info.Kg, "\x00") {
+		bad("Invalid kg; must be at most %d bytes, with no zero bytes.", maxKgLen)
+	}
+	if info.KgHex != "" {
+		key, err := hex.DecodeString(strings.TrimPrefix(info.KgHex, "0x"))
+		if err != nil || len(key) > maxKgLen {
+			bad("Invalid kg_hex; must be at most %d bytes, in hex.", maxKgLen)
+		} else if strings.Contains(strings.TrimRight(string(key), "\x00"), "\x00") {
+			// It couldn't be passed to ipmitool in the environment.
+			bad("Invalid kg_hex; must not have zero bytes except at the end.")
+		}
+	}
+}
+
+// Check the bridging fields of info, reporting problems to bad.
+func (info *connInfo) validateBridging(bad func(format string, args ...interface{})) {
+	for _, addr := range []struct{ name, value string }{
+		{"target_addr", info.TargetAddr},
+		{"transit_addr", info.TransitAddr},
+	} {
+		if addr.value == "" {
+			continue
+		}
+		if _, err := strconv.ParseUint(addr.value, 0, 8); err != nil {
+			bad("Invalid %s %q; must be a one-byte IPMB address.", addr.name, addr.value)
+		}
+	}
+	for _, channel := range []struct {
+		name  string
+		value *int
+	}{
+		{"target_channel", info.TargetChannel},
+		{"transit_channel", info.TransitChannel},
+	} {
+		if channel.value != nil && (*channel.value < 0 || *channel.value > 15) {
+			bad("Invalid %s %d; must be between 0 and 15.", channel.name, *channel.value)
+		}
+	}
+	if info.TargetAddr == "" && (info.TargetChannel != nil || info.TransitAddr != "") {
+		bad("target_channel and transit_addr require target_addr.")
+	}
+	if info.TransitAddr == "" && info.TransitChannel != nil {
+		bad("transit_channel requires transit_addr.")
+	}
+}
+
+// Split a BMC address into a host and port. The port is optional, and
+// IPv6 literals may include a zone, so all of these are accepted:
+//
+// * bmc.example.com, bmc.example.com:623
+// * 10.0.0.4, 10.0.0.4:623
+// * 2001:db8::4, [2001:db8::4], [2001:db8::4]:623
+// * fe80::4%eth0, [fe80::4%eth0]:623
+//
+// The returned host never has brackets; ipmitool hands it straight to
+// getaddrinfo(), which doesn't understand them.
+func splitAddr(addr string) (host, port string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]"):
+		host = addr[1 : len(addr)-1]
+	case strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "["):
+		// A bare IPv6 literal; there's no way to give a port
+		// without brackets.
+		host = addr
+	case strings.Contains(addr, ":"):
+		host, port, err = net.SplitHostPort(addr)
+		if err != nil {
+			return "", "", fmt.Errorf("Invalid addr %q: %v", addr, err)
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return "", "", fmt.Errorf("Invalid port in addr %q.", addr)
+		}
+	default:
+		// A hostname or IPv4 address (or nothing at all).
+		return addr, "", nil
+	}
+	if strings.HasPrefix(addr, "[") || strings.Contains(host, ":") {
+		// Brackets are only for IPv6 literals.
+		ip := host
+		if i := strings.Index(ip, "%"); i >= 0 {
+			ip = ip[:i]
+		}
+		if !strings.Contains(ip, ":") || net.ParseIP(ip) == nil {
+			return "", "", fmt.Errorf("Invalid IPv6 address in addr %q.", addr)
+		}
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("Missing host in addr %q.", addr)
+	}
+	return host, port, nil
 }
 
 // A running ipmi process, connected to a serial console. Its Shutdown() method:
@@ -47,12 +313,22 @@ type ipmitoolProcess struct {
 	info *connInfo
 	proc *os.Process
 	conn io.ReadWriteCloser
+	out  io.Reader // conn, preceded by any output read while starting.
 }
 
 // An server manages a single ipmi controller.
 type server struct {
 	*coordinator.Server
-	info *connInfo
+	info  *connInfo
+	raw   []byte // the info passed to GetOBM.
+	shell serverShell
+}
+
+// Run the server (see coordinator.Server.Serve), closing its ipmitool shell
+// (see SetSessionTimeout) once it stops.
+func (s *server) Serve(ctx context.Context) {
+	s.Server.Serve(ctx)
+	s.closeShell()
 }
 
 // Cleanly disconnect from the console.
@@ -75,7 +351,7 @@ func (p *ipmitoolProcess) Shutdown() error {
 	defer termTimer.Stop()
 	defer killTimer.Stop()
 	p.proc.Wait()
-	errDeactivate := p.info.ipmitool("sol", "deactivate").Run()
+	errDeactivate := p.info.run(context.Background(), p.info.solArgs("deactivate")...)
 
 	// TODO: we should probably be a bit more principled about which
 	// error we return here.
@@ -87,78 +363,787 @@ func (p *ipmitoolProcess) Shutdown() error {
 	return errClose
 }
 
+// Forcibly kill the ipmitool process, and any children it has.
+func (p *ipmitoolProcess) Kill() error {
+	p.conn.Close()
+	return killProcessGroup(p.proc)
+}
+
 func (p *ipmitoolProcess) Reader() io.Reader {
-	return p.conn
+	return p.out
 }
 
-func (info *connInfo) Dial() (coordinator.Proc, error) {
-	cmd := info.ipmitool("sol", "activate")
-	stdio, err := pty.Start(cmd)
-	if err != nil {
-		return nil, err
-	}
-	return &ipmitoolProcess{
-		conn: stdio,
-		proc: cmd.Process,
-		info: info,
-	}, nil
+func (p *ipmitoolProcess) Writer() io.Writer {
+	return p.conn
 }
 
 // Invoke ipmitool, adding connection parameters corresponding to `info`.
-func (info *connInfo) ipmitool(args ...string) *exec.Cmd {
+// The process is killed if ctx is done before it exits. The password is
+// passed through the environment (-E), so that other local users can't
+// read it from the command line.
+func (info *connInfo) ipmitool(ctx context.Context, args ...string) *exec.Cmd {
 	// Annoyingly, when invoking a variadic function f(x ...Foo), you can't
 	// just do Foo(x, y, z, ...more); you need either Foo(x, y, z) or
 	// Foo(...more). We work around this by adding the static arguments to
 	// the slice, and then doing the latter:
-	args = append([]string{
+	host, port := info.target(ctx)
+	conn := []string{
 		"-I", "lanplus",
 		"-U", info.User,
-		"-P", info.Pass,
-		"-H", info.Addr,
-	}, args...)
-	return exec.Command("ipmitool", args...)
+		"-E",
+		"-H", host,
+	}
+	if port != "" {
+		conn = append(conn, "-p", port)
+	}
+	if info.CipherSuite != nil {
+		conn = append(conn, "-C", strconv.Itoa(*info.CipherSuite))
+	}
+	if info.PrivLevel != "" {
+		conn = append(conn, "-L", info.PrivLevel)
+	}
+	if retries := info.retries(); retries > 0 {
+		conn = append(conn, "-R", strconv.Itoa(retries))
+	}
+	if timeout := info.timeout(); timeout > 0 {
+		conn = append(conn, "-N", strconv.Itoa(timeout))
+	}
+	kg := info.kg()
+	if kg != "" {
+		conn = append(conn, "-K")
+	}
+	if info.TargetAddr != "" {
+		conn = append(conn, "-t", info.TargetAddr)
+	}
+	if info.TargetChannel != nil {
+		conn = append(conn, "-b", strconv.Itoa(*info.TargetChannel))
+	}
+	if info.TransitAddr != "" {
+		conn = append(conn, "-T", info.TransitAddr)
+	}
+	if info.TransitChannel != nil {
+		conn = append(conn, "-B", strconv.Itoa(*info.TransitChannel))
+	}
+	args = append(conn, args...)
+	cmd := exec.CommandContext(ctx, "ipmitool", args...)
+	// Like the password, the BMC key is passed in the environment, so that
+	// it doesn't show up in ps.
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+info.Pass)
+	if kg != "" {
+		cmd.Env = append(cmd.Env, "IPMI_KGKEY="+kg)
+	}
+	return cmd
+}
+
+// Return the BMC key, if any, as raw bytes. Trailing zero bytes are
+// dropped, since shorter keys are padded with them anyway.
+func (info *connInfo) kg() string {
+	if info.KgHex == "" {
+		return info.Kg
+	}
+	key, _ := hex.DecodeString(strings.TrimPrefix(info.KgHex, "0x"))
+	return strings.TrimRight(string(key), "\x00")
+}
+
+// The -R value to use, or zero for ipmitool's default.
+func (info *connInfo) retries() int {
+	if info.Retries != nil {
+		return *info.Retries
+	}
+	return int(atomic.LoadInt64(&defaultRetries))
+}
+
+// The -N value to use, or zero for ipmitool's default.
+func (info *connInfo) timeout() int {
+	if info.Timeout != nil {
+		return *info.Timeout
+	}
+	d := time.Duration(atomic.LoadInt64(&defaultTimeout))
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// Messages from ipmitool which indicate that we failed to talk to the
+// controller, rather than that it refused the operation. Failures with
+// these messages are reported as driver.TransientError.
+var transientMessages = []string{
+	"Unable to establish",
+	"Insufficient resources for session",
+	"timeout",
+}
+
+// Run an ipmitool command to completion, once the limiter allows it. If ctx
+// is done before the command finishes, the process is killed and ctx.Err()
+// is returned, rather than the (less informative) error from the process
+// itself. If the command exceeds the deadline set by SetDefaults, it is
+// killed and a driver.TransientError is returned.
+func (info *connInfo) run(ctx context.Context, args ...string) error {
+	_, err := info.output(ctx, args...)
+	return err
+}
+
+// Like run, but also returns the command's standard output.
+func (info *connInfo) output(ctx context.Context, args ...string) ([]byte, error) {
+	err := info.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer info.limiter.Release()
+	if f, replaying, err := replayFixture(info.Addr, args); replaying {
+		if err != nil {
+			return nil, err
+		}
+		if f.Exit != 0 {
+			return nil, ipmitoolError(fmt.Errorf("exit status %d", f.Exit), f.Stderr)
+		}
+		return []byte(f.Stdout), nil
+	}
+	cmdCtx := ctx
+	if deadline := time.Duration(atomic.LoadInt64(&commandTimeout)); deadline > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	cmd := info.ipmitool(cmdCtx, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		info.record(ctx, args, stdout.String(), stderr.String(), 0)
+		return stdout.Bytes(), nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if cmdCtx.Err() != nil {
+		return nil, driver.TransientError{
+			Err: fmt.Errorf("ipmitool: killed after running for too long"),
+		}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		info.record(ctx, args, stdout.String(), stderr.String(), status)
+	}
+	return nil, ipmitoolError(err, stderr.String())
 }
 
-// Invoke ipmitool in the server's main loop, passing extra arguments
+// Record a command's results, if recording fixtures; see SetFixtures.
+func (info *connInfo) record(ctx context.Context, args []string, stdout, stderr string, exit int) {
+	err := recordFixture(fixture{
+		Addr:   info.Addr,
+		Args:   args,
+		Stdout: stdout,
+		Stderr: stderr,
+		Exit:   exit,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to record ipmitool fixture",
+			"driver", "ipmi", "err", err)
+	}
+}
+
+// Return the error for an ipmitool command which failed with err, having
+// printed stderr. This is a driver.TransientError if stderr suggests we
+// failed to talk to the controller.
+func ipmitoolError(err error, stderr string) error {
+	err = fmt.Errorf("ipmitool: %v: %s", err, strings.TrimSpace(stderr))
+	for _, msg := range transientMessages {
+		if strings.Contains(stderr, msg) {
+			return driver.TransientError{Err: err}
+		}
+	}
+	return err
+}
+
+// Invoke ipmitool in the server's command lane, passing extra arguments
 // with the connection info for this ipmi controller.
-func (s *server) ipmitool(args ...string) (err error) {
-	s.RunInServer(func() {
-		err = s.info.ipmitool(args...).Run()
+func (s *server) ipmitool(ctx context.Context, args ...string) (err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		err = s.info.run(ctx, args...)
 	})
+	if errRun != nil {
+		return errRun
+	}
 	return
 }
 
 // Power off the server.
-func (s *server) PowerOff() error {
-	return s.ipmitool("chassis", "power", "off")
+func (s *server) PowerOff(ctx context.Context) error {
+	return s.ipmitool(ctx, "chassis", "power", "off")
+}
+
+// Ask the server's operating system to shut down, via an ACPI soft
+// power off.
+func (s *server) SoftPowerOff(ctx context.Context) error {
+	return s.ipmitool(ctx, "chassis", "power", "soft")
 }
 
 // Reboot the server. `force` indicates whether to do a forced shutdown, or
 // to give the operating system a chance to respond.
-func (s *server) PowerCycle(force bool) (err error) {
+func (s *server) PowerCycle(ctx context.Context, force bool) (err error) {
 	var op string
 	if force {
 		op = "reset"
 	} else {
 		op = "cycle"
 	}
-	s.RunInServer(func() {
-		err = s.info.ipmitool("chassis", "power", op).Run()
-		if err == nil {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		err = s.info.run(ctx, "chassis", "power", op)
+		if err == nil || ctx.Err() != nil {
 			return
 		}
 		// The above can fail if the machine is already powered off; in
 		// this case we just turn it on:
-		err = s.info.ipmitool("chassis", "power", "on").Run()
+		err = s.info.run(ctx, "chassis", "power", "on")
 	})
+	if errRun != nil {
+		return errRun
+	}
+	return
+}
+
+// Query the power state, via ipmitool's "chassis power status", which
+// prints e.g. "Chassis Power is on".
+func (s *server) PowerStatus(ctx context.Context) (state driver.PowerState, err error) {
+	state = driver.PowerStateUnknown
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.query(ctx, func(out []byte) bool {
+			return parsePowerStatus(string(out)) != driver.PowerStateUnknown
+		}, "chassis", "power", "status")
+		if err == nil {
+			state = parsePowerStatus(string(out))
+		}
+	})
+	if errRun != nil {
+		return driver.PowerStateUnknown, errRun
+	}
+	return
+}
+
+// Parse the output of "chassis power status".
+func parsePowerStatus(out string) driver.PowerState {
+	switch strings.ToLower(strings.TrimSpace(out)) {
+	case "chassis power is on":
+		return driver.PowerStateOn
+	case "chassis power is off":
+		return driver.PowerStateOff
+	}
+	return driver.PowerStateUnknown
+}
+
+// Read the power consumption, via DCMI.
+func (s *server) PowerReading(ctx context.Context) (reading driver.PowerReading, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.query(ctx, func(out []byte) bool {
+			_, err := parsePowerReading(string(out))
+			return err == nil
+		}, "dcmi", "power", "reading")
+		if err == nil {
+			reading, err = parsePowerReading(string(out))
+		}
+	})
+	if errRun != nil {
+		return reading, errRun
+	}
 	return
 }
 
-// Set the boot device. Legal values are "disk", "pxe", and "none".
-// "none" resets the boot device to the configured default.
-func (s *server) SetBootdev(dev string) error {
-	if dev != "disk" && dev != "pxe" && dev != "none" {
-		return driver.ErrInvalidBootdev
+// Parse the output of "dcmi power reading", which looks like:
+//
+//	Instantaneous power reading:                   220 Watts
+//	Minimum during sampling period:                 60 Watts
+//	Maximum during sampling period:                440 Watts
+//	Average power reading over sample period:      219 Watts
+//	...
+func parsePowerReading(out string) (reading driver.PowerReading, err error) {
+	fields := map[string]*int{
+		"Instantaneous power reading":              &reading.Watts,
+		"Minimum during sampling period":           &reading.Min,
+		"Maximum during sampling period":           &reading.Max,
+		"Average power reading over sample period": &reading.Average,
+	}
+	found := 0
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		dest, ok := fields[strings.TrimSpace(parts[0])]
+		if !ok {
+			continue
+		}
+		value := strings.TrimSuffix(strings.TrimSpace(parts[1]), "Watts")
+		*dest, err = strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return reading, fmt.Errorf("Unexpected power reading %q.", line)
+		}
+		found++
+	}
+	if found != len(fields) {
+		return reading, fmt.Errorf("Unexpected output from dcmi power reading: %q.", out)
+	}
+	return reading, nil
+}
+
+// Set (and activate) or remove the power limit, via DCMI.
+func (s *server) SetPowerLimit(ctx context.Context, watts int) (err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		if watts == 0 {
+			err = s.info.run(ctx, "dcmi", "power", "deactivate")
+			return
+		}
+		err = s.info.run(ctx, "dcmi", "power", "set_limit", "limit", strconv.Itoa(watts))
+		if err == nil {
+			err = s.info.run(ctx, "dcmi", "power", "activate")
+		}
+	})
+	if errRun != nil {
+		return errRun
+	}
+	return
+}
+
+// Report the BMC's network configuration, via "lan print".
+func (s *server) LANConfig(ctx context.Context) (config driver.LANConfig, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.info.output(ctx, "lan", "print")
+		if err == nil {
+			config = parseLANConfig(string(out))
+		}
+	})
+	if errRun != nil {
+		return config, errRun
+	}
+	return
+}
+
+// Parse the output of "lan print", which has lines like:
+//
+//	IP Address Source       : Static Address
+//	IP Address              : 10.0.0.4
+//	MAC Address             : 00:11:22:33:44:55
+//	802.1q VLAN ID          : Disabled
+func parseLANConfig(out string) (config driver.LANConfig) {
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "IP Address Source":
+			switch {
+			case strings.HasPrefix(value, "Static"):
+				config.IPSource = "static"
+			case strings.HasPrefix(value, "DHCP"):
+				config.IPSource = "dhcp"
+			default:
+				config.IPSource = strings.ToLower(value)
+			}
+		case "IP Address":
+			config.IPAddress = value
+		case "Subnet Mask":
+			config.Netmask = value
+		case "MAC Address":
+			config.MAC = value
+		case "Default Gateway IP":
+			config.Gateway = value
+		case "802.1q VLAN ID":
+			config.VLAN, _ = strconv.Atoi(value) // "Disabled" means 0.
+		}
+	}
+	return config
+}
+
+// Report the BMC's firmware version, via "mc info". ipmitool has no
+// portable way to report (or update) other firmware.
+func (s *server) FirmwareVersions(ctx context.Context) (versions map[string]string, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.info.output(ctx, "mc", "info")
+		if err == nil {
+			versions, err = parseMCInfo(string(out))
+		}
+	})
+	if errRun != nil {
+		return nil, errRun
+	}
+	return
+}
+
+// Parse the BMC's firmware version out of the output of "mc info", which
+// has a line like:
+//
+//	Firmware Revision         : 3.45
+func parseMCInfo(out string) (map[string]string, error) {
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "Firmware Revision" {
+			return map[string]string{"bmc": strings.TrimSpace(parts[1])}, nil
+		}
+	}
+	return nil, fmt.Errorf("Unexpected output from mc info: %q", out)
+}
+
+// Report the power restore policy, via "chassis status".
+func (s *server) PowerRestorePolicy(ctx context.Context) (policy driver.PowerRestorePolicy, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.info.output(ctx, "chassis", "status")
+		if err == nil {
+			policy, err = parsePowerRestorePolicy(string(out))
+		}
+	})
+	if errRun != nil {
+		return "", errRun
+	}
+	return
+}
+
+// Parse the power restore policy out of the output of "chassis status",
+// which has a line like:
+//
+//	Power Restore Policy : always-off
+func parsePowerRestorePolicy(out string) (driver.PowerRestorePolicy, error) {
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "Power Restore Policy" {
+			policy := driver.PowerRestorePolicy(strings.TrimSpace(parts[1]))
+			if policy.Valid() {
+				return policy, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Unexpected output from chassis status: %q", out)
+}
+
+// Set the power restore policy, via "chassis policy", whose arguments are
+// the same as our policies' names.
+func (s *server) SetPowerRestorePolicy(ctx context.Context, policy driver.PowerRestorePolicy) error {
+	if !policy.Valid() {
+		return driver.ErrInvalidPowerRestorePolicy
+	}
+	return s.ipmitool(ctx, "chassis", "policy", string(policy))
+}
+
+// Report the make and model of the node, from its FRU data.
+func (s *server) Model(ctx context.Context) (model string, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.info.output(ctx, "fru", "print", "0")
+		if err == nil {
+			model, err = parseFRUModel(string(out))
+		}
+	})
+	if errRun != nil {
+		return "", errRun
+	}
+	return
+}
+
+// Parse the make and model out of the output of "fru print 0", which
+// looks like:
+//
+//	FRU Device Description : Builtin FRU Device (ID 0)
+//	Board Mfg             : DELL
+//	Board Product         : PowerEdge R640
+//	Product Manufacturer  : DELL
+//	Product Name          : PowerEdge R640
+//
+// The product fields are preferred, falling back to the board's.
+func parseFRUModel(out string) (string, error) {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	for _, names := range [][2]string{
+		{"Product Manufacturer", "Product Name"},
+		{"Board Mfg", "Board Product"},
+	} {
+		if maker, model := fields[names[0]], fields[names[1]]; model != "" {
+			return strings.TrimSpace(maker + " " + model), nil
+		}
+	}
+	return "", fmt.Errorf("No model in the output of fru print: %q", out)
+}
+
+// Report the state of the watchdog timer, via "mc watchdog get".
+func (s *server) WatchdogStatus(ctx context.Context) (status driver.WatchdogStatus, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.info.output(ctx, "mc", "watchdog", "get")
+		if err == nil {
+			status, err = parseWatchdog(string(out))
+		}
+	})
+	if errRun != nil {
+		return status, errRun
+	}
+	return
+}
+
+// The actions reported by "mc watchdog get", and what we call them.
+var watchdogActions = map[string]string{
+	"No action":   "none",
+	"Hard Reset":  "reset",
+	"Power Down":  "power_off",
+	"Power Cycle": "power_cycle",
+}
+
+// Parse the output of "mc watchdog get", which looks like:
+//
+//	Watchdog Timer Use:     SMS/OS (0x44)
+//	Watchdog Timer Is:      Started/Running
+//	Watchdog Timer Actions: Power Cycle (0x03)
+//	Pre-timeout interval:   0 seconds
+//	Timer Expiration Flags: 0x00
+//	Initial Countdown:      300 sec
+//	Present Countdown:      295 sec
+//
+// Newer versions of ipmitool say "Action" rather than "Actions", and give
+// the countdowns to a tenth of a second.
+func parseWatchdog(out string) (status driver.WatchdogStatus, err error) {
+	found := 0
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "Watchdog Timer Is":
+			status.Running = strings.Contains(value, "Running")
+		case "Watchdog Timer Actions", "Watchdog Timer Action":
+			if i := strings.Index(value, " ("); i >= 0 {
+				value = value[:i]
+			}
+			action, ok := watchdogActions[value]
+			if !ok {
+				return status, fmt.Errorf("Unexpected watchdog action %q.", value)
+			}
+			status.Action = action
+		case "Initial Countdown", "Present Countdown":
+			secs, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "sec")), 64)
+			if err != nil {
+				return status, fmt.Errorf("Unexpected watchdog countdown %q.", line)
+			}
+			if key == "Initial Countdown" {
+				status.Timeout = int(secs)
+			} else {
+				status.Remaining = int(secs)
+			}
+		default:
+			continue
+		}
+		found++
+	}
+	if found != 4 {
+		return status, fmt.Errorf("Unexpected output from mc watchdog get: %q", out)
+	}
+	return status, nil
+}
+
+// The longest watchdog timeout IPMI supports: the countdown is 16 bits, in
+// tenths of a second.
+const maxWatchdogSeconds = 0xffff / 10
+
+// Set the watchdog to power cycle the node, and start it. ipmitool has no
+// command for the former, so this sends a raw Set Watchdog Timer request:
+// the timer is for SMS/OS, its action is a power cycle, with no
+// pre-timeout interrupt, clearing the SMS/OS expiration flag, and then the
+// countdown, least significant byte first.
+func (s *server) ArmWatchdog(ctx context.Context, seconds int) (err error) {
+	if seconds <= 0 || seconds > maxWatchdogSeconds {
+		return driver.ErrInvalidWatchdogTimeout
+	}
+	countdown := seconds * 10
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		err = s.info.run(ctx, "raw", "0x06", "0x24", "0x04", "0x03", "0x00", "0x10",
+			fmt.Sprintf("0x%02x", countdown&0xff), fmt.Sprintf("0x%02x", countdown>>8))
+		if err == nil {
+			err = s.info.run(ctx, "mc", "watchdog", "reset")
+		}
+	})
+	if errRun != nil {
+		return errRun
+	}
+	return
+}
+
+func (s *server) ResetWatchdog(ctx context.Context) error {
+	return s.ipmitool(ctx, "mc", "watchdog", "reset")
+}
+
+func (s *server) StopWatchdog(ctx context.Context) error {
+	return s.ipmitool(ctx, "mc", "watchdog", "off")
+}
+
+// The boot devices accepted by SetBootdev. These are passed straight to
+// ipmitool's "chassis bootdev".
+var bootdevs = []string{"disk", "pxe", "none", "bios", "cdrom", "safe"}
+
+// Set the boot device; see bootdevs. "none" resets the boot device to the
+// configured default, "bios" boots into the firmware setup, and "safe"
+// boots from the hard disk in safe mode.
+func (s *server) SetBootdev(ctx context.Context, dev string) error {
+	for _, valid := range bootdevs {
+		if dev == valid {
+			return s.ipmitool(ctx, "chassis", "bootdev", dev, "options=persistent")
+		}
+	}
+	return driver.ErrInvalidBootdev
+}
+
+func (s *server) Bootdevs(ctx context.Context) ([]string, error) {
+	return append([]string(nil), bootdevs...), nil
+}
+
+// The number of entries EventLog first reads from the end of the System
+// Event Log, when asked for those after a given one.
+const selTailSize = 32
+
+// Report the System Event Log, via "sel list". This doesn't use "sel
+// elist", which names sensors from the SDR, as that can take a long time.
+//
+// Rather than reading a large log in full for the few entries after
+// `after`, this reads the last selTailSize entries with "sel list last",
+// doubling the number until it reaches `after` or the start of the log.
+func (s *server) EventLog(ctx context.Context, after int) (entries []driver.EventLogEntry, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		list := func(args ...string) {
+			var out []byte
+			out, err = s.info.output(ctx, append([]string{"sel", "list"}, args...)...)
+			if err == nil {
+				entries, err = parseSELList(string(out))
+			}
+		}
+		if after == 0 {
+			list()
+			return
+		}
+		for n := selTailSize; ; n *= 2 {
+			list("last", strconv.Itoa(n))
+			if err != nil || len(entries) < n {
+				break
+			}
+			if entries[0].ID <= after {
+				if entries[len(entries)-1].ID < after {
+					// Cleared since; we need all of it.
+					list()
+				}
+				break
+			}
+		}
+		if err == nil {
+			entries = driver.EventLogSince(entries, after)
+		}
+	})
+	if errRun != nil {
+		return nil, errRun
+	}
+	return
+}
+
+// Parse the output of "sel list", which has a line per entry, like:
+//
+//	1a | 06/01/2018 | 12:00:00 | Memory #0x01 | Uncorrectable ECC | Asserted
+//
+// with the record ID in hex. Entries logged before the BMC knew the time
+// have "Pre-Init" in place of the date; their times are left zero, as are
+// times which don't parse. An empty log is reported as "SEL has no
+// entries". Lines which aren't entries (e.g. warnings from ipmitool, or
+// entries some BMCs truncate) are skipped, unless nothing else is there.
+func parseSELList(out string) ([]driver.EventLogEntry, error) {
+	entries := []driver.EventLogEntry{}
+	skipped := ""
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "SEL has no entries" {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) < 5 {
+			skipped = line
+			continue
+		}
+		id, err := strconv.ParseInt(fields[0], 16, 32)
+		if err != nil {
+			skipped = line
+			continue
+		}
+		entry := driver.EventLogEntry{
+			ID:       int(id),
+			Sensor:   fields[3],
+			Event:    fields[4],
+			Asserted: len(fields) < 6 || fields[5] != "Deasserted",
+		}
+		if t, err := time.Parse("01/02/2006 15:04:05", fields[1]+" "+fields[2]); err == nil {
+			entry.Time = t
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 && skipped != "" {
+		return nil, fmt.Errorf("Unexpected line in the output of sel list: %q", skipped)
+	}
+	return entries, nil
+}
+
+// Report the boot device, via "chassis bootparam get 5" (the boot flags).
+func (s *server) Bootdev(ctx context.Context) (dev string, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.info.output(ctx, "chassis", "bootparam", "get", "5")
+		if err == nil {
+			dev, err = parseBootFlags(string(out))
+		}
+	})
+	if errRun != nil {
+		return "", errRun
+	}
+	return
+}
+
+// The boot device selectors reported by "chassis bootparam get 5", and the
+// corresponding boot devices (see bootdevs). Safe mode must come before
+// the plain hard drive, since its description has that as a prefix.
+var bootSelectors = []struct{ selector, dev string }{
+	{"No override", "none"},
+	{"Force PXE", "pxe"},
+	{"Force Boot from default Hard-Drive, request Safe-Mode", "safe"},
+	{"Force Boot from default Hard-Drive", "disk"},
+	{"Force Boot from CD/DVD", "cdrom"},
+	{"Force Boot into BIOS Setup", "bios"},
+}
+
+// Parse the boot device out of the output of "chassis bootparam get 5",
+// which lists the boot flags, one per line, starting with "Boot Flag Valid"
+// or "Boot Flag Invalid", and including e.g. "Boot Device Selector : Force
+// PXE". If the flags aren't valid, the BIOS's default applies, i.e. "none".
+func parseBootFlags(out string) (string, error) {
+	var selector string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "-"))
+		if line == "Boot Flag Invalid" {
+			return "none", nil
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "Boot Device Selector" {
+			selector = strings.TrimSpace(parts[1])
+		}
+	}
+	for _, s := range bootSelectors {
+		if strings.HasPrefix(selector, s.selector) {
+			return s.dev, nil
+		}
 	}
-	return s.ipmitool("chassis", "bootdev", dev, "options=persistent")
+	return "", fmt.Errorf("Unexpected boot device selector in chassis bootparam output: %q", out)
 }
@@ -0,0 +1,955 @@
+package ipmi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+func TestSplitAddr(t *testing.T) {
+	cases := []struct {
+		addr, host, port string
+		ok               bool
+	}{
+		{"bmc.example.com", "bmc.example.com", "", true},
+		{"bmc.example.com:623", "bmc.example.com", "623", true},
+		{"10.0.0.4", "10.0.0.4", "", true},
+		{"10.0.0.4:623", "10.0.0.4", "623", true},
+		{"2001:db8::4", "2001:db8::4", "", true},
+		{"[2001:db8::4]", "2001:db8::4", "", true},
+		{"[2001:db8::4]:623", "2001:db8::4", "623", true},
+		{"fe80::4%eth0", "fe80::4%eth0", "", true},
+		{"[fe80::4%eth0]:623", "fe80::4%eth0", "623", true},
+		{"10.0.0.4:", "", "", false},
+		{"10.0.0.4:99999", "", "", false},
+		{"[2001:db8::4]:ipmi", "", "", false},
+		{"[]", "", "", false},
+		{"[bmc.example.com]:623", "", "", false},
+		{"2001:db8::zz", "", "", false},
+	}
+	for _, v := range cases {
+		host, port, err := splitAddr(v.addr)
+		if !v.ok {
+			if err == nil {
+				t.Errorf("%q: expected an error, but got host %q, port %q.",
+					v.addr, host, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", v.addr, err)
+		} else if host != v.host || port != v.port {
+			t.Errorf("%q: expected (%q, %q) but got (%q, %q).",
+				v.addr, v.host, v.port, host, port)
+		}
+	}
+}
+
+func TestParsePowerStatus(t *testing.T) {
+	cases := map[string]driver.PowerState{
+		"Chassis Power is on\n":  driver.PowerStateOn,
+		"Chassis Power is off\n": driver.PowerStateOff,
+		"Chassis Power is bogus": driver.PowerStateUnknown,
+		"":                       driver.PowerStateUnknown,
+	}
+	for out, expected := range cases {
+		if actual := parsePowerStatus(out); actual != expected {
+			t.Errorf("%q: expected %q but got %q.", out, expected, actual)
+		}
+	}
+}
+
+func TestParsePowerReading(t *testing.T) {
+	out := `
+    Instantaneous power reading:                   220 Watts
+    Minimum during sampling period:                 60 Watts
+    Maximum during sampling period:                440 Watts
+    Average power reading over sample period:      219 Watts
+    IPMI timestamp:                           Thu Jan  1 00:00:00 1970
+    Sampling period:                          00000001 Seconds.
+    Power reading state is:                   activated
+`
+	reading, err := parsePowerReading(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := driver.PowerReading{Watts: 220, Min: 60, Max: 440, Average: 219}
+	if reading != expected {
+		t.Fatalf("Expected %+v but got %+v.", expected, reading)
+	}
+	if _, err = parsePowerReading("DCMI request failed"); err == nil {
+		t.Fatal("Expected an error parsing bogus output.")
+	}
+}
+
+func TestParseLANConfig(t *testing.T) {
+	out := `Set in Progress         : Set Complete
+IP Address Source       : DHCP Address
+IP Address              : 10.0.0.4
+Subnet Mask             : 255.255.255.0
+MAC Address             : 00:11:22:33:44:55
+Default Gateway IP      : 10.0.0.1
+Default Gateway MAC     : 00:00:00:00:00:00
+802.1q VLAN ID          : 100
+`
+	expected := driver.LANConfig{
+		IPSource:  "dhcp",
+		IPAddress: "10.0.0.4",
+		Netmask:   "255.255.255.0",
+		MAC:       "00:11:22:33:44:55",
+		Gateway:   "10.0.0.1",
+		VLAN:      100,
+	}
+	if config := parseLANConfig(out); config != expected {
+		t.Fatalf("Expected %+v but got %+v.", expected, config)
+	}
+}
+
+func TestParseMCInfo(t *testing.T) {
+	out := `Device ID                 : 32
+Device Revision           : 1
+Firmware Revision         : 3.45
+IPMI Version              : 2.0
+Manufacturer ID           : 10876
+`
+	versions, err := parseMCInfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions["bmc"] != "3.45" {
+		t.Fatalf("Unexpected versions: %v", versions)
+	}
+	if _, err = parseMCInfo("Device ID : 32\n"); err == nil {
+		t.Fatal("Expected an error parsing output with no firmware revision.")
+	}
+}
+
+func TestParseSELList(t *testing.T) {
+	out := `   1 | Pre-Init  |0000000012| System Event #0x01 | Timestamp Clock Sync | Asserted
+   a | 06/01/2018 | 12:00:00 | Memory #0x01 | Uncorrectable ECC | Asserted
+  1b | 06/01/2018 | 12:05:00 | Power Supply #0x51 | Failure detected | Deasserted
+`
+	entries, err := parseSELList(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].ID != 1 || !entries[0].Time.IsZero() ||
+		entries[1].ID != 10 || entries[1].Event != "Uncorrectable ECC" || !entries[1].Asserted ||
+		!entries[1].Time.Equal(time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)) ||
+		entries[2].ID != 27 || entries[2].Sensor != "Power Supply #0x51" || entries[2].Asserted {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+	if entries, err = parseSELList("SEL has no entries\n"); err != nil || len(entries) != 0 {
+		t.Fatalf("Unexpected result parsing an empty log: %+v (%v)", entries, err)
+	}
+	if _, err = parseSELList("garbage\n"); err == nil {
+		t.Fatal("Expected an error parsing garbage.")
+	}
+	entries, err = parseSELList("   1 | 06/01/2018 | 12:00:00 | Memory #0x01\n" +
+		"Invalid SEL record\n" +
+		"  zz | 06/01/2018 | 12:00:00 | Memory #0x01 | Uncorrectable ECC\n" +
+		"   2 | 06/01/2018 | 12:05:00 | Memory #0x01 | Uncorrectable ECC | Asserted\n")
+	if err != nil || len(entries) != 1 || entries[0].ID != 2 {
+		t.Fatalf("Unexpected result skipping unparseable lines: %+v (%v)", entries, err)
+	}
+}
+
+func TestParsePowerRestorePolicy(t *testing.T) {
+	out := `System Power         : on
+Power Overload       : false
+Power Interlock      : inactive
+Main Power Fault     : false
+Power Control Fault  : false
+Power Restore Policy : previous
+Last Power Event     :
+`
+	policy, err := parsePowerRestorePolicy(out)
+	if err != nil || policy != driver.PowerRestorePrevious {
+		t.Fatalf("Expected %q but got %q (err = %v).", driver.PowerRestorePrevious, policy, err)
+	}
+	if _, err = parsePowerRestorePolicy("Power Restore Policy : unknown\n"); err == nil {
+		t.Fatal("Expected an error parsing an unknown policy.")
+	}
+}
+
+func TestParseFRUModel(t *testing.T) {
+	model, err := parseFRUModel(` FRU Device Description : Builtin FRU Device (ID 0)
+ Board Mfg             : Supermicro
+ Board Product         : X11DPT-B
+ Product Manufacturer  : Supermicro
+ Product Name          : SYS-2029BT-HNR
+`)
+	if err != nil || model != "Supermicro SYS-2029BT-HNR" {
+		t.Fatalf("Unexpected model %q (err = %v).", model, err)
+	}
+	model, err = parseFRUModel(" Board Mfg : Quanta\n Board Product : S2B\n")
+	if err != nil || model != "Quanta S2B" {
+		t.Fatalf("Unexpected model from board fields %q (err = %v).", model, err)
+	}
+	if _, err = parseFRUModel(" FRU Device Description : Builtin FRU Device (ID 0)\n"); err == nil {
+		t.Fatal("Expected an error without model fields.")
+	}
+}
+
+func TestParseWatchdog(t *testing.T) {
+	cases := []struct {
+		out    string
+		status driver.WatchdogStatus
+	}{
+		{
+			out: `Watchdog Timer Use:     SMS/OS (0x44)
+Watchdog Timer Is:      Started/Running
+Watchdog Timer Actions: Power Cycle (0x03)
+Pre-timeout interval:   0 seconds
+Timer Expiration Flags: 0x00
+Initial Countdown:      300 sec
+Present Countdown:      295 sec
+`,
+			status: driver.WatchdogStatus{Running: true, Action: "power_cycle", Timeout: 300, Remaining: 295},
+		},
+		{
+			out: `Watchdog Timer Use:     BIOS FRB2 (0x01)
+Watchdog Timer Is:      Stopped
+Watchdog Timer Logging: On
+Watchdog Timer Action:  No action (0x00)
+Pre-timeout interrupt:  None
+Pre-timeout interval:   0 seconds
+Timer Expired Flags:    None (0x00)
+Initial Countdown:      0.0 sec
+Present Countdown:      0.0 sec
+`,
+			status: driver.WatchdogStatus{Action: "none"},
+		},
+	}
+	for _, c := range cases {
+		status, err := parseWatchdog(c.out)
+		if err != nil {
+			t.Fatal("Parsing watchdog status:", err)
+		}
+		if status != c.status {
+			t.Fatalf("Expected %+v but got %+v.", c.status, status)
+		}
+	}
+	if _, err := parseWatchdog("Watchdog Timer Is: Stopped\n"); err == nil {
+		t.Fatal("Expected an error parsing incomplete output.")
+	}
+}
+
+func TestParseBootFlags(t *testing.T) {
+	out := `Boot parameter version: 1
+Boot parameter 5 is valid/unlocked
+Boot parameter data: c004000000
+ Boot Flags :
+   - Boot Flag Valid
+   - Options apply to all future boots
+   - BIOS PC Compatible (legacy) boot
+   - Boot Device Selector : %s
+   - Console Redirection control : System Default
+`
+	cases := map[string]string{
+		"Force PXE":                          "pxe",
+		"Force Boot from default Hard-Drive": "disk",
+		"Force Boot from default Hard-Drive, request Safe-Mode": "safe",
+		"No override": "none",
+	}
+	for selector, expected := range cases {
+		dev, err := parseBootFlags(fmt.Sprintf(out, selector))
+		if err != nil || dev != expected {
+			t.Fatalf("Parsing %q: expected %q but got %q (err = %v).", selector, expected, dev, err)
+		}
+	}
+	invalid := strings.Replace(fmt.Sprintf(out, "Force PXE"), "Flag Valid", "Flag Invalid", 1)
+	if dev, err := parseBootFlags(invalid); err != nil || dev != "none" {
+		t.Fatalf("Expected \"none\" for invalid boot flags, but got %q (err = %v).", dev, err)
+	}
+	if _, err := parseBootFlags(fmt.Sprintf(out, "Force Boot from Floppy/primary removable media")); err == nil {
+		t.Fatal("Expected an error parsing an unknown boot device.")
+	}
+}
+
+func TestParseUserList(t *testing.T) {
+	out := "ID  Name\t     Callin  Link Auth\tIPMI Msg   Channel Priv Limit\n" +
+		"1                    true    false      false      Unknown (0x00)\n" +
+		"2   admin            true    false      false      ADMINISTRATOR\n" +
+		"3   operator         true    true       true       OPERATOR\n"
+	users := parseUserList(out)
+	expected := []driver.User{
+		{ID: 2, Name: "admin", Privilege: "ADMINISTRATOR"},
+		{ID: 3, Name: "operator", Privilege: "OPERATOR"},
+	}
+	if len(users) != len(expected) {
+		t.Fatalf("Expected %+v but got %+v.", expected, users)
+	}
+	for i := range users {
+		if users[i] != expected[i] {
+			t.Fatalf("Expected %+v but got %+v.", expected, users)
+		}
+	}
+}
+
+func TestWithPassword(t *testing.T) {
+	info, err := withPassword([]byte(`{"addr": "10.0.0.4", "pass": "old", "cipher_suite": 17}`), "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"addr":"10.0.0.4","cipher_suite":17,"pass":"new"}`
+	if string(info) != expected {
+		t.Fatalf("Expected %s but got %s.", expected, info)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	version, ok := parseVersion("ipmitool version 1.8.18\n")
+	if !ok || version != [3]int{1, 8, 18} {
+		t.Fatal("Unexpected version:", version, ok)
+	}
+	if _, ok = parseVersion("command not found"); ok {
+		t.Fatal("Expected bogus output not to parse.")
+	}
+}
+
+func TestSOLInstance(t *testing.T) {
+	info := &connInfo{}
+	if args := strings.Join(info.solArgs("activate"), " "); args != "sol activate" {
+		t.Fatalf("Unexpected args without an instance: %q", args)
+	}
+	if err := json.Unmarshal([]byte(`{"addr": "10.0.0.4", "sol_instance": 2}`), info); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.validate(); err != nil {
+		t.Fatal("Validating info:", err)
+	}
+	if args := strings.Join(info.solArgs("deactivate"), " "); args != "sol deactivate instance=2" {
+		t.Fatalf("Unexpected args with an instance: %q", args)
+	}
+	for _, bad := range []int{0, 16} {
+		info.SOLInstance = &bad
+		if info.validate() == nil {
+			t.Errorf("Expected sol_instance %d to be rejected.", bad)
+		}
+	}
+}
+
+// With a route giving a source address, ipmitool's traffic should go
+// through a relay, and come from that address.
+func TestRelay(t *testing.T) {
+	bmc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bmc.Close()
+	sources := make(chan *net.UDPAddr, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := bmc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			sources <- from
+			bmc.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	_, network, _ := net.ParseCIDR("127.0.0.1/32")
+	driver.SetRoutes([]driver.Route{{Network: network, Source: net.ParseIP("127.0.0.2")}})
+	defer driver.SetRoutes(nil)
+	info := &connInfo{Addr: bmc.LocalAddr().String()}
+	if err = info.validate(); err != nil {
+		t.Fatal(err)
+	}
+	host, port := info.target(context.Background())
+	if net.JoinHostPort(host, port) == info.Addr {
+		t.Fatal("Expected a relay, but got the controller's address.")
+	}
+	defer relays.byKey[net.JoinHostPort(info.host, info.port)].close()
+
+	conn, err := net.Dial("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Unexpected reply %q (err = %v).", buf[:n], err)
+	}
+	if from := <-sources; !from.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatal("Traffic came from the wrong address:", from)
+	}
+
+	// Another socket, which wasn't admitted by a call to target, should
+	// be ignored.
+	other, err := net.Dial("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	other.Write([]byte("ping"))
+	if n, err = other.Read(buf); err == nil {
+		t.Fatalf("Expected traffic from an unknown socket to be dropped, but got %q.", buf[:n])
+	}
+}
+
+// connInfo.target should reuse the route it looked up until the routes
+// change.
+func TestRouteCache(t *testing.T) {
+	_, network, _ := net.ParseCIDR("127.0.0.1/32")
+	driver.SetRoutes([]driver.Route{{Network: network, Source: net.ParseIP("127.0.0.2")}})
+	defer driver.SetRoutes(nil)
+	info := &connInfo{Addr: "127.0.0.1:6231", route: &routeCache{}}
+	if err := info.validate(); err != nil {
+		t.Fatal(err)
+	}
+	host, port := info.target(context.Background())
+	if net.JoinHostPort(host, port) == info.Addr {
+		t.Fatal("Expected a relay, but got the controller's address.")
+	}
+	r := info.route.relay
+	defer r.close()
+	info.target(context.Background())
+	if info.route.relay != r {
+		t.Fatal("Expected the cached relay to be reused.")
+	}
+
+	driver.SetRoutes(nil)
+	host, port = info.target(context.Background())
+	if net.JoinHostPort(host, port) != info.Addr {
+		t.Fatalf("Expected a direct connection once the route was removed, but got %s:%s.", host, port)
+	}
+}
+
+func TestBridgingArgs(t *testing.T) {
+	info := &connInfo{}
+	err := json.Unmarshal([]byte(`{
+		"addr": "10.0.0.4",
+		"target_addr": "0x82",
+		"target_channel": 7,
+		"transit_addr": "0x20",
+		"transit_channel": 0
+	}`), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = info.validate(); err != nil {
+		t.Fatal("Validating info:", err)
+	}
+	args := strings.Join(info.ipmitool(context.Background(), "power", "status").Args, " ")
+	expected := "-t 0x82 -b 7 -T 0x20 -B 0 power status"
+	if !strings.HasSuffix(args, expected) {
+		t.Fatalf("Expected args ending with %q, but got %q.", expected, args)
+	}
+
+	for _, bad := range []string{
+		`{"target_addr": "0x182"}`,
+		`{"target_addr": "0x82", "target_channel": 16}`,
+		`{"transit_addr": "0x20"}`,
+		`{"target_addr": "0x82", "transit_channel": 0}`,
+	} {
+		info := &connInfo{}
+		if err := json.Unmarshal([]byte(bad), info); err != nil {
+			t.Fatal(err)
+		}
+		if info.validate() == nil {
+			t.Errorf("Expected %s to be rejected.", bad)
+		}
+	}
+}
+
+// Verify: validate rejects each invalid field, and reports every problem
+// at once.
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		info    string
+		problem string
+	}{
+		{`{"addr": "[10.0.0.4]"}`, "Invalid IPv6 address in addr"},
+		{`{"addr": "10.0.0.4:99999"}`, "Invalid port in addr"},
+		{`{"addr": "10.0.0.4", "cipher_suite": 18}`, "Invalid cipher_suite 18"},
+		{`{"addr": "10.0.0.4", "retries": -1}`, "Invalid retries -1"},
+		{`{"addr": "10.0.0.4", "timeout": 0}`, "Invalid timeout 0"},
+		{`{"addr": "10.0.0.4", "kg": "k", "kg_hex": "6b"}`, "At most one of kg and kg_hex"},
+		{`{"addr": "10.0.0.4", "kg": "012345678901234567890"}`, "Invalid kg;"},
+		{`{"addr": "10.0.0.4", "kg_hex": "xyz"}`, "Invalid kg_hex"},
+		{`{"addr": "10.0.0.4", "kg_hex": "6b006b"}`, "Invalid kg_hex"},
+		{`{"addr": "10.0.0.4", "kg": "k\u0000k"}`, "Invalid kg;"},
+		{`{"addr": "10.0.0.4", "target_addr": "0x182"}`, "Invalid target_addr"},
+		{`{"addr": "10.0.0.4", "target_addr": "0x82", "target_channel": 16}`, "Invalid target_channel 16"},
+		{`{"addr": "10.0.0.4", "transit_addr": "0x20"}`, "require target_addr"},
+		{`{"addr": "10.0.0.4", "target_addr": "0x82", "transit_channel": 0}`, "transit_channel requires transit_addr"},
+		{`{"addr": "10.0.0.4", "sol_instance": 16}`, "Invalid sol_instance 16"},
+		{`{"addr": "10.0.0.4", "priv_level": "root"}`, "Invalid priv_level"},
+	} {
+		info := &connInfo{}
+		if err := json.Unmarshal([]byte(c.info), info); err != nil {
+			t.Fatal(err)
+		}
+		err, ok := info.validate().(*driver.InvalidInfoError)
+		if !ok || len(err.Problems) != 1 || !strings.Contains(err.Problems[0], c.problem) {
+			t.Errorf("Expected %s to be rejected with %q, but got: %v", c.info, c.problem, err)
+		}
+	}
+
+	info := &connInfo{}
+	err := json.Unmarshal([]byte(`{"addr": "10.0.0.4:0", "retries": -1, "sol_instance": 0, "priv_level": "root"}`), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := info.validate().(*driver.InvalidInfoError); !ok || len(err.Problems) != 4 {
+		t.Fatalf("Expected 4 problems, but got: %v", err)
+	}
+}
+
+func TestValidateInfo(t *testing.T) {
+	d := impiDriver{}
+	if err := d.ValidateInfo([]byte(`{"addr": "10.0.0.4", "user": "admin", "pass": "secret", "Priv_Level": "user"}`)); err != nil {
+		t.Fatal("Valid info was rejected:", err)
+	}
+	for bad, problems := range map[string]int{
+		`{"adddr": "10.0.0.4", "user": "admin", "pass": "secret"}`:          2,
+		`{"addr": "10.0.0.4", "user": null}`:                                2,
+		`{"addr": "10.0.0.4", "user": "admin", "pass": "x", "retries": -1}`: 1,
+		`["10.0.0.4"]`: 1,
+		`null`:         1,
+		// Missing and unknown fields, and invalid values, all at once:
+		`{"addr": "10.0.0.4:0", "user": "admin", "retries": -1, "kg": "k", "kgg": "k"}`: 4,
+		`{"addr": "10.0.0.4", "user": "admin", "pass": "x", "retries": "2"}`:            1,
+	} {
+		err, ok := d.ValidateInfo([]byte(bad)).(*driver.InvalidInfoError)
+		if !ok || len(err.Problems) != problems {
+			t.Errorf("Expected %d problems with %s, but got: %v", problems, bad, err)
+		}
+	}
+}
+
+func TestRetryArgs(t *testing.T) {
+	SetDefaults(2, 1500*time.Millisecond, 0)
+	defer SetDefaults(0, 0, 0)
+
+	info := &connInfo{Addr: "10.0.0.4"}
+	args := strings.Join(info.ipmitool(context.Background()).Args, " ")
+	if !strings.HasSuffix(args, "-R 2 -N 2") {
+		t.Fatalf("Expected the default -R and -N, but got %q.", args)
+	}
+
+	retries, timeout := 0, 5
+	info.Retries, info.Timeout = &retries, &timeout
+	args = strings.Join(info.ipmitool(context.Background()).Args, " ")
+	if !strings.HasSuffix(args, "-N 5") || strings.Contains(args, "-R") {
+		t.Fatalf("Expected the node's own -R and -N, but got %q.", args)
+	}
+}
+
+// The password is passed to ipmitool through its environment, not its
+// command line.
+func TestPasswordNotInArgs(t *testing.T) {
+	info := &connInfo{Addr: "10.0.0.4", User: "admin", Pass: "secret"}
+	cmd := info.ipmitool(context.Background(), "power", "status")
+	if args := strings.Join(cmd.Args, " "); strings.Contains(args, "secret") ||
+		!strings.Contains(args, " -E ") {
+		t.Fatalf("Expected -E and no password in the args, but got %q.", args)
+	}
+	found := false
+	for _, kv := range cmd.Env {
+		found = found || kv == "IPMI_PASSWORD=secret"
+	}
+	if !found {
+		t.Fatal("Password is missing from the environment.")
+	}
+}
+
+// The BMC key is passed to ipmitool through its environment, not its
+// command line, whether given as is or in hex.
+func TestKgNotInArgs(t *testing.T) {
+	for _, c := range []struct {
+		info connInfo
+		env  string
+	}{
+		{connInfo{Kg: "topsecret"}, "IPMI_KGKEY=topsecret"},
+		{connInfo{KgHex: "0x746f70736563726574"}, "IPMI_KGKEY=topsecret"},
+		{connInfo{KgHex: "746f7073656372657400000000"}, "IPMI_KGKEY=topsecret"},
+	} {
+		c.info.Addr = "10.0.0.4"
+		cmd := c.info.ipmitool(context.Background(), "power", "status")
+		args := strings.Join(cmd.Args, " ")
+		if strings.Contains(args, "topsecret") || strings.Contains(args, "746f70") ||
+			!strings.Contains(args, " -K ") {
+			t.Fatalf("Expected -K and no key in the args, but got %q.", args)
+		}
+		found := false
+		for _, kv := range cmd.Env {
+			found = found || kv == c.env
+		}
+		if !found {
+			t.Fatalf("%s is missing from the environment.", c.env)
+		}
+	}
+
+	cmd := (&connInfo{Addr: "10.0.0.4"}).ipmitool(context.Background(), "power", "status")
+	if strings.Contains(strings.Join(cmd.Args, " "), " -K ") {
+		t.Fatal("Expected no -K without a key.")
+	}
+}
+
+// Put a shell script with the given body first in $PATH as "ipmitool".
+// Returns the directory containing it, and a function to undo this. Skips
+// the test on Windows.
+func fakeIpmitool(t *testing.T, body string) (dir string, cleanup func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a shell script standing in for ipmitool.")
+	}
+	dir, err := ioutil.TempDir("", "obmd-ipmi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\n" + body + "\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "ipmitool"), []byte(script), 0755)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return dir, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+// Verify: an ipmitool command which runs past the deadline is killed, and
+// reported as a transient error.
+func TestCommandTimeout(t *testing.T) {
+	_, cleanup := fakeIpmitool(t, "exec sleep 10")
+	defer cleanup()
+
+	SetDefaults(0, 0, 100*time.Millisecond)
+	defer SetDefaults(0, 0, 0)
+	start := time.Now()
+	err := (&connInfo{Addr: "10.0.0.4"}).run(context.Background(), "chassis", "power", "status")
+	if !driver.IsTransient(err) {
+		t.Fatal("Expected a transient error, but got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("ipmitool was not killed promptly; took", elapsed)
+	}
+}
+
+// A fake ipmitool whose SOL sessions conflict with an existing one until
+// "sol deactivate" is run, unless the file "stuck" exists.
+const conflictingSOL = `dir=$(dirname "$0")
+case "$*" in
+*"sol deactivate"*)
+	touch "$dir/deactivated"
+	;;
+*"sol activate"*)
+	if [ -e "$dir/deactivated" ] && [ ! -e "$dir/stuck" ]; then
+		echo "[SOL Session operational.  Use ~? for help]"
+		echo "login:"
+		exec cat
+	fi
+	echo "Info: SOL payload already active on another session"
+	exit 1
+	;;
+esac`
+
+// Verify: if ipmitool doesn't say whether the SOL session started, the
+// output so far is passed on once solStartTimeout has passed, without
+// waiting for more.
+func TestSOLStartTimeout(t *testing.T) {
+	_, cleanup := fakeIpmitool(t, `case "$*" in
+*"sol activate"*)
+	echo "login:"
+	exec sleep 10
+	;;
+esac`)
+	defer cleanup()
+	defer func(d time.Duration) { solStartTimeout = d }(solStartTimeout)
+	solStartTimeout = 100 * time.Millisecond
+
+	info := &connInfo{Addr: "10.0.0.4"}
+	p, err := info.Dial(context.Background())
+	if err != nil {
+		t.Fatal("Dialing the console:", err)
+	}
+	defer p.(*ipmitoolProcess).Kill()
+	read := make(chan []byte)
+	go func() {
+		buf := make([]byte, 512)
+		n, _ := p.Reader().Read(buf)
+		read <- buf[:n]
+	}()
+	select {
+	case out := <-read:
+		if !bytes.Contains(out, []byte("login:")) {
+			t.Fatalf("Unexpected output %q", out)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Output read while starting was not passed on.")
+	}
+}
+
+// Verify: Dial deactivates a conflicting SOL session and tries again.
+func TestSOLConflict(t *testing.T) {
+	dir, cleanup := fakeIpmitool(t, conflictingSOL)
+	defer cleanup()
+
+	info := &connInfo{Addr: "10.0.0.4"}
+	p, err := info.Dial(context.Background())
+	if err != nil {
+		t.Fatal("Dialing the console:", err)
+	}
+	defer p.(*ipmitoolProcess).Kill()
+	buf := make([]byte, 0, 512)
+	for !bytes.Contains(buf, []byte("login:")) {
+		n, err := p.Reader().Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			t.Fatalf("Reading the console: %v; got %q", err, buf)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "stuck"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = info.Dial(context.Background()); err != driver.ErrConsoleInUse {
+		t.Fatal("Expected ErrConsoleInUse, but got:", err)
+	}
+}
+
+// A fake ipmitool whose shell only understands "chassis power status",
+// and which logs each shell or separate command it runs to a file.
+const fakeShell = `dir=$(dirname "$0")
+case "$*" in
+*" shell")
+	echo >> "$dir/shells"
+	printf 'ipmitool> '
+	while read -r line; do
+		case "$line" in
+		"chassis power status") echo "Chassis Power is on" ;;
+		"echo "*) echo "${line#echo }" ;;
+		*) echo "Invalid command: $line" ;;
+		esac
+		printf 'ipmitool> '
+	done
+	;;
+*"dcmi power reading")
+	echo >> "$dir/commands"
+	echo "Instantaneous power reading: 220 Watts"
+	echo "Minimum during sampling period: 60 Watts"
+	echo "Maximum during sampling period: 440 Watts"
+	echo "Average power reading over sample period: 219 Watts"
+	;;
+esac`
+
+// Count the lines in a file written by fakeShell.
+func countLines(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// Verify: with session reuse enabled, queries share one ipmitool shell,
+// fall back to separate commands if the shell doesn't cope, and the shell
+// is closed when the OBM stops.
+func TestSessionReuse(t *testing.T) {
+	dir, cleanup := fakeIpmitool(t, fakeShell)
+	defer cleanup()
+	SetSessionTimeout(time.Minute)
+	defer SetSessionTimeout(0)
+
+	obm, err := NewDriver(nil).GetOBM([]byte(`{"addr": "10.0.0.4"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		obm.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i := 0; i < 3; i++ {
+		state, err := obm.PowerStatus(context.Background())
+		if err != nil || state != driver.PowerStateOn {
+			t.Fatalf("Power status: got (%q, %v).", state, err)
+		}
+	}
+	if n := countLines(t, filepath.Join(dir, "shells")); n != 1 {
+		t.Fatalf("Expected 1 shell to be started, but got %d.", n)
+	}
+
+	reading, err := obm.(driver.PowerMeter).PowerReading(context.Background())
+	if err != nil || reading.Watts != 220 {
+		t.Fatalf("Power reading: got (%+v, %v).", reading, err)
+	}
+	if n := countLines(t, filepath.Join(dir, "commands")); n != 1 {
+		t.Fatalf("Expected the reading to be run separately, but got %d commands.", n)
+	}
+	if _, err = obm.PowerStatus(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, filepath.Join(dir, "shells")); n != 2 {
+		t.Fatalf("Expected a new shell after the failure, but got %d shells.", n)
+	}
+
+	cancel()
+	<-done
+	if obm.(*server).shell.sh != nil {
+		t.Fatal("Shell was not closed when the OBM stopped.")
+	}
+}
+
+// A fake ipmitool whose SEL has entries with record IDs from 1 to the
+// number in the file "count", recording each command in "commands".
+const fakeSEL = `dir=$(dirname "$0")
+echo "$*" >>"$dir/commands"
+count=$(cat "$dir/count")
+i=1
+case "$*" in
+*"sel list last "*)
+	for n in "$@"; do :; done
+	i=$((count - n + 1))
+	[ $i -lt 1 ] && i=1
+	;;
+esac
+while [ $i -le $count ]; do
+	printf '%4x | 06/01/2018 | 12:00:00 | Memory #0x01 | Correctable ECC | Asserted\n' $i
+	i=$((i + 1))
+done`
+
+// Verify: reading the event log after a given entry reads only as much of
+// the end of the log as needed, and the whole log if it was cleared.
+func TestEventLogTail(t *testing.T) {
+	dir, cleanup := fakeIpmitool(t, fakeSEL)
+	defer cleanup()
+	setCount := func(n int) {
+		err := ioutil.WriteFile(filepath.Join(dir, "count"), []byte(strconv.Itoa(n)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(filepath.Join(dir, "commands"))
+	}
+
+	obm, err := NewDriver(nil).GetOBM([]byte(`{"addr": "10.0.0.4"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go obm.Serve(ctx)
+	r := obm.(driver.EventLogReader)
+
+	cases := []struct {
+		count, after   int
+		first, entries int
+		commands       int
+	}{
+		{count: 100, after: 0, first: 1, entries: 100, commands: 1},
+		{count: 100, after: 90, first: 91, entries: 10, commands: 1},
+		{count: 100, after: 50, first: 51, entries: 50, commands: 2},
+		{count: 100, after: 100, entries: 0, commands: 1},
+		{count: 40, after: 90, first: 1, entries: 40, commands: 2},
+	}
+	for _, c := range cases {
+		setCount(c.count)
+		entries, err := r.EventLog(context.Background(), c.after)
+		if err != nil {
+			t.Fatalf("Reading a log of %d after %d: %v", c.count, c.after, err)
+		}
+		if len(entries) != c.entries || (len(entries) != 0 && entries[0].ID != c.first) {
+			t.Fatalf("Reading a log of %d after %d: got %d entries (%+v)",
+				c.count, c.after, len(entries), entries)
+		}
+		if n := countLines(t, filepath.Join(dir, "commands")); n != c.commands {
+			t.Fatalf("Reading a log of %d after %d: expected %d commands, but got %d.",
+				c.count, c.after, c.commands, n)
+		}
+	}
+}
+
+// Verify: commands recorded with SetFixtures are replayed without running
+// ipmitool, and passwords are kept out of the recording.
+func TestFixtures(t *testing.T) {
+	dir, cleanup := fakeIpmitool(t, `case "$*" in
+*"power status") echo "Chassis Power is on" ;;
+*"user set password"*) ;;
+*) echo "Invalid command" >&2; exit 1 ;;
+esac`)
+	path := filepath.Join(dir, "fixtures.json")
+	if err := SetFixtures(path, ""); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	defer SetFixtures("", "")
+
+	info := &connInfo{Addr: "10.0.0.4"}
+	ctx := context.Background()
+	out, err := info.output(ctx, "chassis", "power", "status")
+	if err != nil || parsePowerStatus(string(out)) != driver.PowerStateOn {
+		t.Fatalf("Recording power status: got (%q, %v).", out, err)
+	}
+	if _, err = info.output(ctx, "bogus"); err == nil {
+		t.Fatal("Expected an error from a bogus command.")
+	}
+	if err = info.run(ctx, "user", "set", "password", "2", "secret"); err != nil {
+		t.Fatal("Recording password change:", err)
+	}
+	recording, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(recording, []byte("secret")) {
+		t.Fatalf("Password was recorded: %s", recording)
+	}
+
+	// With ipmitool gone, everything must come from the recording:
+	cleanup()
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(path, recording, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = SetFixtures("", path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		out, err = info.output(ctx, "chassis", "power", "status")
+		if err != nil || parsePowerStatus(string(out)) != driver.PowerStateOn {
+			t.Fatalf("Replaying power status: got (%q, %v).", out, err)
+		}
+	}
+	_, err = info.output(ctx, "bogus")
+	if err == nil || !strings.Contains(err.Error(), "Invalid command") {
+		t.Fatal("Expected the recorded error, but got:", err)
+	}
+	if err = info.run(ctx, "user", "set", "password", "2", "other"); err != nil {
+		t.Fatal("Replaying password change:", err)
+	}
+	if err = info.run(ctx, "chassis", "power", "off"); err == nil {
+		t.Fatal("Expected an error for a command with no recording.")
+	}
+}
@@ -0,0 +1,316 @@
+package ipmi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// How long a relay, or one of its clients' sockets, is kept open without
+// any traffic. ipmitool sends keepalives well within this during console
+// sessions.
+const relayIdleTimeout = 10 * time.Minute
+
+// How long after handing out its address (see relay.addr) a relay accepts
+// traffic from a new ipmitool socket. ipmitool sends its first packet as
+// soon as it starts.
+const relayAdmitWindow = 10 * time.Second
+
+// How long connInfo.target reuses a route it has looked up, unless the
+// routes change first.
+const routeCacheTTL = time.Minute
+
+// The running relays, keyed by the host and port of their controllers; see
+// connInfo.target.
+var relays = struct {
+	sync.Mutex
+	byKey map[string]*relay
+}{byKey: make(map[string]*relay)}
+
+// A relay for ipmitool's traffic to a controller, which sends it from a
+// particular local address (see driver.Route.Source), since ipmitool has
+// no option for that. ipmitool talks to the relay on the loopback
+// interface, and each of its sockets gets one of the relay's, bound to the
+// source address, for talking to the controller, so that replies go back
+// to the right process.
+//
+// Other local processes could send to the relay too, so it only takes on
+// a new socket if it has an unused admission: each call to addr, made
+// just before starting ipmitool, allows one socket to start talking to
+// it within relayAdmitWindow. Traffic from anything else is dropped.
+type relay struct {
+	key    string // in relays.
+	source net.IP
+	target *net.UDPAddr
+	conn   *net.UDPConn   // the loopback socket ipmitool talks to.
+	log    *logger.Logger // with the fields of the ctx passed to startRelay.
+
+	lock    sync.Mutex
+	clients map[string]*relayClient // keyed by ipmitool's address.
+	used    time.Time               // when the relay last saw traffic.
+	admits  []time.Time             // when unused admissions expire.
+	closed  bool
+}
+
+// One of ipmitool's sockets, and the relay's socket for its traffic.
+type relayClient struct {
+	addr *net.UDPAddr
+	conn *net.UDPConn
+	used time.Time // protected by the relay's lock.
+}
+
+// Start a relay which forwards traffic to target from source. It removes
+// itself from relays under key once it is closed. Problems are logged with
+// the fields carried by ctx, though the relay outlives it.
+func startRelay(ctx context.Context, key string, source net.IP, target *net.UDPAddr) (*relay, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	r := &relay{
+		key:     key,
+		source:  source,
+		target:  target,
+		conn:    conn,
+		log:     logger.FromContext(ctx).With("driver", "ipmi", "addr", target, "source", source),
+		clients: make(map[string]*relayClient),
+		used:    time.Now(),
+	}
+	go r.serve()
+	return r, nil
+}
+
+// The host and port for ipmitool to connect to. Counts as traffic, so
+// that the relay isn't closed before ipmitool gets to use it, and admits
+// one new socket.
+func (r *relay) addr() (host, port string) {
+	r.lock.Lock()
+	r.used = time.Now()
+	r.admits = append(r.admits, r.used.Add(relayAdmitWindow))
+	r.lock.Unlock()
+	host, port, _ = net.SplitHostPort(r.conn.LocalAddr().String())
+	return host, port
+}
+
+// Report whether the relay is closed, e.g. because it was idle.
+func (r *relay) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+func (r *relay) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.conn.Close()
+	for _, c := range r.clients {
+		c.conn.Close()
+	}
+}
+
+// Forward ipmitool's traffic to the controller, until the relay is closed
+// or has been idle for relayIdleTimeout.
+func (r *relay) serve() {
+	defer func() {
+		r.close()
+		relays.Lock()
+		if relays.byKey[r.key] == r {
+			delete(relays.byKey, r.key)
+		}
+		relays.Unlock()
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		r.conn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() && !r.idle() {
+				continue
+			}
+			return
+		}
+		c, err := r.client(from)
+		if err == errNotAdmitted {
+			r.log.Debug("Dropped traffic from unknown socket on relay", "from", from)
+			continue
+		} else if err != nil {
+			r.log.Warn("Failed to relay ipmitool traffic", "err", err)
+			continue
+		}
+		c.conn.Write(buf[:n])
+	}
+}
+
+// Report whether the relay has had no clients or traffic for
+// relayIdleTimeout.
+func (r *relay) idle() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.clients) == 0 && time.Since(r.used) >= relayIdleTimeout
+}
+
+// Returned by relay.client for traffic from a socket which wasn't admitted.
+var errNotAdmitted = errors.New("relay: traffic from a socket which wasn't admitted")
+
+// Return the client for traffic from addr, creating it if need be (which
+// uses up an admission), and note that it has seen traffic.
+func (r *relay) client(addr *net.UDPAddr) (*relayClient, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	c, ok := r.clients[addr.String()]
+	if !ok {
+		for len(r.admits) > 0 && now.After(r.admits[0]) {
+			r.admits = r.admits[1:]
+		}
+		if len(r.admits) == 0 {
+			return nil, errNotAdmitted
+		}
+		r.admits = r.admits[1:]
+		conn, err := net.DialUDP("udp", &net.UDPAddr{IP: r.source}, r.target)
+		if err != nil {
+			return nil, err
+		}
+		c = &relayClient{addr: addr, conn: conn}
+		r.clients[addr.String()] = c
+		go r.reply(c)
+	}
+	r.used = now
+	c.used = now
+	return c, nil
+}
+
+// Forward the controller's replies to c, until it has been idle for
+// relayIdleTimeout.
+func (r *relay) reply(c *relayClient) {
+	buf := make([]byte, 64*1024)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+		n, err := c.conn.Read(buf)
+		r.lock.Lock()
+		if err == nil {
+			c.used = time.Now()
+			r.used = c.used
+		} else if e, ok := err.(net.Error); !ok || !e.Timeout() || time.Since(c.used) >= relayIdleTimeout {
+			c.conn.Close()
+			delete(r.clients, c.addr.String())
+			r.lock.Unlock()
+			return
+		}
+		r.lock.Unlock()
+		if err == nil {
+			r.conn.WriteToUDP(buf[:n], c.addr)
+		}
+	}
+}
+
+// A node's route to its controller, as last looked up by connInfo.target,
+// so that hostnames aren't looked up, and relays' lock isn't taken, for
+// every ipmitool command.
+type routeCache struct {
+	sync.Mutex
+	checked time.Time // when the route was looked up; zero if never.
+	gen     uint64    // driver.RoutesGeneration() at the time.
+	relay   *relay    // nil if ipmitool connects directly.
+}
+
+// Return the host and port for ipmitool to connect to the controller
+// with: its own, or those of a relay if a route gives a source address for
+// it (see driver.SetRoutes). If the relay can't be started, this logs an
+// error and connects directly.
+func (info *connInfo) target(ctx context.Context) (host, port string) {
+	c := info.route
+	if c == nil {
+		c = &routeCache{}
+	}
+	c.Lock()
+	defer c.Unlock()
+	gen := driver.RoutesGeneration()
+	if c.checked.IsZero() || time.Since(c.checked) >= routeCacheTTL ||
+		c.gen != gen || (c.relay != nil && c.relay.isClosed()) {
+		r, err := info.findRelay(ctx)
+		c.relay = r
+		c.checked = time.Time{}
+		if err == nil {
+			c.checked = time.Now()
+			c.gen = gen
+		}
+	}
+	if c.relay == nil {
+		return info.host, info.port
+	}
+	return c.relay.addr()
+}
+
+// Return the relay for the controller, starting it if need be, or nil if
+// ipmitool should connect directly. Failures are logged, and also returned
+// so that the result isn't cached.
+func (info *connInfo) findRelay(ctx context.Context) (*relay, error) {
+	log := logger.FromContext(ctx).With("driver", "ipmi", "addr", info.Addr)
+	route, err := driver.RouteTo(ctx, info.host)
+	if err != nil {
+		log.Warn("Failed to look up route to controller", "err", err)
+		return nil, err
+	}
+	if route == nil || route.Source == nil {
+		return nil, nil
+	}
+	key := net.JoinHostPort(info.host, info.port)
+	relays.Lock()
+	r := relays.byKey[key]
+	relays.Unlock()
+	if r != nil && !r.isClosed() && r.source.Equal(route.Source) {
+		return r, nil
+	}
+	target, err := info.resolve(ctx)
+	if err != nil {
+		log.Error("Failed to start relay to controller; connecting directly",
+			"source", route.Source, "err", err)
+		return nil, err
+	}
+	relays.Lock()
+	defer relays.Unlock()
+	r = relays.byKey[key]
+	if r != nil && !r.isClosed() && r.source.Equal(route.Source) {
+		return r, nil
+	}
+	if r != nil {
+		r.close()
+	}
+	r, err = startRelay(ctx, key, route.Source, target)
+	if err != nil {
+		log.Error("Failed to start relay to controller; connecting directly",
+			"source", route.Source, "err", err)
+		delete(relays.byKey, key)
+		return nil, err
+	}
+	relays.byKey[key] = r
+	return r, nil
+}
+
+// Look up the controller's UDP address.
+func (info *connInfo) resolve(ctx context.Context) (*net.UDPAddr, error) {
+	port := info.port
+	if port == "" {
+		port = "623"
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, info.host)
+	if err != nil {
+		return nil, err
+	}
+	target := &net.UDPAddr{IP: addrs[0].IP, Zone: addrs[0].Zone}
+	target.Port, err = net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
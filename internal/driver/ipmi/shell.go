@@ -0,0 +1,258 @@
+package ipmi
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// How long an idle ipmitool shell is kept open; see SetSessionTimeout.
+// Accessed atomically.
+var sessionTimeout int64
+
+// Keep an "ipmitool shell" process open for each ipmi OBM, and run queries
+// (currently power status and power readings) in it, so that they reuse
+// one IPMI session rather than each paying for a new one. A shell is
+// closed once it has gone unused for d; most BMCs expire idle sessions
+// after 60 seconds, so d should be shorter than that. Zero (the default)
+// disables this. This applies to all ipmi OBMs, and may be changed at any
+// time.
+func SetSessionTimeout(d time.Duration) {
+	atomic.StoreInt64(&sessionTimeout, int64(d))
+}
+
+const (
+	// The prompt printed by ipmitool's shell.
+	shellPrompt = "ipmitool> "
+
+	// How long to wait for a command in the shell, if SetDefaults hasn't
+	// set a deadline. On timeout, the command is re-run without the
+	// shell, so this should be generous, but not unbounded.
+	shellCommandTimeout = 30 * time.Second
+)
+
+// Returned by startShell when the OBM's limiter has no slot free for a
+// shell.
+var errNoShellSlot = errors.New("no process slot free for an ipmitool shell")
+
+// A running "ipmitool shell", with an IPMI session open. Commands are
+// delimited in its output by echoing a marker after each one. The shell's
+// process counts against the OBM's limiter for as long as it runs.
+type shell struct {
+	limiter *driver.Limiter
+	cmd     *exec.Cmd
+	stdio   io.ReadWriteCloser
+	out     *bufio.Reader
+	used    time.Time   // when the shell last finished a command.
+	timer   *time.Timer // closes the shell once it has been idle too long.
+}
+
+// Start a shell for the controller described by info. Since a shell
+// holds its slot in the limiter while idle, this doesn't wait for one:
+// if none is free, it returns errNoShellSlot, and the query should be run
+// separately, queuing like any other command.
+func (info *connInfo) startShell() (*shell, error) {
+	if !info.limiter.TryAcquire() {
+		return nil, errNoShellSlot
+	}
+	cmd := info.ipmitool(context.Background(), "shell")
+	// A pty makes ipmitool flush its output after every line, which we
+	// need in order to see the marker.
+	stdio, err := startConsole(cmd)
+	if err != nil {
+		info.limiter.Release()
+		return nil, err
+	}
+	return &shell{
+		limiter: info.limiter,
+		cmd:     cmd,
+		stdio:   stdio,
+		out:     bufio.NewReader(stdio),
+		used:    time.Now(),
+	}, nil
+}
+
+// Kill the shell's process, and wait for it to exit.
+func (sh *shell) close() {
+	if sh.timer != nil {
+		sh.timer.Stop()
+	}
+	sh.stdio.Close()
+	killProcessGroup(sh.cmd.Process)
+	sh.cmd.Wait()
+	sh.limiter.Release()
+}
+
+// Run a command in the shell, and return its output (stdout and stderr
+// combined, as they share the pty). If ctx is done or the command takes
+// too long, the shell is killed. Any error leaves the shell unusable.
+func (sh *shell) run(ctx context.Context, args ...string) ([]byte, error) {
+	marker, err := shellMarker()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Duration(atomic.LoadInt64(&commandTimeout))
+	if deadline <= 0 {
+		deadline = shellCommandTimeout
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	// Wait for the watcher to finish before returning (and so before
+	// cancel is called), so it can't kill the shell once we're done.
+	done, exited := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-exited
+	}()
+	go func() {
+		defer close(exited)
+		select {
+		case <-cmdCtx.Done():
+			sh.stdio.Close()
+			killProcessGroup(sh.cmd.Process)
+		case <-done:
+		}
+	}()
+
+	line := strings.Join(args, " ")
+	echo := "echo " + marker
+	if _, err = io.WriteString(sh.stdio, line+"\n"+echo+"\n"); err != nil {
+		return nil, err
+	}
+	var out []byte
+	for {
+		text, err := sh.out.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("ipmitool shell exited: %v", err)
+		}
+		for strings.HasPrefix(text, shellPrompt) {
+			text = text[len(shellPrompt):]
+		}
+		text = strings.TrimRight(text, "\r\n")
+		switch strings.TrimSpace(text) {
+		case marker:
+			sh.used = time.Now()
+			return out, nil
+		case line, echo:
+			// The pty echoing our input back.
+			continue
+		}
+		out = append(out, text...)
+		out = append(out, '\n')
+	}
+}
+
+// Return a random string to mark the end of a command's output.
+func shellMarker() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "obmd-" + hex.EncodeToString(buf), nil
+}
+
+// A server's shell, if any; see SetSessionTimeout. The lock is held while
+// a command runs in the shell, and when closing it.
+type serverShell struct {
+	sync.Mutex
+	sh *shell
+}
+
+// Run a read-only query, in the server's shell if session reuse is enabled.
+// valid reports whether the output looks like a proper response; if it
+// doesn't, or anything else goes wrong with the shell, the shell is closed
+// and the query is run as a separate ipmitool command instead. This way,
+// the shell can only make queries faster, not less reliable.
+func (s *server) query(ctx context.Context, valid func([]byte) bool, args ...string) ([]byte, error) {
+	idle := time.Duration(atomic.LoadInt64(&sessionTimeout))
+	if idle > 0 && !usingFixtures() {
+		out, err := s.queryShell(ctx, idle, valid, args...)
+		if err == nil {
+			return out, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != errNoShellSlot {
+			logger.FromContext(ctx).Warn("Query in ipmitool shell failed; running it separately",
+				"driver", "ipmi", "addr", s.info.Addr, "err", err)
+		}
+	}
+	return s.info.output(ctx, args...)
+}
+
+// Run a query in the server's shell, starting one if need be.
+func (s *server) queryShell(ctx context.Context, idle time.Duration, valid func([]byte) bool, args ...string) ([]byte, error) {
+	s.shell.Lock()
+	defer s.shell.Unlock()
+	var err error
+	sh := s.shell.sh
+	if sh != nil && time.Since(sh.used) > idle {
+		// The BMC may have dropped the session by now.
+		sh.close()
+		sh = nil
+	}
+	if sh == nil {
+		if sh, err = s.info.startShell(); err != nil {
+			return nil, err
+		}
+		s.shell.sh = sh
+	}
+	out, err := sh.run(ctx, args...)
+	if err == nil && !valid(out) {
+		err = fmt.Errorf("unexpected output: %q", strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		sh.close()
+		s.shell.sh = nil
+		return nil, err
+	}
+	if sh.timer == nil {
+		sh.timer = time.AfterFunc(idle, func() { s.closeIdleShell(sh) })
+	} else {
+		sh.timer.Reset(idle)
+	}
+	return out, nil
+}
+
+// Close sh if it is still the server's shell, and has been idle for the
+// session timeout.
+func (s *server) closeIdleShell(sh *shell) {
+	s.shell.Lock()
+	defer s.shell.Unlock()
+	idle := time.Duration(atomic.LoadInt64(&sessionTimeout))
+	if s.shell.sh != sh {
+		return
+	}
+	if idle > 0 && time.Since(sh.used) < idle {
+		sh.timer.Reset(idle - time.Since(sh.used))
+		return
+	}
+	sh.close()
+	s.shell.sh = nil
+}
+
+// Close the server's shell, if it has one.
+func (s *server) closeShell() {
+	s.shell.Lock()
+	defer s.shell.Unlock()
+	if s.shell.sh != nil {
+		s.shell.sh.close()
+		s.shell.sh = nil
+	}
+}
@@ -0,0 +1,184 @@
+package ipmi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+var (
+	// Printed by ipmitool once a SOL session is established.
+	solReady = []byte("SOL Session operational")
+
+	// Printed by ipmitool if the controller already has a SOL session,
+	// e.g. from someone running ipmitool by hand.
+	solActive = []byte("SOL payload already active")
+)
+
+// How long to wait for ipmitool to report whether a SOL session was
+// established, before assuming it was, and passing on any output so far.
+// Some versions of ipmitool don't print anything on success. This is a
+// variable so that tests can shorten it.
+var solStartTimeout = 10 * time.Second
+
+// The most output to examine while waiting for the above.
+const maxSOLStartOutput = 4096
+
+// The output of ipmitool while starting a SOL session, which a goroutine
+// (see awaitSOL) reads until it can tell how that went, or is told to stop.
+// Once reading has stopped, the output is available as an io.Reader.
+type solStart struct {
+	lock   sync.Mutex
+	output bytes.Buffer // output not yet returned by Read.
+	seen   []byte       // all of the output read, for matching.
+	ended  bool         // whether the goroutine has stopped reading.
+	err    error        // the error which ended reading, if any.
+
+	changed chan struct{} // signalled when the above change.
+	stop    chan struct{} // closed to stop reading after the current read.
+}
+
+// Read from r until ipmitool reports whether the SOL session started, or
+// the returned solStart's stop channel is closed.
+func awaitSOL(r io.Reader) *solStart {
+	s := &solStart{
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	go func() {
+		chunk := make([]byte, 512)
+		for {
+			n, err := r.Read(chunk)
+			s.lock.Lock()
+			s.output.Write(chunk[:n])
+			s.seen = append(s.seen, chunk[:n]...)
+			s.err = err
+			s.ended = err != nil || len(s.seen) >= maxSOLStartOutput ||
+				bytes.Contains(s.seen, solReady) || bytes.Contains(s.seen, solActive)
+			select {
+			case <-s.stop:
+				s.ended = true
+			default:
+			}
+			ended := s.ended
+			s.lock.Unlock()
+			s.signal()
+			if ended {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *solStart) signal() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for up to timeout for reading to end. Returns whether it has, and
+// if so the output and the error which ended it.
+func (s *solStart) wait(timeout time.Duration) (ended bool, output []byte, err error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		if s.ended {
+			defer s.lock.Unlock()
+			return true, s.seen, s.err
+		}
+		s.lock.Unlock()
+		select {
+		case <-s.changed:
+		case <-timer.C:
+			return false, nil, nil
+		}
+	}
+}
+
+// Return what has been read so far, then whatever the goroutine reads
+// before it stops (after its current read), followed by EOF. This may be
+// used after closing s.stop.
+func (s *solStart) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.output.Len() > 0 {
+			defer s.lock.Unlock()
+			return s.output.Read(p)
+		}
+		ended := s.ended
+		s.lock.Unlock()
+		if ended {
+			return 0, io.EOF
+		}
+		<-s.changed
+	}
+}
+
+// Connect to the console. If the controller reports that a SOL session is
+// already active (e.g. one started outside of obmd), deactivate it and try
+// again, returning driver.ErrConsoleInUse if that doesn't help.
+func (info *connInfo) Dial(ctx context.Context) (coordinator.Proc, error) {
+	p, err := info.activate()
+	if err != driver.ErrConsoleInUse {
+		return p, err
+	}
+	logger.FromContext(ctx).Warn("SOL session already active; deactivating it",
+		"driver", "ipmi", "addr", info.Addr)
+	if err = info.run(context.Background(), info.solArgs("deactivate")...); err != nil {
+		return nil, err
+	}
+	return info.activate()
+}
+
+// Return the arguments to ipmitool for the SOL command `op` (e.g.
+// "activate"), on the node's SOL instance.
+func (info *connInfo) solArgs(op string) []string {
+	args := []string{"sol", op}
+	if info.SOLInstance != nil {
+		args = append(args, fmt.Sprintf("instance=%d", *info.SOLInstance))
+	}
+	return args
+}
+
+// Start an ipmitool SOL session, and wait (for up to solStartTimeout) for
+// it to report whether it succeeded.
+func (info *connInfo) activate() (coordinator.Proc, error) {
+	cmd := info.ipmitool(context.Background(), info.solArgs("activate")...)
+	stdio, err := startConsole(cmd)
+	if err != nil {
+		return nil, err
+	}
+	p := &ipmitoolProcess{
+		conn: stdio,
+		proc: cmd.Process,
+		info: info,
+	}
+	start := awaitSOL(stdio)
+	ended, output, err := start.wait(solStartTimeout)
+	if !ended {
+		// Assume it started, and pass on what we have so far without
+		// waiting for more.
+		close(start.stop)
+	} else if err != nil || bytes.Contains(output, solActive) {
+		stdio.Close()
+		killProcessGroup(cmd.Process)
+		cmd.Wait()
+		if bytes.Contains(output, solActive) {
+			return nil, driver.ErrConsoleInUse
+		}
+		return nil, fmt.Errorf("ipmitool: sol activate failed: %s",
+			bytes.TrimSpace(output))
+	}
+	p.out = io.MultiReader(start, stdio)
+	return p, nil
+}
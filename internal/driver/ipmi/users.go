@@ -0,0 +1,117 @@
+package ipmi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// The longest password IPMI 2.0 allows, in bytes. Passwords longer than
+// 16 bytes must be set as such explicitly.
+const maxPasswordLen = 20
+
+// List the BMC's users, via "user list".
+func (s *server) Users(ctx context.Context) (users []driver.User, err error) {
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.info.output(ctx, "user", "list")
+		if err == nil {
+			users = parseUserList(string(out))
+		}
+	})
+	if errRun != nil {
+		return nil, errRun
+	}
+	return
+}
+
+// Parse the output of "user list", which is a table with fixed-width ID
+// and Name columns:
+//
+//	ID  Name	     Callin  Link Auth	IPMI Msg   Channel Priv Limit
+//	1                    true    false      false      Unknown (0x00)
+//	2   admin            true    false      false      ADMINISTRATOR
+//
+// Slots without a name are unused, and are skipped.
+func parseUserList(out string) []driver.User {
+	users := []driver.User{}
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 21 {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(line[:4]))
+		name := strings.TrimSpace(line[4:21])
+		if err != nil || name == "" {
+			continue
+		}
+		user := driver.User{ID: id, Name: name}
+		if fields := strings.Fields(line[21:]); len(fields) > 3 {
+			user.Privilege = strings.Join(fields[3:], " ")
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+// Change the password of the user we log in as, via "user set password",
+// then check that it works by querying the power status with it.
+func (s *server) ChangePassword(ctx context.Context, password string) (info []byte, err error) {
+	if password == "" || len(password) > maxPasswordLen {
+		return nil, driver.ErrInvalidPassword
+	}
+	errRun := s.RunInServer(ctx, func(ctx context.Context) {
+		var out []byte
+		out, err = s.info.output(ctx, "user", "list")
+		if err != nil {
+			return
+		}
+		id := -1
+		for _, user := range parseUserList(string(out)) {
+			if user.Name == s.info.User {
+				id = user.ID
+			}
+		}
+		if id < 0 {
+			err = fmt.Errorf("User %q not found on the BMC.", s.info.User)
+			return
+		}
+		args := []string{"user", "set", "password", strconv.Itoa(id), password}
+		if len(password) > 16 {
+			args = append(args, "20")
+		}
+		if err = s.info.run(ctx, args...); err != nil {
+			return
+		}
+		updated := *s.info
+		updated.Pass = password
+		if err = updated.run(ctx, "chassis", "power", "status"); err != nil {
+			err = fmt.Errorf("The BMC accepted the new password, "+
+				"but logging in with it failed: %v", err)
+			return
+		}
+		info, err = withPassword(s.raw, password)
+	})
+	if errRun != nil {
+		return nil, errRun
+	}
+	return
+}
+
+// Return a copy of the driver info `raw`, with its password replaced.
+// Other fields are kept exactly as they were.
+func withPassword(raw []byte, password string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	pass, err := json.Marshal(password)
+	if err != nil {
+		return nil, err
+	}
+	fields["pass"] = pass
+	return json.Marshal(fields)
+}
@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// A Limiter bounds the number of concurrent executions of some resource,
+// typically external processes such as ipmitool. Callers which exceed the
+// limit queue until a slot is free.
+//
+// A Limiter may have a parent, in which case a slot must be acquired from
+// both; this allows e.g. per-driver limits within a global limit. A nil
+// *Limiter imposes no limit.
+type Limiter struct {
+	parent *Limiter
+	sem    chan struct{} // nil if there is no limit of our own.
+
+	// Accessed atomically:
+	running int64
+	waiting int64
+}
+
+// Snapshot of a Limiter's state, for monitoring.
+type LimiterStats struct {
+	Running int64 `json:"running"`
+	Waiting int64 `json:"waiting"`
+}
+
+// Return a Limiter allowing up to max concurrent holders, or any number if
+// max is 0, within the limits of parent (which may be nil).
+func NewLimiter(max int, parent *Limiter) *Limiter {
+	ret := &Limiter{parent: parent}
+	if max > 0 {
+		ret.sem = make(chan struct{}, max)
+	}
+	return ret
+}
+
+// Wait for a slot to be free, and take it. If ctx is done first, return
+// ctx.Err() without taking a slot. Each successful call must be matched by
+// a call to Release.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if l.sem != nil {
+		atomic.AddInt64(&l.waiting, 1)
+		select {
+		case l.sem <- struct{}{}:
+			atomic.AddInt64(&l.waiting, -1)
+		case <-ctx.Done():
+			atomic.AddInt64(&l.waiting, -1)
+			return ctx.Err()
+		}
+	}
+	// We always take our own slot before the parent's, so that callers
+	// queued on a per-driver limit do not tie up global slots.
+	if err := l.parent.Acquire(ctx); err != nil {
+		if l.sem != nil {
+			<-l.sem
+		}
+		return err
+	}
+	atomic.AddInt64(&l.running, 1)
+	return nil
+}
+
+// Like Acquire, but take a slot only if one is free now, rather than
+// waiting for one. Returns whether a slot was taken.
+func (l *Limiter) TryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if !l.parent.TryAcquire() {
+		if l.sem != nil {
+			<-l.sem
+		}
+		return false
+	}
+	atomic.AddInt64(&l.running, 1)
+	return true
+}
+
+// Release a slot taken by Acquire or TryAcquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	atomic.AddInt64(&l.running, -1)
+	l.parent.Release()
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// Return the number of current holders and waiters. Note that holders of a
+// child Limiter count towards its parent.
+func (l *Limiter) Stats() LimiterStats {
+	if l == nil {
+		return LimiterStats{}
+	}
+	return LimiterStats{
+		Running: atomic.LoadInt64(&l.running),
+		Waiting: atomic.LoadInt64(&l.waiting),
+	}
+}
@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A child Limiter should be bounded by both its own limit and its parent's.
+func TestLimiter(t *testing.T) {
+	global := NewLimiter(2, nil)
+	a := NewLimiter(0, global)
+	b := NewLimiter(1, global)
+	ctx := context.Background()
+
+	if err := b.Acquire(ctx); err != nil {
+		t.Fatal("Acquiring b:", err)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := b.Acquire(shortCtx); err != context.DeadlineExceeded {
+		t.Fatalf("Acquiring b past its limit: expected timeout, got %v", err)
+	}
+	if err := a.Acquire(ctx); err != nil {
+		t.Fatal("Acquiring a:", err)
+	}
+	if stats := global.Stats(); stats.Running != 2 || stats.Waiting != 0 {
+		t.Fatalf("Unexpected global stats: %+v", stats)
+	}
+
+	// The global limit is now reached, so a must wait for b:
+	acquired := make(chan error)
+	go func() {
+		acquired <- a.Acquire(ctx)
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatal("Acquired a past the global limit:", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if stats := global.Stats(); stats.Waiting != 1 {
+		t.Fatalf("Expected one global waiter, got stats: %+v", stats)
+	}
+	b.Release()
+	if err := <-acquired; err != nil {
+		t.Fatal("Acquiring a after b was released:", err)
+	}
+	if stats := a.Stats(); stats.Running != 2 {
+		t.Fatalf("Unexpected stats for a: %+v", stats)
+	}
+}
+
+// TryAcquire should take a slot only if both the Limiter and its parent
+// have one free.
+func TestLimiterTryAcquire(t *testing.T) {
+	global := NewLimiter(1, nil)
+	a := NewLimiter(0, global)
+	b := NewLimiter(1, global)
+
+	if !a.TryAcquire() {
+		t.Fatal("TryAcquire failed with slots free.")
+	}
+	if b.TryAcquire() {
+		t.Fatal("TryAcquire succeeded past the global limit.")
+	}
+	if stats := b.Stats(); stats.Running != 0 || stats.Waiting != 0 {
+		t.Fatalf("Unexpected stats for b: %+v", stats)
+	}
+	a.Release()
+	if !b.TryAcquire() {
+		t.Fatal("TryAcquire failed after a was released.")
+	}
+	if b.TryAcquire() {
+		t.Fatal("TryAcquire succeeded past b's limit.")
+	}
+	if stats := global.Stats(); stats.Running != 1 {
+		t.Fatalf("Unexpected global stats: %+v", stats)
+	}
+	if (*Limiter)(nil).TryAcquire() != true {
+		t.Fatal("TryAcquire failed on a nil Limiter.")
+	}
+}
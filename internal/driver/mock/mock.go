@@ -4,11 +4,15 @@
 package mock
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
 	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
@@ -20,6 +24,7 @@ type PowerAction string
 
 const (
 	Off         PowerAction = "off"
+	SoftOff                 = "soft-off"
 	ForceReboot             = "force-reboot"
 	SoftReboot              = "soft-reboot"
 	BootDevA                = "bootdev-a"
@@ -31,24 +36,109 @@ var (
 	// that was preformed on the OBM.
 	LastPowerActions     = map[string]PowerAction{}
 	lastPowerActionsLock sync.Mutex
+
+	// A mapping from node addrs to the power limit set on the OBM, in
+	// watts (zero if none).
+	PowerLimits     = map[string]int{}
+	powerLimitsLock sync.Mutex
+
+	// A mapping from node addrs to their firmware versions, keyed by
+	// component. Nodes start with version "1.0" of "bmc" and "bios".
+	firmwareVersions     = map[string]map[string]string{}
+	firmwareVersionsLock sync.Mutex
+
+	// A mapping from node addrs to their power restore policies.
+	// Nodes start with "always-off".
+	powerRestorePolicies     = map[string]driver.PowerRestorePolicy{}
+	powerRestorePoliciesLock sync.Mutex
+
+	// A mapping from node addrs to their watchdog timers. The timers
+	// don't actually do anything when they expire.
+	watchdogs     = map[string]watchdog{}
+	watchdogsLock sync.Mutex
+
+	// A mapping from node addrs to their boot devices, as set by
+	// SetBootdev.
+	bootdevs     = map[string]string{}
+	bootdevsLock sync.Mutex
+
+	// A mapping from node addrs to everything written to their consoles.
+	consoleInputs     = map[string][]byte{}
+	consoleInputsLock sync.Mutex
+
+	// A mapping from node addrs to their event logs; see AddEventLogEntry.
+	eventLogs     = map[string][]driver.EventLogEntry{}
+	eventLogsLock sync.Mutex
 )
 
+// Add an asserted entry to the event log of the node with the given addr,
+// numbered after the last one.
+func AddEventLogEntry(addr, sensor, event string) {
+	eventLogsLock.Lock()
+	defer eventLogsLock.Unlock()
+	id := 1
+	if log := eventLogs[addr]; len(log) != 0 {
+		id = log[len(log)-1].ID + 1
+	}
+	eventLogs[addr] = append(eventLogs[addr], driver.EventLogEntry{
+		ID:       id,
+		Time:     time.Now().UTC(),
+		Sensor:   sensor,
+		Event:    event,
+		Asserted: true,
+	})
+}
+
+// Clear the event log of the node with the given addr, so that its entries
+// are numbered from 1 again.
+func ClearEventLog(addr string) {
+	eventLogsLock.Lock()
+	defer eventLogsLock.Unlock()
+	delete(eventLogs, addr)
+}
+
+// Return everything written to the console of the node with the given addr.
+func ConsoleInput(addr string) []byte {
+	consoleInputsLock.Lock()
+	defer consoleInputsLock.Unlock()
+	return append([]byte(nil), consoleInputs[addr]...)
+}
+
 // Mock driver for use in tests
 type mockDriver struct{}
 
 type mockInfo struct {
 	Addr      string `json:"addr"`
 	NumWrites int
+
+	// If true, power operations never complete on their own; they
+	// return only once their context is done. This simulates a hung OBM.
+	Hang bool `json:"hang"`
+
+	// If true, the console produces no output.
+	Quiet bool `json:"quiet"`
+
+	// How long connecting to the console takes, in milliseconds.
+	DialDelay int `json:"dial_delay_ms"`
+
+	// If true, SoftPowerOff does nothing, as if the node's operating
+	// system ignored it.
+	IgnoreSoftOff bool `json:"ignore_soft_off"`
+
+	// Operations the OBM declares it doesn't support; see driver.Limited.
+	Unsupported []driver.Operation `json:"unsupported"`
 }
 
 type server struct {
 	*coordinator.Server
 	info mockInfo
+	raw  []byte // the info passed to GetOBM.
 }
 
 type proc struct {
 	done chan struct{}
 	conn net.Conn
+	addr string
 }
 
 func (p *proc) Shutdown() error {
@@ -62,8 +152,20 @@ func (p *proc) Reader() io.Reader {
 	return p.conn
 }
 
+// Input is recorded, for ConsoleInput.
+func (p *proc) Writer() io.Writer {
+	return p
+}
+
+func (p *proc) Write(data []byte) (int, error) {
+	consoleInputsLock.Lock()
+	defer consoleInputsLock.Unlock()
+	consoleInputs[p.addr] = append(consoleInputs[p.addr], data...)
+	return len(data), nil
+}
+
 func (mockDriver) GetOBM(info []byte) (driver.OBM, error) {
-	ret := &server{}
+	ret := &server{raw: append([]byte(nil), info...)}
 	err := json.Unmarshal(info, &ret.info)
 	if err != nil {
 		return nil, err
@@ -72,15 +174,20 @@ func (mockDriver) GetOBM(info []byte) (driver.OBM, error) {
 	return ret, nil
 }
 
-// Connect to a mock console stream. It just writes "addr":"user":"pass" in a
-// loop until the connection is closed.
-func (info *mockInfo) Dial() (coordinator.Proc, error) {
+// Connect to a mock console stream. It just writes an incrementing counter
+// in a loop until the connection is closed (unless info.Quiet is set).
+func (info *mockInfo) Dial(ctx context.Context) (coordinator.Proc, error) {
+	time.Sleep(time.Duration(info.DialDelay) * time.Millisecond)
 	myConn, theirConn := net.Pipe()
 
 	done := make(chan struct{})
 
 	go func() {
 		var err error
+		if info.Quiet {
+			// Wait for the connection to be closed:
+			_, err = myConn.Read(make([]byte, 1))
+		}
 		for err == nil {
 			_, err = fmt.Fprintf(myConn, "%d\n", info.NumWrites)
 			info.NumWrites++
@@ -91,20 +198,73 @@ func (info *mockInfo) Dial() (coordinator.Proc, error) {
 	return &proc{
 		done: done,
 		conn: theirConn,
+		addr: info.Addr,
 	}, nil
 }
 
+// If the OBM is configured to hang, block until ctx is done and return
+// its error. Otherwise, return nil immediately.
+func (s *server) maybeHang(ctx context.Context) error {
+	if !s.info.Hang {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Return the last power action performed on the OBM at addr. Unlike
+// reading LastPowerActions directly, this is safe while operations may be
+// in progress.
+func LastPowerAction(addr string) PowerAction {
+	lastPowerActionsLock.Lock()
+	defer lastPowerActionsLock.Unlock()
+	return LastPowerActions[addr]
+}
+
+// Return the power limit set on the OBM at addr, in watts (zero if none).
+// Like LastPowerAction, this is safe while operations may be in progress.
+func PowerLimit(addr string) int {
+	powerLimitsLock.Lock()
+	defer powerLimitsLock.Unlock()
+	return PowerLimits[addr]
+}
+
+// Remove the power limit set on the OBM at addr, e.g. as a BMC reset
+// might.
+func ClearPowerLimit(addr string) {
+	powerLimitsLock.Lock()
+	defer powerLimitsLock.Unlock()
+	delete(PowerLimits, addr)
+}
+
 func (s *server) setPowerAction(action PowerAction) {
 	lastPowerActionsLock.Lock()
 	defer lastPowerActionsLock.Unlock()
 	LastPowerActions[s.info.Addr] = action
 }
 
-func (s *server) PowerOff() error {
+func (s *server) PowerOff(ctx context.Context) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
 	s.setPowerAction(Off)
 	return nil
 }
-func (s *server) PowerCycle(force bool) error {
+
+func (s *server) SoftPowerOff(ctx context.Context) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
+	if !s.info.IgnoreSoftOff {
+		s.setPowerAction(SoftOff)
+	}
+	return nil
+}
+
+func (s *server) PowerCycle(ctx context.Context, force bool) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
 	if force {
 		s.setPowerAction(ForceReboot)
 		return nil
@@ -114,14 +274,251 @@ func (s *server) PowerCycle(force bool) error {
 	}
 }
 
-func (s *server) SetBootdev(dev string) error {
+// The node is off if the last power action was Off or SoftOff, and on
+// otherwise.
+func (s *server) PowerStatus(ctx context.Context) (driver.PowerState, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return driver.PowerStateUnknown, err
+	}
+	lastPowerActionsLock.Lock()
+	defer lastPowerActionsLock.Unlock()
+	switch LastPowerActions[s.info.Addr] {
+	case Off, SoftOff:
+		return driver.PowerStateOff, nil
+	}
+	return driver.PowerStateOn, nil
+}
+
+func (s *server) SetBootdev(ctx context.Context, dev string) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
 	switch dev {
 	case "A":
 		s.setPowerAction(BootDevA)
-		return nil
 	case "B":
 		s.setPowerAction(BootDevB)
-		return nil
+	default:
+		return driver.ErrInvalidBootdev
+	}
+	bootdevsLock.Lock()
+	defer bootdevsLock.Unlock()
+	bootdevs[s.info.Addr] = dev
+	return nil
+}
+
+func (s *server) PowerRestorePolicy(ctx context.Context) (driver.PowerRestorePolicy, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return "", err
+	}
+	powerRestorePoliciesLock.Lock()
+	defer powerRestorePoliciesLock.Unlock()
+	if policy, ok := powerRestorePolicies[s.info.Addr]; ok {
+		return policy, nil
+	}
+	return driver.PowerRestoreAlwaysOff, nil
+}
+
+func (s *server) SetPowerRestorePolicy(ctx context.Context, policy driver.PowerRestorePolicy) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
+	if !policy.Valid() {
+		return driver.ErrInvalidPowerRestorePolicy
+	}
+	powerRestorePoliciesLock.Lock()
+	defer powerRestorePoliciesLock.Unlock()
+	powerRestorePolicies[s.info.Addr] = policy
+	return nil
+}
+
+func (s *server) Model(ctx context.Context) (string, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return "", err
+	}
+	return "Mock Model", nil
+}
+
+type watchdog struct {
+	timeout int
+	started time.Time // zero if the timer is stopped.
+}
+
+func (s *server) WatchdogStatus(ctx context.Context) (driver.WatchdogStatus, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return driver.WatchdogStatus{}, err
+	}
+	watchdogsLock.Lock()
+	defer watchdogsLock.Unlock()
+	w, ok := watchdogs[s.info.Addr]
+	if !ok {
+		return driver.WatchdogStatus{Action: "none"}, nil
+	}
+	status := driver.WatchdogStatus{Action: "power_cycle", Timeout: w.timeout}
+	if !w.started.IsZero() {
+		status.Remaining = w.timeout - int(time.Since(w.started)/time.Second)
+		if status.Remaining > 0 {
+			status.Running = true
+		} else {
+			status.Remaining = 0
+		}
+	}
+	return status, nil
+}
+
+func (s *server) ArmWatchdog(ctx context.Context, seconds int) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
+	if seconds <= 0 {
+		return driver.ErrInvalidWatchdogTimeout
+	}
+	watchdogsLock.Lock()
+	defer watchdogsLock.Unlock()
+	watchdogs[s.info.Addr] = watchdog{timeout: seconds, started: time.Now()}
+	return nil
+}
+
+func (s *server) ResetWatchdog(ctx context.Context) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
+	watchdogsLock.Lock()
+	defer watchdogsLock.Unlock()
+	if w, ok := watchdogs[s.info.Addr]; ok {
+		w.started = time.Now()
+		watchdogs[s.info.Addr] = w
+	}
+	return nil
+}
+
+func (s *server) StopWatchdog(ctx context.Context) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
+	watchdogsLock.Lock()
+	defer watchdogsLock.Unlock()
+	if w, ok := watchdogs[s.info.Addr]; ok {
+		w.started = time.Time{}
+		watchdogs[s.info.Addr] = w
+	}
+	return nil
+}
+
+// Nodes boot from "A" until told otherwise.
+func (s *server) Bootdev(ctx context.Context) (string, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return "", err
+	}
+	bootdevsLock.Lock()
+	defer bootdevsLock.Unlock()
+	if dev, ok := bootdevs[s.info.Addr]; ok {
+		return dev, nil
+	}
+	return "A", nil
+}
+
+// The node always draws 200 watts, or its power limit if that is lower.
+func (s *server) PowerReading(ctx context.Context) (driver.PowerReading, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return driver.PowerReading{}, err
+	}
+	watts := 200
+	powerLimitsLock.Lock()
+	defer powerLimitsLock.Unlock()
+	if limit := PowerLimits[s.info.Addr]; limit != 0 && limit < watts {
+		watts = limit
+	}
+	return driver.PowerReading{Watts: watts, Min: watts, Max: watts, Average: watts}, nil
+}
+
+func (s *server) SetPowerLimit(ctx context.Context, watts int) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
+	powerLimitsLock.Lock()
+	defer powerLimitsLock.Unlock()
+	PowerLimits[s.info.Addr] = watts
+	return nil
+}
+
+func (s *server) LANConfig(ctx context.Context) (driver.LANConfig, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return driver.LANConfig{}, err
+	}
+	return driver.LANConfig{IPSource: "static", IPAddress: s.info.Addr}, nil
+}
+
+// There is just the one user.
+func (s *server) Users(ctx context.Context) ([]driver.User, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return nil, err
+	}
+	return []driver.User{{ID: 2, Name: "admin", Privilege: "ADMINISTRATOR"}}, nil
+}
+
+// Returns the info with its "pass" field set to password.
+func (s *server) ChangePassword(ctx context.Context, password string) ([]byte, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(s.raw, &fields); err != nil {
+		return nil, err
+	}
+	fields["pass"] = password
+	return json.Marshal(fields)
+}
+
+func (s *server) FirmwareVersions(ctx context.Context) (map[string]string, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return nil, err
+	}
+	firmwareVersionsLock.Lock()
+	defer firmwareVersionsLock.Unlock()
+	ret := map[string]string{"bmc": "1.0", "bios": "1.0"}
+	for component, version := range firmwareVersions[s.info.Addr] {
+		ret[component] = version
 	}
-	return driver.ErrInvalidBootdev
+	return ret, nil
+}
+
+// The image's contents (less surrounding whitespace) become the
+// component's version.
+func (s *server) UpdateFirmware(ctx context.Context, component string, r io.Reader) error {
+	if err := s.maybeHang(ctx); err != nil {
+		return err
+	}
+	if component != "bmc" && component != "bios" {
+		return fmt.Errorf("No such firmware component: %q", component)
+	}
+	image, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	firmwareVersionsLock.Lock()
+	defer firmwareVersionsLock.Unlock()
+	if firmwareVersions[s.info.Addr] == nil {
+		firmwareVersions[s.info.Addr] = map[string]string{}
+	}
+	firmwareVersions[s.info.Addr][component] = strings.TrimSpace(string(image))
+	return nil
+}
+
+func (s *server) EventLog(ctx context.Context, after int) ([]driver.EventLogEntry, error) {
+	if err := s.maybeHang(ctx); err != nil {
+		return nil, err
+	}
+	eventLogsLock.Lock()
+	defer eventLogsLock.Unlock()
+	log := append([]driver.EventLogEntry{}, eventLogs[s.info.Addr]...)
+	return driver.EventLogSince(log, after), nil
+}
+
+func (s *server) Unsupported() []driver.Operation {
+	return s.info.Unsupported
+}
+
+func (s *server) Bootdevs(ctx context.Context) ([]string, error) {
+	return []string{"A", "B"}, nil
 }
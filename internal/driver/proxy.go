@@ -0,0 +1,186 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Connect to addr through the proxy at u (see Route.Proxy), using d to
+// reach the proxy.
+func dialProxy(ctx context.Context, d *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	// Don't let the handshake outlive ctx:
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	switch u.Scheme {
+	case "http":
+		conn, err = connectHTTP(conn, u, addr)
+	case "socks5":
+		err = connectSOCKS5(conn, u, addr)
+	default:
+		err = fmt.Errorf("Unsupported proxy scheme %q.", u.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("proxy %s: %v", u.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// A net.Conn whose first reads come from a bufio.Reader which has already
+// read from it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Ask an http proxy, connected to by conn, to connect to addr, via the
+// CONNECT method.
+func connectHTTP(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), pass)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT failed: %s", resp.Status)
+	}
+	if r.Buffered() == 0 {
+		return conn, nil
+	}
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// Ask a SOCKS5 proxy (RFC 1928), connected to by conn, to connect to
+// addr, authenticating with the user name and password from u (RFC 1929),
+// if it has them.
+func connectSOCKS5(conn net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid port %q.", portStr)
+	}
+
+	// Offer no authentication, or a user name and password if we have
+	// them:
+	const noAuth, passwordAuth = 0x00, 0x02
+	greeting := []byte{0x05, 1, noAuth}
+	if u.User != nil {
+		greeting = []byte{0x05, 2, noAuth, passwordAuth}
+	}
+	if _, err = conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.New("Not a SOCKS5 proxy.")
+	}
+	switch {
+	case reply[1] == noAuth:
+	case reply[1] == passwordAuth && u.User != nil:
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("SOCKS5 user name or password too long.")
+		}
+		req := append([]byte{0x01, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err = conn.Write(req); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed.")
+		}
+	default:
+		return errors.New("No acceptable SOCKS5 authentication method.")
+	}
+
+	// Ask for the connection, leaving any hostname for the proxy to look
+	// up:
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("Hostname too long for SOCKS5.")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 connect failed with code %d.", head[1])
+	}
+	// Skip the address the proxy bound, and its port:
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		if _, err = io.ReadFull(conn, head[:1]); err != nil {
+			return err
+		}
+		skip = int(head[0])
+	default:
+		return fmt.Errorf("Unexpected SOCKS5 address type %d.", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -3,6 +3,8 @@ package driver
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 )
 
 // Indicates that Registry.GetOBM was called with a "type" field not in
@@ -14,14 +16,17 @@ var ErrUnknownType = errors.New("Unknown obm type")
 //
 // {"type": someType, "info": driverInfo}
 //
-// where someType is a JSON string, and driverInfo is arbitrary JSON.
+// where someType is a JSON string, and driverInfo is arbitrary JSON. It may
+// also have a "model" field, naming the node's make and model, which is
+// for obmd's own use (e.g. in metrics), and ignored here.
 // Its GetOBM method shells out to registry[someType].GetOBM(driverInfo),
 // returning ErrUnknownType if someType is not in the registry.
 type Registry map[string]Driver
 
 type obmInfo struct {
-	Type string      `json:"type"`
-	Info *driverInfo `json:"info"`
+	Type  string      `json:"type"`
+	Info  *driverInfo `json:"info"`
+	Model string      `json:"model"`
 }
 
 // Wrapper around []byte that lets us collect the raw JSON in obmInfo's Info
@@ -34,6 +39,27 @@ func (info *driverInfo) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Check the prerequisites of each driver which is a Checker, in order of
+// type. Each problem is prefixed with its driver's type.
+func (r Registry) Check() []error {
+	types := make([]string, 0, len(r))
+	for typ := range r {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	var problems []error
+	for _, typ := range types {
+		c, ok := r[typ].(Checker)
+		if !ok {
+			continue
+		}
+		for _, err := range c.Check() {
+			problems = append(problems, fmt.Errorf("%s driver: %v", typ, err))
+		}
+	}
+	return problems
+}
+
 func (r Registry) GetOBM(info []byte) (OBM, error) {
 	obmInfo := obmInfo{
 		Info: &driverInfo{},
@@ -48,3 +74,26 @@ func (r Registry) GetOBM(info []byte) (OBM, error) {
 	}
 	return typ.GetOBM([]byte(*obmInfo.Info))
 }
+
+// Check that info has only "type", "info" and "model" fields, and that the
+// type is in the registry, then check the driver info with that type's
+// driver, if it is an InfoValidator.
+func (r Registry) ValidateInfo(info []byte) error {
+	if err := CheckFields(info, &obmInfo{}, "type", "info"); err != nil {
+		return err
+	}
+	obmInfo := obmInfo{
+		Info: &driverInfo{},
+	}
+	if err := json.Unmarshal(info, &obmInfo); err != nil {
+		return &InvalidInfoError{Problems: []string{err.Error()}}
+	}
+	typ, ok := r[obmInfo.Type]
+	if !ok {
+		return ErrUnknownType
+	}
+	if v, ok := typ.(InfoValidator); ok {
+		return v.ValidateInfo([]byte(*obmInfo.Info))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// A policy for retrying idempotent OBM operations which fail with a
+// TransientError.
+type RetryPolicy struct {
+	// The total number of attempts to make, including the first. Values
+	// less than 1 are treated as 1 (i.e. no retries).
+	Attempts int
+
+	// How long to wait before the first retry. The delay doubles after
+	// each subsequent attempt, up to MaxBackoff (if non-zero).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Wrap a Driver such that the OBMs it returns retry idempotent operations
+// (PowerOff, SoftPowerOff, SetBootdev, PowerStatus, Bootdev, LANConfig,
+// Users, FirmwareVersions, Model, EventLog, and those of PowerMeter,
+// PowerRestorer and Watchdog) according to the policy returned by
+// `policy`, which is called at the start of each operation, so that the
+// policy may be changed at runtime.
+// PowerCycle is not retried, since a failure partway through could
+// otherwise result in the node being rebooted twice.
+func WithRetries(d Driver, policy func() RetryPolicy) Driver {
+	return retryDriver{d, policy}
+}
+
+type retryDriver struct {
+	Driver
+	policy func() RetryPolicy
+}
+
+func (d retryDriver) GetOBM(info []byte) (OBM, error) {
+	obm, err := d.Driver.GetOBM(info)
+	if err != nil {
+		return nil, err
+	}
+	return Wrapped{OBM: obm, Hook: retryHook(d.policy)}, nil
+}
+
+func (d retryDriver) ValidateInfo(info []byte) error {
+	if v, ok := d.Driver.(InfoValidator); ok {
+		return v.ValidateInfo(info)
+	}
+	return nil
+}
+
+// The operations (as named for Hook) which are idempotent, so are retried.
+// Others aren't: e.g. after ChangePassword fails we can't tell which
+// password is in effect, and UpdateFirmware's image has been consumed.
+var retriedOps = map[string]bool{
+	"power_off":                true,
+	"soft_power_off":           true,
+	"set_bootdev":              true,
+	"power_status":             true,
+	"bootdev":                  true,
+	"lan_config":               true,
+	"bmc_users":                true,
+	"firmware_versions":        true,
+	"model":                    true,
+	"event_log":                true,
+	"power_reading":            true,
+	"set_power_limit":          true,
+	"power_restore_policy":     true,
+	"set_power_restore_policy": true,
+	"watchdog_status":          true,
+	"arm_watchdog":             true,
+	"reset_watchdog":           true,
+	"stop_watchdog":            true,
+}
+
+// Return a Hook which retries the operations in retriedOps according to
+// the policy returned by `policy`.
+func retryHook(policy func() RetryPolicy) Hook {
+	return func(ctx context.Context, op string, call func() error) error {
+		if !retriedOps[op] {
+			return call()
+		}
+		return policy().do(ctx, call)
+	}
+}
+
+// Call op until it succeeds, returns an error which is not transient, or
+// we run out of attempts. Returns the last error from op, or ctx.Err() if
+// ctx is done while waiting to retry.
+func (p RetryPolicy) do(ctx context.Context, op func() error) error {
+	delay := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !IsTransient(err) || attempt >= p.Attempts {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		delay *= 2
+		if p.MaxBackoff != 0 && delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+	}
+}
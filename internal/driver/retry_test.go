@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// An OBM whose power operations fail with the errors in `errs`, in order,
+// and then succeed. Other methods are not implemented.
+type flakyOBM struct {
+	OBM
+	errs  []error
+	calls int
+}
+
+func (o *flakyOBM) next() error {
+	o.calls++
+	if len(o.errs) == 0 {
+		return nil
+	}
+	err := o.errs[0]
+	o.errs = o.errs[1:]
+	return err
+}
+
+func (o *flakyOBM) PowerOff(ctx context.Context) error {
+	return o.next()
+}
+
+func (o *flakyOBM) PowerCycle(ctx context.Context, force bool) error {
+	return o.next()
+}
+
+type flakyDriver struct {
+	obm *flakyOBM
+}
+
+func (d flakyDriver) GetOBM(info []byte) (OBM, error) {
+	return d.obm, nil
+}
+
+func TestRetries(t *testing.T) {
+	transient := TransientError{errors.New("timed out")}
+	permanent := errors.New("permission denied")
+
+	cases := []struct {
+		context string
+		errs    []error
+		cycle   bool
+		calls   int
+		err     error
+	}{
+		{"success", nil, false, 1, nil},
+		{"transient then success", []error{transient, transient}, false, 3, nil},
+		{"out of attempts", []error{transient, transient, transient, transient}, false, 3, transient},
+		{"permanent error", []error{transient, permanent}, false, 2, permanent},
+		{"power cycle is not retried", []error{transient}, true, 1, transient},
+	}
+
+	for _, v := range cases {
+		obm := &flakyOBM{errs: v.errs}
+		d := WithRetries(flakyDriver{obm}, func() RetryPolicy {
+			return RetryPolicy{Attempts: 3}
+		})
+		wrapped, err := d.GetOBM(nil)
+		if err != nil {
+			t.Fatalf("%s: GetOBM: %v", v.context, err)
+		}
+		if v.cycle {
+			err = wrapped.PowerCycle(context.Background(), false)
+		} else {
+			err = wrapped.PowerOff(context.Background())
+		}
+		if err != v.err {
+			t.Errorf("%s: expected error %v but got %v", v.context, v.err, err)
+		}
+		if obm.calls != v.calls {
+			t.Errorf("%s: expected %d calls but got %d", v.context, v.calls, obm.calls)
+		}
+	}
+}
+
+// Wrapped should run each operation through its hook, naming it, and
+// return ErrNotSupported for optional interfaces the wrapped OBM doesn't
+// implement without running the hook.
+func TestWrapped(t *testing.T) {
+	obm := &flakyOBM{}
+	var ops []string
+	wrapped := Wrapped{OBM: obm, Hook: func(ctx context.Context, op string, call func() error) error {
+		ops = append(ops, op)
+		return call()
+	}}
+	ctx := context.Background()
+	if err := wrapped.PowerOff(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapped.PowerCycle(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrapped.Users(ctx); err != ErrNotSupported {
+		t.Fatalf("Expected ErrNotSupported for an unimplemented interface, but got %v.", err)
+	}
+	if len(ops) != 2 || ops[0] != "power_off" || ops[1] != "power_cycle" || obm.calls != 2 {
+		t.Fatalf("Unexpected operations %q (%d calls).", ops, obm.calls)
+	}
+}
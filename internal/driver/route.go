@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// A route for drivers' connections to OBMs, for hosts on several networks;
+// see SetRoutes.
+type Route struct {
+	// The OBM addresses the route applies to.
+	Network *net.IPNet
+
+	// If set, the local address to connect from.
+	Source net.IP
+
+	// If set, the proxy to make TCP connections through: a "socks5" or
+	// "http" URL, optionally with a user name and password.
+	Proxy *url.URL
+}
+
+// The routes set by SetRoutes, and the number of times they have been set.
+// Accessed atomically.
+var (
+	routes    atomic.Value // []Route
+	routesGen uint64
+)
+
+// Set the routes for drivers' connections to OBMs. The first route whose
+// network contains an OBM's address applies to it; connections to other
+// addresses are made as usual. This applies to all drivers, and may be
+// changed at any time, though existing connections are left as they are.
+//
+// Drivers which make their own connections should use DialContext, or
+// RouteTo if they can't.
+func SetRoutes(r []Route) {
+	routes.Store(append([]Route(nil), r...))
+	atomic.AddUint64(&routesGen, 1)
+}
+
+// Return a number which changes whenever SetRoutes is called, so that
+// drivers which cache the results of RouteTo can tell when to look again.
+func RoutesGeneration() uint64 {
+	return atomic.LoadUint64(&routesGen)
+}
+
+// Return the route for connections to host (an IP address or hostname), or
+// nil if none applies. Hostnames are looked up, and the first of their
+// addresses with a route is used.
+func RouteTo(ctx context.Context, host string) (*Route, error) {
+	rs, _ := routes.Load().([]Route)
+	if len(rs) == 0 {
+		return nil, nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		for i := range rs {
+			if rs[i].Network.Contains(ip) {
+				return &rs[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Connect to addr, like net.Dialer.DialContext, following the route for
+// it, if any (see SetRoutes). Proxies are only used for TCP connections.
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	route, err := RouteTo(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	if route == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	tcp := strings.HasPrefix(network, "tcp")
+	if route.Source != nil {
+		if tcp {
+			d.LocalAddr = &net.TCPAddr{IP: route.Source}
+		} else if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: route.Source}
+		}
+	}
+	if route.Proxy != nil && tcp {
+		return dialProxy(ctx, &d, route.Proxy, addr)
+	}
+	return d.DialContext(ctx, network, addr)
+}
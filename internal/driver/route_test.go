@@ -0,0 +1,144 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// Listen on the loopback interface, echoing a line back on each connection,
+// and return the address.
+func echoServer(t *testing.T) (addr string, remotes <-chan net.Addr) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan net.Addr, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ch <- conn.RemoteAddr()
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				io.WriteString(conn, line)
+			}()
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+// Check that a connection from DialContext to addr reaches the echo server.
+func checkEcho(t *testing.T, addr string) {
+	conn, err := DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal("Dialing:", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hello\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("Unexpected echo %q (err = %v).", line, err)
+	}
+}
+
+func mustRoute(network, source, proxy string) Route {
+	_, n, _ := net.ParseCIDR(network)
+	r := Route{Network: n, Source: net.ParseIP(source)}
+	if proxy != "" {
+		r.Proxy, _ = url.Parse(proxy)
+	}
+	return r
+}
+
+// The first matching route should be used, and connections should come
+// from its source address.
+func TestRoutes(t *testing.T) {
+	defer SetRoutes(nil)
+	SetRoutes([]Route{
+		mustRoute("10.20.0.0/16", "10.20.0.5", ""),
+		mustRoute("127.0.0.0/8", "127.0.0.2", ""),
+		mustRoute("127.0.0.0/8", "127.0.0.3", ""),
+	})
+	route, err := RouteTo(context.Background(), "127.0.0.1")
+	if err != nil || route == nil || !route.Source.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("Unexpected route: %+v (err = %v)", route, err)
+	}
+	if route, _ = RouteTo(context.Background(), "192.0.2.1"); route != nil {
+		t.Fatalf("Unexpected route for an address in no network: %+v", route)
+	}
+
+	addr, remotes := echoServer(t)
+	checkEcho(t, addr)
+	if remote := (<-remotes).(*net.TCPAddr); !remote.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatal("Connection came from the wrong address:", remote)
+	}
+}
+
+// Connections should go through http and SOCKS5 proxies.
+func TestProxies(t *testing.T) {
+	defer SetRoutes(nil)
+	addr, _ := echoServer(t)
+
+	// An http proxy which handles CONNECT:
+	httpProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpProxy.Close()
+	go http.Serve(httpProxy, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	SetRoutes([]Route{mustRoute("127.0.0.0/8", "", "http://user:pass@"+httpProxy.Addr().String())})
+	checkEcho(t, addr)
+
+	// A SOCKS5 proxy which accepts no authentication, and IPv4 addresses:
+	socksProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksProxy.Close()
+	go func() {
+		conn, err := socksProxy.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{0x05, 0x00})
+		req := make([]byte, 10)
+		io.ReadFull(conn, req)
+		target := &net.TCPAddr{IP: net.IP(req[4:8]), Port: int(req[8])<<8 | int(req[9])}
+		upstream, err := net.DialTCP("tcp", nil, target)
+		if err != nil {
+			conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}()
+	SetRoutes([]Route{mustRoute("127.0.0.0/8", "", "socks5://"+socksProxy.Addr().String())})
+	checkEcho(t, addr)
+}
@@ -0,0 +1,561 @@
+// Package shard implements a driver which proxies operations to another
+// obmd instance (a "worker"), which manages the node's actual OBM.
+//
+// This allows a front obmd instance to serve nodes whose BMCs it cannot
+// reach directly, e.g. because they are on isolated per-rack networks. The
+// info for a node looks like:
+//
+//	{"shard": "rack1", "label": "node-17"}
+//
+// where "shard" names the worker (see Lookup) and "label" is the label of
+// the node on the worker, where it must be registered separately.
+package shard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Indicates that a node's info names a shard which is not configured.
+var ErrUnknownShard = errors.New("Unknown shard")
+
+// Time allowed for requests which are not bounded by a caller's context.
+const dropTimeout = 10 * time.Second
+
+// Connection info for a worker.
+type Worker struct {
+	// Base URL of the worker's api, e.g. "https://rack1-obmd:8080".
+	URL string
+
+	// The worker's admin token, as it appears in its config.
+	AdminToken string
+}
+
+// Returns the Worker for the named shard, and whether it exists.
+type Lookup func(name string) (Worker, bool)
+
+type shardDriver struct {
+	lookup Lookup
+	client *http.Client
+}
+
+// Return a driver which uses lookup to find the workers for shards. The
+// lookup is done on every request, so the set of workers may change while
+// nodes are in use.
+func NewDriver(lookup Lookup) driver.Driver {
+	return &shardDriver{
+		lookup: lookup,
+		client: &http.Client{Transport: newTransport()},
+	}
+}
+
+// Return a transport with http.DefaultTransport's settings (proxy, idle
+// connections and timeouts), which connects via driver.DialContext so
+// that routes apply. The fields are copied, since a Transport itself
+// can't be.
+func newTransport() *http.Transport {
+	def := http.DefaultTransport.(*http.Transport)
+	return &http.Transport{
+		Proxy:                 def.Proxy,
+		DialContext:           driver.DialContext,
+		MaxIdleConns:          def.MaxIdleConns,
+		IdleConnTimeout:       def.IdleConnTimeout,
+		TLSHandshakeTimeout:   def.TLSHandshakeTimeout,
+		ExpectContinueTimeout: def.ExpectContinueTimeout,
+	}
+}
+
+type shardInfo struct {
+	Shard string `json:"shard"`
+	Label string `json:"label"`
+}
+
+type obm struct {
+	driver *shardDriver
+	info   shardInfo
+
+	// Protects token, which is the token for the node on the worker, or ""
+	// if we don't currently have one.
+	lock  sync.Mutex
+	token string
+}
+
+func (d *shardDriver) GetOBM(info []byte) (driver.OBM, error) {
+	ret := &obm{driver: d}
+	err := json.Unmarshal(info, &ret.info)
+	if err != nil {
+		return nil, err
+	}
+	if ret.info.Shard == "" || ret.info.Label == "" {
+		return nil, errors.New(`"shard" and "label" are required.`)
+	}
+	return ret, nil
+}
+
+// Check info strictly: unlike GetOBM, this rejects unknown fields.
+func (d *shardDriver) ValidateInfo(info []byte) error {
+	return driver.CheckFields(info, &shardInfo{}, "shard", "label")
+}
+
+// An unexpected response from a worker.
+type workerError struct {
+	status int
+	op     string
+}
+
+func (e workerError) Error() string {
+	return fmt.Sprintf("worker returned %d (%s) for %s",
+		e.status, http.StatusText(e.status), e.op)
+}
+
+// Convert a non-success response status from the worker into an error.
+func statusError(status int, op string) error {
+	switch status {
+	case http.StatusBadRequest:
+		if op == "boot_device" {
+			return driver.ErrInvalidBootdev
+		}
+		if op == "bmc_password" {
+			return driver.ErrInvalidPassword
+		}
+		if op == "power_policy" {
+			return driver.ErrInvalidPowerRestorePolicy
+		}
+		if op == "watchdog" {
+			return driver.ErrInvalidWatchdogTimeout
+		}
+	case http.StatusConflict:
+		if op == "console/input" || op == "console/snapshot" {
+			return driver.ErrNoConsole
+		}
+		if op == "console" {
+			return driver.ErrConsoleInUse
+		}
+	case http.StatusNotImplemented:
+		return driver.ErrNotSupported
+	case http.StatusGatewayTimeout:
+		return context.DeadlineExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return driver.TransientError{Err: workerError{status, op}}
+	}
+	return workerError{status, op}
+}
+
+// Make a request to the worker for this node. `path` is relative to the
+// node's url on the worker, and may include a query string. `body` is sent
+// verbatim if it is a []byte, and otherwise encoded as JSON. If admin is
+// true, the request is authenticated as the admin, otherwise the node's
+// token is added to the query string.
+func (o *obm) do(ctx context.Context, method, path string, body interface{}, admin bool) (*http.Response, error) {
+	worker, ok := o.driver.lookup(o.info.Shard)
+	if !ok {
+		return nil, ErrUnknownShard
+	}
+	u := strings.TrimSuffix(worker.URL, "/") +
+		"/node/" + url.PathEscape(o.info.Label) + path
+	if !admin {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		u += sep + "token=" + url.QueryEscape(o.token)
+	}
+	var reqBody io.Reader
+	switch body := body.(type) {
+	case nil:
+	case []byte:
+		reqBody = bytes.NewBuffer(body)
+	default:
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewBuffer(buf)
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if admin {
+		req.SetBasicAuth("admin", worker.AdminToken)
+	}
+	resp, err := o.driver.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Most likely a network problem reaching the worker.
+		return nil, driver.TransientError{Err: err}
+	}
+	return resp, nil
+}
+
+// Make a request with the node's token, fetching a new token from the
+// worker first if we don't have one, or if the worker rejects ours (e.g.
+// because it has been restarted). Must be called with o.lock held. The
+// caller must close the response body.
+func (o *obm) doWithToken(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if o.token == "" {
+			if err := o.refreshToken(ctx); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := o.do(ctx, method, path, body, false)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		o.token = ""
+	}
+}
+
+// Get a new token for the node from the worker. Must be called with o.lock
+// held.
+func (o *obm) refreshToken(ctx context.Context) error {
+	resp, err := o.do(ctx, "POST", "/token", nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode, "token")
+	}
+	var tokenResp struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return err
+	}
+	o.token = tokenResp.Token
+	return nil
+}
+
+// Perform a non-streaming operation on the worker.
+func (o *obm) op(ctx context.Context, method, path string, body interface{}) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	resp, err := o.doWithToken(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode, strings.TrimPrefix(path, "/"))
+	}
+	return nil
+}
+
+// There is no persistent connection to manage; just wait to be stopped.
+func (o *obm) Serve(ctx context.Context) {
+	<-ctx.Done()
+}
+
+func (o *obm) DialConsole(ctx context.Context) (io.ReadCloser, error) {
+	return o.DialConsoleReplay(ctx, 0)
+}
+
+// The replay is done by the worker.
+func (o *obm) DialConsoleReplay(ctx context.Context, replay int) (io.ReadCloser, error) {
+	path := "/console"
+	if replay > 0 {
+		path += "?replay=" + strconv.Itoa(replay)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	// The context only governs establishing the connection, so the request
+	// itself must not use it. Instead, we cancel the request if ctx is
+	// done before we get the response headers.
+	reqCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	resp, err := o.doWithToken(reqCtx, "GET", path, nil)
+	if err != nil {
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, statusError(resp.StatusCode, "console")
+	}
+	return &consoleConn{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// The body of a console stream from a worker.
+type consoleConn struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *consoleConn) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Invalidate the node's token on the worker, which disconnects any console
+// streams using it.
+func (o *obm) DropConsole() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.token == "" {
+		return nil
+	}
+	o.token = ""
+	ctx, cancel := context.WithTimeout(context.Background(), dropTimeout)
+	defer cancel()
+	resp, err := o.do(ctx, "DELETE", "/token", nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode, "token")
+	}
+	return nil
+}
+
+func (o *obm) WriteConsole(ctx context.Context, p []byte) error {
+	return o.op(ctx, "POST", "/console/input", p)
+}
+
+func (o *obm) ConsoleSnapshot(ctx context.Context, n int) ([]byte, error) {
+	path := "/console/snapshot"
+	if n > 0 {
+		path += "?size=" + strconv.Itoa(n)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	resp, err := o.doWithToken(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, "console/snapshot")
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (o *obm) PowerOff(ctx context.Context) error {
+	return o.op(ctx, "POST", "/power_off", nil)
+}
+
+// Ask the worker for a soft power off, without a timeout: escalating
+// to a hard power off is left to the caller.
+func (o *obm) SoftPowerOff(ctx context.Context) error {
+	return o.op(ctx, "POST", "/shutdown", nil)
+}
+
+func (o *obm) PowerCycle(ctx context.Context, force bool) error {
+	return o.op(ctx, "POST", "/power_cycle", map[string]bool{"force": force})
+}
+
+func (o *obm) SetBootdev(ctx context.Context, dev string) error {
+	return o.op(ctx, "PUT", "/boot_device", map[string]string{"bootdev": dev})
+}
+
+func (o *obm) PowerStatus(ctx context.Context) (driver.PowerState, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	resp, err := o.doWithToken(ctx, "GET", "/power_status", nil)
+	if err != nil {
+		return driver.PowerStateUnknown, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return driver.PowerStateUnknown, statusError(resp.StatusCode, "power_status")
+	}
+	var powerResp struct {
+		Power driver.PowerState `json:"power"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&powerResp)
+	if err != nil {
+		return driver.PowerStateUnknown, err
+	}
+	return powerResp.Power, nil
+}
+
+func (o *obm) PowerReading(ctx context.Context) (reading driver.PowerReading, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	resp, err := o.doWithToken(ctx, "GET", "/power_reading", nil)
+	if err != nil {
+		return reading, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return reading, statusError(resp.StatusCode, "power_reading")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reading)
+	return reading, err
+}
+
+func (o *obm) SetPowerLimit(ctx context.Context, watts int) error {
+	return o.op(ctx, "PUT", "/power_limit", map[string]int{"watts": watts})
+}
+
+func (o *obm) WatchdogStatus(ctx context.Context) (status driver.WatchdogStatus, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	resp, err := o.doWithToken(ctx, "GET", "/watchdog", nil)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, statusError(resp.StatusCode, "watchdog")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+func (o *obm) ArmWatchdog(ctx context.Context, seconds int) error {
+	return o.op(ctx, "PUT", "/watchdog", map[string]int{"timeout": seconds})
+}
+
+func (o *obm) ResetWatchdog(ctx context.Context) error {
+	return o.op(ctx, "POST", "/watchdog/reset", nil)
+}
+
+func (o *obm) StopWatchdog(ctx context.Context) error {
+	return o.op(ctx, "DELETE", "/watchdog", nil)
+}
+
+// This is an admin call on the worker, so it doesn't need the token.
+func (o *obm) LANConfig(ctx context.Context) (config driver.LANConfig, err error) {
+	resp, err := o.do(ctx, "GET", "/lan", nil, true)
+	if err != nil {
+		return config, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return config, statusError(resp.StatusCode, "lan")
+	}
+	err = json.NewDecoder(resp.Body).Decode(&config)
+	return config, err
+}
+
+// As for LANConfig.
+func (o *obm) PowerRestorePolicy(ctx context.Context) (driver.PowerRestorePolicy, error) {
+	resp, err := o.do(ctx, "GET", "/power_policy", nil, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp.StatusCode, "power_policy")
+	}
+	var policyResp struct {
+		Policy driver.PowerRestorePolicy `json:"policy"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&policyResp)
+	return policyResp.Policy, err
+}
+
+func (o *obm) SetPowerRestorePolicy(ctx context.Context, policy driver.PowerRestorePolicy) error {
+	resp, err := o.do(ctx, "PUT", "/power_policy",
+		map[string]driver.PowerRestorePolicy{"policy": policy}, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode, "power_policy")
+	}
+	return nil
+}
+
+func (o *obm) Users(ctx context.Context) (users []driver.User, err error) {
+	resp, err := o.do(ctx, "GET", "/bmc_users", nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, "bmc_users")
+	}
+	var usersResp struct {
+		Users []driver.User `json:"users"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&usersResp)
+	return usersResp.Users, err
+}
+
+// The password is changed on the worker, which stores it; our own info
+// doesn't change.
+func (o *obm) ChangePassword(ctx context.Context, password string) ([]byte, error) {
+	resp, err := o.do(ctx, "POST", "/bmc_password",
+		map[string]string{"password": password}, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, "bmc_password")
+	}
+	return json.Marshal(o.info)
+}
+
+func (o *obm) Bootdevs(ctx context.Context) ([]string, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	resp, err := o.doWithToken(ctx, "GET", "/capabilities", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, "capabilities")
+	}
+	var capsResp struct {
+		BootDevices []string `json:"boot_devices"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&capsResp)
+	if err != nil {
+		return nil, err
+	}
+	if capsResp.BootDevices == nil {
+		return nil, driver.ErrNotSupported
+	}
+	return capsResp.BootDevices, nil
+}
+
+func (o *obm) Inspect() map[string]interface{} {
+	return map[string]interface{}{
+		"shard":        o.info.Shard,
+		"worker_label": o.info.Label,
+	}
+}
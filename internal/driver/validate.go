@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Check that info is a JSON object whose fields all correspond to fields
+// of the struct v points to (matching names as encoding/json does), and
+// that it has each of the fields `required`, which must not be null.
+// Returns an *InvalidInfoError listing the problems, if any; this is a
+// helper for implementing InfoValidator.
+func CheckFields(info []byte, v interface{}, required ...string) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(info, &fields); err != nil || fields == nil {
+		return &InvalidInfoError{Problems: []string{"Info must be a JSON object."}}
+	}
+	known := jsonFields(reflect.TypeOf(v).Elem())
+	var problems []string
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !hasField(known, name) {
+			problems = append(problems, fmt.Sprintf("Unknown field %q.", name))
+		}
+	}
+	for _, name := range required {
+		if value, ok := fields[name]; !ok || string(value) == "null" {
+			problems = append(problems, fmt.Sprintf("Missing required field %q.", name))
+		}
+	}
+	if problems != nil {
+		return &InvalidInfoError{Problems: problems}
+	}
+	return nil
+}
+
+// Return the names encoding/json uses for the exported fields of the
+// struct type t.
+func jsonFields(t reflect.Type) []string {
+	var ret []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		switch {
+		case tag == "-":
+			continue
+		case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+			ret = append(ret, jsonFields(f.Type)...)
+			continue
+		case f.PkgPath != "": // unexported
+			continue
+		case name == "":
+			name = f.Name
+		}
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+// Report whether name matches one of known, ignoring case, as
+// encoding/json does.
+func hasField(known []string, name string) bool {
+	for _, k := range known {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
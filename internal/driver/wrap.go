@@ -0,0 +1,317 @@
+package driver
+
+import (
+	"context"
+	"io"
+)
+
+// Runs one of the operations of an OBM wrapped by Wrapped: op names the
+// operation (e.g. "power_off", "bmc_users"), and call performs it on the
+// wrapped OBM. A hook may call it any number of times, or not at all, and
+// returns the operation's error.
+type Hook func(ctx context.Context, op string, call func() error) error
+
+// An OBM which forwards to another, including the optional interfaces,
+// running each operation through Hook (if not nil). Operations of optional
+// interfaces the wrapped OBM doesn't implement return ErrNotSupported
+// without running the hook. Serve, DropConsole, Unsupported and Inspect
+// aren't operations, so are just forwarded.
+//
+// Wrappers which need to alter an operation's results embed this, and
+// override the method for that operation.
+type Wrapped struct {
+	OBM
+	Hook Hook
+}
+
+func (o Wrapped) run(ctx context.Context, op string, call func() error) error {
+	if o.Hook == nil {
+		return call()
+	}
+	return o.Hook(ctx, op, call)
+}
+
+func (o Wrapped) DialConsole(ctx context.Context) (conn io.ReadCloser, err error) {
+	err = o.run(ctx, "dial_console", func() error {
+		conn, err = o.OBM.DialConsole(ctx)
+		return err
+	})
+	return conn, err
+}
+
+func (o Wrapped) PowerOff(ctx context.Context) error {
+	return o.run(ctx, "power_off", func() error {
+		return o.OBM.PowerOff(ctx)
+	})
+}
+
+func (o Wrapped) PowerCycle(ctx context.Context, force bool) error {
+	return o.run(ctx, "power_cycle", func() error {
+		return o.OBM.PowerCycle(ctx, force)
+	})
+}
+
+func (o Wrapped) SetBootdev(ctx context.Context, dev string) error {
+	return o.run(ctx, "set_bootdev", func() error {
+		return o.OBM.SetBootdev(ctx, dev)
+	})
+}
+
+func (o Wrapped) PowerStatus(ctx context.Context) (state PowerState, err error) {
+	err = o.run(ctx, "power_status", func() error {
+		state, err = o.OBM.PowerStatus(ctx)
+		return err
+	})
+	return state, err
+}
+
+func (o Wrapped) Unsupported() []Operation {
+	if l, ok := o.OBM.(Limited); ok {
+		return l.Unsupported()
+	}
+	return nil
+}
+
+func (o Wrapped) Inspect() map[string]interface{} {
+	if i, ok := o.OBM.(Inspector); ok {
+		return i.Inspect()
+	}
+	return nil
+}
+
+func (o Wrapped) WriteConsole(ctx context.Context, p []byte) error {
+	w, ok := o.OBM.(ConsoleWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return o.run(ctx, "write_console", func() error {
+		return w.WriteConsole(ctx, p)
+	})
+}
+
+// If the wrapped OBM isn't a ConsoleReplayer, this is just DialConsole.
+func (o Wrapped) DialConsoleReplay(ctx context.Context, replay int) (conn io.ReadCloser, err error) {
+	r, ok := o.OBM.(ConsoleReplayer)
+	if !ok {
+		return o.DialConsole(ctx)
+	}
+	err = o.run(ctx, "dial_console", func() error {
+		conn, err = r.DialConsoleReplay(ctx, replay)
+		return err
+	})
+	return conn, err
+}
+
+func (o Wrapped) ConsoleSnapshot(ctx context.Context, n int) (snapshot []byte, err error) {
+	s, ok := o.OBM.(ConsoleSnapshotter)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = o.run(ctx, "console_snapshot", func() error {
+		snapshot, err = s.ConsoleSnapshot(ctx, n)
+		return err
+	})
+	return snapshot, err
+}
+
+func (o Wrapped) PowerReading(ctx context.Context) (reading PowerReading, err error) {
+	m, ok := o.OBM.(PowerMeter)
+	if !ok {
+		return reading, ErrNotSupported
+	}
+	err = o.run(ctx, "power_reading", func() error {
+		reading, err = m.PowerReading(ctx)
+		return err
+	})
+	return reading, err
+}
+
+func (o Wrapped) SetPowerLimit(ctx context.Context, watts int) error {
+	m, ok := o.OBM.(PowerMeter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return o.run(ctx, "set_power_limit", func() error {
+		return m.SetPowerLimit(ctx, watts)
+	})
+}
+
+func (o Wrapped) LANConfig(ctx context.Context) (config LANConfig, err error) {
+	i, ok := o.OBM.(LANInspector)
+	if !ok {
+		return config, ErrNotSupported
+	}
+	err = o.run(ctx, "lan_config", func() error {
+		config, err = i.LANConfig(ctx)
+		return err
+	})
+	return config, err
+}
+
+func (o Wrapped) Users(ctx context.Context) (users []User, err error) {
+	m, ok := o.OBM.(UserManager)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = o.run(ctx, "bmc_users", func() error {
+		users, err = m.Users(ctx)
+		return err
+	})
+	return users, err
+}
+
+func (o Wrapped) ChangePassword(ctx context.Context, password string) (info []byte, err error) {
+	m, ok := o.OBM.(UserManager)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = o.run(ctx, "change_password", func() error {
+		info, err = m.ChangePassword(ctx, password)
+		return err
+	})
+	return info, err
+}
+
+func (o Wrapped) FirmwareVersions(ctx context.Context) (versions map[string]string, err error) {
+	i, ok := o.OBM.(FirmwareInspector)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = o.run(ctx, "firmware_versions", func() error {
+		versions, err = i.FirmwareVersions(ctx)
+		return err
+	})
+	return versions, err
+}
+
+func (o Wrapped) UpdateFirmware(ctx context.Context, component string, r io.Reader) error {
+	u, ok := o.OBM.(FirmwareUpdater)
+	if !ok {
+		return ErrNotSupported
+	}
+	return o.run(ctx, "update_firmware", func() error {
+		return u.UpdateFirmware(ctx, component, r)
+	})
+}
+
+func (o Wrapped) Model(ctx context.Context) (model string, err error) {
+	i, ok := o.OBM.(Identifier)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	err = o.run(ctx, "model", func() error {
+		model, err = i.Model(ctx)
+		return err
+	})
+	return model, err
+}
+
+func (o Wrapped) EventLog(ctx context.Context, after int) (entries []EventLogEntry, err error) {
+	r, ok := o.OBM.(EventLogReader)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = o.run(ctx, "event_log", func() error {
+		entries, err = r.EventLog(ctx, after)
+		return err
+	})
+	return entries, err
+}
+
+func (o Wrapped) SoftPowerOff(ctx context.Context) error {
+	p, ok := o.OBM.(SoftPowerer)
+	if !ok {
+		return ErrNotSupported
+	}
+	return o.run(ctx, "soft_power_off", func() error {
+		return p.SoftPowerOff(ctx)
+	})
+}
+
+func (o Wrapped) PowerRestorePolicy(ctx context.Context) (policy PowerRestorePolicy, err error) {
+	r, ok := o.OBM.(PowerRestorer)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	err = o.run(ctx, "power_restore_policy", func() error {
+		policy, err = r.PowerRestorePolicy(ctx)
+		return err
+	})
+	return policy, err
+}
+
+func (o Wrapped) SetPowerRestorePolicy(ctx context.Context, policy PowerRestorePolicy) error {
+	r, ok := o.OBM.(PowerRestorer)
+	if !ok {
+		return ErrNotSupported
+	}
+	return o.run(ctx, "set_power_restore_policy", func() error {
+		return r.SetPowerRestorePolicy(ctx, policy)
+	})
+}
+
+func (o Wrapped) WatchdogStatus(ctx context.Context) (status WatchdogStatus, err error) {
+	w, ok := o.OBM.(Watchdog)
+	if !ok {
+		return status, ErrNotSupported
+	}
+	err = o.run(ctx, "watchdog_status", func() error {
+		status, err = w.WatchdogStatus(ctx)
+		return err
+	})
+	return status, err
+}
+
+func (o Wrapped) ArmWatchdog(ctx context.Context, seconds int) error {
+	w, ok := o.OBM.(Watchdog)
+	if !ok {
+		return ErrNotSupported
+	}
+	return o.run(ctx, "arm_watchdog", func() error {
+		return w.ArmWatchdog(ctx, seconds)
+	})
+}
+
+func (o Wrapped) ResetWatchdog(ctx context.Context) error {
+	w, ok := o.OBM.(Watchdog)
+	if !ok {
+		return ErrNotSupported
+	}
+	return o.run(ctx, "reset_watchdog", func() error {
+		return w.ResetWatchdog(ctx)
+	})
+}
+
+func (o Wrapped) StopWatchdog(ctx context.Context) error {
+	w, ok := o.OBM.(Watchdog)
+	if !ok {
+		return ErrNotSupported
+	}
+	return o.run(ctx, "stop_watchdog", func() error {
+		return w.StopWatchdog(ctx)
+	})
+}
+
+func (o Wrapped) Bootdev(ctx context.Context) (dev string, err error) {
+	r, ok := o.OBM.(BootdevReporter)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	err = o.run(ctx, "bootdev", func() error {
+		dev, err = r.Bootdev(ctx)
+		return err
+	})
+	return dev, err
+}
+
+func (o Wrapped) Bootdevs(ctx context.Context) (devs []string, err error) {
+	l, ok := o.OBM.(BootdevLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = o.run(ctx, "bootdevs", func() error {
+		devs, err = l.Bootdevs(ctx)
+		return err
+	})
+	return devs, err
+}
@@ -0,0 +1,208 @@
+// Package events publishes obmd's events (changes to nodes, and power
+// operations on them) to a message broker, for event-driven automation.
+// MQTT (3.1.1) and NATS are supported. Only what is needed to publish is
+// implemented, which is little enough that we don't need their client
+// libraries.
+package events
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// An event, which is published as JSON.
+type Event struct {
+	Time   time.Time         `json:"time"`
+	Type   string            `json:"type"` // e.g. "power_off"
+	Node   string            `json:"node"`
+	Detail map[string]string `json:"detail,omitempty"`
+}
+
+// Where and how to publish events.
+type Config struct {
+	Type string // "mqtt" or "nats".
+	Addr string // the broker's host:port.
+
+	// Whether to connect with TLS. For NATS, the connection is upgraded
+	// after the server's greeting, as the protocol requires.
+	TLS bool
+
+	// Credentials, if the broker requires them.
+	User     string
+	Password string
+
+	// Events are published to the topic (MQTT) or subject (NATS)
+	// <Prefix>/<node>/<type> or <Prefix>.<node>.<type>, respectively.
+	// Defaults to "obmd".
+	Prefix string
+
+	// The MQTT client identifier. Defaults to "obmd-<hostname>".
+	ClientID string
+}
+
+// A connection to a broker.
+type conn interface {
+	publish(topic string, payload []byte) error
+	Close() error
+}
+
+const (
+	// How many events may be waiting to be published; more are dropped.
+	queueSize = 1024
+
+	// Limits on the time between attempts to connect to the broker.
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+
+	// How long to wait for the broker when connecting.
+	dialTimeout = 10 * time.Second
+)
+
+// Publishes events to a broker, in the background: events are queued, and
+// sent in order by Run, which (re)connects to the broker as needed.
+type Publisher struct {
+	cfg     Config
+	dial    func(ctx context.Context, cfg Config) (conn, error)
+	sep     string // separates the parts of topics.
+	queue   chan Event
+	dropped uint64 // accessed atomically.
+	log     *logger.Logger
+}
+
+// Create a Publisher for cfg. This doesn't connect to the broker; Run does
+// that.
+func NewPublisher(cfg Config) (*Publisher, error) {
+	p := &Publisher{
+		cfg:   cfg,
+		queue: make(chan Event, queueSize),
+		log:   logger.With("subsystem", "events", "broker", cfg.Addr),
+	}
+	switch cfg.Type {
+	case "mqtt":
+		p.dial, p.sep = dialMQTT, "/"
+	case "nats":
+		p.dial, p.sep = dialNATS, "."
+	default:
+		return nil, fmt.Errorf("Unknown event bus type %q.", cfg.Type)
+	}
+	if p.cfg.Prefix == "" {
+		p.cfg.Prefix = "obmd"
+	}
+	if p.cfg.ClientID == "" {
+		host, _ := os.Hostname()
+		p.cfg.ClientID = "obmd-" + host
+	}
+	return p, nil
+}
+
+// Queue ev for publishing, filling in its time if it is zero. This never
+// blocks; if the queue is full (e.g. because the broker is unreachable),
+// the event is dropped.
+func (p *Publisher) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	select {
+	case p.queue <- ev:
+	default:
+		// Log the first drop, then every time the count doubles, so as
+		// not to flood the log during an outage.
+		if n := atomic.AddUint64(&p.dropped, 1); n&(n-1) == 0 {
+			p.log.Warn("Event queue is full; dropping events", "dropped", n)
+		}
+	}
+}
+
+// The topic (or subject) to publish ev to.
+func (p *Publisher) topic(ev Event) string {
+	// Node labels are arbitrary, but mustn't add levels to the topic, or
+	// contain wildcards or spaces:
+	node := strings.Map(func(r rune) rune {
+		if r <= ' ' || strings.ContainsRune("/+#.*>", r) {
+			return '_'
+		}
+		return r
+	}, ev.Node)
+	return strings.Join([]string{p.cfg.Prefix, node, ev.Type}, p.sep)
+}
+
+// Publish queued events until ctx is done. An event which can't be sent
+// is retried, after reconnecting, until it is.
+func (p *Publisher) Run(ctx context.Context) {
+	var c conn
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	backoff := minBackoff
+	for {
+		var ev Event
+		select {
+		case <-ctx.Done():
+			return
+		case ev = <-p.queue:
+		}
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			p.log.Error("Can't encode event", "type", ev.Type, "err", err)
+			continue
+		}
+		for {
+			if c == nil {
+				c, err = p.dial(ctx, p.cfg)
+				if err != nil {
+					p.log.Warn("Can't connect to the event broker", "err", err)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(backoff):
+					}
+					if backoff *= 2; backoff > maxBackoff {
+						backoff = maxBackoff
+					}
+					continue
+				}
+				backoff = minBackoff
+			}
+			if err = c.publish(p.topic(ev), payload); err == nil {
+				break
+			}
+			p.log.Warn("Error publishing event; reconnecting", "err", err)
+			c.Close()
+			c = nil
+		}
+	}
+}
+
+// Connect to cfg.Addr, with TLS if useTLS is true.
+func dialBroker(ctx context.Context, cfg Config, useTLS bool) (net.Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	c, err := d.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil || !useTLS {
+		return c, err
+	}
+	return startTLS(c, cfg)
+}
+
+// Start TLS on c, closing it if that fails.
+func startTLS(c net.Conn, cfg Config) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(cfg.Addr)
+	tc := tls.Client(c, &tls.Config{ServerName: host})
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return tc, nil
+}
@@ -0,0 +1,167 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A message received by a fake broker.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// Listen on a local port, serving each connection with serve, which
+// sends the messages it receives on the returned channel.
+func fakeBroker(t *testing.T, serve func(c net.Conn, msgs chan<- message) error) (addr string, msgs <-chan message, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan message, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if err := serve(c, ch); err != nil && err != io.EOF {
+					t.Logf("Fake broker: %v", err)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), ch, func() { ln.Close() }
+}
+
+// Serve an MQTT client, checking its credentials.
+func serveMQTT(c net.Conn, msgs chan<- message) error {
+	r := bufio.NewReader(c)
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		n, mult := 0, 1
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			n += int(b&0x7f) * mult
+			mult *= 128
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		switch typ & 0xf0 {
+		case mqttConnect:
+			code := byte(0)
+			if !strings.HasSuffix(string(body), "\x00\x04user\x00\x06secret") {
+				code = 4 // bad user name or password
+			}
+			c.Write([]byte{mqttConnack, 2, 0, code})
+		case mqttPublish:
+			n := int(body[0])<<8 | int(body[1])
+			msgs <- message{string(body[2 : 2+n]), body[2+n:]}
+		}
+	}
+}
+
+// Serve a NATS client, checking its credentials.
+func serveNATS(c net.Conn, msgs chan<- message) error {
+	r := bufio.NewReader(c)
+	io.WriteString(c, "INFO {\"server_id\":\"test\",\"auth_required\":true}\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "CONNECT":
+			var opts struct{ User, Pass string }
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &opts)
+			if opts.User != "user" || opts.Pass != "secret" {
+				io.WriteString(c, "-ERR 'Authorization Violation'\r\n")
+				return nil
+			}
+			// Check that the client answers pings:
+			io.WriteString(c, "PING\r\n")
+		case "PING":
+			io.WriteString(c, "PONG\r\n")
+		case "PUB":
+			n, _ := strconv.Atoi(fields[2])
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			msgs <- message{fields[1], payload[:n]}
+		}
+	}
+}
+
+func testPublisher(t *testing.T, typ string, serve func(net.Conn, chan<- message) error, wantTopic string) {
+	addr, msgs, stop := fakeBroker(t, serve)
+	defer stop()
+
+	// With the wrong password, nothing is published:
+	p, err := NewPublisher(Config{Type: typ, Addr: addr, User: "user", Password: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go p.Run(ctx)
+	p.Publish(Event{Type: "power_off", Node: "node-1"})
+	select {
+	case msg := <-msgs:
+		t.Fatalf("Published with the wrong password: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+
+	p, err = NewPublisher(Config{Type: typ, Addr: addr, User: "user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+	p.Publish(Event{Type: "power_cycle", Node: "rack.1/node 2", Detail: map[string]string{"force": "true"}})
+	select {
+	case msg := <-msgs:
+		if msg.topic != wantTopic {
+			t.Fatalf("Published to %q; want %q", msg.topic, wantTopic)
+		}
+		var ev Event
+		if err := json.Unmarshal(msg.payload, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Node != "rack.1/node 2" || ev.Detail["force"] != "true" || ev.Time.IsZero() {
+			t.Fatalf("Unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event not published")
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	testPublisher(t, "mqtt", serveMQTT, "obmd/rack_1_node_2/power_cycle")
+}
+
+func TestNATS(t *testing.T) {
+	testPublisher(t, "nats", serveNATS, "obmd.rack_1_node_2.power_cycle")
+}
@@ -0,0 +1,150 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types, shifted into the fixed header's first
+// byte.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPingreq    = 12 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// The keep alive interval we ask for; we send a ping twice as often.
+const mqttKeepAlive = 60 * time.Second
+
+// An MQTT connection, publishing messages with QoS 0.
+type mqttConn struct {
+	sync.Mutex // serializes writes.
+	net.Conn
+	done chan struct{} // closed by Close.
+	once sync.Once
+}
+
+// Append an MQTT string (or binary data): its length, then its bytes.
+func appendMQTTString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+// Build a control packet, adding the fixed header (whose first byte is
+// typ) to body.
+func mqttPacket(typ byte, body []byte) []byte {
+	pkt := []byte{typ}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(pkt, body...)
+}
+
+func dialMQTT(ctx context.Context, cfg Config) (conn, error) {
+	c, err := dialBroker(ctx, cfg, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	body := appendMQTTString(nil, "MQTT")
+	flags := byte(0x02) // clean session
+	if cfg.User != "" {
+		flags |= 0x80
+		if cfg.Password != "" {
+			flags |= 0x40
+		}
+	}
+	keepAlive := int(mqttKeepAlive / time.Second)
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, cfg.ClientID)
+	if flags&0x80 != 0 {
+		body = appendMQTTString(body, cfg.User)
+	}
+	if flags&0x40 != 0 {
+		body = appendMQTTString(body, cfg.Password)
+	}
+
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	var ack [4]byte
+	_, err = c.Write(mqttPacket(mqttConnect, body))
+	if err == nil {
+		_, err = io.ReadFull(c, ack[:])
+	}
+	if err == nil && (ack[0] != mqttConnack || ack[1] != 2) {
+		err = errors.New("unexpected response to MQTT CONNECT")
+	}
+	if err == nil && ack[3] != 0 {
+		err = fmt.Errorf("MQTT broker refused the connection (return code %d)", ack[3])
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+
+	mc := &mqttConn{Conn: c, done: make(chan struct{})}
+	// We don't subscribe to anything, so all we receive are ping
+	// responses, which we ignore; reading just tells us when the
+	// connection is lost.
+	go func() {
+		io.Copy(ioutil.Discard, bufio.NewReader(c))
+		mc.Close()
+	}()
+	go mc.keepAlive()
+	return mc, nil
+}
+
+// Ping the broker periodically, so that it doesn't disconnect us while
+// there are no events.
+func (c *mqttConn) keepAlive() {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.write(mqttPacket(mqttPingreq, nil)) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *mqttConn) write(pkt []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	c.SetWriteDeadline(time.Now().Add(dialTimeout))
+	_, err := c.Conn.Write(pkt)
+	return err
+}
+
+func (c *mqttConn) publish(topic string, payload []byte) error {
+	body := appendMQTTString(nil, topic)
+	return c.write(mqttPacket(mqttPublish, append(body, payload...)))
+}
+
+func (c *mqttConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.write(mqttPacket(mqttDisconnect, nil))
+	})
+	return c.Conn.Close()
+}
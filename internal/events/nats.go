@@ -0,0 +1,131 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A NATS connection.
+type natsConn struct {
+	sync.Mutex // serializes writes.
+	net.Conn
+}
+
+func dialNATS(ctx context.Context, cfg Config) (conn, error) {
+	c, err := dialBroker(ctx, cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := natsHandshake(c, cfg)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+// Read the server's greeting, upgrade to TLS if configured, and log in.
+func natsHandshake(c net.Conn, cfg Config) (*natsConn, error) {
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	r := bufio.NewReader(c)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return nil, errors.New("unexpected NATS greeting")
+	}
+	if cfg.TLS {
+		if c, err = startTLS(c, cfg); err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(dialTimeout))
+		r = bufio.NewReader(c)
+	}
+	connectOpts := map[string]interface{}{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": cfg.TLS,
+		"name":         cfg.ClientID,
+		"lang":         "go",
+	}
+	if cfg.User != "" {
+		connectOpts["user"] = cfg.User
+		connectOpts["pass"] = cfg.Password
+	}
+	opts, err := json.Marshal(connectOpts)
+	if err != nil {
+		return nil, err
+	}
+	// The PING makes the server reply, with either a PONG, or an error
+	// if it rejected the CONNECT.
+	if _, err = fmt.Fprintf(c, "CONNECT %s\r\nPING\r\n", opts); err != nil {
+		return nil, err
+	}
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if line == "PING" {
+			if _, err = io.WriteString(c, "PONG\r\n"); err != nil {
+				return nil, err
+			}
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			return nil, fmt.Errorf("NATS server refused the connection: %s", line)
+		}
+	}
+	c.SetDeadline(time.Time{})
+
+	nc := &natsConn{Conn: c}
+	go nc.readLoop(r)
+	return nc, nil
+}
+
+// Answer the server's pings, which it uses to check that we're alive,
+// until the connection is closed.
+func (c *natsConn) readLoop(r *bufio.Reader) {
+	defer c.Close()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			if c.write([]byte("PONG\r\n")) != nil {
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			// The server closes the connection after reporting
+			// most errors; the next publish will reconnect.
+			return
+		}
+	}
+}
+
+func (c *natsConn) write(data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	c.SetWriteDeadline(time.Now().Add(dialTimeout))
+	_, err := c.Conn.Write(data)
+	return err
+}
+
+func (c *natsConn) publish(subject string, payload []byte) error {
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+	return c.write([]byte(msg))
+}
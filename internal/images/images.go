@@ -0,0 +1,112 @@
+// Package images implements stores of disk images (e.g. ISOs for virtual
+// media boots) which obmd serves over http, so that BMCs which can't reach
+// the images' real home can fetch them from obmd, and signed URLs which
+// grant temporary access to them.
+package images
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An image in a Store.
+type Image struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// A store of images.
+type Store interface {
+	// List the images, sorted by name.
+	List(ctx context.Context) ([]Image, error)
+
+	// Serve the image `name` (which must satisfy ValidName) in response
+	// to req, which is a GET or HEAD, including range requests. Responds
+	// with 404 if there is no such image.
+	Serve(w http.ResponseWriter, req *http.Request, name string)
+}
+
+// Report whether name may name an image: it must be a non-empty plain
+// file name, not starting with a dot.
+func ValidName(name string) bool {
+	return name != "" && name[0] != '.' && !strings.ContainsAny(name, `/\`)
+}
+
+// A Store backed by a local directory.
+type Dir string
+
+func (d Dir) List(ctx context.Context) ([]Image, error) {
+	infos, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	var ret []Image
+	for _, info := range infos {
+		if info.Mode().IsRegular() && ValidName(info.Name()) {
+			ret = append(ret, Image{
+				Name:     info.Name(),
+				Size:     info.Size(),
+				Modified: info.ModTime().UTC(),
+			})
+		}
+	}
+	return ret, nil
+}
+
+func (d Dir) Serve(w http.ResponseWriter, req *http.Request, name string) {
+	f, err := os.Open(filepath.Join(string(d), name))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, name, info.ModTime(), f)
+}
+
+// Return the query parameters of a URL which grants access to the image
+// `name` until `expires`, signed with key.
+func Sign(key []byte, name string, expires time.Time) url.Values {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		"expires": {exp},
+		"sig":     {signature(key, name, exp)},
+	}
+}
+
+// Report whether query holds a signature made by Sign with key, granting
+// access to the image `name`, which has not expired.
+func Verify(key []byte, name string, query url.Values, now time.Time) bool {
+	exp, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || now.Unix() > exp {
+		return false
+	}
+	sig, err := hex.DecodeString(query.Get("sig"))
+	if err != nil {
+		return false
+	}
+	want, _ := hex.DecodeString(signature(key, name, query.Get("expires")))
+	return hmac.Equal(sig, want)
+}
+
+func signature(key []byte, name, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,278 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Settings for an S3Store.
+type S3Config struct {
+	// The service's base URL, e.g. "https://s3.us-east-1.amazonaws.com",
+	// or that of anything compatible (e.g. MinIO or Ceph's RADOS gateway).
+	Endpoint string
+
+	// The bucket holding the images, and the region it is in (which
+	// defaults to "us-east-1").
+	Bucket string
+	Region string
+
+	// Only objects whose keys begin with Prefix are images; their names
+	// are the rest of the key.
+	Prefix string
+
+	// Credentials. If AccessKey is empty, requests are not signed, so the
+	// bucket must allow anonymous reads.
+	AccessKey string
+	SecretKey string
+}
+
+// A Store backed by a bucket in S3 (or a compatible service). Images are
+// fetched from the bucket as they are served, and are never modified.
+type S3Store struct {
+	config S3Config
+	client *http.Client
+}
+
+func NewS3Store(config S3Config) *S3Store {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &S3Store{config: config, client: http.DefaultClient}
+}
+
+// The headers of a client's request which are passed on to S3, and those
+// of S3's response which are passed back.
+var (
+	s3RequestHeaders  = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+	s3ResponseHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range", "ETag", "Last-Modified"}
+)
+
+// The SHA-256 hash of an empty request body.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3Store) List(ctx context.Context) ([]Image, error) {
+	var ret []Image
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, s.config.Prefix)
+			if ValidName(name) {
+				ret = append(ret, Image{Name: name, Size: obj.Size, Modified: obj.LastModified})
+			}
+		}
+		if !result.IsTruncated {
+			return ret, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Store) Serve(w http.ResponseWriter, req *http.Request, name string) {
+	header := make(http.Header)
+	for _, k := range s3RequestHeaders {
+		if v := req.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	resp, err := s.do(req.Context(), req.Method, s.config.Prefix+name, nil, header)
+	if err != nil {
+		if e, ok := err.(*S3Error); ok && e.Status == http.StatusNotFound {
+			http.NotFound(w, req)
+			return
+		}
+		// Conditional requests' failures are passed on as they are.
+		if e, ok := err.(*S3Error); ok && (e.Status == http.StatusNotModified ||
+			e.Status == http.StatusPreconditionFailed ||
+			e.Status == http.StatusRequestedRangeNotSatisfiable) {
+			w.WriteHeader(e.Status)
+			return
+		}
+		http.Error(w, "Error fetching the image from S3.", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, k := range s3ResponseHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// An error response from S3.
+type S3Error struct {
+	Status  int
+	Code    string // e.g. "NoSuchKey"
+	Message string
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Make a request for the object with the given key (or the bucket itself,
+// if key is empty), returning the response if it was successful.
+func (s *S3Store) do(ctx context.Context, method, key string, query url.Values, header http.Header) (*http.Response, error) {
+	u := s.config.Endpoint + "/" + escapePath(s.config.Bucket)
+	if key != "" {
+		u += "/" + escapePath(key)
+	}
+	if len(query) != 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.config.AccessKey != "" {
+		s.sign(req, time.Now())
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &S3Error{Status: resp.StatusCode}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		xml.Unmarshal(body, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// Sign req, with no body, using AWS Signature Version 4, as of now. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+func (s *S3Store) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyHash)
+
+	// Sign the host, the range (if any), and the x-amz- headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyHash,
+	}, "\n")
+	scope := day + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), day)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		s.config.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Escape s as AWS requires: everything but unreserved characters (and '/'
+// if path is true) is percent-encoded.
+func escape(s string, path bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || path && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func escapePath(s string) string {
+	return escape(s, true)
+}
+
+// Encode query as AWS requires: sorted by key, then value.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		vs := append([]string(nil), query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, escape(k, false)+"="+escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,318 @@
+// Package kube is a minimal client for the Kubernetes api, with just what
+// obmd's controller mode needs: listing and watching custom resources,
+// updating their status, and reading Secrets.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where a pod's service account credentials are mounted.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// How long to ask the api server to keep a watch open; it ends the watch
+// after this, and the caller starts another.
+const watchTimeout = 5 * time.Minute
+
+// Identifies a kind of (namespaced) resource, e.g. {"obmd.io", "v1alpha1",
+// "obmnodes"}.
+type Resource struct {
+	Group    string
+	Version  string
+	Resource string // the plural name, as in the resource's URL.
+}
+
+// Parse a resource in the form <plural>.<group>/<version>, e.g.
+// "obmnodes.obmd.io/v1alpha1".
+func ParseResource(s string) (Resource, error) {
+	slash := strings.LastIndex(s, "/")
+	dot := strings.Index(s, ".")
+	if slash < 0 || dot < 0 || dot > slash || dot == 0 || slash == len(s)-1 {
+		return Resource{}, fmt.Errorf("Invalid resource %q; expected <plural>.<group>/<version>.", s)
+	}
+	return Resource{Resource: s[:dot], Group: s[dot+1 : slash], Version: s[slash+1:]}, nil
+}
+
+// A custom resource. Only the parts obmd uses are decoded.
+type Object struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+		Generation      int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec json.RawMessage `json:"spec"`
+}
+
+// An event from a watch, e.g. {"ADDED", obj}. Type is "ADDED",
+// "MODIFIED", "DELETED" or "BOOKMARK".
+type Event struct {
+	Type   string
+	Object Object
+}
+
+// An error status returned by the api server.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kubernetes api: %d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// Report whether err says that a watch's resource version is too old, so
+// the caller must list the resources again.
+func IsGone(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.Code == http.StatusGone
+}
+
+// A client for the api server.
+type Client struct {
+	server    string // base URL, e.g. "https://10.0.0.1:443".
+	tokenFile string
+	http      *http.Client
+
+	// The last token read from tokenFile. The file is re-read before each
+	// request, since service account tokens are rotated.
+	mu    sync.Mutex
+	token string
+}
+
+// Create a client for the api server at server (a URL), authenticating
+// with the bearer token in tokenFile (if not empty), and verifying the
+// server's certificate against the CA certificates in caFile (if not
+// empty; otherwise the system's roots are used).
+func NewClient(server, tokenFile, caFile string) (*Client, error) {
+	c := &Client{
+		server:    strings.TrimSuffix(server, "/"),
+		tokenFile: tokenFile,
+		http:      &http.Client{},
+	}
+	if tokenFile != "" {
+		if _, err := c.bearerToken(); err != nil {
+			return nil, err
+		}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %q.", caFile)
+		}
+		c.http.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+	return c, nil
+}
+
+// Create a client using the credentials of the pod we are running in.
+func InClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in a Kubernetes cluster " +
+			"(KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are unset).")
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // an IPv6 address.
+	}
+	return NewClient("https://"+host+":"+port,
+		serviceAccountDir+"/token", serviceAccountDir+"/ca.crt")
+}
+
+// Return the namespace of the pod we are running in, or "" if that can't
+// be determined.
+func InClusterNamespace() string {
+	ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(ns))
+}
+
+// Re-read the token from c.tokenFile, returning it, or the last token read
+// if that fails.
+func (c *Client) bearerToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err == nil {
+		c.token = strings.TrimSpace(string(token))
+	}
+	return c.token, err
+}
+
+// The path of the collection of res in namespace ns.
+func collection(res Resource, ns string) string {
+	return "/apis/" + res.Group + "/" + res.Version +
+		"/namespaces/" + url.PathEscape(ns) + "/" + res.Resource
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, contentType string, body []byte) (*http.Response, error) {
+	u := c.server + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.tokenFile != "" {
+		// If the file can't be read now, the last token we read may
+		// still be valid, so use it anyway.
+		token, _ := c.bearerToken()
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, decodeStatus(resp.StatusCode, resp.Body)
+	}
+	return resp, nil
+}
+
+// Decode a Status object from r, returning it as a *StatusError with the
+// given code if it doesn't say otherwise.
+func decodeStatus(code int, r io.Reader) error {
+	var status struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	}
+	json.NewDecoder(io.LimitReader(r, 1<<16)).Decode(&status)
+	if status.Code != 0 {
+		code = status.Code
+	}
+	return &StatusError{Code: code, Message: status.Message}
+}
+
+// List the resources of kind res in namespace ns, also returning the
+// list's resource version, from which to start watching.
+func (c *Client) List(ctx context.Context, res Resource, ns string) ([]Object, string, error) {
+	resp, err := c.do(ctx, "GET", collection(res, ns), nil, "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []Object `json:"items"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	return list.Items, list.Metadata.ResourceVersion, nil
+}
+
+// Watch the resources of kind res in namespace ns for changes after
+// resourceVersion, calling fn for each, until ctx is done, fn returns an
+// error, or the api server ends the watch (which it does periodically).
+// Returns the resource version to continue watching from.
+//
+// If resourceVersion has expired, the error satisfies IsGone, and the
+// caller must list the resources again.
+func (c *Client) Watch(ctx context.Context, res Resource, ns, resourceVersion string, fn func(Event) error) (string, error) {
+	query := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(watchTimeout / time.Second))},
+	}
+	resp, err := c.do(ctx, "GET", collection(res, ns), query, "", nil)
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err = dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return resourceVersion, err
+		}
+		if ev.Type == "ERROR" {
+			return resourceVersion, decodeStatus(http.StatusInternalServerError,
+				bytes.NewReader(ev.Object))
+		}
+		var obj Object
+		if err = json.Unmarshal(ev.Object, &obj); err != nil {
+			return resourceVersion, err
+		}
+		resourceVersion = obj.Metadata.ResourceVersion
+		if err = fn(Event{Type: ev.Type, Object: obj}); err != nil {
+			return resourceVersion, err
+		}
+	}
+}
+
+// Replace fields of the status of the resource of kind res named name in
+// namespace ns with those of status, using a JSON merge patch. The
+// resource's definition must have the status subresource enabled.
+func (c *Client) PatchStatus(ctx context.Context, res Resource, ns, name string, status interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, "PATCH", collection(res, ns)+"/"+url.PathEscape(name)+"/status",
+		nil, "application/merge-patch+json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Return the data of the Secret named name in namespace ns, decoded.
+func (c *Client) GetSecret(ctx context.Context, ns, name string) (map[string][]byte, error) {
+	resp, err := c.do(ctx, "GET", "/api/v1/namespaces/"+url.PathEscape(ns)+
+		"/secrets/"+url.PathEscape(name), nil, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var secret struct {
+		Data map[string][]byte `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
@@ -0,0 +1,112 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestParseResource(t *testing.T) {
+	res, err := ParseResource("obmnodes.obmd.io/v1alpha1")
+	if err != nil || res != (Resource{"obmd.io", "v1alpha1", "obmnodes"}) {
+		t.Fatalf("ParseResource: got %+v, %v", res, err)
+	}
+	for _, s := range []string{"obmnodes", "obmnodes/v1", ".obmd.io/v1", "obmnodes.obmd.io/"} {
+		if _, err := ParseResource(s); err == nil {
+			t.Errorf("ParseResource accepted %q", s)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	const path = "/apis/obmd.io/v1alpha1/namespaces/ns/obmnodes"
+	var patch []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case req.URL.Path == path && req.URL.Query().Get("watch") == "":
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "10"}, "items": [
+				{"metadata": {"name": "node-1", "resourceVersion": "9"}, "spec": {"type": "ipmi"}}
+			]}`)
+		case req.URL.Path == path && req.URL.Query().Get("resourceVersion") == "10":
+			fmt.Fprint(w, `{"type": "DELETED", "object": {"metadata": {"name": "node-1", "resourceVersion": "11"}}}
+				{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "12"}}}`)
+		case req.URL.Path == path:
+			fmt.Fprint(w, `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "message": "too old"}}`)
+		case req.URL.Path == path+"/node-1/status" && req.Method == "PATCH" &&
+			req.Header.Get("Content-Type") == "application/merge-patch+json":
+			patch, _ = ioutil.ReadAll(req.Body)
+			fmt.Fprint(w, `{}`)
+		case req.URL.Path == "/api/v1/namespaces/ns/secrets/bmc":
+			fmt.Fprint(w, `{"kind": "Secret", "data": {"pass": "aXBtaXBhc3M="}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind": "Status", "code": 404, "message": "not found"}`)
+		}
+	}))
+	defer srv.Close()
+	tokenFile, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	defer tokenFile.Close()
+	fmt.Fprint(tokenFile, "secret\n")
+	c, err := NewClient(srv.URL, tokenFile.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := Resource{"obmd.io", "v1alpha1", "obmnodes"}
+	ctx := context.Background()
+
+	items, version, err := c.List(ctx, res, "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "10" || len(items) != 1 || items[0].Metadata.Name != "node-1" ||
+		string(items[0].Spec) != `{"type": "ipmi"}` {
+		t.Fatalf("List: unexpected result %q, %+v", version, items)
+	}
+
+	var events []string
+	version, err = c.Watch(ctx, res, "ns", version, func(ev Event) error {
+		events = append(events, ev.Type+" "+ev.Object.Metadata.Name)
+		return nil
+	})
+	if err != nil || version != "12" || len(events) != 2 || events[0] != "DELETED node-1" {
+		t.Fatalf("Watch: unexpected result %q, %v, %q", version, err, events)
+	}
+	_, err = c.Watch(ctx, res, "ns", version, func(Event) error { return nil })
+	if !IsGone(err) {
+		t.Fatalf("Watch with an expired version returned %v", err)
+	}
+
+	if err = c.PatchStatus(ctx, res, "ns", "node-1", map[string]bool{"reachable": true}); err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]map[string]bool
+	if json.Unmarshal(patch, &body) != nil || !body["status"]["reachable"] {
+		t.Fatalf("Unexpected patch: %s", patch)
+	}
+	err = c.PatchStatus(ctx, res, "ns", "node-2", nil)
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusNotFound || se.Message != "not found" {
+		t.Fatalf("Patching a missing resource returned %v", err)
+	}
+
+	data, err := c.GetSecret(ctx, "ns", "bmc")
+	if err != nil || len(data) != 1 || string(data["pass"]) != "ipmipass" {
+		t.Fatalf("GetSecret: unexpected result %q, %v", data, err)
+	}
+	_, err = c.GetSecret(ctx, "ns", "other")
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusNotFound {
+		t.Fatalf("Getting a missing secret returned %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+// Package logger implements simple structured, leveled logging.
+//
+// Each log entry consists of a level, a message, and a list of key/value
+// fields, and is written as a single line in either logfmt or JSON format.
+// Loggers may carry fields of their own (see With), which are included in
+// every entry they write; this is used to attach e.g. a subsystem name or
+// node label. Fields may also be carried by a context.Context (see
+// NewContext), so that everything logged on behalf of an operation, at
+// whatever depth, can be attributed to it (see WithContext).
+//
+// If an entry has more than one value for a key, the last one is written,
+// in the place of the first.
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// Parse a level name, as returned by Level.String. The empty string is
+// treated as "info".
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+	for i, v := range levelNames {
+		if strings.EqualFold(name, v) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %q.", name)
+}
+
+// The format in which log entries are written.
+type Format int
+
+const (
+	Logfmt Format = iota
+	JSON
+)
+
+// Parse a format name, "logfmt" or "json". The empty string is treated as
+// "logfmt".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "", "logfmt":
+		return Logfmt, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, fmt.Errorf("Unknown log format %q.", name)
+}
+
+// Shared destination & settings for a family of Loggers.
+type output struct {
+	sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+}
+
+// A Logger writes log entries. It is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// Create a logger writing to w, which discards entries below `level`.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out: &output{
+			w:      w,
+			level:  level,
+			format: format,
+		},
+	}
+}
+
+// The default logger, used by the package-level functions. It writes
+// to stderr.
+var std = New(os.Stderr, LevelInfo, Logfmt)
+
+// Return a Logger which adds the given key/value pairs to each entry. The
+// new Logger shares its output and settings with l.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// The key of the context value set by NewContext.
+type fieldsKey struct{}
+
+// Return a context carrying the given key/value pairs, as well as any
+// carried by ctx, for loggers from WithContext to add to their entries.
+func NewContext(ctx context.Context, kv ...interface{}) context.Context {
+	old, _ := ctx.Value(fieldsKey{}).([]interface{})
+	fields := make([]interface{}, 0, len(old)+len(kv))
+	fields = append(fields, old...)
+	fields = append(fields, kv...)
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+// Return a Logger which adds the key/value pairs carried by ctx (see
+// NewContext), if any, to each entry.
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	fields, _ := ctx.Value(fieldsKey{}).([]interface{})
+	if len(fields) == 0 {
+		return l
+	}
+	return l.With(fields...)
+}
+
+// Set the minimum level of entries that will be written. This affects all
+// Loggers sharing l's output.
+func (l *Logger) SetLevel(level Level) {
+	l.out.Lock()
+	defer l.out.Unlock()
+	l.out.level = level
+}
+
+// Set the output format. This affects all Loggers sharing l's output.
+func (l *Logger) SetFormat(format Format) {
+	l.out.Lock()
+	defer l.out.Unlock()
+	l.out.format = format
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Log at level Error, then exit the program with status 1.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	l.out.Lock()
+	defer l.out.Unlock()
+	if level < l.out.level {
+		return
+	}
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	fields = append(fields,
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg,
+	)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, errors.New("missing value"))
+	}
+	fields = dedupe(fields)
+
+	var buf bytes.Buffer
+	if l.out.format == JSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+	l.out.w.Write(buf.Bytes())
+}
+
+// Remove all but the first occurrence of each key from fields, giving it
+// the last occurrence's value.
+func dedupe(fields []interface{}) []interface{} {
+	ret := fields[:0:0]
+	keys := make([]string, 0, len(fields)/2)
+outer:
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		for j, k := range keys {
+			if k == key {
+				ret[2*j+1] = fields[i+1]
+				continue outer
+			}
+		}
+		keys = append(keys, key)
+		ret = append(ret, fields[i], fields[i+1])
+	}
+	return ret
+}
+
+// Convert a field value to something suitable for formatting.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i != 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprint(buf, fields[i])
+		buf.WriteByte('=')
+		val := fmt.Sprint(fieldValue(fields[i+1]))
+		if val == "" || strings.ContainsAny(val, " =\"\t\r\n") {
+			val = fmt.Sprintf("%q", val)
+		}
+		buf.WriteString(val)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		val, err := json.Marshal(fieldValue(fields[i+1]))
+		if err != nil {
+			val, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+}
+
+// Package-level equivalents of the Logger methods, which use the default
+// logger.
+
+func With(kv ...interface{}) *Logger          { return std.With(kv...) }
+func FromContext(ctx context.Context) *Logger { return std.WithContext(ctx) }
+func SetLevel(level Level)                    { std.SetLevel(level) }
+func SetFormat(format Format)                 { std.SetFormat(format) }
+func Debug(msg string, kv ...interface{})     { std.log(LevelDebug, msg, kv) }
+func Info(msg string, kv ...interface{})      { std.log(LevelInfo, msg, kv) }
+func Warn(msg string, kv ...interface{})      { std.log(LevelWarn, msg, kv) }
+func Error(msg string, kv ...interface{})     { std.log(LevelError, msg, kv) }
+func Fatal(msg string, kv ...interface{})     { std.Fatal(msg, kv...) }
@@ -0,0 +1,70 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Strip the time field, which is the first one in every entry, so we can
+// compare the rest of the output exactly.
+func stripTime(line string) string {
+	if i := strings.IndexAny(line, " ,"); i != -1 && strings.Contains(line[:i], "time") {
+		return line[i+1:]
+	}
+	return line
+}
+
+func TestFormats(t *testing.T) {
+	cases := []struct {
+		format   Format
+		expected string
+	}{
+		{Logfmt, `level=info msg="Powering off" node=node-1 err="no route" count=2` + "\n"},
+		{JSON, `"level":"info","msg":"Powering off","node":"node-1","err":"no route","count":2}` + "\n"},
+	}
+	for _, v := range cases {
+		var buf bytes.Buffer
+		l := New(&buf, LevelInfo, v.format).With("node", "node-1")
+		l.Info("Powering off", "err", errors.New("no route"), "count", 2)
+		actual := stripTime(buf.String())
+		if actual != v.expected {
+			t.Errorf("Format %d: expected %q but got %q", v.format, v.expected, actual)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelWarn, Logfmt)
+	l.Debug("debug")
+	l.Info("info")
+	if buf.Len() != 0 {
+		t.Fatalf("Entries below the minimum level were written: %q", buf.String())
+	}
+	l.Warn("warn")
+	l.With("sub", "x").SetLevel(LevelError)
+	l.Warn("warn again")
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("Expected exactly one entry, but got %d: %q", n, buf.String())
+	}
+}
+
+// Fields carried by a context should be added to entries, with later
+// values for a key replacing earlier ones.
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelInfo, Logfmt).With("subsystem", "http")
+	ctx := NewContext(context.Background(), "request_id", "abc", "node", "node-1")
+	ctx = NewContext(ctx, "driver", "ipmi")
+	l.WithContext(ctx).Warn("Retrying", "node", "node-2")
+	expected := `level=warn msg=Retrying subsystem=http request_id=abc node=node-2 driver=ipmi` + "\n"
+	if actual := stripTime(buf.String()); actual != expected {
+		t.Fatalf("Expected %q but got %q", expected, actual)
+	}
+	if l.WithContext(context.Background()) != l {
+		t.Fatal("A context without fields should leave the logger alone.")
+	}
+}
@@ -0,0 +1,68 @@
+package obmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrNoSuchConsole = errors.New("No such console session.")
+
+// Information about a client's console session, as reported by the api.
+type ConsoleSession struct {
+	ID        string    `json:"id"`
+	Node      string    `json:"node"`
+	Connected time.Time `json:"connected"`
+	Remote    string    `json:"remote"`
+	Bytes     uint64    `json:"bytes"`
+}
+
+// Console statistics for a node, as reported by the api.
+type ConsoleStats struct {
+	// Total console output sent to clients.
+	BytesStreamed uint64 `json:"bytes_streamed"`
+
+	// Number of successful console connections.
+	Sessions uint64 `json:"sessions"`
+
+	// Number of failed attempts to connect to the console (not counting
+	// those refused for an invalid token).
+	DialFailures uint64 `json:"dial_failures"`
+
+	// Number of connections currently open.
+	Active int `json:"active"`
+}
+
+// A record of a console session, for answering "who was on this node's
+// console, and when?"
+type ConsoleAuditRecord struct {
+	// The session's ID, as reported by Daemon.ConsoleSessions while it
+	// was open. These are reused after restarts.
+	Session string `json:"session"`
+
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"` // nil if it hasn't.
+
+	// The SHA-256 of the token the client used, as given to clients (in
+	// hex); empty if the session was opened by obmd itself (e.g. to
+	// forward output to syslog).
+	TokenHash string `json:"token_hash,omitempty"`
+
+	Remote string `json:"remote"`
+
+	// Console output sent to the client. This is only known once the
+	// session has ended.
+	Bytes uint64 `json:"bytes"`
+
+	// Why the session ended, as in the Console-End-Reason trailer; empty
+	// if the client closed it, or it hasn't ended.
+	EndReason string `json:"end_reason,omitempty"`
+}
+
+// Return the hash of token recorded in the console audit.
+func AuditTokenHash(token Token) string {
+	text, _ := token.MarshalText()
+	sum := sha256.Sum256(text)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,195 @@
+// Package obmd declares the Daemon interface, through which obmd's
+// frontends (the http api, Redfish, ssh and virtual BMCs) operate on
+// nodes, along with the types and errors its methods use, so that the
+// frontends need not depend on the daemon itself.
+package obmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+var (
+	ErrNodeExists   = errors.New("Node already exists.")
+	ErrNoSuchNode   = errors.New("No such node.")
+	ErrInvalidToken = errors.New("Invalid token.")
+
+	ErrNodeQuarantined   = errors.New("Node is quarantined.")
+	ErrNodeInMaintenance = errors.New("Node is in maintenance mode.")
+	ErrNodeDraining      = errors.New("Node is being drained.")
+	ErrShuttingDown      = errors.New("The daemon is shutting down.")
+	ErrVersionMismatch   = errors.New("Node's info has changed.")
+
+	ErrInvalidShutdownTimeout  = errors.New("Invalid shutdown timeout.")
+	ErrWatchdogTimeoutTooShort = errors.New("Watchdog timeout is shorter than the power cycle interval.")
+
+	ErrNoPendingPassword = errors.New("Node has no pending password.")
+	ErrPasswordPending   = errors.New("Node has a different pending password.")
+)
+
+// Returned by Daemon.Backup if it doesn't know how to back up the given
+// type of database.
+var ErrBackupUnsupported = errors.New("Backups are not supported for this database type.")
+
+// Returned when a user tries to power cycle a node too soon after it was
+// last power cycled.
+type PowerCycleRateError struct {
+	RetryAfter time.Duration // how long until the node may be power cycled.
+}
+
+func (e PowerCycleRateError) Error() string {
+	return fmt.Sprintf("Node was power cycled too recently; retry in %v.", e.RetryAfter)
+}
+
+// Returned when registering or renaming a node with a label that the label
+// policy doesn't allow.
+type InvalidLabelError struct {
+	Label  string
+	Reason string
+}
+
+func (e InvalidLabelError) Error() string {
+	return fmt.Sprintf("Invalid node label %q: %s.", e.Label, e.Reason)
+}
+
+// The power actions which may be applied to many nodes by
+// Daemon.PowerNodes.
+const (
+	PowerActionOn    = "on"
+	PowerActionOff   = "off"
+	PowerActionCycle = "cycle"
+)
+
+// What a node's OBM can do, as reported by Daemon.NodeCapabilities.
+type Capabilities struct {
+	// The values accepted by the boot device call, or nil if the driver
+	// doesn't say.
+	BootDevices []string `json:"boot_devices"`
+
+	// The operations the OBM declares it doesn't support; see
+	// driver.Limited.
+	Unsupported []driver.Operation `json:"unsupported"`
+}
+
+// The operations underlying the api, which frontends (the http api,
+// Redfish, ssh and virtual BMCs) use, so that they can share a backend
+// without depending on how it works. The daemon's LocalDaemon is the
+// implementation. Unless noted, methods taking a token check it, and a nil
+// token means the admin is acting.
+type Daemon interface {
+	// Nodes
+	SetNode(label string, info []byte) error
+	DeleteNode(label string) error
+	RenameNode(label, newLabel string) error
+	NodeLabels() []string
+	QuarantinedNodes() map[string]string
+	NodeVersion(label string) (string, error)
+	NodeSnapshots() map[string]NodeSnapshot
+	NodeHealth() map[string]NodeHealth
+	NodePowerHistory(label string, period time.Duration) (PowerHistory, error)
+	PrometheusTargets() []PrometheusTargetGroup
+	SetNodeMaintenance(label string, on bool, reason string) error
+	NodeMaintenance(label string) (on bool, reason string, err error)
+	SetNodeDraining(label string, on bool, reason string) error
+	NodeDraining(label string) (on bool, reason string, err error)
+	TransferNode(ctx context.Context, label, project string) error
+	NodeOwner(label string) (project string, transfers []NodeTransfer, err error)
+	Backup(dbType, dbPath string, w io.Writer) error
+
+	// Tokens
+	GetNodeToken(ctx context.Context, label string) (Token, error)
+	InvalidateNodeToken(label string) error
+	CheckNodeToken(label string, token Token) error
+	NodeTokenUsage(label string) (TokenUsage, error)
+	TokenUsage() map[string]TokenUsage
+
+	// Consoles
+	DialNodeConsole(ctx context.Context, label string, replay int, remote string, token *Token) (io.ReadCloser, error)
+	WriteNodeConsole(ctx context.Context, label string, p []byte, token *Token) error
+	NodeConsoleSnapshot(ctx context.Context, label string, n int, token *Token) ([]byte, error)
+	NodeConsoleStats(ctx context.Context, label string, token *Token) (ConsoleStats, error)
+	NodeConsoleAudit(label string, from, to time.Time) ([]ConsoleAuditRecord, error)
+	ConsoleSessions() []ConsoleSession
+	DisconnectConsole(id string) error
+
+	// Power, boot devices and watchdogs
+	PowerOnNode(ctx context.Context, label string, token *Token) error
+	PowerOffNode(ctx context.Context, label string, token *Token) error
+	ShutdownNode(ctx context.Context, label string, timeout time.Duration, token *Token) error
+	PowerCycleNode(ctx context.Context, label string, force bool, token *Token) error
+	PowerNodes(ctx context.Context, labels []string, action string, force bool, timeout time.Duration, report func(label string, err error))
+	PowerPDUNodes(ctx context.Context, pdu, action string, force bool, timeout time.Duration, report func(o PDUOutlet, err error)) error
+	NodePowerStatus(ctx context.Context, label string, token *Token) (driver.PowerState, error)
+	NodeStatus(ctx context.Context, label string, token *Token) (power driver.PowerState, bootdev string, err error)
+	NodePowerReading(ctx context.Context, label string, token *Token) (driver.PowerReading, error)
+	SetNodePowerLimit(ctx context.Context, label string, watts int, token *Token) error
+	NodeCapabilities(ctx context.Context, label string, token *Token) (Capabilities, error)
+	SetNodeBootDev(ctx context.Context, label string, dev string, token *Token) error
+	NodeWatchdog(ctx context.Context, label string, token *Token) (driver.WatchdogStatus, error)
+	ArmNodeWatchdog(ctx context.Context, label string, seconds int, token *Token) error
+	ResetNodeWatchdog(ctx context.Context, label string, token *Token) error
+	StopNodeWatchdog(ctx context.Context, label string, token *Token) error
+
+	// PDUs (admin only)
+	SetPDUOutlet(o PDUOutlet) error
+	DeletePDUOutlet(pdu, outlet string) error
+	PDUs() ([]string, error)
+	PDUOutlets(pdu string) ([]PDUOutlet, error)
+
+	// Power groups (admin only)
+	SetPowerGroup(ctx context.Context, name string, budget int, labels []string) ([]PowerCapResult, error)
+	DeletePowerGroup(ctx context.Context, name string) ([]PowerCapResult, error)
+	PowerGroups() ([]PowerGroup, error)
+	PowerGroup(name string) (PowerGroup, error)
+
+	// The OBMs themselves (admin only)
+	NodeLANConfig(ctx context.Context, label string) (driver.LANConfig, error)
+	NodePowerRestorePolicy(ctx context.Context, label string) (driver.PowerRestorePolicy, error)
+	SetNodePowerRestorePolicy(ctx context.Context, label string, policy driver.PowerRestorePolicy) error
+	NodeBMCUsers(ctx context.Context, label string) ([]driver.User, error)
+	ChangeNodePassword(ctx context.Context, label, password string) (string, error)
+	PendingNodePassword(label string) (string, error)
+	NodeFirmwareVersions(ctx context.Context, label string) (map[string]string, error)
+	StartFirmwareRollout(component, imagePath, version string, labels []string, groupSize int, timeout time.Duration) (FirmwareRollout, error)
+	FirmwareRollouts() []FirmwareRollout
+	FirmwareRollout(id string) (FirmwareRollout, error)
+}
+
+// The key of the context value set by WithOpName.
+type opNameKey struct{}
+
+// Return a context for an operation named `name` (e.g. "power_cycle"), so
+// that it can be recorded as the last use of the token it is made with; see
+// Daemon.NodeTokenUsage.
+func WithOpName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, opNameKey{}, name)
+}
+
+// Return the name given to WithOpName, or "" if none was.
+func OpName(ctx context.Context) string {
+	name, _ := ctx.Value(opNameKey{}).(string)
+	return name
+}
+
+// The key of the context value set by WithExpectedVersion.
+type versionKey struct{}
+
+// Return a context for operations which should only be done if the node's
+// version (see Daemon.NodeVersion) is `version`, e.g. because the client
+// looked at the node's info, and needs to know that it hasn't changed
+// since. Daemon methods given such a context fail with ErrVersionMismatch
+// otherwise.
+func WithExpectedVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+// Return the version given to WithExpectedVersion, and whether one was.
+func ExpectedVersion(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(versionKey{}).(string)
+	return v, ok
+}
@@ -0,0 +1,22 @@
+package obmd
+
+import (
+	"time"
+)
+
+// A time.Duration which is represented in JSON as a string understood
+// by time.ParseDuration, e.g. "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	val, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(val)
+	return nil
+}
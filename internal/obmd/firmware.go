@@ -0,0 +1,40 @@
+package obmd
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoSuchRollout = errors.New("No such firmware rollout.")
+	ErrNoSuchImage   = errors.New("No such firmware image.")
+)
+
+// A staged rollout of a firmware image to a list of nodes, as reported by
+// the api; see Daemon.StartFirmwareRollout.
+type FirmwareRollout struct {
+	ID        string    `json:"id"`
+	Component string    `json:"component"`
+	Image     string    `json:"image"`   // the image's file name.
+	Version   string    `json:"version"` // the expected version after updating.
+	GroupSize int       `json:"group_size"`
+	State     string    `json:"state"` // "running", "done" or "halted".
+	Started   time.Time `json:"started"`
+
+	// The nodes, in the order they are updated.
+	Nodes []FirmwareNodeStatus `json:"nodes"`
+}
+
+// The progress of a node in a FirmwareRollout.
+type FirmwareNodeStatus struct {
+	Node string `json:"node"`
+
+	// "pending", "updating", "verifying", "done", "failed" or "skipped".
+	State string `json:"state"`
+
+	// The version the node reported after the update, if it got that far.
+	Version string `json:"version,omitempty"`
+
+	// Why the update failed, if it did.
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,101 @@
+package obmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// A description of a node, with secrets (e.g. passwords) redacted, for
+// keeping a record of changes; see Daemon.NodeSnapshots.
+type NodeSnapshot struct {
+	Type  string      `json:"type"`
+	Model string      `json:"model,omitempty"`
+	Info  interface{} `json:"info"` // with secrets redacted; see DecodeJSON.
+
+	// The node's version (see Daemon.NodeVersion), which changes whenever
+	// its info does, so that changes to secrets show up too.
+	Version string `json:"version"`
+
+	// Why the node is in maintenance mode or being drained, if it is.
+	Maintenance *string `json:"maintenance,omitempty"`
+	Draining    *string `json:"draining,omitempty"`
+
+	// The project which owns the node, if any; see Daemon.TransferNode.
+	Owner string `json:"owner,omitempty"`
+}
+
+// Decode JSON, keeping numbers as they are written, so that comparing
+// them is exact.
+func DecodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// The results of a node's latest health check, as reported by the api.
+type NodeHealth struct {
+	// Whether the node's OBM answered the latest check.
+	Healthy bool `json:"healthy"`
+
+	// When the node was last checked.
+	LastChecked time.Time `json:"last_checked"`
+
+	// When the node's OBM last answered a check; zero if it never has.
+	LastSeen time.Time `json:"last_seen"`
+
+	// How long the latest check took.
+	Latency Duration `json:"latency"`
+
+	// The node's power state as of LastSeen.
+	PowerState driver.PowerState `json:"power_state"`
+
+	// Why the latest check failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// A change in a node's power state, as seen by a health check.
+type PowerTransition struct {
+	Time  time.Time         `json:"time"`
+	Power driver.PowerState `json:"power"` // the new state.
+}
+
+// A summary of a node's power history over a period; see
+// Daemon.NodePowerHistory.
+type PowerHistory struct {
+	// The transitions during the period, oldest first.
+	Transitions []PowerTransition `json:"transitions"`
+
+	// The node's latest known power state, and when it changed to that,
+	// e.g. how long the node has been on. The state is "unknown" (with a
+	// zero time) if the history is empty.
+	Power driver.PowerState `json:"power"`
+	Since time.Time         `json:"since"`
+
+	// How long the node was on and off during the period, as far as the
+	// history tells: time before the first transition isn't counted.
+	OnTime  Duration `json:"on_time"`
+	OffTime Duration `json:"off_time"`
+}
+
+// A record of a node being moved from one project to another.
+type NodeTransfer struct {
+	Time time.Time `json:"time"`
+
+	// The projects the node was moved from and to; empty means no
+	// project.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Who moved it, as they identified themselves in the X-Requester
+	// header; see Requester.
+	Requester string `json:"requester,omitempty"`
+}
+
+// A target group in Prometheus's http_sd format.
+type PrometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
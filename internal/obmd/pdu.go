@@ -0,0 +1,31 @@
+package obmd
+
+import (
+	"errors"
+)
+
+var (
+	ErrNoSuchPDU           = errors.New("No such PDU.")
+	ErrNoSuchOutlet        = errors.New("No such PDU outlet.")
+	ErrInvalidOutletName   = errors.New("Invalid PDU or outlet name.")
+	ErrOutletNotSwitchable = errors.New("Outlet has no node to switch it through.")
+)
+
+// An outlet of a PDU, which may power a node. obmd has no PDU drivers, and
+// never switches outlets itself: they only record which nodes a PDU powers,
+// and in what order, so that the nodes can be powered through their own
+// OBMs (see Daemon.PowerPDUNodes). Outlets which power something other
+// than a node (e.g. a switch) are recorded, but nothing is done to them.
+type PDUOutlet struct {
+	PDU    string `json:"pdu"`
+	Outlet string `json:"outlet"`
+
+	// The node the outlet powers; empty if it isn't a node.
+	Node string `json:"node,omitempty"`
+
+	// Where the outlet comes in group operations on the PDU; see
+	// Daemon.PowerPDUNodes.
+	Order int `json:"order"`
+
+	Description string `json:"description,omitempty"`
+}
@@ -0,0 +1,54 @@
+package obmd
+
+import (
+	"context"
+	"errors"
+)
+
+// Returned when the authorization policy could not be consulted, and so the
+// operation was refused.
+var ErrPolicyUnavailable = errors.New("The authorization policy could not be consulted.")
+
+// Returned when the authorization policy refuses an operation.
+type PolicyDeniedError struct {
+	Reason string // as given by the policy; may be empty.
+}
+
+func (e PolicyDeniedError) Error() string {
+	if e.Reason == "" {
+		return "Refused by the authorization policy."
+	}
+	return "Refused by the authorization policy: " + e.Reason
+}
+
+// Who made a request, as far as obmd can tell.
+type Requester struct {
+	// Whether the request was made by the admin, rather than with the
+	// node's token.
+	Admin bool `json:"admin"`
+
+	// Who the request was made for: for admin requests, the identity
+	// named in the X-Requester header, e.g. the project on whose behalf a
+	// front end is acting, which is only believed because the admin
+	// credentials are; for ssh sessions authenticated by public key, the
+	// key's fingerprint. Empty otherwise.
+	Identity string `json:"identity,omitempty"`
+
+	// The address the request came from.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// The key of the context value set by WithRequester.
+type requesterKey struct{}
+
+// Return a context for operations made on behalf of r. The Admin field is
+// ignored; the Daemon works that out for itself.
+func WithRequester(ctx context.Context, r Requester) context.Context {
+	return context.WithValue(ctx, requesterKey{}, r)
+}
+
+// Return the Requester given to WithRequester, if any.
+func RequesterOf(ctx context.Context) Requester {
+	r, _ := ctx.Value(requesterKey{}).(Requester)
+	return r
+}
@@ -0,0 +1,36 @@
+package obmd
+
+import (
+	"errors"
+)
+
+var (
+	ErrNoSuchPowerGroup   = errors.New("No such power group.")
+	ErrNodeInPowerGroup   = errors.New("Node is already in another power group.")
+	ErrInvalidPowerBudget = errors.New("Invalid power budget.")
+	ErrInvalidGroupName   = errors.New("Invalid power group name.")
+	ErrGroupPowerLimit    = errors.New("Node's power limit is set by its power group.")
+)
+
+// A group of nodes sharing a power budget, e.g. those in a rack; see
+// Daemon.SetPowerGroup.
+type PowerGroup struct {
+	Name   string   `json:"name"`
+	Budget int      `json:"budget"` // in watts.
+	Nodes  []string `json:"nodes"`  // sorted.
+
+	// Each member's share of the budget, which is its power limit.
+	Share int `json:"share"`
+
+	// Why the share couldn't be applied to members, when it was last
+	// tried, keyed by label. Members which are capped aren't listed.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// The outcome of setting (or removing) a member's power limit on behalf of
+// its group.
+type PowerCapResult struct {
+	Node  string
+	Watts int // zero if the limit was removed.
+	Err   error
+}
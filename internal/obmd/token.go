@@ -0,0 +1,59 @@
+package obmd
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// A cryptographically random 128-bit value.
+type Token [128 / 8]byte
+
+func (t Token) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%0x", t)), nil
+}
+
+func (t *Token) UnmarshalText(text []byte) error {
+	if len(text) != 2*len(t[:]) {
+		// wrong number of characters.
+		return ErrInvalidToken
+	}
+	for _, char := range text {
+		if !isHexDigit(char) {
+			return ErrInvalidToken
+		}
+	}
+	var buf []byte
+	_, err := fmt.Fscanf(bytes.NewBuffer(text), "%32x", &buf)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	copy(t[:], buf)
+	return nil
+}
+
+func isHexDigit(char byte) bool {
+	return char >= '0' && char <= '9' ||
+		char >= 'a' && char <= 'f' ||
+		char >= 'A' && char <= 'F'
+}
+
+// When a node's token was issued and last used; see Daemon.NodeTokenUsage.
+type TokenUsage struct {
+	// Whether the node has a token.
+	Issued bool `json:"issued"`
+
+	// When the token was issued; zero if there is none.
+	IssuedAt time.Time `json:"issued_at"`
+
+	// When the token was last used, and the operation it was used for
+	// (e.g. "power_cycle"); zero and empty if it hasn't been.
+	LastUsed      time.Time `json:"last_used"`
+	LastOperation string    `json:"last_operation,omitempty"`
+}
+
+// Report whether the token was issued, but hasn't been used since `since`
+// (counting being issued as a use).
+func (u TokenUsage) UnusedSince(since time.Time) bool {
+	return u.Issued && u.IssuedAt.Before(since) && u.LastUsed.Before(since)
+}
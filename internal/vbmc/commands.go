@@ -0,0 +1,309 @@
+package vbmc
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Network functions (5.1).
+const (
+	netFnChassis = 0x00
+	netFnApp     = 0x06
+)
+
+// Commands (appendix G).
+const (
+	cmdGetDeviceID             = 0x01 // app
+	cmdGetChannelAuthCaps      = 0x38 // app
+	cmdSetSessionPrivilege     = 0x3b // app
+	cmdCloseSession            = 0x3c // app
+	cmdGetChannelCipherSuites  = 0x54 // app
+	cmdGetChassisStatus        = 0x01 // chassis
+	cmdChassisControl          = 0x02 // chassis
+	cmdSetSystemBootOptions    = 0x08 // chassis
+	cmdGetSystemBootOptions    = 0x09 // chassis
+	bootParamBootFlags         = 0x05
+	bootFlagsValid             = 0x80
+	bootFlagsDeviceMask        = 0x3c
+	bootFlagsParamNotSupported = 0x80 // completion code for Set/Get System Boot Options.
+)
+
+// Completion codes (5.2).
+const (
+	ccOK                    = 0x00
+	ccInvalidCommand        = 0xc1
+	ccInvalidField          = 0xcc
+	ccRequestTooShort       = 0xc7
+	ccInsufficientPrivilege = 0xd4
+	ccUnspecifiedError      = 0xff
+)
+
+// Boot device selectors, from the boot flags parameter (table 28-14), and
+// the obmd boot devices they correspond to.
+var bootdevs = map[byte]string{
+	0x00: "none",
+	0x04: "pxe",
+	0x08: "disk",
+	0x0c: "safe",
+	0x14: "cdrom",
+	0x18: "bios",
+}
+
+// Handle a request received outside a session, returning its completion
+// code and response data. Only the commands needed to open a session are
+// accepted.
+func (s *Server) sessionless(req request) (cc byte, data []byte) {
+	if req.netFn != netFnApp {
+		return ccInvalidCommand, nil
+	}
+	switch req.cmd {
+	case cmdGetChannelAuthCaps:
+		return getChannelAuthCaps(req)
+	case cmdGetChannelCipherSuites:
+		return getChannelCipherSuites(req)
+	}
+	return ccInvalidCommand, nil
+}
+
+// Handle Get Channel Authentication Capabilities (22.13).
+func getChannelAuthCaps(req request) (cc byte, data []byte) {
+	if len(req.data) < 2 {
+		return ccRequestTooShort, nil
+	}
+	return ccOK, []byte{
+		0x01,       // channel number
+		0x80,       // IPMI 2.0 extended capabilities are available.
+		0x04,       // non-null user names only; KG is not set.
+		0x02,       // IPMI 2.0 (RMCP+) connections only.
+		0, 0, 0, 0, // OEM ID & data
+	}
+}
+
+// Handle Get Channel Cipher Suites (22.15). We support cipher suite 3
+// only.
+func getChannelCipherSuites(req request) (cc byte, data []byte) {
+	if len(req.data) < 3 {
+		return ccRequestTooShort, nil
+	}
+	data = []byte{0x01} // channel number
+	if req.data[2]&0x3f == 0 {
+		// The record for cipher suite 3: its ID, then the
+		// authentication, integrity and confidentiality algorithms.
+		data = append(data, 0xc0, 0x03, 0x01, 0x41, 0x81)
+	}
+	return ccOK, data
+}
+
+// The privilege level needed for each chassis command; others need user.
+var chassisPrivileges = map[byte]byte{
+	cmdChassisControl:       privOperator,
+	cmdSetSystemBootOptions: privOperator,
+}
+
+// Handle a request received within sess, calling reply with its completion
+// code and response data. Requests which need the backend are queued for
+// it; others are answered immediately.
+func (s *Server) dispatch(sess *session, req request, reply func(cc byte, data []byte)) {
+	if req.netFn == netFnChassis {
+		s.mu.Lock()
+		priv := sess.priv
+		s.mu.Unlock()
+		if need, ok := chassisPrivileges[req.cmd]; ok && priv < need {
+			reply(ccInsufficientPrivilege, nil)
+			return
+		}
+	}
+	switch req.netFn {
+	case netFnApp:
+		switch req.cmd {
+		case cmdGetChannelAuthCaps, cmdGetChannelCipherSuites:
+			reply(s.sessionless(req))
+		case cmdGetDeviceID:
+			reply(ccOK, []byte{
+				0x20,       // device ID
+				0x01,       // device revision
+				0x00, 0x00, // firmware revision; "device available".
+				0x02,             // IPMI version 2.0
+				0x01,             // additional device support: chassis device.
+				0x00, 0x00, 0x00, // manufacturer ID: unspecified.
+				0x00, 0x00, // product ID
+			})
+		case cmdSetSessionPrivilege:
+			s.setSessionPrivilege(sess, req, reply)
+		case cmdCloseSession:
+			s.closeSession(sess, req, reply)
+		default:
+			reply(ccInvalidCommand, nil)
+		}
+	case netFnChassis:
+		switch req.cmd {
+		case cmdGetChassisStatus:
+			s.enqueue(func(ctx context.Context) {
+				reply(s.getChassisStatus(ctx))
+			})
+		case cmdChassisControl:
+			s.chassisControl(req, reply)
+		case cmdSetSystemBootOptions:
+			s.setSystemBootOptions(req, reply)
+		case cmdGetSystemBootOptions:
+			s.getSystemBootOptions(req, reply)
+		default:
+			reply(ccInvalidCommand, nil)
+		}
+	default:
+		reply(ccInvalidCommand, nil)
+	}
+}
+
+// Handle Set Session Privilege Level (22.18). The level may be raised up to
+// the session's maximum, which is at most the server's.
+func (s *Server) setSessionPrivilege(sess *session, req request, reply func(byte, []byte)) {
+	if len(req.data) < 1 {
+		reply(ccRequestTooShort, nil)
+		return
+	}
+	level := req.data[0] & 0x0f
+	if level != 0 && (level < privUser || level > privAdmin) {
+		reply(ccInvalidField, nil)
+		return
+	}
+	s.mu.Lock()
+	switch {
+	case level == 0:
+		level = sess.priv // "no change"
+	case level > sess.maxPriv:
+		level = 0
+	default:
+		sess.priv = level
+	}
+	s.mu.Unlock()
+	if level == 0 {
+		reply(0x81, nil) // exceeds the user's privilege limit
+		return
+	}
+	reply(ccOK, []byte{level})
+}
+
+// Handle Close Session (22.19).
+func (s *Server) closeSession(sess *session, req request, reply func(byte, []byte)) {
+	if len(req.data) < 4 {
+		reply(ccRequestTooShort, nil)
+		return
+	}
+	if binary.LittleEndian.Uint32(req.data) != sess.bmcID {
+		reply(0x87, nil) // invalid session ID
+		return
+	}
+	// Reply before forgetting the session, since we need its keys to do
+	// so.
+	reply(ccOK, nil)
+	s.mu.Lock()
+	delete(s.sessions, sess.bmcID)
+	s.mu.Unlock()
+}
+
+// Handle Get Chassis Status (28.2).
+func (s *Server) getChassisStatus(ctx context.Context) (cc byte, data []byte) {
+	state, err := s.backend.PowerStatus(ctx)
+	if err != nil {
+		s.log.Warn("Error getting power status", "err", err)
+		return ccUnspecifiedError, nil
+	}
+	var power byte
+	if state == driver.PowerStateOn {
+		power = 0x01
+	}
+	return ccOK, []byte{power, 0, 0}
+}
+
+// Handle Chassis Control (28.3). This replies as soon as the operation is
+// queued, as real BMCs do; any error is logged.
+func (s *Server) chassisControl(req request, reply func(byte, []byte)) {
+	if len(req.data) < 1 {
+		reply(ccRequestTooShort, nil)
+		return
+	}
+	var name string
+	var op func(context.Context) error
+	switch req.data[0] & 0x0f {
+	case 0x00:
+		name, op = "power off", s.backend.PowerOff
+	case 0x01:
+		name, op = "power on", s.backend.PowerOn
+	case 0x02:
+		name = "power cycle"
+		op = func(ctx context.Context) error { return s.backend.PowerCycle(ctx, false) }
+	case 0x03:
+		name = "hard reset"
+		op = func(ctx context.Context) error { return s.backend.PowerCycle(ctx, true) }
+	default:
+		// Diagnostic interrupts and soft shutdown have no obmd
+		// equivalent.
+		reply(ccInvalidField, nil)
+		return
+	}
+	reply(ccOK, nil)
+	s.enqueue(func(ctx context.Context) {
+		if err := op(ctx); err != nil {
+			s.log.Warn("Chassis control failed", "op", name, "err", err)
+		}
+	})
+}
+
+// Handle Set System Boot Options (28.12). Only the boot flags parameter
+// does anything; other parameters (such as the "set in progress" and
+// boot info acknowledge parameters, which clients set around it) are
+// accepted and ignored.
+func (s *Server) setSystemBootOptions(req request, reply func(byte, []byte)) {
+	if len(req.data) < 1 {
+		reply(ccRequestTooShort, nil)
+		return
+	}
+	if req.data[0]&0x7f != bootParamBootFlags {
+		reply(ccOK, nil)
+		return
+	}
+	if len(req.data) < 6 {
+		reply(ccRequestTooShort, nil)
+		return
+	}
+	var flags [5]byte
+	copy(flags[:], req.data[1:])
+	dev := "none"
+	if flags[0]&bootFlagsValid != 0 {
+		var ok bool
+		dev, ok = bootdevs[flags[1]&bootFlagsDeviceMask]
+		if !ok {
+			reply(ccInvalidField, nil)
+			return
+		}
+	}
+	s.mu.Lock()
+	s.bootdev = flags
+	s.mu.Unlock()
+	reply(ccOK, nil)
+	s.enqueue(func(ctx context.Context) {
+		if err := s.backend.SetBootdev(ctx, dev); err != nil {
+			s.log.Warn("Setting boot device failed", "bootdev", dev, "err", err)
+		}
+	})
+}
+
+// Handle Get System Boot Options (28.13), for the boot flags parameter.
+func (s *Server) getSystemBootOptions(req request, reply func(byte, []byte)) {
+	if len(req.data) < 3 {
+		reply(ccRequestTooShort, nil)
+		return
+	}
+	param := req.data[0] & 0x7f
+	if param != bootParamBootFlags {
+		reply(bootFlagsParamNotSupported, nil)
+		return
+	}
+	s.mu.Lock()
+	flags := s.bootdev
+	s.mu.Unlock()
+	reply(ccOK, append([]byte{0x01, param}, flags[:]...))
+}
@@ -0,0 +1,250 @@
+package vbmc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+)
+
+// Constants from the IPMI 2.0 spec; section numbers refer to it.
+const (
+	// RMCP message classes (13.1.3).
+	classASF  = 0x06
+	classIPMI = 0x07
+
+	// Session header "auth type" values; 0x06 means an RMCP+ (IPMI 2.0)
+	// header follows (13.6).
+	authTypeNone = 0x00
+	authTypeRMCP = 0x06
+
+	// Payload types (13.27.3), and the flags sharing their byte.
+	payloadIPMI         = 0x00
+	payloadOpenSession  = 0x10
+	payloadOpenResponse = 0x11
+	payloadRAKP1        = 0x12
+	payloadRAKP2        = 0x13
+	payloadRAKP3        = 0x14
+	payloadRAKP4        = 0x15
+	payloadEncrypted    = 0x80
+	payloadAuthed       = 0x40
+
+	// Length of an HMAC-SHA1-96 auth code.
+	authCodeLen = 12
+
+	// The "next header" byte of the session trailer.
+	nextHeader = 0x07
+)
+
+var errBadPacket = errors.New("malformed packet")
+
+// The 4-byte RMCP header for IPMI messages: version 1.0, no RMCP ack.
+var rmcpHeader = []byte{0x06, 0x00, 0xff, classIPMI}
+
+// Compute HMAC-SHA1 of the concatenation of parts.
+func hmacSHA1(key []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha1.New, key)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// Session keys derived from the RAKP exchange (13.31, 13.32).
+type keys struct {
+	sik, k1, k2 []byte
+}
+
+// Derive the session keys. kg is the BMC key, or the user's password if
+// none is set; the other arguments are as exchanged in RAKP messages 1 & 2.
+func deriveKeys(kg []byte, rm, rc []byte, role byte, user []byte) keys {
+	sik := hmacSHA1(kg, rm, rc, []byte{role, byte(len(user))}, user)
+	return keys{
+		sik: sik,
+		k1:  hmacSHA1(sik, bytes.Repeat([]byte{0x01}, 20)),
+		k2:  hmacSHA1(sik, bytes.Repeat([]byte{0x02}, 20)),
+	}
+}
+
+// Encrypt an IPMI payload with AES-CBC-128 (13.29), returning the IV
+// followed by the ciphertext.
+func encrypt(k2, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(k2[:16])
+	if err != nil {
+		return nil, err
+	}
+	padLen := (aes.BlockSize - (len(plain)+1)%aes.BlockSize) % aes.BlockSize
+	data := make([]byte, 0, len(plain)+padLen+1)
+	data = append(data, plain...)
+	for i := 1; i <= padLen; i++ {
+		data = append(data, byte(i))
+	}
+	data = append(data, byte(padLen))
+	out := make([]byte, aes.BlockSize+len(data))
+	if _, err = rand.Read(out[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).
+		CryptBlocks(out[aes.BlockSize:], data)
+	return out, nil
+}
+
+// Reverse encrypt.
+func decrypt(k2, payload []byte) ([]byte, error) {
+	if len(payload) < 2*aes.BlockSize || len(payload)%aes.BlockSize != 0 {
+		return nil, errBadPacket
+	}
+	block, err := aes.NewCipher(k2[:16])
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(payload)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, payload[:aes.BlockSize]).
+		CryptBlocks(data, payload[aes.BlockSize:])
+	padLen := int(data[len(data)-1])
+	if padLen >= aes.BlockSize || padLen+1 > len(data) {
+		return nil, errBadPacket
+	}
+	data = data[:len(data)-1]
+	for i := 0; i < padLen; i++ {
+		if data[len(data)-padLen+i] != byte(i+1) {
+			return nil, errBadPacket
+		}
+	}
+	return data[:len(data)-padLen], nil
+}
+
+// An RMCP+ packet, after the RMCP header (13.6).
+type v2Packet struct {
+	payloadType byte // including the encrypted/authenticated flags.
+	sessionID   uint32
+	seq         uint32
+	payload     []byte
+}
+
+// Parse an RMCP+ packet (starting from the auth type byte). If it is
+// authenticated, its integrity is checked with k1, which may not be nil.
+// Encrypted payloads are returned as-is.
+func parseV2(body []byte, k1 []byte) (p v2Packet, err error) {
+	if len(body) < 12 || body[0] != authTypeRMCP {
+		return p, errBadPacket
+	}
+	p.payloadType = body[1]
+	p.sessionID = binary.LittleEndian.Uint32(body[2:])
+	p.seq = binary.LittleEndian.Uint32(body[6:])
+	n := int(binary.LittleEndian.Uint16(body[10:]))
+	if 12+n > len(body) {
+		return p, errBadPacket
+	}
+	p.payload = body[12 : 12+n]
+	if p.payloadType&payloadAuthed == 0 {
+		return p, nil
+	}
+	if k1 == nil || len(body) < 12+n+2+authCodeLen {
+		return p, errBadPacket
+	}
+	signed := body[:len(body)-authCodeLen]
+	if signed[len(signed)-1] != nextHeader {
+		return p, errBadPacket
+	}
+	mac := hmacSHA1(k1, signed)[:authCodeLen]
+	if !hmac.Equal(mac, body[len(body)-authCodeLen:]) {
+		return p, errors.New("bad integrity check value")
+	}
+	return p, nil
+}
+
+// Build an RMCP+ packet, including the RMCP header. If k1 is not nil, the
+// packet is marked authenticated, and given an auth code.
+func buildV2(p v2Packet, k1 []byte) []byte {
+	if k1 != nil {
+		p.payloadType |= payloadAuthed
+	}
+	out := append([]byte(nil), rmcpHeader...)
+	var hdr [12]byte
+	hdr[0] = authTypeRMCP
+	hdr[1] = p.payloadType
+	binary.LittleEndian.PutUint32(hdr[2:], p.sessionID)
+	binary.LittleEndian.PutUint32(hdr[6:], p.seq)
+	binary.LittleEndian.PutUint16(hdr[10:], uint16(len(p.payload)))
+	out = append(out, hdr[:]...)
+	out = append(out, p.payload...)
+	if k1 == nil {
+		return out
+	}
+	// Pad so that everything from the auth type to the next header is a
+	// multiple of 4 bytes.
+	padLen := (4 - (len(out)-len(rmcpHeader)+2)%4) % 4
+	for i := 0; i < padLen; i++ {
+		out = append(out, 0xff)
+	}
+	out = append(out, byte(padLen), nextHeader)
+	mac := hmacSHA1(k1, out[len(rmcpHeader):])[:authCodeLen]
+	return append(out, mac...)
+}
+
+// Parse an IPMI 1.5 session packet without authentication (starting from
+// the auth type byte), returning its session ID and message.
+func parseV15(body []byte) (sessionID uint32, msg []byte, err error) {
+	if len(body) < 10 || body[0] != authTypeNone {
+		return 0, nil, errBadPacket
+	}
+	sessionID = binary.LittleEndian.Uint32(body[5:])
+	n := int(body[9])
+	if 10+n > len(body) {
+		return 0, nil, errBadPacket
+	}
+	return sessionID, body[10 : 10+n], nil
+}
+
+// Build an unauthenticated IPMI 1.5 packet, including the RMCP header.
+func buildV15(msg []byte) []byte {
+	out := append([]byte(nil), rmcpHeader...)
+	out = append(out, authTypeNone, 0, 0, 0, 0, 0, 0, 0, 0, byte(len(msg)))
+	return append(out, msg...)
+}
+
+// The checksum used in IPMI messages: the two's complement of the sum.
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+// An IPMI request, as sent over LAN (13.8).
+type request struct {
+	rqAddr, rqSeq, rqLUN byte
+	netFn, cmd           byte
+	data                 []byte
+}
+
+func parseRequest(msg []byte) (req request, err error) {
+	if len(msg) < 7 || checksum(msg[:3]) != 0 || checksum(msg[3:]) != 0 {
+		return req, errBadPacket
+	}
+	req.netFn = msg[1] >> 2
+	req.rqAddr = msg[3]
+	req.rqSeq = msg[4] >> 2
+	req.rqLUN = msg[4] & 0x03
+	req.cmd = msg[5]
+	req.data = msg[6 : len(msg)-1]
+	return req, nil
+}
+
+// The address of the BMC on the IPMB, which it responds from.
+const bmcAddr = 0x20
+
+// Build the response to req, with the given completion code and data.
+func (req request) response(cc byte, data []byte) []byte {
+	msg := []byte{req.rqAddr, (req.netFn+1)<<2 | req.rqLUN, 0}
+	msg[2] = checksum(msg[:2])
+	msg = append(msg, bmcAddr, req.rqSeq<<2, req.cmd, cc)
+	msg = append(msg, data...)
+	return append(msg, checksum(msg[3:]))
+}
@@ -0,0 +1,562 @@
+// Package vbmc implements a virtual BMC: a server speaking IPMI over LAN
+// (RMCP+), which translates chassis commands from standard IPMI tools into
+// operations on a Backend. This lets tools which only know how to talk to
+// a BMC directly, such as ipmitool or Ironic's ipmi drivers, manage a node
+// through obmd.
+//
+// Only what those tools need for power and boot device control is
+// implemented, with a single user, and cipher suite 3 (RAKP-HMAC-SHA1
+// authentication, HMAC-SHA1-96 integrity and AES-CBC-128 encryption),
+// which is ipmitool's default and is required for every session.
+package vbmc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// The operations a Server performs on behalf of its clients.
+type Backend interface {
+	PowerStatus(ctx context.Context) (driver.PowerState, error)
+	// Power on the node, if it isn't already.
+	PowerOn(ctx context.Context) error
+	PowerOff(ctx context.Context) error
+	PowerCycle(ctx context.Context, force bool) error
+	SetBootdev(ctx context.Context, dev string) error
+}
+
+const (
+	// Sessions not used for this long are closed, as with real BMCs,
+	// which typically time them out after a minute.
+	sessionTimeout = 60 * time.Second
+
+	// The most sessions a Server will have open at once.
+	maxSessions = 16
+
+	// How many recent responses each session keeps, to answer
+	// retransmitted requests without repeating their commands.
+	responseCacheSize = 16
+
+	// Maximum time to allow for a backend operation.
+	opTimeout = 2 * time.Minute
+
+	// Privilege levels (6.8).
+	privUser     = 0x02
+	privOperator = 0x03
+	privAdmin    = 0x04
+)
+
+// The privilege levels a Server may be limited to, by name.
+var privileges = map[string]byte{
+	"user":          privUser,
+	"operator":      privOperator,
+	"administrator": privAdmin,
+}
+
+// A virtual BMC for one node.
+type Server struct {
+	backend  Backend
+	user     []byte
+	password []byte
+	maxPriv  byte // the highest privilege level sessions may have.
+	guid     []byte
+	log      *logger.Logger
+
+	// Backend operations are run in order, one at a time, by a single
+	// goroutine reading from ops.
+	ops chan func(ctx context.Context)
+
+	mu       sync.Mutex
+	sessions map[uint32]*session // keyed by our (the BMC's) session ID.
+	bootdev  [5]byte             // the last boot flags set, for Get System Boot Options.
+}
+
+// An RMCP+ session.
+type session struct {
+	addr      net.Addr
+	consoleID uint32 // the client's ID for the session.
+	bmcID     uint32
+	lastUsed  time.Time
+
+	// From the RAKP exchange:
+	rm, rc []byte
+	role   byte // the requested role byte from RAKP1, as sent.
+	keys   keys
+	active bool
+
+	// The highest privilege level the session may have, and the one it
+	// has, which starts at user and is raised by Set Session Privilege
+	// Level (22.18).
+	maxPriv, priv byte
+
+	// Sequence numbers: the last we sent, and a window of those received.
+	outSeq uint32
+	inSeq  uint32
+	inSeen uint32 // bit i is set if inSeq-i has been received.
+
+	// Responses to recent requests, keyed by cacheKey.
+	responses map[uint32][]byte
+	order     []uint32
+}
+
+// Create a server for the node named label, which accepts the given user
+// and password (each of which are limited to 16 and 20 bytes,
+// respectively, by the protocol). The user's privilege is limited to
+// `privilege`: "user" (which may only query the node), "operator" (which
+// may also control it) or "administrator" (the same, as nothing here needs
+// more); empty means "administrator".
+func NewServer(backend Backend, label, user, password, privilege string) (*Server, error) {
+	if len(user) > 16 {
+		return nil, errors.New("user name is longer than 16 bytes")
+	}
+	if len(password) > 20 {
+		return nil, errors.New("password is longer than 20 bytes")
+	}
+	if privilege == "" {
+		privilege = "administrator"
+	}
+	maxPriv, ok := privileges[privilege]
+	if !ok {
+		return nil, errors.New("unknown privilege level " + privilege)
+	}
+	sum := sha1.Sum([]byte(label))
+	return &Server{
+		backend:  backend,
+		user:     []byte(user),
+		password: []byte(password),
+		maxPriv:  maxPriv,
+		guid:     sum[:16],
+		log:      logger.With("subsystem", "vbmc", "node", label),
+		ops:      make(chan func(context.Context), 16),
+		sessions: make(map[uint32]*session),
+	}, nil
+}
+
+// Serve requests received on conn, until reading from it fails (e.g.
+// because it has been closed), returning that error.
+func (s *Server) Serve(conn net.PacketConn) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for op := range s.ops {
+			opCtx, cancel := context.WithTimeout(ctx, opTimeout)
+			op(opCtx)
+			cancel()
+		}
+	}()
+	defer close(s.ops)
+
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		if err := s.handlePacket(conn, addr, pkt); err != nil {
+			s.log.Debug("Dropping packet", "remote", addr.String(), "err", err)
+		}
+	}
+}
+
+// Handle one packet, including the RMCP header.
+func (s *Server) handlePacket(conn net.PacketConn, addr net.Addr, pkt []byte) error {
+	if len(pkt) < 5 || pkt[0] != 0x06 {
+		return errBadPacket
+	}
+	switch pkt[3] {
+	case classASF:
+		return s.handlePing(conn, addr, pkt)
+	case classIPMI:
+	default:
+		return errBadPacket
+	}
+	body := pkt[4:]
+	if body[0] == authTypeNone {
+		// Before opening a session, ipmitool uses IPMI 1.5 packets to
+		// get the channel's capabilities.
+		id, msg, err := parseV15(body)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			return errors.New("IPMI 1.5 sessions are not supported")
+		}
+		req, err := parseRequest(msg)
+		if err != nil {
+			return err
+		}
+		cc, data := s.sessionless(req)
+		_, err = conn.WriteTo(buildV15(req.response(cc, data)), addr)
+		return err
+	}
+
+	p, err := parseV2(body, nil)
+	if err != nil && p.payloadType&payloadAuthed == 0 {
+		return err
+	}
+	var out []byte
+	switch p.payloadType &^ (payloadEncrypted | payloadAuthed) {
+	case payloadOpenSession:
+		out, err = s.openSession(addr, p.payload)
+	case payloadRAKP1:
+		out, err = s.rakp1(p.payload)
+	case payloadRAKP3:
+		out, err = s.rakp3(p.payload)
+	case payloadIPMI:
+		return s.handleIPMI(conn, addr, body, p)
+	default:
+		return errors.New("unsupported payload type")
+	}
+	if out != nil {
+		if _, errWrite := conn.WriteTo(out, addr); err == nil {
+			err = errWrite
+		}
+	}
+	return err
+}
+
+// Answer an ASF presence ping (13.2.3).
+func (s *Server) handlePing(conn net.PacketConn, addr net.Addr, pkt []byte) error {
+	const asfIANA = 4542
+	if len(pkt) < 12 || binary.BigEndian.Uint32(pkt[4:]) != asfIANA || pkt[8] != 0x80 {
+		return errBadPacket
+	}
+	pong := []byte{0x06, 0x00, 0xff, classASF, 0, 0, 0x11, 0xbe, 0x40, pkt[9], 0, 0x10,
+		0, 0, 0x11, 0xbe, // IANA number
+		0, 0, 0, 0, // OEM-defined
+		0x81, // supported entities: IPMI
+		0,    // supported interactions
+		0, 0, 0, 0, 0, 0,
+	}
+	_, err := conn.WriteTo(pong, addr)
+	return err
+}
+
+// Remove sessions which have timed out. s.mu must be held.
+func (s *Server) expireSessions() {
+	now := time.Now()
+	for id, sess := range s.sessions {
+		if now.Sub(sess.lastUsed) > sessionTimeout {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Handle an RMCP+ Open Session Request (13.17), returning the response.
+func (s *Server) openSession(addr net.Addr, req []byte) ([]byte, error) {
+	if len(req) < 32 {
+		return nil, errBadPacket
+	}
+	tag := req[0]
+	consoleID := binary.LittleEndian.Uint32(req[4:])
+	// The session's maximum privilege is what the client asked for (zero
+	// meaning the highest available), up to the server's limit.
+	maxPriv := req[1] & 0x0f
+	if maxPriv == 0 || maxPriv > s.maxPriv {
+		maxPriv = s.maxPriv
+	}
+	reply := func(status byte, rest ...byte) []byte {
+		payload := []byte{tag, status, maxPriv, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(payload[4:], consoleID)
+		return buildV2(v2Packet{
+			payloadType: payloadOpenResponse,
+			payload:     append(payload, rest...),
+		}, nil)
+	}
+	// We only support cipher suite 3, so check for its algorithms:
+	// RAKP-HMAC-SHA1, HMAC-SHA1-96 and AES-CBC-128. (12.21)
+	for i, status := range []byte{0x04, 0x05, 0x10} {
+		alg := req[8+8*i:]
+		if alg[0] != byte(i) || alg[4]&0x3f != 0x01 {
+			return reply(status), nil
+		}
+	}
+	if req[1]&0x0f > privAdmin {
+		return reply(0x09), nil // invalid role
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireSessions()
+	if len(s.sessions) >= maxSessions {
+		return reply(0x01), nil // insufficient resources
+	}
+	sess := &session{
+		addr:      addr,
+		consoleID: consoleID,
+		lastUsed:  time.Now(),
+		responses: make(map[uint32][]byte),
+		maxPriv:   maxPriv,
+		priv:      privUser,
+	}
+	for sess.bmcID == 0 || s.sessions[sess.bmcID] != nil {
+		var id [4]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, err
+		}
+		sess.bmcID = binary.LittleEndian.Uint32(id[:])
+	}
+	s.sessions[sess.bmcID] = sess
+	rest := make([]byte, 4, 28)
+	binary.LittleEndian.PutUint32(rest, sess.bmcID)
+	rest = append(rest,
+		0, 0, 0, 8, 0x01, 0, 0, 0,
+		1, 0, 0, 8, 0x01, 0, 0, 0,
+		2, 0, 0, 8, 0x01, 0, 0, 0)
+	return reply(0, rest...), nil
+}
+
+// Look up a session which has not yet been activated, by the BMC session
+// ID in a RAKP message. s.mu must be held.
+func (s *Server) pendingSession(msg []byte) *session {
+	sess := s.sessions[binary.LittleEndian.Uint32(msg[4:])]
+	if sess == nil || sess.active {
+		return nil
+	}
+	sess.lastUsed = time.Now()
+	return sess
+}
+
+// Handle RAKP Message 1 (13.20), returning RAKP Message 2.
+func (s *Server) rakp1(msg []byte) ([]byte, error) {
+	if len(msg) < 28 || len(msg) != 28+int(msg[27]) {
+		return nil, errBadPacket
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.pendingSession(msg)
+	if sess == nil {
+		return nil, errors.New("RAKP 1 for unknown session")
+	}
+	reply := func(status byte, rest ...byte) []byte {
+		payload := []byte{msg[0], status, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(payload[4:], sess.consoleID)
+		return buildV2(v2Packet{
+			payloadType: payloadRAKP2,
+			payload:     append(payload, rest...),
+		}, nil)
+	}
+	sess.rm = append([]byte(nil), msg[8:24]...)
+	sess.role = msg[24]
+	user := msg[28:]
+	if string(user) != string(s.user) {
+		delete(s.sessions, sess.bmcID)
+		return reply(0x0d), nil // unauthorized name
+	}
+	if role := sess.role & 0x0f; role > privAdmin {
+		delete(s.sessions, sess.bmcID)
+		return reply(0x09), nil // invalid role
+	} else if role != 0 && role < sess.maxPriv {
+		sess.maxPriv = role
+	}
+	sess.rc = make([]byte, 16)
+	if _, err := rand.Read(sess.rc); err != nil {
+		return nil, err
+	}
+	var ids [8]byte
+	binary.LittleEndian.PutUint32(ids[:], sess.consoleID)
+	binary.LittleEndian.PutUint32(ids[4:], sess.bmcID)
+	auth := hmacSHA1(s.password, ids[:], sess.rm, sess.rc, s.guid,
+		[]byte{sess.role, byte(len(user))}, user)
+	rest := append(append(append([]byte(nil), sess.rc...), s.guid...), auth...)
+	return reply(0, rest...), nil
+}
+
+// Handle RAKP Message 3 (13.22), returning RAKP Message 4 and activating
+// the session if the client proved it knows the password.
+func (s *Server) rakp3(msg []byte) ([]byte, error) {
+	if len(msg) < 8 {
+		return nil, errBadPacket
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.pendingSession(msg)
+	if sess == nil || sess.rc == nil {
+		return nil, errors.New("RAKP 3 for unknown session")
+	}
+	reply := func(status byte, rest ...byte) []byte {
+		payload := []byte{msg[0], status, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(payload[4:], sess.consoleID)
+		return buildV2(v2Packet{
+			payloadType: payloadRAKP4,
+			payload:     append(payload, rest...),
+		}, nil)
+	}
+	if msg[1] != 0 {
+		// The client is aborting the session.
+		delete(s.sessions, sess.bmcID)
+		return nil, nil
+	}
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], sess.consoleID)
+	want := hmacSHA1(s.password, sess.rc, id[:], []byte{sess.role, byte(len(s.user))}, s.user)
+	if len(msg) != 8+len(want) || !hmac.Equal(msg[8:], want) {
+		delete(s.sessions, sess.bmcID)
+		s.log.Warn("Rejected login with the wrong password", "remote", sess.addr.String())
+		return reply(0x0f), nil // invalid integrity check value
+	}
+	sess.keys = deriveKeys(s.password, sess.rm, sess.rc, sess.role, s.user)
+	sess.active = true
+	binary.LittleEndian.PutUint32(id[:], sess.bmcID)
+	icv := hmacSHA1(sess.keys.sik, sess.rm, id[:], s.guid)[:authCodeLen]
+	return reply(0, icv...), nil
+}
+
+// Check that seq is in the window of sequence numbers acceptable for sess,
+// and hasn't been seen before, recording it (15.9). s.mu must be held.
+func (sess *session) checkSeq(seq uint32) bool {
+	switch {
+	case seq == 0:
+		return false
+	case seq > sess.inSeq:
+		shift := seq - sess.inSeq
+		if shift >= 32 {
+			sess.inSeen = 0
+		} else {
+			sess.inSeen <<= shift
+		}
+		sess.inSeq = seq
+		sess.inSeen |= 1
+		return true
+	case sess.inSeq-seq >= 32:
+		return false
+	default:
+		bit := uint32(1) << (sess.inSeq - seq)
+		if sess.inSeen&bit != 0 {
+			return false
+		}
+		sess.inSeen |= bit
+		return true
+	}
+}
+
+// Handle an IPMI message received over RMCP+. body is the packet, without
+// its RMCP header, and p is its parse without checking its integrity.
+func (s *Server) handleIPMI(conn net.PacketConn, addr net.Addr, body []byte, p v2Packet) error {
+	if p.sessionID == 0 {
+		// Outside a session, only unauthenticated messages are
+		// accepted.
+		if p.payloadType != payloadIPMI {
+			return errBadPacket
+		}
+		req, err := parseRequest(p.payload)
+		if err != nil {
+			return err
+		}
+		cc, data := s.sessionless(req)
+		_, err = conn.WriteTo(buildV2(v2Packet{
+			payloadType: payloadIPMI,
+			payload:     req.response(cc, data),
+		}, nil), addr)
+		return err
+	}
+
+	s.mu.Lock()
+	sess := s.sessions[p.sessionID]
+	if sess != nil && time.Since(sess.lastUsed) > sessionTimeout {
+		delete(s.sessions, p.sessionID)
+		sess = nil
+	}
+	if sess == nil || !sess.active {
+		s.mu.Unlock()
+		return errors.New("message for unknown session")
+	}
+	k1, k2 := sess.keys.k1, sess.keys.k2
+	s.mu.Unlock()
+
+	// Cipher suite 3 requires both integrity and confidentiality.
+	if p.payloadType != payloadIPMI|payloadAuthed|payloadEncrypted {
+		return errors.New("message is not authenticated and encrypted")
+	}
+	p, err := parseV2(body, k1)
+	if err != nil {
+		return err
+	}
+	msg, err := decrypt(k2, p.payload)
+	if err != nil {
+		return err
+	}
+	req, err := parseRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.sessions[p.sessionID] != sess || !sess.checkSeq(p.seq) {
+		s.mu.Unlock()
+		return errors.New("bad session sequence number")
+	}
+	sess.addr = addr
+	sess.lastUsed = time.Now()
+	key := cacheKey(req)
+	resp, seen := sess.responses[key]
+	if !seen {
+		// Mark the request as in progress, so that retransmissions
+		// while we are working on it are ignored.
+		sess.responses[key] = nil
+		sess.order = append(sess.order, key)
+		if len(sess.order) > responseCacheSize {
+			delete(sess.responses, sess.order[0])
+			sess.order = sess.order[1:]
+		}
+	}
+	s.mu.Unlock()
+
+	if seen {
+		if resp != nil {
+			return s.send(conn, sess, key, resp)
+		}
+		return nil
+	}
+	s.dispatch(sess, req, func(cc byte, data []byte) {
+		if err := s.send(conn, sess, key, req.response(cc, data)); err != nil {
+			s.log.Debug("Error sending response", "remote", addr.String(), "err", err)
+		}
+	})
+	return nil
+}
+
+// Identify a request, for recognising retransmissions: clients reuse the
+// sequence number, function and command when retrying.
+func cacheKey(req request) uint32 {
+	return uint32(req.rqSeq)<<16 | uint32(req.netFn)<<8 | uint32(req.cmd)
+}
+
+// Send a response message within sess, remembering it under key.
+func (s *Server) send(conn net.PacketConn, sess *session, key uint32, msg []byte) error {
+	payload, err := encrypt(sess.keys.k2, msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if _, ok := sess.responses[key]; ok {
+		sess.responses[key] = msg
+	}
+	sess.outSeq++
+	pkt := buildV2(v2Packet{
+		payloadType: payloadIPMI | payloadEncrypted,
+		sessionID:   sess.consoleID,
+		seq:         sess.outSeq,
+		payload:     payload,
+	}, sess.keys.k1)
+	addr := sess.addr
+	s.mu.Unlock()
+	_, err = conn.WriteTo(pkt, addr)
+	return err
+}
+
+// Run op on the backend, after any operations already queued.
+func (s *Server) enqueue(op func(ctx context.Context)) {
+	s.ops <- op
+}
@@ -0,0 +1,408 @@
+package vbmc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// A Backend recording the operations performed on it.
+type fakeBackend struct {
+	sync.Mutex
+	on  bool
+	ops []string
+}
+
+func (b *fakeBackend) record(op string) {
+	b.Lock()
+	defer b.Unlock()
+	b.ops = append(b.ops, op)
+}
+
+func (b *fakeBackend) PowerStatus(ctx context.Context) (driver.PowerState, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.on {
+		return driver.PowerStateOn, nil
+	}
+	return driver.PowerStateOff, nil
+}
+
+func (b *fakeBackend) PowerOn(ctx context.Context) error {
+	b.record("on")
+	b.Lock()
+	defer b.Unlock()
+	b.on = true
+	return nil
+}
+
+func (b *fakeBackend) PowerOff(ctx context.Context) error {
+	b.record("off")
+	b.Lock()
+	defer b.Unlock()
+	b.on = false
+	return nil
+}
+
+func (b *fakeBackend) PowerCycle(ctx context.Context, force bool) error {
+	if force {
+		b.record("reset")
+	} else {
+		b.record("cycle")
+	}
+	return nil
+}
+
+func (b *fakeBackend) SetBootdev(ctx context.Context, dev string) error {
+	b.record("bootdev " + dev)
+	return nil
+}
+
+func (b *fakeBackend) Ops() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string(nil), b.ops...)
+}
+
+// An IPMI client, doing what ipmitool does with "-I lanplus".
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	bmcID   uint32
+	keys    keys
+	seq     uint32
+	rqSeq   byte
+	timeout time.Duration
+}
+
+const testConsoleID = 0xa0a2a3a4
+
+func newTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, conn: conn, timeout: 5 * time.Second}
+}
+
+// Send pkt, and return the next packet received, or nil on timeout.
+func (c *testClient) roundTrip(pkt []byte) []byte {
+	if _, err := c.conn.Write(pkt); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	buf := make([]byte, 1024)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		c.t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// Send a pre-session RMCP+ payload, returning the response payload.
+func (c *testClient) sendPayload(typ byte, payload []byte) []byte {
+	resp := c.roundTrip(buildV2(v2Packet{payloadType: typ, payload: payload}, nil))
+	if resp == nil {
+		c.t.Fatalf("No response to payload type %#x", typ)
+	}
+	p, err := parseV2(resp[4:], nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if p.payloadType != typ+1 {
+		c.t.Fatalf("Got payload type %#x in response to %#x", p.payloadType, typ)
+	}
+	return p.payload
+}
+
+// Build an IPMI request message.
+func (c *testClient) message(netFn, cmd byte, data []byte) []byte {
+	c.rqSeq = (c.rqSeq + 1) & 0x3f
+	msg := []byte{bmcAddr, netFn << 2, 0}
+	msg[2] = checksum(msg[:2])
+	msg = append(msg, 0x81, c.rqSeq<<2, cmd)
+	msg = append(msg, data...)
+	return append(msg, checksum(msg[3:]))
+}
+
+// Check a response message, returning its completion code and data.
+func (c *testClient) parseResponse(msg []byte, netFn, cmd byte) (cc byte, data []byte) {
+	if len(msg) < 8 || checksum(msg[:3]) != 0 || checksum(msg[3:]) != 0 {
+		c.t.Fatalf("Bad response message: %x", msg)
+	}
+	if msg[1]>>2 != netFn+1 || msg[4]>>2 != c.rqSeq || msg[5] != cmd {
+		c.t.Fatalf("Response %x doesn't match request", msg)
+	}
+	return msg[6], msg[7 : len(msg)-1]
+}
+
+// Open a session, returning the RAKP 4 status.
+func (c *testClient) open(user, password string) byte {
+	req := make([]byte, 32)
+	req[1] = privAdmin
+	binary.LittleEndian.PutUint32(req[4:], testConsoleID)
+	copy(req[8:], []byte{0, 0, 0, 8, 1, 0, 0, 0, 1, 0, 0, 8, 1, 0, 0, 0, 2, 0, 0, 8, 1, 0, 0, 0})
+	resp := c.sendPayload(payloadOpenSession, req)
+	if resp[1] != 0 {
+		c.t.Fatalf("Open session failed with status %#x", resp[1])
+	}
+	if binary.LittleEndian.Uint32(resp[4:]) != testConsoleID {
+		c.t.Fatal("Wrong console session ID in open session response")
+	}
+	c.bmcID = binary.LittleEndian.Uint32(resp[8:])
+
+	rm := bytes.Repeat([]byte{0x42}, 16)
+	role := byte(privAdmin | 0x10) // name-only lookup, as ipmitool does.
+	rakp1 := make([]byte, 28)
+	binary.LittleEndian.PutUint32(rakp1[4:], c.bmcID)
+	copy(rakp1[8:], rm)
+	rakp1[24] = role
+	rakp1[27] = byte(len(user))
+	rakp2 := c.sendPayload(payloadRAKP1, append(rakp1, user...))
+	if rakp2[1] != 0 {
+		return rakp2[1]
+	}
+	rc, guid := rakp2[8:24], rakp2[24:40]
+	var sids [8]byte
+	binary.LittleEndian.PutUint32(sids[:], testConsoleID)
+	binary.LittleEndian.PutUint32(sids[4:], c.bmcID)
+	want := hmacSHA1([]byte(password), sids[:], rm, rc, guid, []byte{role, byte(len(user))}, []byte(user))
+	if !hmac.Equal(want, rakp2[40:]) {
+		// The BMC's password differs from ours; ipmitool gives up
+		// here, but carry on to check the BMC rejects RAKP 3.
+		c.t.Log("RAKP 2 auth code mismatch")
+	}
+
+	rakp3 := make([]byte, 8)
+	binary.LittleEndian.PutUint32(rakp3[4:], c.bmcID)
+	rakp3 = append(rakp3, hmacSHA1([]byte(password), rc, sids[:4], []byte{role, byte(len(user))}, []byte(user))...)
+	rakp4 := c.sendPayload(payloadRAKP3, rakp3)
+	if rakp4[1] != 0 {
+		return rakp4[1]
+	}
+	c.keys = deriveKeys([]byte(password), rm, rc, role, []byte(user))
+	icv := hmacSHA1(c.keys.sik, rm, sids[4:], guid)[:authCodeLen]
+	if !hmac.Equal(icv, rakp4[8:]) {
+		c.t.Fatal("RAKP 4 integrity check value mismatch")
+	}
+	return 0
+}
+
+// Build an encrypted, authenticated packet carrying msg in the session.
+func (c *testClient) packet(msg []byte) []byte {
+	payload, err := encrypt(c.keys.k2, msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.seq++
+	return buildV2(v2Packet{
+		payloadType: payloadIPMI | payloadEncrypted,
+		sessionID:   c.bmcID,
+		seq:         c.seq,
+		payload:     payload,
+	}, c.keys.k1)
+}
+
+// Decode a response packet received in the session.
+func (c *testClient) unpack(pkt []byte) []byte {
+	p, err := parseV2(pkt[4:], c.keys.k1)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if p.sessionID != testConsoleID || p.payloadType != payloadIPMI|payloadEncrypted|payloadAuthed {
+		c.t.Fatalf("Unexpected response header: %+v", p)
+	}
+	msg, err := decrypt(c.keys.k2, p.payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// Run a command in the session, returning its completion code and data.
+func (c *testClient) run(netFn, cmd byte, data ...byte) (cc byte, resp []byte) {
+	pkt := c.roundTrip(c.packet(c.message(netFn, cmd, data)))
+	if pkt == nil {
+		c.t.Fatalf("No response to command %#x/%#x", netFn, cmd)
+	}
+	return c.parseResponse(c.unpack(pkt), netFn, cmd)
+}
+
+func startServer(t *testing.T, backend Backend, privilege string) (addr string, stop func()) {
+	srv, err := NewServer(backend, "node-1", "admin", "secret", privilege)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.Serve(conn)
+		close(done)
+	}()
+	return conn.LocalAddr().String(), func() {
+		conn.Close()
+		<-done
+	}
+}
+
+// Wait for the backend's operations to be ops.
+func waitOps(t *testing.T, b *fakeBackend, ops ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(b.Ops(), ops) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Backend operations: got %q, want %q", b.Ops(), ops)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSession(t *testing.T) {
+	backend := &fakeBackend{}
+	addr, stop := startServer(t, backend, "")
+	defer stop()
+	c := newTestClient(t, addr)
+	defer c.conn.Close()
+
+	// Presence ping:
+	pong := c.roundTrip([]byte{0x06, 0x00, 0xff, 0x06, 0, 0, 0x11, 0xbe, 0x80, 0x07, 0, 0})
+	if len(pong) < 28 || pong[8] != 0x40 || pong[9] != 0x07 {
+		t.Fatalf("Bad presence pong: %x", pong)
+	}
+
+	// Channel capabilities, over IPMI 1.5:
+	resp := c.roundTrip(buildV15(c.message(netFnApp, cmdGetChannelAuthCaps, []byte{0x8e, 0x04})))
+	_, msg, err := parseV15(resp[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, data := c.parseResponse(msg, netFnApp, cmdGetChannelAuthCaps)
+	if cc != 0 || data[1]&0x80 == 0 || data[3]&0x02 == 0 {
+		t.Fatalf("Channel doesn't advertise IPMI 2.0: cc=%#x data=%x", cc, data)
+	}
+
+	if status := c.open("admin", "secret"); status != 0 {
+		t.Fatalf("RAKP failed with status %#x", status)
+	}
+	if cc, data := c.run(netFnApp, cmdSetSessionPrivilege, privAdmin); cc != 0 || data[0] != privAdmin {
+		t.Fatalf("Set session privilege: cc=%#x data=%x", cc, data)
+	}
+	if cc, _ := c.run(netFnApp, 0x42); cc != ccInvalidCommand {
+		t.Fatalf("Unknown command: got cc=%#x, want %#x", cc, ccInvalidCommand)
+	}
+
+	cc, data = c.run(netFnChassis, cmdGetChassisStatus)
+	if cc != 0 || data[0]&1 != 0 {
+		t.Fatalf("Chassis status: cc=%#x data=%x, want off", cc, data)
+	}
+	if cc, _ := c.run(netFnChassis, cmdChassisControl, 0x01); cc != 0 {
+		t.Fatalf("Power on: cc=%#x", cc)
+	}
+	// Status queries are queued after earlier operations, so this sees
+	// the node on:
+	cc, data = c.run(netFnChassis, cmdGetChassisStatus)
+	if cc != 0 || data[0]&1 != 1 {
+		t.Fatalf("Chassis status: cc=%#x data=%x, want on", cc, data)
+	}
+
+	// A retransmitted request (same sequence number, with a new session
+	// sequence number) gets the same response, without repeating the
+	// operation:
+	req := c.message(netFnChassis, cmdChassisControl, []byte{0x02})
+	for i := 0; i < 2; i++ {
+		pkt := c.roundTrip(c.packet(req))
+		if cc, _ := c.parseResponse(c.unpack(pkt), netFnChassis, cmdChassisControl); cc != 0 {
+			t.Fatalf("Power cycle: cc=%#x", cc)
+		}
+	}
+	if cc, _ := c.run(netFnChassis, cmdChassisControl, 0x05); cc != ccInvalidField {
+		t.Fatalf("Soft shutdown: got cc=%#x, want %#x", cc, ccInvalidField)
+	}
+
+	// Boot device, as set by "ipmitool chassis bootdev pxe":
+	if cc, _ := c.run(netFnChassis, cmdSetSystemBootOptions, 0x05, 0x80, 0x04, 0, 0, 0); cc != 0 {
+		t.Fatalf("Set boot flags: cc=%#x", cc)
+	}
+	cc, data = c.run(netFnChassis, cmdGetSystemBootOptions, 0x05, 0, 0)
+	if cc != 0 || !bytes.Equal(data, []byte{0x01, 0x05, 0x80, 0x04, 0, 0, 0}) {
+		t.Fatalf("Get boot flags: cc=%#x data=%x", cc, data)
+	}
+	waitOps(t, backend, "on", "cycle", "bootdev pxe")
+
+	// A replayed packet is ignored:
+	c.timeout = 200 * time.Millisecond
+	pkt := c.packet(c.message(netFnChassis, cmdChassisControl, []byte{0x00}))
+	if c.roundTrip(pkt) == nil || c.roundTrip(pkt) != nil {
+		t.Fatal("Replayed packet was not ignored")
+	}
+	waitOps(t, backend, "on", "cycle", "bootdev pxe", "off")
+
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], c.bmcID)
+	if cc, _ := c.run(netFnApp, cmdCloseSession, id[:]...); cc != 0 {
+		t.Fatalf("Close session: cc=%#x", cc)
+	}
+	if c.roundTrip(c.packet(c.message(netFnChassis, cmdGetChassisStatus, nil))) != nil {
+		t.Fatal("Got a response in a closed session")
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	backend := &fakeBackend{}
+	addr, stop := startServer(t, backend, "")
+	defer stop()
+	c := newTestClient(t, addr)
+	defer c.conn.Close()
+
+	if status := c.open("root", "secret"); status != 0x0d {
+		t.Fatalf("Wrong user: got status %#x, want unauthorized name", status)
+	}
+	if status := c.open("admin", "wrong"); status != 0x0f {
+		t.Fatalf("Wrong password: got status %#x, want invalid integrity check value", status)
+	}
+}
+
+func TestPrivilegeLimit(t *testing.T) {
+	if _, err := NewServer(&fakeBackend{}, "node-1", "admin", "secret", "root"); err == nil {
+		t.Fatal("Unknown privilege level was accepted")
+	}
+	backend := &fakeBackend{}
+	addr, stop := startServer(t, backend, "user")
+	defer stop()
+	c := newTestClient(t, addr)
+	defer c.conn.Close()
+
+	// Sessions can be opened asking for more, but the privilege level
+	// can't be raised past the limit:
+	if status := c.open("admin", "secret"); status != 0 {
+		t.Fatalf("RAKP failed with status %#x", status)
+	}
+	if cc, _ := c.run(netFnApp, cmdSetSessionPrivilege, privAdmin); cc != 0x81 {
+		t.Fatalf("Set session privilege above the limit: got cc=%#x, want 0x81", cc)
+	}
+	if cc, data := c.run(netFnApp, cmdSetSessionPrivilege, privUser); cc != 0 || data[0] != privUser {
+		t.Fatalf("Set session privilege: cc=%#x data=%x", cc, data)
+	}
+	if cc, _ := c.run(netFnChassis, cmdGetChassisStatus); cc != 0 {
+		t.Fatalf("Chassis status: cc=%#x", cc)
+	}
+	if cc, _ := c.run(netFnChassis, cmdChassisControl, 0x01); cc != ccInsufficientPrivilege {
+		t.Fatalf("Power on as user: got cc=%#x, want insufficient privilege", cc)
+	}
+	if ops := backend.Ops(); len(ops) != 0 {
+		t.Fatalf("Backend operations: got %q, want none", ops)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// A declarative description of the nodes that should be registered. The
+// keys of Nodes are node labels, and the values are the same JSON accepted
+// as the body of `PUT /node/{node_id}`.
+type Inventory struct {
+	Nodes map[string]json.RawMessage `json:"nodes"`
+}
+
+// Read an inventory from the JSON file at path.
+func LoadInventory(path string) (*Inventory, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inv Inventory
+	err = json.Unmarshal(buf, &inv)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// Bring the registered nodes in line with inv: nodes which are missing are
+// created, and nodes whose info differs from inv are updated in place (see
+// State.UpdateNodeInfo), keeping their owners, power groups, PDU outlets
+// and other settings, but invalidating their tokens. If prune is true,
+// nodes not listed in inv are deleted.
+//
+// Failures for individual nodes are logged and do not stop reconciliation
+// of the others; if any occur, an error reporting how many is returned.
+func (d *LocalDaemon) Reconcile(inv *Inventory, prune bool) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+
+	failures := 0
+	fail := func(label, op string, err error) {
+		logger.Error("Failed to reconcile node with inventory",
+			"subsystem", "inventory", "node", label, "op", op, "err", err)
+		failures++
+	}
+
+	for label, info := range inv.Nodes {
+		info, err := expandTemplate(d.templates, info)
+		if err != nil {
+			fail(label, "expand template", err)
+			continue
+		}
+		reason, inMaintenance := d.state.Maintenance(label)
+		drainReason, draining := d.state.Draining(label)
+		node, err := d.state.GetNode(label)
+		switch err {
+		case nil:
+			if sameJSON(node.ConnInfo, info) {
+				continue
+			}
+			if err = d.state.UpdateNodeInfo(label, info); err != nil {
+				fail(label, "update", err)
+				continue
+			}
+			if node, err = d.state.GetNode(label); err != nil {
+				fail(label, "update", err)
+				continue
+			}
+			node.Lock()
+			node.acquireOBM()
+			node.ClearToken()
+			node.releaseOBM()
+			node.Unlock()
+			d.publish("node_updated", label, nil)
+			continue
+		case obmd.ErrNoSuchNode:
+			if err = d.labels.check(label); err != nil {
+				fail(label, "register", err)
+				continue
+			}
+		case obmd.ErrNodeQuarantined:
+		default:
+			fail(label, "look up", err)
+			continue
+		}
+		_, err = d.state.NewNode(label, info)
+		if err != nil {
+			fail(label, "register", err)
+			continue
+		}
+		if inMaintenance {
+			// Re-registering the node mustn't take it out of
+			// maintenance mode.
+			if err = d.state.SetMaintenance(label, true, reason); err != nil {
+				fail(label, "keep in maintenance", err)
+			}
+		}
+		if draining {
+			if err = d.state.SetDraining(label, true, drainReason); err != nil {
+				fail(label, "keep draining", err)
+			}
+		}
+		d.publish("node_registered", label, nil)
+	}
+
+	if prune {
+		for _, label := range d.state.Labels() {
+			if _, ok := inv.Nodes[label]; ok {
+				continue
+			}
+			err := d.state.DeleteNode(label)
+			if err != nil {
+				fail(label, "prune", err)
+				continue
+			}
+			d.publish("node_deleted", label, nil)
+		}
+	}
+
+	d.state.check()
+	if failures != 0 {
+		return fmt.Errorf("Failed to reconcile %d node(s); see log for details.", failures)
+	}
+	return nil
+}
+
+// Report whether a and b are semantically equivalent JSON values, i.e.
+// they differ at most in whitespace and the order of object keys.
+func sameJSON(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+func mockNodeInfo(addr string) json.RawMessage {
+	return json.RawMessage(`{"type": "ipmi", "info": {"addr": "` + addr + `"}}`)
+}
+
+// Check that Reconcile creates, updates, and (optionally) prunes nodes.
+func TestReconcile(t *testing.T) {
+	daemon := newTestDaemon()
+	errpanic(daemon.SetNode("keep", mockNodeInfo("10.0.0.1")))
+	errpanic(daemon.SetNode("change", mockNodeInfo("10.0.0.2")))
+	errpanic(daemon.SetNode("extra", mockNodeInfo("10.0.0.3")))
+	keepToken, err := daemon.GetNodeToken(context.Background(), "keep")
+	errpanic(err)
+	changeToken, err := daemon.GetNodeToken(context.Background(), "change")
+	errpanic(err)
+	// The changed node's other settings should survive the update:
+	errpanic(daemon.TransferNode(context.Background(), "change", "project"))
+	_, err = daemon.SetPowerGroup(context.Background(), "group", 100, []string{"change"})
+	errpanic(err)
+	errpanic(daemon.SetPDUOutlet(obmd.PDUOutlet{PDU: "pdu", Outlet: "1", Node: "change"}))
+
+	inv := &Inventory{Nodes: map[string]json.RawMessage{
+		// Same info, modulo formatting:
+		"keep":   json.RawMessage(`{"info":{"addr":"10.0.0.1"},"type":"ipmi"}`),
+		"change": mockNodeInfo("10.0.0.20"),
+		"new":    mockNodeInfo("10.0.0.4"),
+	}}
+
+	checkLabels := func(expected ...string) {
+		actual := daemon.state.Labels()
+		sort.Strings(actual)
+		sort.Strings(expected)
+		if len(actual) != len(expected) {
+			t.Fatalf("Expected nodes %v but got %v", expected, actual)
+		}
+		for i := range actual {
+			if actual[i] != expected[i] {
+				t.Fatalf("Expected nodes %v but got %v", expected, actual)
+			}
+		}
+	}
+
+	if err := daemon.Reconcile(inv, false); err != nil {
+		t.Fatal("Reconcile:", err)
+	}
+	checkLabels("keep", "change", "new", "extra")
+
+	// An unchanged node should keep its token; a changed node should not.
+	if err := daemon.PowerOffNode(context.Background(), "keep", &keepToken); err != nil {
+		t.Fatal("Token for unchanged node was invalidated:", err)
+	}
+	if err := daemon.PowerOffNode(context.Background(), "change", &changeToken); err != obmd.ErrInvalidToken {
+		t.Fatal("Token for changed node is still valid; err =", err)
+	}
+	if project, _, err := daemon.NodeOwner("change"); err != nil || project != "project" {
+		t.Fatalf("Changed node lost its owner: %q (%v)", project, err)
+	}
+	if group, err := daemon.state.PowerGroupOf("change"); err != nil || group != "group" {
+		t.Fatalf("Changed node lost its power group: %q (%v)", group, err)
+	}
+	if outlets, err := daemon.PDUOutlets("pdu"); err != nil || len(outlets) != 1 || outlets[0].Node != "change" {
+		t.Fatalf("Changed node lost its PDU outlet: %+v (%v)", outlets, err)
+	}
+
+	if err := daemon.Reconcile(inv, true); err != nil {
+		t.Fatal("Reconcile (prune):", err)
+	}
+	checkLabels("keep", "change", "new")
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/kube"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The defaults for KubernetesConfig.
+const (
+	defaultKubeResource       = "obmnodes.obmd.io/v1alpha1"
+	defaultKubeStatusInterval = time.Minute
+)
+
+// How long to wait before listing the resources again, after an error.
+const kubeRetryDelay = 10 * time.Second
+
+// The status written back to each resource; see kubeController.
+type kubeNodeStatus struct {
+	// Whether the node is registered (and not quarantined).
+	Registered bool `json:"registered"`
+
+	// Whether the node's OBM answered a power status query.
+	Reachable bool `json:"reachable"`
+
+	// "on" or "off", or "" if not Reachable.
+	PowerState string `json:"powerState"`
+
+	// Why the node isn't registered or reachable, if it isn't.
+	Message string `json:"message"`
+
+	// The resource's metadata.generation when the status was checked.
+	ObservedGeneration int64 `json:"observedGeneration"`
+
+	LastChecked time.Time `json:"lastChecked"`
+}
+
+// In controller mode (see KubernetesConfig), reconciles the daemon's nodes
+// with custom resources in a Kubernetes namespace, whose names are the
+// nodes' labels and whose specs are the nodes' info (as in the body of
+// `PUT /node/{node_id}`), and periodically writes each node's status back
+// to its resource. A spec may also have a "secretRef" (see
+// kubeController.nodeInfo), so that credentials can be kept in a Secret.
+type kubeController struct {
+	client *kube.Client
+	daemon *LocalDaemon
+	config *LiveConfig
+	res    kube.Resource
+	ns     string
+	prune  bool
+	log    *logger.Logger
+
+	mu      sync.Mutex
+	objects map[string]kube.Object // the resources, by name.
+}
+
+func newKubeController(config *LiveConfig, daemon *LocalDaemon) (*kubeController, error) {
+	cfg := config.Get().Kubernetes
+	var client *kube.Client
+	var err error
+	if cfg.APIServer == "" {
+		client, err = kube.InClusterClient()
+	} else {
+		client, err = kube.NewClient(cfg.APIServer, cfg.TokenFile, cfg.CAFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resource := cfg.Resource
+	if resource == "" {
+		resource = defaultKubeResource
+	}
+	res, err := kube.ParseResource(resource)
+	if err != nil {
+		return nil, err
+	}
+	ns := cfg.Namespace
+	if ns == "" {
+		ns = kube.InClusterNamespace()
+	}
+	if ns == "" {
+		ns = "default"
+	}
+	return &kubeController{
+		client:  client,
+		daemon:  daemon,
+		config:  config,
+		res:     res,
+		ns:      ns,
+		prune:   cfg.Prune,
+		log:     logger.With("subsystem", "kubernetes", "namespace", ns),
+		objects: make(map[string]kube.Object),
+	}, nil
+}
+
+// Reconcile nodes with the resources, and update their status, until ctx
+// is done.
+func (c *kubeController) Run(ctx context.Context) {
+	go c.updateStatuses(ctx)
+	for {
+		err := c.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if kube.IsGone(err) {
+			c.log.Debug("Watch expired; listing resources again")
+			continue
+		}
+		c.log.Error("Error watching resources", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(kubeRetryDelay):
+		}
+	}
+}
+
+// List the resources and reconcile the nodes with them, then watch for
+// changes, reconciling after each, until an error occurs.
+func (c *kubeController) sync(ctx context.Context) error {
+	items, version, err := c.client.List(ctx, c.res, c.ns)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.objects = make(map[string]kube.Object, len(items))
+	for _, obj := range items {
+		c.objects[obj.Metadata.Name] = obj
+	}
+	c.mu.Unlock()
+	c.reconcile(ctx)
+	for {
+		version, err = c.client.Watch(ctx, c.res, c.ns, version, func(ev kube.Event) error {
+			c.mu.Lock()
+			switch ev.Type {
+			case "ADDED", "MODIFIED":
+				c.objects[ev.Object.Metadata.Name] = ev.Object
+			case "DELETED":
+				delete(c.objects, ev.Object.Metadata.Name)
+			default:
+				c.mu.Unlock()
+				return nil
+			}
+			c.mu.Unlock()
+			c.reconcile(ctx)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Bring the daemon's nodes in line with the resources. If a node's
+// Secret can't be read, nothing is changed (rather than pruning or
+// updating that node), until the next attempt.
+func (c *kubeController) reconcile(ctx context.Context) {
+	c.mu.Lock()
+	specs := make(map[string]json.RawMessage, len(c.objects))
+	for name, obj := range c.objects {
+		specs[name] = obj.Spec
+	}
+	c.mu.Unlock()
+	inv := &Inventory{Nodes: make(map[string]json.RawMessage, len(specs))}
+	failed := false
+	for name, spec := range specs {
+		info, err := c.nodeInfo(ctx, spec)
+		if err != nil {
+			c.log.Error("Error reading node's secret", "node", name, "err", err)
+			failed = true
+			continue
+		}
+		inv.Nodes[name] = info
+	}
+	if failed {
+		c.log.Error("Not reconciling nodes with resources until their secrets can be read")
+		return
+	}
+	if err := c.daemon.Reconcile(inv, c.prune); err != nil {
+		c.log.Error("Error reconciling nodes with resources", "err", err)
+	}
+}
+
+// Return the node info for a resource's spec. If the spec has a
+// "secretRef": {"name": <secret>}, it is removed, and the keys of that
+// Secret (in the resource's namespace) are set as fields of the spec's
+// "info", e.g. "user" and "pass". Other problems with the spec are left
+// for the daemon to report.
+func (c *kubeController) nodeInfo(ctx context.Context, spec json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(spec, &fields) != nil || fields["secretRef"] == nil {
+		return spec, nil
+	}
+	var ref struct {
+		Name string `json:"name"`
+	}
+	if json.Unmarshal(fields["secretRef"], &ref) != nil || ref.Name == "" {
+		return nil, errors.New(`secretRef must be {"name": <secret>}.`)
+	}
+	data, err := c.client.GetSecret(ctx, c.ns, ref.Name)
+	if err != nil {
+		return nil, err
+	}
+	return mergeSecret(fields, data)
+}
+
+// Remove "secretRef" from a spec's fields, and set the fields of its
+// "info" (an object, if present) from a Secret's data.
+func mergeSecret(fields map[string]json.RawMessage, data map[string][]byte) (json.RawMessage, error) {
+	delete(fields, "secretRef")
+	info := make(map[string]json.RawMessage)
+	if raw, ok := fields["info"]; ok {
+		if err := json.Unmarshal(raw, &info); err != nil || info == nil {
+			return nil, errors.New("The info must be a JSON object.")
+		}
+	}
+	for key, value := range data {
+		info[key], _ = json.Marshal(string(value))
+	}
+	var err error
+	if fields["info"], err = json.Marshal(info); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// Periodically write each resource's status, until ctx is done. This also
+// reconciles the nodes first, to pick up changes to their Secrets, which
+// aren't watched.
+func (c *kubeController) updateStatuses(ctx context.Context) {
+	for {
+		interval := time.Duration(c.config.Get().Kubernetes.StatusInterval)
+		if interval == 0 {
+			interval = defaultKubeStatusInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		c.reconcile(ctx)
+		c.mu.Lock()
+		objects := make([]kube.Object, 0, len(c.objects))
+		for _, obj := range c.objects {
+			objects = append(objects, obj)
+		}
+		c.mu.Unlock()
+		for _, obj := range objects {
+			status := c.nodeStatus(ctx, obj)
+			err := c.client.PatchStatus(ctx, c.res, c.ns, obj.Metadata.Name, status)
+			if err != nil && ctx.Err() == nil {
+				c.log.Warn("Error updating status",
+					"node", obj.Metadata.Name, "err", err)
+			}
+		}
+	}
+}
+
+// Check the status of the node for obj.
+func (c *kubeController) nodeStatus(ctx context.Context, obj kube.Object) kubeNodeStatus {
+	label := obj.Metadata.Name
+	status := kubeNodeStatus{
+		Registered:         true,
+		ObservedGeneration: obj.Metadata.Generation,
+		LastChecked:        time.Now().UTC(),
+	}
+	if reason, ok := c.daemon.QuarantinedNodes()[label]; ok {
+		status.Registered = false
+		status.Message = "Quarantined: " + reason
+		return status
+	}
+	if timeout := time.Duration(c.config.Get().OperationTimeout); timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	state, err := c.daemon.NodePowerStatus(ctx, label, nil)
+	switch err {
+	case nil:
+		status.Reachable = true
+		status.PowerState = string(state)
+	case obmd.ErrNoSuchNode:
+		// e.g. because its spec is invalid; the reason is logged.
+		status.Registered = false
+		status.Message = "Not registered; see obmd's log."
+	default:
+		status.Message = err.Error()
+	}
+	return status
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CCI-MOC/obmd/internal/kube"
+)
+
+// A spec's secretRef should be replaced by the Secret's keys, set in its
+// info; specs without one are passed through as they are.
+func TestKubeNodeInfo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/namespaces/ns/secrets/bmc" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind": "Status", "code": 404, "message": "not found"}`)
+			return
+		}
+		fmt.Fprint(w, `{"data": {"user": "YWRtaW4=", "pass": "c2VjcmV0"}}`)
+	}))
+	defer srv.Close()
+	client, err := kube.NewClient(srv.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &kubeController{client: client, ns: "ns"}
+	ctx := context.Background()
+
+	cases := []struct {
+		spec, info string
+	}{
+		{`{"type": "ipmi", "info": {"addr": "10.0.0.4"}}`,
+			`{"type": "ipmi", "info": {"addr": "10.0.0.4"}}`},
+		{`{"type": "ipmi", "info": {"addr": "10.0.0.4", "pass": "old"}, "secretRef": {"name": "bmc"}}`,
+			`{"type": "ipmi", "info": {"addr": "10.0.0.4", "user": "admin", "pass": "secret"}}`},
+		{`{"template": "r640", "secretRef": {"name": "bmc"}}`,
+			`{"template": "r640", "info": {"user": "admin", "pass": "secret"}}`},
+	}
+	for _, tc := range cases {
+		info, err := c.nodeInfo(ctx, []byte(tc.spec))
+		if err != nil || !sameJSON(info, []byte(tc.info)) {
+			t.Errorf("nodeInfo(%s) = %s, %v; expected %s.", tc.spec, info, err, tc.info)
+		}
+	}
+	for _, spec := range []string{
+		`{"type": "ipmi", "secretRef": {"name": "other"}}`,
+		`{"type": "ipmi", "secretRef": "bmc"}`,
+		`{"type": "ipmi", "info": [], "secretRef": {"name": "bmc"}}`,
+	} {
+		if info, err := c.nodeInfo(ctx, []byte(spec)); err == nil {
+			t.Errorf("Expected an error for %s, but got %s.", spec, info)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The longest label the database can store; see the nodes table in
+// NewState.
+const maxLabelLength = 80
+
+// The default for Config.LabelPattern. Labels appear in URLs, so by default
+// they are limited to characters which need no escaping there.
+const defaultLabelPattern = `^[A-Za-z0-9][A-Za-z0-9._-]*$`
+
+var defaultLabelRegexp = regexp.MustCompile(defaultLabelPattern)
+
+// The labels which new nodes may be given.
+type labelPolicy struct {
+	pattern *regexp.Regexp
+	maxLen  int
+}
+
+// Check that label is allowed by the policy.
+func (p labelPolicy) check(label string) error {
+	if len(label) > p.maxLen {
+		return obmd.InvalidLabelError{
+			Label:  label,
+			Reason: fmt.Sprintf("longer than %d bytes", p.maxLen),
+		}
+	}
+	if !p.pattern.MatchString(label) {
+		return obmd.InvalidLabelError{
+			Label:  label,
+			Reason: fmt.Sprintf("doesn't match %q", p.pattern.String()),
+		}
+	}
+	return nil
+}
+
+// Only allow new nodes (whether registered or renamed) to have labels
+// which match pattern (nil means the default, which allows letters, digits,
+// '.', '_' and '-', not starting with punctuation), and are at most maxLen
+// bytes long (zero means the maximum the database can store, which is 80).
+// Existing nodes keep their labels. This may be called at any time.
+func (d *LocalDaemon) SetLabelPolicy(pattern *regexp.Regexp, maxLen int) {
+	if pattern == nil {
+		pattern = defaultLabelRegexp
+	}
+	if maxLen == 0 {
+		maxLen = maxLabelLength
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.labels = labelPolicy{pattern: pattern, maxLen: maxLen}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Provides the certificate for a TLS listener, loaded from a pair of files.
+// The file names are supplied by a function, so that they may come from a
+// LiveConfig; Reload re-reads the files, allowing certificates to be
+// rotated without a restart.
+type certLoader struct {
+	sync.RWMutex
+	cert  *tls.Certificate
+	paths func() (certFile, keyFile string)
+}
+
+// Create a certLoader, and load the initial certificate.
+func newCertLoader(paths func() (certFile, keyFile string)) (*certLoader, error) {
+	ret := &certLoader{paths: paths}
+	err := ret.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Re-read the certificate. On failure, the old certificate is kept.
+func (l *certLoader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(l.paths())
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.cert = &cert
+	return nil
+}
+
+// Return the current certificate. This has the signature required by
+// tls.Config.GetCertificate.
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.cert, nil
+}
+
+// The default period for TCP keepalives; see Config.TCPKeepAlivePeriod.
+const defaultKeepAlivePeriod = 3 * time.Minute
+
+// A net.Listener which enables TCP keepalives on accepted connections, so
+// that clients which vanish without closing their connections (e.g. due to
+// a network failure) are eventually noticed, even if we aren't sending
+// them anything. This is what http.ListenAndServe does, but we need to
+// create the listener ourselves; see listener.bind.
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(l.period)
+	return conn, nil
+}
+
+// Listen for TCP connections on addr, with keepalives sent every period
+// (or defaultKeepAlivePeriod, if period is zero).
+func listenTCP(addr string, period time.Duration) (net.Listener, error) {
+	if period == 0 {
+		period = defaultKeepAlivePeriod
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return keepAliveListener{ln.(*net.TCPListener), period}, nil
+}
+
+// An http.Server, which serves TLS if certs is not nil.
+type listener struct {
+	srv       *http.Server
+	certs     *certLoader
+	keepAlive time.Duration
+	ln        net.Listener // nil until bind is called.
+}
+
+// Create an http.Server for addr, applying the limits from config.
+func newServer(config *Config, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(config.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout),
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+// Create a listener on addr. If paths returns non-empty file names, the
+// listener serves TLS using that certificate and key.
+func newListener(config *Config, addr string, handler http.Handler, paths func() (certFile, keyFile string)) (*listener, error) {
+	ret := &listener{
+		srv:       newServer(config, addr, handler),
+		keepAlive: time.Duration(config.TCPKeepAlivePeriod),
+	}
+	if certFile, _ := paths(); certFile == "" {
+		return ret, nil
+	}
+	certs, err := newCertLoader(paths)
+	if err != nil {
+		return nil, err
+	}
+	ret.certs = certs
+	ret.srv.TLSConfig = &tls.Config{
+		GetCertificate: certs.GetCertificate,
+	}
+	return ret, nil
+}
+
+// Start listening on the server's address. This is separate from serve so
+// that we can bind privileged ports before dropping privileges.
+func (l *listener) bind() error {
+	ln, err := listenTCP(l.srv.Addr, l.keepAlive)
+	if err != nil {
+		return err
+	}
+	if l.certs != nil {
+		ln = tls.NewListener(ln, l.srv.TLSConfig)
+	}
+	l.ln = ln
+	return nil
+}
+
+// Accept and serve connections, until the server is shut down, binding
+// first if necessary. See http.Server.Serve.
+func (l *listener) serve() error {
+	if l.ln == nil {
+		if err := l.bind(); err != nil {
+			return err
+		}
+	}
+	return l.srv.Serve(l.ln)
+}
@@ -1,50 +1,416 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"database/sql"
-	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/CCI-MOC/obmd/internal/api"
 	"github.com/CCI-MOC/obmd/internal/driver"
-	"github.com/CCI-MOC/obmd/internal/driver/dummy"
+	"github.com/CCI-MOC/obmd/internal/driver/coordinator"
 	"github.com/CCI-MOC/obmd/internal/driver/ipmi"
+	"github.com/CCI-MOC/obmd/internal/driver/shard"
+	"github.com/CCI-MOC/obmd/internal/events"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
 )
 
-// Contents of the config file
-type Config struct {
-	DBType     string
-	DBPath     string
-	ListenAddr string
-	AdminToken Token
-}
-
 var (
-	configPath = flag.String("config", "config.json", "Path to config file")
-	genToken   = flag.Bool("gen-token", false,
+	configPath = flag.String("config", "config.json",
+		"Path to config file. If empty, the config is read from the environment only.")
+	genToken = flag.Bool("gen-token", false,
 		"Generate a random token, instead of starting the daemon.")
+	checkConfig = flag.Bool("check-config", false,
+		"Check the config (and that the database and driver prerequisites "+
+			"are available), report any problems, and exit.")
+	backupPath = flag.String("backup", "",
+		"Write a backup of the database to the given file ('-' for stdout), "+
+			"instead of starting the daemon.")
 )
 
 // Exit with an error message if err != nil.
 func chkfatal(err error) {
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Fatal error", "err", err)
+	}
+}
+
+// Apply the logging settings from config.
+func configureLogging(config *Config) error {
+	level, err := logger.ParseLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	format, err := logger.ParseFormat(config.LogFormat)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(level)
+	logger.SetFormat(format)
+	return nil
+}
+
+// Apply the connection tuning parameters from config to db.
+func configureDB(db *sql.DB, config *Config) {
+	if config.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(time.Duration(config.ConnMaxLifetime))
+	}
+}
+
+// Write a backup of the database to the file at path, or stdout if path
+// is "-".
+func writeBackup(db *sql.DB, config *Config, path string) error {
+	if path == "-" {
+		return backupDB(db, config.DBType, config.DBPath, os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = backupDB(db, config.DBType, config.DBPath, f)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// Load the inventory file named in config, and reconcile the daemon's
+// nodes against it.
+func reconcileInventory(daemon *LocalDaemon, config *Config) error {
+	inv, err := LoadInventory(config.InventoryFile)
+	if err != nil {
+		return err
+	}
+	return daemon.Reconcile(inv, config.InventoryPrune)
+}
+
+// Return the registry of available drivers. This includes the development
+// drivers only if obmd was built with the "dev" tag. The shard driver
+// finds its workers in the current config. Drivers which run external
+// processes are subject to the limits in procs.
+func newRegistry(config *LiveConfig, procs *procLimits) driver.Registry {
+	ret := driver.Registry{
+		"ipmi": ipmi.NewDriver(procs.forDriver("ipmi")),
+		"shard": shard.NewDriver(func(name string) (shard.Worker, bool) {
+			c, ok := config.Get().Shards[name]
+			return c.Worker(), ok
+		}),
+	}
+	for typ, d := range devDrivers {
+		ret[typ] = d
+	}
+	return ret
+}
+
+// Check config for problems, including those which depend on the available
+// drivers. Returns the list of problems found, if any.
+func validateConfig(config *Config, registry driver.Registry) []error {
+	problems := config.Validate()
+	for typ := range config.Retries {
+		if _, ok := registry[typ]; !ok {
+			problems = append(problems,
+				fmt.Errorf("Retries configured for unknown driver %q.", typ))
+		}
+	}
+	for typ := range config.DriverMaxProcs {
+		if _, ok := registry[typ]; !ok {
+			problems = append(problems,
+				fmt.Errorf("DriverMaxProcs configured for unknown driver %q.", typ))
+		}
+	}
+	for name, tmpl := range config.NodeTemplates {
+		if _, ok := registry[tmpl.Type]; tmpl.Type != "" && !ok {
+			problems = append(problems,
+				fmt.Errorf("Node template %q has unknown driver %q.", name, tmpl.Type))
+		}
+	}
+	return problems
+}
+
+// Do everything that -check-config asks for: validate the config, and then
+// check that the database is reachable, that the TLS certificates load, and
+// that drivers' external prerequisites are available (see driver.Checker).
+// Problems are printed to stderr. Returns true if there were none.
+func runConfigChecks(config *Config, registry driver.Registry) bool {
+	problems := validateConfig(config, registry)
+	if len(problems) == 0 {
+		// Only worth trying if the database settings are sane.
+		db, err := openDB(config)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Connecting to database: %v", err))
+		} else {
+			db.Close()
+		}
+	}
+	tlsPairs := [][2]string{
+		{config.TLSCertFile, config.TLSKeyFile},
+		{config.AdminTLSCertFile, config.AdminTLSKeyFile},
+	}
+	for _, pair := range tlsPairs {
+		if pair[0] == "" {
+			continue
+		}
+		if _, err := tls.LoadX509KeyPair(pair[0], pair[1]); err != nil {
+			problems = append(problems, fmt.Errorf("Loading TLS certificate: %v", err))
+		}
+	}
+	problems = append(problems, registry.Check()...)
+	for _, err := range problems {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return len(problems) == 0
+}
+
+// Open and connect to the database described by config.
+func openDB(config *Config) (*sql.DB, error) {
+	dbPath := config.DBPath
+	if config.DBKey != "" {
+		var err error
+		dbPath, err = keyedDBPath(config.DBPath, config.DBKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// DB Types: sqlite3 or postgres
+	db, err := sql.Open(config.DBType, dbPath)
+	if err != nil {
+		return nil, err
+	}
+	configureDB(db, config)
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Re-read the config file, replacing the contents of live. Settings which
+// can't be changed without a restart are logged, but otherwise ignored.
+// If the new config can't be loaded, live is left unchanged.
+func reloadConfig(live *LiveConfig, daemon *LocalDaemon, db *sql.DB, registry driver.Registry, listeners []*listener) error {
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if problems := validateConfig(config, registry); len(problems) != 0 {
+		return problems[0]
+	}
+	if err = configureLogging(config); err != nil {
+		return err
+	}
+	for _, name := range restartOnlyChanges(live.Get(), config) {
+		logger.Warn("Config setting changed; this requires a restart to take effect",
+			"setting", name)
+	}
+	configureDB(db, config)
+	coordinator.SetTimeout(time.Duration(config.WatchdogTimeout))
+	coordinator.SetHistorySize(config.ConsoleHistorySize)
+	coordinator.SetReconnectAttempts(config.ConsoleReconnectAttempts)
+	coordinator.SetSessionLimits(time.Duration(config.ConsoleIdleTimeout),
+		time.Duration(config.ConsoleMaxDuration))
+	ipmi.SetDefaults(config.IPMIRetries, time.Duration(config.IPMITimeout),
+		time.Duration(config.IPMICommandTimeout))
+	ipmi.SetSessionTimeout(time.Duration(config.IPMISessionTimeout))
+	driver.SetRoutes(config.Routes())
+	daemon.SetLabelPolicy(config.LabelRegexp(), config.MaxLabelLength)
+	daemon.SetNodeTemplates(config.NodeTemplates)
+	daemon.SetPolicy(config.Policy.URL, time.Duration(config.Policy.Timeout), config.Policy.FailOpen)
+	daemon.SetPowerCycleInterval(time.Duration(config.PowerCycleInterval))
+	daemon.SetPowerOnStagger(time.Duration(config.PowerOnDelay), config.PowerOnGroupSize)
+	daemon.SetHealthChecks(time.Duration(config.HealthCheckInterval),
+		time.Duration(config.OperationTimeout))
+	daemon.SetSELMonitoring(time.Duration(config.SELPollInterval),
+		time.Duration(config.OperationTimeout))
+	daemon.SetPowerGroupReapply(time.Duration(config.PowerGroupInterval),
+		time.Duration(config.OperationTimeout))
+	live.Set(config)
+	for _, l := range listeners {
+		if l.certs == nil {
+			continue
+		}
+		if err = l.certs.Reload(); err != nil {
+			logger.Error("Error reloading TLS certificate; keeping the old one",
+				"addr", l.srv.Addr, "err", err)
+		}
+	}
+	return nil
+}
+
+// Make a handler for the api (see api.NewHandler), with its settings
+// taken from the current config.
+func makeHandler(config *LiveConfig, daemon obmd.Daemon, parts api.Parts) http.Handler {
+	settings := func() *api.Settings {
+		return apiSettings(config.Get())
+	}
+	snapshot := func() interface{} {
+		return takeSnapshot(daemon, config.Get())
+	}
+	return api.NewHandler(daemon, settings, snapshot, parts)
+}
+
+// Return the settings for the api from config.
+func apiSettings(config *Config) *api.Settings {
+	return &api.Settings{
+		AdminToken:            config.AdminToken,
+		OperationTimeout:      time.Duration(config.OperationTimeout),
+		WriteTimeout:          time.Duration(config.WriteTimeout),
+		MaxRequestBodyBytes:   config.MaxRequestBodyBytes,
+		IdempotencyWindow:     time.Duration(config.IdempotencyWindow),
+		Redfish:               config.Redfish,
+		WebUI:                 config.WebUI,
+		ConsoleRecordDir:      config.ConsoleRecordDir,
+		FirmwareDir:           config.FirmwareDir,
+		FirmwareUpdateTimeout: time.Duration(config.FirmwareUpdateTimeout),
+		DBType:                config.DBType,
+		DBPath:                config.DBPath,
+		Images:                config.Images.Store(),
+		ImageBaseURL:          config.Images.BaseURL,
+		ImageURLLifetime:      time.Duration(config.Images.URLLifetime),
+	}
+}
+
+// Create the listeners for the api. If config.AdminListenAddr is set, the
+// admin and user apis are served separately, on AdminListenAddr and
+// ListenAddr respectively; otherwise both are served on ListenAddr.
+func makeListeners(live *LiveConfig, daemon *LocalDaemon) ([]*listener, error) {
+	config := live.Get()
+	userTLS := func() (string, string) {
+		return live.Get().TLSCertFile, live.Get().TLSKeyFile
+	}
+	if config.AdminListenAddr == "" {
+		l, err := newListener(config, config.ListenAddr, makeHandler(live, daemon, api.AllAPI), userTLS)
+		if err != nil {
+			return nil, err
+		}
+		return []*listener{l}, nil
+	}
+	adminTLS := func() (string, string) {
+		return live.Get().AdminTLSCertFile, live.Get().AdminTLSKeyFile
+	}
+	userL, err := newListener(config, config.ListenAddr, makeHandler(live, daemon, api.UserAPI), userTLS)
+	if err != nil {
+		return nil, err
+	}
+	adminL, err := newListener(config, config.AdminListenAddr, makeHandler(live, daemon, api.AdminAPI), adminTLS)
+	if err != nil {
+		return nil, err
+	}
+	return []*listener{userL, adminL}, nil
+}
+
+// Every time we receive SIGHUP, reload the config file, and then reconcile
+// the inventory, if any. Does not return.
+func reloadOnSighup(live *LiveConfig, daemon *LocalDaemon, db *sql.DB, registry driver.Registry, listeners []*listener) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		logger.Info("Received SIGHUP; reloading config")
+		err := reloadConfig(live, daemon, db, registry, listeners)
+		if err != nil {
+			logger.Error("Error reloading config; keeping the old one", "err", err)
+		}
+		config := live.Get()
+		if config.InventoryFile == "" {
+			continue
+		}
+		err = reconcileInventory(daemon, config)
+		if err != nil {
+			logger.Error("Error reconciling inventory", "err", err)
+		}
 	}
 }
 
+// Wait for SIGTERM or SIGINT, or for an error on lostLeadership, and then
+// shut down cleanly: stop accepting new requests, disconnect console
+// sessions and stop the OBMs (so that e.g. ipmitool processes are not
+// orphaned), and give in-flight requests up to config.ShutdownTimeout to
+// finish. Exits the program when done; the exit status is non-zero if we
+// lost leadership, so that a supervisor will restart us as a standby.
+//
+// lostLeadership may be nil, if high availability is not in use.
+//
+// closers stop the other listeners (e.g. the ssh server), which don't wait
+// for requests in progress.
+func shutdownOnSignal(listeners []*listener, closers []func() error, daemon *LocalDaemon, config *LiveConfig, lostLeadership <-chan error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	status := 0
+	select {
+	case sig := <-sigs:
+		logger.Info("Received signal; shutting down", "signal", sig)
+	case err := <-lostLeadership:
+		logger.Error("Lost leadership; shutting down", "err", err)
+		status = 1
+	}
+
+	timeout := time.Duration(config.Get().ShutdownTimeout)
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Shutdown closes the listeners immediately, but then waits for
+	// active requests, which include console streams. These only end
+	// once the daemon disconnects them, so we have to do that
+	// concurrently.
+	for _, c := range closers {
+		if err := c(); err != nil {
+			logger.Error("Error closing listener", "err", err)
+		}
+	}
+	srvDone := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			srvDone <- l.srv.Shutdown(ctx)
+		}(l)
+	}
+	daemonDone := make(chan error, 1)
+	go func() {
+		daemonDone <- daemon.Close()
+	}()
+	select {
+	case err := <-daemonDone:
+		if err != nil {
+			logger.Error("Error stopping OBMs", "err", err)
+		}
+	case <-ctx.Done():
+		logger.Error("Timed out waiting for OBMs to stop")
+	}
+	for range listeners {
+		if err := <-srvDone; err != nil {
+			logger.Error("Error shutting down http server", "err", err)
+		}
+	}
+	os.Exit(status)
+}
+
 func main() {
 	flag.Parse()
 
 	if *genToken {
 		// The user passed -gen-token; generate a token and exit.
-		var tok Token
+		var tok obmd.Token
 		_, err := rand.Read(tok[:])
 		chkfatal(err)
 		text, err := tok.MarshalText()
@@ -53,24 +419,208 @@ func main() {
 		return
 	}
 
-	buf, err := ioutil.ReadFile(*configPath)
+	config, err := LoadConfig(*configPath)
 	chkfatal(err)
-	var config Config
-	chkfatal(json.Unmarshal(buf, &config))
-	// DB Types: sqlite3 or postgres
-	db, err := sql.Open(config.DBType, config.DBPath)
+	live := NewLiveConfig(config)
+	procs := newProcLimits(config)
+	expvar.Publish("procs", expvar.Func(func() interface{} {
+		return procs.Stats()
+	}))
+	registry := newRegistry(live, procs)
+
+	if *checkConfig {
+		// The user passed -check-config; report any problems and exit.
+		if !runConfigChecks(config, registry) {
+			os.Exit(1)
+		}
+		fmt.Println("Config OK.")
+		return
+	}
+
+	if problems := validateConfig(config, registry); len(problems) != 0 {
+		for _, err := range problems {
+			logger.Error("Invalid config", "err", err)
+		}
+		os.Exit(1)
+	}
+	chkfatal(configureLogging(config))
+	coordinator.SetTimeout(time.Duration(config.WatchdogTimeout))
+	coordinator.SetHistorySize(config.ConsoleHistorySize)
+	coordinator.SetReconnectAttempts(config.ConsoleReconnectAttempts)
+	coordinator.SetSessionLimits(time.Duration(config.ConsoleIdleTimeout),
+		time.Duration(config.ConsoleMaxDuration))
+	ipmi.SetDefaults(config.IPMIRetries, time.Duration(config.IPMITimeout),
+		time.Duration(config.IPMICommandTimeout))
+	ipmi.SetSessionTimeout(time.Duration(config.IPMISessionTimeout))
+	driver.SetRoutes(config.Routes())
+	chkfatal(ipmi.SetFixtures(config.IPMIRecordFile, config.IPMIReplayFile))
+	db, err := openDB(config)
 	chkfatal(err)
-	chkfatal(db.Ping())
 
-	state, err := NewState(db, driver.Registry{
-		"ipmi": ipmi.Driver,
+	if *backupPath != "" {
+		// The user passed -backup; write out the database and exit.
+		chkfatal(writeBackup(db, config, *backupPath))
+		return
+	}
+
+	// Missing prerequisites only affect nodes using the driver in
+	// question, so we carry on, but say so now rather than leave it to
+	// the first request.
+	for _, err := range registry.Check() {
+		logger.Error("Driver prerequisite check failed", "err", err)
+	}
 
-		// TODO: maybe mask this behind a build tag, so it's not there
-		// in production builds:
-		"dummy": dummy.Driver,
-	})
+	var lostLeadership <-chan error
+	if config.HA {
+		key := config.HALockKey
+		if key == 0 {
+			key = defaultHALockKey
+		}
+		logger.Info("Waiting to become the leader", "lock_key", key)
+		// The lock holds its connection for as long as we run, so it
+		// gets a pool of its own rather than one of db's connections,
+		// which may be limited (see MaxOpenConns).
+		lockDB, err := openDB(config)
+		chkfatal(err)
+		lockDB.SetMaxOpenConns(1)
+		lock, err := acquireLeadership(context.Background(), lockDB, key)
+		chkfatal(err)
+		logger.Info("Became the leader; starting up")
+		lostLeadership = lock.watch(5 * time.Second)
+	}
+
+	for typ, d := range registry {
+		typ := typ
+		registry[typ] = driver.WithRetries(d, func() driver.RetryPolicy {
+			return live.Get().Retries[typ].Policy()
+		})
+	}
+	opts := StateOptions{
+		QueryTimeout:   time.Duration(config.QueryTimeout),
+		OBMIdleTimeout: time.Duration(config.OBMIdleTimeout),
+		DeferOBMStart:  true,
+	}
+	metrics := NewDriverMetrics()
+	opts.WrapOBM = metrics.WrapOBM
+	opts.ForgetOBM = metrics.ForgetOBM
+	var faults *FaultInjector
+	if config.FaultInjection {
+		logger.Warn("Fault injection is enabled; OBM operations may " +
+			"be made to fail on request")
+		faults = &FaultInjector{}
+		// Record injected faults too, as the failures they stand for
+		// would be:
+		opts.WrapOBM = func(label string, info []byte, obm driver.OBM) driver.OBM {
+			return metrics.WrapOBM(label, info, faults.WrapOBM(label, info, obm))
+		}
+	}
+	expvar.Publish("drivers", expvar.Func(func() interface{} {
+		return metrics.Stats()
+	}))
+	state, err := NewState(db, registry, opts)
 	chkfatal(err)
-	srv := makeHandler(&config, NewDaemon(state))
-	http.Handle("/", srv)
-	chkfatal(http.ListenAndServe(config.ListenAddr, nil))
+	daemon := NewDaemon(state)
+	daemon.SetLabelPolicy(config.LabelRegexp(), config.MaxLabelLength)
+	daemon.SetNodeTemplates(config.NodeTemplates)
+	daemon.SetPolicy(config.Policy.URL, time.Duration(config.Policy.Timeout), config.Policy.FailOpen)
+	daemon.SetPowerCycleInterval(time.Duration(config.PowerCycleInterval))
+	daemon.SetPowerOnStagger(time.Duration(config.PowerOnDelay), config.PowerOnGroupSize)
+	daemon.SetHealthChecks(time.Duration(config.HealthCheckInterval),
+		time.Duration(config.OperationTimeout))
+	daemon.SetSELMonitoring(time.Duration(config.SELPollInterval),
+		time.Duration(config.OperationTimeout))
+	daemon.SetPowerGroupReapply(time.Duration(config.PowerGroupInterval),
+		time.Duration(config.OperationTimeout))
+	if config.EventBus.Type != "" {
+		pub, err := events.NewPublisher(config.EventBus.Config())
+		chkfatal(err)
+		go pub.Run(context.Background())
+		daemon.SetEventPublisher(pub)
+	}
+	daemon.SetAlerter(newAlerter(live))
+	expvar.Publish("consoles", expvar.Func(func() interface{} {
+		return daemon.ConsoleStats()
+	}))
+	expvar.Publish("health", expvar.Func(func() interface{} {
+		return daemon.NodeHealth()
+	}))
+	if config.InventoryFile != "" {
+		chkfatal(reconcileInventory(daemon, config))
+	}
+	var kubeCtl *kubeController
+	if config.Kubernetes.Enabled {
+		kubeCtl, err = newKubeController(live, daemon)
+		chkfatal(err)
+	}
+	listeners, err := makeListeners(live, daemon)
+	chkfatal(err)
+	var closers []func() error
+	if config.DebugListenAddr != "" {
+		debugL := &listener{
+			srv: newServer(config, config.DebugListenAddr,
+				makeDebugHandler(live, daemon, faults)),
+		}
+		chkfatal(debugL.bind())
+		go func() {
+			err := debugL.serve()
+			if err != http.ErrServerClosed {
+				chkfatal(err)
+			}
+		}()
+		// Requests to it (e.g. profiles) needn't finish before we exit:
+		closers = append(closers, debugL.srv.Close)
+	}
+	for _, l := range listeners {
+		chkfatal(l.bind())
+	}
+	var sshL *sshServer
+	if config.SSHListenAddr != "" {
+		sshL, err = newSSHServer(live, daemon)
+		chkfatal(err)
+		chkfatal(sshL.bind())
+		closers = append(closers, sshL.close)
+	}
+	// Bind these before dropping privileges too, since IPMI's port (623)
+	// is privileged.
+	vbmcs, err := makeVirtualBMCs(live, daemon)
+	chkfatal(err)
+	for _, v := range vbmcs {
+		closers = append(closers, v.close)
+	}
+	chkfatal(dropPrivileges(config))
+	go reloadOnSighup(live, daemon, db, registry, listeners)
+	go shutdownOnSignal(listeners, closers, daemon, live, lostLeadership)
+	for _, l := range listeners {
+		go func(l *listener) {
+			err := l.serve()
+			if err != http.ErrServerClosed {
+				chkfatal(err)
+			}
+		}(l)
+	}
+	if sshL != nil {
+		go func() {
+			chkfatal(sshL.serve())
+		}()
+	}
+	for _, v := range vbmcs {
+		go func(v *vbmcListener) {
+			chkfatal(v.serve())
+		}(v)
+	}
+	// Now that we're serving (so health checks pass), connect to the
+	// OBMs. Nodes used before this happens are started on demand.
+	daemon.StartOBMs()
+	if kubeCtl != nil {
+		go kubeCtl.Run(context.Background())
+	}
+	if config.ConsoleSyslogAddr != "" {
+		network := config.ConsoleSyslogNetwork
+		if network == "" {
+			network = "udp"
+		}
+		go daemon.ForwardConsoles(newSyslogWriter(network, config.ConsoleSyslogAddr))
+	}
+	// Wait for shutdownOnSignal to finish cleaning up:
+	select {}
 }
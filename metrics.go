@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// How long to wait for a node's OBM to report its model; see
+// DriverMetrics.
+const modelLookupTimeout = time.Minute
+
+// How long to wait before looking up a node's model again after a failure,
+// by default. The delay doubles after each failure, up to the maximum.
+const (
+	modelRetryMinDelay = time.Minute
+	modelRetryMaxDelay = time.Hour
+)
+
+// Counts and latencies of OBM operations, by driver type, the nodes' make
+// and model, and operation, e.g. for comparing the reliability of
+// different hardware. A node's model is the "model" in its info, if any,
+// otherwise whatever its OBM reports (see driver.Identifier), looked up
+// in the background when it is first used (and again later, if that
+// fails), or "unknown".
+type DriverMetrics struct {
+	lock sync.Mutex
+	ops  map[opKey]*OpStats
+
+	// The models reported by nodes' OBMs, keyed by label.
+	models map[string]*modelLookup
+
+	// The bounds on the delay before retrying a failed lookup; tests
+	// shorten them.
+	retryMinDelay, retryMaxDelay time.Duration
+}
+
+// What is known of the model reported by a node's OBM. Protected by the
+// DriverMetrics' lock.
+type modelLookup struct {
+	model   string        // "" if not known (yet).
+	looking bool          // whether a lookup is in progress.
+	delay   time.Duration // how long the last failure's retry was put off.
+	retry   time.Time     // when to look again, after a failure.
+}
+
+type opKey struct {
+	typ, model, op string
+}
+
+// Statistics for one kind of operation.
+type OpStats struct {
+	OK     int64 `json:"ok"`
+	Failed int64 `json:"failed"`
+
+	// The total and longest time taken by the operations, in seconds.
+	Seconds    float64 `json:"seconds"`
+	MaxSeconds float64 `json:"max_seconds"`
+}
+
+func NewDriverMetrics() *DriverMetrics {
+	return &DriverMetrics{
+		ops:    make(map[opKey]*OpStats),
+		models: make(map[string]*modelLookup),
+
+		retryMinDelay: modelRetryMinDelay,
+		retryMaxDelay: modelRetryMaxDelay,
+	}
+}
+
+// Return the statistics, keyed by driver type, model and operation.
+func (m *DriverMetrics) Stats() map[string]map[string]map[string]OpStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make(map[string]map[string]map[string]OpStats)
+	for key, stats := range m.ops {
+		if ret[key.typ] == nil {
+			ret[key.typ] = make(map[string]map[string]OpStats)
+		}
+		if ret[key.typ][key.model] == nil {
+			ret[key.typ][key.model] = make(map[string]OpStats)
+		}
+		ret[key.typ][key.model][key.op] = *stats
+	}
+	return ret
+}
+
+func (m *DriverMetrics) record(key opKey, took time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats := m.ops[key]
+	if stats == nil {
+		stats = &OpStats{}
+		m.ops[key] = stats
+	}
+	if err == nil {
+		stats.OK++
+	} else {
+		stats.Failed++
+	}
+	secs := took.Seconds()
+	stats.Seconds += secs
+	if secs > stats.MaxSeconds {
+		stats.MaxSeconds = secs
+	}
+}
+
+// Return the model reported by the node's OBM, obm, or "unknown" if it
+// hasn't (yet). The first call for each OBM starts looking it up, as do
+// later calls once it is time to retry after a failure.
+func (m *DriverMetrics) reportedModel(label string, obm driver.OBM) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	l := m.models[label]
+	if l == nil {
+		l = &modelLookup{}
+		m.models[label] = l
+	}
+	if l.model != "" {
+		return l.model
+	}
+	if !l.looking && !time.Now().Before(l.retry) {
+		l.looking = true
+		go m.lookupModel(label, l, obm)
+	}
+	return "unknown"
+}
+
+func (m *DriverMetrics) lookupModel(label string, l *modelLookup, obm driver.OBM) {
+	model := "unknown"
+	var err error
+	if i, ok := obm.(driver.Identifier); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), modelLookupTimeout)
+		defer cancel()
+		var reported string
+		reported, err = i.Model(ctx)
+		if err == driver.ErrNotSupported {
+			err = nil
+		} else if err == nil && reported != "" {
+			model = reported
+		}
+	}
+	// If the node has been deleted or its OBM replaced meanwhile, l is no
+	// longer in m.models, so this is harmless.
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	l.looking = false
+	if err == nil {
+		l.model = model
+		return
+	}
+	l.delay *= 2
+	if l.delay < m.retryMinDelay {
+		l.delay = m.retryMinDelay
+	} else if l.delay > m.retryMaxDelay {
+		l.delay = m.retryMaxDelay
+	}
+	l.retry = time.Now().Add(l.delay)
+	logger.Warn("Failed to look up node's model", "node", label, "err", err,
+		"retry_in", l.delay)
+}
+
+// Forget what is known about the node's OBM, e.g. because the node has
+// been deleted. This is suitable for StateOptions.ForgetOBM.
+func (m *DriverMetrics) ForgetOBM(label string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.models, label)
+}
+
+// Wrap a node's OBM such that its operations are recorded. info is the
+// node's stored info, which names its driver, and perhaps its model. This
+// is suitable for StateOptions.WrapOBM.
+func (m *DriverMetrics) WrapOBM(label string, info []byte, obm driver.OBM) driver.OBM {
+	var fields struct {
+		Type  string `json:"type"`
+		Model string `json:"model"`
+	}
+	json.Unmarshal(info, &fields)
+	// The node's OBM (and so perhaps its model) may have changed:
+	m.ForgetOBM(label)
+	o := metricsRecorder{obm: obm, metrics: m, label: label, typ: fields.Type, model: fields.Model}
+	return driver.Wrapped{OBM: obm, Hook: o.hook}
+}
+
+// Records the operations of a node's OBM in DriverMetrics; see WrapOBM.
+type metricsRecorder struct {
+	obm     driver.OBM
+	metrics *DriverMetrics
+	label   string
+	typ     string
+	model   string // from the node's info; "" if not given.
+}
+
+// Do the operation op, recording it, as a driver.Hook.
+func (o metricsRecorder) hook(ctx context.Context, op string, call func() error) error {
+	start := time.Now()
+	err := call()
+	o.record(op, start, err)
+	return err
+}
+
+// Record the operation op, which started at start, and returned err.
+// Operations which are unsupported, or which the caller cancelled, say
+// nothing about the OBM, so aren't recorded.
+func (o metricsRecorder) record(op string, start time.Time, err error) {
+	if err == driver.ErrNotSupported || err == context.Canceled {
+		return
+	}
+	model := o.model
+	if model == "" {
+		model = o.metrics.reportedModel(o.label, o.obm)
+	}
+	o.metrics.record(opKey{o.typ, model, op}, time.Since(start), err)
+}
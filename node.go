@@ -4,16 +4,72 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/subtle"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/obmd"
 )
 
 // Information about a node
 type Node struct {
-	ConnInfo     []byte             // Connection info for this node's OBM.
-	ObmCancel    context.CancelFunc // stop the OBM
-	OBM          driver.OBM         // OBM for this node.
-	CurrentToken Token              // Token for regular user operations.
+	// Statistics about the console. This comes first to ensure 64-bit
+	// alignment; see the sync/atomic docs.
+	console consoleCounters
+
+	// Protects CurrentToken and removed, and serializes operations on the
+	// OBM.
+	sync.Mutex
+
+	ConnInfo     []byte     // Connection info for this node's OBM.
+	OBM          driver.OBM // OBM for this node.
+	CurrentToken obmd.Token // Token for regular user operations.
+
+	// Identifies the node's info: this changes whenever the info does
+	// (even if it changes back), so clients can tell that it has. It is
+	// opaque, and persisted along with the info.
+	Version string
+
+	// When the node was last power cycled; see LocalDaemon.SetPowerCycleInterval.
+	lastPowerCycle time.Time
+
+	// The number of operations which have changed (or tried to change)
+	// the node's power or boot state, so that a pending shutdown can
+	// tell whether it has been superseded; see LocalDaemon.ShutdownNode.
+	powerOps uint64
+
+	// Set when the node is deleted or replaced (see State.DeleteNode and
+	// State.UpdateNodeInfo), for the benefit of operations which looked it
+	// up before then, and were waiting for its lock.
+	removed bool
+
+	// Protects the fields below. This is only ever held briefly, so it
+	// may be taken without the main lock, e.g. for debugging.
+	obmLock   sync.Mutex
+	ObmCancel context.CancelFunc // stop the OBM; nil if not running.
+	obmDone   chan struct{}      // closed when the OBM's Serve method returns.
+	users     int                // number of operations/consoles using the OBM.
+	lastUsed  time.Time          // when the OBM was last released.
+
+	// Why the OBM was last stopped (see StopOBM), for reporting why
+	// console sessions ended.
+	stopReason string
+
+	// When CurrentToken was issued and last used. This is kept under
+	// obmLock, so that it can be reported while an operation is in
+	// progress.
+	tokenUsage obmd.TokenUsage
+}
+
+// Return the type of the node's driver, from its info.
+func (n *Node) driverType() string {
+	var info struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(n.ConnInfo, &info)
+	return info.Type
 }
 
 // Returns a new node with the given driver information, with no valid token.
@@ -33,41 +89,226 @@ func NewNode(d driver.Driver, info []byte) (*Node, error) {
 // Generate a new token, invaidating the old one if any, and disconnecting
 // clients using it. If an error occurs, the state of the node/token will
 // be unchanged.
-func (n *Node) NewToken() (Token, error) {
-	var token Token
+func (n *Node) NewToken() (obmd.Token, error) {
+	var token obmd.Token
 	_, err := rand.Read(token[:])
 	if err != nil {
 		return token, err
 	}
 	n.ClearToken()
 	copy(n.CurrentToken[:], token[:])
+	n.setTokenUsage(obmd.TokenUsage{Issued: true, IssuedAt: time.Now()})
 	return n.CurrentToken, nil
 }
 
+// Return the node's console statistics, given the number of active
+// connections.
+func (n *Node) consoleStats(active int) obmd.ConsoleStats {
+	return obmd.ConsoleStats{
+		BytesStreamed: atomic.LoadUint64(&n.console.bytes),
+		Sessions:      atomic.LoadUint64(&n.console.sessions),
+		DialFailures:  atomic.LoadUint64(&n.console.dialFailures),
+		Active:        active,
+	}
+}
+
+// Acquire the node's lock, unless ctx is done first, in which case return
+// ctx.Err(), e.g. so that a request whose client has given up doesn't keep
+// waiting behind a slow operation.
+func (n *Node) lockContext(ctx context.Context) error {
+	locked := make(chan struct{})
+	go func() {
+		n.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// We still get the lock eventually; give it straight back.
+		go func() {
+			<-locked
+			n.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
 // Return whether a token is valid.
-func (n *Node) ValidToken(token Token) bool {
+func (n *Node) ValidToken(token obmd.Token) bool {
 	return subtle.ConstantTimeCompare(n.CurrentToken[:], token[:]) == 1
 }
 
+// Return the node's current token, or ok == false if it has none (e.g.
+// because it was revoked). Users authenticated by some means other than a
+// token (e.g. an ssh key) act with this, so lose access with it.
+func (n *Node) currentToken() (token obmd.Token, ok bool) {
+	return n.CurrentToken, !n.ValidToken(noToken)
+}
+
+// Like ValidToken, but if the token is valid, also record that it was used
+// for op.
+func (n *Node) useToken(token obmd.Token, op string) bool {
+	if !n.ValidToken(token) {
+		return false
+	}
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	n.tokenUsage.LastUsed = time.Now()
+	n.tokenUsage.LastOperation = op
+	return true
+}
+
+// Return when the node's token was issued and last used.
+func (n *Node) getTokenUsage() obmd.TokenUsage {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	return n.tokenUsage
+}
+
+func (n *Node) setTokenUsage(usage obmd.TokenUsage) {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	n.tokenUsage = usage
+}
+
 // Clear any existing token, and disconnect any clients
 func (n *Node) ClearToken() {
 	n.OBM.DropConsole()
 	copy(n.CurrentToken[:], noToken[:])
+	n.setTokenUsage(obmd.TokenUsage{})
 }
 
 func (n *Node) StartOBM() {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	n.startOBM()
+}
+
+// Like StartOBM, but must be called with n.obmLock held.
+func (n *Node) startOBM() {
 	if n.ObmCancel != nil {
 		panic("BUG: OBM is already started!")
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	n.ObmCancel = cancel
-	go n.OBM.Serve(ctx)
+	prev := n.obmDone
+	done := make(chan struct{})
+	n.obmDone = done
+	n.lastUsed = time.Now()
+	go func() {
+		// The previous run may still be shutting down, and the two
+		// mustn't serve at once:
+		if prev != nil {
+			<-prev
+		}
+		n.OBM.Serve(ctx)
+		close(done)
+	}()
 }
 
-func (n *Node) StopOBM() {
+// Stop the OBM, if it is running, for the given reason (see
+// consoleConn.EndReason), e.g. "shutdown".
+func (n *Node) StopOBM(reason string) {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
 	if n.ObmCancel == nil {
-		panic("BUG: OBM is not running!")
+		return
+	}
+	n.stopReason = reason
+	n.ObmCancel()
+	n.ObmCancel = nil
+}
+
+// Return the reason given to StopOBM.
+func (n *Node) getStopReason() string {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	return n.stopReason
+}
+
+// Wait for the OBM to finish shutting down after a call to StopOBM. Returns
+// immediately if the OBM was never started.
+func (n *Node) WaitOBM() {
+	n.obmLock.Lock()
+	done := n.obmDone
+	n.obmLock.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Start the OBM if it is not running. Unlike checking OBMRunning before
+// calling StartOBM, this is safe against the OBM being started meanwhile,
+// e.g. by acquireOBM.
+func (n *Node) startIfStopped() {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	if n.ObmCancel == nil {
+		n.startOBM()
+	}
+}
+
+// Report whether the OBM is running.
+func (n *Node) OBMRunning() bool {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	return n.ObmCancel != nil
+}
+
+// Mark the OBM as in use, starting it if it is not running. Each call must
+// be matched by a call to releaseOBM.
+func (n *Node) acquireOBM() {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	if n.ObmCancel == nil {
+		n.startOBM()
+	}
+	n.users++
+}
+
+func (n *Node) releaseOBM() {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	n.users--
+	n.lastUsed = time.Now()
+}
+
+// Like acquireOBM, but for passive uses (see withPassiveUse): if the OBM
+// is not running, this leaves it stopped and returns false. Each
+// successful call must be matched by a call to releasePassiveOBM.
+func (n *Node) acquireRunningOBM() bool {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	if n.ObmCancel == nil {
+		return false
+	}
+	n.users++
+	return true
+}
+
+// Like releaseOBM, but passive uses don't count towards keeping the OBM
+// running; see stopIfIdle.
+func (n *Node) releasePassiveOBM() {
+	n.obmLock.Lock()
+	defer n.obmLock.Unlock()
+	n.users--
+}
+
+// Stop the OBM if it is running, but has not been in use for at least
+// `idle`, and wait for it to finish shutting down. Returns whether it was
+// stopped.
+func (n *Node) stopIfIdle(idle time.Duration) bool {
+	n.obmLock.Lock()
+	if n.ObmCancel == nil || n.users != 0 || time.Since(n.lastUsed) < idle {
+		n.obmLock.Unlock()
+		return false
 	}
+	n.stopReason = "obm_idle"
 	n.ObmCancel()
 	n.ObmCancel = nil
+	done := n.obmDone
+	n.obmLock.Unlock()
+	<-done
+	return true
 }
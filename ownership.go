@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Create the tables of nodes' owners and their transfers, if they don't
+// exist. Times are stored as nanoseconds since the Unix epoch, as in the
+// power history.
+func createOwnership(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS node_owners (
+		label VARCHAR(80) PRIMARY KEY,
+		project TEXT NOT NULL
+	)`)
+	if err == nil {
+		_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS node_transfers (
+			label VARCHAR(80) NOT NULL,
+			at BIGINT NOT NULL,
+			from_project TEXT NOT NULL,
+			to_project TEXT NOT NULL,
+			requester TEXT NOT NULL
+		)`)
+	}
+	if err == nil {
+		_, err = db.ExecContext(ctx,
+			`CREATE INDEX IF NOT EXISTS node_transfers_label_at ON node_transfers (label, at)`)
+	}
+	return err
+}
+
+// Read each node's owner into s.owners.
+func (s *State) loadOwners() error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT label, project FROM node_owners`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	s.owners = make(map[string]string)
+	for rows.Next() {
+		var label, project string
+		if err = rows.Scan(&label, &project); err != nil {
+			return err
+		}
+		s.owners[label] = project
+	}
+	return rows.Err()
+}
+
+// Return the project which owns the node; empty if none does.
+func (s *State) Owner(label string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.owners[label]
+}
+
+// Move the node (which may be quarantined) to `project` (empty for none),
+// on behalf of requester, returning the project it was moved from. The new
+// owner and the record of the transfer are stored together, and only once
+// they are is the node's token cleared, which also closes its console
+// sessions. This waits for operations in progress on the node to finish,
+// and none start until it returns, so nothing is done on the previous
+// project's behalf after the node has moved.
+func (s *State) TransferNode(label, project, requester string, at time.Time) (from string, err error) {
+	unlock := s.mutations.lock(label)
+	defer unlock()
+	node, err := s.GetNode(label)
+	if err != nil && err != obmd.ErrNodeQuarantined {
+		return "", err
+	}
+	if node != nil {
+		node.Lock()
+		defer node.Unlock()
+	}
+	from = s.Owner(label)
+
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM node_owners WHERE label = $1`, label)
+	if err == nil && project != "" {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO node_owners(label, project) VALUES ($1, $2)`, label, project)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO node_transfers(label, at, from_project, to_project, requester)
+			VALUES ($1, $2, $3, $4, $5)`,
+			label, at.UnixNano(), from, project, requester)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	if project != "" {
+		s.owners[label] = project
+	} else {
+		delete(s.owners, label)
+	}
+	s.lock.Unlock()
+	if node != nil {
+		node.acquireOBM()
+		node.ClearToken()
+		node.releaseOBM()
+		// Count the transfer as a power operation, so that a
+		// shutdown requested before it isn't escalated after it.
+		node.powerOps++
+	}
+	return from, nil
+}
+
+// Return the node's transfers, oldest first. Like the console audit, these
+// are kept after the node is deleted, so this doesn't check that it
+// exists.
+func (s *State) Transfers(label string) ([]obmd.NodeTransfer, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT at, from_project, to_project, requester FROM node_transfers
+		WHERE label = $1 ORDER BY at`, label)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []obmd.NodeTransfer{}
+	for rows.Next() {
+		var (
+			t  obmd.NodeTransfer
+			at int64
+		)
+		if err = rows.Scan(&at, &t.From, &t.To, &t.Requester); err != nil {
+			return nil, err
+		}
+		t.Time = time.Unix(0, at).UTC()
+		ret = append(ret, t)
+	}
+	return ret, rows.Err()
+}
+
+// Move the node to `project` (empty to leave it with no project), e.g.
+// when it is reallocated. Its token is revoked and its console sessions
+// are closed, so that the previous project loses access to it, and the
+// transfer is recorded, along with the requester named by ctx (see
+// obmd.WithRequester). Any pending shutdown escalation (see ShutdownNode) is
+// cancelled, and the node's watchdog timer, if its driver has one, is
+// stopped, so that nothing the previous project set up acts on the node
+// afterwards. This is done even if the node already belongs to project, so
+// that it can be used to reclaim a node from its users.
+func (d *LocalDaemon) TransferNode(ctx context.Context, label, project string) error {
+	d.RLock()
+	if d.closed {
+		d.RUnlock()
+		return obmd.ErrShuttingDown
+	}
+	from, err := d.state.TransferNode(label, project, obmd.RequesterOf(ctx).Identity, time.Now())
+	if err != nil {
+		d.RUnlock()
+		return err
+	}
+	d.publish("node_transferred", label, map[string]string{"from": from, "to": project})
+	d.RUnlock()
+	d.stopWatchdogForTransfer(ctx, label)
+	return nil
+}
+
+// Stop the watchdog timer of the node, which has just been transferred;
+// failures are logged, as the transfer itself has been done.
+func (d *LocalDaemon) stopWatchdogForTransfer(ctx context.Context, label string) {
+	stopped := false
+	err := d.withOBM(ctx, label, nil, func(ctx context.Context, node *Node) error {
+		w, ok := node.OBM.(driver.Watchdog)
+		if !ok {
+			return nil
+		}
+		status, err := w.WatchdogStatus(ctx)
+		if err != nil || !status.Running {
+			return err
+		}
+		stopped = true
+		return w.StopWatchdog(ctx)
+	})
+	switch {
+	case err == obmd.ErrNodeQuarantined:
+	case err != nil:
+		logger.Warn("Failed to stop the watchdog of a transferred node",
+			"node", label, "err", err)
+	case stopped:
+		d.publish("watchdog_stopped", label, map[string]string{"reason": "node_transferred"})
+	}
+}
+
+// Return the project which owns the node (empty if none does), and its
+// transfers, oldest first.
+func (d *LocalDaemon) NodeOwner(label string) (project string, transfers []obmd.NodeTransfer, err error) {
+	d.RLock()
+	defer d.RUnlock()
+	if _, err = d.state.GetNode(label); err != nil && err != obmd.ErrNodeQuarantined {
+		return "", nil, err
+	}
+	transfers, err = d.state.Transfers(label)
+	if err != nil {
+		return "", nil, err
+	}
+	return d.state.Owner(label), transfers, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The longest outlet name the database can store; see createPDUOutlets.
+const maxOutletLength = 32
+
+// Create the table of PDU outlets, if it doesn't exist.
+func createPDUOutlets(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS pdu_outlets (
+		pdu VARCHAR(80) NOT NULL,
+		outlet VARCHAR(32) NOT NULL,
+		label VARCHAR(80) NOT NULL,
+		seq INTEGER NOT NULL,
+		description TEXT NOT NULL,
+		PRIMARY KEY (pdu, outlet)
+	)`)
+	return err
+}
+
+// Add or replace the outlet o. If it powers a node, the node must exist
+// (but may be quarantined).
+func (s *State) SetOutlet(o obmd.PDUOutlet) error {
+	if o.Node != "" {
+		unlock := s.mutations.lock(o.Node)
+		defer unlock()
+		if _, err := s.GetNode(o.Node); err != nil && err != obmd.ErrNodeQuarantined {
+			return err
+		}
+	}
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM pdu_outlets WHERE pdu = $1 AND outlet = $2`, o.PDU, o.Outlet)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO pdu_outlets(pdu, outlet, label, seq, description)
+			VALUES ($1, $2, $3, $4, $5)`,
+			o.PDU, o.Outlet, o.Node, o.Order, o.Description)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	return err
+}
+
+// Remove the outlet. Returns ErrNoSuchOutlet if there is no such outlet.
+func (s *State) DeleteOutlet(pdu, outlet string) error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM pdu_outlets WHERE pdu = $1 AND outlet = $2`, pdu, outlet)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return obmd.ErrNoSuchOutlet
+	}
+	return nil
+}
+
+// Return the names of the PDUs with any outlets, sorted.
+func (s *State) PDUs() ([]string, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT pdu FROM pdu_outlets ORDER BY pdu`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []string{}
+	for rows.Next() {
+		var pdu string
+		if err = rows.Scan(&pdu); err != nil {
+			return nil, err
+		}
+		ret = append(ret, pdu)
+	}
+	return ret, rows.Err()
+}
+
+// Return the PDU's outlets, sorted by order, and then by name. Returns
+// ErrNoSuchPDU if it has none.
+func (s *State) Outlets(pdu string) ([]obmd.PDUOutlet, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT outlet, label, seq, description FROM pdu_outlets
+		WHERE pdu = $1 ORDER BY seq, outlet`, pdu)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []obmd.PDUOutlet
+	for rows.Next() {
+		o := obmd.PDUOutlet{PDU: pdu}
+		if err = rows.Scan(&o.Outlet, &o.Node, &o.Order, &o.Description); err != nil {
+			return nil, err
+		}
+		ret = append(ret, o)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, obmd.ErrNoSuchPDU
+	}
+	return ret, nil
+}
+
+// Check that name is usable as the name of a PDU or outlet: they appear in
+// URLs, so are held to the default label pattern.
+func checkOutletName(name string, maxLen int) error {
+	if len(name) > maxLen || !defaultLabelRegexp.MatchString(name) {
+		return obmd.ErrInvalidOutletName
+	}
+	return nil
+}
+
+// Record that the PDU o.PDU has the outlet o.Outlet, powering the node
+// o.Node (if any), replacing whatever was recorded about the outlet
+// before. The outlet follows the node if it is renamed, and becomes
+// standalone if the node is deleted.
+func (d *LocalDaemon) SetPDUOutlet(o obmd.PDUOutlet) error {
+	if err := checkOutletName(o.PDU, maxLabelLength); err != nil {
+		return err
+	}
+	if err := checkOutletName(o.Outlet, maxOutletLength); err != nil {
+		return err
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+	return d.state.SetOutlet(o)
+}
+
+// Forget the outlet. A PDU is forgotten along with its last outlet.
+func (d *LocalDaemon) DeletePDUOutlet(pdu, outlet string) error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return obmd.ErrShuttingDown
+	}
+	return d.state.DeleteOutlet(pdu, outlet)
+}
+
+// Return the names of the PDUs with any outlets, sorted.
+func (d *LocalDaemon) PDUs() ([]string, error) {
+	return d.state.PDUs()
+}
+
+// Return the PDU's outlets, in the order PowerPDUNodes powers them on.
+func (d *LocalDaemon) PDUOutlets(pdu string) ([]obmd.PDUOutlet, error) {
+	return d.state.Outlets(pdu)
+}
+
+// Apply a power action (as for PowerNodes) to the nodes on the PDU's
+// outlets, through their OBMs, as the admin, calling report with the
+// outcome for each outlet. The PDU itself is never touched; this only
+// sequences the nodes. Outlets are taken in waves by their Order:
+// ascending when powering on or cycling (so that e.g. nodes serving others
+// can come up first), and descending when powering off. Each wave finishes
+// before the next starts; within a wave, nodes are powered as by
+// PowerNodes. Standalone outlets get ErrOutletNotSwitchable. Returns
+// ErrNoSuchPDU if the PDU has no outlets, without calling report.
+func (d *LocalDaemon) PowerPDUNodes(ctx context.Context, pdu, action string, force bool, timeout time.Duration, report func(o obmd.PDUOutlet, err error)) error {
+	outlets, err := d.state.Outlets(pdu)
+	if err != nil {
+		return err
+	}
+	if action == obmd.PowerActionOff {
+		sort.SliceStable(outlets, func(i, j int) bool {
+			return outlets[i].Order > outlets[j].Order
+		})
+	}
+	for len(outlets) != 0 {
+		n := 1
+		for n < len(outlets) && outlets[n].Order == outlets[0].Order {
+			n++
+		}
+		wave := outlets[:n]
+		outlets = outlets[n:]
+		var labels []string
+		byLabel := make(map[string][]obmd.PDUOutlet)
+		for _, o := range wave {
+			if o.Node == "" {
+				report(o, obmd.ErrOutletNotSwitchable)
+				continue
+			}
+			if _, ok := byLabel[o.Node]; !ok {
+				labels = append(labels, o.Node)
+			}
+			// A node with redundant supplies may be on several outlets.
+			byLabel[o.Node] = append(byLabel[o.Node], o)
+		}
+		d.PowerNodes(ctx, labels, action, force, timeout, func(label string, err error) {
+			for _, o := range byLabel[label] {
+				report(o, err)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The default for PolicyConfig.Timeout.
+const defaultPolicyTimeout = 5 * time.Second
+
+// The question put to the authorization policy: may this operation go ahead?
+type PolicyRequest struct {
+	// The operation: "token" (issuing a new token), or one of
+	// "power_off", "shutdown", "power_cycle", "power_on",
+	// "boot_device", "power_limit" and "watchdog".
+	Operation string `json:"operation"`
+
+	// Operation-specific details, as in the corresponding event.
+	Detail map[string]string `json:"detail,omitempty"`
+
+	Node      string         `json:"node"`
+	NodeType  string         `json:"node_type"`
+	Requester obmd.Requester `json:"requester"`
+
+	// The reasons the node is in maintenance mode or draining, if it is.
+	Maintenance *string `json:"maintenance"`
+	Draining    *string `json:"draining"`
+
+	// The project which owns the node (see LocalDaemon.TransferNode);
+	// empty if none does.
+	Owner string `json:"owner"`
+}
+
+// The policy's answer to a PolicyRequest.
+type PolicyResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"` // why not, if Allow is false.
+}
+
+// An authorization policy served over http: each PolicyRequest is POSTed
+// to url, which answers with a PolicyResponse.
+type policyHook struct {
+	url      string
+	timeout  time.Duration
+	failOpen bool // allow operations if the policy can't be consulted.
+}
+
+// Ask the policy about req, returning nil if it is allowed, and otherwise
+// a PolicyDeniedError or ErrPolicyUnavailable.
+func (h *policyHook) check(ctx context.Context, req PolicyRequest) error {
+	err := h.ask(ctx, req)
+	if err == nil {
+		return nil
+	}
+	if _, denied := err.(obmd.PolicyDeniedError); denied || err == ctx.Err() {
+		return err
+	}
+	logger.Error("Error consulting the authorization policy",
+		"subsystem", "policy", "node", req.Node, "op", req.Operation,
+		"fail_open", h.failOpen, "err", err)
+	if h.failOpen {
+		return nil
+	}
+	return obmd.ErrPolicyUnavailable
+}
+
+func (h *policyHook) ask(ctx context.Context, req PolicyRequest) error {
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest("POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("policy returned %s", resp.Status)
+	}
+	var answer PolicyResponse
+	if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return err
+	}
+	if !answer.Allow {
+		return obmd.PolicyDeniedError{Reason: answer.Reason}
+	}
+	return nil
+}
+
+// Consult the authorization policy at url before issuing tokens, and before
+// operations which change a node's power or boot state, waiting at most
+// timeout (zero means 5 seconds) for it to answer. If failOpen is true,
+// operations are allowed when the policy can't be consulted; otherwise
+// they get ErrPolicyUnavailable. An empty url means there is no policy. This
+// may be called at any time.
+func (d *LocalDaemon) SetPolicy(url string, timeout time.Duration, failOpen bool) {
+	var hook *policyHook
+	if url != "" {
+		if timeout == 0 {
+			timeout = defaultPolicyTimeout
+		}
+		hook = &policyHook{url: url, timeout: timeout, failOpen: failOpen}
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.policy = hook
+}
+
+// Ask the authorization policy, if any, whether operation op may be done on
+// the node `label` on behalf of the caller identified by ctx and token.
+// The policy may be slow to answer, so this must be called without the
+// daemon's lock or the node's held; it takes the former only to look up
+// what the policy is told about the node.
+func (d *LocalDaemon) checkPolicy(ctx context.Context, label string, token *obmd.Token, op string, detail map[string]string) error {
+	d.RLock()
+	policy := d.policy
+	if policy == nil {
+		d.RUnlock()
+		return nil
+	}
+	if d.closed {
+		d.RUnlock()
+		return obmd.ErrShuttingDown
+	}
+	node, err := d.state.GetNode(label)
+	if err != nil {
+		d.RUnlock()
+		return err
+	}
+	req := PolicyRequest{
+		Operation: op,
+		Detail:    detail,
+		Node:      label,
+		Requester: obmd.RequesterOf(ctx),
+	}
+	req.Requester.Admin = isAdminOp(ctx, token)
+	var info struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(node.ConnInfo, &info)
+	req.NodeType = info.Type
+	if reason, ok := d.state.Maintenance(label); ok {
+		req.Maintenance = &reason
+	}
+	if reason, ok := d.state.Draining(label); ok {
+		req.Draining = &reason
+	}
+	req.Owner = d.state.Owner(label)
+	d.RUnlock()
+	return policy.check(ctx, req)
+}
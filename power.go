@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Staggers operations which power nodes on (power cycles, and powering on
+// nodes which are off), so that powering on many nodes at once doesn't
+// draw enough in-rush current to trip a breaker: each operation starts at
+// least `delay` after the previous one, and at most `max` (if non-zero)
+// are in progress at once. Operations start in the order they arrive.
+type powerGate struct {
+	// Held (i.e. full) while an operation is waiting for its turn to
+	// start; goroutines blocked sending on a channel are served in order.
+	turn chan struct{}
+
+	// Protects the fields below.
+	mu        sync.Mutex
+	delay     time.Duration
+	slots     chan struct{} // one per operation in progress; nil if unlimited.
+	lastStart time.Time
+}
+
+func newPowerGate() *powerGate {
+	return &powerGate{turn: make(chan struct{}, 1)}
+}
+
+// Change the gate's settings. Operations already in progress count
+// against the new limit only until they finish.
+func (g *powerGate) configure(delay time.Duration, max int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.delay = delay
+	if g.slots == nil && max == 0 || g.slots != nil && cap(g.slots) == max {
+		return
+	}
+	g.slots = nil
+	if max != 0 {
+		g.slots = make(chan struct{}, max)
+	}
+}
+
+// Wait for an operation's turn to start, until ctx is done. If this
+// succeeds, the caller must call the returned function when the operation
+// is done.
+func (g *powerGate) acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case g.turn <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-g.turn }()
+
+	g.mu.Lock()
+	slots, wait := g.slots, time.Until(g.lastStart.Add(g.delay))
+	g.mu.Unlock()
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release = func() {}
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			release = func() { <-slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	g.mu.Lock()
+	g.lastStart = time.Now()
+	g.mu.Unlock()
+	return release, nil
+}
+
+// Stagger operations which power nodes on: each starts at least `delay`
+// after the previous one, and at most `groupSize` (if non-zero) are in
+// progress at once. Waiting counts against the operation's context. This
+// may be called at any time.
+func (d *LocalDaemon) SetPowerOnStagger(delay time.Duration, groupSize int) {
+	d.power.configure(delay, groupSize)
+}
+
+// Apply a power action (see above) to each of the nodes `labels`, as the
+// admin, calling report (from any goroutine, but not concurrently) with
+// the outcome for each node, and return once all are done. Powering on
+// and cycling are staggered (see SetPowerOnStagger), in the order the
+// nodes are listed; each operation's context only starts counting down
+// `timeout` (if non-zero) once it is allowed to start.
+func (d *LocalDaemon) PowerNodes(ctx context.Context, labels []string, action string, force bool, timeout time.Duration, report func(label string, err error)) {
+	var wg sync.WaitGroup
+	var reportLock sync.Mutex
+	done := func(label string, err error) {
+		reportLock.Lock()
+		defer reportLock.Unlock()
+		report(label, err)
+	}
+	for _, label := range labels {
+		release := func() {}
+		if action != obmd.PowerActionOff {
+			var err error
+			if release, err = d.power.acquire(ctx); err != nil {
+				done(label, err)
+				continue
+			}
+		}
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			defer release()
+			opCtx, cancel := ctx, context.CancelFunc(func() {})
+			if timeout != 0 {
+				opCtx, cancel = context.WithTimeout(ctx, timeout)
+			}
+			defer cancel()
+			var err error
+			switch action {
+			case obmd.PowerActionOn:
+				err = d.powerOnNode(opCtx, label, nil)
+			case obmd.PowerActionOff:
+				err = d.PowerOffNode(opCtx, label, nil)
+			case obmd.PowerActionCycle:
+				err = d.powerCycleNode(opCtx, label, force, nil)
+			}
+			done(label, err)
+		}(label)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// How long to allow for reapplying a power group's shares when one of its
+// members is deleted; see LocalDaemon.DeleteNode.
+const powerGroupTimeout = time.Minute
+
+// Create the tables of power groups and their members, if they don't
+// exist. A node may be in at most one group.
+func createPowerGroups(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS power_groups (
+		name VARCHAR(80) PRIMARY KEY,
+		budget INTEGER NOT NULL
+	)`)
+	if err == nil {
+		_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS power_group_members (
+			label VARCHAR(80) PRIMARY KEY,
+			name VARCHAR(80) NOT NULL
+		)`)
+	}
+	return err
+}
+
+// Create or replace the power group `name`, with the given budget and
+// members, which must all exist (but may be quarantined), and not be in
+// other groups. Returns the nodes which were in the group before, but no
+// longer are.
+func (s *State) SetPowerGroup(name string, budget int, labels []string) (removed []string, err error) {
+	unlock := s.mutations.lock(labels...)
+	defer unlock()
+	for _, label := range labels {
+		if _, err := s.GetNode(label); err != nil && err != obmd.ErrNodeQuarantined {
+			return nil, err
+		}
+	}
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	members := make(map[string]bool)
+	for _, label := range labels {
+		members[label] = true
+		var group string
+		err = tx.QueryRowContext(ctx,
+			`SELECT name FROM power_group_members WHERE label = $1`, label).Scan(&group)
+		if err == sql.ErrNoRows {
+			err = nil
+		} else if err == nil && group != name {
+			err = obmd.ErrNodeInPowerGroup
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	old, err := groupMembers(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, label := range old {
+		if !members[label] {
+			removed = append(removed, label)
+		}
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM power_group_members WHERE name = $1`, name)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM power_groups WHERE name = $1`, name)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO power_groups(name, budget) VALUES ($1, $2)`, name, budget)
+	}
+	for label := range members {
+		if err == nil {
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO power_group_members(label, name) VALUES ($1, $2)`, label, name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// Delete the power group `name`, returning its members.
+func (s *State) DeletePowerGroup(name string) (labels []string, err error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	labels, err = groupMembers(ctx, tx, name)
+	var result sql.Result
+	if err == nil {
+		result, err = tx.ExecContext(ctx, `DELETE FROM power_groups WHERE name = $1`, name)
+	}
+	if err == nil {
+		var n int64
+		if n, err = result.RowsAffected(); err == nil && n == 0 {
+			err = obmd.ErrNoSuchPowerGroup
+		}
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM power_group_members WHERE name = $1`, name)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// Return the power group `name`.
+func (s *State) PowerGroup(name string) (obmd.PowerGroup, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return obmd.PowerGroup{}, err
+	}
+	defer tx.Rollback()
+	group := obmd.PowerGroup{Name: name}
+	err = tx.QueryRowContext(ctx,
+		`SELECT budget FROM power_groups WHERE name = $1`, name).Scan(&group.Budget)
+	if err == sql.ErrNoRows {
+		return obmd.PowerGroup{}, obmd.ErrNoSuchPowerGroup
+	} else if err != nil {
+		return obmd.PowerGroup{}, err
+	}
+	if group.Nodes, err = groupMembers(ctx, tx, name); err != nil {
+		return obmd.PowerGroup{}, err
+	}
+	if len(group.Nodes) != 0 {
+		group.Share = group.Budget / len(group.Nodes)
+	}
+	return group, nil
+}
+
+// Return the names of all power groups, sorted.
+func (s *State) PowerGroupNames() ([]string, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM power_groups ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		ret = append(ret, name)
+	}
+	return ret, rows.Err()
+}
+
+// Return the name of the power group the node is in; empty if none.
+func (s *State) PowerGroupOf(label string) (string, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	var name string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT name FROM power_group_members WHERE label = $1`, label).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+// Return the members of the power group `name`, sorted.
+func groupMembers(ctx context.Context, tx *sql.Tx, name string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT label FROM power_group_members WHERE name = $1 ORDER BY label`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []string{}
+	for rows.Next() {
+		var label string
+		if err = rows.Scan(&label); err != nil {
+			return nil, err
+		}
+		ret = append(ret, label)
+	}
+	return ret, rows.Err()
+}
+
+// Create or replace the power group `name`, whose members share a budget
+// of `budget` watts: each gets an equal share (rounded down) as its power
+// limit, which is applied to each now. Nodes which were in the group, but
+// no longer are, have their limits removed. Each node may be in one group.
+// Whenever the group's membership changes, including when a member is
+// deleted, the shares are recalculated and applied again; they are also
+// reapplied periodically (see SetPowerGroupReapply). Members' limits can't
+// be set otherwise; see SetNodePowerLimit.
+//
+// Shares are applied as the admin, regardless of maintenance mode and the
+// authorization policy, since the budget is the facility's. Failures are
+// published as power_cap_failed events, and reported by PowerGroup.
+//
+// Returns the outcome for each node whose limit was set or removed. An
+// error means the group was not changed, and nothing was done.
+func (d *LocalDaemon) SetPowerGroup(ctx context.Context, name string, budget int, labels []string) ([]obmd.PowerCapResult, error) {
+	if len(name) > maxLabelLength || !defaultLabelRegexp.MatchString(name) {
+		return nil, obmd.ErrInvalidGroupName
+	}
+	members := make(map[string]bool)
+	for _, label := range labels {
+		members[label] = true
+	}
+	if budget <= 0 || budget < len(members) {
+		return nil, obmd.ErrInvalidPowerBudget
+	}
+	d.RLock()
+	closed := d.closed
+	var removed []string
+	var err error
+	if !closed {
+		removed, err = d.state.SetPowerGroup(name, budget, labels)
+	}
+	d.RUnlock()
+	if closed {
+		return nil, obmd.ErrShuttingDown
+	} else if err != nil {
+		return nil, err
+	}
+	results := d.applyPowerGroup(ctx, name)
+	return append(results, d.setPowerCaps(ctx, "", removed, 0)...), nil
+}
+
+// Delete the power group, removing its members' power limits. Returns the
+// outcome for each member.
+func (d *LocalDaemon) DeletePowerGroup(ctx context.Context, name string) ([]obmd.PowerCapResult, error) {
+	d.RLock()
+	closed := d.closed
+	var labels []string
+	var err error
+	if !closed {
+		labels, err = d.state.DeletePowerGroup(name)
+	}
+	d.RUnlock()
+	if closed {
+		return nil, obmd.ErrShuttingDown
+	} else if err != nil {
+		return nil, err
+	}
+	return d.setPowerCaps(ctx, "", labels, 0), nil
+}
+
+// Return the power group `name`.
+func (d *LocalDaemon) PowerGroup(name string) (obmd.PowerGroup, error) {
+	group, err := d.state.PowerGroup(name)
+	if err != nil {
+		return obmd.PowerGroup{}, err
+	}
+	d.powerGroupLock.Lock()
+	defer d.powerGroupLock.Unlock()
+	for _, label := range group.Nodes {
+		if msg, ok := d.capFailures[label]; ok {
+			if group.Failed == nil {
+				group.Failed = make(map[string]string)
+			}
+			group.Failed[label] = msg
+		}
+	}
+	return group, nil
+}
+
+// Return all of the power groups, sorted by name.
+func (d *LocalDaemon) PowerGroups() ([]obmd.PowerGroup, error) {
+	names, err := d.state.PowerGroupNames()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]obmd.PowerGroup, 0, len(names))
+	for _, name := range names {
+		group, err := d.PowerGroup(name)
+		if err == obmd.ErrNoSuchPowerGroup {
+			// Deleted meanwhile.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ret = append(ret, group)
+	}
+	return ret, nil
+}
+
+// Reapply every power group's shares every `interval` (zero disables
+// this), in case e.g. a BMC reset removed a member's power limit, with
+// each group allowed up to `timeout` (zero means no limit). They are also
+// reapplied right away, e.g. so that they are in place after a restart.
+// This may be called at any time.
+func (d *LocalDaemon) SetPowerGroupReapply(interval, timeout time.Duration) {
+	d.powerGroupLock.Lock()
+	d.powerGroupSettings = pollSettings{interval: interval, timeout: timeout}
+	d.powerGroupLock.Unlock()
+	select {
+	case d.powerGroupWake <- struct{}{}:
+	default:
+	}
+}
+
+// Reapply power groups according to the current settings, until the
+// daemon is closed.
+func (d *LocalDaemon) monitorPowerGroups() {
+	for {
+		d.powerGroupLock.Lock()
+		settings := d.powerGroupSettings
+		d.powerGroupLock.Unlock()
+		var tick <-chan time.Time
+		if settings.interval != 0 {
+			tick = time.After(settings.interval)
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-d.powerGroupWake:
+		case <-tick:
+		}
+		d.reapplyPowerGroups(settings.timeout)
+	}
+}
+
+// Apply every power group's shares, allowing each group up to timeout.
+func (d *LocalDaemon) reapplyPowerGroups(timeout time.Duration) {
+	names, err := d.state.PowerGroupNames()
+	if err != nil {
+		logger.Error("Error listing power groups", "err", err)
+		return
+	}
+	for _, name := range names {
+		ctx, cancel := context.WithCancel(context.Background())
+		if timeout != 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		d.applyPowerGroup(ctx, name)
+		cancel()
+	}
+}
+
+// Apply the power group's current shares to its members, returning the
+// outcome for each. Nothing is done if the group no longer exists.
+func (d *LocalDaemon) applyPowerGroup(ctx context.Context, name string) []obmd.PowerCapResult {
+	group, err := d.state.PowerGroup(name)
+	if err != nil {
+		return nil
+	}
+	return d.setPowerCaps(ctx, name, group.Nodes, group.Share)
+}
+
+// Set the power limit of each of the nodes `labels` to watts (zero to
+// remove it), on behalf of the power group `group` (empty when removing
+// limits of nodes no longer in a group), concurrently. Returns the outcome
+// for each, sorted by label.
+func (d *LocalDaemon) setPowerCaps(ctx context.Context, group string, labels []string, watts int) []obmd.PowerCapResult {
+	results := make([]obmd.PowerCapResult, len(labels))
+	var wg sync.WaitGroup
+	for i, label := range labels {
+		wg.Add(1)
+		go func(i int, label string) {
+			defer wg.Done()
+			results[i] = obmd.PowerCapResult{
+				Node:  label,
+				Watts: watts,
+				Err:   d.setPowerCap(ctx, label, watts),
+			}
+		}(i, label)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Node < results[j].Node
+	})
+
+	d.powerGroupLock.Lock()
+	defer d.powerGroupLock.Unlock()
+	for _, r := range results {
+		if r.Err == nil || group == "" {
+			delete(d.capFailures, r.Node)
+			continue
+		}
+		if d.capFailures[r.Node] != r.Err.Error() {
+			logger.Warn("Failed to apply a power group's share",
+				"group", group, "node", r.Node, "watts", watts, "err", r.Err)
+			d.publish("power_cap_failed", r.Node, map[string]string{
+				"group": group,
+				"watts": strconv.Itoa(watts),
+				"error": r.Err.Error(),
+			})
+		}
+		d.capFailures[r.Node] = r.Err.Error()
+	}
+	return results
+}
+
+// Set the node's power limit on behalf of its power group. Unlike
+// SetNodePowerLimit, this isn't subject to maintenance mode or the
+// authorization policy.
+func (d *LocalDaemon) setPowerCap(ctx context.Context, label string, watts int) error {
+	err := d.withOBM(obmd.WithOpName(ctx, "power_limit"), label, nil, func(ctx context.Context, node *Node) error {
+		m, ok := node.OBM.(driver.PowerMeter)
+		if !ok {
+			return driver.ErrNotSupported
+		}
+		return m.SetPowerLimit(ctx, watts)
+	})
+	if err == nil {
+		d.publish("power_limit_set", label, map[string]string{"watts": strconv.Itoa(watts)})
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// The most power history entries kept per node; older ones are deleted.
+const maxPowerHistory = 1000
+
+// Create the power history table, if it doesn't exist. Times are stored as
+// nanoseconds since the Unix epoch, which sqlite and postgres agree on.
+func createPowerHistory(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS power_history (
+		label VARCHAR(80) NOT NULL,
+		at BIGINT NOT NULL,
+		power VARCHAR(16) NOT NULL
+	)`)
+	if err == nil {
+		_, err = db.ExecContext(ctx,
+			`CREATE INDEX IF NOT EXISTS power_history_label_at ON power_history (label, at)`)
+	}
+	return err
+}
+
+// Read each node's latest power state from the power history, into
+// s.lastPower.
+func (s *State) loadLastPower() error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT label, power FROM power_history ORDER BY at`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	s.lastPower = make(map[string]driver.PowerState)
+	for rows.Next() {
+		var label string
+		var power driver.PowerState
+		if err = rows.Scan(&label, &power); err != nil {
+			return err
+		}
+		s.lastPower[label] = power
+	}
+	return rows.Err()
+}
+
+// Record that the node's power state was `power` at time `at`, adding it
+// to the node's power history if it has changed. Unknown states are
+// ignored. The caller must hold the node's lock, so that it isn't deleted
+// meanwhile.
+func (s *State) RecordPower(label string, at time.Time, power driver.PowerState) error {
+	if power != driver.PowerStateOn && power != driver.PowerStateOff {
+		return nil
+	}
+	s.healthLock.Lock()
+	last := s.lastPower[label]
+	s.lastPower[label] = power
+	s.healthLock.Unlock()
+	if last == power {
+		return nil
+	}
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO power_history(label, at, power) VALUES ($1, $2, $3)`,
+		label, at.UnixNano(), string(power))
+	if err == nil {
+		// Delete all but the latest maxPowerHistory entries:
+		_, err = s.db.ExecContext(ctx, `
+			DELETE FROM power_history WHERE label = $1 AND at < (
+				SELECT at FROM power_history WHERE label = $2
+				ORDER BY at DESC LIMIT 1 OFFSET $3
+			)`, label, label, maxPowerHistory-1)
+	}
+	if err != nil {
+		// Try again next time:
+		s.healthLock.Lock()
+		if s.lastPower[label] == power {
+			delete(s.lastPower, label)
+		}
+		s.healthLock.Unlock()
+	}
+	return err
+}
+
+// Return the node's power history, oldest first.
+func (s *State) PowerHistory(label string) ([]obmd.PowerTransition, error) {
+	if _, err := s.GetNode(label); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT at, power FROM power_history WHERE label = $1 ORDER BY at`, label)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []obmd.PowerTransition
+	for rows.Next() {
+		var at int64
+		var t obmd.PowerTransition
+		if err = rows.Scan(&at, &t.Power); err != nil {
+			return nil, err
+		}
+		t.Time = time.Unix(0, at).UTC()
+		ret = append(ret, t)
+	}
+	return ret, rows.Err()
+}
+
+// Report the node's power history over the last `period` (or all of it, if
+// period is zero), as seen by health checks (see SetHealthChecks), which
+// record each change in its power state. Times are when the changes were
+// seen, so are only as accurate as the checks are frequent.
+func (d *LocalDaemon) NodePowerHistory(label string, period time.Duration) (history obmd.PowerHistory, err error) {
+	all, err := d.state.PowerHistory(label)
+	if err != nil {
+		return history, err
+	}
+	return summarizePowerHistory(all, period, time.Now()), nil
+}
+
+// Summarize the power history `all` (oldest first) over the `period` (or
+// all of it, if zero) up to now.
+func summarizePowerHistory(all []obmd.PowerTransition, period time.Duration, now time.Time) obmd.PowerHistory {
+	history := obmd.PowerHistory{
+		Transitions: []obmd.PowerTransition{},
+		Power:       driver.PowerStateUnknown,
+	}
+	var from time.Time
+	if period != 0 {
+		from = now.Add(-period)
+	}
+	// The state at the start of the period, if known:
+	state, since := driver.PowerStateUnknown, from
+	for i, t := range all {
+		if !t.Time.After(from) {
+			state = t.Power
+			continue
+		}
+		history.Transitions = append(history.Transitions, all[i])
+		addPowerTime(&history, state, t.Time.Sub(since))
+		state, since = t.Power, t.Time
+	}
+	addPowerTime(&history, state, now.Sub(since))
+	if len(all) != 0 {
+		last := all[len(all)-1]
+		history.Power, history.Since = last.Power, last.Time
+	}
+	return history
+}
+
+// Count d as time spent in the given state in h.
+func addPowerTime(h *obmd.PowerHistory, state driver.PowerState, d time.Duration) {
+	if d < 0 {
+		return
+	}
+	switch state {
+	case driver.PowerStateOn:
+		h.OnTime += obmd.Duration(d)
+	case driver.PowerStateOff:
+		h.OffTime += obmd.Duration(d)
+	}
+}
+
+// Record the node's power state in its power history, logging any error.
+func (d *LocalDaemon) recordPower(label string, at time.Time, power driver.PowerState) {
+	if err := d.state.RecordPower(label, at, power); err != nil {
+		logger.Warn("Failed to record power history", "node", label, "err", err)
+	}
+}
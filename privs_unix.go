@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Switch to the user and/or group named in the config (see Config.User),
+// if any. This must be called while we are still root.
+//
+// Note that on Linux, this requires obmd to be built with go 1.16 or
+// later; earlier versions do not support changing the credentials of
+// every thread in the process, and fail with an error.
+func dropPrivileges(config *Config) error {
+	if config.User == "" && config.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if config.User != "" {
+		u, err := user.Lookup(config.User)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return err
+		}
+	}
+	if config.Group != "" {
+		g, err := user.LookupGroup(config.Group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+
+	// The group must be changed first, since we can't do so once we've
+	// given up root:
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if uid == -1 {
+		return nil
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("Still able to regain root after dropping privileges.")
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "errors"
+
+// Windows has no equivalent of setuid; run obmd as the desired account
+// instead.
+func dropPrivileges(config *Config) error {
+	if config.User == "" && config.Group == "" {
+		return nil
+	}
+	return errors.New("User and Group are not supported on Windows.")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Limits on the number of concurrent external processes run by drivers;
+// see Config.MaxProcs.
+type procLimits struct {
+	global  *driver.Limiter
+	drivers map[string]*driver.Limiter
+}
+
+func newProcLimits(config *Config) *procLimits {
+	ret := &procLimits{
+		global:  driver.NewLimiter(config.MaxProcs, nil),
+		drivers: make(map[string]*driver.Limiter),
+	}
+	for typ, max := range config.DriverMaxProcs {
+		ret.drivers[typ] = driver.NewLimiter(max, ret.global)
+	}
+	return ret
+}
+
+// Return the limiter for drivers of type typ.
+func (p *procLimits) forDriver(typ string) *driver.Limiter {
+	l, ok := p.drivers[typ]
+	if !ok {
+		l = driver.NewLimiter(0, p.global)
+		p.drivers[typ] = l
+	}
+	return l
+}
+
+// Return the current usage of each limiter, keyed by driver type, plus
+// "global" for the overall limit.
+func (p *procLimits) Stats() map[string]driver.LimiterStats {
+	ret := map[string]driver.LimiterStats{
+		"global": p.global.Stats(),
+	}
+	for typ, l := range p.drivers {
+		ret[typ] = l.Stats()
+	}
+	return ret
+}
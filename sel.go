@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+// The kinds of hardware event log entries which are promoted to events and
+// alerts; see SetSELMonitoring. An entry is of a kind if its sensor and
+// event contain the given strings (ignoring case; an empty sensor matches
+// any).
+var criticalSELEntries = []struct {
+	kind   string
+	desc   string // for alerts.
+	sensor string
+	event  string
+}{
+	{"uncorrectable_ecc", "an uncorrectable ECC error", "", "uncorrectable ecc"},
+	{"psu_failure", "a power supply failure", "power supply", "failure"},
+	{"psu_failure", "a power supply failure", "power supply", "ac lost"},
+	{"thermal_trip", "a thermal trip", "", "thermal trip"},
+}
+
+// Return the kind of critical event the entry records, and a description
+// of it, or ok == false if it isn't critical. Deasserted entries (e.g. a
+// failure clearing) aren't.
+func classifySELEntry(e driver.EventLogEntry) (kind, desc string, ok bool) {
+	if !e.Asserted {
+		return "", "", false
+	}
+	sensor, event := strings.ToLower(e.Sensor), strings.ToLower(e.Event)
+	for _, c := range criticalSELEntries {
+		if strings.Contains(sensor, c.sensor) && strings.Contains(event, c.event) {
+			return c.kind, c.desc, true
+		}
+	}
+	return "", "", false
+}
+
+// Create the table of the latest event log entry seen for each node, if it
+// doesn't exist.
+func createSELCursors(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS sel_cursors (
+		label VARCHAR(80) PRIMARY KEY,
+		last_id BIGINT NOT NULL
+	)`)
+	return err
+}
+
+// Return the record ID of the latest entry in the node's event log seen by
+// SEL monitoring, or ok == false if its log hasn't been read yet.
+func (s *State) SELCursor(label string) (id int, ok bool, err error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	var last int64
+	err = s.db.QueryRowContext(ctx,
+		`SELECT last_id FROM sel_cursors WHERE label = $1`, label).Scan(&last)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return int(last), err == nil, err
+}
+
+// Record the record ID of the latest entry in the node's event log. The
+// caller must hold the node's lock, so that it isn't deleted meanwhile.
+func (s *State) SetSELCursor(label string, id int) error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM sel_cursors WHERE label = $1`, label)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO sel_cursors(label, last_id) VALUES ($1, $2)`, label, int64(id))
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	return err
+}
+
+// Periodically read every node's hardware event log (e.g. its IPMI SEL),
+// every `interval` (zero disables this), allowing each read up to
+// `timeout` (zero means no limit). New entries recording critical
+// hardware faults (uncorrectable ECC errors, power supply failures and
+// thermal trips) are published as sel_critical events, and sent as alerts
+// (see SetAlerter). Failed reads count as OBM failures for the alerter.
+// This may be called at any time.
+func (d *LocalDaemon) SetSELMonitoring(interval, timeout time.Duration) {
+	d.selLock.Lock()
+	d.selSettings = pollSettings{interval: interval, timeout: timeout}
+	d.selLock.Unlock()
+	select {
+	case d.selWake <- struct{}{}:
+	default:
+	}
+}
+
+// Read event logs according to the current settings, until the daemon is
+// closed.
+func (d *LocalDaemon) monitorSEL() {
+	for {
+		d.selLock.Lock()
+		settings := d.selSettings
+		d.selLock.Unlock()
+		var tick <-chan time.Time
+		if settings.interval != 0 {
+			tick = time.After(settings.interval)
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-d.selWake:
+		case <-tick:
+			d.forEachNode(func(label string) {
+				d.checkNodeSEL(label, settings.timeout)
+			})
+		}
+	}
+}
+
+// Read the node's event log, promoting any new critical entries. The
+// first time a node's log is read, its existing entries are taken as
+// already seen, so that old faults aren't reported. If the log has been
+// cleared since it was last read, all of its entries are new.
+//
+// Only the entries after the last one seen are read (see
+// driver.EventLogReader), and without the node's lock, since this can be
+// slow, and mustn't hold up other operations on the node.
+func (d *LocalDaemon) checkNodeSEL(label string, timeout time.Duration) {
+	ctx := context.Background()
+	d.RLock()
+	if d.closed {
+		d.RUnlock()
+		return
+	}
+	node, err := d.lockNode(ctx, label)
+	if err != nil {
+		d.RUnlock()
+		return
+	}
+	// Like health checks, polls don't start stopped OBMs, nor keep
+	// running ones from being stopped for being idle.
+	if !node.acquireRunningOBM() {
+		node.Unlock()
+		d.RUnlock()
+		return
+	}
+	node.Unlock()
+	d.RUnlock()
+	defer node.releasePassiveOBM()
+
+	r, ok := node.OBM.(driver.EventLogReader)
+	if !ok {
+		return
+	}
+	ctx = nodeLogContext(ctx, label, node)
+	log := logger.FromContext(ctx)
+	stored, seen, err := d.state.SELCursor(label)
+	if err != nil {
+		log.Error("Error reading SEL cursor", "err", err)
+		return
+	}
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	entries, err := r.EventLog(ctx, stored)
+	if err == driver.ErrNotSupported {
+		return
+	}
+	if d.alerts != nil {
+		d.alerts.observe(label, err)
+	}
+	if err != nil {
+		return
+	}
+	if seen {
+		for _, e := range entries {
+			if kind, desc, ok := classifySELEntry(e); ok {
+				d.promoteSELEntry(ctx, label, kind, desc, e)
+			}
+		}
+	}
+	if seen && len(entries) == 0 {
+		return
+	}
+	latest := 0
+	for _, e := range entries {
+		if e.ID > latest {
+			latest = e.ID
+		}
+	}
+	// Record the cursor with the lock held, unless the node has been
+	// deleted or replaced meanwhile.
+	d.withNode(context.Background(), label, nil, func(_ context.Context, current *Node) error {
+		if current != node {
+			return nil
+		}
+		if err := d.state.SetSELCursor(label, latest); err != nil {
+			log.Error("Error recording SEL cursor", "err", err)
+		}
+		return nil
+	})
+}
+
+// Report a critical entry in the node's event log, of the given kind.
+func (d *LocalDaemon) promoteSELEntry(ctx context.Context, label, kind, desc string, e driver.EventLogEntry) {
+	logger.FromContext(ctx).Warn("Critical hardware event",
+		"kind", kind, "sensor", e.Sensor, "event", e.Event, "record_id", e.ID)
+	detail := map[string]string{
+		"kind":      kind,
+		"record_id": strconv.Itoa(e.ID),
+		"sensor":    e.Sensor,
+		"event":     e.Event,
+	}
+	if !e.Time.IsZero() {
+		detail["time"] = e.Time.Format(time.RFC3339)
+	}
+	d.publish("sel_critical", label, detail)
+	if d.alerts != nil {
+		d.alerts.hardwareFault(label, desc, e)
+	}
+}
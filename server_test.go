@@ -3,14 +3,31 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/CCI-MOC/obmd/internal/alert"
+	"github.com/CCI-MOC/obmd/internal/api"
+	"github.com/CCI-MOC/obmd/internal/driver"
 	"github.com/CCI-MOC/obmd/internal/driver/mock"
+	"github.com/CCI-MOC/obmd/internal/events"
+	"github.com/CCI-MOC/obmd/internal/obmd"
 )
 
 // adminRequests is a sequence of admin-only requests that is used by various tests.
@@ -24,6 +41,7 @@ var adminRequests = []requestSpec{
 		}
 	}`},
 	{"POST", "http://localhost:8080/node/somenode/token", ""},
+	{"GET", "http://localhost:8080/node/somenode/lan", ""},
 	{"DELETE", "http://localhost:8080/node/somenode", ""},
 	{"DELETE", "http://localhost:8080/node/somenode/token", ""},
 }
@@ -48,7 +66,7 @@ func TestAdminNoAuth(t *testing.T) {
 func TestAdminGoodAuth(t *testing.T) {
 	handler := newHandler()
 
-	expected := []int{200, 200, 200, 404}
+	expected := []int{200, 200, 200, 200, 404}
 
 	for i, v := range adminRequests {
 		resp := adminReq(handler, v)
@@ -60,6 +78,39 @@ func TestAdminGoodAuth(t *testing.T) {
 	}
 }
 
+// Registering a node with malformed info should get 422, listing the
+// problems.
+func TestRegisterInvalidInfo(t *testing.T) {
+	handler := newHandler()
+	resp := adminReq(handler, requestSpec{"PUT", "http://localhost/node/somenode",
+		`{"type": "ipmi", "info": {"addr": "10.0.0.3"}, "infoo": {}}`})
+	requireStatus(t, "Registering a node with an unknown field", resp,
+		http.StatusUnprocessableEntity)
+	var problems api.ProblemsResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&problems))
+	if len(problems.Problems) != 1 || !strings.Contains(problems.Problems[0], `"infoo"`) {
+		t.Fatalf("Unexpected problems: %v", problems.Problems)
+	}
+	adminRequireStatus(t, handler, http.StatusUnprocessableEntity,
+		requestSpec{"PUT", "http://localhost/node/somenode", `{"type": "ipmi"}`})
+	adminRequireStatus(t, handler, http.StatusNotFound,
+		requestSpec{"DELETE", "http://localhost/node/somenode", ""})
+}
+
+// Deleting a node which doesn't exist should get 404, unless the client
+// asks for idempotent deletes.
+func TestDeleteNode(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{"type": "ipmi", "info": {"addr": "10.0.0.3"}}`)
+	del := requestSpec{"DELETE", "http://localhost/node/somenode", ""}
+	adminRequireStatus(t, handler, http.StatusOK, del)
+	adminRequireStatus(t, handler, http.StatusNotFound, del)
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"DELETE", "http://localhost/node/somenode?idempotent=true", ""})
+	adminRequireStatus(t, handler, http.StatusBadRequest,
+		requestSpec{"DELETE", "http://localhost/node/somenode?idempotent=maybe", ""})
+}
+
 // Go through the motions of granting access to the console, viewing it, and then having access
 // revoked.
 func TestViewConsole(t *testing.T) {
@@ -152,7 +203,7 @@ func TestPowerActions(t *testing.T) {
 	}`)
 	token := getToken(t, handler, "somenode")
 
-	badToken, _ := Token{}.MarshalText() // All zeros
+	badToken, _ := obmd.Token{}.MarshalText() // All zeros
 
 	testCases := []struct {
 		context string
@@ -235,10 +286,2950 @@ func TestPowerActions(t *testing.T) {
 			t.Fatalf("%s: Unexpected status code; wanted %d but got %d.",
 				v.context, v.status, status)
 		}
-		action := mock.LastPowerActions["10.0.0.3"]
+		action := mock.LastPowerAction("10.0.0.3")
 		if action != v.action {
 			t.Fatalf("%s: Incorrect power action; wanted %s but got %s.",
 				v.context, v.action, action)
 		}
 	}
 }
+
+// Verify: the power status reflects the last power action.
+func TestPowerStatus(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "statusnode", `{"type": "ipmi", "info": {"addr": "10.0.0.9"}}`)
+	token := getToken(t, handler, "statusnode")
+
+	status := requestSpec{"GET", "/node/statusnode/power_status", ""}
+	for _, v := range []struct {
+		action   requestSpec
+		expected driver.PowerState
+	}{
+		{requestSpec{"POST", "/node/statusnode/power_off", ""}, driver.PowerStateOff},
+		{requestSpec{"POST", "/node/statusnode/power_cycle", `{"force": true}`}, driver.PowerStateOn},
+	} {
+		requireStatus(t, "Power action", tokenReq(handler, token, v.action), http.StatusOK)
+		resp := tokenReq(handler, token, status)
+		requireStatus(t, "Power status", resp, http.StatusOK)
+		var powerResp api.PowerResp
+		if err := json.NewDecoder(resp.Body).Decode(&powerResp); err != nil {
+			t.Fatal("Decoding power status:", err)
+		}
+		if powerResp.Power != v.expected {
+			t.Fatalf("Expected power status %q after %s, but got %q.",
+				v.expected, v.action.url, powerResp.Power)
+		}
+	}
+}
+
+// Verify: power limits are passed to the OBM, and reflected in its
+// readings.
+func TestPowerLimit(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "cappednode", `{"type": "ipmi", "info": {"addr": "10.0.0.10"}}`)
+	token := getToken(t, handler, "cappednode")
+
+	resp := tokenReq(handler, token, requestSpec{
+		"PUT", "/node/cappednode/power_limit", `{"watts": 150}`,
+	})
+	requireStatus(t, "Setting power limit with the node's token", resp, http.StatusNotFound)
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+		"PUT", "http://localhost/node/cappednode/power_limit", `{"watts": -1}`,
+	})
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+		"PUT", "http://localhost/node/cappednode/power_limit", `{"watts": 150}`,
+	})
+	if limit := mock.PowerLimit("10.0.0.10"); limit != 150 {
+		t.Fatal("Unexpected power limit on OBM:", limit)
+	}
+
+	resp = tokenReq(handler, token, requestSpec{"GET", "/node/cappednode/power_reading", ""})
+	requireStatus(t, "Power reading", resp, http.StatusOK)
+	var reading driver.PowerReading
+	if err := json.NewDecoder(resp.Body).Decode(&reading); err != nil {
+		t.Fatal("Decoding power reading:", err)
+	}
+	if reading.Watts != 150 {
+		t.Fatal("Unexpected power reading:", reading.Watts)
+	}
+}
+
+// Verify: the watchdog timer can be armed, reset and stopped with the
+// node's token.
+func TestWatchdog(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "watchednode", `{"type": "ipmi", "info": {"addr": "10.0.0.49"}}`)
+	token := getToken(t, handler, "watchednode")
+
+	getStatus := func() driver.WatchdogStatus {
+		resp := tokenReq(handler, token, requestSpec{"GET", "/node/watchednode/watchdog", ""})
+		requireStatus(t, "Getting watchdog status", resp, http.StatusOK)
+		var status driver.WatchdogStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal("Decoding watchdog status:", err)
+		}
+		return status
+	}
+	if status := getStatus(); status.Running {
+		t.Fatal("Watchdog is running before being armed.")
+	}
+
+	resp := tokenReq(handler, token, requestSpec{"PUT", "/node/watchednode/watchdog", `{"timeout": 0}`})
+	requireStatus(t, "Arming with no timeout", resp, http.StatusBadRequest)
+	resp = tokenReq(handler, token, requestSpec{"PUT", "/node/watchednode/watchdog", `{"timeout": 600}`})
+	requireStatus(t, "Arming watchdog", resp, http.StatusOK)
+	status := getStatus()
+	if !status.Running || status.Action != "power_cycle" || status.Timeout != 600 {
+		t.Fatalf("Unexpected watchdog status after arming: %+v", status)
+	}
+
+	resp = tokenReq(handler, token, requestSpec{"POST", "/node/watchednode/watchdog/reset", ""})
+	requireStatus(t, "Resetting watchdog", resp, http.StatusOK)
+	resp = tokenReq(handler, token, requestSpec{"DELETE", "/node/watchednode/watchdog", ""})
+	requireStatus(t, "Stopping watchdog", resp, http.StatusOK)
+	if status := getStatus(); status.Running {
+		t.Fatal("Watchdog is still running after being stopped.")
+	}
+
+	// Changing the timer is a power operation, so is locked out by
+	// maintenance mode:
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"PUT", "http://localhost/node/watchednode/maintenance", `{"reason": "testing"}`})
+	resp = tokenReq(handler, token, requestSpec{"PUT", "/node/watchednode/watchdog", `{"timeout": 600}`})
+	requireStatus(t, "Arming watchdog in maintenance mode", resp, http.StatusLocked)
+}
+
+// Verify: users may not arm a watchdog to fire sooner than the power cycle
+// interval allows; admins may.
+func TestWatchdogPowerCycleInterval(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	errpanic(daemon.SetNode("watchednode", []byte(`{"type": "ipmi", "info": {"addr": "10.0.0.67"}}`)))
+	token, err := daemon.GetNodeToken(context.Background(), "watchednode")
+	errpanic(err)
+	daemon.SetPowerCycleInterval(time.Minute)
+	defer daemon.SetPowerCycleInterval(0)
+
+	ctx := context.Background()
+	if err := daemon.ArmNodeWatchdog(ctx, "watchednode", 1, &token); err != obmd.ErrWatchdogTimeoutTooShort {
+		t.Fatalf("Expected ErrWatchdogTimeoutTooShort, but got %v", err)
+	}
+	errpanic(daemon.ArmNodeWatchdog(ctx, "watchednode", 60, &token))
+	errpanic(daemon.ArmNodeWatchdog(ctx, "watchednode", 1, nil))
+}
+
+// Verify: shutting down a node asks for a soft power off, which is
+// escalated to a hard one if the node is still on after the timeout, unless
+// something else has been done to the node in the meantime.
+func TestNodeShutdown(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "polite", `{"type": "ipmi", "info": {"addr": "10.0.0.53"}}`)
+	makeNode(t, handler, "stubborn", `{"type": "ipmi", "info": {"addr": "10.0.0.54", "ignore_soft_off": true}}`)
+
+	token := getToken(t, handler, "polite")
+	requireStatus(t, "Shutdown without a body", tokenReq(handler, token,
+		requestSpec{"POST", "/node/polite/shutdown", ""}), http.StatusOK)
+	if action := mock.LastPowerAction("10.0.0.53"); action != mock.SoftOff {
+		t.Fatalf("Expected a soft power off, but the last action was %q.", action)
+	}
+	requireStatus(t, "Shutdown with a timeout too long", tokenReq(handler, token,
+		requestSpec{"POST", "/node/polite/shutdown", `{"timeout": "2h"}`}), http.StatusBadRequest)
+
+	token = getToken(t, handler, "stubborn")
+	shutdown := requestSpec{"POST", "/node/stubborn/shutdown", `{"timeout": "50ms"}`}
+	requireStatus(t, "Shutdown with a timeout", tokenReq(handler, token, shutdown), http.StatusOK)
+	for i := 0; mock.LastPowerAction("10.0.0.54") != mock.Off; i++ {
+		if i == 100 {
+			t.Fatal("The node was never powered off after the shutdown timed out.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A power cycle after the shutdown cancels the escalation:
+	requireStatus(t, "Shutdown with a timeout", tokenReq(handler, token, shutdown), http.StatusOK)
+	requireStatus(t, "Power cycle", tokenReq(handler, token,
+		requestSpec{"POST", "/node/stubborn/power_cycle", `{"force": false}`}), http.StatusOK)
+	time.Sleep(200 * time.Millisecond)
+	if action := mock.LastPowerAction("10.0.0.54"); action != mock.SoftReboot {
+		t.Fatalf("Expected the power cycle to stand, but the last action was %q.", action)
+	}
+}
+
+// Verify: an admin can set a node's power restore policy, and invalid
+// policies are rejected.
+func TestPowerRestorePolicy(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "policynode", `{"type": "ipmi", "info": {"addr": "10.0.0.48"}}`)
+
+	getPolicy := func() string {
+		resp := adminReq(handler, requestSpec{"GET", "http://localhost/node/policynode/power_policy", ""})
+		requireStatus(t, "Getting power restore policy", resp, http.StatusOK)
+		var policy api.PowerPolicyResp
+		if err := json.NewDecoder(resp.Body).Decode(&policy); err != nil {
+			t.Fatal("Decoding power restore policy:", err)
+		}
+		return string(policy.Policy)
+	}
+	if policy := getPolicy(); policy != "always-off" {
+		t.Fatal("Unexpected initial policy:", policy)
+	}
+
+	resp := adminReq(handler, requestSpec{
+		"PUT", "http://localhost/node/policynode/power_policy", `{"policy": "sometimes"}`,
+	})
+	requireStatus(t, "Setting invalid policy", resp, http.StatusBadRequest)
+	resp = adminReq(handler, requestSpec{
+		"PUT", "http://localhost/node/policynode/power_policy", `{"policy": "previous"}`,
+	})
+	requireStatus(t, "Setting policy", resp, http.StatusOK)
+	if policy := getPolicy(); policy != "previous" {
+		t.Fatal("Policy was not set:", policy)
+	}
+
+	resp = adminReq(handler, requestSpec{
+		"PUT", "http://localhost/node/nosuchnode/power_policy", `{"policy": "previous"}`,
+	})
+	requireStatus(t, "Setting policy of a missing node", resp, http.StatusNotFound)
+}
+
+// Verify: rotating a node's OBM password updates its stored info, and
+// keeps its token valid.
+func TestChangeBMCPassword(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "rotatednode", `{"type": "ipmi", "info": {"addr": "10.0.0.11", "pass": "old"}}`)
+	token := getToken(t, handler, "rotatednode")
+
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/node/rotatednode/bmc_users", ""})
+	requireStatus(t, "Listing BMC users", resp, http.StatusOK)
+	if !strings.Contains(resp.Body.String(), `"name":"admin"`) {
+		t.Fatal("Unexpected BMC users:", resp.Body.String())
+	}
+
+	resp = adminReq(handler, requestSpec{"POST", "http://localhost/node/rotatednode/bmc_password", ""})
+	requireStatus(t, "Rotating the BMC password", resp, http.StatusOK)
+	var passwordResp api.PasswordResp
+	if err := json.NewDecoder(resp.Body).Decode(&passwordResp); err != nil {
+		t.Fatal("Decoding password:", err)
+	}
+	if len(passwordResp.Password) != passwordLen {
+		t.Fatalf("Unexpected generated password: %q", passwordResp.Password)
+	}
+	node, err := daemon.state.GetNode("rotatednode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`{"type": "ipmi", "info": {"addr": "10.0.0.11", "pass": %q}}`,
+		passwordResp.Password)
+	if !sameJSON(node.ConnInfo, []byte(expected)) {
+		t.Fatalf("Unexpected stored info: %s", node.ConnInfo)
+	}
+
+	resp = tokenReq(handler, token, requestSpec{"POST", "/node/rotatednode/power_off", ""})
+	requireStatus(t, "Power off after rotating the password", resp, http.StatusOK)
+}
+
+// Verify: if changing a node's OBM password fails part way, the new
+// password is kept as pending, and retries use it.
+func TestPendingBMCPassword(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	faults := &FaultInjector{}
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{
+		WrapOBM: faults.WrapOBM,
+	})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "pendingnode", `{"type": "ipmi", "info": {"addr": "10.0.0.66", "pass": "old"}}`)
+	pending := requestSpec{"GET", "http://localhost/node/pendingnode/bmc_password", ""}
+	adminRequireStatus(t, handler, http.StatusNotFound, pending)
+
+	errpanic(faults.SetRules([]FaultRule{{Op: "change_password", Error: "lost", Count: 1}}))
+	adminRequireStatus(t, handler, http.StatusInternalServerError, requestSpec{
+		"POST", "http://localhost/node/pendingnode/bmc_password", `{"password": "first"}`,
+	})
+	resp := adminReq(handler, pending)
+	requireStatus(t, "Reading the pending password", resp, http.StatusOK)
+	var passwordResp api.PasswordResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&passwordResp))
+	if passwordResp.Password != "first" {
+		t.Fatalf("Expected pending password %q, but got %q.", "first", passwordResp.Password)
+	}
+
+	adminRequireStatus(t, handler, http.StatusConflict, requestSpec{
+		"POST", "http://localhost/node/pendingnode/bmc_password", `{"password": "second"}`,
+	})
+	resp = adminReq(handler, requestSpec{"POST", "http://localhost/node/pendingnode/bmc_password", ""})
+	requireStatus(t, "Retrying the password change", resp, http.StatusOK)
+	errpanic(json.NewDecoder(resp.Body).Decode(&passwordResp))
+	if passwordResp.Password != "first" {
+		t.Fatalf("Expected the retry to use %q, but got %q.", "first", passwordResp.Password)
+	}
+	node, err := daemon.state.GetNode("pendingnode")
+	errpanic(err)
+	if !sameJSON(node.ConnInfo, []byte(`{"type": "ipmi", "info": {"addr": "10.0.0.66", "pass": "first"}}`)) {
+		t.Fatalf("Unexpected stored info: %s", node.ConnInfo)
+	}
+	adminRequireStatus(t, handler, http.StatusNotFound, pending)
+}
+
+// Make sure we can take a backup of the database via the api, and that the result
+// looks like an sqlite database.
+func TestBackup(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, (&requestSpec{"GET", "http://localhost/backup", ""}).toNoAuth())
+	requireStatus(t, "Unauthenticated backup", resp, http.StatusNotFound)
+
+	resp = adminReq(handler, requestSpec{"GET", "http://localhost/backup", ""})
+	requireStatus(t, "Backup", resp, http.StatusOK)
+	if !bytes.HasPrefix(resp.Body.Bytes(), []byte("SQLite format 3\x00")) {
+		t.Fatal("Backup does not look like an sqlite database.")
+	}
+}
+
+// Snapshots should leave out secrets, be the same until something changes,
+// and diff against the current state.
+func TestSnapshot(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "snapnode", `{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.52", "user": "ipmiuser", "pass": "secret"}
+	}`)
+
+	takeSnapshot := func() []byte {
+		resp := adminReq(handler, requestSpec{"GET", "http://localhost/snapshot", ""})
+		requireStatus(t, "Snapshot", resp, http.StatusOK)
+		return resp.Body.Bytes()
+	}
+	before := takeSnapshot()
+	if bytes.Contains(before, []byte("secret")) {
+		t.Fatalf("Snapshot includes the password: %s", before)
+	}
+	if again := takeSnapshot(); !bytes.Equal(before, again) {
+		t.Fatalf("Snapshots differ with no changes:\n%s\n%s", before, again)
+	}
+	var snapshot Snapshot
+	errpanic(json.Unmarshal(before, &snapshot))
+	if info, _ := snapshot.Nodes["snapnode"].Info.(map[string]interface{}); info["pass"] != redacted || info["addr"] != "10.0.0.52" {
+		t.Fatalf("Unexpected info in snapshot: %v", snapshot.Nodes["snapnode"].Info)
+	}
+
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+		"PUT", "http://localhost/node/snapnode/maintenance", `{"reason": "testing"}`,
+	})
+	resp := adminReq(handler, requestSpec{"POST", "http://localhost/snapshot/diff", string(before)})
+	requireStatus(t, "Diffing snapshots", resp, http.StatusOK)
+	var diff api.SnapshotDiffResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&diff))
+	if len(diff.Changes) != 1 || diff.Changes[0].Path != "/nodes/snapnode/maintenance" ||
+		diff.Changes[0].Old != nil || diff.Changes[0].New != "testing" {
+		t.Fatalf("Unexpected changes: %+v", diff.Changes)
+	}
+
+	adminRequireStatus(t, handler, http.StatusBadRequest,
+		requestSpec{"POST", "http://localhost/snapshot/diff", `["not", "a", "snapshot"]`})
+}
+
+// Nodes whose info can't be loaded at startup should be quarantined, rather than
+// preventing the daemon from starting. Check that they are reported, can't be used,
+// and can be fixed by re-registering them.
+func TestQuarantine(t *testing.T) {
+	state := newTestDaemon().state
+	db := state.db
+	_, err := db.Exec(`INSERT INTO nodes(label, obm_info) VALUES ($1, $2)`,
+		"badnode", `{"type": "no-such-driver", "info": {}}`)
+	errpanic(err)
+	errpanic(state.Close())
+
+	state, err = NewState(db, state.driver, StateOptions{})
+	if err != nil {
+		t.Fatal("Loading state with a bad node failed:", err)
+	}
+	handler := makeHandler(NewLiveConfig(theConfig), NewDaemon(state), api.AllAPI)
+
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/quarantine", ""})
+	requireStatus(t, "Listing quarantined nodes", resp, http.StatusOK)
+	var body api.QuarantineResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&body))
+	if _, ok := body.Nodes["badnode"]; !ok || len(body.Nodes) != 1 {
+		t.Fatalf("Unexpected quarantine list: %v", body.Nodes)
+	}
+
+	resp = adminReq(handler, requestSpec{"GET", "http://localhost/node", ""})
+	requireStatus(t, "Listing nodes", resp, http.StatusOK)
+	var nodes api.NodesResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&nodes))
+	if len(nodes.Nodes) != 1 || nodes.Nodes[0] != "badnode" {
+		t.Fatalf("Expected quarantined node to be listed, but got %v", nodes.Nodes)
+	}
+
+	resp = adminReq(handler, requestSpec{"POST", "http://localhost/node/badnode/token", ""})
+	requireStatus(t, "Getting token for quarantined node", resp, http.StatusConflict)
+
+	makeNode(t, handler, "badnode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+	getToken(t, handler, "badnode")
+	resp = adminReq(handler, requestSpec{"GET", "http://localhost/quarantine", ""})
+	body = api.QuarantineResp{}
+	errpanic(json.NewDecoder(resp.Body).Decode(&body))
+	if len(body.Nodes) != 0 {
+		t.Fatalf("Node still quarantined after being fixed: %v", body.Nodes)
+	}
+}
+
+// Operations on an OBM which hangs should time out, returning 504.
+func TestOperationTimeout(t *testing.T) {
+	config := *theConfig
+	config.OperationTimeout = obmd.Duration(100 * time.Millisecond)
+	handler := makeHandler(NewLiveConfig(&config), newTestDaemon(), api.AllAPI)
+	makeNode(t, handler, "hungnode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.5",
+			"hang": true
+		}
+	}`)
+	token := getToken(t, handler, "hungnode")
+	resp := tokenReq(handler, token, requestSpec{"POST", "/node/hungnode/power_off", ""})
+	requireStatus(t, "Power off (hung OBM)", resp, http.StatusGatewayTimeout)
+}
+
+// A request waiting behind a hung operation on the same node should give
+// up when its client does, rather than waiting its turn.
+func TestClientDisconnect(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "gonenode", `{"type": "ipmi", "info": {"addr": "10.0.0.33", "hang": true}}`)
+	token := getToken(t, handler, "gonenode")
+
+	hungCtx, cancelHung := context.WithCancel(context.Background())
+	hung := make(chan error)
+	go func() {
+		hung <- daemon.PowerOffNode(hungCtx, "gonenode", nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	spec := requestSpec{"POST", "/node/gonenode/power_off?token=" + token, ""}
+	req := spec.toNoAuth()
+	resp := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(resp, req.WithContext(ctx))
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Request was still waiting after its client went away.")
+	}
+	requireStatus(t, "Abandoned power off", resp, api.StatusClientClosedRequest)
+
+	cancelHung()
+	if err := <-hung; err != context.Canceled {
+		t.Fatalf("Unexpected error from the hung power off: %v", err)
+	}
+}
+
+// After the daemon is closed, node operations should fail with 503.
+func TestShutdown(t *testing.T) {
+	daemon := newTestDaemon()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3"
+		}
+	}`)
+	token := getToken(t, handler, "somenode")
+	errpanic(daemon.Close())
+	resp := tokenReq(handler, token, requestSpec{"POST", "/node/somenode/power_off", ""})
+	requireStatus(t, "Power off after shutdown", resp, http.StatusServiceUnavailable)
+}
+
+// Changing the admin token in a LiveConfig should take effect immediately.
+func TestReloadAdminToken(t *testing.T) {
+	live := NewLiveConfig(theConfig)
+	handler := makeHandler(live, newTestDaemon(), api.AllAPI)
+	spec := requestSpec{"PUT", "http://localhost/node/somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3"
+		}
+	}`}
+	newConfig := *theConfig
+	errpanic((&newConfig.AdminToken).
+		UnmarshalText([]byte("0123456789abcdef0123456789abcdef")))
+	live.Set(&newConfig)
+
+	// The old token should no longer work:
+	adminRequireStatus(t, handler, http.StatusNotFound, spec)
+
+	// ...but the new one should:
+	req := spec.toNoAuth()
+	req.SetBasicAuth("admin", "0123456789abcdef0123456789abcdef")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	requireStatus(t, "Registering node with new admin token", resp, http.StatusOK)
+}
+
+// Check that the debug handler requires admin credentials, and reports node state.
+func TestDebugNodes(t *testing.T) {
+	daemon := newTestDaemon()
+	live := NewLiveConfig(theConfig)
+	handler := makeHandler(live, daemon, api.AllAPI)
+	debugHandler := makeDebugHandler(live, daemon, nil)
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3"
+		}
+	}`)
+
+	spec := requestSpec{"GET", "http://localhost/debug/nodes", ""}
+	resp := httptest.NewRecorder()
+	debugHandler.ServeHTTP(resp, spec.toNoAuth())
+	requireStatus(t, "Unauthenticated debug request", resp, http.StatusNotFound)
+
+	resp = adminReq(debugHandler, spec)
+	requireStatus(t, "Debug request", resp, http.StatusOK)
+	var body DebugNodesResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&body))
+	info, ok := body.Nodes["somenode"]
+	if !ok {
+		t.Fatalf("Node missing from debug info: %v", body.Nodes)
+	}
+	if info["obm_running"] != true || info["console_connected"] != false {
+		t.Fatalf("Unexpected debug info for node: %v", info)
+	}
+}
+
+// When the admin and user apis are served separately, each handler should only
+// serve its own part.
+func TestSplitAPI(t *testing.T) {
+	daemon := newTestDaemon()
+	live := NewLiveConfig(theConfig)
+	adminHandler := makeHandler(live, daemon, api.AdminAPI)
+	userHandler := makeHandler(live, daemon, api.UserAPI)
+
+	nodeSpec := requestSpec{"PUT", "http://localhost/node/somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3"
+		}
+	}`}
+	adminRequireStatus(t, userHandler, http.StatusNotFound, nodeSpec)
+	makeNode(t, adminHandler, "somenode", nodeSpec.body)
+	token := getToken(t, adminHandler, "somenode")
+
+	powerOff := requestSpec{"POST", "/node/somenode/power_off", ""}
+	resp := tokenReq(adminHandler, token, powerOff)
+	requireStatus(t, "Power off via admin listener", resp, http.StatusNotFound)
+	resp = tokenReq(userHandler, token, powerOff)
+	requireStatus(t, "Power off via user listener", resp, http.StatusOK)
+}
+
+// Request bodies larger than MaxRequestBodyBytes should be rejected.
+func TestMaxRequestBody(t *testing.T) {
+	config := *theConfig
+	config.MaxRequestBodyBytes = 64
+	handler := makeHandler(NewLiveConfig(&config), newTestDaemon(), api.AllAPI)
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+		"PUT", "http://localhost/node/somenode", `{
+			"type": "ipmi",
+			"info": {
+				"addr": "10.0.0.3",
+				"user": "a-long-user-name-to-get-us-over-the-limit"
+			}
+		}`,
+	})
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+		"PUT", "http://localhost/node/somenode", `{"type": "ipmi", "info": {}}`,
+	})
+}
+
+// Operations on a node using the shard driver should be proxied to the
+// worker, including after the worker's token for the node is invalidated.
+func TestShard(t *testing.T) {
+	live := NewLiveConfig(theConfig)
+	workerHandler := makeHandler(live, newTestDaemon(), api.AllAPI)
+	worker := httptest.NewServer(workerHandler)
+	defer worker.Close()
+	config := *theConfig
+	config.Shards = map[string]ShardConfig{
+		"rack1": {URL: worker.URL, AdminToken: theConfig.AdminToken},
+	}
+	front := newTestDaemon()
+	front.state.driver = driver.Registry{"shard": newRegistry(NewLiveConfig(&config), newProcLimits(&config))["shard"]}
+	frontHandler := makeHandler(live, front, api.AllAPI)
+
+	makeNode(t, workerHandler, "worker-node", `{"type": "ipmi", "info": {"addr": "10.0.5.1"}}`)
+	makeNode(t, frontHandler, "front-node",
+		`{"type": "shard", "info": {"shard": "rack1", "label": "worker-node"}}`)
+	token := getToken(t, frontHandler, "front-node")
+
+	resp := tokenReq(frontHandler, token, requestSpec{"POST", "/node/front-node/power_off", ""})
+	requireStatus(t, "Power off", resp, http.StatusOK)
+	if action := mock.LastPowerAction("10.0.5.1"); action != mock.Off {
+		t.Fatalf("Unexpected power action on worker: %q", action)
+	}
+	resp = tokenReq(frontHandler, token, requestSpec{"GET", "/node/front-node/power_status", ""})
+	requireStatus(t, "Power status", resp, http.StatusOK)
+	if !strings.Contains(resp.Body.String(), `"off"`) {
+		t.Fatalf("Unexpected power status from worker: %s", resp.Body.String())
+	}
+
+	resp = adminReq(frontHandler, requestSpec{"GET", "http://localhost/node/front-node/lan", ""})
+	requireStatus(t, "LAN config", resp, http.StatusOK)
+	if !strings.Contains(resp.Body.String(), `"ip_address":"10.0.5.1"`) {
+		t.Fatalf("Unexpected LAN config from worker: %s", resp.Body.String())
+	}
+
+	resp = tokenReq(frontHandler, token, requestSpec{"GET", "/node/front-node/capabilities", ""})
+	requireStatus(t, "Capabilities", resp, http.StatusOK)
+	var caps obmd.Capabilities
+	if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+		t.Fatal("Decoding capabilities:", err)
+	}
+	if strings.Join(caps.BootDevices, ",") != "A,B" {
+		t.Fatalf("Unexpected boot devices from worker: %q", caps.BootDevices)
+	}
+
+	resp = tokenReq(frontHandler, token, requestSpec{
+		"PUT", "/node/front-node/boot_device", `{"bootdev": "C"}`,
+	})
+	requireStatus(t, "Invalid boot device", resp, http.StatusBadRequest)
+
+	adminRequireStatus(t, workerHandler, http.StatusOK,
+		requestSpec{"DELETE", "http://localhost/node/worker-node/token", ""})
+	resp = tokenReq(frontHandler, token, requestSpec{
+		"PUT", "/node/front-node/boot_device", `{"bootdev": "A"}`,
+	})
+	requireStatus(t, "Set boot device after worker token reset", resp, http.StatusOK)
+	if action := mock.LastPowerAction("10.0.5.1"); action != mock.BootDevA {
+		t.Fatalf("Unexpected power action on worker: %q", action)
+	}
+}
+
+// With OBMIdleTimeout set, OBMs should only run while their nodes are in use.
+func TestLazyOBM(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{
+		OBMIdleTimeout: 50 * time.Millisecond,
+	})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	running := func() bool {
+		return daemon.InspectNodes()["somenode"]["obm_running"].(bool)
+	}
+
+	makeNode(t, handler, "somenode", `{"type": "ipmi", "info": {"addr": "10.0.0.3"}}`)
+	if running() {
+		t.Fatal("OBM started before the node was used.")
+	}
+	token := getToken(t, handler, "somenode")
+	resp := tokenReq(handler, token, requestSpec{"POST", "/node/somenode/power_off", ""})
+	requireStatus(t, "Power off", resp, http.StatusOK)
+	if !running() {
+		t.Fatal("OBM not running after the node was used.")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for running() {
+		if time.Now().After(deadline) {
+			t.Fatal("Idle OBM was not stopped.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Health checks shouldn't keep an otherwise idle OBM running, nor start
+// a stopped one.
+func TestHealthChecksIdleOBM(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{
+		OBMIdleTimeout: 50 * time.Millisecond,
+	})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	defer daemon.Close()
+	daemon.SetHealthChecks(5*time.Millisecond, 0)
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	running := func() bool {
+		return daemon.InspectNodes()["somenode"]["obm_running"].(bool)
+	}
+
+	makeNode(t, handler, "somenode", `{"type": "ipmi", "info": {"addr": "10.0.0.71"}}`)
+	time.Sleep(50 * time.Millisecond)
+	if running() {
+		t.Fatal("Health checks started the OBM.")
+	}
+	token := getToken(t, handler, "somenode")
+	resp := tokenReq(handler, token, requestSpec{"POST", "/node/somenode/power_off", ""})
+	requireStatus(t, "Power off", resp, http.StatusOK)
+	deadline := time.Now().Add(5 * time.Second)
+	for running() {
+		if time.Now().After(deadline) {
+			t.Fatal("Idle OBM was not stopped despite health checks.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := daemon.NodeHealth()["somenode"]; !ok {
+		t.Error("Node was not checked while its OBM was running.")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if running() {
+		t.Fatal("Health checks restarted the idle OBM.")
+	}
+}
+
+// An OBM whose Serve takes a while to return once cancelled, and which
+// notes whether two runs ever overlap.
+type slowStopOBM struct {
+	driver.OBM
+	lock    sync.Mutex
+	running int
+	overlap bool
+}
+
+func (o *slowStopOBM) Serve(ctx context.Context) {
+	o.lock.Lock()
+	o.running++
+	o.overlap = o.overlap || o.running > 1
+	o.lock.Unlock()
+	<-ctx.Done()
+	time.Sleep(20 * time.Millisecond)
+	o.lock.Lock()
+	o.running--
+	o.lock.Unlock()
+}
+
+// Stopping an idle OBM should wait for it to shut down, and an OBM which
+// is restarted while shutting down shouldn't run twice at once.
+func TestStopIdleOBMWaits(t *testing.T) {
+	obm := &slowStopOBM{}
+	node := &Node{OBM: obm}
+	node.acquireOBM()
+	node.releaseOBM()
+	if !node.stopIfIdle(0) {
+		t.Fatal("Idle OBM was not stopped.")
+	}
+	obm.lock.Lock()
+	running := obm.running
+	obm.lock.Unlock()
+	if running != 0 {
+		t.Fatal("stopIfIdle returned before the OBM had shut down.")
+	}
+
+	node.acquireOBM()
+	node.releaseOBM()
+	node.StopOBM("test")
+	node.acquireOBM()
+	node.releaseOBM()
+	node.StopOBM("test")
+	node.WaitOBM()
+	obm.lock.Lock()
+	defer obm.lock.Unlock()
+	if obm.overlap {
+		t.Fatal("The OBM was restarted before it had shut down.")
+	}
+}
+
+// With DeferOBMStart, nodes should be loaded without starting their OBMs,
+// which are started by StartOBMs or on first use.
+func TestDeferOBMStart(t *testing.T) {
+	daemon := newTestDaemon()
+	db := daemon.state.db
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	for i := 0; i < 20; i++ {
+		makeNode(t, handler, fmt.Sprintf("node-%d", i),
+			fmt.Sprintf(`{"type": "ipmi", "info": {"addr": "10.0.1.%d"}}`, i))
+	}
+	errpanic(daemon.Close())
+
+	state, err := NewState(db, daemon.state.driver, StateOptions{DeferOBMStart: true})
+	errpanic(err)
+	daemon = NewDaemon(state)
+	defer daemon.Close()
+	handler = makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	nodes := daemon.InspectNodes()
+	if len(nodes) != 20 {
+		t.Fatalf("Expected 20 nodes to be loaded, got %d.", len(nodes))
+	}
+	for label, info := range nodes {
+		if info["obm_running"] != false {
+			t.Fatalf("OBM for %s started before StartOBMs.", label)
+		}
+	}
+
+	token := getToken(t, handler, "node-3")
+	resp := tokenReq(handler, token, requestSpec{"POST", "/node/node-3/power_off", ""})
+	requireStatus(t, "Power off before StartOBMs", resp, http.StatusOK)
+
+	daemon.StartOBMs()
+	for label, info := range daemon.InspectNodes() {
+		if info["obm_running"] != true {
+			t.Fatalf("OBM for %s not running after StartOBMs.", label)
+		}
+	}
+}
+
+// StartOBMs should cope with nodes' OBMs being started by their first use
+// at the same time, rather than trying to start them twice.
+func TestStartOBMsRace(t *testing.T) {
+	// The race is narrow, so try it a few times:
+	for try := 0; try < 200; try++ {
+		state := &State{nodes: make(map[string]*Node)}
+		for i := 0; i < 50; i++ {
+			state.nodes[fmt.Sprintf("node-%d", i)] = &Node{OBM: &slowStopOBM{}}
+		}
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for _, node := range state.nodes {
+			wg.Add(1)
+			go func(node *Node) {
+				defer wg.Done()
+				<-start
+				node.acquireOBM()
+				node.releaseOBM()
+			}(node)
+		}
+		close(start)
+		state.StartOBMs()
+		wg.Wait()
+		for label, node := range state.nodes {
+			if !node.OBMRunning() {
+				t.Fatalf("OBM for %s not running after StartOBMs.", label)
+			}
+			node.StopOBM("shutdown")
+		}
+	}
+}
+
+// Input to the console should be forwarded to the connected session.
+func TestConsoleInput(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{"type": "ipmi", "info": {"addr": "10.0.2.1"}}`)
+	token := getToken(t, handler, "somenode")
+	input := requestSpec{"POST", "http://localhost/node/somenode/console/input", "ls\n"}
+
+	resp := tokenReq(handler, token, input)
+	requireStatus(t, "Input with no console connected", resp, http.StatusConflict)
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	consoleResp, err := http.Get(srv.URL + "/node/somenode/console?token=" + token)
+	if err != nil {
+		t.Fatal("Connecting to the console:", err)
+	}
+	defer consoleResp.Body.Close()
+
+	resp = tokenReq(handler, token, input)
+	requireStatus(t, "Input with a console connected", resp, http.StatusOK)
+	if got := string(mock.ConsoleInput("10.0.2.1")); got != "ls\n" {
+		t.Fatalf("Unexpected console input: %q", got)
+	}
+}
+
+// The admin should be able to list console connections, and forcibly close
+// one without disturbing the others.
+func TestConsoleSessions(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+	token := getToken(t, handler, "somenode")
+
+	// Start a client, returning a channel which is closed when its stream
+	// ends.
+	streamConsole := func() chan struct{} {
+		req := httptest.NewRequest(
+			"GET",
+			"http://localhost/node/somenode/console?token="+token,
+			bytes.NewBuffer(nil),
+		)
+		r, w := io.Pipe()
+		go func() {
+			handler.ServeHTTP(&responseStreamer{
+				header: make(http.Header),
+				body:   w,
+			}, req)
+			w.Close()
+		}()
+		done := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, r)
+			close(done)
+		}()
+		return done
+	}
+
+	listSessions := func() []obmd.ConsoleSession {
+		resp := adminReq(handler, requestSpec{"GET", "http://localhost/console", ""})
+		requireStatus(t, "Listing console sessions", resp, http.StatusOK)
+		var body api.ConsolesResp
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal("Decoding response:", err)
+		}
+		return body.Sessions
+	}
+
+	first := streamConsole()
+	second := streamConsole()
+	var sessions []obmd.ConsoleSession
+	for i := 0; i < 100; i++ {
+		if sessions = listSessions(); len(sessions) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 console sessions, but got %v", sessions)
+	}
+	for _, s := range sessions {
+		if s.Node != "somenode" {
+			t.Fatalf("Unexpected node %q for console session", s.Node)
+		}
+	}
+
+	resp := adminReq(handler, requestSpec{
+		"DELETE", "http://localhost/console/" + sessions[0].ID, ""})
+	requireStatus(t, "Disconnecting console session", resp, http.StatusOK)
+	// We don't know which of the clients connected first, so accept
+	// either; the other should stay connected.
+	other := second
+	select {
+	case <-first:
+	case <-second:
+		other = first
+	case <-time.After(time.Second):
+		t.Fatal("Disconnected console session did not end.")
+	}
+	select {
+	case <-other:
+		t.Fatal("Other console session ended.")
+	default:
+	}
+	if sessions = listSessions(); len(sessions) != 1 {
+		t.Fatalf("Expected 1 console session, but got %v", sessions)
+	}
+
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"DELETE", "http://localhost/console/" + sessions[0].ID + "0", ""})
+}
+
+// A slow console dial shouldn't hold the daemon's lock, blocking e.g. a
+// reload.
+func TestConsoleSlowDial(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "slow", `{"type": "ipmi", "info": {"addr": "10.0.0.68", "dial_delay_ms": 500}}`)
+
+	ctx := context.Background()
+	token, err := daemon.GetNodeToken(ctx, "slow")
+	errpanic(err)
+	dialed := make(chan io.ReadCloser)
+	go func() {
+		conn, err := daemon.DialNodeConsole(ctx, "slow", 0, "192.0.2.1:1234", &token)
+		errpanic(err)
+		dialed <- conn
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	daemon.StartOBMs()
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("Taking the daemon's lock waited %v for a console dial", elapsed)
+	}
+	(<-dialed).Close()
+}
+
+// Console sessions should be recorded in the console audit, with who
+// opened them and how much output they got.
+func TestConsoleAudit(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "audited", `{"type": "ipmi", "info": {"addr": "10.0.0.56"}}`)
+	before := time.Now().UTC().Add(-time.Second).Format(time.RFC3339)
+
+	ctx := context.Background()
+	token, err := daemon.GetNodeToken(ctx, "audited")
+	errpanic(err)
+	conn, err := daemon.DialNodeConsole(ctx, "audited", 0, "192.0.2.1:1234", &token)
+	errpanic(err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	errpanic(err)
+
+	audit := func(query string) []obmd.ConsoleAuditRecord {
+		resp := adminReq(handler, requestSpec{
+			"GET", "http://localhost/node/audited/console_audit" + query, "",
+		})
+		requireStatus(t, "Console audit", resp, http.StatusOK)
+		var body api.ConsoleAuditResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		return body.Sessions
+	}
+	sessions := audit("")
+	if len(sessions) != 1 || sessions[0].Ended != nil || sessions[0].Remote != "192.0.2.1:1234" ||
+		sessions[0].TokenHash != obmd.AuditTokenHash(token) {
+		t.Fatalf("Unexpected console audit of an open session: %+v", sessions)
+	}
+	errpanic(daemon.DisconnectConsole(sessions[0].Session))
+
+	sessions = audit("?from=" + before)
+	if len(sessions) != 1 || sessions[0].Ended == nil || sessions[0].Bytes < 5 ||
+		sessions[0].EndReason != "disconnected" {
+		t.Fatalf("Unexpected console audit of an ended session: %+v", sessions)
+	}
+	if sessions = audit("?to=" + before); len(sessions) != 0 {
+		t.Fatalf("Expected no sessions before the first, but got %+v", sessions)
+	}
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+		"GET", "http://localhost/node/audited/console_audit?from=yesterday", "",
+	})
+}
+
+// Sessions left open when obmd stopped should be recorded as ended when it
+// starts again.
+func TestConsoleAuditRestart(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
+	errpanic(err)
+	_, err = state.StartConsoleAudit("restarted", "1", time.Now(), "", "192.0.2.1:1234")
+	errpanic(err)
+
+	state, err = NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
+	errpanic(err)
+	sessions, err := state.ConsoleAudit("restarted", time.Time{}, time.Time{})
+	errpanic(err)
+	if len(sessions) != 1 || sessions[0].Ended == nil || sessions[0].EndReason != consoleEndRestarted {
+		t.Fatalf("Unexpected console audit after a restart: %+v", sessions)
+	}
+}
+
+// Moving a node to another project should revoke its token, close its
+// console sessions and record the transfer.
+func TestTransferNode(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "owned", `{"type": "ipmi", "info": {"addr": "10.0.0.59", "ignore_soft_off": true}}`)
+	ctx := context.Background()
+	errpanic(daemon.TransferNode(obmd.WithRequester(ctx, obmd.Requester{Identity: "hil"}), "owned", "project-a"))
+
+	token := getToken(t, handler, "owned")
+	var tok obmd.Token
+	errpanic(tok.UnmarshalText([]byte(token)))
+	conn, err := daemon.DialNodeConsole(ctx, "owned", 0, "192.0.2.1:1234", &tok)
+	errpanic(err)
+	defer conn.Close()
+	// Nothing the previous project set up should act on the node after
+	// the transfer:
+	errpanic(daemon.ArmNodeWatchdog(ctx, "owned", 300, &tok))
+	errpanic(daemon.ShutdownNode(ctx, "owned", 50*time.Millisecond, nil))
+
+	spec := requestSpec{"PUT", "http://localhost/node/owned/owner", `{"project": "project-b"}`}
+	req := spec.toAdminAuth()
+	req.Header.Set("X-Requester", "hil")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	requireStatus(t, "Transferring the node", resp, http.StatusOK)
+
+	if _, err = ioutil.ReadAll(conn); err != nil {
+		t.Fatal("Reading the console until it was closed:", err)
+	}
+	resp = tokenReq(handler, token, requestSpec{"GET", "http://localhost/node/owned/power_status", ""})
+	requireStatus(t, "Using the previous project's token", resp, http.StatusUnauthorized)
+	conn.Close()
+	if status, err := daemon.NodeWatchdog(ctx, "owned", nil); err != nil || status.Running {
+		t.Fatalf("Expected the watchdog to be stopped by the transfer: %+v (%v)", status, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if action := mock.LastPowerAction("10.0.0.59"); action == mock.Off {
+		t.Fatal("The shutdown was escalated after the transfer.")
+	}
+	if sessions, err := daemon.NodeConsoleAudit("owned", time.Time{}, time.Time{}); err != nil ||
+		len(sessions) != 1 || sessions[0].EndReason != "token_revoked" {
+		t.Fatalf("Unexpected console audit after the transfer: %+v (%v)", sessions, err)
+	}
+
+	resp = adminReq(handler, requestSpec{"GET", "http://localhost/node/owned/owner", ""})
+	requireStatus(t, "Querying the owner", resp, http.StatusOK)
+	var owner api.OwnerResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&owner))
+	if owner.Project != "project-b" || len(owner.Transfers) != 2 ||
+		owner.Transfers[0].From != "" || owner.Transfers[0].To != "project-a" ||
+		owner.Transfers[1].From != "project-a" || owner.Transfers[1].To != "project-b" ||
+		owner.Transfers[1].Requester != "hil" {
+		t.Fatalf("Unexpected owner: %+v", owner)
+	}
+
+	// Ownership follows the node when it is renamed.
+	errpanic(daemon.RenameNode("owned", "renamed"))
+	if project, transfers, err := daemon.NodeOwner("renamed"); err != nil ||
+		project != "project-b" || len(transfers) != 2 {
+		t.Fatalf("Unexpected owner after renaming: %q, %+v (%v)", project, transfers, err)
+	}
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+		"PUT", "http://localhost/node/renamed/owner", "",
+	})
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"PUT", "http://localhost/node/nosuchnode/owner", `{"project": "project-b"}`,
+	})
+}
+
+// The expect call should return the first line matching the pattern, with
+// the requested context, or time out.
+func TestConsoleExpect(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"user": "ipmiuser",
+			"pass": "secret"
+		}
+	}`)
+	token := getToken(t, handler, "somenode")
+
+	// The mock driver's console counts up from wherever it left off, one
+	// number per line.
+	resp := tokenReq(handler, token, requestSpec{
+		"POST", "http://localhost/node/somenode/console/expect",
+		`{"pattern": "^[0-9]*5$", "context": 2, "timeout": "5s"}`,
+	})
+	requireStatus(t, "Expecting console output", resp, http.StatusOK)
+	var body api.ExpectResp
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal("Decoding response:", err)
+	}
+	var n int
+	if _, err := fmt.Sscanf(body.Line, "%d", &n); err != nil || n%10 != 5 {
+		t.Fatalf("Unexpected matching line %q", body.Line)
+	}
+	expected := []string{fmt.Sprint(n - 2), fmt.Sprint(n - 1)}
+	if body.Match != body.Line || len(body.Before) != 2 ||
+		body.Before[0] != expected[0] || body.Before[1] != expected[1] {
+		t.Fatalf("Unexpected response %+v", body)
+	}
+
+	resp = tokenReq(handler, token, requestSpec{
+		"POST", "http://localhost/node/somenode/console/expect",
+		`{"pattern": "never", "timeout": "10ms"}`,
+	})
+	requireStatus(t, "Expecting missing console output", resp, http.StatusGatewayTimeout)
+
+	resp = tokenReq(handler, token, requestSpec{
+		"POST", "http://localhost/node/somenode/console/expect",
+		`{"pattern": "(", "timeout": "10ms"}`,
+	})
+	requireStatus(t, "Expecting with an invalid pattern", resp, http.StatusBadRequest)
+}
+
+// When a client goes away, its console stream should be torn down, even if
+// there is no output to write to it.
+func TestConsoleClientGone(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3",
+			"quiet": true
+		}
+	}`)
+	token := getToken(t, handler, "somenode")
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	numSessions := func() int {
+		resp := adminReq(handler, requestSpec{"GET", "http://localhost/console", ""})
+		var body api.ConsolesResp
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal("Decoding response:", err)
+		}
+		return len(body.Sessions)
+	}
+	waitSessions := func(n int) {
+		for i := 0; i < 100; i++ {
+			if numSessions() == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d console sessions, but got %d", n, numSessions())
+	}
+
+	resp, err := http.Get(srv.URL + "/node/somenode/console?token=" + token)
+	if err != nil {
+		t.Fatal("Connecting to the console:", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status connecting to the console:", resp.StatusCode)
+	}
+	waitSessions(1)
+	resp.Body.Close()
+	waitSessions(0)
+}
+
+// When a console stream ends, its trailer should say why.
+func TestConsoleEndReason(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{"type": "ipmi", "info": {"addr": "10.0.0.40"}}`)
+	token := getToken(t, handler, "somenode")
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/node/somenode/console?token=" + token)
+	if err != nil {
+		t.Fatal("Connecting to the console:", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status connecting to the console:", resp.StatusCode)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		done <- err
+	}()
+
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+		"DELETE", "http://localhost/node/somenode/token", ""})
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal("Reading from the console:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Console stream did not end after the token was invalidated.")
+	}
+	if reason := resp.Trailer.Get("Console-End-Reason"); reason != "token_revoked" {
+		t.Fatalf("Expected end reason %q, but got %q", "token_revoked", reason)
+	}
+}
+
+// Responses should report the node's version, which should change when the
+// node's info does, and operations with a stale expect_version should fail.
+func TestNodeVersion(t *testing.T) {
+	daemon := newTestDaemon()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "somenode", `{"type": "ipmi", "info": {"addr": "10.0.0.45"}}`)
+	resp := adminReq(handler, requestSpec{"POST", "http://localhost/node/somenode/token", ""})
+	requireStatus(t, "Getting token", resp, http.StatusOK)
+	var tokenResp api.TokenResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&tokenResp))
+	text, err := tokenResp.Token.MarshalText()
+	errpanic(err)
+	token := string(text)
+	version := tokenResp.Version
+	if version == "" {
+		t.Fatal("No version in token response.")
+	}
+
+	// Make a request with our token, expecting the given version (if
+	// not empty).
+	versionReq := func(method, path, expect string) *httptest.ResponseRecorder {
+		url := "http://localhost/node/somenode/" + path + "?token=" + token
+		if expect != "" {
+			url += "&expect_version=" + expect
+		}
+		spec := requestSpec{method, url, ""}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, spec.toNoAuth())
+		return resp
+	}
+	statusReq := func(expect string) *httptest.ResponseRecorder {
+		return versionReq("GET", "power_status", expect)
+	}
+	resp = statusReq("")
+	requireStatus(t, "Getting power status", resp, http.StatusOK)
+	if got := resp.Header().Get("Node-Version"); got != version {
+		t.Fatalf("Node-Version is %q; expected %q", got, version)
+	}
+	requireStatus(t, "Getting power status with the right version",
+		statusReq(version), http.StatusOK)
+
+	// Changing the node's info keeps its token, but not its version:
+	errpanic(daemon.state.UpdateNodeInfo("somenode",
+		[]byte(`{"type": "ipmi", "info": {"addr": "10.0.0.46"}}`)))
+	requireStatus(t, "Getting power status with a stale version",
+		statusReq(version), http.StatusPreconditionFailed)
+	resp = versionReq("POST", "power_off", version)
+	requireStatus(t, "Powering off with a stale version", resp, http.StatusPreconditionFailed)
+	resp = statusReq("")
+	requireStatus(t, "Getting power status after the update", resp, http.StatusOK)
+	newVersion := resp.Header().Get("Node-Version")
+	if newVersion == version || newVersion == "" {
+		t.Fatalf("Version %q didn't change after updating the node's info.", version)
+	}
+
+	// The version should survive a restart:
+	state, err := NewState(daemon.state.db, driver.Registry{"ipmi": mock.Driver},
+		StateOptions{DeferOBMStart: true})
+	errpanic(err)
+	node, err := state.GetNode("somenode")
+	errpanic(err)
+	if node.Version != newVersion {
+		t.Fatalf("Version %q was not persisted; got %q after reloading.", newVersion, node.Version)
+	}
+}
+
+// With ?status=true, the console response's headers should give the node's
+// power state and boot device, leaving the stream itself alone.
+func TestConsoleStatus(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{"type": "ipmi", "info": {"addr": "10.0.0.47"}}`)
+	token := getToken(t, handler, "somenode")
+	resp := tokenReq(handler, token, requestSpec{"PUT",
+		"http://localhost/node/somenode/boot_device", `{"bootdev": "B"}`})
+	requireStatus(t, "Setting boot device", resp, http.StatusOK)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	consoleResp, err := http.Get(srv.URL + "/node/somenode/console?status=true&token=" + token)
+	if err != nil {
+		t.Fatal("Connecting to the console:", err)
+	}
+	defer consoleResp.Body.Close()
+	if consoleResp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status connecting to the console:", consoleResp.StatusCode)
+	}
+	for name, expected := range map[string]string{
+		"Console-Power":        string(driver.PowerStateOn),
+		"Console-Bootdev":      "B",
+		"Console-Status-Error": "",
+	} {
+		if actual := consoleResp.Header.Get(name); actual != expected {
+			t.Errorf("Expected %s %q, but got %q.", name, expected, actual)
+		}
+	}
+	line, err := bufio.NewReader(consoleResp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal("Reading from the console:", err)
+	}
+	// The mock's console prints numbers:
+	if _, err = strconv.Atoi(strings.TrimSpace(line)); err != nil {
+		t.Fatalf("Expected the console's own output first, but got %q.", line)
+	}
+}
+
+// With ?compress=true, the console stream should be compressed if the client
+// accepts it, with output still arriving as it is produced.
+func TestConsoleCompress(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{"type": "ipmi", "info": {"addr": "10.0.0.41"}}`)
+	token := getToken(t, handler, "somenode")
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/node/somenode/console?compress=true&token="+token, nil)
+	errpanic(err)
+	// Setting this ourselves stops the client from decompressing the
+	// response for us.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Connecting to the console:", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status connecting to the console:", resp.StatusCode)
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Expected gzip encoding, but got %q", enc)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal("Reading gzip header:", err)
+	}
+	line, err := bufio.NewReader(zr).ReadString('\n')
+	if err != nil {
+		t.Fatal("Reading from the console:", err)
+	}
+	if strings.TrimSpace(line) == "" {
+		t.Fatal("Empty line read from the console.")
+	}
+}
+
+// Console statistics should reflect the connections made to a node.
+func TestConsoleStats(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "somenode", `{
+		"type": "ipmi",
+		"info": {
+			"addr": "10.0.0.3"
+		}
+	}`)
+	token := getToken(t, handler, "somenode")
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	getStats := func() obmd.ConsoleStats {
+		resp := tokenReq(handler, token, requestSpec{
+			"GET", "http://localhost/node/somenode/console/stats", ""})
+		requireStatus(t, "Getting console stats", resp, http.StatusOK)
+		var stats obmd.ConsoleStats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatal("Decoding response:", err)
+		}
+		return stats
+	}
+
+	resp, err := http.Get(srv.URL + "/node/somenode/console?token=" + token)
+	if err != nil {
+		t.Fatal("Connecting to the console:", err)
+	}
+	buf := make([]byte, 100)
+	if _, err = io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal("Reading from the console:", err)
+	}
+	stats := getStats()
+	if stats.Sessions != 1 || stats.Active != 1 || stats.BytesStreamed < 100 {
+		t.Fatalf("Unexpected stats while connected: %+v", stats)
+	}
+	resp.Body.Close()
+	for i := 0; i < 100 && stats.Active != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stats = getStats()
+	}
+	if stats.Active != 0 {
+		t.Fatalf("Unexpected stats after disconnecting: %+v", stats)
+	}
+
+	resp2 := tokenReq(handler, strings.Repeat("0", 32), requestSpec{
+		"GET", "http://localhost/node/somenode/console/stats", ""})
+	requireStatus(t, "Getting console stats with a bad token", resp2, http.StatusUnauthorized)
+}
+
+// Verify: faults set via the debug handler are injected into OBM
+// operations, and expire after their count.
+func TestFaultInjection(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	faults := &FaultInjector{}
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{
+		WrapOBM: faults.WrapOBM,
+	})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	live := NewLiveConfig(theConfig)
+	handler := makeHandler(live, daemon, api.AllAPI)
+	debugHandler := makeDebugHandler(live, daemon, faults)
+	makeNode(t, handler, "faultynode", `{"type": "ipmi", "info": {"addr": "10.0.0.13"}}`)
+	token := getToken(t, handler, "faultynode")
+
+	adminRequireStatus(t, debugHandler, http.StatusBadRequest, requestSpec{
+		"PUT", "http://localhost/debug/faults", `{"faults": [{"op": "bogus", "error": "x"}]}`,
+	})
+	adminRequireStatus(t, debugHandler, http.StatusOK, requestSpec{
+		"PUT", "http://localhost/debug/faults", `{"faults": [
+			{"node": "faultynode", "op": "power_off", "error": "injected", "count": 1},
+			{"driver": "ipmi", "op": "power_status", "corrupt": true}
+		]}`,
+	})
+
+	powerOff := requestSpec{"POST", "/node/faultynode/power_off", ""}
+	requireStatus(t, "Power off with a fault", tokenReq(handler, token, powerOff),
+		http.StatusInternalServerError)
+	requireStatus(t, "Power off after the fault expired", tokenReq(handler, token, powerOff),
+		http.StatusOK)
+
+	resp := tokenReq(handler, token, requestSpec{"GET", "/node/faultynode/power_status", ""})
+	requireStatus(t, "Corrupted power status", resp, http.StatusOK)
+	var powerResp api.PowerResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&powerResp))
+	if powerResp.Power != driver.PowerStateOn {
+		t.Fatalf("Expected the power status to be flipped to on, but got %q.",
+			powerResp.Power)
+	}
+
+	resp = adminReq(debugHandler, requestSpec{"GET", "http://localhost/debug/faults", ""})
+	requireStatus(t, "Listing faults", resp, http.StatusOK)
+	var args FaultsArgs
+	errpanic(json.NewDecoder(resp.Body).Decode(&args))
+	if len(args.Faults) != 1 || args.Faults[0].Op != "power_status" {
+		t.Fatalf("Expected only the power_status fault to remain, but got %+v.",
+			args.Faults)
+	}
+	adminRequireStatus(t, debugHandler, http.StatusOK,
+		requestSpec{"DELETE", "http://localhost/debug/faults", ""})
+	if rules := faults.Rules(); len(rules) != 0 {
+		t.Fatalf("Expected no faults after clearing them, but got %+v.", rules)
+	}
+}
+
+// OBM operations should be counted by driver, model and operation, with
+// the model from the node's info, or from its OBM.
+func TestDriverMetrics(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	metrics := NewDriverMetrics()
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{
+		WrapOBM: metrics.WrapOBM,
+	})
+	errpanic(err)
+	handler := makeHandler(NewLiveConfig(theConfig), NewDaemon(state), api.AllAPI)
+	makeNode(t, handler, "modelled", `{"type": "ipmi", "model": "Acme X1", "info": {"addr": "10.0.0.50"}}`)
+	makeNode(t, handler, "unmodelled", `{"type": "ipmi", "info": {"addr": "10.0.0.51"}}`)
+
+	powerOff := func(label string) {
+		token := getToken(t, handler, label)
+		requireStatus(t, "Power off", tokenReq(handler, token,
+			requestSpec{"POST", "/node/" + label + "/power_off", ""}), http.StatusOK)
+	}
+	powerOff("modelled")
+	powerOff("modelled")
+	if stats := metrics.Stats()["ipmi"]["Acme X1"]["power_off"]; stats.OK != 2 || stats.Failed != 0 {
+		t.Fatalf("Unexpected stats for the modelled node: %+v", stats)
+	}
+
+	// The other node's model is looked up in the background, after its
+	// first operation:
+	powerOff("unmodelled")
+	for i := 0; metrics.Stats()["ipmi"]["Mock Model"]["power_off"].OK == 0; i++ {
+		if i == 100 {
+			t.Fatalf("The node's model was never looked up: %+v", metrics.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+		powerOff("unmodelled")
+	}
+	if stats := metrics.Stats()["ipmi"]["unknown"]["power_off"]; stats.OK == 0 {
+		t.Fatalf("Expected the first operation to be under \"unknown\": %+v", metrics.Stats())
+	}
+}
+
+// An OBM whose Model fails the first `fails` times it is called.
+type flakyModelOBM struct {
+	driver.OBM
+	lock  sync.Mutex
+	fails int
+}
+
+func (o *flakyModelOBM) Model(ctx context.Context) (string, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.fails > 0 {
+		o.fails--
+		return "", errors.New("timed out")
+	}
+	return "Acme X2", nil
+}
+
+// A failed model lookup should be retried later, and forgotten along with
+// the node.
+func TestModelLookupRetry(t *testing.T) {
+	metrics := NewDriverMetrics()
+	metrics.retryMinDelay = time.Millisecond
+	metrics.retryMaxDelay = 10 * time.Millisecond
+	obm := &flakyModelOBM{fails: 3}
+	for i := 0; metrics.reportedModel("flaky", obm) != "Acme X2"; i++ {
+		if i == 100 {
+			t.Fatal("The node's model was never looked up again.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	metrics.ForgetOBM("flaky")
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if len(metrics.models) != 0 {
+		t.Fatalf("Expected the node's model to be forgotten: %+v", metrics.models)
+	}
+}
+
+func TestRedfish(t *testing.T) {
+	config := *theConfig
+	config.Redfish = true
+	live := NewLiveConfig(&config)
+	daemon := newTestDaemon()
+	handler := makeHandler(live, daemon, api.AllAPI)
+	makeNode(t, handler, "rf-1", `{"type": "ipmi", "info": {"addr": "10.0.0.14"}}`)
+	makeNode(t, handler, "rf-2", `{"type": "ipmi", "info": {"addr": "10.0.0.15"}}`)
+	token := getToken(t, handler, "rf-1")
+
+	// Requests authenticated with rf-1's token:
+	nodeReq := func(spec requestSpec) *httptest.ResponseRecorder {
+		req := spec.toNoAuth()
+		req.SetBasicAuth("rf-1", token)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+	members := func(resp *httptest.ResponseRecorder) []string {
+		var coll struct {
+			Members []struct {
+				ID string `json:"@odata.id"`
+			}
+		}
+		errpanic(json.NewDecoder(resp.Body).Decode(&coll))
+		var ret []string
+		for _, m := range coll.Members {
+			ret = append(ret, m.ID)
+		}
+		return ret
+	}
+	powerState := func(resp *httptest.ResponseRecorder) interface{} {
+		var system map[string]interface{}
+		errpanic(json.NewDecoder(resp.Body).Decode(&system))
+		return system["PowerState"]
+	}
+
+	requireStatus(t, "Unauthenticated service root",
+		noAuthReq(handler, requestSpec{"GET", "/redfish/v1/", ""}), http.StatusOK)
+	requireStatus(t, "Unauthenticated systems",
+		noAuthReq(handler, requestSpec{"GET", "/redfish/v1/Systems", ""}), http.StatusUnauthorized)
+
+	resp := adminReq(handler, requestSpec{"GET", "/redfish/v1/Systems", ""})
+	if got := members(resp); strings.Join(got, " ") != "/redfish/v1/Systems/rf-1 /redfish/v1/Systems/rf-2" {
+		t.Fatalf("Admin's systems: got %q", got)
+	}
+	resp = nodeReq(requestSpec{"GET", "/redfish/v1/Systems", ""})
+	if got := members(resp); strings.Join(got, " ") != "/redfish/v1/Systems/rf-1" {
+		t.Fatalf("Node token's systems: got %q", got)
+	}
+	requireStatus(t, "Other node's system",
+		nodeReq(requestSpec{"GET", "/redfish/v1/Systems/rf-2", ""}), http.StatusNotFound)
+
+	reset := func(typ string) requestSpec {
+		return requestSpec{"POST", "/redfish/v1/Systems/rf-1/Actions/ComputerSystem.Reset",
+			`{"ResetType": "` + typ + `"}`}
+	}
+	requireStatus(t, "ForceOff", nodeReq(reset("ForceOff")), http.StatusNoContent)
+	if state := powerState(nodeReq(requestSpec{"GET", "/redfish/v1/Systems/rf-1", ""})); state != "Off" {
+		t.Fatalf("Expected PowerState Off, got %v", state)
+	}
+	requireStatus(t, "On", nodeReq(reset("On")), http.StatusNoContent)
+	if state := powerState(nodeReq(requestSpec{"GET", "/redfish/v1/Systems/rf-1", ""})); state != "On" {
+		t.Fatalf("Expected PowerState On, got %v", state)
+	}
+	requireStatus(t, "GracefulShutdown", nodeReq(reset("GracefulShutdown")), http.StatusNoContent)
+	if state := powerState(nodeReq(requestSpec{"GET", "/redfish/v1/Systems/rf-1", ""})); state != "Off" {
+		t.Fatalf("Expected PowerState Off after GracefulShutdown, got %v", state)
+	}
+	requireStatus(t, "GracefulRestart", nodeReq(reset("GracefulRestart")), http.StatusBadRequest)
+	// Errors get the same statuses as in the rest of the api:
+	errpanic(daemon.SetNodeMaintenance("rf-1", true, "testing"))
+	requireStatus(t, "ForceOff in maintenance mode", nodeReq(reset("ForceOff")), http.StatusLocked)
+	errpanic(daemon.SetNodeMaintenance("rf-1", false, ""))
+
+	// The mock driver only accepts boot devices "A" and "B":
+	requireStatus(t, "Boot override", nodeReq(requestSpec{"PATCH", "/redfish/v1/Systems/rf-1",
+		`{"Boot": {"BootSourceOverrideTarget": "Pxe", "BootSourceOverrideEnabled": "Continuous"}}`}),
+		http.StatusBadRequest)
+	requireStatus(t, "Unknown boot override", nodeReq(requestSpec{"PATCH", "/redfish/v1/Systems/rf-1",
+		`{"Boot": {"BootSourceOverrideTarget": "Floppy"}}`}), http.StatusBadRequest)
+
+	// With Redfish disabled:
+	handler = makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	requireStatus(t, "Disabled Redfish",
+		adminReq(handler, requestSpec{"GET", "/redfish/v1/Systems", ""}), http.StatusNotFound)
+}
+
+func TestPrometheusSD(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "sd-b", `{"type": "ipmi", "info": {"addr": "10.0.0.16", "pass": "secret"}}`)
+	makeNode(t, handler, "sd-a", `{"type": "ipmi", "info": {"addr": "10.0.0.17"}}`)
+
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/sd/prometheus", ""})
+	requireStatus(t, "Prometheus service discovery", resp, http.StatusOK)
+	if strings.Contains(resp.Body.String(), "secret") {
+		t.Fatalf("Service discovery leaked OBM credentials: %s", resp.Body)
+	}
+	var groups []obmd.PrometheusTargetGroup
+	errpanic(json.NewDecoder(resp.Body).Decode(&groups))
+	if len(groups) != 2 || groups[0].Targets[0] != "sd-a" || groups[1].Targets[0] != "sd-b" {
+		t.Fatalf("Unexpected target groups: %+v", groups)
+	}
+	if groups[1].Labels["__meta_obmd_addr"] != "10.0.0.16" ||
+		groups[1].Labels["__meta_obmd_driver"] != "ipmi" {
+		t.Fatalf("Unexpected labels: %v", groups[1].Labels)
+	}
+
+	requireStatus(t, "Service discovery without admin credentials",
+		tokenReq(handler, "", requestSpec{"GET", "http://localhost/sd/prometheus", ""}),
+		http.StatusNotFound)
+}
+
+// An eventPublisher which records the events it is given.
+type recordingPublisher struct {
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(ev events.Event) {
+	p.events = append(p.events, ev)
+}
+
+func TestEvents(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	pub := &recordingPublisher{}
+	daemon.SetEventPublisher(pub)
+	ctx := context.Background()
+
+	errpanic(daemon.SetNode("evnode", mockNodeInfo("10.0.0.18")))
+	errpanic(daemon.PowerCycleNode(ctx, "evnode", true, nil))
+	errpanic(daemon.SetNodeBootDev(ctx, "evnode", "A", nil))
+	// Failed operations aren't published:
+	if daemon.SetNodeBootDev(ctx, "evnode", "bogus", nil) == nil {
+		t.Fatal("Setting an invalid boot device succeeded.")
+	}
+	errpanic(daemon.PowerOffNode(ctx, "evnode", nil))
+	errpanic(daemon.DeleteNode("evnode"))
+
+	want := []string{
+		"node_registered", "power_cycle", "bootdev_set", "power_off", "node_deleted",
+	}
+	if len(pub.events) != len(want) {
+		t.Fatalf("Published %d events; want %d: %+v", len(pub.events), len(want), pub.events)
+	}
+	for i, ev := range pub.events {
+		if ev.Type != want[i] || ev.Node != "evnode" {
+			t.Fatalf("Event %d is %+v; want a %s event for evnode", i, ev, want[i])
+		}
+	}
+	if pub.events[1].Detail["force"] != "true" || pub.events[2].Detail["bootdev"] != "A" {
+		t.Fatalf("Unexpected event details: %+v", pub.events)
+	}
+}
+
+// Errors the daemon or driver returns without the OBM being at fault
+// shouldn't count towards alerts.
+func TestIsOBMFailure(t *testing.T) {
+	for _, err := range []error{
+		nil, obmd.ErrNodeDraining, obmd.ErrNodeInPowerGroup, obmd.ErrGroupPowerLimit,
+		obmd.ErrPasswordPending, obmd.ErrNoPendingPassword, obmd.ErrWatchdogTimeoutTooShort,
+		obmd.PolicyDeniedError{Reason: "no"}, obmd.ErrPolicyUnavailable, obmd.ErrShuttingDown,
+		obmd.ErrNodeInMaintenance, obmd.ErrInvalidShutdownTimeout, obmd.ErrNoSuchNode,
+		driver.ErrInvalidWatchdogTimeout, &driver.InvalidInfoError{},
+	} {
+		if isOBMFailure(err) {
+			t.Errorf("%v was counted as an OBM failure.", err)
+		}
+	}
+	for _, err := range []error{
+		errors.New("ipmitool: timed out"), driver.TransientError{Err: errors.New("timed out")},
+	} {
+		if !isOBMFailure(err) {
+			t.Errorf("%v wasn't counted as an OBM failure.", err)
+		}
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	faults := &FaultInjector{}
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{
+		WrapOBM: faults.WrapOBM,
+	})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	defer daemon.Close()
+
+	cfg := *theConfig
+	cfg.Alerts = AlertsConfig{Threshold: 2, SlackWebhook: "http://alerts.example.com/hook"}
+	a := newAlerter(NewLiveConfig(&cfg))
+	sent := make(chan alert.Message, 10)
+	a.send = func(ctx context.Context, cfg alert.Config, msg alert.Message) error {
+		sent <- msg
+		return nil
+	}
+	daemon.SetAlerter(a)
+	errpanic(daemon.SetNode("alertnode", mockNodeInfo("10.0.0.19")))
+	ctx := context.Background()
+
+	expectAlert := func(desc, subject string) {
+		select {
+		case msg := <-sent:
+			if !strings.Contains(msg.Subject, subject) {
+				t.Fatalf("%s: got alert %q; want one containing %q", desc, msg.Subject, subject)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no alert sent", desc)
+		}
+	}
+	expectNone := func(desc string) {
+		select {
+		case msg := <-sent:
+			t.Fatalf("%s: unexpected alert %q", desc, msg.Subject)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	errpanic(faults.SetRules([]FaultRule{{Op: "power_off", Error: "BMC unreachable"}}))
+	if daemon.PowerOffNode(ctx, "alertnode", nil) == nil {
+		t.Fatal("Power off with a fault succeeded.")
+	}
+	// Errors caused by the request don't count:
+	if daemon.SetNodeBootDev(ctx, "alertnode", "bogus", nil) == nil {
+		t.Fatal("Setting an invalid boot device succeeded.")
+	}
+	expectNone("After one failure")
+	daemon.PowerOffNode(ctx, "alertnode", nil)
+	expectAlert("After two failures", "alertnode is failing")
+	daemon.PowerOffNode(ctx, "alertnode", nil)
+	expectNone("After three failures")
+
+	errpanic(faults.SetRules(nil))
+	errpanic(daemon.PowerOffNode(ctx, "alertnode", nil))
+	expectAlert("After recovering", "alertnode recovered")
+	errpanic(daemon.PowerOffNode(ctx, "alertnode", nil))
+	expectNone("After another success")
+}
+
+// Reading a node's event log shouldn't hold the node's lock.
+func TestSELReadUnlocked(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	errpanic(daemon.SetNode("slowsel", []byte(`{"type": "ipmi", "info": {"addr": "10.0.0.70", "hang": true}}`)))
+	done := make(chan struct{})
+	go func() {
+		daemon.checkNodeSEL("slowsel", 500*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	_, err := daemon.GetNodeToken(context.Background(), "slowsel")
+	errpanic(err)
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("Getting a token waited %v for the event log to be read", elapsed)
+	}
+	<-done
+}
+
+// Critical entries added to a node's event log should be published and
+// alerted on, once each.
+func TestSELMonitoring(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	pub := &recordingPublisher{}
+	daemon.SetEventPublisher(pub)
+	cfg := *theConfig
+	cfg.Alerts = AlertsConfig{SlackWebhook: "http://alerts.example.com/hook"}
+	a := newAlerter(NewLiveConfig(&cfg))
+	sent := make(chan alert.Message, 10)
+	a.send = func(ctx context.Context, cfg alert.Config, msg alert.Message) error {
+		sent <- msg
+		return nil
+	}
+	daemon.SetAlerter(a)
+
+	addr := "10.0.0.62"
+	mock.AddEventLogEntry(addr, "Memory #0x01", "Uncorrectable ECC")
+	errpanic(daemon.SetNode("selnode", mockNodeInfo(addr)))
+	// Entries from before the log was first read aren't reported:
+	daemon.checkNodeSEL("selnode", time.Second)
+	mock.AddEventLogEntry(addr, "Memory #0x01", "Correctable ECC")
+	mock.AddEventLogEntry(addr, "Power Supply #0x51", "Failure detected")
+	daemon.checkNodeSEL("selnode", time.Second)
+	daemon.checkNodeSEL("selnode", time.Second)
+	// Clearing the log numbers entries from 1 again:
+	mock.ClearEventLog(addr)
+	mock.AddEventLogEntry(addr, "Processor #0x01", "Thermal Trip")
+	daemon.checkNodeSEL("selnode", time.Second)
+
+	var critical []events.Event
+	for _, ev := range pub.events {
+		if ev.Type == "sel_critical" {
+			critical = append(critical, ev)
+		}
+	}
+	if len(critical) != 2 ||
+		critical[0].Detail["kind"] != "psu_failure" || critical[0].Detail["record_id"] != "3" ||
+		critical[0].Detail["sensor"] != "Power Supply #0x51" ||
+		critical[1].Detail["kind"] != "thermal_trip" || critical[1].Detail["record_id"] != "1" {
+		t.Fatalf("Unexpected sel_critical events: %+v", critical)
+	}
+	for _, subject := range []string{"a power supply failure", "a thermal trip"} {
+		select {
+		case msg := <-sent:
+			if !strings.Contains(msg.Subject, "selnode reported "+subject) {
+				t.Fatalf("Got alert %q; want one about %s", msg.Subject, subject)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No alert sent about %s", subject)
+		}
+	}
+}
+
+func TestWebUI(t *testing.T) {
+	cfg := *theConfig
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	live := NewLiveConfig(&cfg)
+	handler := makeHandler(live, daemon, api.AllAPI)
+
+	ui := requestSpec{"GET", "http://localhost/ui/", ""}
+	requireStatus(t, "UI while disabled", noAuthReq(handler, ui), http.StatusNotFound)
+
+	cfg.WebUI = true
+	resp := noAuthReq(handler, ui)
+	requireStatus(t, "UI", resp, http.StatusOK)
+	if !strings.HasPrefix(resp.Header().Get("Content-Type"), "text/html") ||
+		!strings.Contains(resp.Header().Get("Content-Security-Policy"), "script-src 'sha256-") {
+		t.Fatalf("Unexpected headers: %v", resp.Header())
+	}
+	requireStatus(t, "UI without a trailing slash",
+		noAuthReq(handler, requestSpec{"GET", "http://localhost/ui", ""}),
+		http.StatusMovedPermanently)
+
+	// The UI needs both parts of the api:
+	requireStatus(t, "UI on the admin listener",
+		noAuthReq(makeHandler(live, daemon, api.AdminAPI), ui), http.StatusNotFound)
+}
+
+func TestKubeController(t *testing.T) {
+	const path = "/apis/obmd.io/v1alpha1/namespaces/ns/obmnodes"
+	patches := make(chan string, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == path && req.URL.Query().Get("watch") == "":
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "1"}, "items": [
+				{"metadata": {"name": "kube-a", "generation": 3},
+				 "spec": {"type": "ipmi", "info": {"addr": "10.0.0.20"}}}
+			]}`)
+		case req.URL.Path == path:
+			fmt.Fprint(w, `{"type": "ADDED", "object": {"metadata": {"name": "kube-b"},
+				"spec": {"type": "ipmi", "info": {"addr": "10.0.0.21"}}}}`)
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+		case req.Method == "PATCH":
+			body, _ := ioutil.ReadAll(req.Body)
+			patches <- strings.TrimPrefix(req.URL.Path, path+"/") + " " + string(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := *theConfig
+	cfg.Kubernetes = KubernetesConfig{
+		Enabled:        true,
+		APIServer:      srv.URL,
+		Namespace:      "ns",
+		StatusInterval: obmd.Duration(10 * time.Millisecond),
+	}
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	ctl, err := newKubeController(NewLiveConfig(&cfg), daemon)
+	errpanic(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctl.Run(ctx)
+
+	// Both nodes get registered, and their status written:
+	seen := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for !seen["kube-a"] || !seen["kube-b"] {
+		select {
+		case patch := <-patches:
+			if strings.HasPrefix(patch, "kube-a/status ") {
+				if !strings.Contains(patch, `"reachable":true`) ||
+					!strings.Contains(patch, `"powerState":"on"`) ||
+					!strings.Contains(patch, `"observedGeneration":3`) {
+					t.Fatalf("Unexpected status patch: %s", patch)
+				}
+				seen["kube-a"] = true
+			} else if strings.HasPrefix(patch, "kube-b/status ") {
+				seen["kube-b"] = strings.Contains(patch, `"registered":true`)
+			}
+		case <-timeout:
+			t.Fatalf("Statuses not written; saw %v", seen)
+		}
+	}
+	if labels := daemon.NodeLabels(); len(labels) != 2 {
+		t.Fatalf("Expected two nodes, but got %v", labels)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "maintnode", `{"type": "ipmi", "info": {"addr": "10.0.0.22"}}`)
+	token := getToken(t, handler, "maintnode")
+
+	maint := "http://localhost/node/maintnode/maintenance"
+	powerOff := requestSpec{"POST", "/node/maintnode/power_off", ""}
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{"PUT", maint, `{"reason": "BIOS update"}`})
+	requireStatus(t, "Power off in maintenance mode",
+		tokenReq(handler, token, powerOff), http.StatusLocked)
+	requireStatus(t, "Power status in maintenance mode",
+		tokenReq(handler, token, requestSpec{"GET", "/node/maintnode/power_status", ""}),
+		http.StatusOK)
+	errpanic(daemon.PowerOffNode(context.Background(), "maintnode", nil))
+	if daemon.PowerOffNode(userContext(context.Background()), "maintnode", nil) != obmd.ErrNodeInMaintenance {
+		t.Fatal("Power off by a tokenless user succeeded in maintenance mode.")
+	}
+	adminRequireStatus(t, handler, http.StatusNotFound,
+		requestSpec{"PUT", "http://localhost/node/nosuchnode/maintenance", ""})
+
+	// Maintenance mode persists across restarts:
+	errpanic(daemon.Close())
+	state, err = NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
+	errpanic(err)
+	daemon = NewDaemon(state)
+	defer daemon.Close()
+	handler = makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	resp := adminReq(handler, requestSpec{"GET", maint, ""})
+	requireStatus(t, "Querying maintenance mode", resp, http.StatusOK)
+	var maintResp api.MaintenanceResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&maintResp))
+	if !maintResp.Maintenance || maintResp.Reason != "BIOS update" {
+		t.Fatalf("Unexpected maintenance mode after restarting: %+v", maintResp)
+	}
+
+	token = getToken(t, handler, "maintnode")
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{"DELETE", maint, ""})
+	requireStatus(t, "Power off after maintenance",
+		tokenReq(handler, token, powerOff), http.StatusOK)
+}
+
+func TestDrain(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "drainnode", `{"type": "ipmi", "info": {"addr": "10.0.0.35"}}`)
+	token := getToken(t, handler, "drainnode")
+
+	drain := "http://localhost/node/drainnode/drain"
+	newToken := requestSpec{"POST", "http://localhost/node/drainnode/token", ""}
+	powerStatus := requestSpec{"GET", "/node/drainnode/power_status", ""}
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{"PUT", drain, `{"reason": "decommissioning"}`})
+	adminRequireStatus(t, handler, http.StatusConflict, newToken)
+	requireStatus(t, "Power status while draining",
+		tokenReq(handler, token, powerStatus), http.StatusOK)
+	adminRequireStatus(t, handler, http.StatusNotFound,
+		requestSpec{"PUT", "http://localhost/node/nosuchnode/drain", ""})
+
+	// Draining persists across restarts:
+	errpanic(daemon.Close())
+	state, err = NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
+	errpanic(err)
+	daemon = NewDaemon(state)
+	defer daemon.Close()
+	handler = makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	resp := adminReq(handler, requestSpec{"GET", drain, ""})
+	requireStatus(t, "Querying drain", resp, http.StatusOK)
+	var drainResp api.DrainResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&drainResp))
+	if !drainResp.Draining || drainResp.Reason != "decommissioning" {
+		t.Fatalf("Unexpected drain state after restarting: %+v", drainResp)
+	}
+	adminRequireStatus(t, handler, http.StatusConflict, newToken)
+
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{"DELETE", drain, ""})
+	adminRequireStatus(t, handler, http.StatusOK, newToken)
+}
+
+func TestRenameNode(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	info := `{"type": "ipmi", "info": {"addr": "10.0.0.31"}}`
+	for _, label := range []string{"-badnode", strings.Repeat("x", 81)} {
+		adminRequireStatus(t, handler, http.StatusBadRequest,
+			requestSpec{"PUT", "http://localhost/node/" + label, info})
+	}
+	makeNode(t, handler, "oldnode", info)
+	makeNode(t, handler, "othernode", `{"type": "ipmi", "info": {"addr": "10.0.0.32"}}`)
+	adminRequireStatus(t, handler, http.StatusConflict,
+		requestSpec{"PUT", "http://localhost/node/othernode", info})
+	token := getToken(t, handler, "oldnode")
+	adminRequireStatus(t, handler, http.StatusOK,
+		requestSpec{"PUT", "http://localhost/node/oldnode/maintenance", `{"reason": "moving"}`})
+
+	rename := func(label, newLabel string) requestSpec {
+		return requestSpec{"POST", "http://localhost/node/" + label + "/rename",
+			`{"label": "` + newLabel + `"}`}
+	}
+	adminRequireStatus(t, handler, http.StatusBadRequest, rename("oldnode", "-badnode"))
+	adminRequireStatus(t, handler, http.StatusConflict, rename("oldnode", "othernode"))
+	adminRequireStatus(t, handler, http.StatusNotFound, rename("nosuchnode", "newnode"))
+	adminRequireStatus(t, handler, http.StatusOK, rename("oldnode", "newnode"))
+
+	// The node keeps its token and maintenance mode:
+	requireStatus(t, "Power status after renaming",
+		tokenReq(handler, token, requestSpec{"GET", "/node/newnode/power_status", ""}),
+		http.StatusOK)
+	requireStatus(t, "Power off after renaming",
+		tokenReq(handler, token, requestSpec{"POST", "/node/newnode/power_off", ""}),
+		http.StatusLocked)
+	requireStatus(t, "Power status under the old label",
+		tokenReq(handler, token, requestSpec{"GET", "/node/oldnode/power_status", ""}),
+		http.StatusNotFound)
+
+	// The new label persists across restarts:
+	errpanic(daemon.Close())
+	state, err = NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
+	errpanic(err)
+	daemon = NewDaemon(state)
+	defer daemon.Close()
+	if labels := daemon.NodeLabels(); !reflect.DeepEqual(labels, []string{"newnode", "othernode"}) {
+		t.Fatalf("Unexpected labels after restarting: %v", labels)
+	}
+	if on, reason, err := daemon.NodeMaintenance("newnode"); err != nil || !on || reason != "moving" {
+		t.Fatalf("Unexpected maintenance mode after restarting: %v %q %v", on, reason, err)
+	}
+}
+
+func TestPowerCycleInterval(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	daemon.SetPowerCycleInterval(time.Hour)
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "ratenode", `{"type": "ipmi", "info": {"addr": "10.0.0.23"}}`)
+	token := getToken(t, handler, "ratenode")
+
+	cycle := requestSpec{"POST", "/node/ratenode/power_cycle", `{"force": true}`}
+	requireStatus(t, "First power cycle", tokenReq(handler, token, cycle), http.StatusOK)
+	resp := tokenReq(handler, token, cycle)
+	requireStatus(t, "Second power cycle", resp, http.StatusTooManyRequests)
+	if secs, err := strconv.Atoi(resp.Header().Get("Retry-After")); err != nil || secs < 3590 || secs > 3600 {
+		t.Fatalf("Unexpected Retry-After: %q", resp.Header().Get("Retry-After"))
+	}
+
+	// The admin is exempt:
+	errpanic(daemon.PowerCycleNode(context.Background(), "ratenode", true, nil))
+
+	daemon.SetPowerCycleInterval(0)
+	requireStatus(t, "Power cycle without a limit", tokenReq(handler, token, cycle), http.StatusOK)
+}
+
+// Retries of a power cycle with the same Idempotency-Key should get the
+// original result, rather than power cycling the node again.
+func TestIdempotencyKey(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	daemon.SetPowerCycleInterval(time.Hour)
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "retrynode", `{"type": "ipmi", "info": {"addr": "10.0.0.34"}}`)
+	token := getToken(t, handler, "retrynode")
+
+	cycle := func(key, body string) *httptest.ResponseRecorder {
+		spec := requestSpec{"POST", "/node/retrynode/power_cycle?token=" + token, body}
+		req := spec.toNoAuth()
+		req.Header.Set("Idempotency-Key", key)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+	requireStatus(t, "First power cycle", cycle("a", `{"force": true}`), http.StatusOK)
+	resp := cycle("a", `{"force": true}`)
+	requireStatus(t, "Retried power cycle", resp, http.StatusOK)
+	if resp.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("Retried power cycle wasn't marked as replayed.")
+	}
+	requireStatus(t, "Power cycle reusing a key", cycle("a", `{"force": false}`),
+		http.StatusUnprocessableEntity)
+	requireStatus(t, "Power cycle with a new key", cycle("b", `{"force": true}`),
+		http.StatusTooManyRequests)
+	// A 429 says to retry later, so isn't replayed:
+	resp = cycle("b", `{"force": true}`)
+	requireStatus(t, "Retrying a refused power cycle", resp, http.StatusTooManyRequests)
+	if resp.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatal("Refused power cycle was replayed.")
+	}
+}
+
+func TestBatchPower(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	delay := 50 * time.Millisecond
+	daemon.SetPowerOnStagger(delay, 1)
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "batch-1", `{"type": "ipmi", "info": {"addr": "10.0.0.24"}}`)
+	makeNode(t, handler, "batch-2", `{"type": "ipmi", "info": {"addr": "10.0.0.25"}}`)
+
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+		"POST", "http://localhost/batch/power", `{"action": "explode", "nodes": ["batch-1"]}`,
+	})
+
+	start := time.Now()
+	resp := adminReq(handler, requestSpec{"POST", "http://localhost/batch/power",
+		`{"action": "cycle", "nodes": ["batch-1", "nosuchnode", "batch-2"]}`})
+	requireStatus(t, "Batch power cycle", resp, http.StatusOK)
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Fatalf("Power cycles of three nodes took %v; expected them to be staggered.", elapsed)
+	}
+	results := map[string]int{}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var result api.BatchPowerResult
+		if err := dec.Decode(&result); err == io.EOF {
+			break
+		} else {
+			errpanic(err)
+		}
+		results[result.Node] = result.Status
+	}
+	if len(results) != 3 || results["batch-1"] != http.StatusOK ||
+		results["batch-2"] != http.StatusOK || results["nosuchnode"] != http.StatusNotFound {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+
+	resp = adminReq(handler, requestSpec{"POST", "http://localhost/batch/power",
+		`{"action": "off", "nodes": ["batch-1", "batch-2"]}`})
+	requireStatus(t, "Batch power off", resp, http.StatusOK)
+	state, err := daemon.NodePowerStatus(context.Background(), "batch-2", nil)
+	errpanic(err)
+	if state != driver.PowerStateOff {
+		t.Fatalf("Node is %q after a batch power off.", state)
+	}
+}
+
+// Powering off the nodes on a PDU should power them off in descending
+// order of their outlets.
+func TestPDUPower(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "pdu-1", `{"type": "ipmi", "info": {"addr": "10.0.0.60"}}`)
+	makeNode(t, handler, "pdu-2", `{"type": "ipmi", "info": {"addr": "10.0.0.61"}}`)
+	for _, spec := range []requestSpec{
+		{"PUT", "http://localhost/pdu/pdu-r4-a/outlet/1", `{"node": "pdu-1", "order": 1}`},
+		{"PUT", "http://localhost/pdu/pdu-r4-a/outlet/2", `{"node": "pdu-2", "order": 2}`},
+		{"PUT", "http://localhost/pdu/pdu-r4-a/outlet/3", `{"order": 0, "description": "switch"}`},
+	} {
+		adminRequireStatus(t, handler, http.StatusOK, spec)
+	}
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"PUT", "http://localhost/pdu/pdu-r4-a/outlet/4", `{"node": "nosuchnode"}`,
+	})
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+		"PUT", "http://localhost/pdu/pdu-r4-a/outlet/" + strings.Repeat("9", 40), `{}`,
+	})
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"POST", "http://localhost/pdu/nosuchpdu/power_nodes", `{"action": "off"}`,
+	})
+
+	resp := adminReq(handler, requestSpec{
+		"POST", "http://localhost/pdu/pdu-r4-a/power_nodes", `{"action": "off"}`,
+	})
+	requireStatus(t, "Powering off the nodes on the PDU", resp, http.StatusOK)
+	var results []api.PDUPowerResult
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var result api.PDUPowerResult
+		if err := dec.Decode(&result); err == io.EOF {
+			break
+		} else {
+			errpanic(err)
+		}
+		results = append(results, result)
+	}
+	expected := []api.PDUPowerResult{
+		{Outlet: "2", Node: "pdu-2", Status: http.StatusOK},
+		{Outlet: "1", Node: "pdu-1", Status: http.StatusOK},
+		{Outlet: "3", Status: http.StatusNotImplemented},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Expected results %v, but got %v", expected, results)
+	}
+	for _, addr := range []string{"10.0.0.60", "10.0.0.61"} {
+		if action := mock.LastPowerAction(addr); action != mock.Off {
+			t.Fatalf("Expected %s to be powered off, but its last action was %q", addr, action)
+		}
+	}
+
+	// Outlets follow their nodes when they are renamed, and become
+	// standalone when they are deleted.
+	errpanic(daemon.RenameNode("pdu-2", "pdu-2b"))
+	errpanic(daemon.DeleteNode("pdu-1"))
+	outlets, err := daemon.PDUOutlets("pdu-r4-a")
+	errpanic(err)
+	nodes := map[string]string{}
+	for _, o := range outlets {
+		nodes[o.Outlet] = o.Node
+	}
+	if !reflect.DeepEqual(nodes, map[string]string{"1": "", "2": "pdu-2b", "3": ""}) {
+		t.Fatalf("Unexpected outlets after renaming and deleting nodes: %+v", outlets)
+	}
+	for _, outlet := range []string{"1", "2", "3"} {
+		adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+			"DELETE", "http://localhost/pdu/pdu-r4-a/outlet/" + outlet, "",
+		})
+	}
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"GET", "http://localhost/pdu/pdu-r4-a", "",
+	})
+}
+
+// A power group's budget is split among its members, and redistributed as
+// its membership changes.
+func TestPowerGroup(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	addrs := map[string]string{
+		"group-1": "10.0.0.63",
+		"group-2": "10.0.0.64",
+		"group-3": "10.0.0.65",
+	}
+	for label, addr := range addrs {
+		makeNode(t, handler, label, `{"type": "ipmi", "info": {"addr": "`+addr+`"}}`)
+	}
+	requireLimits := func(what string, expected map[string]int) {
+		for label, watts := range expected {
+			if limit := mock.PowerLimit(addrs[label]); limit != watts {
+				t.Fatalf("%s: expected %s to be limited to %d watts, but got %d",
+					what, label, watts, limit)
+			}
+		}
+	}
+	setGroup := func(body string) api.PowerCapsResp {
+		resp := adminReq(handler, requestSpec{"PUT", "http://localhost/power_group/rack-4", body})
+		requireStatus(t, "Setting the power group", resp, http.StatusOK)
+		var caps api.PowerCapsResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&caps))
+		return caps
+	}
+
+	caps := setGroup(`{"budget": 1000, "nodes": ["group-1", "group-2", "group-3"]}`)
+	expected := []api.PowerCapStatus{
+		{Node: "group-1", Watts: 333, Status: http.StatusOK},
+		{Node: "group-2", Watts: 333, Status: http.StatusOK},
+		{Node: "group-3", Watts: 333, Status: http.StatusOK},
+	}
+	if !reflect.DeepEqual(caps.Caps, expected) {
+		t.Fatalf("Expected caps %v, but got %v", expected, caps.Caps)
+	}
+	requireLimits("Creating the group", map[string]int{"group-1": 333, "group-2": 333, "group-3": 333})
+
+	// Members' limits are the group's, and are reapplied, e.g. after a
+	// BMC reset, even in maintenance mode.
+	if err := daemon.SetNodePowerLimit(context.Background(), "group-1", 1000, nil); err != obmd.ErrGroupPowerLimit {
+		t.Fatalf("Expected ErrGroupPowerLimit setting a member's limit, but got %v", err)
+	}
+	errpanic(daemon.SetNodeMaintenance("group-1", true, "repairs"))
+	mock.ClearPowerLimit(addrs["group-1"])
+	daemon.reapplyPowerGroups(0)
+	requireLimits("Reapplying the group", map[string]int{"group-1": 333})
+	errpanic(daemon.SetNodeMaintenance("group-1", false, ""))
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"budget": 1000, "nodes": ["nosuchnode"]}`, http.StatusNotFound},
+		{`{"budget": 1, "nodes": ["group-1", "group-2"]}`, http.StatusBadRequest},
+		{`{"budget": 0, "nodes": []}`, http.StatusBadRequest},
+	} {
+		adminRequireStatus(t, handler, tc.status, requestSpec{
+			"PUT", "http://localhost/power_group/rack-4", tc.body,
+		})
+	}
+	adminRequireStatus(t, handler, http.StatusConflict, requestSpec{
+		"PUT", "http://localhost/power_group/rack-5", `{"budget": 500, "nodes": ["group-1"]}`,
+	})
+
+	// Dropping a member removes its limit, and raises the others'.
+	caps = setGroup(`{"budget": 1000, "nodes": ["group-1", "group-2"]}`)
+	if len(caps.Caps) != 3 || caps.Caps[2] != (api.PowerCapStatus{Node: "group-3", Status: http.StatusOK}) {
+		t.Fatalf("Unexpected caps after dropping a member: %v", caps.Caps)
+	}
+	requireLimits("Dropping a member", map[string]int{"group-1": 500, "group-2": 500, "group-3": 0})
+
+	// Groups follow renamed members, and deleting one redistributes the
+	// budget.
+	errpanic(daemon.RenameNode("group-2", "group-2b"))
+	errpanic(daemon.DeleteNode("group-1"))
+	group, err := daemon.PowerGroup("rack-4")
+	errpanic(err)
+	if !reflect.DeepEqual(group.Nodes, []string{"group-2b"}) || group.Share != 1000 {
+		t.Fatalf("Unexpected group after renaming and deleting members: %+v", group)
+	}
+	requireLimits("Deleting a member", map[string]int{"group-2": 1000})
+
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+		"DELETE", "http://localhost/power_group/rack-4", "",
+	})
+	requireLimits("Deleting the group", map[string]int{"group-2": 0})
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"GET", "http://localhost/power_group/rack-4", "",
+	})
+}
+
+// A Daemon which refuses to power nodes off, standing in for another
+// backend.
+type noPowerOffDaemon struct {
+	obmd.Daemon
+}
+
+func (noPowerOffDaemon) PowerOffNode(ctx context.Context, label string, token *obmd.Token) error {
+	return obmd.ErrNodeInMaintenance
+}
+
+// The api should work with any implementation of Daemon.
+func TestDaemonInterface(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), noPowerOffDaemon{daemon}, api.AllAPI)
+	makeNode(t, handler, "backend", `{"type": "ipmi", "info": {"addr": "10.0.0.58"}}`)
+	token := getToken(t, handler, "backend")
+
+	resp := tokenReq(handler, token, requestSpec{"POST", "http://localhost/node/backend/power_off", ""})
+	requireStatus(t, "Powering off", resp, http.StatusLocked)
+	resp = tokenReq(handler, token, requestSpec{"GET", "http://localhost/node/backend/power_status", ""})
+	requireStatus(t, "Power status", resp, http.StatusOK)
+}
+
+// Responses should carry the request's ID, which is the client's if it is
+// reasonable.
+func TestRequestID(t *testing.T) {
+	handler := newHandler()
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/node", ""})
+	generated := resp.Header().Get("X-Request-ID")
+	if len(generated) != 16 {
+		t.Fatalf("Expected a random request ID, but got %q", generated)
+	}
+	for id, expected := range map[string]string{
+		"req-1234":              "req-1234",
+		"has spaces":            "",
+		strings.Repeat("x", 65): "",
+		strings.Repeat("x", 64): strings.Repeat("x", 64),
+	} {
+		spec := requestSpec{"GET", "http://localhost/node", ""}
+		req := spec.toAdminAuth()
+		req.Header.Set("X-Request-ID", id)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		actual := resp.Header().Get("X-Request-ID")
+		if expected == "" && (actual == id || actual == "") || expected != "" && actual != expected {
+			t.Errorf("Given request ID %q, got %q", id, actual)
+		}
+	}
+}
+
+// Health checks should record changes in nodes' power states, which the
+// power history reports.
+func TestPowerHistory(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "history-1", `{"type": "ipmi", "info": {"addr": "10.0.0.55"}}`)
+
+	daemon.checkHealth(time.Second)
+	daemon.checkHealth(time.Second)
+	errpanic(daemon.PowerOffNode(context.Background(), "history-1", nil))
+	daemon.checkHealth(time.Second)
+	errpanic(daemon.RenameNode("history-1", "history-2"))
+
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/node/history-2/power_history", ""})
+	requireStatus(t, "Power history", resp, http.StatusOK)
+	var history obmd.PowerHistory
+	errpanic(json.NewDecoder(resp.Body).Decode(&history))
+	if len(history.Transitions) != 2 ||
+		history.Transitions[0].Power != driver.PowerStateOn ||
+		history.Transitions[1].Power != driver.PowerStateOff ||
+		history.Power != driver.PowerStateOff || !history.Since.Equal(history.Transitions[1].Time) {
+		t.Fatalf("Unexpected power history: %+v", history)
+	}
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+		"GET", "http://localhost/node/history-2/power_history?period=forever", "",
+	})
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"GET", "http://localhost/node/history-1/power_history", "",
+	})
+}
+
+func TestSummarizePowerHistory(t *testing.T) {
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	all := []obmd.PowerTransition{
+		{Time: start, Power: driver.PowerStateOn},
+		{Time: start.Add(10 * time.Hour), Power: driver.PowerStateOff},
+		{Time: start.Add(12 * time.Hour), Power: driver.PowerStateOn},
+	}
+	now := start.Add(20 * time.Hour)
+
+	history := summarizePowerHistory(all, 0, now)
+	if len(history.Transitions) != 3 || history.OnTime != obmd.Duration(18*time.Hour) ||
+		history.OffTime != obmd.Duration(2*time.Hour) || history.Power != driver.PowerStateOn ||
+		!history.Since.Equal(start.Add(12*time.Hour)) {
+		t.Fatalf("Unexpected summary of the whole history: %+v", history)
+	}
+	// The last 9 hours start with the node off, from the transition
+	// before them:
+	history = summarizePowerHistory(all, 9*time.Hour, now)
+	if len(history.Transitions) != 1 || history.OnTime != obmd.Duration(8*time.Hour) ||
+		history.OffTime != obmd.Duration(time.Hour) {
+		t.Fatalf("Unexpected summary of the last 9 hours: %+v", history)
+	}
+	history = summarizePowerHistory(nil, time.Hour, now)
+	if history.Power != driver.PowerStateUnknown || history.OnTime != 0 || history.OffTime != 0 {
+		t.Fatalf("Unexpected summary of no history: %+v", history)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	faults := &FaultInjector{}
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{
+		WrapOBM: faults.WrapOBM,
+	})
+	errpanic(err)
+	daemon := NewDaemon(state)
+	defer daemon.Close()
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "health-1", `{"type": "ipmi", "info": {"addr": "10.0.0.26"}}`)
+	makeNode(t, handler, "health-2", `{"type": "ipmi", "info": {"addr": "10.0.0.27"}}`)
+	errpanic(faults.SetRules([]FaultRule{
+		{Node: "health-2", Op: "power_status", Error: "BMC unreachable"},
+	}))
+
+	getHealth := func() map[string]obmd.NodeHealth {
+		resp := adminReq(handler, requestSpec{"GET", "http://localhost/nodes/health", ""})
+		requireStatus(t, "Get node health", resp, http.StatusOK)
+		var body api.HealthResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		return body.Nodes
+	}
+	// Wait for the nodes' health to satisfy ok.
+	waitFor := func(desc string, ok func(map[string]obmd.NodeHealth) bool) map[string]obmd.NodeHealth {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			health := getHealth()
+			if ok(health) {
+				return health
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: got %+v", desc, health)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if health := getHealth(); len(health) != 0 {
+		t.Fatalf("Nodes were checked with checks disabled: %+v", health)
+	}
+	requireStatus(t, "Get node health without auth",
+		noAuthReq(handler, requestSpec{"GET", "http://localhost/nodes/health", ""}),
+		http.StatusNotFound)
+
+	daemon.SetHealthChecks(10*time.Millisecond, time.Second)
+	health := waitFor("Waiting for both nodes to be checked", func(h map[string]obmd.NodeHealth) bool {
+		return len(h) == 2
+	})
+	good, bad := health["health-1"], health["health-2"]
+	if !good.Healthy || good.LastSeen.IsZero() || good.PowerState != driver.PowerStateOn || good.Error != "" {
+		t.Fatalf("Unexpected health of the working node: %+v", good)
+	}
+	if bad.Healthy || !bad.LastSeen.IsZero() || !strings.Contains(bad.Error, "BMC unreachable") {
+		t.Fatalf("Unexpected health of the failing node: %+v", bad)
+	}
+
+	errpanic(faults.SetRules(nil))
+	waitFor("Waiting for the failing node to recover", func(h map[string]obmd.NodeHealth) bool {
+		return h["health-2"].Healthy && !h["health-2"].LastSeen.IsZero()
+	})
+
+	adminRequireStatus(t, handler, http.StatusOK, requestSpec{
+		"DELETE", "http://localhost/node/health-2", "",
+	})
+	if _, ok := daemon.NodeHealth()["health-2"]; ok {
+		t.Fatal("Deleted node's health is still reported.")
+	}
+}
+
+func TestFirmwareRollout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obmd-firmware")
+	errpanic(err)
+	defer os.RemoveAll(dir)
+	errpanic(ioutil.WriteFile(filepath.Join(dir, "good.bin"), []byte("2.0\n"), 0600))
+	errpanic(ioutil.WriteFile(filepath.Join(dir, "bad.bin"), []byte("2.1\n"), 0600))
+
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	cfg := *theConfig
+	live := NewLiveConfig(&cfg)
+	handler := makeHandler(live, daemon, api.AllAPI)
+	makeNode(t, handler, "fw-1", `{"type": "ipmi", "info": {"addr": "10.0.0.28"}}`)
+	makeNode(t, handler, "fw-2", `{"type": "ipmi", "info": {"addr": "10.0.0.29"}}`)
+	makeNode(t, handler, "fw-3", `{"type": "ipmi", "info": {"addr": "10.0.0.30"}}`)
+
+	versions := func(label string) map[string]string {
+		resp := adminReq(handler, requestSpec{"GET", "http://localhost/node/" + label + "/firmware", ""})
+		requireStatus(t, "Get firmware versions", resp, http.StatusOK)
+		var body api.FirmwareResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		return body.Versions
+	}
+	if v := versions("fw-1"); v["bmc"] != "1.0" {
+		t.Fatalf("Unexpected initial firmware versions: %v", v)
+	}
+
+	start := func(body string) *httptest.ResponseRecorder {
+		return adminReq(handler, requestSpec{"POST", "http://localhost/firmware/rollouts", body})
+	}
+	requireStatus(t, "Rollout with FirmwareDir unset",
+		start(`{"component": "bmc", "image": "good.bin", "version": "2.0", "nodes": ["fw-1"]}`),
+		http.StatusNotFound)
+	cfg.FirmwareDir = dir
+	live.Set(&cfg)
+	for _, c := range []struct {
+		body   string
+		status int
+	}{
+		{`{"component": "bmc", "image": "../good.bin", "version": "2.0", "nodes": ["fw-1"]}`, http.StatusBadRequest},
+		{`{"component": "bmc", "image": "nope.bin", "version": "2.0", "nodes": ["fw-1"]}`, http.StatusBadRequest},
+		{`{"component": "bmc", "image": "good.bin", "nodes": ["fw-1"]}`, http.StatusBadRequest},
+		{`{"component": "bmc", "image": "good.bin", "version": "2.0", "nodes": ["fw-1", "fw-1"]}`, http.StatusBadRequest},
+		{`{"component": "bmc", "image": "good.bin", "version": "2.0", "nodes": ["fw-1", "nosuchnode"]}`, http.StatusNotFound},
+	} {
+		requireStatus(t, "Rollout "+c.body, start(c.body), c.status)
+	}
+
+	// Start a rollout, and wait for it to finish.
+	rollOut := func(body string) obmd.FirmwareRollout {
+		resp := start(body)
+		requireStatus(t, "Rollout "+body, resp, http.StatusAccepted)
+		var rollout obmd.FirmwareRollout
+		errpanic(json.NewDecoder(resp.Body).Decode(&rollout))
+		loc := resp.Header().Get("Location")
+		deadline := time.Now().Add(5 * time.Second)
+		for rollout.State == rolloutRunning {
+			if time.Now().After(deadline) {
+				t.Fatalf("Rollout didn't finish: %+v", rollout)
+			}
+			time.Sleep(10 * time.Millisecond)
+			resp = adminReq(handler, requestSpec{"GET", "http://localhost" + loc, ""})
+			requireStatus(t, "Get rollout", resp, http.StatusOK)
+			errpanic(json.NewDecoder(resp.Body).Decode(&rollout))
+		}
+		return rollout
+	}
+	nodeStates := func(rollout obmd.FirmwareRollout) []string {
+		var states []string
+		for _, n := range rollout.Nodes {
+			states = append(states, n.State)
+		}
+		return states
+	}
+
+	rollout := rollOut(`{"component": "bmc", "image": "good.bin", "version": "2.0", "nodes": ["fw-1", "fw-2"]}`)
+	if rollout.State != rolloutDone || fmt.Sprint(nodeStates(rollout)) != "[done done]" {
+		t.Fatalf("Unexpected outcome of a good rollout: %+v", rollout)
+	}
+	if v := versions("fw-2"); v["bmc"] != "2.0" || v["bios"] != "1.0" {
+		t.Fatalf("Unexpected firmware versions after the update: %v", v)
+	}
+
+	// The image's version doesn't match, so the first group fails
+	// verification, and the rest is skipped:
+	rollout = rollOut(`{"component": "bmc", "image": "bad.bin", "version": "3.0",
+		"nodes": ["fw-1", "fw-2", "fw-3"], "group_size": 2}`)
+	if rollout.State != rolloutHalted || fmt.Sprint(nodeStates(rollout)) != "[failed failed skipped]" ||
+		rollout.Nodes[0].Version != "2.1" || rollout.Nodes[0].Error == "" {
+		t.Fatalf("Unexpected outcome of a bad rollout: %+v", rollout)
+	}
+	if v := versions("fw-3"); v["bmc"] != "1.0" {
+		t.Fatalf("Skipped node was updated: %v", v)
+	}
+
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/firmware/rollouts", ""})
+	requireStatus(t, "List rollouts", resp, http.StatusOK)
+	var list api.FirmwareRolloutsResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&list))
+	if len(list.Rollouts) != 2 || list.Rollouts[1].ID != rollout.ID {
+		t.Fatalf("Unexpected list of rollouts: %+v", list)
+	}
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"GET", "http://localhost/firmware/rollouts/1234", "",
+	})
+}
+
+func TestImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obmd-images")
+	errpanic(err)
+	defer os.RemoveAll(dir)
+	errpanic(ioutil.WriteFile(filepath.Join(dir, "boot.iso"), []byte("0123456789"), 0600))
+
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	cfg := *theConfig
+	live := NewLiveConfig(&cfg)
+	handler := makeHandler(live, daemon, api.AllAPI)
+
+	adminRequireStatus(t, handler, http.StatusNotFound, requestSpec{
+		"GET", "http://localhost/images", "",
+	})
+	cfg.Images.Dir = dir
+	live.Set(&cfg)
+
+	resp := adminReq(handler, requestSpec{"GET", "http://localhost/images", ""})
+	requireStatus(t, "List images", resp, http.StatusOK)
+	var list api.ImagesResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&list))
+	if len(list.Images) != 1 || list.Images[0].Name != "boot.iso" || list.Images[0].Size != 10 {
+		t.Fatalf("Unexpected images: %+v", list)
+	}
+
+	adminRequireStatus(t, handler, http.StatusBadRequest, requestSpec{
+		"POST", "http://localhost/images/.hidden/url", "",
+	})
+	signedURL := func(name string) string {
+		resp := adminReq(handler, requestSpec{"POST", "http://localhost/images/" + name + "/url", ""})
+		requireStatus(t, "Get signed URL", resp, http.StatusOK)
+		var body api.ImageURLResp
+		errpanic(json.NewDecoder(resp.Body).Decode(&body))
+		if !strings.HasPrefix(body.URL, "http://localhost/images/"+name+"?") {
+			t.Fatalf("Unexpected signed URL: %q", body.URL)
+		}
+		if d := time.Until(body.Expires); d < 23*time.Hour || d > 25*time.Hour {
+			t.Fatalf("Signed URL expires in %v; expected a day.", d)
+		}
+		return body.URL
+	}
+	u := signedURL("boot.iso")
+
+	resp = noAuthReq(handler, requestSpec{"GET", u, ""})
+	requireStatus(t, "Fetch image", resp, http.StatusOK)
+	if resp.Body.String() != "0123456789" {
+		t.Fatalf("Unexpected image contents: %q", resp.Body.String())
+	}
+	req := httptest.NewRequest("GET", u, nil)
+	req.Header.Set("Range", "bytes=8-")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	requireStatus(t, "Fetch part of image", resp, http.StatusPartialContent)
+	if resp.Body.String() != "89" {
+		t.Fatalf("Unexpected partial image contents: %q", resp.Body.String())
+	}
+
+	requireStatus(t, "Fetch image without signature",
+		noAuthReq(handler, requestSpec{"GET", "http://localhost/images/boot.iso", ""}),
+		http.StatusForbidden)
+	requireStatus(t, "Fetch image with another image's signature",
+		noAuthReq(handler, requestSpec{"GET", strings.Replace(signedURL("other.iso"), "other.iso", "boot.iso", 1), ""}),
+		http.StatusForbidden)
+	requireStatus(t, "Fetch missing image",
+		noAuthReq(handler, requestSpec{"GET", signedURL("other.iso"), ""}),
+		http.StatusNotFound)
+
+	// Changing the admin token revokes signed URLs:
+	newCfg := cfg
+	newCfg.AdminToken[0]++
+	live.Set(&newCfg)
+	requireStatus(t, "Fetch image after changing the admin token",
+		noAuthReq(handler, requestSpec{"GET", u, ""}), http.StatusForbidden)
+}
+
+// Nodes registered from a template should get the template's type and
+// info, with their own fields added.
+func TestNodeTemplates(t *testing.T) {
+	daemon := newTestDaemon()
+	daemon.SetNodeTemplates(map[string]NodeTemplate{
+		"rack": {Type: "ipmi", Info: map[string]json.RawMessage{
+			"addr": json.RawMessage(`"10.0.0.1"`),
+			"user": json.RawMessage(`"ipmiuser"`),
+		}},
+	})
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "templated", `{"template": "rack", "info": {"addr": "10.0.0.36"}}`)
+	node, err := daemon.state.GetNode("templated")
+	errpanic(err)
+	if !sameJSON(node.ConnInfo, []byte(`{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.36", "user": "ipmiuser"}
+	}`)) {
+		t.Fatalf("Unexpected info: %s", node.ConnInfo)
+	}
+	adminRequireStatus(t, handler, http.StatusUnprocessableEntity,
+		requestSpec{"PUT", "http://localhost/node/other", `{"template": "nope", "info": {}}`})
+	adminRequireStatus(t, handler, http.StatusUnprocessableEntity,
+		requestSpec{"PUT", "http://localhost/node/other", `{"template": "rack", "type": "ipmi"}`})
+}
+
+// Operations which a node's OBM declares it doesn't support should get 501,
+// saying what isn't supported.
+func TestUnsupportedOperations(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "limited", `{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.37", "unsupported": ["console", "set_bootdev"]}
+	}`)
+	token := getToken(t, handler, "limited")
+
+	resp := tokenReq(handler, token, requestSpec{"PUT", "/node/limited/boot_device", `{"bootdev": "A"}`})
+	requireStatus(t, "Setting the boot device", resp, http.StatusNotImplemented)
+	var body api.ErrorResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&body))
+	if !strings.Contains(body.Error, `"set_bootdev"`) {
+		t.Fatalf("Unexpected error: %q", body.Error)
+	}
+	resp = tokenReq(handler, token, requestSpec{"GET", "/node/limited/console", ""})
+	requireStatus(t, "Viewing the console", resp, http.StatusNotImplemented)
+	resp = tokenReq(handler, token, requestSpec{"GET", "/node/limited/power_status", ""})
+	requireStatus(t, "Querying the power status", resp, http.StatusOK)
+
+	resp = tokenReq(handler, token, requestSpec{"GET", "/node/limited/capabilities", ""})
+	requireStatus(t, "Capabilities", resp, http.StatusOK)
+	var caps obmd.Capabilities
+	errpanic(json.NewDecoder(resp.Body).Decode(&caps))
+	if !reflect.DeepEqual(caps.Unsupported, []driver.Operation{driver.OpConsole, driver.OpSetBootdev}) {
+		t.Fatalf("Unexpected unsupported operations: %v", caps.Unsupported)
+	}
+}
+
+// Each node's token usage should record the last operation the token was
+// used for.
+func TestTokenUsage(t *testing.T) {
+	handler := newHandler()
+	makeNode(t, handler, "usednode", `{"type": "ipmi", "info": {"addr": "10.0.0.38"}}`)
+	usage := func() obmd.TokenUsage {
+		resp := adminReq(handler, requestSpec{"GET", "http://localhost/node/usednode/token", ""})
+		requireStatus(t, "Getting token usage", resp, http.StatusOK)
+		var ret obmd.TokenUsage
+		errpanic(json.NewDecoder(resp.Body).Decode(&ret))
+		return ret
+	}
+	if u := usage(); u.Issued {
+		t.Fatalf("Token reported as issued before it was: %+v", u)
+	}
+	token := getToken(t, handler, "usednode")
+	if u := usage(); !u.Issued || u.IssuedAt.IsZero() || !u.LastUsed.IsZero() {
+		t.Fatalf("Unexpected usage of a new token: %+v", u)
+	}
+	requireStatus(t, "Querying the power status",
+		tokenReq(handler, token, requestSpec{"GET", "/node/usednode/power_status", ""}),
+		http.StatusOK)
+	if u := usage(); u.LastUsed.IsZero() || u.LastOperation != "power_status" {
+		t.Fatalf("Unexpected usage after querying the power status: %+v", u)
+	}
+
+	for query, listed := range map[string]bool{"": true, "?unused_for=1h": false} {
+		var resp api.TokenUsageResp
+		result := adminReq(handler, requestSpec{"GET", "http://localhost/nodes/tokens" + query, ""})
+		requireStatus(t, "Listing token usage", result, http.StatusOK)
+		errpanic(json.NewDecoder(result.Body).Decode(&resp))
+		if _, ok := resp.Nodes["usednode"]; ok != listed {
+			t.Fatalf("Listing token usage%s: node listed = %v; expected %v.", query, ok, listed)
+		}
+	}
+	adminRequireStatus(t, handler, http.StatusBadRequest,
+		requestSpec{"GET", "http://localhost/nodes/tokens?unused_for=a+month", ""})
+}
+
+// The authorization policy should be consulted before issuing tokens and
+// power operations, and be able to refuse them.
+func TestPolicy(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		asked []PolicyRequest
+	)
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var preq PolicyRequest
+		errpanic(json.NewDecoder(req.Body).Decode(&preq))
+		lock.Lock()
+		asked = append(asked, preq)
+		lock.Unlock()
+		allow := preq.Operation != "power_cycle"
+		json.NewEncoder(w).Encode(&PolicyResponse{Allow: allow, Reason: "Rack r7 is frozen."})
+	}))
+	defer policy.Close()
+	daemon := newTestDaemon()
+	daemon.SetPolicy(policy.URL, 0, false)
+	handler := makeHandler(NewLiveConfig(theConfig), daemon, api.AllAPI)
+	makeNode(t, handler, "policynode", `{"type": "ipmi", "info": {"addr": "10.0.0.39"}}`)
+
+	spec := requestSpec{"POST", "http://localhost/node/policynode/token", ""}
+	req := spec.toAdminAuth()
+	req.Header.Set("X-Requester", "project-x")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	requireStatus(t, "Getting a token", resp, http.StatusOK)
+	var tokenResp api.TokenResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&tokenResp))
+	text, _ := tokenResp.Token.MarshalText()
+	token := string(text)
+	if len(asked) != 1 || asked[0].Operation != "token" || asked[0].Node != "policynode" ||
+		asked[0].NodeType != "ipmi" || !asked[0].Requester.Admin ||
+		asked[0].Requester.Identity != "project-x" {
+		t.Fatalf("Unexpected policy requests: %+v", asked)
+	}
+
+	// X-Requester is only believed from the admin.
+	spec = requestSpec{"POST", "/node/policynode/power_cycle?token=" + token, `{"force": true}`}
+	req = spec.toNoAuth()
+	req.Header.Set("X-Requester", "project-y")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	requireStatus(t, "Power cycling", resp, http.StatusForbidden)
+	var body api.ErrorResp
+	errpanic(json.NewDecoder(resp.Body).Decode(&body))
+	if !strings.Contains(body.Error, "Rack r7 is frozen.") {
+		t.Fatalf("Unexpected error: %q", body.Error)
+	}
+	if last := asked[len(asked)-1]; last.Requester.Admin || last.Requester.Identity != "" ||
+		last.Detail["force"] != "true" {
+		t.Fatalf("Unexpected policy request: %+v", last)
+	}
+	requireStatus(t, "Powering off",
+		tokenReq(handler, token, requestSpec{"POST", "/node/policynode/power_off", ""}),
+		http.StatusOK)
+
+	// If the policy can't be consulted, operations are refused, unless
+	// it fails open.
+	policy.Close()
+	requireStatus(t, "Powering off without a policy",
+		tokenReq(handler, token, requestSpec{"POST", "/node/policynode/power_off", ""}),
+		http.StatusServiceUnavailable)
+	daemon.SetPolicy(policy.URL, 0, true)
+	requireStatus(t, "Powering off with a policy which fails open",
+		tokenReq(handler, token, requestSpec{"POST", "/node/policynode/power_off", ""}),
+		http.StatusOK)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// What secrets are replaced with in snapshots.
+const redacted = "REDACTED"
+
+// A description of obmd's configuration: its nodes and the settings which
+// govern what may be done with them, with secrets (e.g. passwords)
+// redacted, for keeping a record of changes. Timestamps and other state
+// which changes by itself are left out, and encoding/json sorts map keys,
+// so the same configuration always gives the same JSON.
+type Snapshot struct {
+	Nodes map[string]obmd.NodeSnapshot `json:"nodes"`
+
+	// Quarantined nodes, and why; see State.QuarantinedNodes. Their info
+	// couldn't be loaded, so they aren't in Nodes.
+	Quarantined map[string]string `json:"quarantined"`
+
+	Policy PolicySnapshot `json:"policy"`
+}
+
+// The settings from the config which govern what may be done with nodes,
+// named as in the config.
+type PolicySnapshot struct {
+	LabelPattern       string
+	MaxLabelLength     int
+	OperationTimeout   obmd.Duration
+	PowerCycleInterval obmd.Duration
+	PowerOnDelay       obmd.Duration
+	PowerOnGroupSize   int
+	Policy             PolicyConfig // with any password in the URL redacted.
+	Retries            map[string]RetryConfig
+	NodeTemplates      map[string]NodeTemplate // with secrets redacted.
+}
+
+// Take a snapshot of the daemon's nodes, and the policy settings from
+// config.
+func takeSnapshot(daemon obmd.Daemon, config *Config) Snapshot {
+	policy := config.Policy
+	policy.URL = redactURL(policy.URL)
+	templates := make(map[string]NodeTemplate, len(config.NodeTemplates))
+	for name, tmpl := range config.NodeTemplates {
+		info := make(map[string]json.RawMessage, len(tmpl.Info))
+		for k, v := range tmpl.Info {
+			if isSecretField(k) {
+				v = json.RawMessage(`"` + redacted + `"`)
+			}
+			info[k] = v
+		}
+		tmpl.Info = info
+		templates[name] = tmpl
+	}
+	return Snapshot{
+		Nodes:       daemon.NodeSnapshots(),
+		Quarantined: daemon.QuarantinedNodes(),
+		Policy: PolicySnapshot{
+			LabelPattern:       config.LabelPattern,
+			MaxLabelLength:     config.MaxLabelLength,
+			OperationTimeout:   config.OperationTimeout,
+			PowerCycleInterval: config.PowerCycleInterval,
+			PowerOnDelay:       config.PowerOnDelay,
+			PowerOnGroupSize:   config.PowerOnGroupSize,
+			Policy:             policy,
+			Retries:            config.Retries,
+			NodeTemplates:      templates,
+		},
+	}
+}
+
+// Report whether a field of driver info (or a template's) holds a secret,
+// going by its name, e.g. "pass" or "kg_hex".
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"pass", "secret", "token", "key"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return name == "kg" || strings.HasPrefix(name, "kg_")
+}
+
+// Return a copy of the JSON value v (as decoded into an interface{}) with
+// the values of secret fields, at any depth, redacted.
+func redactSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, field := range v {
+			if isSecretField(k) {
+				ret[k] = redacted
+			} else {
+				ret[k] = redactSecrets(field)
+			}
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, elem := range v {
+			ret[i] = redactSecrets(elem)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+// Redact the password, if any, in rawurl. Strings which don't parse as
+// URLs are returned as they are.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
@@ -0,0 +1,22 @@
+//go:build sqlcipher
+// +build sqlcipher
+
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	// Registers itself as "sqlite3", in place of go-sqlite3:
+	_ "github.com/mutecomm/go-sqlcipher"
+)
+
+// keyedDBPath returns the sqlite DBPath to use for a database encrypted
+// with key, by adding the key to the DSN's parameters.
+func keyedDBPath(dbPath, key string) (string, error) {
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + "_pragma_key=" + url.QueryEscape(key), nil
+}
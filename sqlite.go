@@ -0,0 +1,18 @@
+//go:build !sqlcipher
+// +build !sqlcipher
+
+package main
+
+import (
+	"errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// keyedDBPath returns the sqlite DBPath to use for an encrypted database.
+// Plain sqlite doesn't support encryption; build with the "sqlcipher" tag
+// to get this functionality.
+func keyedDBPath(dbPath, key string) (string, error) {
+	return "", errors.New("obmd was built without sqlcipher support; " +
+		"rebuild with -tags sqlcipher to use DBKey.")
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/CCI-MOC/obmd/internal/consoleio"
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+)
+
+// Serves node consoles over ssh: `ssh <node_id>@host` attaches to the
+// console of <node_id>. Clients authenticate with the node's token as the
+// password, or with a public key listed in the node's authorized keys file
+// (see Config.SSHAuthorizedKeysDir).
+type sshServer struct {
+	addr   string
+	live   *LiveConfig
+	daemon obmd.Daemon
+	config *ssh.ServerConfig
+	ln     net.Listener // nil until bind is called.
+	closed int32        // set (atomically) to 1 by close.
+}
+
+// Keys in ssh.Permissions.Extensions:
+const (
+	// The node token the client authenticated with, if any.
+	sshTokenExt = "obmd-token"
+
+	// The fingerprint of the public key the client authenticated with,
+	// if any.
+	sshKeyExt = "obmd-key"
+)
+
+// Create an sshServer on config.SSHListenAddr, loading the host key.
+func newSSHServer(live *LiveConfig, daemon obmd.Daemon) (*sshServer, error) {
+	config := live.Get()
+	keyData, err := ioutil.ReadFile(config.SSHHostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, err
+	}
+	ret := &sshServer{
+		addr:   config.SSHListenAddr,
+		live:   live,
+		daemon: daemon,
+	}
+	ret.config = &ssh.ServerConfig{
+		PasswordCallback:  ret.checkPassword,
+		PublicKeyCallback: ret.checkPublicKey,
+	}
+	ret.config.AddHostKey(hostKey)
+	return ret, nil
+}
+
+// Authenticate with the node's token.
+func (s *sshServer) checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	var token obmd.Token
+	if err := (&token).UnmarshalText(password); err != nil {
+		return nil, obmd.ErrInvalidToken
+	}
+	if err := s.daemon.CheckNodeToken(meta.User(), token); err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{sshTokenExt: string(password)},
+	}, nil
+}
+
+// Authenticate with a public key from the node's authorized keys file.
+func (s *sshServer) checkPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	dir := s.live.Get().SSHAuthorizedKeysDir
+	label := meta.User()
+	// Labels can't contain a slash (they're part of api paths), but don't
+	// trust that to keep us inside dir:
+	if dir == "" || label == "" || strings.ContainsAny(label, `/\`) || strings.HasPrefix(label, ".") {
+		return nil, errors.New("No authorized keys.")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, label))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("Error reading authorized keys",
+				"subsystem", "ssh", "node", label, "err", err)
+		}
+		return nil, errors.New("No authorized keys.")
+	}
+	want := key.Marshal()
+	for len(data) > 0 {
+		var authorized ssh.PublicKey
+		authorized, _, _, data, err = ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(authorized.Marshal(), want) {
+			return &ssh.Permissions{
+				Extensions: map[string]string{sshKeyExt: ssh.FingerprintSHA256(key)},
+			}, nil
+		}
+	}
+	return nil, errors.New("Key not authorized.")
+}
+
+// Start listening on the server's address; see listener.bind.
+func (s *sshServer) bind() error {
+	ln, err := listenTCP(s.addr, time.Duration(s.live.Get().TCPKeepAlivePeriod))
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	return nil
+}
+
+// Accept and serve connections, binding first if necessary. This only
+// returns on error, or (with nil) once close is called.
+func (s *sshServer) serve() error {
+	if s.ln == nil {
+		if err := s.bind(); err != nil {
+			return err
+		}
+	}
+	for {
+		conn, err := s.ln.Accept()
+		if atomic.LoadInt32(&s.closed) != 0 {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Stop accepting connections. Sessions already open end when the daemon
+// closes their consoles.
+func (s *sshServer) close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return s.ln.Close()
+}
+
+func (s *sshServer) handleConn(nConn net.Conn) {
+	log := logger.With("subsystem", "ssh", "remote", nConn.RemoteAddr().String())
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		log.Debug("ssh handshake failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	go s.keepAlive(conn)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "Only sessions are supported.")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			log.Debug("Error accepting ssh channel", "err", err)
+			continue
+		}
+		go s.handleSession(conn, ch, reqs)
+	}
+}
+
+// Periodically check that the client is still there, closing the
+// connection if it doesn't respond; see Config.TCPKeepAlivePeriod. Returns
+// when the connection is closed.
+func (s *sshServer) keepAlive(conn *ssh.ServerConn) {
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+	for {
+		period := time.Duration(s.live.Get().TCPKeepAlivePeriod)
+		if period == 0 {
+			period = defaultKeepAlivePeriod
+		}
+		timer := time.NewTimer(period)
+		select {
+		case <-closed:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// Clients reply to unknown requests with a failure, which is
+		// fine; we just care that they reply.
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		timer = time.NewTimer(period)
+		select {
+		case err := <-replied:
+			timer.Stop()
+			if err != nil {
+				conn.Close()
+				return
+			}
+		case <-timer.C:
+			conn.Close()
+			return
+		case <-closed:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Handle a session channel. The client may request a pty (which we accept,
+// but don't need) and must request a shell, which is connected to the
+// console. Other requests, such as exec, are refused.
+func (s *sshServer) handleSession(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	started := false
+	for req := range reqs {
+		ok := false
+		switch req.Type {
+		case "pty-req", "window-change", "env":
+			ok = true
+		case "shell":
+			ok = !started
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if ok && req.Type == "shell" {
+			started = true
+			go s.attachConsole(conn, ch)
+		}
+	}
+	if !started {
+		ch.Close()
+	}
+}
+
+// Return a context for an OBM operation, which is subject to the configured
+// OperationTimeout. The caller must call the returned CancelFunc when the
+// operation is complete.
+func (s *sshServer) opContext() (context.Context, context.CancelFunc) {
+	timeout := time.Duration(s.live.Get().OperationTimeout)
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Connect ch to the console of the node named by the ssh user.
+func (s *sshServer) attachConsole(conn *ssh.ServerConn, ch ssh.Channel) {
+	label := conn.User()
+	log := logger.With("subsystem", "ssh", "node", label,
+		"remote", conn.RemoteAddr().String())
+	requester := obmd.Requester{RemoteAddr: conn.RemoteAddr().String()}
+	var token *obmd.Token
+	if text, ok := conn.Permissions.Extensions[sshTokenExt]; ok {
+		token = new(obmd.Token)
+		token.UnmarshalText([]byte(text))
+	} else {
+		// Authenticated with a key: this is a user, acting with the
+		// node's current token; see DialNodeConsole.
+		requester.Identity = "ssh-key:" + conn.Permissions.Extensions[sshKeyExt]
+	}
+	// Return a context for an operation on the console.
+	opContext := func() (context.Context, context.CancelFunc) {
+		ctx, cancel := s.opContext()
+		ctx = obmd.WithRequester(obmd.WithOpName(ctx, "ssh"), requester)
+		if token == nil {
+			ctx = userContext(ctx)
+		}
+		return ctx, cancel
+	}
+
+	exit := func(status uint32) {
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		ch.Close()
+	}
+
+	ctx, cancel := opContext()
+	console, err := s.daemon.DialNodeConsole(ctx, label, 0, requester.RemoteAddr, token)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "obmd: %v\r\n", err)
+		exit(1)
+		return
+	}
+	ender, _ := console.(driver.ConsoleEnder)
+	console = consoleio.StartRecording(console, s.live.Get().ConsoleRecordDir, label)
+	defer console.Close()
+
+	// Send input from the client to the console. This ends when the
+	// client disconnects, which also ends the output stream.
+	go func() {
+		defer console.Close()
+		var buf [256]byte
+		for {
+			n, err := ch.Read(buf[:])
+			if n != 0 {
+				ctx, cancel := opContext()
+				werr := s.daemon.WriteNodeConsole(ctx, label, buf[:n], token)
+				cancel()
+				if werr != nil {
+					log.Debug("Error sending input to console", "err", werr)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// This also fails when the client disconnects, so it isn't worth
+	// more than a debug message.
+	if _, err = io.Copy(ch, console); err != nil {
+		log.Debug("Console stream ended", "err", err)
+	}
+	if ender != nil && ender.EndReason() != "" {
+		fmt.Fprintf(ch.Stderr(), "\r\nobmd: console ended: %s\r\n", ender.EndReason())
+	}
+	exit(0)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Start an ssh server for daemon on a random port, returning its address.
+// authorizedKeysDir is as in Config.SSHAuthorizedKeysDir.
+func startSSHServer(t *testing.T, daemon *LocalDaemon, authorizedKeysDir string) string {
+	dir, err := ioutil.TempDir("", "obmd-ssh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "host_key")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := *theConfig
+	config.SSHListenAddr = "127.0.0.1:0"
+	config.SSHHostKeyFile = keyFile
+	config.SSHAuthorizedKeysDir = authorizedKeysDir
+	srv, err := newSSHServer(NewLiveConfig(&config), daemon)
+	if err != nil {
+		t.Fatal("Creating ssh server:", err)
+	}
+	if err = srv.bind(); err != nil {
+		t.Fatal("Binding ssh server:", err)
+	}
+	go srv.serve()
+	return srv.ln.Addr().String()
+}
+
+// Connect to the console over ssh, and read a line of its output.
+func readSSHConsole(addr string, auth ssh.AuthMethod) (string, error) {
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "somenode",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+	out, err := sess.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = sess.Shell(); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(out).ReadString('\n')
+}
+
+// Connect to the console over ssh, and check that we see its output.
+func requireSSHConsole(t *testing.T, addr string, auth ssh.AuthMethod) {
+	line, err := readSSHConsole(addr, auth)
+	if err != nil {
+		t.Fatal("Reading from the console over ssh:", err)
+	}
+	if strings.TrimSpace(line) == "" {
+		t.Fatal("Empty line read from the console.")
+	}
+}
+
+// Verify that we can view a node's console over ssh, with the node's token
+// or an authorized key, and not otherwise.
+func TestSSHConsole(t *testing.T) {
+	daemon := newTestDaemon()
+	err := daemon.SetNode("somenode", []byte(`{"type": "ipmi", "info": {}}`))
+	if err != nil {
+		t.Fatal("Creating node:", err)
+	}
+	token, err := daemon.GetNodeToken(context.Background(), "somenode")
+	if err != nil {
+		t.Fatal("Getting token:", err)
+	}
+	tokenText, _ := token.MarshalText()
+
+	keysDir, err := ioutil.TempDir("", "obmd-ssh-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keysDir)
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(keysDir, "somenode"),
+		ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startSSHServer(t, daemon, keysDir)
+	requireSSHConsole(t, addr, ssh.Password(string(tokenText)))
+	requireSSHConsole(t, addr, ssh.PublicKeys(signer))
+
+	_, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "somenode",
+		Auth:            []ssh.AuthMethod{ssh.Password(strings.Repeat("0", 32))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("Connected over ssh with a bad token.")
+	}
+
+	// Key holders act with the node's token, so lose access with it.
+	if err = daemon.InvalidateNodeToken("somenode"); err != nil {
+		t.Fatal("Invalidating token:", err)
+	}
+	if _, err = readSSHConsole(addr, ssh.PublicKeys(signer)); err == nil {
+		t.Fatal("Read the console with an authorized key after the token was revoked.")
+	}
+}
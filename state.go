@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
 )
 
 // Persistent store for node info, + ephemeral tracking of live OBM
@@ -12,59 +21,482 @@ import (
 // This is basically a map[string]*Node, except that it (a) persists changes in
 // metadata to a database, and (b) will shutdown/initialize OBMs as needed
 //
-// Note that this is not thread-safe.
+// Nodes whose stored info could not be loaded (e.g. because their driver
+// no longer exists) are kept "quarantined"; they cannot be used, but can be
+// listed, fixed (by re-registering them) or deleted.
+//
+// A State is safe for concurrent use. Lookups (GetNode, Maintenance, etc.)
+// only ever wait for other goroutines to update the in-memory maps, never
+// for database queries or OBMs. Changes to a node are serialized with other
+// changes to the same label, and wait for operations in progress on the
+// node (i.e. holding its lock) to finish, but proceed independently of
+// changes to other nodes. Callers must not hold a node's lock while changing
+// it, or they will deadlock.
 type State struct {
 	db     *sql.DB
-	nodes  map[string]*Node
 	driver driver.Driver
+	opts   StateOptions
+
+	// Protects the maps below, including the flag tables' reasons. This
+	// is only ever held briefly, never during database queries.
+	lock        sync.RWMutex
+	nodes       map[string]*Node
+	quarantined map[string]error
+	maintenance *flagTable // nodes in maintenance mode.
+	draining    *flagTable // nodes being drained; see SetDraining.
+
+	// The project which owns each node which has an owner; see
+	// TransferNode.
+	owners map[string]string
+
+	// Serializes changes to each label.
+	mutations labelLocks
+
+	// The results of each node's latest health check; see
+	// LocalDaemon.SetHealthChecks. Unlike the rest of the State, this is
+	// protected by its own lock, since health checks of different nodes
+	// run concurrently. It is not persisted.
+	healthLock sync.Mutex
+	health     map[string]obmd.NodeHealth
+
+	// Each node's power state as of its latest power history entry; see
+	// RecordPower. Also protected by healthLock.
+	lastPower map[string]driver.PowerState
+}
+
+// Tunable parameters for a State. The zero value is a sensible default.
+type StateOptions struct {
+	// Maximum time to allow for a single database query. Zero means no
+	// limit.
+	QueryTimeout time.Duration
+
+	// If non-zero, OBMs are started lazily, when a node is first used,
+	// and are stopped after being idle for this long. Otherwise, every
+	// node's OBM runs for as long as the node exists.
+	OBMIdleTimeout time.Duration
+
+	// If true, NewState does not start the OBMs of the nodes it loads;
+	// they are started by StartOBMs, or when each node is first used.
+	// This lets the caller start serving sooner.
+	DeferOBMStart bool
+
+	// If set, each node's OBM is replaced by the result of calling this
+	// with the node's label and info, e.g. to add fault injection.
+	WrapOBM func(label string, info []byte, obm driver.OBM) driver.OBM
+
+	// If set, this is called with a node's label when the node is
+	// deleted, e.g. to discard what WrapOBM kept about it.
+	ForgetOBM func(label string)
 }
 
 // Create a State from a database. This loads existant objects in immediately.
-func NewState(db *sql.DB, driver driver.Driver) (*State, error) {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS nodes (
+func NewState(db *sql.DB, driver driver.Driver, opts StateOptions) (*State, error) {
+	ret := &State{
+		nodes:       make(map[string]*Node),
+		quarantined: make(map[string]error),
+		maintenance: newFlagTable("node_maintenance"),
+		draining:    newFlagTable("node_drain"),
+		health:      make(map[string]obmd.NodeHealth),
+		mutations:   labelLocks{locks: make(map[string]*labelLock)},
+		db:          db,
+		driver:      driver,
+		opts:        opts,
+	}
+	ctx, cancel := ret.queryContext()
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS nodes (
 		label VARCHAR(80) PRIMARY KEY,
 		obm_info TEXT NOT NULL
 	)`)
+	for _, flags := range ret.flagTables() {
+		if err == nil {
+			_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+flags.table+` (
+				label VARCHAR(80) PRIMARY KEY,
+				reason TEXT NOT NULL
+			)`)
+		}
+	}
+	if err == nil {
+		// Kept separate from the nodes table, so that existing databases
+		// needn't be migrated.
+		_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS node_versions (
+			label VARCHAR(80) PRIMARY KEY,
+			version TEXT NOT NULL
+		)`)
+	}
+	if err == nil {
+		err = createPowerHistory(ctx, db)
+	}
+	if err == nil {
+		err = createConsoleAudit(ctx, db)
+	}
+	if err == nil {
+		err = endDanglingConsoleAudit(ctx, db, time.Now())
+	}
+	if err == nil {
+		err = createOwnership(ctx, db)
+	}
+	if err == nil {
+		err = createPDUOutlets(ctx, db)
+	}
+	if err == nil {
+		err = createSELCursors(ctx, db)
+	}
+	if err == nil {
+		err = createPowerGroups(ctx, db)
+	}
+	if err == nil {
+		err = createPendingPasswords(ctx, db)
+	}
+	cancel()
 	if err != nil {
 		return nil, err
 	}
-	ret := &State{
-		nodes:  make(map[string]*Node),
-		db:     db,
-		driver: driver,
+	stored, err := ret.loadRows()
+	if err != nil {
+		return nil, err
+	}
+	for _, flags := range ret.flagTables() {
+		if err = ret.loadFlags(flags); err != nil {
+			return nil, err
+		}
+	}
+	if err = ret.loadLastPower(); err != nil {
+		return nil, err
+	}
+	if err = ret.loadOwners(); err != nil {
+		return nil, err
 	}
-	rows, err := db.Query(`SELECT label, obm_info FROM nodes`)
+
+	// Constructing the OBMs dominates startup time with many nodes, so
+	// we do it concurrently:
+	nodes := make([]*Node, len(stored))
+	errs := make([]error, len(stored))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				nodes[j], errs[j] = ret.newNode(stored[j].label, stored[j].info)
+				if errs[j] == nil {
+					nodes[j].Version = stored[j].version
+				}
+			}
+		}()
+	}
+	for i := range stored {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for i, row := range stored {
+		if errs[i] != nil {
+			logger.Warn("Quarantining node, which could not be loaded",
+				"subsystem", "state", "node", row.label, "err", errs[i])
+			ret.quarantined[row.label] = errs[i]
+			continue
+		}
+		ret.nodes[row.label] = nodes[i]
+	}
+	if !opts.DeferOBMStart {
+		ret.StartOBMs()
+	}
+	ret.check()
+	return ret, nil
+}
+
+// A row of the nodes table, with the node's version.
+type nodeRow struct {
+	label   string
+	info    []byte
+	version string
+}
+
+// Read all of the rows of the nodes table, giving versions to any nodes
+// which don't have them (e.g. because they were registered by an older
+// version of obmd).
+func (s *State) loadRows() ([]nodeRow, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT nodes.label, nodes.obm_info, node_versions.version
+		FROM nodes LEFT JOIN node_versions ON nodes.label = node_versions.label`)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	var ret []nodeRow
+	var missing []int
 	for rows.Next() {
-		var (
-			label string
-			info  []byte
-		)
-		err = rows.Scan(&label, &info)
+		var row nodeRow
+		var version sql.NullString
+		err = rows.Scan(&row.label, &row.info, &version)
 		if err != nil {
+			rows.Close()
 			return nil, err
 		}
-		node, err := NewNode(driver, info)
+		row.version = version.String
+		if !version.Valid {
+			missing = append(missing, len(ret))
+		}
+		ret = append(ret, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, i := range missing {
+		ret[i].version = newVersion()
+		_, err = s.db.ExecContext(ctx,
+			`INSERT INTO node_versions(label, version) VALUES ($1, $2)`,
+			ret[i].label,
+			ret[i].version,
+		)
 		if err != nil {
 			return nil, err
 		}
-		ret.nodes[label] = node
 	}
-	err = rows.Err()
+	return ret, nil
+}
+
+// Return a new node version; see Node.Version.
+func newVersion() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// Record version as the version of the node `label`, as part of tx.
+func setVersion(ctx context.Context, tx *sql.Tx, label, version string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM node_versions WHERE label = $1`, label)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO node_versions(label, version) VALUES ($1, $2)`,
+			label,
+			version,
+		)
+	}
+	return err
+}
+
+// A set of locks, one per label, created as needed.
+type labelLocks struct {
+	sync.Mutex
+	locks map[string]*labelLock
+}
+
+type labelLock struct {
+	sync.Mutex
+	refs int // the number of goroutines holding or waiting for the lock.
+}
+
+// Acquire the locks for the given labels, in a consistent order, so that
+// goroutines locking overlapping sets of labels don't deadlock. Returns a
+// function which releases them.
+func (l *labelLocks) lock(labels ...string) (unlock func()) {
+	labels = append([]string(nil), labels...)
+	sort.Strings(labels)
+	var held []string
+	for i, label := range labels {
+		if i > 0 && label == labels[i-1] {
+			continue
+		}
+		l.Lock()
+		ll, ok := l.locks[label]
+		if !ok {
+			ll = &labelLock{}
+			l.locks[label] = ll
+		}
+		ll.refs++
+		l.Unlock()
+		ll.Lock()
+		held = append(held, label)
+	}
+	return func() {
+		l.Lock()
+		defer l.Unlock()
+		for _, label := range held {
+			ll := l.locks[label]
+			ll.Unlock()
+			if ll.refs--; ll.refs == 0 {
+				delete(l.locks, label)
+			}
+		}
+	}
+}
+
+// A per-node flag with a reason, such as maintenance mode, which is
+// persisted in a table of (label, reason) rows.
+type flagTable struct {
+	table   string
+	reasons map[string]string // by label, for nodes with the flag set.
+}
+
+func newFlagTable(table string) *flagTable {
+	return &flagTable{table: table, reasons: make(map[string]string)}
+}
+
+// Return all of the flag tables.
+func (s *State) flagTables() []*flagTable {
+	return []*flagTable{s.maintenance, s.draining}
+}
+
+// Read flags' table into flags.reasons.
+func (s *State) loadFlags(flags *flagTable) error {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT label, reason FROM `+flags.table)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for _, node := range ret.nodes {
-		node.StartOBM()
+	defer rows.Close()
+	for rows.Next() {
+		var label, reason string
+		if err = rows.Scan(&label, &reason); err != nil {
+			return err
+		}
+		flags.reasons[label] = reason
 	}
-	ret.check()
-	return ret, nil
+	return rows.Err()
+}
+
+// Set the flag for the node (which may be quarantined), recording reason,
+// or clear it if on is false. This waits for operations in progress on the
+// node to finish.
+func (s *State) setFlag(flags *flagTable, label string, on bool, reason string) error {
+	unlock := s.mutations.lock(label)
+	defer unlock()
+	node, err := s.GetNode(label)
+	if err != nil && err != obmd.ErrNodeQuarantined {
+		return err
+	}
+	if node != nil {
+		node.Lock()
+		defer node.Unlock()
+	}
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, `DELETE FROM `+flags.table+` WHERE label = $1`, label)
+	if err == nil && on {
+		_, err = s.db.ExecContext(ctx,
+			`INSERT INTO `+flags.table+`(label, reason) VALUES ($1, $2)`,
+			label,
+			reason,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if on {
+		flags.reasons[label] = reason
+	} else {
+		delete(flags.reasons, label)
+	}
+	return nil
+}
+
+// Report whether the node has the flag set, and if so, why.
+func (s *State) flag(flags *flagTable, label string) (reason string, ok bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	reason, ok = flags.reasons[label]
+	return reason, ok
+}
+
+// Report whether the node is in maintenance mode, and if so, why.
+func (s *State) Maintenance(label string) (reason string, ok bool) {
+	return s.flag(s.maintenance, label)
+}
+
+// Put the node (which may be quarantined) into maintenance mode, recording
+// reason, or take it out of maintenance mode if on is false.
+func (s *State) SetMaintenance(label string, on bool, reason string) error {
+	return s.setFlag(s.maintenance, label, on, reason)
+}
+
+// Report whether the node is being drained, and if so, why.
+func (s *State) Draining(label string) (reason string, ok bool) {
+	return s.flag(s.draining, label)
+}
+
+// Start draining the node (which may be quarantined), recording reason,
+// or stop if on is false. While a node is draining, no new tokens are
+// issued for it.
+func (s *State) SetDraining(label string, on bool, reason string) error {
+	return s.setFlag(s.draining, label, on, reason)
+}
+
+// Record the result of a health check of the node, which started at
+// `checked` and took `latency`. err is nil if the OBM answered, reporting
+// the node's power state. Results for nodes which no longer exist are
+// discarded.
+func (s *State) RecordHealth(label string, checked time.Time, latency time.Duration, power driver.PowerState, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if _, ok := s.nodes[label]; !ok {
+		return
+	}
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	h := s.health[label]
+	h.Healthy = err == nil
+	h.LastChecked = checked
+	h.Latency = obmd.Duration(latency)
+	h.Error = ""
+	if err == nil {
+		h.LastSeen = checked
+		h.PowerState = power
+	} else {
+		h.Error = err.Error()
+	}
+	s.health[label] = h
+}
+
+// Return the results of the latest health check of each node which has
+// been checked.
+func (s *State) Health() map[string]obmd.NodeHealth {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	ret := make(map[string]obmd.NodeHealth, len(s.health))
+	for label, h := range s.health {
+		ret[label] = h
+	}
+	return ret
+}
+
+// Start the OBMs of any nodes which are not already running. This does
+// nothing if OBMs are started lazily (see StateOptions.OBMIdleTimeout).
+func (s *State) StartOBMs() {
+	if s.opts.OBMIdleTimeout != 0 {
+		return
+	}
+	// Holding the lock stops nodes being deleted (and their OBMs
+	// stopped) while we start them.
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, node := range s.nodes {
+		node.startIfStopped()
+	}
+}
+
+// Return a context to be used for a single database query, which will
+// time out according to s.opts.QueryTimeout. The caller must call the
+// returned CancelFunc when the query is complete.
+func (s *State) queryContext() (context.Context, context.CancelFunc) {
+	if s.opts.QueryTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), s.opts.QueryTimeout)
 }
 
 func (s *State) check() {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	for label, node := range s.nodes {
 		if node == nil {
 			panic("Node " + label + " is nil!")
@@ -73,52 +505,394 @@ func (s *State) check() {
 }
 
 // Clean up resources used by the State. Does not close the database.
+//
+// This stops all of the running OBMs (disconnecting any console sessions), and
+// waits for them to finish shutting down.
 func (s *State) Close() error {
-	for _, node := range s.nodes {
-		node.StopOBM()
+	nodes := s.Nodes()
+	for _, node := range nodes {
+		node.StopOBM("shutdown")
+	}
+	for _, node := range nodes {
+		node.WaitOBM()
 	}
 	return nil
 }
 
+// Get the node with the given label. Returns ErrNodeQuarantined if the
+// node exists but is quarantined.
 func (s *State) GetNode(label string) (*Node, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	node, ok := s.nodes[label]
 	if !ok {
-		return nil, ErrNoSuchNode
+		if _, ok = s.quarantined[label]; ok {
+			return nil, obmd.ErrNodeQuarantined
+		}
+		return nil, obmd.ErrNoSuchNode
+	}
+	return node, nil
+}
+
+// Return all of the nodes (excluding quarantined ones), keyed by label.
+// The map is a copy, so the caller may keep it, but the nodes may be
+// deleted or replaced after this returns.
+func (s *State) Nodes() map[string]*Node {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make(map[string]*Node, len(s.nodes))
+	for label, node := range s.nodes {
+		ret[label] = node
+	}
+	return ret
+}
+
+// Return the labels of all nodes, including quarantined ones.
+func (s *State) Labels() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make([]string, 0, len(s.nodes)+len(s.quarantined))
+	for label := range s.nodes {
+		ret = append(ret, label)
+	}
+	for label := range s.quarantined {
+		ret = append(ret, label)
+	}
+	return ret
+}
+
+// Return the labels of all quarantined nodes, with the errors that caused
+// them to be quarantined.
+func (s *State) QuarantinedNodes() map[string]error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ret := make(map[string]error, len(s.quarantined))
+	for label, err := range s.quarantined {
+		ret[label] = err
+	}
+	return ret
+}
+
+// Make a Node for the given label and info, applying opts.WrapOBM.
+func (s *State) newNode(label string, info []byte) (*Node, error) {
+	node, err := NewNode(s.driver, info)
+	if err != nil || s.opts.WrapOBM == nil {
+		return node, err
 	}
+	node.OBM = s.opts.WrapOBM(label, info, node.OBM)
 	return node, nil
 }
 
+// Validate info, if the driver is a driver.InfoValidator.
+func (s *State) validateInfo(info []byte) error {
+	if v, ok := s.driver.(driver.InfoValidator); ok {
+		return v.ValidateInfo(info)
+	}
+	return nil
+}
+
+// Create a new node. If a quarantined node with the same label exists,
+// its info is replaced, and it is released from quarantine. If the driver
+// is a driver.InfoValidator, the info is validated first.
 func (s *State) NewNode(label string, info []byte) (*Node, error) {
+	unlock := s.mutations.lock(label)
+	defer unlock()
 	_, err := s.GetNode(label)
 	if err == nil {
-		return nil, ErrNodeExists
+		return nil, obmd.ErrNodeExists
+	}
+	quarantined := err == obmd.ErrNodeQuarantined
+	if err = s.validateInfo(info); err != nil {
+		return nil, err
+	}
+	// Node doesn't exist (or is unusable); create it.
+	node, err := s.newNode(label, info)
+	if err != nil {
+		return nil, err
+	}
+	node.Version = newVersion()
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if quarantined {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE nodes SET obm_info = $2 WHERE label = $1`,
+			label,
+			info,
+		)
+	} else {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO nodes(label, obm_info)
+				VALUES ($1, $2)`,
+			label,
+			info,
+		)
+	}
+	if err == nil {
+		err = setVersion(ctx, tx, label, node.Version)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
 	}
-	// Node doesn't exist; create it.
-	node, err := NewNode(s.driver, info)
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.db.Exec(
-		`INSERT INTO nodes(label, obm_info)
-			VALUES ($1, $2)`,
+	s.lock.Lock()
+	delete(s.quarantined, label)
+	s.nodes[label] = node
+	s.lock.Unlock()
+	if s.opts.OBMIdleTimeout == 0 {
+		node.StartOBM()
+	}
+	return node, nil
+}
+
+// Replace the info of an existing node, e.g. after its OBM's credentials
+// have changed. The node is replaced by a new one, with a new OBM, but the
+// same token. This waits for operations in progress on the node to finish.
+// As with NewNode, the info is validated first.
+func (s *State) UpdateNodeInfo(label string, info []byte) error {
+	unlock := s.mutations.lock(label)
+	defer unlock()
+	old, err := s.GetNode(label)
+	if err != nil {
+		return err
+	}
+	if err = s.validateInfo(info); err != nil {
+		return err
+	}
+	old.Lock()
+	defer old.Unlock()
+	return s.replaceNodeInfo(label, old, info)
+}
+
+// Like UpdateNodeInfo, but the caller must hold the label's mutation lock
+// and the lock of its current node, old. Any pending password for the
+// node is dropped, as the new info supersedes it; see SetPendingPassword.
+func (s *State) replaceNodeInfo(label string, old *Node, info []byte) error {
+	node, err := s.newNode(label, info)
+	if err != nil {
+		return err
+	}
+	node.Version = newVersion()
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE nodes SET obm_info = $2 WHERE label = $1`,
 		label,
 		info,
 	)
+	if err == nil {
+		err = setVersion(ctx, tx, label, node.Version)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM pending_passwords WHERE label = $1`, label)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
+	node.CurrentToken = old.CurrentToken
+	old.removed = true
+	s.lock.Lock()
 	s.nodes[label] = node
-	node.StartOBM()
-	return node, nil
+	s.lock.Unlock()
+	old.StopOBM("node_updated")
+	if s.opts.OBMIdleTimeout == 0 {
+		node.StartOBM()
+	}
+	return nil
 }
 
-func (s *State) DeleteNode(label string) error {
-	var err error
-	node, ok := s.nodes[label]
-	if ok {
-		node.StopOBM()
+// Change the label of the node (which may be quarantined) `label` to
+// newLabel, which must not be in use. The node itself is unchanged, so it
+// keeps its OBM and token.
+func (s *State) RenameNode(label, newLabel string) error {
+	unlock := s.mutations.lock(label, newLabel)
+	defer unlock()
+	if _, err := s.GetNode(label); err != nil && err != obmd.ErrNodeQuarantined {
+		return err
+	}
+	if _, err := s.GetNode(newLabel); err != obmd.ErrNoSuchNode {
+		return obmd.ErrNodeExists
+	}
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// sqlite numbers parameters in the order they appear, regardless of
+	// their names, so they must appear in order:
+	_, err = tx.ExecContext(ctx, `UPDATE nodes SET label = $1 WHERE label = $2`, newLabel, label)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE node_versions SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE power_history SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE console_audit SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE node_owners SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE node_transfers SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE pdu_outlets SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE sel_cursors SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE power_group_members SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE pending_passwords SET label = $1 WHERE label = $2`, newLabel, label)
+	}
+	for _, flags := range s.flagTables() {
+		if err == nil {
+			_, err = tx.ExecContext(ctx,
+				`UPDATE `+flags.table+` SET label = $1 WHERE label = $2`,
+				newLabel,
+				label,
+			)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if node, ok := s.nodes[label]; ok {
 		delete(s.nodes, label)
-		_, err = s.db.Exec("DELETE FROM nodes WHERE label = $1", label)
+		s.nodes[newLabel] = node
 	}
-	return err
+	if qerr, ok := s.quarantined[label]; ok {
+		delete(s.quarantined, label)
+		s.quarantined[newLabel] = qerr
+	}
+	for _, flags := range s.flagTables() {
+		if reason, ok := flags.reasons[label]; ok {
+			delete(flags.reasons, label)
+			flags.reasons[newLabel] = reason
+		}
+	}
+	if project, ok := s.owners[label]; ok {
+		delete(s.owners, label)
+		s.owners[newLabel] = project
+	}
+	s.healthLock.Lock()
+	if health, ok := s.health[label]; ok {
+		delete(s.health, label)
+		s.health[newLabel] = health
+	}
+	if power, ok := s.lastPower[label]; ok {
+		delete(s.lastPower, label)
+		s.lastPower[newLabel] = power
+	}
+	s.healthLock.Unlock()
+	return nil
+}
+
+// Delete the node (which may be quarantined). Returns ErrNoSuchNode if
+// there is no such node. This waits for operations in progress on the
+// node to finish.
+func (s *State) DeleteNode(label string) error {
+	unlock := s.mutations.lock(label)
+	defer unlock()
+	node, err := s.GetNode(label)
+	if err == obmd.ErrNodeQuarantined {
+		node = nil
+	} else if err != nil {
+		return err
+	}
+	if node != nil {
+		node.Lock()
+		defer node.Unlock()
+	}
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM nodes WHERE label = $1", label)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM node_versions WHERE label = $1", label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM power_history WHERE label = $1", label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM node_owners WHERE label = $1", label)
+	}
+	if err == nil {
+		// The outlet is still there, but no longer powers a node.
+		_, err = tx.ExecContext(ctx, "UPDATE pdu_outlets SET label = '' WHERE label = $1", label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM sel_cursors WHERE label = $1", label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM power_group_members WHERE label = $1", label)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM pending_passwords WHERE label = $1", label)
+	}
+	for _, flags := range s.flagTables() {
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "DELETE FROM "+flags.table+" WHERE label = $1", label)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	delete(s.nodes, label)
+	delete(s.quarantined, label)
+	for _, flags := range s.flagTables() {
+		delete(flags.reasons, label)
+	}
+	delete(s.owners, label)
+	s.healthLock.Lock()
+	delete(s.health, label)
+	delete(s.lastPower, label)
+	s.healthLock.Unlock()
+	s.lock.Unlock()
+	if node != nil {
+		node.removed = true
+		node.StopOBM("node_deleted")
+	}
+	if s.opts.ForgetOBM != nil {
+		s.opts.ForgetOBM(label)
+	}
+	return nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Changes to different nodes, and lookups, should be safe to make
+// concurrently.
+func TestStateConcurrentUse(t *testing.T) {
+	daemon := newTestDaemon()
+	state := daemon.state
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		label := fmt.Sprintf("node-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := state.NewNode(label, mockNodeInfo("10.0.0.42")); err != nil {
+					t.Error("Creating node:", err)
+					return
+				}
+				if err := state.SetMaintenance(label, true, "testing"); err != nil {
+					t.Error("Setting maintenance mode:", err)
+					return
+				}
+				if _, ok := state.Maintenance(label); !ok {
+					t.Error("Node is not in maintenance mode.")
+				}
+				if err := state.RenameNode(label, label+"-renamed"); err != nil {
+					t.Error("Renaming node:", err)
+					return
+				}
+				if err := state.DeleteNode(label + "-renamed"); err != nil {
+					t.Error("Deleting node:", err)
+					return
+				}
+			}
+		}()
+	}
+	// Meanwhile, read the state:
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			for label := range state.Nodes() {
+				state.GetNode(label)
+				state.Draining(label)
+			}
+			state.Labels()
+		}
+	}()
+	wg.Wait()
+	if labels := state.Labels(); len(labels) != 0 {
+		t.Fatal("Nodes left over:", labels)
+	}
+	if _, ok := state.Maintenance("node-0"); ok {
+		t.Fatal("Deleted node is still in maintenance mode.")
+	}
+}
+
+// A change to a node which is waiting for an operation on it to finish
+// shouldn't hold up operations on other nodes.
+func TestSlowChangeIsolated(t *testing.T) {
+	daemon := newTestDaemon()
+	errpanic(daemon.SetNode("slow", []byte(`{"type": "ipmi", "info": {"addr": "10.0.0.43", "hang": true}}`)))
+	errpanic(daemon.SetNode("fast", mockNodeInfo("10.0.0.44")))
+	token, err := daemon.GetNodeToken(context.Background(), "fast")
+	errpanic(err)
+
+	// Start an operation on the slow node, which hangs until cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hung := make(chan struct{})
+	go func() {
+		daemon.PowerOffNode(ctx, "slow", nil)
+		close(hung)
+	}()
+	// Wait for it to take the node's lock:
+	node, err := daemon.state.GetNode("slow")
+	errpanic(err)
+	for i := 0; ; i++ {
+		lockCtx, cancelLock := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err = node.lockContext(lockCtx)
+		cancelLock()
+		if err != nil {
+			break
+		}
+		node.Unlock()
+		if i == 100 {
+			t.Fatal("Operation on the slow node didn't start.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// This waits for the operation to finish:
+	maintenance := make(chan error)
+	go func() {
+		maintenance <- daemon.SetNodeMaintenance("slow", true, "testing")
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		if err := daemon.CheckNodeToken("fast", token); err != nil {
+			done <- err
+			return
+		}
+		done <- daemon.PowerOffNode(context.Background(), "fast", &token)
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal("Operating on the fast node:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Operations on the fast node were held up by a change to the slow one.")
+	}
+	select {
+	case <-maintenance:
+		t.Fatal("Maintenance mode was set while an operation was in progress.")
+	default:
+	}
+
+	cancel()
+	<-hung
+	if err = <-maintenance; err != nil {
+		t.Fatal("Setting maintenance mode:", err)
+	}
+	if on, _, _ := daemon.NodeMaintenance("slow"); !on {
+		t.Fatal("Slow node is not in maintenance mode.")
+	}
+}
+
+// If deleting a node fails partway through, none of it should be
+// deleted.
+func TestDeleteNodeAtomic(t *testing.T) {
+	daemon := newTestDaemon()
+	state := daemon.state
+	errpanic(daemon.SetNode("node-0", mockNodeInfo("10.0.0.42")))
+
+	// Make one of the later deletes fail:
+	_, err := state.db.Exec("DROP TABLE pending_passwords")
+	errpanic(err)
+	if err := state.DeleteNode("node-0"); err == nil {
+		t.Fatal("Deleting the node succeeded without the pending_passwords table.")
+	}
+
+	if _, err := state.GetNode("node-0"); err != nil {
+		t.Fatal("Node is gone after a failed delete:", err)
+	}
+	var count int
+	errpanic(state.db.QueryRow("SELECT COUNT(*) FROM nodes WHERE label = $1", "node-0").Scan(&count))
+	if count != 1 {
+		t.Fatal("Node was deleted from the database by a failed delete.")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/consoleio"
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+)
+
+const (
+	// Syslog priority for forwarded console lines: facility local0,
+	// severity informational.
+	syslogPriority = 16*8 + 6
+
+	// The maximum length of a forwarded line; longer lines are split.
+	maxSyslogLine = 2048
+
+	// How often ForwardConsoles checks for added or removed nodes.
+	forwardPollInterval = 10 * time.Second
+
+	// How long to wait before reconnecting to a console, after failing to
+	// connect or being disconnected.
+	forwardRetryDelay = 10 * time.Second
+)
+
+// Sends messages to a syslog collector, in RFC 5424 format. Over TCP,
+// messages are framed with octet counting (RFC 6587), and the connection
+// is re-established as needed.
+type syslogWriter struct {
+	network, addr string
+
+	lock sync.Mutex
+	conn net.Conn // nil if not connected.
+}
+
+func newSyslogWriter(network, addr string) *syslogWriter {
+	return &syslogWriter{network: network, addr: addr}
+}
+
+// Format a message from the node `label`.
+func formatSyslog(label string, t time.Time, msg string) string {
+	// Labels can be arbitrary, but the HOSTNAME field must be printable
+	// ASCII, with no spaces:
+	host := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, label)
+	if host == "" {
+		host = "-"
+	}
+	if len(host) > 255 {
+		host = host[:255]
+	}
+	return fmt.Sprintf("<%d>1 %s %s obmd %d console - %s",
+		syslogPriority,
+		t.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		host, os.Getpid(), msg)
+}
+
+// Send a line of console output from the node `label`.
+func (w *syslogWriter) send(label, line string) error {
+	msg := formatSyslog(label, time.Now(), line)
+	if w.network != "udp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.conn == nil {
+		conn, err := net.DialTimeout(w.network, w.addr, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := w.conn.Write([]byte(msg))
+	if err != nil {
+		// Reconnect next time:
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// Forward the console output of every node to w, line by line, until the
+// daemon is closed. This keeps each node's console connected.
+func (d *LocalDaemon) ForwardConsoles(w *syslogWriter) {
+	forwarders := make(map[string]chan struct{}) // closed to stop each one.
+	for {
+		nodes := d.state.Nodes()
+		current := make(map[string]bool, len(nodes))
+		for label := range nodes {
+			current[label] = true
+		}
+		for label := range current {
+			if _, ok := forwarders[label]; !ok {
+				stop := make(chan struct{})
+				forwarders[label] = stop
+				go d.forwardConsole(label, w, stop)
+			}
+		}
+		for label, stop := range forwarders {
+			if !current[label] {
+				close(stop)
+				delete(forwarders, label)
+			}
+		}
+		select {
+		case <-d.stop:
+			for _, stop := range forwarders {
+				close(stop)
+			}
+			return
+		case <-time.After(forwardPollInterval):
+		}
+	}
+}
+
+// Reasons (see consoleConn.EndReason) for which a forwarding connection
+// may end, after which forwardConsole doesn't reconnect until a user
+// connects to the console, since it was deliberately disconnected.
+var forwardYieldReasons = map[string]bool{
+	driver.ConsoleEndIdle:        true,
+	driver.ConsoleEndMaxDuration: true,
+	"token_revoked":              true,
+	"disconnected":               true,
+}
+
+// Forward the console output of the node `label` to w, until stop is
+// closed, reconnecting as needed.
+//
+// The connections are background ones (see driver.WithBackground), so
+// they don't keep an otherwise idle console connected, and once a console
+// has been disconnected (see forwardYieldReasons), they yield it to users:
+// forwarding resumes only when a user connects to it again, by joining
+// their session.
+func (d *LocalDaemon) forwardConsole(label string, w *syslogWriter, stop chan struct{}) {
+	log := logger.With("subsystem", "syslog", "node", label)
+	for {
+		ctx, cancel := context.WithTimeout(driver.WithBackground(context.Background()), forwardRetryDelay)
+		conn, err := d.DialNodeConsole(ctx, label, 0, "syslog", nil)
+		cancel()
+		var yield bool
+		if err != nil {
+			log.Debug("Error connecting to console for forwarding", "err", err)
+		} else {
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					conn.Close()
+				case <-done:
+				}
+			}()
+			scanner := bufio.NewScanner(consoleio.NewSanitizer(conn))
+			scanner.Buffer(make([]byte, maxSyslogLine), maxSyslogLine)
+			scanner.Split(scanLinesLimited)
+			// Only log when forwarding starts or stops failing, so that
+			// an unreachable collector doesn't flood the log.
+			failing := false
+			for scanner.Scan() {
+				line := scanner.Text()
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				err := w.send(label, line)
+				if err != nil && !failing {
+					log.Warn("Error forwarding console output", "err", err)
+				} else if err == nil && failing {
+					log.Info("Resumed forwarding console output")
+				}
+				failing = err != nil
+			}
+			close(done)
+			if e, ok := conn.(driver.ConsoleEnder); ok {
+				yield = forwardYieldReasons[e.EndReason()]
+			}
+			conn.Close()
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(forwardRetryDelay):
+			}
+			if !yield || d.consoles.inUse(label) {
+				break
+			}
+		}
+	}
+}
+
+// Like bufio.ScanLines, but splits lines which don't fit in the buffer,
+// rather than failing.
+func scanLinesLimited(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance == 0 && token == nil && err == nil && len(data) >= maxSyslogLine {
+		return len(data), data, nil
+	}
+	return advance, token, err
+}
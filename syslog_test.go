@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// Messages should be in RFC 5424 format, with the label as the hostname.
+func TestFormatSyslog(t *testing.T) {
+	msg := formatSyslog("rack 1/node 2", time.Date(2018, 3, 2, 15, 4, 5, 0, time.UTC), "hello")
+	if !strings.HasPrefix(msg, "<134>1 2018-03-02T15:04:05.000000Z rack_1/node_2 obmd ") ||
+		!strings.HasSuffix(msg, " console - hello") {
+		t.Fatalf("Unexpected message %q", msg)
+	}
+}
+
+// Console output should be forwarded to the collector.
+func TestForwardConsoles(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	err = daemon.SetNode("somenode", []byte(`{"type": "ipmi", "info": {}}`))
+	if err != nil {
+		t.Fatal("Creating node:", err)
+	}
+	go daemon.ForwardConsoles(newSyslogWriter("udp", collector.LocalAddr().String()))
+
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("Reading from the collector:", err)
+	}
+	if msg := string(buf[:n]); !strings.Contains(msg, " somenode obmd ") {
+		t.Fatalf("Unexpected message %q", msg)
+	}
+}
+
+// Background console connections, as used for forwarding, need no token,
+// but aren't the admin's, and don't count as the console being in use.
+// They end like the node's other connections when its token is revoked.
+func TestBackgroundConsole(t *testing.T) {
+	daemon := newTestDaemon()
+	defer daemon.Close()
+	err := daemon.SetNode("forwarded", []byte(`{"type": "ipmi", "info": {"addr": "10.0.0.69"}}`))
+	if err != nil {
+		t.Fatal("Creating node:", err)
+	}
+	ctx := context.Background()
+	token, err := daemon.GetNodeToken(ctx, "forwarded")
+	errpanic(err)
+
+	bgCtx := driver.WithBackground(ctx)
+	if isAdminOp(bgCtx, nil) {
+		t.Fatal("Background operation treated as the admin's")
+	}
+	bg, err := daemon.DialNodeConsole(bgCtx, "forwarded", 0, "syslog", nil)
+	if err != nil {
+		t.Fatal("Dialing a background console:", err)
+	}
+	defer bg.Close()
+	if daemon.consoles.inUse("forwarded") {
+		t.Fatal("Console in use with only a background connection")
+	}
+	conn, err := daemon.DialNodeConsole(ctx, "forwarded", 0, "192.0.2.1:1234", &token)
+	errpanic(err)
+	defer conn.Close()
+	if !daemon.consoles.inUse("forwarded") {
+		t.Fatal("Console not in use with a user connected")
+	}
+
+	_, err = daemon.GetNodeToken(ctx, "forwarded")
+	errpanic(err)
+	if _, err = io.Copy(ioutil.Discard, bg); err != nil {
+		t.Fatal("Reading from the background console:", err)
+	}
+	reason := bg.(driver.ConsoleEnder).EndReason()
+	if !forwardYieldReasons[reason] {
+		t.Fatalf("Background console ended with reason %q, which doesn't yield", reason)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+)
+
+// A template for registering nodes; see Config.NodeTemplates.
+type NodeTemplate struct {
+	// The driver type, e.g. "ipmi".
+	Type string
+
+	// Driver info shared by the nodes, e.g. credentials. Each node's own
+	// info fields are added to these, replacing any of the same name.
+	Info map[string]json.RawMessage
+
+	// Optional: the make and model of the nodes, for metrics; see
+	// DriverMetrics.
+	Model string
+}
+
+// Register nodes which refer to templates (see expandTemplate) using
+// these, keyed by name. This may be called at any time.
+//
+// A node's info is expanded once, when it is registered, and only the
+// result is stored, so changing templates doesn't affect nodes already
+// registered through the api. Nodes from the inventory file or
+// Kubernetes are re-expanded whenever those are next reconciled, and
+// updated if the result differs.
+func (d *LocalDaemon) SetNodeTemplates(templates map[string]NodeTemplate) {
+	d.Lock()
+	defer d.Unlock()
+	d.templates = templates
+}
+
+// If info (the info given when registering a node) refers to one of
+// templates, i.e. it is of the form
+//
+//	{"template": name, "info": {...}}
+//
+// optionally with a "model", return the info of the node as registered:
+// the template's type, its info with the given fields added, and the
+// given model or the template's. Otherwise, return info as it is.
+// Problems are reported as a *driver.InvalidInfoError.
+func expandTemplate(templates map[string]NodeTemplate, info []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(info, &fields) != nil || fields["template"] == nil {
+		return info, nil
+	}
+	var problems []string
+	var name string
+	if err := json.Unmarshal(fields["template"], &name); err != nil {
+		problems = append(problems, "The template must be a string.")
+	}
+	tmpl, ok := templates[name]
+	if problems == nil && !ok {
+		problems = append(problems, fmt.Sprintf("No such template %q.", name))
+	}
+	var nodeInfo map[string]json.RawMessage
+	if raw, ok := fields["info"]; ok {
+		if err := json.Unmarshal(raw, &nodeInfo); err != nil {
+			problems = append(problems, "The info must be a JSON object.")
+		}
+	}
+	for field := range fields {
+		if field != "template" && field != "info" && field != "model" {
+			problems = append(problems, fmt.Sprintf(
+				"Unknown field %q; nodes registered from templates may only have \"template\", \"info\" and \"model\".",
+				field))
+		}
+	}
+	model := tmpl.Model
+	if raw, ok := fields["model"]; ok {
+		if err := json.Unmarshal(raw, &model); err != nil {
+			problems = append(problems, "The model must be a string.")
+		}
+	}
+	if problems != nil {
+		return nil, &driver.InvalidInfoError{Problems: problems}
+	}
+
+	merged := make(map[string]json.RawMessage, len(tmpl.Info)+len(nodeInfo))
+	for k, v := range tmpl.Info {
+		merged[k] = v
+	}
+	for k, v := range nodeInfo {
+		merged[k] = v
+	}
+	expanded := map[string]interface{}{
+		"type": tmpl.Type,
+		"info": merged,
+	}
+	if model != "" {
+		expanded["model"] = model
+	}
+	return json.Marshal(expanded)
+}
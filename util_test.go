@@ -12,6 +12,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/CCI-MOC/obmd/internal/api"
 	"github.com/CCI-MOC/obmd/internal/driver"
 	"github.com/CCI-MOC/obmd/internal/driver/dummy"
 	"github.com/CCI-MOC/obmd/internal/driver/mock"
@@ -27,6 +28,8 @@ func errpanic(err error) {
 
 func init() {
 	theConfig = &Config{
+		DBType:     "sqlite3",
+		DBPath:     ":memory:",
 		ListenAddr: ":8080", // Not actually used directly by the handler.
 	}
 	errpanic((&theConfig.AdminToken).
@@ -82,7 +85,7 @@ func getToken(t *testing.T, handler http.Handler, nodeId string) string {
 	if result.StatusCode != http.StatusOK {
 		t.Fatalf("getting token failed with status %d.", result.StatusCode)
 	}
-	var respBody TokenResp
+	var respBody api.TokenResp
 	err := json.NewDecoder(result.Body).Decode(&respBody)
 	if err != nil {
 		t.Fatalf("Decoding body in getToken: %v", err)
@@ -108,14 +111,24 @@ func makeNode(t *testing.T, handler http.Handler, nodeId string, nodeInfo string
 
 // Wraps makeHandler, passing testing-appropriate arguments
 func newHandler() http.Handler {
-	db, err := sql.Open("sqlite3", ":memory:")
+	db, err := sql.Open(theConfig.DBType, theConfig.DBPath)
 	errpanic(err)
 	state, err := NewState(db, driver.Registry{
 		"ipmi":  mock.Driver,
 		"dummy": dummy.Driver,
-	})
+	}, StateOptions{})
+	errpanic(err)
+	return makeHandler(NewLiveConfig(theConfig), NewDaemon(state), api.AllAPI)
+}
+
+// Create a Daemon backed by a fresh in-memory database.
+func newTestDaemon() *LocalDaemon {
+	db, err := sql.Open("sqlite3", ":memory:")
+	errpanic(err)
+	db.SetMaxOpenConns(1)
+	state, err := NewState(db, driver.Registry{"ipmi": mock.Driver}, StateOptions{})
 	errpanic(err)
-	return makeHandler(theConfig, NewDaemon(state))
+	return NewDaemon(state)
 }
 
 // Make the specified request, and call t.Fatal if the status code is
@@ -136,6 +149,14 @@ func adminReq(handler http.Handler, spec requestSpec) *httptest.ResponseRecorder
 	return resp
 }
 
+// Make the specified request without authenticating.
+func noAuthReq(handler http.Handler, spec requestSpec) *httptest.ResponseRecorder {
+	req := spec.toNoAuth()
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
 // Like adminReq, but (a) doesn't authenticate as admin, and (b) adds the query string
 // ?token=<token> to the url.
 func tokenReq(handler http.Handler, token string, spec requestSpec) *httptest.ResponseRecorder {
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/CCI-MOC/obmd/internal/driver"
+	"github.com/CCI-MOC/obmd/internal/logger"
+	"github.com/CCI-MOC/obmd/internal/obmd"
+	"github.com/CCI-MOC/obmd/internal/vbmc"
+)
+
+// A node, as the backend of a virtual BMC. Operations are made without a
+// token (the virtual BMC authenticates its own clients), but otherwise as
+// a user's, so they are refused while the node is in maintenance mode.
+// They are subject to the configured OperationTimeout.
+type vbmcNode struct {
+	live   *LiveConfig
+	daemon obmd.Daemon
+	label  string
+}
+
+func (n vbmcNode) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = userContext(ctx)
+	timeout := time.Duration(n.live.Get().OperationTimeout)
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (n vbmcNode) PowerStatus(ctx context.Context) (driver.PowerState, error) {
+	ctx, cancel := n.opContext(ctx)
+	defer cancel()
+	return n.daemon.NodePowerStatus(ctx, n.label, nil)
+}
+
+func (n vbmcNode) PowerOn(ctx context.Context) error {
+	ctx, cancel := n.opContext(ctx)
+	defer cancel()
+	return n.daemon.PowerOnNode(ctx, n.label, nil)
+}
+
+func (n vbmcNode) PowerOff(ctx context.Context) error {
+	ctx, cancel := n.opContext(ctx)
+	defer cancel()
+	return n.daemon.PowerOffNode(ctx, n.label, nil)
+}
+
+func (n vbmcNode) PowerCycle(ctx context.Context, force bool) error {
+	ctx, cancel := n.opContext(ctx)
+	defer cancel()
+	return n.daemon.PowerCycleNode(ctx, n.label, force, nil)
+}
+
+func (n vbmcNode) SetBootdev(ctx context.Context, dev string) error {
+	ctx, cancel := n.opContext(ctx)
+	defer cancel()
+	return n.daemon.SetNodeBootDev(ctx, n.label, dev, nil)
+}
+
+// A virtual BMC, bound to its address.
+type vbmcListener struct {
+	srv    *vbmc.Server
+	conn   net.PacketConn
+	closed int32 // set (atomically) to 1 by close.
+}
+
+// Create and bind the virtual BMCs in the config. Nodes need not exist yet;
+// operations on missing nodes fail until they are registered.
+func makeVirtualBMCs(live *LiveConfig, daemon obmd.Daemon) ([]*vbmcListener, error) {
+	var ret []*vbmcListener
+	for label, c := range live.Get().VirtualBMCs {
+		srv, err := vbmc.NewServer(vbmcNode{live: live, daemon: daemon, label: label},
+			label, c.User, c.Password, c.Privilege)
+		if err == nil {
+			var conn net.PacketConn
+			conn, err = net.ListenPacket("udp", c.ListenAddr)
+			ret = append(ret, &vbmcListener{srv: srv, conn: conn})
+		}
+		if err != nil {
+			for _, l := range ret {
+				if l.conn != nil {
+					l.conn.Close()
+				}
+			}
+			return nil, err
+		}
+		logger.Info("Serving virtual BMC", "node", label, "addr", c.ListenAddr)
+	}
+	return ret, nil
+}
+
+// Serve requests on the listener. This only returns on error, or after
+// close, when it returns nil.
+func (l *vbmcListener) serve() error {
+	err := l.srv.Serve(l.conn)
+	if atomic.LoadInt32(&l.closed) != 0 {
+		return nil
+	}
+	return err
+}
+
+// Stop serving requests, e.g. when shutting down.
+func (l *vbmcListener) close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	return l.conn.Close()
+}